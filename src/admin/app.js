@@ -0,0 +1,306 @@
+// Admin dashboard for the product store. Every call goes to the v1 API
+// with the admin token the operator signs in with; the token is kept in
+// sessionStorage, so it's gone when the tab closes. Data is only ever
+// rendered with textContent.
+"use strict";
+
+const tokenKey = "product-store-admin-token";
+const $ = (selector) => document.querySelector(selector);
+
+let current = null; // product shown in the detail view
+let currentETag = "";
+
+// api calls the v1 API and returns the parsed body and the response,
+// throwing with the API's error message on failure
+async function api(method, path, body, headers = {}) {
+  const init = {
+    method,
+    headers: { Authorization: "Bearer " + sessionStorage.getItem(tokenKey), ...headers },
+  };
+  if (body !== undefined) {
+    init.headers["Content-Type"] = "application/json";
+    init.body = JSON.stringify(body);
+  }
+  const res = await fetch("/v1" + path, init);
+  const data = res.status === 204 ? null : await res.json().catch(() => null);
+  if (res.status === 401) {
+    signOut();
+  }
+  if (!res.ok) {
+    let message = (data && data.error) || res.statusText;
+    if (data && Array.isArray(data.errors)) {
+      message += ": " + data.errors.map((v) => (v.field ? v.field + " " : "") + v.message).join(", ");
+    }
+    throw new Error(message);
+  }
+  return { data, res };
+}
+
+function show(message, isError = false) {
+  const el = $("#message");
+  el.textContent = message;
+  el.classList.toggle("error", isError);
+}
+
+function fail(err) {
+  show(err.message, true);
+}
+
+function cell(row, text) {
+  const td = document.createElement("td");
+  td.textContent = text === undefined || text === null ? "" : String(text);
+  row.appendChild(td);
+  return td;
+}
+
+function fill(tbody, items, columns, onClick) {
+  tbody.replaceChildren();
+  for (const item of items) {
+    const row = document.createElement("tr");
+    columns.forEach((column) => cell(row, column(item)));
+    if (onClick) {
+      row.classList.add("link");
+      row.addEventListener("click", () => onClick(item));
+    }
+    tbody.appendChild(row);
+  }
+}
+
+function view(name) {
+  for (const section of document.querySelectorAll("main > section")) {
+    section.hidden = section.id !== name;
+  }
+  for (const button of document.querySelectorAll("nav button")) {
+    button.classList.toggle("active", button.dataset.view === name);
+  }
+  show("");
+}
+
+function totalStock(p) {
+  if (!p.variants || p.variants.length === 0) {
+    return p.stock;
+  }
+  return p.variants.reduce((sum, v) => sum + v.stock, 0);
+}
+
+function status(p) {
+  if (p.deleted_at) {
+    return "deleted";
+  }
+  if (p.suspension) {
+    return "suspended";
+  }
+  return "live";
+}
+
+async function loadProducts() {
+  const params = new URLSearchParams();
+  if ($("#q").value) {
+    params.set("q", $("#q").value);
+  }
+  if ($("#category").value) {
+    params.set("category", $("#category").value);
+  }
+  if ($("#deleted").checked) {
+    params.set("include_deleted", "true");
+  }
+  try {
+    const { data } = await api("GET", "/products?" + params);
+    fill($("#product-rows"), data.products, [
+      (p) => p.id,
+      (p) => p.name,
+      (p) => p.category,
+      (p) => p.price + " " + p.currency,
+      totalStock,
+      status,
+      (p) => p.version,
+    ], (p) => openProduct(p.id));
+  } catch (err) {
+    fail(err);
+  }
+}
+
+async function loadLowStock() {
+  try {
+    const { data } = await api("GET", "/products/low-stock");
+    fill($("#low-stock-rows"), data.products, [
+      (p) => p.id,
+      (p) => p.name,
+      (p) => p.category,
+      (p) => p.stock,
+      (p) => p.threshold,
+    ], (p) => openProduct(p.id));
+  } catch (err) {
+    fail(err);
+  }
+}
+
+async function openProduct(id) {
+  try {
+    const { data, res } = await api("GET", "/products/" + encodeURIComponent(id));
+    current = data;
+    currentETag = res.headers.get("ETag") || "";
+    view("detail");
+    renderProduct();
+    await loadAudit();
+  } catch (err) {
+    fail(err);
+  }
+}
+
+function renderProduct() {
+  $("#detail-title").textContent = current.name + " (" + current.id + ", version " + current.version + ")";
+  const form = $("#edit");
+  for (const field of ["name", "description", "category", "price", "currency"]) {
+    form.elements[field].value = current[field] || "";
+  }
+
+  const stock = current.variants && current.variants.length > 0
+    ? current.variants.map((v) => ({ sku: v.sku, stock: v.stock }))
+    : [{ sku: current.sku || "", stock: current.stock }];
+  fill($("#stock-rows"), stock, [(s) => s.sku || "(product)", (s) => s.stock]);
+  const select = $("#adjust-sku");
+  select.replaceChildren();
+  for (const s of stock) {
+    const option = document.createElement("option");
+    option.value = current.variants && current.variants.length > 0 ? s.sku : "";
+    option.textContent = s.sku || "(product)";
+    select.appendChild(option);
+  }
+}
+
+async function loadAudit() {
+  try {
+    const { data } = await api("GET", "/products/" + encodeURIComponent(current.id) + "/audit");
+    const rows = $("#audit-rows");
+    fill(rows, data.entries, [
+      (e) => e.timestamp,
+      (e) => e.action,
+      (e) => e.actor,
+      () => "",
+    ]);
+    // Changes are shown as preformatted JSON in the last column
+    data.entries.forEach((e, i) => {
+      const pre = document.createElement("pre");
+      pre.textContent = e.changes ? JSON.stringify(e.changes, null, 2) : "";
+      rows.children[i].lastChild.appendChild(pre);
+    });
+  } catch (err) {
+    $("#audit-rows").replaceChildren();
+    fail(err);
+  }
+}
+
+async function saveProduct(event) {
+  event.preventDefault();
+  const form = event.target;
+  const patch = {};
+  for (const field of ["name", "description", "category", "price", "currency"]) {
+    if (form.elements[field].value !== (current[field] || "")) {
+      patch[field] = form.elements[field].value;
+    }
+  }
+  if (Object.keys(patch).length === 0) {
+    show("Nothing to save");
+    return;
+  }
+  try {
+    await api("PATCH", "/products/" + encodeURIComponent(current.id), patch, { "If-Match": currentETag });
+    await openProduct(current.id);
+    show("Saved");
+  } catch (err) {
+    fail(err);
+  }
+}
+
+async function adjustStock(event) {
+  event.preventDefault();
+  const form = event.target;
+  const adjustment = {
+    sku: form.elements.sku.value,
+    delta: Number(form.elements.delta.value),
+    reason: form.elements.reason.value,
+    note: form.elements.note.value,
+  };
+  try {
+    await api("POST", "/products/" + encodeURIComponent(current.id) + "/stock-adjustments", adjustment);
+    form.reset();
+    await openProduct(current.id);
+    show("Stock adjusted");
+  } catch (err) {
+    fail(err);
+  }
+}
+
+async function createProduct(event) {
+  event.preventDefault();
+  const form = event.target;
+  const product = {
+    id: form.elements.id.value,
+    name: form.elements.name.value,
+    description: form.elements.description.value,
+    category: form.elements.category.value,
+    price: form.elements.price.value,
+    stock: Number(form.elements.stock.value),
+  };
+  if (form.elements.currency.value) {
+    product.currency = form.elements.currency.value;
+  }
+  try {
+    const { data } = await api("POST", "/products", product);
+    form.reset();
+    await openProduct(data.product.id);
+    show("Created");
+  } catch (err) {
+    fail(err);
+  }
+}
+
+function signIn(event) {
+  event.preventDefault();
+  sessionStorage.setItem(tokenKey, $("#token").value);
+  $("#token").value = "";
+  start();
+}
+
+function signOut() {
+  sessionStorage.removeItem(tokenKey);
+  $("#app").hidden = true;
+  $("#logout").hidden = true;
+  $("#login").hidden = false;
+}
+
+function start() {
+  if (!sessionStorage.getItem(tokenKey)) {
+    signOut();
+    return;
+  }
+  $("#login").hidden = true;
+  $("#logout").hidden = false;
+  $("#app").hidden = false;
+  view("products");
+  loadProducts();
+}
+
+document.addEventListener("DOMContentLoaded", () => {
+  $("#login").addEventListener("submit", signIn);
+  $("#logout").addEventListener("click", signOut);
+  $("#search").addEventListener("submit", (event) => {
+    event.preventDefault();
+    loadProducts();
+  });
+  $("#create").addEventListener("submit", createProduct);
+  $("#edit").addEventListener("submit", saveProduct);
+  $("#adjust").addEventListener("submit", adjustStock);
+  for (const button of document.querySelectorAll("nav button")) {
+    button.addEventListener("click", () => {
+      view(button.dataset.view);
+      if (button.dataset.view === "products") {
+        loadProducts();
+      } else if (button.dataset.view === "low-stock") {
+        loadLowStock();
+      }
+    });
+  }
+  start();
+});
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// adminAssets is the admin dashboard, plain HTML, JS and CSS with no build
+// step. Edit the files under admin/ directly.
+//
+//go:embed admin
+var adminAssets embed.FS
+
+// adminUIFiles serves the dashboard's assets from the admin directory
+var adminUIFiles = func() http.FileSystem {
+	sub, err := fs.Sub(adminAssets, "admin")
+	if err != nil {
+		panic(err)
+	}
+	return http.FS(sub)
+}()
+
+// adminUIPolicy only lets the dashboard load its own scripts and styles,
+// and call the API it's served with
+const adminUIPolicy = "default-src 'self'; frame-ancestors 'none'; base-uri 'none'; form-action 'self'"
+
+// adminUI serves the dashboard only when admin access is on. The pages
+// hold no data: the operator signs in with ADMIN_TOKEN in the browser and
+// every call goes through requireAdmin like any other client's.
+// Returns: 404 Not Found - ADMIN_TOKEN isn't set
+func adminUI() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if adminToken == "" {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{
+				"error": "The admin dashboard needs ADMIN_TOKEN",
+			})
+			return
+		}
+		c.Header("Content-Security-Policy", adminUIPolicy)
+		c.Header("Cache-Control", "no-cache")
+		c.Next()
+	}
+}
+
+// getAdminDashboard serves the admin dashboard page
+// Returns: 200 OK - HTML page (Cat at the control panel!)
+// Returns: 404 Not Found - ADMIN_TOKEN isn't set
+func getAdminDashboard(c *gin.Context) {
+	page, err := adminAssets.ReadFile("admin/index.html")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.Data(http.StatusOK, "text/html; charset=utf-8", page)
+}
+
+// getAdminAsset serves a script or stylesheet of the admin dashboard
+// Returns: 200 OK - Asset
+// Returns: 404 Not Found - No such asset, or ADMIN_TOKEN isn't set
+func getAdminAsset(c *gin.Context) {
+	c.FileFromFS(c.Param("filepath"), adminUIFiles)
+}
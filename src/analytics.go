@@ -0,0 +1,278 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Analytics event types
+const (
+	eventView      = "view"
+	eventAddToCart = "add_to_cart"
+	eventSale      = "sale"
+)
+
+// metricBucket aggregates one minute of activity for a product
+type metricBucket struct {
+	views      int64
+	addsToCart int64
+	sales      int64
+	stock      int
+	hasStock   bool
+}
+
+// AnalyticsStore aggregates product events in memory, per minute, and
+// follows the age of each product's stock. Ages aren't bucketed, so
+// retention doesn't cut them short. Products are by key.
+type AnalyticsStore struct {
+	mu     sync.Mutex
+	series map[string]map[int64]*metricBucket
+	aging  map[string]*stockAging
+}
+
+// Global analytics store
+var analytics = &AnalyticsStore{
+	series: make(map[string]map[int64]*metricBucket),
+	aging:  make(map[string]*stockAging),
+}
+
+// bucket returns the bucket for a product and minute, creating it.
+// Callers must hold a.mu.
+func (a *AnalyticsStore) bucket(productID string, at time.Time) *metricBucket {
+	buckets, exists := a.series[productID]
+	if !exists {
+		buckets = make(map[int64]*metricBucket)
+		a.series[productID] = buckets
+	}
+	minute := at.Unix() / 60
+	b, exists := buckets[minute]
+	if !exists {
+		b = &metricBucket{}
+		buckets[minute] = b
+	}
+	return b
+}
+
+// record counts an event for a product
+func (a *AnalyticsStore) record(productID, event string, quantity int64, at time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	b := a.bucket(productID, at)
+	switch event {
+	case eventView:
+		b.views += quantity
+	case eventAddToCart:
+		b.addsToCart += quantity
+	case eventSale:
+		b.sales += quantity
+		if age := a.agingOf(productID); at.After(age.lastSale) {
+			age.lastSale = at
+		}
+	}
+}
+
+// recordStock samples the stock level of a product. created tells a new
+// product, whose stock all arrives now, from one first seen since startup,
+// whose stock is of unknown age.
+func (a *AnalyticsStore) recordStock(productID string, stock int, created bool, at time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	b := a.bucket(productID, at)
+	b.stock = stock
+	b.hasStock = true
+	a.agingOf(productID).restock(stock, created, at)
+}
+
+// purgeBefore drops buckets older than the cutoff and returns how many
+// were (or, on a dry run, would be) dropped. The latest stock sample of a
+// product is kept so stock series don't start empty.
+func (a *AnalyticsStore) purgeBefore(cutoff time.Time, dryRun bool) int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	limit := cutoff.Unix() / 60
+	purged := 0
+	for _, buckets := range a.series {
+		latestStock := int64(-1)
+		for minute, b := range buckets {
+			if b.hasStock && minute > latestStock {
+				latestStock = minute
+			}
+		}
+		for minute := range buckets {
+			if minute < limit && minute != latestStock {
+				purged++
+				if !dryRun {
+					delete(buckets, minute)
+				}
+			}
+		}
+	}
+	return purged
+}
+
+// MetricPoint is one interval of a product's time series
+type MetricPoint struct {
+	Start      time.Time `json:"start"`
+	Views      int64     `json:"views"`
+	AddsToCart int64     `json:"adds_to_cart"`
+	Sales      int64     `json:"sales"`
+	Stock      *int      `json:"stock"`
+}
+
+// timeSeries aggregates buckets in [from, to) into points of the given
+// granularity. Stock is the last known level at the end of each point.
+func (a *AnalyticsStore) timeSeries(productID string, from, to time.Time, granularity time.Duration) []MetricPoint {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	buckets := a.series[productID]
+	minutes := make([]int64, 0, len(buckets))
+	for minute := range buckets {
+		minutes = append(minutes, minute)
+	}
+	sort.Slice(minutes, func(i, j int) bool { return minutes[i] < minutes[j] })
+
+	points := make([]MetricPoint, 0, int(to.Sub(from)/granularity)+1)
+	for start := from; start.Before(to); start = start.Add(granularity) {
+		points = append(points, MetricPoint{Start: start})
+	}
+
+	var stock *int
+	next := 0
+	for i := range points {
+		end := points[i].Start.Add(granularity).Unix() / 60
+		for ; next < len(minutes) && minutes[next] < end; next++ {
+			b := buckets[minutes[next]]
+			if b.hasStock {
+				level := b.stock
+				stock = &level
+			}
+			if minutes[next] < points[i].Start.Unix()/60 {
+				continue
+			}
+			points[i].Views += b.views
+			points[i].AddsToCart += b.addsToCart
+			points[i].Sales += b.sales
+		}
+		points[i].Stock = stock
+	}
+	return points
+}
+
+// maxMetricPoints caps the size of a metrics response
+const maxMetricPoints = 1440
+
+// getProductMetrics returns a product's activity over a window, e.g.
+// ?window=24h&granularity=1h
+// Returns: 200 OK - Time series (Cat reading charts!)
+// Returns: 400 Bad Request - Invalid window or granularity
+// Returns: 404 Not Found - Product doesn't exist
+func getProductMetrics(c *gin.Context) {
+	id := c.Param("id")
+
+	window, err := time.ParseDuration(c.DefaultQuery("window", "24h"))
+	if err != nil || window <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid window", "window": c.Query("window")})
+		return
+	}
+	granularity, err := time.ParseDuration(c.DefaultQuery("granularity", "1h"))
+	if err != nil || granularity < time.Minute || granularity%time.Minute != 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":       "Granularity must be a whole number of minutes",
+			"granularity": c.Query("granularity"),
+		})
+		return
+	}
+	if window/granularity > maxMetricPoints {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Too many points, use a coarser granularity",
+			"max":   maxMetricPoints,
+		})
+		return
+	}
+
+	key := tenantKey(c, id)
+	store.mu.RLock()
+	_, exists := store.getShown(c, id)
+	store.mu.RUnlock()
+	if !exists {
+		productNotFound(c, id)
+		return
+	}
+
+	to := time.Now().UTC().Truncate(granularity).Add(granularity)
+	from := to.Add(-window).Truncate(granularity)
+	points := analytics.timeSeries(key, from, to, granularity)
+
+	c.JSON(http.StatusOK, gin.H{
+		"id":          id,
+		"window":      window.String(),
+		"granularity": granularity.String(),
+		"points":      points,
+	})
+}
+
+// AnalyticsEvent is a storefront event reported to the API
+type AnalyticsEvent struct {
+	ProductID string     `json:"product_id" binding:"required"`
+	Type      string     `json:"type" binding:"required,oneof=view add_to_cart sale"`
+	Quantity  int64      `json:"quantity" binding:"min=0"`
+	Timestamp *time.Time `json:"timestamp"`
+	OrderID   string     `json:"order_id" binding:"max=64"` // pairs the sales of one order
+}
+
+// ingestAnalyticsEvents accepts a batch of storefront events about the
+// tenant's products. Events for unknown products are skipped. Sales with
+// an order ID also count the products bought together.
+// Returns: 202 Accepted - Events recorded
+// Returns: 400 Bad Request - Invalid events
+func ingestAnalyticsEvents(c *gin.Context) {
+	var body struct {
+		Events []AnalyticsEvent `json:"events" binding:"required,min=1,max=1000,dive"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":   "Invalid analytics events",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	now := time.Now()
+	accepted := 0
+	for _, e := range body.Events {
+		key := tenantKey(c, e.ProductID)
+		store.mu.RLock()
+		_, exists := store.products[key]
+		store.mu.RUnlock()
+		if !exists {
+			continue
+		}
+
+		at := now
+		if e.Timestamp != nil && e.Timestamp.Before(now) {
+			at = *e.Timestamp
+		}
+		quantity := e.Quantity
+		if quantity == 0 {
+			quantity = 1
+		}
+		analytics.record(key, e.Type, quantity, at)
+		if e.Type == eventSale && e.OrderID != "" {
+			coPurchases.recordSale(tenantKey(c, e.OrderID), key)
+		}
+		accepted++
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"accepted": accepted,
+		"skipped":  len(body.Events) - accepted,
+	})
+}
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Async job settings
+var (
+	// asyncMaxJobs caps the jobs kept at once, running or done,
+	// ASYNC_MAX_JOBS
+	asyncMaxJobs = envInt("ASYNC_MAX_JOBS", 100)
+	// asyncWorkers is how many jobs run at once, ASYNC_WORKERS
+	asyncWorkers = envInt("ASYNC_WORKERS", 4)
+	// asyncJobTimeout bounds a job, ASYNC_JOB_TIMEOUT
+	asyncJobTimeout = envDuration("ASYNC_JOB_TIMEOUT", 30*time.Minute)
+	// asyncResultTTL is how long a finished job and its result are kept,
+	// ASYNC_RESULT_TTL
+	asyncResultTTL = envDuration("ASYNC_RESULT_TTL", time.Hour)
+	// asyncMaxResultBytes caps a stored result, ASYNC_MAX_RESULT_BYTES
+	asyncMaxResultBytes = envInt("ASYNC_MAX_RESULT_BYTES", 64<<20)
+	// asyncCallbackSecret signs callbacks like webhook deliveries,
+	// ASYNC_CALLBACK_SECRET
+	asyncCallbackSecret = os.Getenv("ASYNC_CALLBACK_SECRET")
+)
+
+// asyncRoutes are the GET routes that can answer asynchronously, without
+// their version prefix: the ones that can take minutes on a big catalog
+var asyncRoutes = map[string]bool{
+	"/products":                      true,
+	"/admin/export":                  true,
+	"/admin/reports/dead-stock":      true,
+	"/admin/reports/valuation":       true,
+	"/admin/reports/margins":         true,
+	"/admin/reports/inventory-value": true,
+	"/admin/reports/top-products":    true,
+	"/admin/reports/stock-movements": true,
+}
+
+// callbackHeader names the URL a finished job is POSTed to
+const callbackHeader = "X-Callback-URL"
+
+// Async job statuses
+const (
+	asyncPending   = "pending"
+	asyncRunning   = "running"
+	asyncSucceeded = "succeeded" // the request ran and answered 2xx
+	asyncFailed    = "failed"    // it answered an error, timed out or was canceled
+)
+
+// asyncJobKey marks a request run by a job, so it isn't deferred again
+type asyncJobKey struct{}
+
+// AsyncJob is a request run in the background after the client was
+// answered 202 Accepted. Its response is kept until ExpiresAt, for the
+// client to fetch from ResultURL, and POSTed to CallbackURL when set.
+type AsyncJob struct {
+	ID            string     `json:"id"`
+	Status        string     `json:"status"`
+	Method        string     `json:"method"`
+	Path          string     `json:"path"` // with the query
+	CreatedAt     time.Time  `json:"created_at"`
+	StartedAt     *time.Time `json:"started_at,omitempty"`
+	FinishedAt    *time.Time `json:"finished_at,omitempty"`
+	ExpiresAt     *time.Time `json:"expires_at,omitempty"`
+	StatusCode    int        `json:"status_code,omitempty"`
+	Error         string     `json:"error,omitempty"`
+	ResultURL     string     `json:"result_url"`
+	CallbackURL   string     `json:"callback_url,omitempty"`
+	CallbackError string     `json:"callback_error,omitempty"`
+
+	admin  bool   // started with the admin token, so only admins can see it
+	tenant string // the tenant it was started in, the only one that sees it
+	cancel context.CancelFunc
+	header http.Header
+	body   []byte
+}
+
+// AsyncJobStore keeps the async jobs of this instance, in memory
+type AsyncJobStore struct {
+	mu    sync.Mutex
+	jobs  map[string]*AsyncJob
+	slots chan struct{}
+}
+
+// Global async jobs
+var asyncJobs = &AsyncJobStore{
+	jobs:  make(map[string]*AsyncJob),
+	slots: make(chan struct{}, max(asyncWorkers, 1)),
+}
+
+// respondAsync answers GET requests to asyncRoutes with
+// "Prefer: respond-async" (RFC 7240) with 202 Accepted, then runs them
+// through router in the background. Other requests go on as usual.
+// Returns: 202 Accepted - Job started, Location is its status
+// Returns: 400 Bad Request - Invalid callback URL, or a callback without the admin token
+// Returns: 429 Too Many Requests - Too many jobs, try again later
+func respondAsync(router *gin.Engine) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		route := versionedPath.ReplaceAllString(c.FullPath(), "/")
+		if c.Request.Method != http.MethodGet || !asyncRoutes[route] || !prefersAsync(c.Request) || c.Request.Context().Value(asyncJobKey{}) != nil || !flagEnabled(c, flagAsyncRequests) {
+			c.Next()
+			return
+		}
+		if strings.HasPrefix(route, "/admin/") && !isAdmin(c) {
+			// Let requireAdmin turn it down now rather than the job later
+			c.Next()
+			return
+		}
+
+		callback := c.GetHeader(callbackHeader)
+		if callback != "" {
+			// Callbacks reach out to any host, so only admins set them
+			u, err := url.Parse(callback)
+			if !isAdmin(c) || err != nil || u.Scheme != "https" && u.Scheme != "http" || u.Host == "" {
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+					"error": callbackHeader + " must be an http or https URL, and needs the admin token",
+				})
+				return
+			}
+		}
+
+		version := strings.Trim(strings.TrimSuffix(c.FullPath(), route), "/")
+		job, err := asyncJobs.start(router, c, version, callback)
+		if err != nil {
+			c.Header("Retry-After", "60")
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": err.Error()})
+			return
+		}
+		c.Header("Location", "/"+version+"/async-jobs/"+job.ID)
+		c.Header("Preference-Applied", "respond-async")
+		if version != "v1" {
+			// Answered before the version's routes, and their envelope
+			env := newEnvelope(c, version, http.StatusAccepted)
+			env.Data = job
+			env.Links["job"], env.Links["result"] = "/"+version+"/async-jobs/"+job.ID, job.ResultURL
+			c.AbortWithStatusJSON(http.StatusAccepted, env)
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusAccepted, gin.H{
+			"message": "Request accepted, poll the job for its result",
+			"job":     job,
+		})
+	}
+}
+
+// prefersAsync reports whether a request asks for an async response
+func prefersAsync(r *http.Request) bool {
+	for _, header := range r.Header.Values("Prefer") {
+		for _, pref := range strings.Split(header, ",") {
+			if strings.EqualFold(strings.TrimSpace(pref), "respond-async") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// start records a job for the request and runs it once a worker is free
+func (s *AsyncJobStore) start(router *gin.Engine, c *gin.Context, version, callback string) (AsyncJob, error) {
+	id := make([]byte, 16)
+	rand.Read(id)
+
+	s.mu.Lock()
+	s.expire(time.Now())
+	if len(s.jobs) >= asyncMaxJobs {
+		s.mu.Unlock()
+		return AsyncJob{}, fmt.Errorf("too many async jobs, at most %d are kept", asyncMaxJobs)
+	}
+	ctx, cancel := context.WithTimeout(context.WithValue(context.WithoutCancel(c.Request.Context()), asyncJobKey{}, true), asyncJobTimeout)
+	job := &AsyncJob{
+		ID:          hex.EncodeToString(id),
+		Status:      asyncPending,
+		Method:      c.Request.Method,
+		Path:        c.Request.URL.RequestURI(),
+		CreatedAt:   time.Now().UTC(),
+		CallbackURL: callback,
+		admin:       isAdmin(c),
+		tenant:      tenantOf(c),
+		cancel:      cancel,
+	}
+	job.ResultURL = "/" + version + "/async-jobs/" + job.ID + "/result"
+	s.jobs[job.ID] = job
+	view := *job
+	s.mu.Unlock()
+
+	req := c.Request.Clone(ctx)
+	req.Header.Del("Prefer")
+	req.Header.Del("Accept-Encoding") // kept plain, compressed when fetched
+	req.Header.Set("X-Request-ID", c.GetString(requestIDKey))
+	go s.run(router, job, req)
+	return view, nil
+}
+
+// run serves a job's request into memory and keeps the response
+func (s *AsyncJobStore) run(router *gin.Engine, job *AsyncJob, req *http.Request) {
+	defer job.cancel()
+
+	select {
+	case s.slots <- struct{}{}:
+		defer func() { <-s.slots }()
+	case <-req.Context().Done():
+		s.finish(job, nil, req.Context().Err())
+		return
+	}
+	s.mu.Lock()
+	now := time.Now().UTC()
+	job.Status, job.StartedAt = asyncRunning, &now
+	s.mu.Unlock()
+
+	rec := &asyncRecorder{header: make(http.Header), status: http.StatusOK}
+	router.ServeHTTP(rec, req)
+	var err error
+	switch {
+	case rec.truncated:
+		err = fmt.Errorf("result is over %d bytes", asyncMaxResultBytes)
+	case req.Context().Err() != nil:
+		err = req.Context().Err()
+	}
+	s.finish(job, rec, err)
+}
+
+// finish stores a job's outcome and sends its callback
+func (s *AsyncJobStore) finish(job *AsyncJob, rec *asyncRecorder, err error) {
+	s.mu.Lock()
+	now := time.Now().UTC()
+	expires := now.Add(asyncResultTTL)
+	job.FinishedAt, job.ExpiresAt = &now, &expires
+	switch {
+	case err != nil:
+		job.Status, job.Error = asyncFailed, err.Error()
+	case rec.status/100 != 2:
+		job.Status, job.StatusCode = asyncFailed, rec.status
+		job.header, job.body = rec.header, rec.body.Bytes()
+	default:
+		job.Status, job.StatusCode = asyncSucceeded, rec.status
+		job.header, job.body = rec.header, rec.body.Bytes()
+	}
+	view := *job
+	s.mu.Unlock()
+
+	if view.CallbackURL != "" {
+		if err := sendCallback(view); err != nil {
+			log.Printf("async job %s: callback: %v", view.ID, err)
+			s.mu.Lock()
+			job.CallbackError = err.Error()
+			s.mu.Unlock()
+		}
+	}
+}
+
+// sendCallback POSTs a finished job to its callback URL, signed with
+// ASYNC_CALLBACK_SECRET when it's set
+func sendCallback(job AsyncJob) error {
+	body, _ := json.Marshal(job)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, job.CallbackURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Idempotency-Key", job.ID)
+	if asyncCallbackSecret != "" {
+		req.Header.Set("X-Callback-Signature", webhookSignature(asyncCallbackSecret, time.Now(), body))
+	}
+	return sendChecked(webhooks.http, req, "callback")
+}
+
+// expire drops finished jobs past their TTL. Callers must hold s.mu.
+func (s *AsyncJobStore) expire(now time.Time) {
+	for id, job := range s.jobs {
+		if job.ExpiresAt != nil && now.After(*job.ExpiresAt) {
+			delete(s.jobs, id)
+		}
+	}
+}
+
+// purgeBefore drops the jobs that finished before the cutoff, for the
+// async_jobs retention policy. Reads drop expired jobs too; this frees the
+// results no one comes back for.
+func (s *AsyncJobStore) purgeBefore(cutoff time.Time, dryRun bool) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	purged := 0
+	for id, job := range s.jobs {
+		if job.FinishedAt != nil && job.FinishedAt.Before(cutoff) {
+			purged++
+			if !dryRun {
+				delete(s.jobs, id)
+			}
+		}
+	}
+	return purged
+}
+
+// lookup returns a job the request may see. Jobs are found by their
+// random ID in the tenant that started them; ones started as admin also
+// need an admin token.
+func (s *AsyncJobStore) lookup(c *gin.Context) (*AsyncJob, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expire(time.Now())
+	job, exists := s.jobs[c.Param("id")]
+	if !exists || job.tenant != tenantOf(c) || job.admin && !isAdmin(c) {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "Async job not found",
+			"id":    c.Param("id"),
+		})
+		return nil, false
+	}
+	return job, true
+}
+
+// getAsyncJob returns the status of an async job
+// Returns: 200 OK - The job (Cat checking the oven!)
+// Returns: 404 Not Found - No such job, or it expired
+func getAsyncJob(c *gin.Context) {
+	job, ok := asyncJobs.lookup(c)
+	if !ok {
+		return
+	}
+	asyncJobs.mu.Lock()
+	view := *job
+	asyncJobs.mu.Unlock()
+	if view.Status == asyncPending || view.Status == asyncRunning {
+		c.Header("Retry-After", "5")
+	}
+	c.JSON(http.StatusOK, view)
+}
+
+// getAsyncJobResult replays the response of a finished job, status code
+// and headers included
+// Returns: 200 OK - The response, as the request would have had it
+// Returns: 404 Not Found - No such job, or it expired
+// Returns: 409 Conflict - The job hasn't finished, or failed without a response
+func getAsyncJobResult(c *gin.Context) {
+	job, ok := asyncJobs.lookup(c)
+	if !ok {
+		return
+	}
+	asyncJobs.mu.Lock()
+	view, header, body := *job, job.header, job.body
+	asyncJobs.mu.Unlock()
+	if header == nil {
+		if view.Status == asyncPending || view.Status == asyncRunning {
+			c.Header("Retry-After", "5")
+		}
+		c.JSON(http.StatusConflict, gin.H{
+			"error":  "Async job has no result",
+			"id":     view.ID,
+			"status": view.Status,
+			"reason": view.Error,
+		})
+		return
+	}
+	for _, name := range []string{"Content-Type", "Content-Disposition", "ETag", "Last-Modified", "Vary", "X-Export-As-Of", "X-Export-Sequence", "X-Export-Count"} {
+		if value := header.Get(name); value != "" {
+			c.Header(name, value)
+		}
+	}
+	c.Header("Cache-Control", "private, no-store")
+	c.Set(envelopedKey, false) // enveloped already, if its version does
+	c.Data(view.StatusCode, header.Get("Content-Type"), body)
+}
+
+// deleteAsyncJob cancels a job that's still running and drops it
+// Returns: 204 No Content - Canceled or dropped
+// Returns: 404 Not Found - No such job, or it expired
+func deleteAsyncJob(c *gin.Context) {
+	job, ok := asyncJobs.lookup(c)
+	if !ok {
+		return
+	}
+	job.cancel()
+	asyncJobs.mu.Lock()
+	delete(asyncJobs.jobs, job.ID)
+	asyncJobs.mu.Unlock()
+	c.Status(http.StatusNoContent)
+}
+
+// asyncRecorder is the response writer of a job, kept in memory up to
+// asyncMaxResultBytes
+type asyncRecorder struct {
+	header    http.Header
+	status    int
+	body      bytes.Buffer
+	truncated bool
+}
+
+func (r *asyncRecorder) Header() http.Header { return r.header }
+
+func (r *asyncRecorder) WriteHeader(status int) { r.status = status }
+
+func (r *asyncRecorder) Write(p []byte) (int, error) {
+	if r.body.Len()+len(p) > asyncMaxResultBytes {
+		r.truncated = true
+		return 0, fmt.Errorf("async result over %d bytes", asyncMaxResultBytes)
+	}
+	return r.body.Write(p)
+}
+
+// Flush lets streaming handlers run; everything is kept until the end
+func (r *asyncRecorder) Flush() {}
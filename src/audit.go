@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// AuditEntry records one write operation on a product
+type AuditEntry struct {
+	ID        int64                  `json:"id"`
+	Tenant    string                 `json:"tenant,omitempty"`
+	ProductID string                 `json:"product_id"`
+	Action    string                 `json:"action"`
+	Actor     string                 `json:"actor"`
+	RequestID string                 `json:"request_id,omitempty"`
+	Timestamp time.Time              `json:"timestamp"`
+	Changes   map[string]FieldChange `json:"changes,omitempty"`
+}
+
+// FieldChange holds the value of a field before and after a write
+type FieldChange struct {
+	Before any `json:"before"`
+	After  any `json:"after"`
+}
+
+// AuditLog keeps the audit trail by product key. Every entry is also written
+// as a JSON line to stdout, which ECS ships to CloudWatch Logs.
+type AuditLog struct {
+	mu      sync.RWMutex
+	seq     int64
+	entries map[string][]AuditEntry
+	out     *log.Logger
+}
+
+// Global audit log
+var audit = &AuditLog{
+	entries: make(map[string][]AuditEntry),
+	out:     log.New(os.Stdout, "", 0),
+}
+
+// record appends an audit entry for a write made by the request.
+// before is nil for creates, after is nil for hard deletes.
+func (a *AuditLog) record(c *gin.Context, action string, before, after *Product) {
+	entry := AuditEntry{
+		Action:    action,
+		Actor:     "system",
+		Timestamp: time.Now().UTC(),
+		Changes:   diffProducts(before, after),
+	}
+	if c != nil {
+		entry.Actor = actor(c)
+		entry.RequestID = c.GetString(requestIDKey)
+	}
+	if after != nil {
+		entry.Tenant, entry.ProductID = after.Tenant, after.ID
+	} else if before != nil {
+		entry.Tenant, entry.ProductID = before.Tenant, before.ID
+	}
+	key := productKey(entry.Tenant, entry.ProductID)
+
+	a.mu.Lock()
+	a.seq++
+	entry.ID = a.seq
+	a.entries[key] = append(a.entries[key], entry)
+	a.mu.Unlock()
+
+	if line, err := json.Marshal(gin.H{"audit": entry}); err == nil {
+		a.out.Println(string(line))
+	}
+}
+
+// forProduct returns the audit trail of a product key, oldest first
+func (a *AuditLog) forProduct(key string) []AuditEntry {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	return append([]AuditEntry(nil), a.entries[key]...)
+}
+
+// diffProducts returns the fields that differ between two product states,
+// keyed by their JSON name
+func diffProducts(before, after *Product) map[string]FieldChange {
+	b, a := productFields(before), productFields(after)
+	changes := make(map[string]FieldChange)
+	for field, value := range a {
+		if !reflect.DeepEqual(b[field], value) {
+			changes[field] = FieldChange{Before: b[field], After: value}
+		}
+	}
+	for field, value := range b {
+		if _, exists := a[field]; !exists {
+			changes[field] = FieldChange{Before: value, After: nil}
+		}
+	}
+	return changes
+}
+
+// productFields flattens a product into its JSON fields
+func productFields(p *Product) map[string]any {
+	fields := make(map[string]any)
+	if p == nil {
+		return fields
+	}
+	data, _ := json.Marshal(p)
+	json.Unmarshal(data, &fields)
+	return fields
+}
+
+// getProductAudit returns the audit trail of a product, including
+// deleted and purged products
+// Returns: 200 OK - Success (Cat with reading glasses!)
+// Returns: 401 Unauthorized - Admin access required
+func getProductAudit(c *gin.Context) {
+	id := c.Param("id")
+	entries := audit.forProduct(tenantKey(c, id))
+
+	c.JSON(http.StatusOK, gin.H{
+		"id":      id,
+		"count":   len(entries),
+		"entries": entries,
+	})
+}
+
+// purgeBefore drops audit entries older than the cutoff and returns how
+// many were (or, on a dry run, would be) dropped. When S3 export is on,
+// entries that haven't been sealed yet are kept.
+func (a *AuditLog) purgeBefore(cutoff time.Time, dryRun bool) int {
+	exported := int64(-1)
+	if segmentExporter != nil {
+		exported = segmentExporter.cursor("audit")
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	purged := 0
+	for key, entries := range a.entries {
+		kept := entries[:0:0]
+		for _, e := range entries {
+			if e.Timestamp.Before(cutoff) && (exported < 0 || e.ID <= exported) {
+				purged++
+				continue
+			}
+			kept = append(kept, e)
+		}
+		if dryRun {
+			continue
+		}
+		if len(kept) == 0 {
+			delete(a.entries, key)
+		} else {
+			a.entries[key] = kept
+		}
+	}
+	return purged
+}
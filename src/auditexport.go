@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// segmentSource produces the records of one kind (audit log, stock
+// ledger, ...) that haven't been exported yet
+type segmentSource struct {
+	kind   string
+	cursor int64 // ID of the last exported record
+	since  func(after int64) (lines [][]byte, lastID int64)
+}
+
+// SealedSegment describes an exported, write-once segment in S3
+type SealedSegment struct {
+	Name        string    `json:"name"`
+	Kind        string    `json:"kind"`
+	FirstID     int64     `json:"first_id"`
+	LastID      int64     `json:"last_id"`
+	Count       int       `json:"count"`
+	SHA256      string    `json:"sha256"`
+	SealedAt    time.Time `json:"sealed_at"`
+	RetainUntil time.Time `json:"retain_until"`
+}
+
+// SegmentExporter periodically writes new records as JSON lines segments
+// to an S3 bucket with Object Lock, so they can't be altered or deleted
+// before their retention date
+type SegmentExporter struct {
+	mu        sync.Mutex
+	s3        *S3Client
+	lockMode  string
+	retention time.Duration
+	sources   []*segmentSource
+	sealed    []SealedSegment
+}
+
+const segmentPrefix = "segments/"
+
+// segmentNamePattern only allows names produced by the exporter
+var segmentNamePattern = regexp.MustCompile(`^[a-z]+-\d{8}T\d{6}Z-\d+-\d+\.jsonl$`)
+
+// Global exporter, nil unless AUDIT_EXPORT_BUCKET is set
+var segmentExporter = newSegmentExporter()
+
+func newSegmentExporter() *SegmentExporter {
+	bucket := os.Getenv("AUDIT_EXPORT_BUCKET")
+	if bucket == "" {
+		return nil
+	}
+	mode := os.Getenv("AUDIT_LOCK_MODE")
+	if mode == "" {
+		mode = "COMPLIANCE"
+	}
+	return &SegmentExporter{
+		s3:       newS3Client(bucket),
+		lockMode: mode,
+		// How long S3 keeps sealed segments locked, about 7 years by
+		// default; AUDIT_LOG_RETENTION_DAYS is the in-memory trail's
+		retention: time.Duration(envInt("AUDIT_RETENTION_DAYS", 2555)) * 24 * time.Hour,
+		sources: []*segmentSource{
+			{kind: "audit", since: audit.exportSince},
+		},
+	}
+}
+
+// exportSince returns audit entries newer than the given ID as JSON lines
+func (a *AuditLog) exportSince(after int64) ([][]byte, int64) {
+	a.mu.RLock()
+	var entries []AuditEntry
+	for _, productEntries := range a.entries {
+		for _, e := range productEntries {
+			if e.ID > after {
+				entries = append(entries, e)
+			}
+		}
+	}
+	a.mu.RUnlock()
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].ID < entries[j].ID })
+
+	lines := make([][]byte, 0, len(entries))
+	last := after
+	for _, e := range entries {
+		line, _ := json.Marshal(e)
+		lines = append(lines, line)
+		last = e.ID
+	}
+	return lines, last
+}
+
+// run exports new segments on every tick
+func (e *SegmentExporter) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		if err := e.export(ctx); err != nil {
+			log.Printf("segment export failed: %v", err)
+		}
+		cancel()
+	}
+}
+
+// export seals one segment per source with new records. Cursors only
+// advance after a successful upload so failed segments are retried.
+func (e *SegmentExporter) export(ctx context.Context) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for _, src := range e.sources {
+		lines, last := src.since(src.cursor)
+		if len(lines) == 0 {
+			continue
+		}
+
+		body := append(bytes.Join(lines, []byte("\n")), '\n')
+		sum := sha256.Sum256(body)
+		md5sum := md5.Sum(body)
+		now := time.Now().UTC()
+
+		segment := SealedSegment{
+			Name:        fmt.Sprintf("%s-%s-%d-%d.jsonl", src.kind, now.Format("20060102T150405Z"), src.cursor+1, last),
+			Kind:        src.kind,
+			FirstID:     src.cursor + 1,
+			LastID:      last,
+			Count:       len(lines),
+			SHA256:      hex.EncodeToString(sum[:]),
+			SealedAt:    now,
+			RetainUntil: now.Add(e.retention),
+		}
+
+		header := http.Header{}
+		header.Set("Content-Type", "application/x-ndjson")
+		header.Set("Content-MD5", base64.StdEncoding.EncodeToString(md5sum[:]))
+		header.Set("X-Amz-Checksum-Sha256", base64.StdEncoding.EncodeToString(sum[:]))
+		header.Set("X-Amz-Object-Lock-Mode", e.lockMode)
+		header.Set("X-Amz-Object-Lock-Retain-Until-Date", segment.RetainUntil.Format(time.RFC3339))
+		header.Set("X-Amz-Meta-Sha256", segment.SHA256)
+		header.Set("X-Amz-Meta-Count", strconv.Itoa(segment.Count))
+
+		if err := e.s3.putObject(ctx, segmentPrefix+segment.Name, body, header); err != nil {
+			return fmt.Errorf("%s segment: %w", src.kind, err)
+		}
+		src.cursor = last
+		e.sealed = append(e.sealed, segment)
+		log.Printf("sealed %s segment %s (%d records)", src.kind, segment.Name, segment.Count)
+	}
+	return nil
+}
+
+// getSealedSegments lists the segments sealed by this instance
+// Returns: 200 OK - Success
+// Returns: 404 Not Found - Export is not configured
+func getSealedSegments(c *gin.Context) {
+	if segmentExporter == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Audit export is not configured"})
+		return
+	}
+
+	segmentExporter.mu.Lock()
+	segments := append([]SealedSegment(nil), segmentExporter.sealed...)
+	segmentExporter.mu.Unlock()
+
+	c.JSON(http.StatusOK, gin.H{
+		"count":    len(segments),
+		"segments": segments,
+	})
+}
+
+// getSealedSegment downloads a sealed segment from S3 and verifies its
+// checksum before returning it
+// Returns: 200 OK - Segment content as JSON lines
+// Returns: 400 Bad Request - Invalid segment name
+// Returns: 404 Not Found - Export is not configured
+// Returns: 502 Bad Gateway - S3 failed or the checksum doesn't match
+// Returns: 503 Service Unavailable - S3 is down, with Retry-After
+// Returns: 504 Gateway Timeout - Took longer than REQUEST_TIMEOUT
+func getSealedSegment(c *gin.Context) {
+	if segmentExporter == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Audit export is not configured"})
+		return
+	}
+
+	name := c.Param("name")
+	if !segmentNamePattern.MatchString(name) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid segment name",
+			"name":  name,
+		})
+		return
+	}
+
+	header := http.Header{}
+	header.Set("X-Amz-Checksum-Mode", "ENABLED")
+	body, respHeader, err := segmentExporter.s3.getObject(c.Request.Context(), segmentPrefix+name, header)
+	if dependencyUnavailable(c, err) || err != nil && requestCanceled(c) {
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{
+			"error":   "Failed to fetch segment",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	sum := sha256Hex(body)
+	if expected := respHeader.Get("X-Amz-Meta-Sha256"); expected != sum {
+		c.JSON(http.StatusBadGateway, gin.H{
+			"error":    "Segment checksum mismatch",
+			"name":     name,
+			"expected": expected,
+			"actual":   sum,
+		})
+		return
+	}
+
+	c.Header("X-Segment-Sha256", sum)
+	if until := respHeader.Get("X-Amz-Object-Lock-Retain-Until-Date"); until != "" {
+		c.Header("X-Retain-Until", until)
+	}
+	c.Data(http.StatusOK, "application/x-ndjson", body)
+}
+
+// cursor returns the ID of the last exported record of a kind
+func (e *SegmentExporter) cursor(kind string) int64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for _, src := range e.sources {
+		if src.kind == kind {
+			return src.cursor
+		}
+	}
+	return 0
+}
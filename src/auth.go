@@ -0,0 +1,95 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// adminToken is the bearer token that grants admin access.
+// Admin-only features are disabled when ADMIN_TOKEN is not set.
+var adminToken = os.Getenv("ADMIN_TOKEN")
+
+// bearerToken returns the request's bearer token
+func bearerToken(header http.Header) (string, bool) {
+	token, found := strings.CutPrefix(header.Get("Authorization"), "Bearer ")
+	return token, found && token != ""
+}
+
+// isOperator reports whether the request carries the admin bearer token,
+// which administers the whole deployment, every tenant included
+func isOperator(c *gin.Context) bool {
+	return operatorHeader(c.Request.Header)
+}
+
+// operatorHeader is isOperator for headers outside a gin request, such as
+// gRPC metadata
+func operatorHeader(header http.Header) bool {
+	if adminToken == "" {
+		return false
+	}
+	token, found := bearerToken(header)
+	return found && subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) == 1
+}
+
+// isAdmin reports whether the request carries the admin bearer token, or
+// its tenant's token, which administers that tenant's catalog
+func isAdmin(c *gin.Context) bool {
+	return adminHeader(c.Request.Header, tenantOf(c))
+}
+
+// adminHeader is isAdmin for headers outside a gin request, of a tenant
+func adminHeader(header http.Header, tenant string) bool {
+	if operatorHeader(header) {
+		return true
+	}
+	owner, ok := tokenTenant(header)
+	return ok && owner == tenant
+}
+
+// requireAdmin rejects requests without the admin bearer token or their
+// tenant's token
+// Returns: 401 Unauthorized - Missing or wrong token
+func requireAdmin() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !isAdmin(c) {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+				"error": "Admin access required",
+			})
+			return
+		}
+		c.Next()
+	}
+}
+
+// requireOperator rejects requests without the admin bearer token, for
+// routes that reach past one tenant's catalog
+// Returns: 401 Unauthorized - Missing or wrong token
+func requireOperator() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !isOperator(c) {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+				"error": "Admin access required",
+			})
+			return
+		}
+		c.Next()
+	}
+}
+
+// actor identifies who made a request for audit purposes
+func actor(c *gin.Context) string {
+	if isOperator(c) {
+		return "admin"
+	}
+	if isAdmin(c) {
+		return "admin:" + tenantOf(c)
+	}
+	if user := c.GetHeader("X-Actor"); user != "" {
+		return user
+	}
+	return "anonymous"
+}
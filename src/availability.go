@@ -0,0 +1,167 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// restockHistory is how many of a SKU's latest restocks its next one is
+// estimated from
+const restockHistory = 5
+
+// AvailabilityRequest is a checkout's lines to check
+type AvailabilityRequest struct {
+	Lines []AvailabilityLine `json:"lines" binding:"required,min=1,dive"`
+}
+
+// AvailabilityLine is a SKU and the quantity wanted
+type AvailabilityLine struct {
+	SKU      string `json:"sku" binding:"required"`
+	Quantity int    `json:"quantity" binding:"required,min=1"`
+}
+
+// Availability statuses of a line
+const (
+	availabilityAvailable = "available" // the whole quantity can be reserved
+	availabilityPartial   = "partial"   // some of it can
+	availabilityOut       = "out_of_stock"
+	availabilityUnknown   = "unknown" // no product shown to the caller has the SKU
+)
+
+// LineAvailability is the answer for one line. Lines for the same SKU
+// share its stock, in the order they're given, as they would at checkout.
+type LineAvailability struct {
+	SKU                string     `json:"sku"`
+	Quantity           int        `json:"quantity"`
+	ProductID          string     `json:"product_id,omitempty"`
+	Status             string     `json:"status"`
+	Available          int        `json:"available"`  // stock left for this line after the lines before it
+	Reservable         int        `json:"reservable"` // of the quantity
+	EstimatedRestockAt *time.Time `json:"estimated_restock_at,omitempty"`
+}
+
+// skuStock is where a SKU's stock was found and how much of it the lines
+// so far have left
+type skuStock struct {
+	productID string
+	key       string
+	variant   bool
+	left      int
+}
+
+// checkAvailability answers whether each line of a checkout can be
+// reserved. Every line is read under one store lock, and only the lines
+// that are short look at the stock ledger, for the restock estimate.
+// Nothing is reserved: the answer is what a reservation made now would
+// get. With sharding, only the SKUs of this shard are known.
+// Returns: 200 OK - Availability of each line (Cat checking the pantry!)
+// Returns: 400 Bad Request - Invalid request or too many lines
+func checkAvailability(c *gin.Context) {
+	var req AvailabilityRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":   "Invalid availability request",
+			"details": err.Error(),
+		})
+		return
+	}
+	if len(req.Lines) > maxBatchItems {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Too many lines in one request",
+			"max":   maxBatchItems,
+		})
+		return
+	}
+
+	lines := make([]LineAvailability, len(req.Lines))
+	stock := make([]*skuStock, len(req.Lines))
+	bySKU := make(map[string]*skuStock, len(req.Lines))
+	store.mu.RLock()
+	for i, line := range req.Lines {
+		sku := strings.TrimSpace(line.SKU)
+		lines[i] = LineAvailability{SKU: sku, Quantity: line.Quantity, Status: availabilityUnknown}
+
+		s, seen := bySKU[sku]
+		if !seen {
+			if product, exists := store.get(codes.skus[tenantCode{tenantOf(c), sku}]); exists && shownTo(c, product) {
+				s = &skuStock{productID: product.ID, key: product.key(), left: product.Stock}
+				if v := product.variantIndex(sku); v >= 0 {
+					s.variant, s.left = true, product.Variants[v].Stock
+				}
+			}
+			bySKU[sku] = s
+		}
+		stock[i] = s
+		if s == nil {
+			continue
+		}
+
+		result := &lines[i]
+		result.ProductID = s.productID
+		result.Available = max(s.left, 0)
+		result.Reservable = min(line.Quantity, result.Available)
+		switch {
+		case result.Reservable == line.Quantity:
+			result.Status = availabilityAvailable
+		case result.Reservable > 0:
+			result.Status = availabilityPartial
+		default:
+			result.Status = availabilityOut
+		}
+		s.left -= result.Reservable
+	}
+	store.mu.RUnlock()
+
+	now := time.Now()
+	all := true
+	for i := range lines {
+		if lines[i].Status == availabilityAvailable {
+			continue
+		}
+		all = false
+		if stock[i] == nil {
+			continue
+		}
+		ledgerSKU := ""
+		if stock[i].variant {
+			ledgerSKU = lines[i].SKU
+		}
+		lines[i].EstimatedRestockAt = stockLedger.restockEstimate(stock[i].key, ledgerSKU, now)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"lines":          lines,
+		"all_reservable": all,
+	})
+}
+
+// restockEstimate guesses when a SKU is next restocked, "" for a product
+// without variants: its last restock plus the average time between its
+// latest ones. It returns nil with fewer than two restocks, or when the
+// estimate has already passed.
+func (s *StockLedger) restockEstimate(key, sku string, now time.Time) *time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var restocks []time.Time
+	entries := s.entries[key]
+	for i := len(entries) - 1; i >= 0 && len(restocks) < restockHistory; i-- {
+		e := entries[i]
+		if e.SKU == sku && e.Delta > 0 && (e.Reason == reasonRestock || e.Reason == reasonReceipt) {
+			restocks = append(restocks, e.At)
+		}
+	}
+	if len(restocks) < 2 {
+		return nil
+	}
+	// Newest first, so the span is from the last to the oldest
+	interval := restocks[0].Sub(restocks[len(restocks)-1]) / time.Duration(len(restocks)-1)
+	next := restocks[0].Add(interval)
+	if !next.After(now) {
+		return nil
+	}
+	return &next
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// awsRegion is the region used for AWS API calls
+var awsRegion = awsRegionFromEnv()
+
+func awsRegionFromEnv() string {
+	if region := os.Getenv("AWS_REGION"); region != "" {
+		return region
+	}
+	if region := os.Getenv("AWS_DEFAULT_REGION"); region != "" {
+		return region
+	}
+	return "us-west-2"
+}
+
+// awsCredentials are the keys used to sign AWS requests
+type awsCredentials struct {
+	AccessKeyID     string    `json:"AccessKeyId"`
+	SecretAccessKey string    `json:"SecretAccessKey"`
+	SessionToken    string    `json:"Token"`
+	Expiration      time.Time `json:"Expiration"`
+}
+
+// credentialProvider resolves credentials from the environment or, on ECS,
+// from the task role endpoint. Task role credentials are cached until
+// shortly before they expire.
+type credentialProvider struct {
+	mu     sync.Mutex
+	cached *awsCredentials
+	client *http.Client
+}
+
+var awsCreds = &credentialProvider{client: newPooledClient("aws_credentials", 5*time.Second)}
+
+// get returns valid credentials
+func (p *credentialProvider) get(ctx context.Context) (*awsCredentials, error) {
+	if key := os.Getenv("AWS_ACCESS_KEY_ID"); key != "" {
+		return &awsCredentials{
+			AccessKeyID:     key,
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		}, nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.cached != nil && time.Until(p.cached.Expiration) > 5*time.Minute {
+		return p.cached, nil
+	}
+
+	uri := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI")
+	if uri == "" {
+		return nil, errors.New("no AWS credentials found")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://169.254.170.2"+uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("fetching task role credentials: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching task role credentials: %s", resp.Status)
+	}
+
+	var creds awsCredentials
+	if err := json.NewDecoder(resp.Body).Decode(&creds); err != nil {
+		return nil, fmt.Errorf("decoding task role credentials: %w", err)
+	}
+	p.cached = &creds
+	return p.cached, nil
+}
+
+// snsPublish publishes to an SNS topic, params holding Message and any
+// of Subject, MessageGroupId and MessageDeduplicationId
+func snsPublish(ctx context.Context, client *http.Client, topic string, params url.Values) error {
+	// arn:aws:sns:<region>:<account>:<topic>
+	region := awsRegion
+	if parts := strings.Split(topic, ":"); len(parts) == 6 {
+		region = parts[3]
+	}
+	params.Set("Action", "Publish")
+	params.Set("Version", "2010-03-31")
+	params.Set("TopicArn", topic)
+	return awsQuery(ctx, client, "sns", region, fmt.Sprintf("https://sns.%s.amazonaws.com/", region), params)
+}
+
+// sqsSend sends a message to an SQS queue, params holding MessageBody and
+// any of MessageGroupId and MessageDeduplicationId
+func sqsSend(ctx context.Context, client *http.Client, queueURL string, params url.Values) error {
+	// https://sqs.<region>.amazonaws.com/<account>/<queue>
+	region := awsRegion
+	if u, err := url.Parse(queueURL); err == nil {
+		if parts := strings.Split(u.Host, "."); len(parts) == 4 && parts[0] == "sqs" {
+			region = parts[1]
+		}
+	}
+	params.Set("Action", "SendMessage")
+	params.Set("Version", "2012-11-05")
+	return awsQuery(ctx, client, "sqs", region, queueURL, params)
+}
+
+// awsQuery calls an AWS query API action with a signed form POST
+func awsQuery(ctx context.Context, client *http.Client, service, region, endpoint string, params url.Values) error {
+	body := []byte(params.Encode())
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+
+	creds, err := awsCreds.get(ctx)
+	if err != nil {
+		return err
+	}
+	signV4(req, body, service, region, creds, time.Now())
+	return sendChecked(client, req, service+" "+strings.ToLower(params.Get("Action")))
+}
+
+// cloudFrontInvalidate asks CloudFront to drop cached paths of a
+// distribution and returns the invalidation ID. reference must be unique
+// per invalidation; CloudFront treats a repeat as the same request.
+func cloudFrontInvalidate(ctx context.Context, client *http.Client, distribution string, paths []string, reference string) (string, error) {
+	type items struct {
+		Quantity int      `xml:"Quantity"`
+		Items    []string `xml:"Items>Path"`
+	}
+	batch := struct {
+		XMLName         xml.Name `xml:"http://cloudfront.amazonaws.com/doc/2020-05-31/ InvalidationBatch"`
+		Paths           items    `xml:"Paths"`
+		CallerReference string   `xml:"CallerReference"`
+	}{Paths: items{Quantity: len(paths), Items: paths}, CallerReference: reference}
+	body, err := xml.Marshal(batch)
+	if err != nil {
+		return "", err
+	}
+
+	// CloudFront is global, signed for us-east-1
+	endpoint := "https://cloudfront.amazonaws.com/2020-05-31/distribution/" + url.PathEscape(distribution) + "/invalidation"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "text/xml")
+	creds, err := awsCreds.get(ctx)
+	if err != nil {
+		return "", err
+	}
+	signV4(req, body, "cloudfront", "us-east-1", creds, time.Now())
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return "", fmt.Errorf("cloudfront createinvalidation: %s: %s", resp.Status, msg)
+	}
+	var invalidation struct {
+		ID string `xml:"Id"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&invalidation); err != nil {
+		return "", fmt.Errorf("decoding cloudfront invalidation: %w", err)
+	}
+	return invalidation.ID, nil
+}
+
+// sendChecked performs a request and turns non-2xx responses into errors
+func sendChecked(client *http.Client, req *http.Request, name string) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s: %s: %s", name, resp.Status, msg)
+	}
+	return nil
+}
+
+// signV4 signs a request with AWS Signature Version 4. The payload must be
+// the exact request body (nil for none).
+func signV4(req *http.Request, payload []byte, service, region string, creds *awsCredentials, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	payloadHash := sha256Hex(payload)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+
+	// Canonical headers: host plus everything set on the request
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	query := strings.ReplaceAll(req.URL.Query().Encode(), "+", "%20")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method, path, query, canonicalHeaders.String(), signedHeaders, payloadHash,
+	}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+creds.SecretAccessKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.AccessKeyID, scope, signedHeaders, signature))
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,436 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Restore conflict policies, for products whose current state differs
+// from the backup
+const (
+	restoreOverwrite = "overwrite" // put the backed-up product back
+	restoreSkip      = "skip"      // keep the current product
+	restoreFail      = "fail"      // change nothing if any product conflicts
+)
+
+// maxRestoreChanges caps the changes listed in a restore summary
+const maxRestoreChanges = 1000
+
+// backupNamePattern only allows names produced by create, with the
+// extension of the codec they were written in
+var backupNamePattern = regexp.MustCompile(`^catalog-\d{8}T\d{6}Z\.[a-z0-9]+$`)
+
+// Backup describes a catalog snapshot in S3
+type Backup struct {
+	Name      string    `json:"name"`
+	Count     int       `json:"count,omitempty"`
+	Size      int64     `json:"size"`
+	SHA256    string    `json:"sha256,omitempty"`
+	Codec     string    `json:"codec"` // RECORD_CODEC when it was written
+	Encrypted bool      `json:"encrypted,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// BackupStore snapshots the whole catalog, deleted products included, to
+// objects under BACKUP_PREFIX in BACKUP_BUCKET, written in RECORD_CODEC.
+// Each backup records its codec, so it's read back in that one whatever
+// RECORD_CODEC says by then. With
+// BACKUP_KMS_KEY_ID, S3 encrypts them with that KMS key.
+type BackupStore struct {
+	s3       *S3Client
+	prefix   string
+	kmsKeyID string
+}
+
+// Global backups, nil unless BACKUP_BUCKET is set
+var backups = newBackupStore()
+
+func newBackupStore() *BackupStore {
+	bucket := os.Getenv("BACKUP_BUCKET")
+	if bucket == "" {
+		return nil
+	}
+	return &BackupStore{
+		s3:       newS3Client(bucket),
+		prefix:   envString("BACKUP_PREFIX", "backups/"),
+		kmsKeyID: os.Getenv("BACKUP_KMS_KEY_ID"),
+	}
+}
+
+// create uploads a snapshot of the current catalog
+func (b *BackupStore) create(ctx context.Context) (Backup, error) {
+	cut := store.cut()
+
+	var body bytes.Buffer
+	enc := recordCodec.NewEncoder(&body)
+	for _, p := range cut.products {
+		if err := enc.Encode(p); err != nil {
+			return Backup{}, err
+		}
+	}
+
+	now := cut.at
+	backup := Backup{
+		Name:      "catalog-" + now.Format("20060102T150405Z") + "." + recordCodec.Extension(),
+		Count:     len(cut.products),
+		Size:      int64(body.Len()),
+		SHA256:    sha256Hex(body.Bytes()),
+		Codec:     recordCodec.Name(),
+		Encrypted: b.kmsKeyID != "",
+		CreatedAt: now,
+	}
+	header := http.Header{}
+	header.Set("Content-Type", recordCodec.ContentType())
+	header.Set("X-Amz-Meta-Sha256", backup.SHA256)
+	header.Set("X-Amz-Meta-Codec", backup.Codec)
+	header.Set("X-Amz-Meta-Count", strconv.Itoa(backup.Count))
+	if backup.Encrypted {
+		header.Set("X-Amz-Server-Side-Encryption", "aws:kms")
+		header.Set("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id", b.kmsKeyID)
+	}
+	if err := b.s3.putObject(ctx, b.prefix+backup.Name, body.Bytes(), header); err != nil {
+		return Backup{}, err
+	}
+	return backup, nil
+}
+
+// list returns the backups in the bucket, newest first
+func (b *BackupStore) list(ctx context.Context) ([]Backup, error) {
+	objects, err := b.s3.listObjects(ctx, b.prefix)
+	if err != nil {
+		return nil, err
+	}
+	list := make([]Backup, 0, len(objects))
+	for _, o := range objects {
+		name := strings.TrimPrefix(o.Key, b.prefix)
+		if backupNamePattern.MatchString(name) {
+			list = append(list, Backup{Name: name, Size: o.Size, Codec: backupCodecName(name), CreatedAt: o.LastModified})
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name > list[j].Name })
+	return list, nil
+}
+
+// backupCodecName tells the codec of a backup from its extension, for
+// listings, which don't carry the metadata
+func backupCodecName(name string) string {
+	for _, codec := range codecs {
+		if strings.HasSuffix(name, "."+codec.Extension()) {
+			return codec.Name()
+		}
+	}
+	return ""
+}
+
+// errBackupCorrupt is returned for a backup that doesn't match its
+// checksum or doesn't decode
+var errBackupCorrupt = errors.New("backup is corrupt")
+
+// load downloads a backup and checks it against the checksum it was
+// uploaded with
+func (b *BackupStore) load(ctx context.Context, name string) ([]Product, error) {
+	body, header, err := b.s3.getObject(ctx, b.prefix+name, nil)
+	if err != nil {
+		return nil, err
+	}
+	if expected := header.Get("X-Amz-Meta-Sha256"); expected != sha256Hex(body) {
+		return nil, fmt.Errorf("%w: checksum %s, expected %s", errBackupCorrupt, sha256Hex(body), expected)
+	}
+
+	// Backups from before codecs were recorded are JSON lines
+	codecName := header.Get("X-Amz-Meta-Codec")
+	if codecName == "" {
+		codecName = "json"
+	}
+	codec, exists := codecs[codecName]
+	if !exists {
+		return nil, fmt.Errorf("backup is written in codec %s, which this instance doesn't have", codecName)
+	}
+
+	var products []Product
+	dec := codec.NewDecoder(bytes.NewReader(body))
+	for {
+		var p Product
+		err := dec.Decode(&p)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: product %d: %v", errBackupCorrupt, len(products)+1, err)
+		}
+		products = append(products, p)
+	}
+	return products, nil
+}
+
+// RestoreOptions control a restore. Prune soft-deletes live products the
+// backup doesn't have, such as those a bad import created.
+type RestoreOptions struct {
+	Policy string
+	DryRun bool
+	Prune  bool
+}
+
+// RestoreChange is what a restore does, or would do, to one product
+type RestoreChange struct {
+	Tenant string `json:"tenant,omitempty"`
+	ID     string `json:"id"`
+	Action string `json:"action"` // create, update, skip or prune
+}
+
+// RestoreSummary counts what a restore changed, or would change on a dry
+// run. Changes lists them, up to maxRestoreChanges.
+type RestoreSummary struct {
+	Backup    string          `json:"backup"`
+	DryRun    bool            `json:"dry_run"`
+	Policy    string          `json:"policy"`
+	Created   int             `json:"created"`
+	Updated   int             `json:"updated"`
+	Unchanged int             `json:"unchanged"`
+	Skipped   int             `json:"skipped"`
+	Pruned    int             `json:"pruned"`
+	Conflicts int             `json:"conflicts"`
+	Changes   []RestoreChange `json:"changes"`
+}
+
+// errRestoreConflicts is returned by the fail policy
+var errRestoreConflicts = errors.New("products differ from the backup")
+
+// errRestoreStopped is a restore a failed write cut short
+var errRestoreStopped = errors.New("restore stopped")
+
+func (s *RestoreSummary) change(p *Product, action string) {
+	if len(s.Changes) < maxRestoreChanges {
+		s.Changes = append(s.Changes, RestoreChange{Tenant: p.Tenant, ID: p.ID, Action: action})
+	}
+}
+
+// restoreCatalog puts the products of a backup back in the store, under
+// one lock so the restore is all or nothing for readers. Restored
+// products get a new version, so clients holding old ETags must re-read
+// them. c is nil from productctl.
+func restoreCatalog(c *gin.Context, name string, products []Product, opts RestoreOptions) (RestoreSummary, error) {
+	summary := RestoreSummary{Backup: name, DryRun: opts.DryRun, Policy: opts.Policy, Changes: []RestoreChange{}}
+	for i := range products {
+		if violations := productViolations(&products[i]); len(violations) > 0 {
+			return summary, fmt.Errorf("%w: product %s: %s", errBackupCorrupt, products[i].ID, violationSummary(violations))
+		}
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	// Work out every change first, so the fail policy and dry runs
+	// change nothing
+	type write struct {
+		product Product
+		current *Product
+	}
+	var writes []write
+	inBackup := make(map[string]bool, len(products))
+	for _, product := range products {
+		inBackup[product.key()] = true
+		if violations := codes.conflicts(&product); len(violations) > 0 {
+			return summary, fmt.Errorf("product %s: %s", qualifiedID(product.Tenant, product.ID), violationSummary(violations))
+		}
+		current, exists := store.products[product.key()]
+		if !exists {
+			// Reviews aren't backed up, so neither are ratings
+			product.Version = 0
+			product.Rating, product.ReviewCount = 0, 0
+			writes = append(writes, write{product: product})
+			summary.Created++
+			summary.change(&product, "create")
+			continue
+		}
+		product.Version, product.CreatedAt, product.UpdatedAt = current.Version, current.CreatedAt, current.UpdatedAt
+		product.Rating, product.ReviewCount = current.Rating, current.ReviewCount
+		// A restore doesn't lift a suspension, nor bring one back
+		product.Suspension = current.Suspension
+		product.ActiveBadges = nil
+		syncVariantStock(&product)
+		if reflect.DeepEqual(product, current) {
+			summary.Unchanged++
+			continue
+		}
+		summary.Conflicts++
+		if opts.Policy == restoreSkip {
+			summary.Skipped++
+			summary.change(&product, "skip")
+			continue
+		}
+		writes = append(writes, write{product: product, current: &current})
+		summary.Updated++
+		summary.change(&product, "update")
+	}
+	if opts.Prune {
+		now := time.Now().UTC()
+		for _, key := range sortedProductKeys() {
+			current := store.products[key]
+			if inBackup[key] || current.DeletedAt != nil {
+				continue
+			}
+			pruned := current
+			pruned.DeletedAt = &now
+			writes = append(writes, write{product: pruned, current: &current})
+			summary.Pruned++
+			summary.change(&current, "prune")
+		}
+	}
+
+	if opts.Policy == restoreFail && summary.Conflicts > 0 {
+		return summary, fmt.Errorf("%w: %d of them", errRestoreConflicts, summary.Conflicts)
+	}
+	if opts.DryRun {
+		return summary, nil
+	}
+	for i, w := range writes {
+		if err := store.save(&w.product); err != nil {
+			return summary, fmt.Errorf("%w after %d of %d writes: %w", errRestoreStopped, i, len(writes), err)
+		}
+		audit.record(c, "restore", w.current, &w.product)
+	}
+	return summary, nil
+}
+
+// sortedProductKeys lists the keys in the store in order. Callers must
+// hold store.mu.
+func sortedProductKeys() []string {
+	keys := make([]string, 0, len(store.products))
+	for key := range store.products {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// backupsUnavailable writes 404 when backups aren't configured and 409
+// with sharding, and reports whether it did
+func backupsUnavailable(c *gin.Context) bool {
+	switch {
+	case backups == nil:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Backups are not configured"})
+		return true
+	case cluster != nil:
+		c.JSON(http.StatusConflict, gin.H{"error": "Sharded catalogs aren't backed up as a whole, each shard holds part of it"})
+		return true
+	}
+	return false
+}
+
+// getBackups lists the catalog backups in S3
+// Returns: 200 OK - Success
+// Returns: 404 Not Found - Backups are not configured
+// Returns: 409 Conflict - Sharding is enabled
+// Returns: 502 Bad Gateway - S3 failed
+// Returns: 503 Service Unavailable - S3 is down, with Retry-After
+func getBackups(c *gin.Context) {
+	if backupsUnavailable(c) {
+		return
+	}
+	list, err := backups.list(c.Request.Context())
+	if dependencyUnavailable(c, err) {
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to list backups", "details": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"count":   len(list),
+		"backups": list,
+	})
+}
+
+// createBackup snapshots the catalog to S3
+// Returns: 201 Created - Backup written (Cat burying treasure!)
+// Returns: 404 Not Found - Backups are not configured
+// Returns: 409 Conflict - Sharding is enabled
+// Returns: 502 Bad Gateway - S3 failed
+// Returns: 503 Service Unavailable - S3 is down, with Retry-After
+func createBackup(c *gin.Context) {
+	if backupsUnavailable(c) {
+		return
+	}
+	backup, err := backups.create(c.Request.Context())
+	if dependencyUnavailable(c, err) {
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to write backup", "details": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{
+		"message": "Backup created successfully",
+		"backup":  backup,
+	})
+}
+
+// restoreBackup restores the catalog from a backup. ?policy= is
+// overwrite (default), skip or fail for products that changed since,
+// ?prune=true soft-deletes products the backup doesn't have, and
+// ?dry_run=true only previews the changes.
+// Returns: 200 OK - Restored, or the preview (Cat putting everything back!)
+// Returns: 400 Bad Request - Invalid name or options
+// Returns: 404 Not Found - Backups are not configured, or no such backup
+// Returns: 409 Conflict - The fail policy found conflicts, or sharding is enabled
+// Returns: 502 Bad Gateway - S3 failed or the backup is corrupt
+// Returns: 503 Service Unavailable - S3 is down, with Retry-After
+func restoreBackup(c *gin.Context) {
+	if backupsUnavailable(c) {
+		return
+	}
+	name := c.Param("name")
+	if !backupNamePattern.MatchString(name) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid backup name", "name": name})
+		return
+	}
+	opts := RestoreOptions{
+		Policy: c.DefaultQuery("policy", restoreOverwrite),
+		DryRun: c.Query("dry_run") == "true",
+		Prune:  c.Query("prune") == "true",
+	}
+	if opts.Policy != restoreOverwrite && opts.Policy != restoreSkip && opts.Policy != restoreFail {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "policy must be overwrite, skip or fail", "policy": opts.Policy})
+		return
+	}
+
+	products, err := backups.load(c.Request.Context(), name)
+	if dependencyUnavailable(c, err) {
+		return
+	}
+	if s3Status(err) == http.StatusNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Backup not found", "name": name})
+		return
+	}
+	if err == nil {
+		var summary RestoreSummary
+		summary, err = restoreCatalog(c, name, products, opts)
+		if errors.Is(err, errRestoreConflicts) {
+			c.JSON(http.StatusConflict, gin.H{"error": "Products changed since the backup, nothing was restored", "summary": summary})
+			return
+		}
+		if errors.Is(err, errRestoreStopped) {
+			writeFailed(c, err)
+			return
+		}
+		if err == nil {
+			c.JSON(http.StatusOK, summary)
+			return
+		}
+	}
+	c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to restore backup", "name": name, "details": err.Error()})
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Badge is a storefront label such as "New", "Sale" or "Limited". A
+// product's own badges are set by hand; From and Until schedule them, e.g.
+// a "Limited" badge for the week of a drop.
+type Badge struct {
+	Label string     `json:"label"`
+	From  *time.Time `json:"from,omitempty"`
+	Until *time.Time `json:"until,omitempty"`
+}
+
+// activeAt reports whether a badge is shown at a given time
+func (b Badge) activeAt(now time.Time) bool {
+	return (b.From == nil || !now.Before(*b.From)) && (b.Until == nil || now.Before(*b.Until))
+}
+
+// Badge rules
+const (
+	badgeRuleNew      = "new"       // created within Days
+	badgeRuleSale     = "sale"      // a coupon scoped to the product or its category is usable
+	badgeRuleLowStock = "low_stock" // in stock, but below the low-stock threshold
+)
+
+// BadgeRule gives a badge to every product that matches the rule, while
+// its own schedule allows. Coupons for the whole catalog don't make
+// products "Sale", or every product would be.
+type BadgeRule struct {
+	Badge
+	Rule string `json:"rule"`
+	Days int    `json:"days,omitempty"`
+}
+
+// Global badge rules
+var badgeRules = newBadgeRules()
+
+// newBadgeRules reads BADGE_RULES, a JSON array of rules replacing the
+// defaults: "New" for 14 days after creation, "Sale" and "Limited"
+func newBadgeRules() []BadgeRule {
+	raw := os.Getenv("BADGE_RULES")
+	if raw == "" {
+		return []BadgeRule{
+			{Badge: Badge{Label: "New"}, Rule: badgeRuleNew, Days: 14},
+			{Badge: Badge{Label: "Sale"}, Rule: badgeRuleSale},
+			{Badge: Badge{Label: "Limited"}, Rule: badgeRuleLowStock},
+		}
+	}
+	var rules []BadgeRule
+	if err := json.Unmarshal([]byte(raw), &rules); err != nil {
+		panic(fmt.Sprintf("invalid BADGE_RULES: %v", err))
+	}
+	for i, r := range rules {
+		var violations []Violation
+		badgeViolation(&rules[i].Badge, fmt.Sprintf("[%d]", i), &violations)
+		switch {
+		case len(violations) > 0:
+			panic(fmt.Sprintf("invalid BADGE_RULES: %s", violationSummary(violations)))
+		case r.Rule != badgeRuleNew && r.Rule != badgeRuleSale && r.Rule != badgeRuleLowStock:
+			panic(fmt.Sprintf("invalid BADGE_RULES: rule must be new, sale or low_stock, not %q", r.Rule))
+		case r.Rule == badgeRuleNew && r.Days <= 0:
+			panic(fmt.Sprintf("invalid BADGE_RULES: the %s rule needs days", r.Label))
+		}
+	}
+	return rules
+}
+
+// badgeViolations checks and normalizes a product's badges, for
+// productViolations
+func badgeViolations(p *Product, violations *[]Violation) {
+	if len(p.Badges) > maxBadges {
+		*violations = append(*violations, Violation{Code: violationOutOfRange, Field: "badges", Message: fmt.Sprintf("Must have at most %d badges", maxBadges)})
+	}
+	seen := make(map[string]bool, len(p.Badges))
+	for i := range p.Badges {
+		prefix := fmt.Sprintf("badges[%d]", i)
+		badgeViolation(&p.Badges[i], prefix, violations)
+		if label := strings.ToLower(p.Badges[i].Label); label != "" {
+			if seen[label] {
+				*violations = append(*violations, Violation{Code: violationDuplicate, Field: prefix + ".label", Message: fmt.Sprintf("Duplicate badge %q", p.Badges[i].Label)})
+			}
+			seen[label] = true
+		}
+	}
+}
+
+func badgeViolation(b *Badge, prefix string, violations *[]Violation) {
+	normalizeText(&b.Label, prefix+".label", maxBadgeLabelLength, violations)
+	if b.Label == "" {
+		*violations = append(*violations, Violation{Code: violationRequired, Field: prefix + ".label", Message: "Is required"})
+	}
+	if b.From != nil && b.Until != nil && !b.Until.After(*b.From) {
+		*violations = append(*violations, Violation{Code: violationInvalid, Field: prefix + ".until", Message: "Must be after from"})
+	}
+}
+
+// badgeContext is what the rules look at besides the product, taken once
+// per response
+type badgeContext struct {
+	now  time.Time
+	sale []Coupon // usable coupons scoped to products or categories
+}
+
+func newBadgeContext(now time.Time) badgeContext {
+	bc := badgeContext{now: now}
+	coupons.mu.RLock()
+	defer coupons.mu.RUnlock()
+	for _, cp := range coupons.coupons {
+		if cp.unusableReason(now) == "" && (len(cp.Products) > 0 || len(cp.Categories) > 0) {
+			bc.sale = append(bc.sale, cp)
+		}
+	}
+	return bc
+}
+
+// activeBadges returns the labels a product shows now: its own scheduled
+// badges first, then those of matching rules, without repeats
+func (bc badgeContext) activeBadges(p *Product) []string {
+	var labels []string
+	add := func(b Badge) {
+		if !b.activeAt(bc.now) {
+			return
+		}
+		for _, label := range labels {
+			if strings.EqualFold(label, b.Label) {
+				return
+			}
+		}
+		labels = append(labels, b.Label)
+	}
+
+	for _, b := range p.Badges {
+		add(b)
+	}
+	for _, r := range badgeRules {
+		if bc.matches(r, p) {
+			add(r.Badge)
+		}
+	}
+	return labels
+}
+
+func (bc badgeContext) matches(r BadgeRule, p *Product) bool {
+	switch r.Rule {
+	case badgeRuleNew:
+		return !p.CreatedAt.IsZero() && bc.now.Sub(p.CreatedAt) < time.Duration(r.Days)*24*time.Hour
+	case badgeRuleSale:
+		for _, cp := range bc.sale {
+			if cp.appliesTo(*p) {
+				return true
+			}
+		}
+	case badgeRuleLowStock:
+		return p.Stock > 0 && p.isLowStock()
+	}
+	return false
+}
+
+// withActiveBadges returns a copy of products with their active badges
+// set, for list responses
+func withActiveBadges(products []Product) []Product {
+	bc := newBadgeContext(time.Now().UTC())
+	badged := make([]Product, len(products))
+	for i, p := range products {
+		p.ActiveBadges = bc.activeBadges(&p)
+		badged[i] = p
+	}
+	return badged
+}
+
+// getBadgeRules lists the badge rules, so storefronts know which labels
+// to style
+// Returns: 200 OK - Success
+func getBadgeRules(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"count": len(badgeRules),
+		"rules": badgeRules,
+	})
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxBatchItems caps the size of batch requests, BATCH_MAX_ITEMS
+var maxBatchItems = envInt("BATCH_MAX_ITEMS", 500)
+
+// BatchResult is the outcome of one item of a batch write
+type BatchResult struct {
+	Index   int         `json:"index"`
+	ID      string      `json:"id,omitempty"`
+	Status  int         `json:"status"`
+	Error   string      `json:"error,omitempty"`
+	Details string      `json:"details,omitempty"`
+	Errors  []Violation `json:"errors,omitempty"`
+	Product *Product    `json:"product,omitempty"`
+}
+
+// batchGetProducts returns several products at once, in the order asked
+// for. ?currency=EUR converts prices.
+// Returns: 200 OK - Found products and the IDs that weren't found (Cat herding!)
+// Returns: 400 Bad Request - Invalid request or unsupported currency
+func batchGetProducts(c *gin.Context) {
+	var body struct {
+		IDs []string `json:"ids" binding:"required,min=1"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":   "Invalid batch request",
+			"details": err.Error(),
+		})
+		return
+	}
+	if len(body.IDs) > maxBatchItems {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Too many IDs in one batch",
+			"max":   maxBatchItems,
+		})
+		return
+	}
+	currency, ok := requestedCurrency(c)
+	if !ok {
+		return
+	}
+
+	products := make([]Product, 0, len(body.IDs))
+	missing := make([]string, 0)
+	seen := make(map[string]bool, len(body.IDs))
+	store.mu.RLock()
+	for _, id := range body.IDs {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		if p, exists := store.getShown(c, id); exists {
+			products = append(products, p)
+		} else {
+			missing = append(missing, id)
+		}
+	}
+	store.mu.RUnlock()
+
+	if products, ok = localizeProducts(c, products, currency); !ok {
+		return
+	}
+	products = translateProducts(c, products)
+
+	c.JSON(http.StatusOK, gin.H{
+		"count":    len(products),
+		"products": products,
+		"missing":  missing,
+	})
+}
+
+// batchUpsertProducts creates or replaces several products. Each item is
+// applied on its own and gets its own result, so one bad item doesn't fail
+// the batch. An item with a non-zero version only replaces the product if
+// that is still its current version, like If-Match on PUT.
+// Returns: 200 OK - Per-item results (Cat sorting the mail!)
+// Returns: 400 Bad Request - Body isn't a list of items, is too large or names an unknown profile
+func batchUpsertProducts(c *gin.Context) {
+	profile, ok := writeProfile(c)
+	if !ok {
+		return
+	}
+	var body struct {
+		Items []json.RawMessage `json:"items" binding:"required,min=1"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":   "Invalid batch request",
+			"details": err.Error(),
+		})
+		return
+	}
+	if len(body.Items) > maxBatchItems {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Too many items in one batch",
+			"max":   maxBatchItems,
+		})
+		return
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	results := make([]BatchResult, len(body.Items))
+	failed := 0
+	for i, raw := range body.Items {
+		results[i] = upsertBatchItem(c, i, raw, profile)
+		if results[i].Status >= 400 {
+			failed++
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"count":     len(results),
+		"succeeded": len(results) - failed,
+		"failed":    failed,
+		"results":   results,
+	})
+}
+
+// upsertBatchItem applies one batch item, checked against the batch's
+// validation profile. Callers must hold store.mu.
+func upsertBatchItem(c *gin.Context, i int, raw json.RawMessage, profile ValidationProfile) BatchResult {
+	result := BatchResult{Index: i}
+	var product Product
+	violations := decodeStrict(raw, &product)
+	if violations == nil {
+		violations = append(productViolations(&product), profile.gaps(&product)...)
+	}
+	result.ID, product.Tenant = product.ID, tenantOf(c)
+	if len(violations) > 0 {
+		result.Status = http.StatusBadRequest
+		result.Error = "Invalid product data"
+		result.Errors = violations
+		return result
+	}
+
+	current, exists := store.products[product.key()]
+	switch {
+	case exists && current.DeletedAt != nil:
+		result.Status = http.StatusConflict
+		result.Error = "Product with this ID is deleted"
+		return result
+	case exists && current.Suspension != nil:
+		result.Status = http.StatusConflict
+		result.Error = "Product with this ID is suspended"
+		return result
+	case exists && product.Version != 0 && product.Version != current.Version:
+		result.Status = http.StatusPreconditionFailed
+		result.Error = "Product has been modified"
+		result.Details = fmt.Sprintf("current version is %d", current.Version)
+		return result
+	}
+	if exists {
+		if violations := stockWriteViolations(&current, &product); len(violations) > 0 {
+			result.Status = http.StatusBadRequest
+			result.Error = "Invalid product data"
+			result.Errors = violations
+			return result
+		}
+	}
+	if violations := codes.conflicts(&product); len(violations) > 0 {
+		result.Status = http.StatusConflict
+		result.Error = "SKU or barcode is already used by another product"
+		result.Errors = violations
+		return result
+	}
+	if violations := catalogViolations(&product); len(violations) > 0 {
+		result.Status = http.StatusBadRequest
+		result.Error = "Invalid product data"
+		result.Errors = violations
+		return result
+	}
+
+	// Versions and ratings are managed by the server
+	product.DeletedAt, product.Suspension = nil, nil
+	if exists {
+		product.Version = current.Version
+		product.Rating, product.ReviewCount = current.Rating, current.ReviewCount
+		if err := store.save(&product); err != nil {
+			result.Status = http.StatusServiceUnavailable
+			result.Error = "Write failed, try again later"
+			result.Details = err.Error()
+			return result
+		}
+		audit.record(c, "update", &current, &product)
+		result.Status = http.StatusOK
+	} else {
+		product.Version = 0
+		product.Rating, product.ReviewCount = 0, 0
+		if err := store.save(&product); err != nil {
+			result.Status = http.StatusServiceUnavailable
+			result.Error = "Write failed, try again later"
+			result.Details = err.Error()
+			return result
+		}
+		audit.record(c, "create", nil, &product)
+		result.Status = http.StatusCreated
+	}
+	result.Product = &product
+	return result
+}
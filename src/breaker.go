@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Retry and circuit breaker settings of AWS clients
+var (
+	// awsMaxAttempts is how many times a call is tried, AWS_MAX_ATTEMPTS
+	awsMaxAttempts = envInt("AWS_MAX_ATTEMPTS", 3)
+	// awsRetryBase is the backoff before the first retry, doubling after
+	// each, with full jitter, AWS_RETRY_BASE
+	awsRetryBase = envDuration("AWS_RETRY_BASE", 100*time.Millisecond)
+	// awsAttemptTimeout bounds each attempt, so a hung connection is
+	// retried rather than waited on until the client gives up,
+	// AWS_ATTEMPT_TIMEOUT
+	awsAttemptTimeout = envDuration("AWS_ATTEMPT_TIMEOUT", 10*time.Second)
+	// breakerThreshold is how many calls in a row must fail to open a
+	// circuit, BREAKER_THRESHOLD
+	breakerThreshold = envInt("BREAKER_THRESHOLD", 5)
+	// breakerCooldown is how long an open circuit fails fast before it
+	// lets a trial call through, BREAKER_COOLDOWN
+	breakerCooldown = envDuration("BREAKER_COOLDOWN", 30*time.Second)
+)
+
+// awsRetryMax caps the backoff between attempts
+const awsRetryMax = 2 * time.Second
+
+// Circuit states
+const (
+	circuitClosed   = "closed"
+	circuitOpen     = "open"
+	circuitHalfOpen = "half_open"
+)
+
+// CircuitBreaker stops calling a dependency that keeps failing. After
+// breakerThreshold failed calls in a row it opens and fails every call at
+// once for breakerCooldown; then one trial call goes through, closing it
+// again if it works.
+type CircuitBreaker struct {
+	name string
+
+	mu       sync.Mutex
+	state    string
+	failures int // in a row
+	openedAt time.Time
+	trial    bool // a half-open trial call is in flight
+	opened   int64
+	rejected int64
+}
+
+// BreakerStats is a breaker's entry in the circuit_breakers metric
+type BreakerStats struct {
+	State    string `json:"state"`
+	Failures int    `json:"failures"`
+	Opened   int64  `json:"opened"`
+	Rejected int64  `json:"rejected"`
+}
+
+// CircuitOpenError is returned, without calling the dependency, while its
+// circuit is open
+type CircuitOpenError struct {
+	Name       string
+	RetryAfter time.Duration
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("%s is unavailable, circuit open for %s more", e.Name, e.RetryAfter.Round(time.Second))
+}
+
+var (
+	breakersMu sync.Mutex
+	breakers   []*CircuitBreaker
+)
+
+func init() {
+	expvar.Publish("circuit_breakers", expvar.Func(func() any {
+		breakersMu.Lock()
+		defer breakersMu.Unlock()
+
+		stats := make(map[string]BreakerStats, len(breakers))
+		for _, b := range breakers {
+			stats[b.name] = b.stats()
+		}
+		return stats
+	}))
+}
+
+// newCircuitBreaker returns the breaker published as name in
+// circuit_breakers. Clients of the same dependency share it.
+func newCircuitBreaker(name string) *CircuitBreaker {
+	breakersMu.Lock()
+	defer breakersMu.Unlock()
+
+	for _, b := range breakers {
+		if b.name == name {
+			return b
+		}
+	}
+	b := &CircuitBreaker{name: name, state: circuitClosed}
+	breakers = append(breakers, b)
+	return b
+}
+
+// allow reports whether a call may go ahead, or how long until the
+// circuit lets one through
+func (b *CircuitBreaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == circuitOpen {
+		if wait := breakerCooldown - time.Since(b.openedAt); wait > 0 {
+			b.rejected++
+			return &CircuitOpenError{Name: b.name, RetryAfter: wait}
+		}
+		b.state = circuitHalfOpen
+	}
+	if b.state == circuitHalfOpen {
+		if b.trial {
+			b.rejected++
+			return &CircuitOpenError{Name: b.name, RetryAfter: time.Second}
+		}
+		b.trial = true
+	}
+	return nil
+}
+
+// record takes the outcome of a call that was allowed
+func (b *CircuitBreaker) record(failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.trial = false
+	if !failed {
+		b.state, b.failures = circuitClosed, 0
+		return
+	}
+	b.failures++
+	if b.state == circuitHalfOpen || b.failures >= breakerThreshold {
+		if b.state != circuitOpen {
+			b.opened++
+		}
+		b.state, b.openedAt = circuitOpen, time.Now()
+	}
+}
+
+// abandon ends a call that was allowed without an outcome
+func (b *CircuitBreaker) abandon() {
+	b.mu.Lock()
+	b.trial = false
+	b.mu.Unlock()
+}
+
+func (b *CircuitBreaker) stats() BreakerStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return BreakerStats{State: b.state, Failures: b.failures, Opened: b.opened, Rejected: b.rejected}
+}
+
+// newAWSClient returns a pooled client for an AWS service that retries
+// throttling, 5xx responses and network errors with jittered backoff, and
+// fails fast through the service's circuit breaker while it's down. Only
+// for calls that are safe to repeat: S3 object writes and CloudFront
+// invalidations (the caller reference makes a repeat the same request)
+// are, and for low-stock alerts a duplicate beats a lost one. Event
+// destinations retry on their own and keep their plain client.
+func newAWSClient(name string, timeout time.Duration) *http.Client {
+	client := newPooledClient(name, timeout)
+	client.Transport = &resilientTransport{next: client.Transport, breaker: newCircuitBreaker(name)}
+	return client
+}
+
+// resilientTransport adds retries and a circuit breaker to a transport
+type resilientTransport struct {
+	next    http.RoundTripper
+	breaker *CircuitBreaker
+}
+
+func (t *resilientTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.breaker.allow(); err != nil {
+		return nil, err
+	}
+
+	var resp *http.Response
+	var err error
+	for attempt := 1; ; attempt++ {
+		resp, err = t.attempt(req)
+		if attempt >= awsMaxAttempts || !retryable(req.Context(), resp, err) {
+			break
+		}
+		if req.Body != nil && req.GetBody == nil {
+			break
+		}
+		if resp != nil {
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+			resp.Body.Close()
+		}
+		if !sleepCtx(req.Context(), backoff(attempt)) {
+			resp, err = nil, req.Context().Err()
+			break
+		}
+		if req.GetBody != nil {
+			body, bodyErr := req.GetBody()
+			if bodyErr != nil {
+				resp, err = nil, bodyErr
+				break
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+	}
+
+	switch {
+	case req.Context().Err() != nil:
+		// The caller gave up, which says nothing about the service
+		t.breaker.abandon()
+	default:
+		// Client errors, 404s and failed preconditions included, mean the
+		// service is answering
+		t.breaker.record(err != nil || resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests)
+	}
+	return resp, err
+}
+
+// attempt sends the request once, within awsAttemptTimeout. The timeout
+// is released when the body is closed, not when the headers arrive.
+func (t *resilientTransport) attempt(req *http.Request) (*http.Response, error) {
+	if awsAttemptTimeout <= 0 {
+		return t.next.RoundTrip(req)
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), awsAttemptTimeout)
+	resp, err := t.next.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &pooledBody{ReadCloser: resp.Body, release: cancel}
+	return resp, nil
+}
+
+// retryable reports whether a failed attempt is worth repeating: network
+// errors and timeouts of the attempt, throttling and 5xx responses. A
+// request whose caller gave up is not.
+func retryable(ctx context.Context, resp *http.Response, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	if err != nil {
+		return true
+	}
+	return resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+}
+
+// backoff is the wait before retry n: a random duration up to
+// awsRetryBase doubled n-1 times, at most awsRetryMax
+func backoff(n int) time.Duration {
+	ceiling := min(awsRetryBase<<(n-1), awsRetryMax)
+	if ceiling <= 0 {
+		return 0
+	}
+	return rand.N(ceiling)
+}
+
+// sleepCtx waits for d, returning false if ctx is done first
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// dependencyUnavailable writes 503 with Retry-After when err comes from
+// an open circuit, and reports whether it did
+// Returns: 503 Service Unavailable - A dependency is down, retry later (Cat napping, come back later!)
+func dependencyUnavailable(c *gin.Context, err error) bool {
+	var open *CircuitOpenError
+	if !errors.As(err, &open) {
+		return false
+	}
+	seconds := int(math.Ceil(open.RetryAfter.Seconds()))
+	c.Header("Retry-After", strconv.Itoa(seconds))
+	c.JSON(http.StatusServiceUnavailable, gin.H{
+		"error":       "A dependency is unavailable, try again later",
+		"dependency":  open.Name,
+		"retry_after": seconds,
+	})
+	return true
+}
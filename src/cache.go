@@ -0,0 +1,550 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cache metrics, exposed at /debug/vars
+var (
+	cacheHits      = expvar.NewInt("cache_hits")
+	cacheStaleHits = expvar.NewInt("cache_stale_hits")
+	cacheMisses    = expvar.NewInt("cache_misses")
+	cacheRepairs   = expvar.NewInt("cache_repairs")
+	// cacheInvalidations counts the lists dropped because a write touched
+	// one of their tags
+	cacheInvalidations = expvar.NewInt("cache_invalidations")
+)
+
+// cachePolicy controls freshness for one cached route
+type cachePolicy struct {
+	ttl   time.Duration // how long an entry is fresh
+	stale time.Duration // how long past ttl it may still be served while refreshing
+}
+
+// ProductCache is a read-through cache in front of the product store.
+// Entries past their TTL are served stale within the route's budget while
+// a single background refresh reloads them.
+type ProductCache struct {
+	product cachePolicy
+	list    cachePolicy
+	backend cacheBackend
+}
+
+type cacheEntry struct {
+	value  any
+	stored time.Time
+}
+
+// cacheBackend holds the cached entries: in process by default, or in
+// Redis so instances serving the same catalog share one cache
+type cacheBackend interface {
+	// get reads an entry, giving up when ctx is done
+	get(ctx context.Context, key string) (cacheEntry, bool)
+	// set stores an entry, which the backend may drop after ttl, under
+	// tags that invalidateTags drops it by
+	set(key string, entry cacheEntry, ttl time.Duration, tags []string)
+	del(keys ...string)
+	// invalidateTags drops every entry under any of the tags and returns
+	// how many there were
+	invalidateTags(tags ...string) int
+	clear()
+	ping(ctx context.Context) error
+}
+
+type cacheState int
+
+const (
+	cacheMiss cacheState = iota
+	cacheFresh
+	cacheStale
+)
+
+// listCacheKey is the key of the unfiltered list, and the prefix of the
+// keys of filtered ones
+const listCacheKey = "list"
+
+// cacheMaxEntries caps the in-process cache, CACHE_MAX_ENTRIES. Filtered
+// lists can have any number of keys, so once it's full expired entries are
+// swept and, if that doesn't free room, new ones aren't cached.
+var cacheMaxEntries = envInt("CACHE_MAX_ENTRIES", 10000)
+
+// Global product cache, a TTL of 0 disables caching for that route
+var cache = &ProductCache{
+	product: cachePolicy{
+		ttl:   envDuration("CACHE_TTL", 30*time.Second),
+		stale: envDuration("CACHE_STALE_PRODUCT", 30*time.Second),
+	},
+	list: cachePolicy{
+		ttl:   envDuration("CACHE_TTL_LIST", 5*time.Second),
+		stale: envDuration("CACHE_STALE_LIST", 10*time.Second),
+	},
+	backend: newCacheBackend(),
+}
+
+// newCacheBackend picks the backend from CACHE_BACKEND: memory (the
+// default) or redis, which connects to REDIS_URL
+func newCacheBackend() cacheBackend {
+	switch backend := os.Getenv("CACHE_BACKEND"); backend {
+	case "", "memory":
+		return newMemoryCache()
+	case "redis":
+		client, err := newRedisClient(os.Getenv("REDIS_URL"))
+		if err != nil {
+			panic(fmt.Sprintf("invalid REDIS_URL: %v", err))
+		}
+		prefix := os.Getenv("REDIS_KEY_PREFIX")
+		if prefix == "" {
+			prefix = "productstore:"
+		}
+		return &redisCache{client: client, prefix: prefix, hedger: newHedger("redis")}
+	default:
+		panic(fmt.Sprintf("unsupported CACHE_BACKEND %q, want memory or redis", backend))
+	}
+}
+
+func productCacheKey(id string) string {
+	return "product:" + id
+}
+
+// get returns a cached value and whether it is fresh or stale
+func (pc *ProductCache) get(ctx context.Context, key string, policy cachePolicy) (any, cacheState) {
+	entry, exists := pc.backend.get(ctx, key)
+	if !exists {
+		return nil, cacheMiss
+	}
+	age := time.Since(entry.stored)
+	switch {
+	case age <= policy.ttl:
+		return entry.value, cacheFresh
+	case age <= policy.ttl+policy.stale:
+		return entry.value, cacheStale
+	}
+	return nil, cacheMiss
+}
+
+// set caches a value under tags. Callers must hold store.mu so a
+// concurrent write can't slip in between reading the store and filling
+// the cache.
+func (pc *ProductCache) set(key string, policy cachePolicy, value any, tags ...string) {
+	if policy.ttl <= 0 {
+		return
+	}
+	pc.backend.set(key, cacheEntry{value: value, stored: time.Now()}, policy.ttl+policy.stale, tags)
+}
+
+// invalidate drops a cached product along with the cached lists a write
+// to it can change, given its key and the product before and after the
+// write
+func (pc *ProductCache) invalidate(key string, before, after *Product) {
+	pc.backend.del(productCacheKey(key))
+	cacheInvalidations.Add(int64(pc.backend.invalidateTags(writeTags(key, before, after)...)))
+}
+
+// clear drops every cached entry, used when the whole store is replaced
+func (pc *ProductCache) clear() {
+	pc.backend.clear()
+}
+
+// memoryCache keeps entries in process, up to CACHE_MAX_ENTRIES
+type memoryCache struct {
+	mu      sync.RWMutex
+	entries map[string]memoryEntry
+	tags    map[string]map[string]bool // tag -> keys
+}
+
+type memoryEntry struct {
+	cacheEntry
+	expires time.Time
+}
+
+func newMemoryCache() *memoryCache {
+	return &memoryCache{entries: make(map[string]memoryEntry), tags: make(map[string]map[string]bool)}
+}
+
+func (m *memoryCache) get(ctx context.Context, key string) (cacheEntry, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	entry, exists := m.entries[key]
+	return entry.cacheEntry, exists
+}
+
+func (m *memoryCache) set(key string, entry cacheEntry, ttl time.Duration, tags []string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, exists := m.entries[key]; !exists && len(m.entries) >= cacheMaxEntries {
+		m.sweep()
+		if len(m.entries) >= cacheMaxEntries {
+			return
+		}
+	}
+	m.entries[key] = memoryEntry{cacheEntry: entry, expires: time.Now().Add(ttl)}
+	for _, tag := range tags {
+		if m.tags[tag] == nil {
+			m.tags[tag] = make(map[string]bool)
+		}
+		m.tags[tag][key] = true
+	}
+}
+
+// sweep drops expired entries and the tags of entries that are gone.
+// Callers must hold m.mu.
+func (m *memoryCache) sweep() {
+	now := time.Now()
+	for key, entry := range m.entries {
+		if now.After(entry.expires) {
+			delete(m.entries, key)
+		}
+	}
+	for tag, keys := range m.tags {
+		for key := range keys {
+			if _, exists := m.entries[key]; !exists {
+				delete(keys, key)
+			}
+		}
+		if len(keys) == 0 {
+			delete(m.tags, tag)
+		}
+	}
+}
+
+func (m *memoryCache) del(keys ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, key := range keys {
+		delete(m.entries, key)
+	}
+}
+
+func (m *memoryCache) invalidateTags(tags ...string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	dropped := 0
+	for _, tag := range tags {
+		for key := range m.tags[tag] {
+			if _, exists := m.entries[key]; exists {
+				delete(m.entries, key)
+				dropped++
+			}
+		}
+		delete(m.tags, tag)
+	}
+	return dropped
+}
+
+func (m *memoryCache) clear() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.entries = make(map[string]memoryEntry)
+	m.tags = make(map[string]map[string]bool)
+}
+
+func (m *memoryCache) ping(ctx context.Context) error {
+	m.mu.RLock()
+	_ = len(m.entries)
+	m.mu.RUnlock()
+	return nil
+}
+
+// redisCache keeps entries in Redis as JSON under REDIS_KEY_PREFIX. Redis
+// errors count as misses, so the store answers while Redis is down; a
+// failed invalidation is logged and the entry expires with its TTL.
+type redisCache struct {
+	client *RedisClient
+	prefix string
+	hedger *Hedger // reads, with HEDGE_READS
+}
+
+// redisCacheEntry is how an entry is stored in Redis
+type redisCacheEntry struct {
+	Stored time.Time       `json:"stored"`
+	Value  json.RawMessage `json:"value"`
+}
+
+func (rc *redisCache) do(args ...string) (any, error) {
+	start := time.Now()
+	reply, err := rc.client.do(context.Background(), args...)
+	cacheDependency.observe(start, err)
+	return reply, err
+}
+
+func (rc *redisCache) pipeline(cmds ...[]string) ([]any, error) {
+	start := time.Now()
+	replies, err := rc.client.pipeline(context.Background(), cmds)
+	cacheDependency.observe(start, err)
+	return replies, err
+}
+
+// tagKey is the Redis set of the keys under a tag
+func (rc *redisCache) tagKey(tag string) string {
+	return rc.prefix + "tag:" + tag
+}
+
+func (rc *redisCache) get(ctx context.Context, key string) (cacheEntry, bool) {
+	start := time.Now()
+	reply, release, err := hedge(rc.hedger, ctx, func(ctx context.Context, _ int) (any, error) {
+		return rc.client.do(ctx, "GET", rc.prefix+key)
+	}, nil)
+	release()
+	if ctx.Err() == nil {
+		// A request that gave up says nothing about Redis
+		cacheDependency.observe(start, err)
+	}
+	data, _ := reply.([]byte)
+	if err != nil || data == nil {
+		return cacheEntry{}, false
+	}
+
+	var stored redisCacheEntry
+	var value any
+	if err = json.Unmarshal(data, &stored); err == nil {
+		// The key says what was cached
+		if strings.HasPrefix(key, listCacheKey) {
+			var products []Product
+			err = json.Unmarshal(stored.Value, &products)
+			value = products
+		} else {
+			var product Product
+			err = json.Unmarshal(stored.Value, &product)
+			value = product
+		}
+	}
+	if err != nil {
+		log.Printf("cache: dropping unreadable redis entry %s: %v", key, err)
+		rc.del(key)
+		return cacheEntry{}, false
+	}
+	return cacheEntry{value: value, stored: stored.Stored}, true
+}
+
+func (rc *redisCache) set(key string, entry cacheEntry, ttl time.Duration, tags []string) {
+	value, err := json.Marshal(entry.value)
+	if err != nil {
+		return
+	}
+	data, _ := json.Marshal(redisCacheEntry{Stored: entry.stored, Value: value})
+	px := strconv.FormatInt(max(ttl.Milliseconds(), 1), 10)
+	// A tag's set lives as long as the newest entry under it
+	cmds := [][]string{{"SET", rc.prefix + key, string(data), "PX", px}}
+	for _, tag := range tags {
+		cmds = append(cmds, []string{"SADD", rc.tagKey(tag), rc.prefix + key}, []string{"PEXPIRE", rc.tagKey(tag), px})
+	}
+	if _, err := rc.pipeline(cmds...); err != nil {
+		log.Printf("cache: redis SET %s: %v", key, err)
+	}
+}
+
+func (rc *redisCache) del(keys ...string) {
+	args := []string{"DEL"}
+	for _, key := range keys {
+		args = append(args, rc.prefix+key)
+	}
+	if _, err := rc.do(args...); err != nil {
+		log.Printf("cache: redis DEL %v: %v", keys, err)
+	}
+}
+
+// invalidateTags reads the keys under the tags, then deletes them along
+// with the tags' sets
+func (rc *redisCache) invalidateTags(tags ...string) int {
+	cmds := make([][]string, len(tags))
+	for i, tag := range tags {
+		cmds[i] = []string{"SMEMBERS", rc.tagKey(tag)}
+	}
+	replies, err := rc.pipeline(cmds...)
+	if err != nil {
+		log.Printf("cache: redis SMEMBERS %v: %v", tags, err)
+		return 0
+	}
+
+	keys := []string{"DEL"}
+	for _, reply := range replies {
+		members, _ := reply.([]any)
+		for _, member := range members {
+			if member, ok := member.([]byte); ok {
+				keys = append(keys, string(member))
+			}
+		}
+	}
+	tagKeys := []string{"DEL"}
+	for _, tag := range tags {
+		tagKeys = append(tagKeys, rc.tagKey(tag))
+	}
+	if len(keys) == 1 {
+		if _, err := rc.do(tagKeys...); err != nil {
+			log.Printf("cache: redis DEL %v: %v", tags, err)
+		}
+		return 0
+	}
+	replies, err = rc.pipeline(keys, tagKeys)
+	if err != nil {
+		log.Printf("cache: redis DEL %v: %v", tags, err)
+		return 0
+	}
+	dropped, _ := replies[0].(int64)
+	return int(dropped)
+}
+
+// clear deletes every key under the prefix, a page of SCAN at a time
+func (rc *redisCache) clear() {
+	cursor := "0"
+	for {
+		reply, err := rc.do("SCAN", cursor, "MATCH", rc.prefix+"*", "COUNT", "500")
+		page, _ := reply.([]any)
+		if err != nil || len(page) != 2 {
+			log.Printf("cache: redis SCAN: %v", err)
+			return
+		}
+		next, _ := page[0].([]byte)
+		keys, _ := page[1].([]any)
+		if len(keys) > 0 {
+			args := []string{"DEL"}
+			for _, key := range keys {
+				if key, ok := key.([]byte); ok {
+					args = append(args, string(key))
+				}
+			}
+			if _, err := rc.do(args...); err != nil {
+				log.Printf("cache: redis DEL: %v", err)
+				return
+			}
+		}
+		if cursor = string(next); cursor == "0" || cursor == "" {
+			return
+		}
+	}
+}
+
+func (rc *redisCache) ping(ctx context.Context) error {
+	_, err := rc.client.do(ctx, "PING")
+	return err
+}
+
+// fetchProduct reads a product from the store and caches it. Concurrent
+// callers for the same product share one store lookup.
+func (pc *ProductCache) fetchProduct(key string) (Product, bool) {
+	val, exists := flights.do("product", key, func() (any, bool) {
+		store.mu.RLock()
+		defer store.mu.RUnlock()
+
+		p, exists := store.products[key]
+		if exists {
+			pc.set(productCacheKey(key), pc.product, p)
+		}
+		return p, exists
+	})
+	if !exists {
+		return Product{}, false
+	}
+	return val.(Product), true
+}
+
+// fetchList reads the products of a list query from the store and caches
+// the result under the query's tags. Concurrent callers of the same query
+// share one pass over the store.
+func (pc *ProductCache) fetchList(q listQuery) []Product {
+	val, _ := flights.do("list", q.key(), func() (any, bool) {
+		store.mu.RLock()
+		defer store.mu.RUnlock()
+
+		products := q.run(store.products)
+		pc.set(q.key(), pc.list, products, q.tags()...)
+		return products, true
+	})
+	return val.([]Product)
+}
+
+// load returns a product by key from the cache, falling back to the store
+// on a miss. Once ctx is done it returns nothing, so callers check it
+// first.
+func (pc *ProductCache) load(ctx context.Context, key string) (Product, bool) {
+	val, state := pc.get(ctx, productCacheKey(key), pc.product)
+	switch state {
+	case cacheFresh:
+		cacheHits.Add(1)
+		return val.(Product), true
+	case cacheStale:
+		cacheStaleHits.Add(1)
+		go pc.fetchProduct(key)
+		return val.(Product), true
+	}
+
+	if ctx.Err() != nil {
+		return Product{}, false
+	}
+	cacheMisses.Add(1)
+	return pc.fetchProduct(key)
+}
+
+// loadList returns the products of a list query from the cache, falling
+// back to the store. Once ctx is done it returns nothing, so callers check
+// it first.
+func (pc *ProductCache) loadList(ctx context.Context, q listQuery) []Product {
+	val, state := pc.get(ctx, q.key(), pc.list)
+	switch state {
+	case cacheFresh:
+		cacheHits.Add(1)
+		return val.([]Product)
+	case cacheStale:
+		cacheStaleHits.Add(1)
+		go pc.fetchList(q)
+		return val.([]Product)
+	}
+
+	if ctx.Err() != nil {
+		return nil
+	}
+	cacheMisses.Add(1)
+	return pc.fetchList(q)
+}
+
+// repair checks a cached product against the ETags a client sent on a
+// conditional read. A client that has already seen a newer version than the
+// cache holds means an invalidation was missed, so the entry is reloaded
+// from the store.
+func (pc *ProductCache) repair(cached Product, ifNoneMatch string) (Product, bool) {
+	if newestETagVersion(ifNoneMatch) <= cached.Version {
+		return cached, true
+	}
+
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	current, exists := store.products[cached.key()]
+	if !exists {
+		pc.invalidate(cached.key(), &cached, nil)
+		return Product{}, false
+	}
+	if current.Version != cached.Version {
+		pc.set(productCacheKey(current.key()), pc.product, current)
+		cacheRepairs.Add(1)
+	}
+	return current, true
+}
+
+// newestETagVersion returns the highest product version referenced in an
+// If-None-Match header, or 0 when there is none
+func newestETagVersion(header string) int64 {
+	var newest int64
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.Trim(strings.TrimPrefix(strings.TrimSpace(candidate), "W/"), `"`)
+		version, _, _ := strings.Cut(candidate, "-")
+		if v, err := strconv.ParseInt(version, 10, 64); err == nil && v > newest {
+			newest = v
+		}
+	}
+	return newest
+}
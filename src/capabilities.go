@@ -0,0 +1,145 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Capabilities describes what this deployment has turned on, so generic
+// clients can adapt instead of probing endpoints for 404s. It only
+// changes when the process restarts with a different configuration.
+type Capabilities struct {
+	APIVersions    []string           `json:"api_versions"`
+	DefaultVersion string             `json:"default_version"`
+	Formats        []string           `json:"formats"`
+	Interfaces     []string           `json:"interfaces"` // rest, graphql, stream, grpc
+	Auth           CapabilityAuth     `json:"auth"`
+	Storage        CapabilityStorage  `json:"storage"`
+	Features       map[string]bool    `json:"features"`
+	Limits         CapabilityLimits   `json:"limits"`
+	Currencies     CapabilityCurrency `json:"currencies"`
+}
+
+// CapabilityAuth lists how requests identify themselves
+type CapabilityAuth struct {
+	Modes []string `json:"modes"` // bearer (admin token), actor (X-Actor), anonymous
+	Admin bool     `json:"admin"` // admin-only endpoints can be used
+}
+
+// CapabilityStorage describes where the catalog lives
+type CapabilityStorage struct {
+	Backend     string `json:"backend"` // memory
+	WAL         bool   `json:"wal"`
+	File        bool   `json:"file"`        // STORE_FILE
+	Replication bool   `json:"replication"` // Raft
+	Sharding    bool   `json:"sharding"`
+	Cache       string `json:"cache"` // memory or redis
+}
+
+// CapabilityLimits are the limits clients are most likely to run into
+type CapabilityLimits struct {
+	MaxBodyBytes   int64 `json:"max_body_bytes"`
+	MaxJSONDepth   int   `json:"max_json_depth"`
+	MaxPrice       Money `json:"max_price"`
+	MaxBatchItems  int   `json:"max_batch_items"`
+	MaxVariants    int   `json:"max_variants"`
+	RequestTimeout int   `json:"request_timeout_seconds"` // 0 for none
+}
+
+// CapabilityCurrency says where exchange rates come from
+type CapabilityCurrency struct {
+	Default string `json:"default"`
+	Rates   string `json:"rates"` // static or http
+}
+
+// capabilities builds the capability document from the configuration
+func capabilities() Capabilities {
+	versions := make([]string, 0, len(apiVersions))
+	for version := range apiVersions {
+		versions = append(versions, version)
+	}
+	slices.Sort(versions)
+
+	interfaces := []string{"rest", "graphql", "stream"}
+	if grpcAddr != "" {
+		interfaces = append(interfaces, "grpc")
+	}
+	modes := []string{"actor", "anonymous"}
+	if adminToken != "" {
+		modes = append([]string{"bearer"}, modes...)
+	}
+	cacheBackend := "memory"
+	if _, ok := cache.backend.(*redisCache); ok {
+		cacheBackend = "redis"
+	}
+	rates := "static"
+	if cached, ok := exchangeRates.(*cachedRates); ok {
+		if _, ok := cached.provider.(*httpRates); ok {
+			rates = "http"
+		}
+	}
+
+	admin := adminToken != ""
+	return Capabilities{
+		APIVersions:    versions,
+		DefaultVersion: defaultAPIVersion,
+		Formats:        productFormats,
+		Interfaces:     interfaces,
+		Auth:           CapabilityAuth{Modes: modes, Admin: admin},
+		Storage: CapabilityStorage{
+			Backend:     "memory",
+			WAL:         walDir != "",
+			File:        storeFile != "",
+			Replication: replication != nil,
+			Sharding:    cluster != nil,
+			Cache:       cacheBackend,
+		},
+		Features: map[string]bool{
+			"search":               true,
+			"related_products":     flags.Load().flag(flagRelatedProducts).Enabled,
+			"reviews":              flags.Load().flag(flagReviews).Enabled,
+			"product_rules":        true,
+			"translations":         true,
+			"idempotency_keys":     true,
+			"async_requests":       flags.Load().flag(flagAsyncRequests).Enabled,
+			"field_selection":      flags.Load().flag(flagFieldSelection).Enabled,
+			"compression":          compressionEnabled,
+			"cors":                 corsPolicy != nil,
+			"backups":              backups != nil && cluster == nil && admin,
+			"snapshots":            admin && cluster == nil,
+			"audit_export":         segmentExporter != nil,
+			"event_destinations":   eventDelivery != nil,
+			"event_outbox":         outbox != nil,
+			"webhooks":             admin,
+			"imports":              admin,
+			"admin_dashboard":      admin,
+			"low_stock_alerts":     lowStockAlerts != nil,
+			"cdn_invalidation":     cdnDistribution != "",
+			"stock_ledger_only":    stockLedgerOnly,
+			"hedged_reads":         hedgeReads,
+			"route_policies":       routePoliciesFile != "",
+			"feature_flags":        flagsFile != "" || appConfigApp != "",
+			"shadow_comparison":    shadow != nil,
+			"fault_injection":      chaosBuilt,
+			"price_json_as_number": moneyAsNumber,
+		},
+		Limits: CapabilityLimits{
+			MaxBodyBytes:   maxBodyBytes,
+			MaxJSONDepth:   maxJSONDepth,
+			MaxPrice:       maxPrice,
+			MaxBatchItems:  maxBatchItems,
+			MaxVariants:    maxVariants,
+			RequestTimeout: int(requestTimeout.Seconds()),
+		},
+		Currencies: CapabilityCurrency{Default: defaultCurrency, Rates: rates},
+	}
+}
+
+// getCapabilities describes the features of this deployment
+// Returns: 200 OK - Capability document (Cat showing off its tricks!)
+func getCapabilities(c *gin.Context) {
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, capabilities())
+}
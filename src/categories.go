@@ -0,0 +1,383 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Categories are the category names products carry, so deleting one means
+// changing its products. A deletion is requested with what happens to
+// them, previewed, and applied only once an admin approves it, so a typo
+// can't empty a category.
+const (
+	cascadeUncategorize = "uncategorize" // clear the category of the products
+	cascadeDelete       = "delete"       // soft-delete the products
+)
+
+// Category deletion statuses
+const (
+	deletionPending  = "pending"
+	deletionApplied  = "applied"
+	deletionRejected = "rejected"
+	deletionStale    = "stale" // the products changed before approval
+)
+
+// CategoryDeletion is a request to delete a category. Products lists the
+// IDs it changes, as previewed when it was requested: every product in
+// the category when reassigning or uncategorizing, deleted ones included
+// so a restore doesn't bring the category back, and the live ones when
+// cascading deletes. Coupons scoped to the category are moved to the new
+// one, or lose it; those scoped to nothing else expire. Deletions are the
+// tenant's that requested them. Coupons are shared by every tenant, so
+// only the default tenant's deletions change them.
+type CategoryDeletion struct {
+	ID          string     `json:"id"`
+	Tenant      string     `json:"tenant,omitempty"`
+	Category    string     `json:"category"`
+	ReassignTo  string     `json:"reassign_to,omitempty"`
+	Cascade     string     `json:"cascade,omitempty"`
+	Status      string     `json:"status"`
+	Products    []string   `json:"products"`
+	Coupons     []string   `json:"coupons,omitempty"`
+	RequestedBy string     `json:"requested_by"`
+	RequestedAt time.Time  `json:"requested_at"`
+	DecidedBy   string     `json:"decided_by,omitempty"`
+	DecidedAt   *time.Time `json:"decided_at,omitempty"`
+	Reason      string     `json:"reason,omitempty"`
+}
+
+// CategoryDeletionRequest is the body of a deletion request; one of
+// ReassignTo and Cascade is needed when the category has products
+type CategoryDeletionRequest struct {
+	ReassignTo string `json:"reassign_to"`
+	Cascade    string `json:"cascade" binding:"omitempty,oneof=uncategorize delete"`
+}
+
+// CategoryDeletionStore keeps our in-memory deletion requests
+type CategoryDeletionStore struct {
+	mu        sync.Mutex
+	seq       int64
+	deletions map[string]CategoryDeletion
+}
+
+// Global category deletion store
+var categoryDeletions = &CategoryDeletionStore{
+	deletions: make(map[string]CategoryDeletion),
+}
+
+// affectedProducts returns the IDs of the products a deletion changes, in
+// order. Callers must hold store.mu.
+func (d *CategoryDeletion) affectedProducts() []string {
+	ids := []string{}
+	for _, key := range sortedProductKeys() {
+		p := store.products[key]
+		if p.Tenant == d.Tenant && p.Category == d.Category && (d.Cascade != cascadeDelete || p.DeletedAt == nil) {
+			ids = append(ids, p.ID)
+		}
+	}
+	return ids
+}
+
+// affectedCoupons returns the codes of the coupons scoped to the category,
+// in order. Callers must hold coupons.mu.
+func (d *CategoryDeletion) affectedCoupons() []string {
+	var codes []string
+	if d.Tenant != "" {
+		return codes
+	}
+	for code, cp := range coupons.coupons {
+		if slices.Contains(cp.Categories, d.Category) {
+			codes = append(codes, code)
+		}
+	}
+	sort.Strings(codes)
+	return codes
+}
+
+// apply makes the changes of a deletion, all of them or none: when a
+// product write fails, the products already written are put back as they
+// were, with new versions, and the coupons are left alone. Callers must
+// hold store.mu and coupons.mu.
+func (d *CategoryDeletion) apply(c *gin.Context) error {
+	now := time.Now().UTC()
+	var befores, afters []Product
+	for _, id := range d.Products {
+		product := store.products[productKey(d.Tenant, id)]
+		before := product
+		switch {
+		case d.ReassignTo != "":
+			product.Category = d.ReassignTo
+		case d.Cascade == cascadeDelete:
+			product.DeletedAt = &now
+		default:
+			product.Category = ""
+		}
+		if err := store.save(&product); err != nil {
+			if undoErr := restoreProducts(befores); undoErr != nil {
+				return fmt.Errorf("%v, and putting back the products already changed failed: %v", err, undoErr)
+			}
+			return err
+		}
+		befores, afters = append(befores, before), append(afters, product)
+	}
+	for i := range befores {
+		audit.record(c, "category.delete", &befores[i], &afters[i])
+	}
+
+	for _, code := range d.Coupons {
+		cp := coupons.coupons[code]
+		categories := slices.DeleteFunc(slices.Clone(cp.Categories), func(category string) bool { return category == d.Category })
+		switch {
+		case d.ReassignTo != "" && !slices.Contains(categories, d.ReassignTo):
+			categories = append(categories, d.ReassignTo)
+		case len(categories) == 0 && len(cp.Products) == 0:
+			// Without a scope it would apply to every product
+			cp.ValidUntil = &now
+		}
+		cp.Categories = categories
+		coupons.coupons[code] = cp
+	}
+	return nil
+}
+
+// restoreProducts writes products back as they were, the last written
+// first, keeping their versions moving forward. Callers must hold store.mu.
+func restoreProducts(products []Product) error {
+	for i := len(products) - 1; i >= 0; i-- {
+		product := products[i]
+		product.Version = store.products[product.key()].Version
+		if err := store.save(&product); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func categoryDeletionNotFound(c *gin.Context, id string) {
+	c.JSON(http.StatusNotFound, gin.H{
+		"error": "Category deletion not found",
+		"id":    id,
+	})
+}
+
+// requestCategoryDeletion asks to delete a category, with a preview of
+// the products and coupons it changes. The caller needs an X-Actor
+// identity or the admin token; nothing changes until an admin approves.
+// The body can be left out for a category only coupons use.
+// Returns: 201 Created - Pending, with the preview (Cat tidying the shelves!)
+// Returns: 400 Bad Request - Products need reassign_to or cascade, or invalid options
+// Returns: 401 Unauthorized - No X-Actor identity
+// Returns: 404 Not Found - No product or coupon has the category
+// Returns: 409 Conflict - Sharding is enabled
+func requestCategoryDeletion(c *gin.Context) {
+	category := c.Param("name")
+	requester := actor(c)
+	if requester == "anonymous" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Category deletions require an X-Actor identity"})
+		return
+	}
+	if cluster != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Sharded catalogs can't delete categories, each shard holds part of them"})
+		return
+	}
+
+	var req CategoryDeletionRequest
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":   "Invalid category deletion",
+			"details": err.Error(),
+		})
+		return
+	}
+	var violations []Violation
+	normalizeText(&req.ReassignTo, "reassign_to", maxCategoryLength, &violations)
+	switch {
+	case len(violations) > 0:
+		invalidRequest(c, "Invalid category deletion", violations)
+		return
+	case req.ReassignTo != "" && req.Cascade != "":
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid category deletion", "details": "Set reassign_to or cascade, not both"})
+		return
+	case req.ReassignTo == category:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid category deletion", "details": "Can't reassign a category to itself"})
+		return
+	}
+
+	deletion := CategoryDeletion{
+		Tenant:      tenantOf(c),
+		Category:    category,
+		ReassignTo:  req.ReassignTo,
+		Cascade:     req.Cascade,
+		Status:      deletionPending,
+		RequestedBy: requester,
+		RequestedAt: time.Now().UTC(),
+	}
+	store.mu.RLock()
+	deletion.Products = deletion.affectedProducts()
+	inUse := false
+	for _, p := range store.products {
+		inUse = inUse || p.Tenant == deletion.Tenant && p.Category == category
+	}
+	store.mu.RUnlock()
+	coupons.mu.RLock()
+	deletion.Coupons = deletion.affectedCoupons()
+	coupons.mu.RUnlock()
+
+	switch {
+	case !inUse && len(deletion.Coupons) == 0:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Category not found", "category": category})
+		return
+	case len(deletion.Products) > 0 && req.ReassignTo == "" && req.Cascade == "":
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":    "Category has products, set reassign_to or cascade",
+			"category": category,
+			"products": deletion.Products,
+		})
+		return
+	}
+
+	categoryDeletions.mu.Lock()
+	categoryDeletions.seq++
+	deletion.ID = strconv.FormatInt(categoryDeletions.seq, 10)
+	categoryDeletions.deletions[deletion.ID] = deletion
+	categoryDeletions.mu.Unlock()
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message":  fmt.Sprintf("Deletion of category %s is waiting for approval", category),
+		"deletion": deletion,
+	})
+}
+
+// getCategoryDeletions lists category deletions, newest first, of a
+// ?status= if given
+// Returns: 200 OK - Success
+func getCategoryDeletions(c *gin.Context) {
+	tenant, status := tenantOf(c), c.Query("status")
+
+	categoryDeletions.mu.Lock()
+	list := make([]CategoryDeletion, 0, len(categoryDeletions.deletions))
+	for _, d := range categoryDeletions.deletions {
+		if d.Tenant == tenant && (status == "" || d.Status == status) {
+			list = append(list, d)
+		}
+	}
+	categoryDeletions.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].RequestedAt.After(list[j].RequestedAt) })
+
+	c.JSON(http.StatusOK, gin.H{
+		"count":     len(list),
+		"deletions": list,
+	})
+}
+
+// getCategoryDeletion returns a category deletion and its preview
+// Returns: 200 OK - Success
+// Returns: 404 Not Found - Deletion doesn't exist
+func getCategoryDeletion(c *gin.Context) {
+	id := c.Param("id")
+
+	categoryDeletions.mu.Lock()
+	deletion, exists := categoryDeletions.deletions[id]
+	categoryDeletions.mu.Unlock()
+	if !exists || deletion.Tenant != tenantOf(c) {
+		categoryDeletionNotFound(c, id)
+		return
+	}
+	c.JSON(http.StatusOK, deletion)
+}
+
+// approveCategoryDeletion applies a pending deletion in one step: every
+// product and coupon changes under the same locks, or none does, as a
+// failed write puts back the products written before it. If the
+// products in the category changed since the preview, nothing is applied
+// and the deletion goes stale with the new preview, to be requested again.
+// Returns: 200 OK - Applied (Cat sweeping up!)
+// Returns: 404 Not Found - Deletion doesn't exist
+// Returns: 409 Conflict - Not pending, or went stale
+// Returns: 503 Service Unavailable - A write failed, nothing was applied, with Retry-After
+func approveCategoryDeletion(c *gin.Context) {
+	id := c.Param("id")
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	coupons.mu.Lock()
+	defer coupons.mu.Unlock()
+	categoryDeletions.mu.Lock()
+	defer categoryDeletions.mu.Unlock()
+
+	deletion, exists := categoryDeletions.deletions[id]
+	if !exists || deletion.Tenant != tenantOf(c) {
+		categoryDeletionNotFound(c, id)
+		return
+	}
+	if deletion.Status != deletionPending {
+		c.JSON(http.StatusConflict, gin.H{"error": "Category deletion is " + deletion.Status, "id": id})
+		return
+	}
+
+	now := time.Now().UTC()
+	deletion.DecidedBy, deletion.DecidedAt = actor(c), &now
+	if products := deletion.affectedProducts(); !slices.Equal(products, deletion.Products) {
+		deletion.Status = deletionStale
+		deletion.Reason = "products in the category changed since the preview"
+		categoryDeletions.deletions[id] = deletion
+		c.JSON(http.StatusConflict, gin.H{
+			"error":    "Products in the category changed since the preview, nothing was deleted",
+			"id":       id,
+			"products": products,
+		})
+		return
+	}
+	deletion.Coupons = deletion.affectedCoupons()
+	if err := deletion.apply(c); err != nil {
+		writeFailed(c, err)
+		return
+	}
+	deletion.Status = deletionApplied
+	categoryDeletions.deletions[id] = deletion
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":  fmt.Sprintf("Category %s deleted", deletion.Category),
+		"deletion": deletion,
+	})
+}
+
+// rejectCategoryDeletion turns down a pending deletion, with an optional
+// ?reason=
+// Returns: 200 OK - Rejected
+// Returns: 404 Not Found - Deletion doesn't exist
+// Returns: 409 Conflict - Not pending
+func rejectCategoryDeletion(c *gin.Context) {
+	id := c.Param("id")
+
+	categoryDeletions.mu.Lock()
+	defer categoryDeletions.mu.Unlock()
+
+	deletion, exists := categoryDeletions.deletions[id]
+	if !exists || deletion.Tenant != tenantOf(c) {
+		categoryDeletionNotFound(c, id)
+		return
+	}
+	if deletion.Status != deletionPending {
+		c.JSON(http.StatusConflict, gin.H{"error": "Category deletion is " + deletion.Status, "id": id})
+		return
+	}
+	now := time.Now().UTC()
+	deletion.Status, deletion.DecidedBy, deletion.DecidedAt = deletionRejected, actor(c), &now
+	deletion.Reason = c.Query("reason")
+	categoryDeletions.deletions[id] = deletion
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":  "Category deletion rejected",
+		"deletion": deletion,
+	})
+}
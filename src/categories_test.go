@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestCategoryDeletionAllOrNothing(t *testing.T) {
+	router := newTestRouter(t)
+	for _, id := range []string{"lamp-1", "lamp-2", "lamp-3"} {
+		mustCreate(t, router, `{"id": "`+id+`", "name": "Lamp", "description": "A lamp", "category": "lamps", "price": "10.00", "currency": "USD", "stock": 1}`)
+	}
+	coupons.mu.Lock()
+	coupons.coupons["LAMPS10"] = Coupon{Code: "LAMPS10", Type: "percentage", Percent: 10, Categories: []string{"lamps"}}
+	coupons.mu.Unlock()
+	defer func() {
+		coupons.mu.Lock()
+		delete(coupons.coupons, "LAMPS10")
+		coupons.mu.Unlock()
+	}()
+
+	w := serve(router, "POST", "/v1/categories/lamps/deletions", `{"reassign_to": "lights"}`, "X-Actor", "editor")
+	if w.Code != http.StatusCreated {
+		t.Fatalf("request: %d %s", w.Code, w.Body)
+	}
+	var resp struct{ Deletion CategoryDeletion }
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	deletion := resp.Deletion
+
+	// The last product's write fails
+	defer func(r *RaftNode) { replication = r }(replication)
+	replication = &RaftNode{applyFn: func(rec walRecord) error {
+		if rec.ID == "lamp-3" && rec.Product.Category == "lights" {
+			return errors.New("disk full")
+		}
+		return store.apply(rec)
+	}}
+	if w := serve(router, "POST", "/v1/category-deletions/"+deletion.ID+"/approve", "", asAdmin...); w.Code < http.StatusInternalServerError {
+		t.Fatalf("approve: %d %s, want a failure", w.Code, w.Body)
+	}
+
+	for _, id := range deletion.Products {
+		if p := store.products[id]; p.Category != "lamps" {
+			t.Errorf("%s is in %q, want lamps", id, p.Category)
+		}
+	}
+	if cp := coupons.coupons["LAMPS10"]; len(cp.Categories) != 1 || cp.Categories[0] != "lamps" {
+		t.Errorf("coupon categories = %v, want [lamps]", cp.Categories)
+	}
+}
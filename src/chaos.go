@@ -0,0 +1,292 @@
+//go:build chaos
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Fault injection lets client teams and load tests check their retries
+// and timeouts against a misbehaving service. It's only compiled into
+// builds tagged chaos (go build -tags chaos); the production image is
+// built without the tag, so there's nothing to turn on there, whatever
+// the environment says.
+const chaosBuilt = true
+
+// chaosFile declares the faults to inject from the start, CHAOS_FILE,
+// JSON or YAML. PUT /admin/chaos replaces them at runtime.
+var chaosFile = os.Getenv("CHAOS_FILE")
+
+// chaosRoute is where faults are managed, never faulted itself so a rule
+// on /* can still be cleared
+const chaosRoute = "/admin/chaos"
+
+// ChaosRule injects faults into the requests of the routes it matches.
+// The first rule matching a request's route and method applies. Latency
+// comes first, then at most one of a storage error or another 5xx.
+type ChaosRule struct {
+	Name string `json:"name"`
+	// Routes are route patterns without the version, such as /products,
+	// /products/:id or /admin/*
+	Routes           []string `json:"routes"`
+	Methods          []string `json:"methods,omitempty"`            // all when empty
+	Latency          string   `json:"latency,omitempty"`            // added to every request, e.g. 200ms
+	Jitter           string   `json:"jitter,omitempty"`             // up to this much more, at random
+	ErrorRate        float64  `json:"error_rate,omitempty"`         // share answered with one of error_statuses
+	ErrorStatuses    []int    `json:"error_statuses,omitempty"`     // 5xx, 503 by default
+	StorageErrorRate float64  `json:"storage_error_rate,omitempty"` // share answered as if storage were down
+
+	latency, jitter                time.Duration
+	delayed, errors, storageErrors atomic.Int64
+}
+
+// chaosRuleSet is the rules in force and where they came from
+type chaosRuleSet struct {
+	rules    []*ChaosRule
+	source   string
+	loadedAt time.Time
+}
+
+// Global fault injection rules, swapped whole when replaced
+var chaosRules atomic.Pointer[chaosRuleSet]
+
+func init() {
+	set := &chaosRuleSet{loadedAt: time.Now().UTC()}
+	if chaosFile != "" {
+		data, err := os.ReadFile(chaosFile)
+		if err == nil {
+			if ext := strings.ToLower(filepath.Ext(chaosFile)); ext == ".yaml" || ext == ".yml" {
+				data, err = yamlToJSON(data)
+			}
+		}
+		if err == nil {
+			set, err = parseChaosRules(data, chaosFile)
+		}
+		if err != nil {
+			panic(fmt.Sprintf("CHAOS_FILE: %v", err))
+		}
+	}
+	chaosRules.Store(set)
+}
+
+// parseChaosRules reads and checks {"rules": [...]}
+func parseChaosRules(data []byte, source string) (*chaosRuleSet, error) {
+	var file struct {
+		Rules []*ChaosRule `json:"rules"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+	names := make(map[string]bool, len(file.Rules))
+	for i, r := range file.Rules {
+		if r.Name == "" {
+			r.Name = "rule-" + strconv.Itoa(i+1)
+		}
+		if names[r.Name] {
+			return nil, fmt.Errorf("rule %s is declared twice", r.Name)
+		}
+		names[r.Name] = true
+		if err := r.prepare(); err != nil {
+			return nil, fmt.Errorf("rule %s: %v", r.Name, err)
+		}
+	}
+	return &chaosRuleSet{rules: file.Rules, source: source, loadedAt: time.Now().UTC()}, nil
+}
+
+// prepare checks a rule and fills in the defaults
+func (r *ChaosRule) prepare() error {
+	if len(r.Routes) == 0 {
+		return fmt.Errorf("routes is required")
+	}
+	for _, route := range r.Routes {
+		if !strings.HasPrefix(route, "/") {
+			return fmt.Errorf("route %q must start with /", route)
+		}
+	}
+	for i, method := range r.Methods {
+		r.Methods[i] = strings.ToUpper(method)
+	}
+	for _, d := range []struct {
+		name  string
+		value string
+		into  *time.Duration
+	}{{"latency", r.Latency, &r.latency}, {"jitter", r.Jitter, &r.jitter}} {
+		if d.value == "" {
+			continue
+		}
+		parsed, err := time.ParseDuration(d.value)
+		if err != nil || parsed < 0 {
+			return fmt.Errorf("%s must be a duration such as 200ms", d.name)
+		}
+		*d.into = parsed
+	}
+	if r.ErrorRate < 0 || r.StorageErrorRate < 0 || r.ErrorRate+r.StorageErrorRate > 1 {
+		return fmt.Errorf("error_rate and storage_error_rate must be between 0 and 1, and add up to at most 1")
+	}
+	if len(r.ErrorStatuses) == 0 {
+		r.ErrorStatuses = []int{http.StatusServiceUnavailable}
+	}
+	for _, status := range r.ErrorStatuses {
+		if status < 500 || status > 599 {
+			return fmt.Errorf("error_statuses must be 5xx, not %d", status)
+		}
+	}
+	return nil
+}
+
+// delay is how long to hold a request
+func (r *ChaosRule) delay() time.Duration {
+	if r.jitter <= 0 {
+		return r.latency
+	}
+	return r.latency + rand.N(r.jitter)
+}
+
+// injectFaults delays and fails requests as the rule of their route says.
+// Responses it touches carry X-Chaos-Rule, so tests can tell injected
+// faults from real ones.
+// Returns: 503 Service Unavailable - Injected storage error, with Retry-After
+// Returns: 5xx - Injected error, one of the rule's error_statuses
+// Returns: 504 Gateway Timeout - The latency outlasted REQUEST_TIMEOUT
+func injectFaults() gin.HandlerFunc {
+	log.Printf("chaos: fault injection is compiled in, %d rules in force", len(chaosRules.Load().rules))
+	return func(c *gin.Context) {
+		// Unversioned paths get their route when unversionedRoute routes
+		// them again, and their faults then
+		route := versionedPath.ReplaceAllString(c.FullPath(), "/")
+		if route == "" || route == chaosRoute {
+			c.Next()
+			return
+		}
+		var rule *ChaosRule
+		for _, r := range chaosRules.Load().rules {
+			if routeMatches(r.Routes, r.Methods, route, c.Request.Method) {
+				rule = r
+				break
+			}
+		}
+		if rule == nil {
+			c.Next()
+			return
+		}
+		c.Header("X-Chaos-Rule", rule.Name)
+
+		if delay := rule.delay(); delay > 0 {
+			rule.delayed.Add(1)
+			timer := time.NewTimer(delay)
+			select {
+			case <-timer.C:
+			case <-c.Request.Context().Done():
+				timer.Stop()
+			}
+			if requestCanceled(c) {
+				return
+			}
+		}
+
+		switch roll := rand.Float64(); {
+		case roll < rule.StorageErrorRate:
+			// Shaped like dependencyUnavailable, as a backend outage is
+			rule.storageErrors.Add(1)
+			c.Header("Retry-After", "1")
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{
+				"error":       "A dependency is unavailable, try again later",
+				"dependency":  "storage",
+				"retry_after": 1,
+			})
+			return
+		case roll < rule.StorageErrorRate+rule.ErrorRate:
+			rule.errors.Add(1)
+			status := rule.ErrorStatuses[rand.IntN(len(rule.ErrorStatuses))]
+			c.AbortWithStatusJSON(status, gin.H{
+				"error": http.StatusText(status),
+			})
+			return
+		}
+		c.Next()
+	}
+}
+
+// registerChaosRoutes registers the admin API of fault injection
+func registerChaosRoutes(r gin.IRouter) {
+	r.GET(chaosRoute, requireOperator(), getChaosRules)
+	r.PUT(chaosRoute, requireOperator(), putChaosRules)
+	r.DELETE(chaosRoute, requireOperator(), deleteChaosRules)
+}
+
+// chaosRuleView is a rule as the admin API shows it
+type chaosRuleView struct {
+	*ChaosRule
+	Delayed       int64 `json:"delayed"` // since the rule was loaded
+	Errors        int64 `json:"errors"`
+	StorageErrors int64 `json:"storage_errors"`
+}
+
+func viewChaosRules(set *chaosRuleSet) gin.H {
+	views := make([]chaosRuleView, len(set.rules))
+	for i, r := range set.rules {
+		views[i] = chaosRuleView{
+			ChaosRule:     r,
+			Delayed:       r.delayed.Load(),
+			Errors:        r.errors.Load(),
+			StorageErrors: r.storageErrors.Load(),
+		}
+	}
+	return gin.H{
+		"source":    set.source,
+		"loaded_at": set.loadedAt,
+		"count":     len(views),
+		"rules":     views,
+	}
+}
+
+// getChaosRules lists the fault injection rules in force, with what each
+// has injected
+// Returns: 200 OK - Success (Cat knocking things off the table!)
+// Returns: 401 Unauthorized - Admin access required
+func getChaosRules(c *gin.Context) {
+	c.JSON(http.StatusOK, viewChaosRules(chaosRules.Load()))
+}
+
+// putChaosRules replaces the fault injection rules on this instance, with
+// a body shaped like CHAOS_FILE
+// Returns: 200 OK - Replaced, the new rules
+// Returns: 400 Bad Request - Invalid rules, the current ones stay
+// Returns: 401 Unauthorized - Admin access required
+func putChaosRules(c *gin.Context) {
+	body, err := c.GetRawData()
+	if err == nil {
+		var set *chaosRuleSet
+		if set, err = parseChaosRules(body, "api"); err == nil {
+			chaosRules.Store(set)
+			log.Printf("chaos: %s set %d rules", actor(c), len(set.rules))
+			c.JSON(http.StatusOK, viewChaosRules(set))
+			return
+		}
+	}
+	c.JSON(http.StatusBadRequest, gin.H{
+		"error":   "Invalid chaos rules",
+		"details": err.Error(),
+	})
+}
+
+// deleteChaosRules stops injecting faults on this instance
+// Returns: 204 No Content - Cleared
+// Returns: 401 Unauthorized - Admin access required
+func deleteChaosRules(c *gin.Context) {
+	chaosRules.Store(&chaosRuleSet{source: "api", loadedAt: time.Now().UTC()})
+	log.Printf("chaos: %s cleared the rules", actor(c))
+	c.Status(http.StatusNoContent)
+}
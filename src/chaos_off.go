@@ -0,0 +1,17 @@
+//go:build !chaos
+
+package main
+
+import "github.com/gin-gonic/gin"
+
+// Fault injection is left out of builds without the chaos tag, the
+// production image among them; see chaos.go
+const chaosBuilt = false
+
+// injectFaults has nothing to inject
+func injectFaults() gin.HandlerFunc {
+	return nil
+}
+
+// registerChaosRoutes has no routes to register
+func registerChaosRoutes(r gin.IRouter) {}
@@ -0,0 +1,503 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// productctl manages a catalog from the command line, through the same
+// store, validation, import pipeline and migrations as the server. It
+// runs as "server productctl <command>", or as productctl when the binary
+// is linked under that name. Store commands open WAL_DIR or STORE_FILE
+// directly, so the server using it must be stopped first.
+type cliCommand struct {
+	name    string
+	usage   string
+	summary string
+	store   bool // works on the products in WAL_DIR or STORE_FILE
+	run     func(args []string) error
+}
+
+var cliCommands = []cliCommand{
+	{"seed", "seed [-policy upsert|insert] [fixture]", "Seed products from a fixture, the missing samples without one", true, cliSeed},
+	{"export", "export [-format csv|jsonl] [-o file]", "Write every product, deleted ones included", true, cliExport},
+	{"import", "import [-format csv|jsonl] [-mapping mapping.json] [-tenant tenant] file", "Create or replace products from a file, - for stdin", true, cliImport},
+	{"stock get", "stock get [-tenant tenant] id", "Print the stock of a product and its variants", true, cliStockGet},
+	{"stock set", "stock set [-sku sku] [-tenant tenant] id quantity", "Set the stock of a product, or of one variant", true, cliStockSet},
+	{"migrate", "migrate [-timeout 10m]", "Apply pending migrations in MIGRATIONS_BUCKET", false, cliMigrate},
+	{"backup list", "backup list", "List the catalog backups in BACKUP_BUCKET", false, cliBackupList},
+	{"backup create", "backup create", "Snapshot the catalog to BACKUP_BUCKET", true, cliBackupCreate},
+	{"backup restore", "backup restore [-policy overwrite|skip|fail] [-prune] [-dry-run] name", "Restore the catalog from a backup", true, cliBackupRestore},
+}
+
+// errUsage is returned for bad arguments, after the flag set has
+// described them
+var errUsage = errors.New("usage")
+
+// productctlArgs returns the command line of productctl, if that's how
+// the binary was started
+func productctlArgs() ([]string, bool) {
+	if filepath.Base(os.Args[0]) == "productctl" {
+		return os.Args[1:], true
+	}
+	if len(os.Args) > 1 && os.Args[1] == "productctl" {
+		return os.Args[2:], true
+	}
+	return nil, false
+}
+
+// productctl runs a command and returns the exit code
+func productctl(args []string) int {
+	cmd, rest, ok := findCLICommand(args)
+	if !ok {
+		cliUsage()
+		return 2
+	}
+	// Keep stdout for the command's output
+	audit.out.SetOutput(os.Stderr)
+
+	if cmd.store {
+		if err := openCLIStore(); err != nil {
+			fmt.Fprintf(os.Stderr, "productctl: %v\n", err)
+			return 1
+		}
+	}
+	err := cmd.run(rest)
+	if cmd.store {
+		var syncErr error
+		if store.wal != nil {
+			syncErr = store.wal.sync()
+		} else {
+			syncErr = store.file.save()
+		}
+		if err == nil {
+			err = syncErr
+		}
+	}
+	switch {
+	case errors.Is(err, errUsage):
+		fmt.Fprintf(os.Stderr, "usage: productctl %s\n", cmd.usage)
+		return 2
+	case err != nil:
+		fmt.Fprintf(os.Stderr, "productctl %s: %v\n", cmd.name, err)
+		return 1
+	}
+	return 0
+}
+
+func findCLICommand(args []string) (cliCommand, []string, bool) {
+	for _, cmd := range cliCommands {
+		words := strings.Fields(cmd.name)
+		if len(args) >= len(words) && strings.Join(args[:len(words)], " ") == cmd.name {
+			return cmd, args[len(words):], true
+		}
+	}
+	return cliCommand{}, nil, false
+}
+
+func cliUsage() {
+	fmt.Fprintln(os.Stderr, "usage: productctl <command> [flags]")
+	fmt.Fprintln(os.Stderr)
+	for _, cmd := range cliCommands {
+		fmt.Fprintf(os.Stderr, "  %-55s %s\n", cmd.usage, cmd.summary)
+	}
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "Store commands work on WAL_DIR or STORE_FILE; stop the server using it first.")
+}
+
+// openCLIStore loads the catalog from WAL_DIR or STORE_FILE. Without them
+// there is only the sample data, and writes would be lost on exit.
+// Replicated and sharded catalogs span instances, so they're left to the
+// admin API.
+func openCLIStore() error {
+	switch {
+	case replication != nil:
+		return errors.New("RAFT_SELF is set; change a replicated catalog through the API")
+	case cluster != nil:
+		return errors.New("SHARD_SELF is set; change a sharded catalog through the API")
+	case walDir != "" && storeFile != "":
+		return errors.New("set WAL_DIR or STORE_FILE, not both")
+	case storeFile != "":
+		return store.loadStoreFile(storeFile)
+	case walDir == "":
+		return errors.New("WAL_DIR and STORE_FILE are not set, there is no catalog to open")
+	}
+	return store.recoverFromWAL(walDir)
+}
+
+// newCLIFlags returns a flag set whose errors are reported as errUsage
+func newCLIFlags(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet("productctl "+name, flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	return fs
+}
+
+// cliSeed seeds like startup does, except that SEED=off doesn't apply and
+// the missing samples are added back to any catalog. Samples leave
+// existing products alone unless -policy says otherwise.
+func cliSeed(args []string) error {
+	fs := newCLIFlags("seed")
+	policy := fs.String("policy", "", "upsert or insert, for products already in the catalog (default SEED_POLICY, insert for the samples)")
+	if fs.Parse(args) != nil || fs.NArg() > 1 {
+		return errUsage
+	}
+
+	products := sampleProducts
+	if fs.NArg() == 1 {
+		fixture, err := readFixture(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		products = fixture
+		if *policy == "" {
+			*policy = envString("SEED_POLICY", seedUpsert)
+		}
+	} else if *policy == "" {
+		*policy = seedInsert
+	}
+	summary, err := seed(products, *policy)
+	if err != nil {
+		return err
+	}
+	out, _ := json.MarshalIndent(summary, "", "  ")
+	fmt.Println(string(out))
+	return nil
+}
+
+func cliExport(args []string) error {
+	fs := newCLIFlags("export")
+	format := fs.String("format", "csv", "csv or jsonl")
+	output := fs.String("o", "-", "file to write, - for stdout")
+	if fs.Parse(args) != nil || fs.NArg() > 0 || *format != "csv" && *format != "jsonl" {
+		return errUsage
+	}
+
+	products := store.cut().products
+
+	out := io.Writer(os.Stdout)
+	if *output != "-" {
+		f, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+	if *format == "csv" {
+		return encodeProductsCSV(out, products)
+	}
+	enc := jsonCodec{}.NewEncoder(out)
+	for _, p := range products {
+		if err := enc.Encode(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func cliImport(args []string) error {
+	fs := newCLIFlags("import")
+	format := fs.String("format", "", "csv or jsonl, from the file extension by default")
+	mappingPath := fs.String("mapping", "", "import mapping for CSV or XML feeds, as PUT to /admin/import-mappings")
+	tenant := cliTenantFlag(fs)
+	if fs.Parse(args) != nil || fs.NArg() != 1 {
+		return errUsage
+	}
+	if err := checkCLITenant(*tenant); err != nil {
+		return err
+	}
+	path := fs.Arg(0)
+	if *format == "" {
+		*format = strings.TrimPrefix(filepath.Ext(path), ".")
+	}
+
+	in := io.Reader(os.Stdin)
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	body := &trackedReader{r: in}
+
+	var dec RecordDecoder
+	resumable := mappingResumable
+	switch {
+	case *mappingPath != "":
+		mapping, err := readCLIMapping(*mappingPath)
+		if err != nil {
+			return err
+		}
+		dec = mapping.newDecoder(body)
+	case *format == "csv":
+		// The header is read twice: here for the columns present, then by
+		// the decoder
+		br := bufio.NewReader(body)
+		line, err := br.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		header, _ := csv.NewReader(strings.NewReader(line)).Read()
+		dec = exportCSVMapping(header).newDecoder(io.MultiReader(strings.NewReader(line), br))
+	case *format == "jsonl":
+		dec, resumable = jsonCodec{}.NewDecoder(body), jsonCodec{}.Resumable
+	default:
+		return fmt.Errorf("can't tell the format of %s, pass -format", path)
+	}
+
+	summary, abort := runImport(context.Background(), nil, *tenant, dec, body, resumable)
+	out, _ := json.MarshalIndent(summary, "", "  ")
+	fmt.Println(string(out))
+	if abort == nil && summary.Invalid+summary.Failed > 0 {
+		abort = fmt.Errorf("%d records not imported", summary.Invalid+summary.Failed)
+	}
+	return abort
+}
+
+// readCLIMapping reads and checks an import mapping file
+func readCLIMapping(path string) (ImportMapping, error) {
+	var mapping ImportMapping
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return mapping, err
+	}
+	if violations := decodeStrict(data, &mapping); violations != nil {
+		return mapping, fmt.Errorf("%s: %s", path, violationSummary(violations))
+	}
+	if mapping.Name == "" {
+		mapping.Name = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	}
+	if violations := mappingViolations(&mapping); len(violations) > 0 {
+		return mapping, fmt.Errorf("%s: %s", path, violationSummary(violations))
+	}
+	return mapping, nil
+}
+
+// exportCSVMapping reads the CSV that export writes, mapping the columns
+// of header named after product fields. Others, such as version, are
+// ignored.
+func exportCSVMapping(header []string) ImportMapping {
+	mapping := ImportMapping{Name: "export", Format: mappingCSV}
+	for _, column := range header {
+		column = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(column, "\ufeff")))
+		if slices.Contains(mappableFields, column) {
+			mapping.Fields = append(mapping.Fields, FieldMapping{Field: column, Column: column})
+		}
+	}
+	mappingViolations(&mapping)
+	return mapping
+}
+
+// cliTenantFlag adds -tenant, the tenant whose catalog a command works
+// on, to a command's flags
+func cliTenantFlag(fs *flag.FlagSet) *string {
+	return fs.String("tenant", "", "tenant whose products to use, from TENANTS (default the default tenant)")
+}
+
+// checkCLITenant checks that -tenant names a tenant in TENANTS
+func checkCLITenant(tenant string) error {
+	if _, exists := tenantTokens[tenant]; tenant != "" && !exists {
+		return fmt.Errorf("tenant %s not found in TENANTS", tenant)
+	}
+	return nil
+}
+
+func cliStockGet(args []string) error {
+	fs := newCLIFlags("stock get")
+	tenant := cliTenantFlag(fs)
+	if fs.Parse(args) != nil || fs.NArg() != 1 {
+		return errUsage
+	}
+	if err := checkCLITenant(*tenant); err != nil {
+		return err
+	}
+	id := fs.Arg(0)
+	store.mu.RLock()
+	product, exists := store.get(productKey(*tenant, id))
+	store.mu.RUnlock()
+	if !exists {
+		return fmt.Errorf("product %s not found", id)
+	}
+
+	fmt.Printf("%s\t%d\n", product.ID, product.Stock)
+	for _, v := range product.Variants {
+		fmt.Printf("%s\t%s\t%d\n", product.ID, v.SKU, v.Stock)
+	}
+	return nil
+}
+
+func cliStockSet(args []string) error {
+	fs := newCLIFlags("stock set")
+	sku := fs.String("sku", "", "variant to set, required for products with variants")
+	tenant := cliTenantFlag(fs)
+	if fs.Parse(args) != nil || fs.NArg() != 2 {
+		return errUsage
+	}
+	if err := checkCLITenant(*tenant); err != nil {
+		return err
+	}
+	id := fs.Arg(0)
+	quantity, err := strconv.Atoi(fs.Arg(1))
+	if err != nil || quantity < 0 {
+		return fmt.Errorf("quantity must be a whole number, not %q", fs.Arg(1))
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	product, exists := store.get(productKey(*tenant, id))
+	if !exists {
+		return fmt.Errorf("product %s not found", id)
+	}
+	before := product
+	var delta int
+	switch {
+	case len(product.Variants) > 0 && *sku == "":
+		return errors.New("product has variants, pass -sku")
+	case len(product.Variants) > 0:
+		i := product.variantIndex(*sku)
+		if i < 0 {
+			return fmt.Errorf("variant %s of product %s not found", *sku, id)
+		}
+		product.Variants = append([]Variant(nil), product.Variants...)
+		delta = quantity - product.Variants[i].Stock
+		product.Variants[i].Stock = quantity
+	case *sku != "":
+		return fmt.Errorf("product %s has no variants", id)
+	default:
+		delta = quantity - product.Stock
+		product.Stock = quantity
+	}
+	// A count of the stock on hand corrects the ledger by the difference
+	var stock []StockEntry
+	if delta != 0 {
+		stock = append(stock, stockEntry(nil, &product, *sku, delta, reasonCorrection, "productctl stock set"))
+	}
+	if err := store.save(&product, stock...); err != nil {
+		return err
+	}
+	audit.record(nil, "stock.set", &before, &product)
+
+	fmt.Printf("%s\t%d\n", product.ID, product.Stock)
+	return nil
+}
+
+func cliMigrate(args []string) error {
+	fs := newCLIFlags("migrate")
+	timeout := fs.Duration("timeout", 10*time.Minute, "how long to wait for another instance holding the lock")
+	if fs.Parse(args) != nil || fs.NArg() > 0 {
+		return errUsage
+	}
+	bucket := os.Getenv("MIGRATIONS_BUCKET")
+	if bucket == "" {
+		return errors.New("MIGRATIONS_BUCKET is not set")
+	}
+
+	m := migrationRunnerFor(bucket)
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	for {
+		err := m.attempt(ctx)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, errMigrationsLocked) {
+			return err
+		}
+		fmt.Fprintln(os.Stderr, err)
+		select {
+		case <-time.After(m.poll):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	fmt.Printf("applied %d migrations\n", len(m.applied))
+	return nil
+}
+
+// cliBackups returns the backup store, or why there is none
+func cliBackups() (*BackupStore, error) {
+	if backups == nil {
+		return nil, errors.New("BACKUP_BUCKET is not set")
+	}
+	return backups, nil
+}
+
+func cliBackupList(args []string) error {
+	if len(args) > 0 {
+		return errUsage
+	}
+	b, err := cliBackups()
+	if err != nil {
+		return err
+	}
+	list, err := b.list(context.Background())
+	if err != nil {
+		return err
+	}
+	for _, backup := range list {
+		fmt.Printf("%s\t%d\t%s\n", backup.Name, backup.Size, backup.CreatedAt.Format(time.RFC3339))
+	}
+	return nil
+}
+
+func cliBackupCreate(args []string) error {
+	if len(args) > 0 {
+		return errUsage
+	}
+	b, err := cliBackups()
+	if err != nil {
+		return err
+	}
+	backup, err := b.create(context.Background())
+	if err != nil {
+		return err
+	}
+	out, _ := json.MarshalIndent(backup, "", "  ")
+	fmt.Println(string(out))
+	return nil
+}
+
+func cliBackupRestore(args []string) error {
+	fs := newCLIFlags("backup restore")
+	policy := fs.String("policy", restoreOverwrite, "overwrite, skip or fail, for products that changed since the backup")
+	prune := fs.Bool("prune", false, "soft-delete products the backup doesn't have")
+	dryRun := fs.Bool("dry-run", false, "only print what would change")
+	if fs.Parse(args) != nil || fs.NArg() != 1 {
+		return errUsage
+	}
+	if *policy != restoreOverwrite && *policy != restoreSkip && *policy != restoreFail {
+		return errUsage
+	}
+	b, err := cliBackups()
+	if err != nil {
+		return err
+	}
+	name := fs.Arg(0)
+	if !backupNamePattern.MatchString(name) {
+		return fmt.Errorf("%q is not a backup name, see backup list", name)
+	}
+
+	products, err := b.load(context.Background(), name)
+	if err != nil {
+		return err
+	}
+	summary, err := restoreCatalog(nil, name, products, RestoreOptions{Policy: *policy, DryRun: *dryRun, Prune: *prune})
+	out, _ := json.MarshalIndent(summary, "", "  ")
+	fmt.Println(string(out))
+	return err
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Codec serializes the streams of products of catalog exports, imports
+// and backups. Only JSON exists today; binary formats such as
+// protobuf or Avro plug in here without changing those callers. The WAL,
+// event payloads and webhooks stay JSON whatever RECORD_CODEC says: their
+// formats are contracts of their own, with readers outside this codebase
+// or on older instances.
+//
+// Schema evolution rule: decoders must ignore fields they don't know and
+// leave missing fields at their zero value, so adding a field to Product
+// never breaks readers of older or newer records.
+type Codec interface {
+	Name() string
+	// ContentType of a stream of records
+	ContentType() string
+	// Extension for files holding a stream of records
+	Extension() string
+	NewEncoder(w io.Writer) RecordEncoder
+	NewDecoder(r io.Reader) RecordDecoder
+	// Resumable reports whether a decoder can go on with the next record
+	// after returning err, i.e. only that record was malformed
+	Resumable(err error) bool
+}
+
+// RecordEncoder writes one record at a time to a stream
+type RecordEncoder interface {
+	Encode(v any) error
+}
+
+// RecordDecoder reads one record at a time from a stream, returning
+// io.EOF at the end
+type RecordDecoder interface {
+	Decode(v any) error
+}
+
+// jsonCodec writes JSON lines. encoding/json already ignores unknown
+// fields, which is what keeps old readers working.
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string        { return "json" }
+func (jsonCodec) ContentType() string { return "application/x-ndjson" }
+func (jsonCodec) Extension() string   { return "jsonl" }
+
+func (jsonCodec) NewEncoder(w io.Writer) RecordEncoder { return json.NewEncoder(w) }
+func (jsonCodec) NewDecoder(r io.Reader) RecordDecoder { return json.NewDecoder(r) }
+
+// Resumable is false for syntax errors, after which json.Decoder can't
+// find the start of the next record
+func (jsonCodec) Resumable(err error) bool {
+	var syntax *json.SyntaxError
+	return !errors.As(err, &syntax) && !errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// codecs lists the available codecs by name
+var codecs = map[string]Codec{
+	"json": jsonCodec{},
+}
+
+// recordCodec is the codec for exported, imported and backed-up records,
+// RECORD_CODEC
+var recordCodec = lookupCodec(os.Getenv("RECORD_CODEC"))
+
+func lookupCodec(name string) Codec {
+	if name == "" {
+		name = "json"
+	}
+	codec, exists := codecs[name]
+	if !exists {
+		panic(fmt.Sprintf("unknown RECORD_CODEC %q", name))
+	}
+	return codec
+}
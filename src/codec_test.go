@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// updateGolden rewrites the golden files of the current version from what
+// the codecs encode: go test -run Codec -update
+var updateGolden = flag.Bool("update", false, "rewrite golden files")
+
+// codecProducts are the records of the current version's golden files
+func codecProducts() []Product {
+	threshold, sale := 2, Money(3999)
+	deleted := time.Date(2026, 3, 4, 5, 6, 7, 0, time.UTC)
+	return []Product{
+		{
+			ID:                "cat-tree",
+			Name:              "Cat Tree",
+			Description:       "Five levels of napping",
+			Category:          "furniture",
+			Price:             4999,
+			Currency:          "USD",
+			Stock:             3,
+			LowStockThreshold: &threshold,
+			SKU:               "CT-5",
+			GTIN:              "4006381333931",
+			WeightGrams:       12000,
+			Images:            []string{"https://img.example.com/cat-tree.jpg"},
+			SalePrice:         &sale,
+			Rating:            4.5,
+			ReviewCount:       2,
+			Version:           7,
+			CreatedAt:         time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC),
+			UpdatedAt:         time.Date(2026, 2, 3, 4, 5, 6, 0, time.UTC),
+		},
+		{
+			ID:          "laser",
+			Name:        "Laser Pointer",
+			Description: "Red dot",
+			Price:       450,
+			Currency:    "EUR",
+			Version:     1,
+			DeletedAt:   &deleted,
+		},
+	}
+}
+
+// codecVersions are the record versions every codec must keep reading.
+// v1 is what the first release wrote, before currencies, versions and
+// timestamps; v2 is the current version; v3 is a newer writer's, with
+// fields this one doesn't know.
+var codecVersions = []struct {
+	version string
+	current bool // encoding the products must give the file back
+	want    func() []Product
+}{
+	{
+		version: "v1",
+		want: func() []Product {
+			return []Product{
+				{ID: "cat-tree", Name: "Cat Tree", Description: "Five levels of napping", Price: 4999, Stock: 3},
+				{ID: "laser", Name: "Laser Pointer", Description: "Red dot", Price: 450},
+			}
+		},
+	},
+	{version: "v2", current: true, want: codecProducts},
+	{
+		version: "v3",
+		want: func() []Product {
+			return []Product{
+				{
+					ID: "cat-tree", Name: "Cat Tree", Description: "Five levels of napping", Category: "furniture",
+					Price: 4999, Currency: "USD", Stock: 3, SKU: "CT-5", Rating: 4.5, ReviewCount: 2, Version: 7,
+					CreatedAt: time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC),
+					UpdatedAt: time.Date(2026, 2, 3, 4, 5, 6, 0, time.UTC),
+				},
+				{ID: "laser", Name: "Laser Pointer", Description: "Red dot", Price: 450, Currency: "EUR", Version: 1},
+			}
+		},
+	},
+}
+
+func goldenPath(codec Codec, version string) string {
+	return filepath.Join("testdata", "codec", codec.Name(), version+"."+codec.Extension())
+}
+
+func TestCodecGoldenFiles(t *testing.T) {
+	for name, codec := range codecs {
+		for _, v := range codecVersions {
+			t.Run(name+"/"+v.version, func(t *testing.T) {
+				path := goldenPath(codec, v.version)
+				if v.current {
+					var buf bytes.Buffer
+					enc := codec.NewEncoder(&buf)
+					for _, p := range v.want() {
+						if err := enc.Encode(p); err != nil {
+							t.Fatalf("encoding %s: %v", p.ID, err)
+						}
+					}
+					if *updateGolden {
+						if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+							t.Fatal(err)
+						}
+					}
+					golden, err := os.ReadFile(path)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if !bytes.Equal(buf.Bytes(), golden) {
+						t.Errorf("encoding changed, run go test -run Codec -update if that's intended\ngot:\n%s\nwant:\n%s", buf.Bytes(), golden)
+					}
+				}
+
+				file, err := os.Open(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer file.Close()
+				var got []Product
+				dec := codec.NewDecoder(file)
+				for {
+					var p Product
+					err := dec.Decode(&p)
+					if err == io.EOF {
+						break
+					}
+					if err != nil {
+						t.Fatalf("decoding record %d: %v", len(got)+1, err)
+					}
+					got = append(got, p)
+				}
+				if want := v.want(); !reflect.DeepEqual(got, want) {
+					t.Errorf("decoded\n%+v\nwant\n%+v", got, want)
+				}
+			})
+		}
+	}
+}
+
+func TestJSONCodecResumable(t *testing.T) {
+	tests := []struct {
+		name      string
+		stream    string
+		resumable bool
+	}{
+		{"wrong type", `{"id":"a","stock":"many"}` + "\n" + `{"id":"b"}`, true},
+		{"invalid amount", `{"id":"a","price":"cheap"}` + "\n" + `{"id":"b"}`, true},
+		{"syntax error", `{"id":"a",,}` + "\n" + `{"id":"b"}`, false},
+		{"truncated", `{"id":"a","name":"Cat`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			codec := jsonCodec{}
+			dec := codec.NewDecoder(strings.NewReader(tt.stream))
+			var p Product
+			err := dec.Decode(&p)
+			if err == nil {
+				t.Fatal("decoding succeeded")
+			}
+			if got := codec.Resumable(err); got != tt.resumable {
+				t.Fatalf("Resumable(%v) = %v, want %v", err, got, tt.resumable)
+			}
+			if !tt.resumable {
+				return
+			}
+			var next Product
+			if err := dec.Decode(&next); err != nil || next.ID != "b" {
+				t.Errorf("next record = %+v, %v; want b", next, err)
+			}
+		})
+	}
+}
+
+func TestLookupCodec(t *testing.T) {
+	if got := lookupCodec("").Name(); got != "json" {
+		t.Errorf("default codec = %s, want json", got)
+	}
+	defer func() {
+		if recover() == nil {
+			t.Error("unknown codec didn't panic")
+		}
+	}()
+	lookupCodec("avro")
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"expvar"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Response compression. COMPRESSION=off turns it off, e.g. behind a load
+// balancer or CDN that compresses itself. Responses smaller than
+// COMPRESSION_MIN_BYTES (default 1KiB) aren't worth it and are sent as
+// they are, as are content types outside COMPRESSION_TYPES.
+// COMPRESSION_LEVEL is the flate level, 1 (fastest) to 9 (smallest).
+var (
+	compressionEnabled  = os.Getenv("COMPRESSION") != "off"
+	compressionMinBytes = envInt("COMPRESSION_MIN_BYTES", 1024)
+	compressionLevel    = envInt("COMPRESSION_LEVEL", gzip.DefaultCompression)
+	compressionTypes    = parseCompressionTypes(envString("COMPRESSION_TYPES", defaultCompressionTypes))
+)
+
+// defaultCompressionTypes are the text formats the API serves. +json
+// and +xml types are always compressible.
+const defaultCompressionTypes = "application/json, application/xml, application/x-ndjson, text/csv, text/html, text/plain, application/graphql-response+json"
+
+var compressedResponses = expvar.NewMap("compressed_responses")
+
+// compressionEncodings are the content codings served, best first. Brotli
+// needs an encoder outside the standard library and is left to the edge.
+var compressionEncodings = []string{"gzip", "deflate"}
+
+// compressor is a stream encoder for one content coding
+type compressor interface {
+	io.WriteCloser
+	Flush() error
+	Reset(w io.Writer)
+}
+
+// compressorPools keep encoders between responses, since each holds
+// sizeable buffers
+var compressorPools = map[string]*sync.Pool{
+	"gzip": {New: func() any {
+		w, err := gzip.NewWriterLevel(io.Discard, compressionLevel)
+		if err != nil {
+			w = gzip.NewWriter(io.Discard)
+		}
+		return w
+	}},
+	"deflate": {New: func() any {
+		w, err := flate.NewWriter(io.Discard, compressionLevel)
+		if err != nil {
+			w, _ = flate.NewWriter(io.Discard, flate.DefaultCompression)
+		}
+		return w
+	}},
+}
+
+func parseCompressionTypes(raw string) map[string]bool {
+	types := make(map[string]bool)
+	for _, t := range strings.Split(raw, ",") {
+		if t = strings.ToLower(strings.TrimSpace(t)); t != "" {
+			types[t] = true
+		}
+	}
+	return types
+}
+
+// compressible reports whether responses of a content type are compressed
+func compressible(contentType string) bool {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+	return compressionTypes[mediaType] || strings.HasSuffix(mediaType, "+json") || strings.HasSuffix(mediaType, "+xml")
+}
+
+// acceptedEncoding picks the best content coding the Accept-Encoding
+// header allows, empty for none
+func acceptedEncoding(header string) string {
+	best, bestQ := "", 0.0
+	for _, encoding := range compressionEncodings {
+		q, specificity := 0.0, -1
+		for _, part := range strings.Split(header, ",") {
+			name, params, _ := strings.Cut(part, ";")
+			name = strings.ToLower(strings.TrimSpace(name))
+			s := -1
+			switch name {
+			case encoding:
+				s = 1
+			case "*":
+				s = 0
+			}
+			if s <= specificity {
+				continue
+			}
+			specificity, q = s, 1
+			if name, value, ok := strings.Cut(strings.TrimSpace(params), "="); ok && strings.EqualFold(strings.TrimSpace(name), "q") {
+				if parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+		if q > bestQ {
+			best, bestQ = encoding, q
+		}
+	}
+	return best
+}
+
+// compressResponses compresses large text responses for clients that
+// accept it. Server-sent events are never compressed, so each event
+// reaches the client as soon as it's flushed.
+func compressResponses() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !compressionEnabled || c.Request.Method == http.MethodHead {
+			c.Next()
+			return
+		}
+		encoding := acceptedEncoding(c.GetHeader("Accept-Encoding"))
+		if encoding == "" {
+			c.Next()
+			return
+		}
+
+		w := &compressWriter{ResponseWriter: c.Writer, c: c, encoding: encoding}
+		c.Writer = w
+		defer w.finish()
+		c.Next()
+	}
+}
+
+// compressWriter holds back the start of a response until it knows
+// whether it's worth compressing: the content type allows it and the body
+// reaches the size threshold, or the handler flushes.
+type compressWriter struct {
+	gin.ResponseWriter
+	c        *gin.Context
+	encoding string
+	decided  bool
+	buf      bytes.Buffer
+	enc      compressor
+}
+
+func (w *compressWriter) Write(b []byte) (int, error) {
+	if !w.decided {
+		if !w.eligible() {
+			w.decided = true
+		} else {
+			w.buf.Write(b)
+			if w.buf.Len() < compressionMinBytes {
+				return len(b), nil
+			}
+			if err := w.start(); err != nil {
+				return 0, err
+			}
+			return len(b), nil
+		}
+	}
+	if w.enc != nil {
+		return w.enc.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *compressWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// Flush sends what's been written so far, compressing it if the content
+// type allows, since a flushing handler is streaming a long response
+func (w *compressWriter) Flush() {
+	if !w.decided {
+		if w.eligible() {
+			w.start()
+		} else {
+			w.decided = true
+		}
+	}
+	if w.enc != nil {
+		w.enc.Flush()
+	}
+	w.ResponseWriter.Flush()
+}
+
+// eligible reports whether the response, as its headers stand, could be
+// compressed
+func (w *compressWriter) eligible() bool {
+	h := w.Header()
+	status := w.Status()
+	if status < http.StatusOK || status == http.StatusNoContent || status == http.StatusNotModified {
+		return false
+	}
+	if h.Get("Content-Encoding") != "" || h.Get("Content-Type") == "text/event-stream" || w.c.GetBool(noCompressionKey) {
+		return false
+	}
+	if !compressible(h.Get("Content-Type")) {
+		return false
+	}
+	// Whether the body is compressed depends on Accept-Encoding from here
+	// on, big or small
+	addVary(w.c, "Accept-Encoding")
+	return true
+}
+
+// start switches to compressing, writing what was held back through the
+// encoder
+func (w *compressWriter) start() error {
+	w.decided = true
+	h := w.Header()
+	h.Set("Content-Encoding", w.encoding)
+	h.Del("Content-Length")
+	compressedResponses.Add(w.encoding, 1)
+
+	w.enc = compressorPools[w.encoding].Get().(compressor)
+	w.enc.Reset(w.ResponseWriter)
+	_, err := w.enc.Write(w.buf.Bytes())
+	w.buf.Reset()
+	return err
+}
+
+// finish writes a response that stayed under the threshold as it is, or
+// ends the compressed stream
+func (w *compressWriter) finish() {
+	if w.enc != nil {
+		w.enc.Close()
+		w.enc.Reset(io.Discard)
+		compressorPools[w.encoding].Put(w.enc)
+		w.enc = nil
+		return
+	}
+	if w.buf.Len() > 0 {
+		w.ResponseWriter.Write(w.buf.Bytes())
+		w.buf.Reset()
+	}
+}
+
+// Written reports whether anything has been written, held back or not
+func (w *compressWriter) Written() bool {
+	return w.ResponseWriter.Written() || w.buf.Len() > 0
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Security headers sent on every response. HSTS_MAX_AGE (default a year,
+// 0 to turn it off) is only sent over HTTPS, including behind a load
+// balancer terminating TLS. FRAME_OPTIONS defaults to DENY, off to omit.
+var (
+	hstsMaxAge   = envDuration("HSTS_MAX_AGE", 365*24*time.Hour)
+	frameOptions = envString("FRAME_OPTIONS", "DENY")
+)
+
+// Default CORS lists, covering the headers the API reads and sets
+const (
+	defaultCORSMethods = "GET, HEAD, POST, PUT, PATCH, DELETE"
+	defaultCORSHeaders = "Authorization, Content-Type, Accept, Accept-Language, If-Match, If-None-Match, If-Modified-Since, Idempotency-Key, Prefer, X-Actor, X-Callback-URL, X-Catalog-Snapshot, X-Request-ID"
+	defaultCORSExposed = "API-Version, ETag, Last-Modified, Location, Preference-Applied, Retry-After, X-Catalog-Snapshot, Idempotent-Replayed, X-Request-ID, X-Retain-Until, X-Shard-Partial, X-Shard-Owner, X-Raft-Leader"
+)
+
+// CORSPolicy lets browser storefronts on other origins call the API
+type CORSPolicy struct {
+	origins     map[string]bool
+	anyOrigin   bool // "*" is allowed
+	wildcards   []corsWildcard
+	methods     string
+	headers     string // "*" echoes what the preflight asks for
+	exposed     string
+	maxAge      string // seconds, empty to leave it to the browser
+	credentials bool
+}
+
+// corsWildcard is an https://*.example.com entry, matching the subdomains
+// of example.com
+type corsWildcard struct {
+	scheme string // "https://"
+	suffix string // ".example.com"
+}
+
+// Global CORS policy, nil unless CORS_ALLOWED_ORIGINS is set
+var corsPolicy = newCORSPolicy()
+
+// newCORSPolicy reads CORS_ALLOWED_ORIGINS, a comma-separated list of
+// origins such as https://shop.example.com, https://*.example.com for its
+// subdomains, or *. CORS_ALLOWED_METHODS, CORS_ALLOWED_HEADERS and
+// CORS_EXPOSED_HEADERS override the defaults, CORS_MAX_AGE (default 10m)
+// is how long browsers cache a preflight and CORS_ALLOW_CREDENTIALS=true
+// lets them send cookies.
+func newCORSPolicy() *CORSPolicy {
+	raw := os.Getenv("CORS_ALLOWED_ORIGINS")
+	if raw == "" {
+		return nil
+	}
+	p := &CORSPolicy{
+		origins:     make(map[string]bool),
+		methods:     envString("CORS_ALLOWED_METHODS", defaultCORSMethods),
+		headers:     envString("CORS_ALLOWED_HEADERS", defaultCORSHeaders),
+		exposed:     envString("CORS_EXPOSED_HEADERS", defaultCORSExposed),
+		credentials: os.Getenv("CORS_ALLOW_CREDENTIALS") == "true",
+	}
+	if maxAge := envDuration("CORS_MAX_AGE", 10*time.Minute); maxAge > 0 {
+		p.maxAge = strconv.Itoa(int(maxAge.Seconds()))
+	}
+	for _, origin := range strings.Split(raw, ",") {
+		origin = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(origin)), "/")
+		switch {
+		case origin == "":
+		case origin == "*":
+			p.anyOrigin = true
+		case strings.Contains(origin, "://*."):
+			scheme, suffix, _ := strings.Cut(origin, "*")
+			p.wildcards = append(p.wildcards, corsWildcard{scheme: scheme, suffix: suffix})
+		default:
+			p.origins[origin] = true
+		}
+	}
+	return p
+}
+
+// allowed reports whether requests from an origin may read responses
+func (p *CORSPolicy) allowed(origin string) bool {
+	origin = strings.ToLower(origin)
+	if p.anyOrigin || p.origins[origin] {
+		return true
+	}
+	for _, w := range p.wildcards {
+		if host, ok := strings.CutPrefix(origin, w.scheme); ok && strings.HasSuffix(host, w.suffix) && len(host) > len(w.suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// handle adds the CORS headers for allowed origins, and answers
+// preflights itself
+// Returns: 204 No Content - Preflight from an allowed origin (Cat waves you in!)
+// Returns: 403 Forbidden - Preflight from an origin not allowed (Cat at the door says no!)
+func (p *CORSPolicy) handle(c *gin.Context) {
+	origin := c.GetHeader("Origin")
+	if origin == "" {
+		c.Next()
+		return
+	}
+	addVary(c, "Origin")
+	preflight := c.Request.Method == http.MethodOptions && c.GetHeader("Access-Control-Request-Method") != ""
+	if !p.allowed(origin) {
+		if preflight {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Origin not allowed", "origin": origin})
+			return
+		}
+		// Served without CORS headers, so the browser keeps the response
+		// from the page
+		c.Next()
+		return
+	}
+
+	h := c.Writer.Header()
+	if p.anyOrigin && !p.credentials {
+		h.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		h.Set("Access-Control-Allow-Origin", origin)
+	}
+	if p.credentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+	if !preflight {
+		h.Set("Access-Control-Expose-Headers", p.exposed)
+		c.Next()
+		return
+	}
+
+	addVary(c, "Access-Control-Request-Method", "Access-Control-Request-Headers")
+	h.Set("Access-Control-Allow-Methods", p.methods)
+	if p.headers == "*" {
+		if requested := c.GetHeader("Access-Control-Request-Headers"); requested != "" {
+			h.Set("Access-Control-Allow-Headers", requested)
+		}
+	} else {
+		h.Set("Access-Control-Allow-Headers", p.headers)
+	}
+	if p.maxAge != "" {
+		h.Set("Access-Control-Max-Age", p.maxAge)
+	}
+	c.AbortWithStatus(http.StatusNoContent)
+}
+
+// securityHeaders sets the headers that keep browsers from sniffing,
+// framing or downgrading the API
+func securityHeaders() gin.HandlerFunc {
+	hsts := ""
+	if hstsMaxAge > 0 {
+		hsts = "max-age=" + strconv.Itoa(int(hstsMaxAge.Seconds())) + "; includeSubDomains"
+	}
+	return func(c *gin.Context) {
+		h := c.Writer.Header()
+		h.Set("X-Content-Type-Options", "nosniff")
+		h.Set("Referrer-Policy", "no-referrer")
+		if frameOptions != "off" {
+			h.Set("X-Frame-Options", frameOptions)
+		}
+		if hsts != "" && (c.Request.TLS != nil || c.GetHeader("X-Forwarded-Proto") == "https") {
+			h.Set("Strict-Transport-Security", hsts)
+		}
+		c.Next()
+	}
+}
+
+// addVary adds to the Vary header, keeping what's already there
+func addVary(c *gin.Context, names ...string) {
+	h := c.Writer.Header()
+	present := strings.Split(h.Get("Vary"), ", ")
+	for _, name := range names {
+		found := false
+		for _, v := range present {
+			if strings.EqualFold(v, name) {
+				found = true
+			}
+		}
+		if !found {
+			present = append(present, name)
+		}
+	}
+	h.Set("Vary", strings.TrimPrefix(strings.Join(present, ", "), ", "))
+}
+
+// dropEdgeHeaders removes the CORS and security headers from a response
+// proxied from another instance, since this one has already set them
+func dropEdgeHeaders(resp *http.Response) error {
+	for name := range resp.Header {
+		if strings.HasPrefix(name, "Access-Control-") {
+			resp.Header.Del(name)
+		}
+	}
+	for _, name := range []string{"X-Content-Type-Options", "Referrer-Policy", "X-Frame-Options", "Strict-Transport-Security"} {
+		resp.Header.Del(name)
+	}
+	return nil
+}
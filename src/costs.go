@@ -0,0 +1,527 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Costing methods, for the value of stock on hand and its margin. Both
+// are kept for every product; COST_METHOD picks the reports' default.
+const (
+	costAverage = "average" // moving weighted average of the receipts
+	costFIFO    = "fifo"    // the oldest units received are the first to go
+)
+
+// costMethod is the default costing method
+var costMethod = newCostMethod()
+
+func newCostMethod() string {
+	method := envString("COST_METHOD", costAverage)
+	if method != costAverage && method != costFIFO {
+		panic(fmt.Sprintf("invalid COST_METHOD %q: must be average or fifo", method))
+	}
+	return method
+}
+
+// Receipt records stock arriving from a supplier and what it cost to land:
+// the purchase price of the units plus the freight and duty of the
+// shipment, which are spread over its units.
+type Receipt struct {
+	ID             string    `json:"id"`
+	ProductID      string    `json:"product_id"`
+	SKU            string    `json:"sku,omitempty"`
+	Quantity       int       `json:"quantity" binding:"required,min=1,max=1000000"`
+	UnitCost       Money     `json:"unit_cost"`
+	Freight        Money     `json:"freight"`
+	Duty           Money     `json:"duty"`
+	Currency       string    `json:"currency"`                              // the product's, by default
+	Reference      string    `json:"reference,omitempty" binding:"max=100"` // purchase order or invoice
+	LandedCost     Money     `json:"landed_cost"`
+	LandedUnitCost Money     `json:"landed_unit_cost"`
+	ReceivedAt     time.Time `json:"received_at"`
+
+	key string // the product's key
+}
+
+// maxReceiptAmount caps each amount of a receipt, so landed costs of the
+// largest quantities can't overflow
+const maxReceiptAmount Money = 1_000_000_000_00
+
+// validateReceipt checks and completes a receipt for a product, and
+// returns why it's invalid
+func validateReceipt(r *Receipt, p *Product) string {
+	r.Currency = strings.ToUpper(r.Currency)
+	if r.Currency == "" {
+		r.Currency = p.Currency
+	}
+	switch {
+	case r.UnitCost < 0 || r.Freight < 0 || r.Duty < 0:
+		return "unit_cost, freight and duty can't be negative"
+	case r.Currency != p.Currency:
+		return fmt.Sprintf("currency must be the product's, %s", p.Currency)
+	case r.UnitCost > maxReceiptAmount || r.Freight > maxReceiptAmount || r.Duty > maxReceiptAmount:
+		return fmt.Sprintf("unit_cost, freight and duty must be at most %s", maxReceiptAmount)
+	}
+	r.LandedCost = r.UnitCost*Money(r.Quantity) + r.Freight + r.Duty
+	r.LandedUnitCost = divideMoney(r.LandedCost, r.Quantity)
+	return ""
+}
+
+// divideMoney splits a non-negative amount over n units, rounding half up
+func divideMoney(m Money, n int) Money {
+	if n <= 0 {
+		return 0
+	}
+	return (2*m + Money(n)) / (2 * Money(n))
+}
+
+// productCost follows the cost of a product's stock on hand. Layers are
+// first in, first out, like stockAging; stock added without a receipt,
+// including what was on hand at startup, has no known cost. The average
+// pool holds the costed units on hand at their moving average cost.
+type productCost struct {
+	layers   []costLayer
+	stock    int
+	seen     bool // stock has been sampled
+	currency string
+	units    int   // costed units on hand
+	average  Money // their total value at average cost
+}
+
+type costLayer struct {
+	quantity int
+	cost     Money // total for the quantity
+	costed   bool
+}
+
+// CostStore keeps our in-memory receipts and costs, by product key
+type CostStore struct {
+	mu       sync.Mutex
+	seq      int64
+	receipts map[string][]Receipt
+	costs    map[string]*productCost
+}
+
+// Global cost store
+var costs = &CostStore{
+	receipts: make(map[string][]Receipt),
+	costs:    make(map[string]*productCost),
+}
+
+// costOf returns the cost of a product, creating it. Callers must hold
+// s.mu.
+func (s *CostStore) costOf(productID string) *productCost {
+	pc, exists := s.costs[productID]
+	if !exists {
+		pc = &productCost{}
+		s.costs[productID] = pc
+	}
+	return pc
+}
+
+// recordStock follows a change to a product's stock made without a
+// receipt. Increases have no known cost, decreases take the oldest units.
+func (s *CostStore) recordStock(productID string, stock int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.costOf(productID).restock(stock)
+}
+
+// restock moves the layers to a new stock level
+func (pc *productCost) restock(stock int) {
+	if !pc.seen {
+		pc.seen, pc.stock = true, stock
+		if stock > 0 {
+			pc.layers = []costLayer{{quantity: stock}}
+		}
+		return
+	}
+	change := stock - pc.stock
+	pc.stock = stock
+	if change > 0 {
+		pc.layers = append(pc.layers, costLayer{quantity: change})
+	} else {
+		pc.take(-change)
+	}
+}
+
+// take removes units from the oldest layers, and their share of the
+// average pool
+func (pc *productCost) take(quantity int) {
+	for quantity > 0 && len(pc.layers) > 0 {
+		layer := &pc.layers[0]
+		taken := min(quantity, layer.quantity)
+		if layer.costed {
+			// Take the pool's value in proportion, the last unit takes the rest
+			pc.average -= pc.average * Money(taken) / Money(pc.units)
+			pc.units -= taken
+		}
+		layer.cost -= layer.cost * Money(taken) / Money(layer.quantity)
+		layer.quantity -= taken
+		quantity -= taken
+		if layer.quantity == 0 {
+			pc.layers = pc.layers[1:]
+		}
+	}
+}
+
+// receive adds a receipt to a product whose stock was before, ahead of
+// the write that raises it so recordStock sees no change. Callers must
+// hold store.mu.
+func (s *CostStore) receive(r *Receipt, before int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pc := s.costOf(r.key)
+	pc.restock(before)
+	pc.stock += r.Quantity
+	pc.layers = append(pc.layers, costLayer{quantity: r.Quantity, cost: r.LandedCost, costed: true})
+	pc.units += r.Quantity
+	pc.average += r.LandedCost
+	pc.currency = r.Currency
+
+	s.seq++
+	r.ID = strconv.FormatInt(s.seq, 10)
+	s.receipts[r.key] = append(s.receipts[r.key], *r)
+}
+
+// unreceive takes back a receipt whose write failed. Callers hold
+// store.mu, so it's still the last of its product.
+func (s *CostStore) unreceive(r *Receipt) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pc := s.costOf(r.key)
+	if n := len(pc.layers); n > 0 {
+		pc.layers = pc.layers[:n-1]
+	}
+	pc.stock -= r.Quantity
+	pc.units -= r.Quantity
+	pc.average -= r.LandedCost
+	if receipts := s.receipts[r.key]; len(receipts) > 0 {
+		s.receipts[r.key] = receipts[:len(receipts)-1]
+	}
+}
+
+// removeProduct forgets the receipts and costs of a purged product
+func (s *CostStore) removeProduct(productID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.receipts, productID)
+	delete(s.costs, productID)
+}
+
+// ProductCost is the cost of a product's stock on hand under both
+// methods. Unit costs are nil until a receipt is on hand.
+type ProductCost struct {
+	Stock           int    `json:"stock"`
+	CostedUnits     int    `json:"costed_units"`
+	UncostedUnits   int    `json:"uncosted_units"` // added without a receipt
+	AverageUnitCost *Money `json:"average_unit_cost"`
+	AverageValue    Money  `json:"average_value"`
+	FIFOUnitCost    *Money `json:"fifo_unit_cost"`
+	FIFOValue       Money  `json:"fifo_value"`
+	Currency        string `json:"currency,omitempty"`
+}
+
+// summary reports the costs of a product. Callers must hold s.mu.
+func (s *CostStore) summary(productID string) ProductCost {
+	pc := s.costs[productID]
+	if pc == nil {
+		return ProductCost{}
+	}
+	cost := ProductCost{Stock: pc.stock, CostedUnits: pc.units, AverageValue: pc.average, Currency: pc.currency}
+	for _, layer := range pc.layers {
+		if layer.costed {
+			cost.FIFOValue += layer.cost
+		} else {
+			cost.UncostedUnits += layer.quantity
+		}
+	}
+	if pc.units > 0 {
+		average, fifo := divideMoney(pc.average, pc.units), divideMoney(cost.FIFOValue, pc.units)
+		cost.AverageUnitCost, cost.FIFOUnitCost = &average, &fifo
+	}
+	return cost
+}
+
+// unitCost returns the unit cost and value of a product under a method
+func (pc ProductCost) unitCost(method string) (*Money, Money) {
+	if method == costFIFO {
+		return pc.FIFOUnitCost, pc.FIFOValue
+	}
+	return pc.AverageUnitCost, pc.AverageValue
+}
+
+// getReceipts lists a product's receipts, oldest first, and the cost of
+// its stock on hand
+// Returns: 200 OK - Success
+// Returns: 404 Not Found - Product doesn't exist
+func getReceipts(c *gin.Context) {
+	id := c.Param("id")
+	key := tenantKey(c, id)
+	if _, exists := store.get(key); !exists {
+		productNotFound(c, id)
+		return
+	}
+
+	costs.mu.Lock()
+	list := append([]Receipt{}, costs.receipts[key]...)
+	cost := costs.summary(key)
+	costs.mu.Unlock()
+
+	c.JSON(http.StatusOK, gin.H{
+		"count":    len(list),
+		"receipts": list,
+		"cost":     cost,
+	})
+}
+
+// createReceipt records stock arriving for a product, or one of its
+// variants, and adds it to the stock
+// Returns: 201 Created - Success (Cat unloading the truck!)
+// Returns: 400 Bad Request - Invalid receipt
+// Returns: 404 Not Found - Product or variant doesn't exist
+func createReceipt(c *gin.Context) {
+	id := c.Param("id")
+
+	var receipt Receipt
+	if err := c.ShouldBindJSON(&receipt); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":   "Invalid receipt",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	product, exists := store.get(tenantKey(c, id))
+	if !exists {
+		productNotFound(c, id)
+		return
+	}
+	if msg := validateReceipt(&receipt, &product); msg != "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":   "Invalid receipt",
+			"details": msg,
+		})
+		return
+	}
+
+	before := product
+	if len(product.Variants) > 0 {
+		if receipt.SKU == "" {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error":   "Invalid receipt",
+				"details": "Product has variants, sku is required",
+			})
+			return
+		}
+		i := product.variantIndex(receipt.SKU)
+		if i < 0 {
+			variantNotFound(c, id, receipt.SKU)
+			return
+		}
+		product.Variants = append([]Variant(nil), product.Variants...)
+		product.Variants[i].Stock += receipt.Quantity
+	} else {
+		if receipt.SKU != "" {
+			variantNotFound(c, id, receipt.SKU)
+			return
+		}
+		product.Stock += receipt.Quantity
+	}
+	receipt.ProductID, receipt.key = id, product.key()
+	receipt.ReceivedAt = time.Now().UTC()
+	costs.receive(&receipt, before.Stock)
+	if err := store.save(&product, stockEntry(c, &product, receipt.SKU, receipt.Quantity, reasonReceipt, receipt.Reference)); err != nil {
+		costs.unreceive(&receipt)
+		writeFailed(c, err)
+		return
+	}
+	audit.record(c, "receipt.create", &before, &product)
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message": "Receipt recorded successfully",
+		"receipt": receipt,
+		"product": product,
+	})
+}
+
+// reportMethod reads ?method=, COST_METHOD by default, and writes 400 if
+// it's invalid
+func reportMethod(c *gin.Context) (string, bool) {
+	method := c.DefaultQuery("method", costMethod)
+	if method != costAverage && method != costFIFO {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "method must be average or fifo", "method": method})
+		return "", false
+	}
+	return method, true
+}
+
+// reportProducts returns the request tenant's live products of
+// ?category=, by ID, with their costs
+func reportProducts(c *gin.Context) ([]Product, map[string]ProductCost) {
+	tenant, category := tenantOf(c), c.Query("category")
+	store.mu.RLock()
+	products := make([]Product, 0, len(store.products))
+	for _, p := range store.products {
+		if p.Tenant == tenant && p.DeletedAt == nil && (category == "" || p.Category == category) {
+			products = append(products, p)
+		}
+	}
+	store.mu.RUnlock()
+	sort.Slice(products, func(i, j int) bool { return products[i].ID < products[j].ID })
+
+	summaries := make(map[string]ProductCost, len(products))
+	costs.mu.Lock()
+	for _, p := range products {
+		summaries[p.ID] = costs.summary(p.key())
+	}
+	costs.mu.Unlock()
+	return products, summaries
+}
+
+// StockValuation is the value of a product's stock on hand at cost
+type StockValuation struct {
+	ID            string `json:"id"`
+	Name          string `json:"name"`
+	Category      string `json:"category,omitempty"`
+	Stock         int    `json:"stock"`
+	CostedUnits   int    `json:"costed_units"`
+	UncostedUnits int    `json:"uncosted_units"`
+	UnitCost      *Money `json:"unit_cost"`
+	Value         Money  `json:"value"`
+	Currency      string `json:"currency"`
+}
+
+// ValuationTotal sums the valuation of one currency
+type ValuationTotal struct {
+	Currency      string `json:"currency"`
+	CostedUnits   int    `json:"costed_units"`
+	UncostedUnits int    `json:"uncosted_units"`
+	Value         Money  `json:"value"`
+}
+
+// getValuationReport values the stock on hand at landed cost, by
+// ?method= (default COST_METHOD), with totals per currency. ?category=
+// narrows it down. Units added without a receipt aren't valued.
+// Returns: 200 OK - Report (Cat counting the inventory!)
+// Returns: 400 Bad Request - Invalid method
+func getValuationReport(c *gin.Context) {
+	method, ok := reportMethod(c)
+	if !ok {
+		return
+	}
+	products, summaries := reportProducts(c)
+
+	rows := make([]StockValuation, 0, len(products))
+	totals := map[string]*ValuationTotal{}
+	for _, p := range products {
+		cost := summaries[p.ID]
+		if cost.Stock <= 0 {
+			continue
+		}
+		unitCost, value := cost.unitCost(method)
+		currency := cost.Currency
+		if currency == "" {
+			currency = p.Currency
+		}
+		rows = append(rows, StockValuation{
+			ID: p.ID, Name: p.Name, Category: p.Category,
+			Stock: cost.Stock, CostedUnits: cost.CostedUnits, UncostedUnits: cost.UncostedUnits,
+			UnitCost: unitCost, Value: value, Currency: currency,
+		})
+		total := totals[currency]
+		if total == nil {
+			total = &ValuationTotal{Currency: currency}
+			totals[currency] = total
+		}
+		total.CostedUnits += cost.CostedUnits
+		total.UncostedUnits += cost.UncostedUnits
+		total.Value += value
+	}
+
+	byCurrency := make([]ValuationTotal, 0, len(totals))
+	for _, total := range totals {
+		byCurrency = append(byCurrency, *total)
+	}
+	sort.Slice(byCurrency, func(i, j int) bool { return byCurrency[i].Currency < byCurrency[j].Currency })
+	c.JSON(http.StatusOK, gin.H{
+		"method":   method,
+		"count":    len(rows),
+		"products": rows,
+		"totals":   byCurrency,
+	})
+}
+
+// ProductMargin is a product's list price against its landed cost
+type ProductMargin struct {
+	ID            string  `json:"id"`
+	Name          string  `json:"name"`
+	Category      string  `json:"category,omitempty"`
+	Price         Money   `json:"price"`
+	UnitCost      Money   `json:"unit_cost"`
+	Margin        Money   `json:"margin"`
+	MarginPercent float64 `json:"margin_percent"` // of the price
+	Currency      string  `json:"currency"`
+}
+
+// getMarginReport compares list prices with unit costs, by ?method=
+// (default COST_METHOD), thinnest margin first. ?category= narrows it
+// down and ?below= keeps margins under a percentage. Products without
+// costed stock on hand, or costed in another currency, are left out.
+// Returns: 200 OK - Report
+// Returns: 400 Bad Request - Invalid method or below
+func getMarginReport(c *gin.Context) {
+	method, ok := reportMethod(c)
+	if !ok {
+		return
+	}
+	below := 0.0
+	if raw := c.Query("below"); raw != "" {
+		var err error
+		if below, err = strconv.ParseFloat(raw, 64); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "below must be a percentage", "below": raw})
+			return
+		}
+	}
+	products, summaries := reportProducts(c)
+
+	rows := make([]ProductMargin, 0, len(products))
+	for _, p := range products {
+		cost := summaries[p.ID]
+		unitCost, _ := cost.unitCost(method)
+		if unitCost == nil || cost.Currency != p.Currency {
+			continue
+		}
+		row := ProductMargin{
+			ID: p.ID, Name: p.Name, Category: p.Category,
+			Price: p.Price, UnitCost: *unitCost, Margin: p.Price - *unitCost, Currency: p.Currency,
+		}
+		if p.Price > 0 {
+			row.MarginPercent = float64(int64(row.Margin)*10000/int64(p.Price)) / 100
+		}
+		if c.Query("below") == "" || row.MarginPercent < below {
+			rows = append(rows, row)
+		}
+	}
+	sort.SliceStable(rows, func(i, j int) bool { return rows[i].MarginPercent < rows[j].MarginPercent })
+
+	c.JSON(http.StatusOK, gin.H{
+		"method":   method,
+		"count":    len(rows),
+		"products": rows,
+	})
+}
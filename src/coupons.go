@@ -0,0 +1,235 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Coupon is a discount code. Percentage coupons take Percent off eligible
+// lines; fixed coupons take Amount (in Currency) off the eligible subtotal.
+// Empty Products and Categories make every product eligible.
+type Coupon struct {
+	Code       string     `json:"code" binding:"required"`
+	Type       string     `json:"type" binding:"required,oneof=percentage fixed"`
+	Percent    int        `json:"percent,omitempty" binding:"omitempty,min=1,max=100"`
+	Amount     Money      `json:"amount,omitempty"`
+	Currency   string     `json:"currency,omitempty"`
+	ValidFrom  *time.Time `json:"valid_from,omitempty"`
+	ValidUntil *time.Time `json:"valid_until,omitempty"`
+	MaxUses    int        `json:"max_uses,omitempty" binding:"min=0"`
+	Uses       int        `json:"uses"`
+	Products   []string   `json:"products,omitempty"`
+	Categories []string   `json:"categories,omitempty"`
+}
+
+// CouponStore manages our in-memory coupons
+type CouponStore struct {
+	mu      sync.RWMutex
+	coupons map[string]Coupon
+}
+
+// Global coupon store
+var coupons = &CouponStore{
+	coupons: make(map[string]Coupon),
+}
+
+// normalizeCouponCode makes codes case-insensitive
+func normalizeCouponCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// unusableReason explains why a coupon can't be used right now, or
+// returns an empty string when it can
+func (cp Coupon) unusableReason(now time.Time) string {
+	switch {
+	case cp.ValidFrom != nil && now.Before(*cp.ValidFrom):
+		return "Coupon is not valid yet"
+	case cp.ValidUntil != nil && now.After(*cp.ValidUntil):
+		return "Coupon has expired"
+	case cp.MaxUses > 0 && cp.Uses >= cp.MaxUses:
+		return "Coupon usage limit reached"
+	}
+	return ""
+}
+
+// appliesTo reports whether a product is eligible for the coupon
+func (cp Coupon) appliesTo(p Product) bool {
+	if len(cp.Products) == 0 && len(cp.Categories) == 0 {
+		return true
+	}
+	return slices.Contains(cp.Products, p.ID) ||
+		(p.Category != "" && slices.Contains(cp.Categories, p.Category))
+}
+
+// validateCoupon checks type-specific fields. Returns an empty string when
+// the coupon is valid.
+func validateCoupon(cp *Coupon) string {
+	cp.Code = normalizeCouponCode(cp.Code)
+	cp.Currency = strings.ToUpper(cp.Currency)
+	switch cp.Type {
+	case "percentage":
+		if cp.Percent == 0 {
+			return "Percentage coupons require percent"
+		}
+		if cp.Amount != 0 {
+			return "Percentage coupons can't have an amount"
+		}
+	case "fixed":
+		if cp.Amount <= 0 {
+			return "Fixed coupons require a positive amount"
+		}
+		if cp.Percent != 0 {
+			return "Fixed coupons can't have a percent"
+		}
+		if cp.Currency == "" {
+			cp.Currency = defaultCurrency
+		}
+		if !validCurrency(cp.Currency) {
+			return "Currency must be an ISO 4217 code"
+		}
+	}
+	if cp.ValidFrom != nil && cp.ValidUntil != nil && cp.ValidUntil.Before(*cp.ValidFrom) {
+		return "valid_until must be after valid_from"
+	}
+	return ""
+}
+
+// couponNotFound writes the standard 404 response for a missing coupon
+func couponNotFound(c *gin.Context, code string) {
+	c.JSON(http.StatusNotFound, gin.H{
+		"error": "Coupon not found",
+		"code":  code,
+	})
+}
+
+// getCoupons returns all coupons
+// Returns: 200 OK - Success
+func getCoupons(c *gin.Context) {
+	coupons.mu.RLock()
+	list := make([]Coupon, 0, len(coupons.coupons))
+	for _, cp := range coupons.coupons {
+		list = append(list, cp)
+	}
+	coupons.mu.RUnlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Code < list[j].Code })
+
+	c.JSON(http.StatusOK, gin.H{
+		"count":   len(list),
+		"coupons": list,
+	})
+}
+
+// getCouponByCode returns a single coupon
+// Returns: 200 OK - Found
+// Returns: 404 Not Found - Coupon doesn't exist
+func getCouponByCode(c *gin.Context) {
+	code := normalizeCouponCode(c.Param("code"))
+
+	coupons.mu.RLock()
+	defer coupons.mu.RUnlock()
+
+	cp, exists := coupons.coupons[code]
+	if !exists {
+		couponNotFound(c, code)
+		return
+	}
+
+	c.JSON(http.StatusOK, cp)
+}
+
+// createCoupon adds a new coupon
+// Returns: 201 Created - Success (Cat with a price tag!)
+// Returns: 400 Bad Request - Invalid input
+// Returns: 409 Conflict - Coupon code already exists
+func createCoupon(c *gin.Context) {
+	var newCoupon Coupon
+	if err := c.ShouldBindJSON(&newCoupon); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":   "Invalid coupon data",
+			"details": err.Error(),
+		})
+		return
+	}
+	if msg := validateCoupon(&newCoupon); msg != "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":   "Invalid coupon data",
+			"details": msg,
+		})
+		return
+	}
+	newCoupon.Uses = 0
+
+	coupons.mu.Lock()
+	defer coupons.mu.Unlock()
+
+	if _, exists := coupons.coupons[newCoupon.Code]; exists {
+		c.JSON(http.StatusConflict, gin.H{
+			"error": "Coupon with this code already exists",
+			"code":  newCoupon.Code,
+		})
+		return
+	}
+	coupons.coupons[newCoupon.Code] = newCoupon
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message": "Coupon created successfully",
+		"coupon":  newCoupon,
+	})
+}
+
+// deleteCoupon removes a coupon
+// Returns: 204 No Content - Success
+// Returns: 404 Not Found - Coupon doesn't exist
+func deleteCoupon(c *gin.Context) {
+	code := normalizeCouponCode(c.Param("code"))
+
+	coupons.mu.Lock()
+	defer coupons.mu.Unlock()
+
+	if _, exists := coupons.coupons[code]; !exists {
+		couponNotFound(c, code)
+		return
+	}
+	delete(coupons.coupons, code)
+
+	c.Status(http.StatusNoContent)
+}
+
+// redeemCoupon counts one use of a coupon, called by checkout when an
+// order using it is placed
+// Returns: 200 OK - Redeemed
+// Returns: 404 Not Found - Coupon doesn't exist
+// Returns: 409 Conflict - Coupon is expired, not valid yet, or used up
+func redeemCoupon(c *gin.Context) {
+	code := normalizeCouponCode(c.Param("code"))
+
+	coupons.mu.Lock()
+	defer coupons.mu.Unlock()
+
+	cp, exists := coupons.coupons[code]
+	if !exists {
+		couponNotFound(c, code)
+		return
+	}
+	if reason := cp.unusableReason(time.Now()); reason != "" {
+		c.JSON(http.StatusConflict, gin.H{
+			"error": reason,
+			"code":  code,
+		})
+		return
+	}
+	cp.Uses++
+	coupons.coupons[code] = cp
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Coupon redeemed",
+		"coupon":  cp,
+	})
+}
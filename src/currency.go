@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RateProvider returns exchange rates from a base currency to others.
+// A rate r means 1 unit of base = r units of the target currency.
+type RateProvider interface {
+	Rates(ctx context.Context, base string) (map[string]*big.Rat, error)
+}
+
+// errNoRate is returned when a currency pair can't be converted
+var errNoRate = errors.New("no exchange rate")
+
+// staticRates serves fixed rates, configured as EXCHANGE_RATES JSON such as
+// {"USD": {"EUR": "0.92", "GBP": "0.79"}}
+type staticRates map[string]map[string]*big.Rat
+
+func (s staticRates) Rates(ctx context.Context, base string) (map[string]*big.Rat, error) {
+	return s[base], nil
+}
+
+// httpRates fetches rates from a JSON API that answers {"rates": {...}}.
+// The URL may contain {base}, e.g. https://api.frankfurter.app/latest?from={base}
+type httpRates struct {
+	url    string
+	client *http.Client
+}
+
+func (h *httpRates) Rates(ctx context.Context, base string) (rates map[string]*big.Rat, err error) {
+	start := time.Now()
+	defer func() { exchangeRatesDependency.observe(start, err) }()
+
+	url := strings.ReplaceAll(h.url, "{base}", base)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("exchange rates: %s", resp.Status)
+	}
+
+	var body struct {
+		Rates map[string]json.Number `json:"rates"`
+	}
+	dec := json.NewDecoder(resp.Body)
+	dec.UseNumber()
+	if err := dec.Decode(&body); err != nil {
+		return nil, fmt.Errorf("exchange rates: %w", err)
+	}
+	return parseRates(body.Rates)
+}
+
+// cachedRates keeps rates per base currency for a TTL
+type cachedRates struct {
+	provider RateProvider
+	ttl      time.Duration
+
+	mu      sync.Mutex
+	entries map[string]cachedRateEntry
+}
+
+type cachedRateEntry struct {
+	rates   map[string]*big.Rat
+	fetched time.Time
+}
+
+func (c *cachedRates) Rates(ctx context.Context, base string) (map[string]*big.Rat, error) {
+	c.mu.Lock()
+	entry, exists := c.entries[base]
+	c.mu.Unlock()
+	if exists && time.Since(entry.fetched) < c.ttl {
+		return entry.rates, nil
+	}
+
+	var fetchErr error
+	val, ok := flights.do("rates", base, func() (any, bool) {
+		rates, err := c.provider.Rates(ctx, base)
+		if err != nil {
+			fetchErr = err
+			return nil, false
+		}
+		c.mu.Lock()
+		c.entries[base] = cachedRateEntry{rates: rates, fetched: time.Now()}
+		c.mu.Unlock()
+		return rates, true
+	})
+	if !ok {
+		// Fall back to the last known rates rather than failing reads
+		if exists {
+			return entry.rates, nil
+		}
+		if fetchErr == nil {
+			fetchErr = errors.New("exchange rates unavailable")
+		}
+		return nil, fetchErr
+	}
+	return val.(map[string]*big.Rat), nil
+}
+
+// Global rate provider
+var exchangeRates RateProvider = newRateProvider()
+
+func newRateProvider() RateProvider {
+	var provider RateProvider = staticRates{}
+	if url := os.Getenv("EXCHANGE_RATES_URL"); url != "" {
+		provider = &httpRates{url: url, client: newPooledClient("exchange_rates", 5*time.Second)}
+	} else if raw := os.Getenv("EXCHANGE_RATES"); raw != "" {
+		rates, err := parseStaticRates(raw)
+		if err != nil {
+			panic(fmt.Sprintf("invalid EXCHANGE_RATES: %v", err))
+		}
+		provider = rates
+	}
+	return &cachedRates{
+		provider: provider,
+		ttl:      envDuration("EXCHANGE_RATES_TTL", time.Hour),
+		entries:  make(map[string]cachedRateEntry),
+	}
+}
+
+func parseStaticRates(raw string) (staticRates, error) {
+	var config map[string]map[string]json.Number
+	dec := json.NewDecoder(strings.NewReader(raw))
+	dec.UseNumber()
+	if err := dec.Decode(&config); err != nil {
+		return nil, err
+	}
+	rates := make(staticRates, len(config))
+	for base, targets := range config {
+		parsed, err := parseRates(targets)
+		if err != nil {
+			return nil, err
+		}
+		rates[strings.ToUpper(base)] = parsed
+	}
+	return rates, nil
+}
+
+func parseRates(raw map[string]json.Number) (map[string]*big.Rat, error) {
+	rates := make(map[string]*big.Rat, len(raw))
+	for currency, value := range raw {
+		r, ok := new(big.Rat).SetString(value.String())
+		if !ok || r.Sign() <= 0 {
+			return nil, fmt.Errorf("invalid rate %s for %s", value, currency)
+		}
+		rates[strings.ToUpper(currency)] = r
+	}
+	return rates, nil
+}
+
+// exchangeRate returns the rate to convert from one currency to another
+func exchangeRate(ctx context.Context, from, to string) (*big.Rat, error) {
+	if from == to {
+		return big.NewRat(1, 1), nil
+	}
+	rates, err := exchangeRates.Rates(ctx, from)
+	if err != nil {
+		return nil, err
+	}
+	rate, exists := rates[to]
+	if !exists {
+		return nil, fmt.Errorf("%w from %s to %s", errNoRate, from, to)
+	}
+	return rate, nil
+}
+
+// convert multiplies an amount by a rate, rounding half away from zero
+func (m Money) convert(rate *big.Rat) Money {
+	r := new(big.Rat).Mul(new(big.Rat).SetInt64(int64(m)), rate)
+	num, den := r.Num(), r.Denom()
+	q, rem := new(big.Int).QuoRem(num, den, new(big.Int))
+	if new(big.Int).Abs(new(big.Int).Mul(rem, big.NewInt(2))).Cmp(den) >= 0 {
+		if num.Sign() < 0 {
+			q.Sub(q, big.NewInt(1))
+		} else {
+			q.Add(q, big.NewInt(1))
+		}
+	}
+	return Money(q.Int64())
+}
+
+// convertProduct returns a copy of a product priced in another currency
+func convertProduct(p Product, to string, rate *big.Rat) Product {
+	p.Price = p.Price.convert(rate)
+	p.Currency = to
+	if p.SalePrice != nil {
+		sale := p.SalePrice.convert(rate)
+		p.SalePrice = &sale
+	}
+	if len(p.ScheduledPrices) > 0 {
+		scheduled := make([]ScheduledPrice, len(p.ScheduledPrices))
+		for i, sp := range p.ScheduledPrices {
+			sp.Price = sp.Price.convert(rate)
+			scheduled[i] = sp
+		}
+		p.ScheduledPrices = scheduled
+	}
+	if len(p.Variants) > 0 {
+		variants := make([]Variant, len(p.Variants))
+		for i, v := range p.Variants {
+			v.PriceDelta = v.PriceDelta.convert(rate)
+			variants[i] = v
+		}
+		p.Variants = variants
+	}
+	return p
+}
+
+// requestedCurrency reads ?currency=XXX. It writes a 400 and returns false
+// when the code is invalid.
+func requestedCurrency(c *gin.Context) (string, bool) {
+	currency := strings.ToUpper(c.Query("currency"))
+	if currency != "" && !validCurrency(currency) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":    "Currency must be an ISO 4217 code",
+			"currency": currency,
+		})
+		return "", false
+	}
+	return currency, true
+}
+
+// localizeProducts converts products into the requested currency. It
+// writes the error response and returns false on failure.
+func localizeProducts(c *gin.Context, products []Product, to string) ([]Product, bool) {
+	if to == "" {
+		return products, true
+	}
+	localized := make([]Product, len(products))
+	for i, p := range products {
+		rate, err := exchangeRate(c.Request.Context(), p.Currency, to)
+		if err != nil {
+			conversionFailed(c, err)
+			return nil, false
+		}
+		localized[i] = convertProduct(p, to, rate)
+	}
+	return localized, true
+}
+
+// conversionFailed writes 400 for unsupported pairs and 502 when the rate
+// provider is down
+func conversionFailed(c *gin.Context, err error) {
+	if requestCanceled(c) {
+		return
+	}
+	status := http.StatusBadGateway
+	if errors.Is(err, errNoRate) {
+		status = http.StatusBadRequest
+	}
+	c.JSON(status, gin.H{
+		"error":   "Currency conversion failed",
+		"details": err.Error(),
+	})
+}
+
+// convertCurrency converts an amount between currencies
+// Returns: 200 OK - Converted amount (Cat counting coins!)
+// Returns: 400 Bad Request - Invalid amount or unsupported currency
+// Returns: 502 Bad Gateway - Exchange rate provider unavailable
+// Returns: 504 Gateway Timeout - Took longer than REQUEST_TIMEOUT
+func convertCurrency(c *gin.Context) {
+	amount, err := parseMoney(c.Query("amount"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":   "Invalid amount",
+			"details": err.Error(),
+		})
+		return
+	}
+	from, to := strings.ToUpper(c.Query("from")), strings.ToUpper(c.Query("to"))
+	if !validCurrency(from) || !validCurrency(to) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "from and to must be ISO 4217 codes",
+		})
+		return
+	}
+
+	rate, err := exchangeRate(c.Request.Context(), from, to)
+	if err != nil {
+		conversionFailed(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"amount":    amount,
+		"from":      from,
+		"to":        to,
+		"rate":      rate.FloatString(6),
+		"converted": amount.convert(rate),
+	})
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// requestTimeout bounds how long a request may wait on the cache, peers,
+// S3 and exchange rates, REQUEST_TIMEOUT (0 for no deadline)
+var requestTimeout = envDuration("REQUEST_TIMEOUT", 30*time.Second)
+
+// Requests that ended before their handler was done
+var (
+	requestTimeouts    = expvar.NewInt("request_timeouts")
+	requestDisconnects = expvar.NewInt("request_disconnects")
+)
+
+// longRequests are the routes, without their version prefix, that stream
+// or move the whole catalog and so run without a deadline. Async jobs have
+// ASYNC_JOB_TIMEOUT instead.
+var longRequests = map[string]bool{
+	"/products/stream":              true,
+	"/admin/export":                 true,
+	"/admin/import":                 true,
+	"/admin/backups":                true,
+	"/admin/backups/:name/restore":  true,
+	"/admin/snapshots":              true,
+	"/admin/replace-jobs/:id/apply": true,
+}
+
+// requestDeadline gives each request's context a deadline of
+// requestTimeout. The context is also canceled when the client goes
+// away, so calls made with it stop rather than pile up behind a slow
+// backend. Writes to the store don't take the context: once started they
+// finish, so a product is never half written.
+func requestDeadline() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Unversioned paths have no route until unversionedRoute routes
+		// them again, and this runs again then
+		route := c.FullPath()
+		if requestTimeout <= 0 || route == "" || longRequests[versionedPath.ReplaceAllString(route, "/")] || c.Request.Context().Value(asyncJobKey{}) != nil {
+			c.Next()
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(c.Request.Context(), requestTimeout)
+		defer cancel()
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+	}
+}
+
+// requestCanceled reports whether the request's context is done, writing
+// 504 when it ran out of time. A client that went away gets nothing.
+// Returns: 504 Gateway Timeout - Took longer than REQUEST_TIMEOUT (Cat got bored waiting!)
+func requestCanceled(c *gin.Context) bool {
+	err := c.Request.Context().Err()
+	switch {
+	case err == nil:
+		return false
+	case errors.Is(err, context.DeadlineExceeded):
+		requestTimeouts.Add(1)
+		c.AbortWithStatusJSON(http.StatusGatewayTimeout, gin.H{
+			"error":   "Request took too long",
+			"timeout": requestTimeout.String(),
+		})
+	default:
+		requestDisconnects.Add(1)
+		c.Abort()
+	}
+	return true
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/csv"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// deadStockDays is how long stock can go unsold before it's dead,
+// DEAD_STOCK_DAYS, and the report's default
+var deadStockDays = envInt("DEAD_STOCK_DAYS", 90)
+
+// stockAging follows a product's stock first in, first out: increases are
+// layers received at a time, decreases take from the oldest layer. A zero
+// time is stock that was on hand before the process started, whose age
+// is unknown.
+type stockAging struct {
+	layers   []stockLayer
+	stock    int
+	seen     bool // stock has been sampled
+	lastSale time.Time
+}
+
+type stockLayer struct {
+	quantity int
+	at       time.Time
+}
+
+// agingOf returns the aging of a product, creating it. Callers must hold
+// a.mu.
+func (a *AnalyticsStore) agingOf(productID string) *stockAging {
+	age, exists := a.aging[productID]
+	if !exists {
+		age = &stockAging{}
+		a.aging[productID] = age
+	}
+	return age
+}
+
+// removeAging forgets a purged product
+func (a *AnalyticsStore) removeAging(productID string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	delete(a.aging, productID)
+}
+
+// restock moves the layers to a new stock level
+func (s *stockAging) restock(stock int, created bool, at time.Time) {
+	if !s.seen {
+		s.seen, s.stock = true, stock
+		if stock > 0 {
+			layer := stockLayer{quantity: stock}
+			if created {
+				layer.at = at
+			}
+			s.layers = []stockLayer{layer}
+		}
+		return
+	}
+
+	change := stock - s.stock
+	s.stock = stock
+	if change > 0 {
+		s.layers = append(s.layers, stockLayer{quantity: change, at: at})
+		return
+	}
+	for change < 0 && len(s.layers) > 0 {
+		taken := min(-change, s.layers[0].quantity)
+		s.layers[0].quantity -= taken
+		change += taken
+		if s.layers[0].quantity == 0 {
+			s.layers = s.layers[1:]
+		}
+	}
+}
+
+// StockAge describes how old a product's stock is and when it last sold.
+// Ages are in whole days and nil when unknown.
+type StockAge struct {
+	ID              string     `json:"id"`
+	Name            string     `json:"name"`
+	Category        string     `json:"category,omitempty"`
+	Stock           int        `json:"stock"`
+	StockValue      Money      `json:"stock_value"` // at list price
+	Currency        string     `json:"currency"`
+	LastSaleAt      *time.Time `json:"last_sale_at"`
+	DaysSinceSale   *int       `json:"days_since_last_sale"`
+	OldestStockDays *int       `json:"oldest_stock_days"`
+	AverageAgeDays  *int       `json:"average_stock_age_days"` // weighted by quantity
+	idleDays        int
+}
+
+// stockAge reports on a product's stock at a time. It's idle for the days
+// since its last sale, or since its oldest stock arrived when it hasn't
+// sold. Callers must hold a.mu.
+func (a *AnalyticsStore) stockAge(p *Product, now time.Time) (StockAge, bool) {
+	report := StockAge{
+		ID:         p.ID,
+		Name:       p.Name,
+		Category:   p.Category,
+		Stock:      p.Stock,
+		StockValue: p.Price * Money(p.Stock),
+		Currency:   p.Currency,
+	}
+	days := func(since time.Time) *int {
+		d := int(now.Sub(since) / (24 * time.Hour))
+		return &d
+	}
+
+	age := a.aging[p.key()]
+	if age == nil {
+		return report, false
+	}
+	if !age.lastSale.IsZero() {
+		lastSale := age.lastSale.UTC()
+		report.LastSaleAt, report.DaysSinceSale = &lastSale, days(lastSale)
+	}
+	known := len(age.layers) > 0 && !age.layers[0].at.IsZero()
+	if known {
+		report.OldestStockDays = days(age.layers[0].at)
+		var total time.Duration
+		var units int
+		for _, layer := range age.layers {
+			total += now.Sub(layer.at) * time.Duration(layer.quantity)
+			units += layer.quantity
+		}
+		average := int(total / time.Duration(units) / (24 * time.Hour))
+		report.AverageAgeDays = &average
+	}
+
+	switch {
+	case report.DaysSinceSale != nil:
+		report.idleDays = *report.DaysSinceSale
+	case report.OldestStockDays != nil:
+		report.idleDays = *report.OldestStockDays
+	default:
+		return report, false
+	}
+	return report, true
+}
+
+// deadStockCSVHeader are the columns of the CSV report
+var deadStockCSVHeader = []string{"id", "name", "category", "stock", "stock_value", "currency", "last_sale_at", "days_since_last_sale", "oldest_stock_days", "average_stock_age_days"}
+
+// getDeadStockReport lists products in stock that haven't sold for
+// ?days= (default DEAD_STOCK_DAYS), longest idle first, so purchasing can
+// plan clearance. ?category= narrows it down. Accept: text/csv exports it.
+// Sales come from analytics events and stock ages from stock changes,
+// both since the process started.
+// Returns: 200 OK - Report (Cat dusting the back shelves!)
+// Returns: 400 Bad Request - Invalid days
+// Returns: 406 Not Acceptable - Accept rules out JSON and CSV
+func getDeadStockReport(c *gin.Context) {
+	days, err := strconv.Atoi(c.DefaultQuery("days", strconv.Itoa(deadStockDays)))
+	if err != nil || days < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "days must be a positive number", "days": c.Query("days")})
+		return
+	}
+	format, ok := negotiate(c, mimeJSON, mimeCSV)
+	if !ok {
+		return
+	}
+	tenant, category := tenantOf(c), c.Query("category")
+
+	store.mu.RLock()
+	products := make([]Product, 0, len(store.products))
+	for _, p := range store.products {
+		if p.Tenant == tenant && p.DeletedAt == nil && p.Stock > 0 && (category == "" || p.Category == category) {
+			products = append(products, p)
+		}
+	}
+	store.mu.RUnlock()
+
+	now := time.Now()
+	dead := make([]StockAge, 0)
+	analytics.mu.Lock()
+	for i := range products {
+		if report, known := analytics.stockAge(&products[i], now); known && report.idleDays >= days {
+			dead = append(dead, report)
+		}
+	}
+	analytics.mu.Unlock()
+
+	sort.Slice(dead, func(i, j int) bool {
+		if dead[i].idleDays != dead[j].idleDays {
+			return dead[i].idleDays > dead[j].idleDays
+		}
+		return dead[i].ID < dead[j].ID
+	})
+
+	if format == mimeCSV {
+		c.Header("Content-Type", mimeCSV+"; charset=utf-8")
+		c.Header("Content-Disposition", `attachment; filename="dead-stock.csv"`)
+		c.Status(http.StatusOK)
+		w := csv.NewWriter(c.Writer)
+		w.Write(deadStockCSVHeader)
+		for _, r := range dead {
+			w.Write([]string{
+				r.ID, r.Name, r.Category, strconv.Itoa(r.Stock), r.StockValue.String(), r.Currency,
+				csvTime(r.LastSaleAt), csvDays(r.DaysSinceSale), csvDays(r.OldestStockDays), csvDays(r.AverageAgeDays),
+			})
+		}
+		w.Flush()
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"days":     days,
+		"count":    len(dead),
+		"products": dead,
+	})
+}
+
+func csvTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+func csvDays(d *int) string {
+	if d == nil {
+		return ""
+	}
+	return strconv.Itoa(*d)
+}
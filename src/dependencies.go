@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Dependency status values
+const (
+	statusUp       = "up"
+	statusDegraded = "degraded"
+	statusDown     = "down"
+)
+
+// latencySamples is how many recent calls percentiles are computed over
+const latencySamples = 256
+
+// dependency tracks the health of something the API relies on. Passive
+// stats come from observe() on real calls; probe, when set, is run on
+// every /admin/system request.
+type dependency struct {
+	name      string
+	kind      string
+	critical  bool
+	dependsOn []string
+	probe     func(ctx context.Context) error
+
+	mu            sync.Mutex
+	latencies     [latencySamples]time.Duration
+	samples       int
+	calls         int64
+	failures      int64
+	recentResults uint64 // bit i set = call i ago failed
+	lastError     string
+	lastErrorAt   time.Time
+}
+
+// observe records the outcome of one call that started at start
+func (d *dependency) observe(start time.Time, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.latencies[d.samples%latencySamples] = time.Since(start)
+	d.samples++
+	d.calls++
+	d.recentResults <<= 1
+	if err != nil {
+		d.failures++
+		d.recentResults |= 1
+		d.lastError = err.Error()
+		d.lastErrorAt = time.Now().UTC()
+	}
+}
+
+// status derives up/degraded/down from the last 16 calls: down when all
+// of them failed, degraded when some did. Callers must hold d.mu.
+func (d *dependency) status() string {
+	window := min(d.calls, 16)
+	mask := uint64(1)<<window - 1
+	failed := d.recentResults & mask
+	switch {
+	case failed == 0:
+		return statusUp
+	case failed == mask:
+		return statusDown
+	}
+	return statusDegraded
+}
+
+// DependencyReport is one node of the dependency map
+type DependencyReport struct {
+	Name        string             `json:"name"`
+	Kind        string             `json:"kind"`
+	Critical    bool               `json:"critical"`
+	Status      string             `json:"status"`
+	DependsOn   []string           `json:"depends_on"`
+	Calls       int64              `json:"calls"`
+	Failures    int64              `json:"failures"`
+	LatencyMS   map[string]float64 `json:"latency_ms,omitempty"`
+	LastError   string             `json:"last_error,omitempty"`
+	LastErrorAt *time.Time         `json:"last_error_at,omitempty"`
+}
+
+// report snapshots the dependency, running its probe first
+func (d *dependency) report(ctx context.Context) DependencyReport {
+	if d.probe != nil {
+		start := time.Now()
+		d.observe(start, d.probe(ctx))
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	r := DependencyReport{
+		Name:      d.name,
+		Kind:      d.kind,
+		Critical:  d.critical,
+		Status:    d.status(),
+		DependsOn: d.dependsOn,
+		Calls:     d.calls,
+		Failures:  d.failures,
+		LastError: d.lastError,
+	}
+	if !d.lastErrorAt.IsZero() {
+		at := d.lastErrorAt
+		r.LastErrorAt = &at
+	}
+
+	n := min(d.samples, latencySamples)
+	if n > 0 {
+		sorted := append([]time.Duration(nil), d.latencies[:n]...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		r.LatencyMS = make(map[string]float64, 3)
+		for name, q := range map[string]float64{"p50": 0.50, "p95": 0.95, "p99": 0.99} {
+			r.LatencyMS[name] = float64(sorted[int(q*float64(n-1))].Microseconds()) / 1000
+		}
+	}
+	return r
+}
+
+// dependencyMap holds every registered dependency
+type dependencyMap struct {
+	mu    sync.Mutex
+	nodes []*dependency
+}
+
+var dependencies = &dependencyMap{}
+
+// register adds a dependency to the map and returns it
+func (m *dependencyMap) register(d *dependency) *dependency {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.nodes = append(m.nodes, d)
+	return d
+}
+
+// Registered dependencies
+var (
+	storageDependency = dependencies.register(&dependency{
+		name:     "storage",
+		kind:     "in-memory store",
+		critical: true,
+		probe: func(ctx context.Context) error {
+			store.mu.RLock()
+			_ = len(store.products)
+			store.mu.RUnlock()
+			return nil
+		},
+	})
+	walDependency = dependencies.register(&dependency{
+		name:      "wal",
+		kind:      "write-ahead log",
+		critical:  true,
+		dependsOn: []string{"storage"},
+		probe: func(ctx context.Context) error {
+			if store.wal == nil {
+				return nil
+			}
+			return store.wal.sync()
+		},
+	})
+	cacheDependency = dependencies.register(&dependency{
+		name:      "cache",
+		kind:      "in-process cache / redis",
+		dependsOn: []string{"storage"},
+		probe: func(ctx context.Context) error {
+			return cache.backend.ping(ctx)
+		},
+	})
+	exchangeRatesDependency = dependencies.register(&dependency{
+		name: "exchange_rates",
+		kind: "external api",
+	})
+	s3Dependency = dependencies.register(&dependency{
+		name: "s3",
+		kind: "aws s3",
+	})
+	notificationsDependency = dependencies.register(&dependency{
+		name: "notifications",
+		kind: "sns / slack webhook",
+	})
+	eventDestinationsDependency = dependencies.register(&dependency{
+		name: "event_destinations",
+		kind: "sns / sqs / http",
+	})
+	webhooksDependency = dependencies.register(&dependency{
+		name: "webhooks",
+		kind: "http",
+	})
+)
+
+// probeCritical runs the probe of every critical dependency, giving up on
+// ones that don't answer before ctx is done. It returns the failures.
+func probeCritical(ctx context.Context) map[string]string {
+	dependencies.mu.Lock()
+	nodes := append([]*dependency(nil), dependencies.nodes...)
+	dependencies.mu.Unlock()
+
+	failures := make(map[string]string)
+	for _, d := range nodes {
+		if !d.critical || d.probe == nil {
+			continue
+		}
+		done := make(chan error, 1)
+		start := time.Now()
+		go func() { done <- d.probe(ctx) }()
+
+		var err error
+		select {
+		case err = <-done:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+		d.observe(start, err)
+		if err != nil {
+			failures[d.name] = err.Error()
+		}
+	}
+	return failures
+}
+
+// statusWeight turns a status into a score contribution
+var statusWeight = map[string]float64{statusUp: 1, statusDegraded: 0.5, statusDown: 0}
+
+// getSystemStatus returns the dependency map with a composite health score
+// from 0 to 100. Critical dependencies weigh three times as much and any
+// critical dependency being down makes the whole system down.
+// Returns: 200 OK - Dependency map (Cat inspecting the wiring!)
+func getSystemStatus(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 2*time.Second)
+	defer cancel()
+
+	dependencies.mu.Lock()
+	nodes := append([]*dependency(nil), dependencies.nodes...)
+	dependencies.mu.Unlock()
+
+	reports := make([]DependencyReport, 0, len(nodes))
+	var score, total float64
+	overall := statusUp
+	for _, d := range nodes {
+		r := d.report(ctx)
+		reports = append(reports, r)
+
+		weight := 1.0
+		if r.Critical {
+			weight = 3
+		}
+		score += weight * statusWeight[r.Status]
+		total += weight
+
+		switch {
+		case r.Status == statusDown && r.Critical:
+			overall = statusDown
+		case r.Status != statusUp && overall == statusUp:
+			overall = statusDegraded
+		}
+	}
+
+	names := make([]string, len(reports))
+	for i, r := range reports {
+		names[i] = r.Name
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":       overall,
+		"score":        int(100 * score / total),
+		"root":         gin.H{"name": "api", "depends_on": names},
+		"dependencies": reports,
+	})
+}
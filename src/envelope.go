@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// v2 product list pages: ?limit= products (default 50, at most 500) after
+// the ID in ?after=
+const (
+	defaultPageSize = 50
+	maxPageSize     = 500
+)
+
+// envelopedKey is the gin context key set on requests whose JSON
+// responses are enveloped
+const envelopedKey = "enveloped"
+
+// Envelope is the shape of every v2 JSON response. Data is what v1
+// answers; errors go in Error instead, so clients can tell them apart
+// without the status code. Validation problems stay application/problem+json.
+type Envelope struct {
+	Data  any               `json:"data,omitempty"`
+	Error json.RawMessage   `json:"error,omitempty"`
+	Meta  EnvelopeMeta      `json:"meta"`
+	Links map[string]string `json:"links,omitempty"`
+}
+
+// EnvelopeMeta describes the response rather than the resource
+type EnvelopeMeta struct {
+	APIVersion string `json:"api_version"`
+	RequestID  string `json:"request_id,omitempty"`
+	Status     int    `json:"status"`
+	Count      *int   `json:"count,omitempty"` // items in a list page
+	Total      *int   `json:"total,omitempty"` // items in the whole list
+}
+
+// ProductResource is a product with the links to what belongs to it
+type ProductResource struct {
+	Product
+	Links map[string]string `json:"links"`
+}
+
+// registerV2Routes registers the v2 API: the routes of v1, with JSON
+// responses in an Envelope and product lists paged
+func registerV2Routes(r gin.IRouter) {
+	r.Use(envelopeResponses("v2"))
+	registerV1Routes(r)
+}
+
+// envelopeResponses wraps the JSON responses of a version's routes in an
+// Envelope. Handlers that build the envelope themselves, as product reads
+// do to add links, are left alone; other formats and streams too.
+func envelopeResponses(version string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set(envelopedKey, true)
+		w := &envelopeWriter{ResponseWriter: c.Writer, c: c, version: version}
+		c.Writer = w
+		defer w.finish()
+		c.Next()
+	}
+}
+
+// enveloped reports whether a request's JSON responses are enveloped
+func enveloped(c *gin.Context) bool {
+	return c.GetBool(envelopedKey)
+}
+
+// envelopeWriter holds back JSON bodies to wrap them once the handler is
+// done. Anything else, or a JSON body the handler flushes, goes straight
+// through.
+type envelopeWriter struct {
+	gin.ResponseWriter
+	c       *gin.Context
+	version string
+	decided bool
+	hold    bool
+	buf     bytes.Buffer
+}
+
+func (w *envelopeWriter) Write(b []byte) (int, error) {
+	if !w.decided {
+		w.decided = true
+		mediaType, _, _ := strings.Cut(w.Header().Get("Content-Type"), ";")
+		w.hold = strings.TrimSpace(mediaType) == mimeJSON && w.c.GetBool(envelopedKey)
+	}
+	if w.hold {
+		return w.buf.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *envelopeWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// Flush gives up on enveloping, since a flushing handler is streaming
+func (w *envelopeWriter) Flush() {
+	if w.hold {
+		w.hold = false
+		w.ResponseWriter.Write(w.buf.Bytes())
+		w.buf.Reset()
+	}
+	w.ResponseWriter.Flush()
+}
+
+// Written reports whether anything has been written, held back or not
+func (w *envelopeWriter) Written() bool {
+	return w.ResponseWriter.Written() || w.buf.Len() > 0
+}
+
+// finish writes a held back body in its envelope
+func (w *envelopeWriter) finish() {
+	if !w.hold {
+		return
+	}
+	body := bytes.TrimSpace(w.buf.Bytes())
+	env := newEnvelope(w.c, w.version, w.Status())
+	if w.Status() >= http.StatusBadRequest {
+		env.Error = body
+	} else {
+		env.Data = json.RawMessage(body)
+	}
+	data, err := json.Marshal(env)
+	if err != nil {
+		data = w.buf.Bytes()
+	}
+	w.Header().Del("Content-Length")
+	w.ResponseWriter.Write(data)
+}
+
+// newEnvelope starts the envelope of a response, linking to itself
+func newEnvelope(c *gin.Context, version string, status int) Envelope {
+	return Envelope{
+		Meta: EnvelopeMeta{
+			APIVersion: version,
+			RequestID:  c.GetString(requestIDKey),
+			Status:     status,
+		},
+		Links: map[string]string{"self": c.Request.URL.RequestURI()},
+	}
+}
+
+// writeEnvelope answers with an envelope a handler built, which
+// envelopeResponses then leaves as it is
+func writeEnvelope(c *gin.Context, env Envelope) {
+	c.Set(envelopedKey, false)
+	c.JSON(env.Meta.Status, env)
+}
+
+// productLinks are the links of a product under a version's base path
+func productLinks(base string, p Product) map[string]string {
+	self := base + "/products/" + url.PathEscape(p.ID)
+	links := map[string]string{
+		"self":       self,
+		"collection": base + "/products",
+		"full":       self + "/full",
+		"reviews":    self + "/reviews",
+		"related":    self + "/related",
+		"metrics":    self + "/metrics",
+	}
+	if len(p.Variants) > 0 {
+		links["variants"] = self + "/variants"
+	}
+	if len(p.Images) > 0 {
+		links["image"] = p.Images[0]
+	}
+	if p.Category != "" {
+		links["category"] = base + "/products?category=" + url.QueryEscape(p.Category)
+	}
+	return links
+}
+
+// versionBase is the path prefix of the version serving a request
+func versionBase(c *gin.Context) string {
+	return "/" + c.Writer.Header().Get("API-Version")
+}
+
+// renderProductEnvelope writes one product with its links
+func renderProductEnvelope(c *gin.Context, product Product, fields fieldSet) {
+	env := newEnvelope(c, strings.TrimPrefix(versionBase(c), "/"), http.StatusOK)
+	env.Data = productResource(product, productLinks(versionBase(c), product), fields)
+	writeEnvelope(c, env)
+}
+
+// renderProductPage writes a page of a product list, sorted by ID, each
+// product with its links, and a next link while there are more
+// Returns: 400 Bad Request - Invalid limit
+func renderProductPage(c *gin.Context, products []Product, fields fieldSet) {
+	limit := defaultPageSize
+	if raw := c.Query("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > maxPageSize {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and " + strconv.Itoa(maxPageSize)})
+			return
+		}
+		limit = n
+	}
+
+	sorted := slices.Clone(products)
+	slices.SortFunc(sorted, func(a, b Product) int { return strings.Compare(a.ID, b.ID) })
+	start := 0
+	if after := c.Query("after"); after != "" {
+		start, _ = slices.BinarySearchFunc(sorted, after, func(p Product, id string) int {
+			if p.ID <= id {
+				return -1
+			}
+			return 1
+		})
+	}
+	end := min(start+limit, len(sorted))
+	page := sorted[start:end]
+
+	base := versionBase(c)
+	resources := make([]any, len(page))
+	for i, p := range page {
+		resources[i] = productResource(p, productLinks(base, p), fields)
+	}
+	count, total := len(page), len(sorted)
+	env := newEnvelope(c, strings.TrimPrefix(base, "/"), http.StatusOK)
+	env.Data = resources
+	env.Meta.Count, env.Meta.Total = &count, &total
+
+	query := c.Request.URL.Query()
+	query.Del("after")
+	env.Links["first"] = pageURL(c, query)
+	if end < len(sorted) {
+		query.Set("after", page[len(page)-1].ID)
+		env.Links["next"] = pageURL(c, query)
+	}
+	writeEnvelope(c, env)
+}
+
+// productResource is a product with its links, only the selected fields
+// of it if any were
+func productResource(p Product, links map[string]string, fields fieldSet) any {
+	if fields != nil {
+		return fields.project(p, links)
+	}
+	return ProductResource{Product: p, Links: links}
+}
+
+// pageURL is the request's path with another query
+func pageURL(c *gin.Context, query url.Values) string {
+	if len(query) == 0 {
+		return c.Request.URL.Path
+	}
+	return c.Request.URL.Path + "?" + query.Encode()
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// productETag returns the strong ETag for the current version of a
+// product, as writes return it. Versions start over when a product is
+// purged and created again, so the ETag also hashes its key and creation
+// time, and one held for the purged product doesn't match the new one.
+func productETag(p Product) string {
+	h := fnv.New32a()
+	fmt.Fprintf(h, "%s/%d", p.key(), p.CreatedAt.UnixNano())
+	return fmt.Sprintf(`"%d-%08x"`, p.Version, h.Sum32())
+}
+
+// readETag returns the strong ETag of a product as a read renders it: in
+// a format and currency, in the locale Accept-Language picks and with
+// ?fields=. Each representation has its own, the productETag with a hash
+// of what sets it apart after a "+"; JSON in the product's own terms has
+// the productETag itself. If-Match takes any of them.
+func readETag(c *gin.Context, p Product, format, currency string, fields fieldSet) string {
+	var representation []string
+	if format != mimeJSON {
+		representation = append(representation, format)
+	}
+	if currency != "" {
+		representation = append(representation, currency)
+	}
+	if locale := bestLocale(p, acceptedLocales(c.GetHeader("Accept-Language"))); locale != defaultLocale {
+		representation = append(representation, locale)
+	}
+	if fields != nil {
+		names := slices.Sorted(maps.Keys(fields))
+		representation = append(representation, strings.Join(names, ","))
+	}
+
+	etag := productETag(p)
+	if len(representation) == 0 {
+		return etag
+	}
+	h := fnv.New32a()
+	fmt.Fprint(h, strings.Join(representation, "\x00"))
+	return fmt.Sprintf(`%s+%08x"`, strings.TrimSuffix(etag, `"`), h.Sum32())
+}
+
+// baseETag returns the productETag an ETag of readETag is of
+func baseETag(etag string) string {
+	if base, _, found := strings.Cut(etag, "+"); found {
+		return base + `"`
+	}
+	return etag
+}
+
+// listETag returns a weak ETag for a list of products, which changes when
+// any of them is added, removed, changes version or starts or stops
+// showing a badge. It doesn't depend on their order.
+func listETag(products []Product, currency string) string {
+	var sum uint64
+	for _, p := range products {
+		h := fnv.New64a()
+		fmt.Fprintf(h, "%s/%d", p.ID, p.Version)
+		if len(p.ActiveBadges) > 0 {
+			fmt.Fprintf(h, "/%s", strings.Join(p.ActiveBadges, ","))
+		}
+		sum += h.Sum64()
+	}
+	if currency != "" {
+		return fmt.Sprintf(`W/"%d-%x-%s"`, len(products), sum, currency)
+	}
+	return fmt.Sprintf(`W/"%d-%x"`, len(products), sum)
+}
+
+// setCacheHeaders tells clients and CDNs how long a response stays fresh,
+// the route's cache TTL. Responses that depend on who is asking are only
+// cached by the client.
+func setCacheHeaders(c *gin.Context, policy cachePolicy) {
+	addVary(c, "Accept", "Authorization")
+	seconds := int(policy.ttl.Seconds())
+	switch {
+	case seconds <= 0:
+		c.Header("Cache-Control", "no-cache")
+	case c.GetHeader("Authorization") != "":
+		c.Header("Cache-Control", fmt.Sprintf("private, max-age=%d", seconds))
+	default:
+		c.Header("Cache-Control", fmt.Sprintf("public, max-age=%d, stale-while-revalidate=%d", seconds, int(policy.stale.Seconds())))
+	}
+}
+
+// notModified answers 304 when If-None-Match has the current ETag. The
+// comparison is weak, as RFC 9110 asks for If-None-Match.
+// Returns: 304 Not Modified - The client's copy is current
+func notModified(c *gin.Context, etag string) bool {
+	header := c.GetHeader("If-None-Match")
+	if header == "" || !etagMatches(strings.ReplaceAll(header, "W/", ""), strings.TrimPrefix(etag, "W/")) {
+		return false
+	}
+	c.Status(http.StatusNotModified)
+	return true
+}
+
+// setLastModified sets Last-Modified, unless the time is unknown
+func setLastModified(c *gin.Context, modified time.Time) {
+	if !modified.IsZero() {
+		c.Header("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	}
+}
+
+// notModifiedSince answers 304 when nothing changed after If-Modified-Since.
+// It's ignored when If-None-Match is sent, which is more precise, or when
+// the modification time is unknown.
+// Returns: 304 Not Modified - The client's copy is current
+func notModifiedSince(c *gin.Context, modified time.Time) bool {
+	if modified.IsZero() || c.GetHeader("If-None-Match") != "" {
+		return false
+	}
+	since, err := http.ParseTime(c.GetHeader("If-Modified-Since"))
+	// HTTP dates have whole seconds
+	if err != nil || modified.Truncate(time.Second).After(since) {
+		return false
+	}
+	c.Status(http.StatusNotModified)
+	return true
+}
+
+// etagMatches reports whether a comma separated If-Match / If-None-Match
+// header value contains the given ETag (or the "*" wildcard)
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// checkIfMatch enforces optimistic concurrency for writes. It writes the
+// error response and returns false when the request must not proceed.
+// Returns: 428 Precondition Required - If-Match header is missing
+// Returns: 412 Precondition Failed - If-Match doesn't match the current version
+func checkIfMatch(c *gin.Context, current Product) bool {
+	header := c.GetHeader("If-Match")
+	if header == "" {
+		c.JSON(http.StatusPreconditionRequired, gin.H{
+			"error": "If-Match header is required",
+			"id":    current.ID,
+		})
+		return false
+	}
+
+	// Any representation of the current version will do
+	candidates := strings.Split(header, ",")
+	for i, candidate := range candidates {
+		candidates[i] = baseETag(strings.TrimSpace(candidate))
+	}
+	etag := productETag(current)
+	if !etagMatches(strings.Join(candidates, ","), etag) {
+		c.Header("ETag", etag)
+		c.JSON(http.StatusPreconditionFailed, gin.H{
+			"error":   "Product has been modified",
+			"id":      current.ID,
+			"version": current.Version,
+		})
+		return false
+	}
+	return true
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+const bin = `{"id": "bin", "name": "Bin", "description": "Steel bin", "category": "storage", "price": "8.00", "currency": "USD", "stock": 2,
+	"translations": {"fr": {"name": "Poubelle"}}}`
+
+func TestETagOfPurgedProduct(t *testing.T) {
+	router := newTestRouter(t)
+	mustCreate(t, router, bin)
+	old := serve(router, "GET", "/v1/products/bin", "").Header().Get("ETag")
+
+	store.mu.Lock()
+	err := store.remove("bin")
+	store.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustCreate(t, router, bin)
+
+	if w := serve(router, "PATCH", "/v1/products/bin", `{"name": "Old bin"}`, append(asAdmin, "If-Match", old)...); w.Code != http.StatusPreconditionFailed {
+		t.Errorf("If-Match of the purged product: %d %s", w.Code, w.Body)
+	}
+	current := serve(router, "GET", "/v1/products/bin", "").Header().Get("ETag")
+	if w := serve(router, "PATCH", "/v1/products/bin", `{"name": "New bin"}`, append(asAdmin, "If-Match", current)...); w.Code != http.StatusOK {
+		t.Errorf("If-Match of the new product: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestETagPerRepresentation(t *testing.T) {
+	router := newTestRouter(t)
+	mustCreate(t, router, bin)
+
+	tests := []struct {
+		name   string
+		path   string
+		header []string
+	}{
+		{"JSON", "/v1/products/bin", nil},
+		{"fields", "/v1/products/bin?fields=name", nil},
+		{"locale", "/v1/products/bin", []string{"Accept-Language", "fr"}},
+		{"XML", "/v1/products/bin", []string{"Accept", "application/xml"}},
+	}
+	etags := make(map[string]string)
+	for _, tt := range tests {
+		w := serve(router, "GET", tt.path, "", tt.header...)
+		etag := w.Header().Get("ETag")
+		if other, seen := etags[etag]; seen {
+			t.Errorf("%s has the ETag of %s: %s", tt.name, other, etag)
+		}
+		etags[etag] = tt.name
+
+		t.Run(tt.name, func(t *testing.T) {
+			if w := serve(router, "GET", tt.path, "", append(tt.header, "If-None-Match", etag)...); w.Code != http.StatusNotModified {
+				t.Errorf("own ETag: %d", w.Code)
+			}
+			if tt.name != "JSON" {
+				if w := serve(router, "GET", "/v1/products/bin", "", "If-None-Match", etag); w.Code != http.StatusOK {
+					t.Errorf("ETag revalidates the JSON: %d", w.Code)
+				}
+			}
+		})
+	}
+	if _, ok := etags[productETag(store.products["bin"])]; !ok {
+		t.Errorf("JSON doesn't have the productETag, %s", productETag(store.products["bin"]))
+	}
+
+	// Writes take the ETag of any representation
+	for etag := range etags {
+		if etag != productETag(store.products["bin"]) {
+			if w := serve(router, "PATCH", "/v1/products/bin", `{"stock": 2}`, append(asAdmin, "If-Match", etag)...); w.Code != http.StatusOK {
+				t.Errorf("If-Match %s: %d %s", etag, w.Code, w.Body)
+			}
+			break
+		}
+	}
+}
+
+func TestGRPCExpectedVersion(t *testing.T) {
+	router := newTestRouter(t)
+	mustCreate(t, router, bin)
+	server := newGRPCServer(router)
+	call := &grpcCall{ctx: context.Background(), header: http.Header{}, send: func([]byte) error { return nil }}
+	call.header.Set("Authorization", asAdmin[1])
+
+	var status *grpcStatus
+	err := server.delete(call, protoInt(protoString(nil, 1, "bin"), 2, 2))
+	if !errors.As(err, &status) || status.code != grpcFailedPrecondition {
+		t.Errorf("stale version: err = %v, want FAILED_PRECONDITION", err)
+	}
+	if err := server.delete(call, protoInt(protoString(nil, 1, "bin"), 2, 1)); err != nil {
+		t.Errorf("current version: %v", err)
+	}
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Destination types
+const (
+	destinationSNS  = "sns"
+	destinationSQS  = "sqs"
+	destinationHTTP = "http"
+)
+
+// Delivery semantics. At-least-once retries a failed delivery until it
+// goes through, holding back the events after it so they stay in order;
+// consumers drop duplicates by the message ID. Best-effort tries once.
+const (
+	deliveryAtLeastOnce = "at-least-once"
+	deliveryBestEffort  = "best-effort"
+)
+
+// Ordering keys: per product keeps each product's events in order, catalog
+// orders every event
+const (
+	orderingProduct = "product"
+	orderingCatalog = "catalog"
+)
+
+// Delivery retry backoff, doubling from the first to the max
+const (
+	deliveryBackoff    = time.Second
+	deliveryMaxBackoff = time.Minute
+)
+
+// subscribableEvents are the event types destinations and webhooks can
+// subscribe to
+var subscribableEvents = []string{eventCreated, eventUpdated, eventDeleted, eventPurged, eventSuspended, eventUnsuspended, eventStock}
+
+// eventDeliveries counts deliveries per destination and outcome, e.g.
+// "inventory.sent"
+var eventDeliveries = expvar.NewMap("event_deliveries")
+
+// EventDestination forwards product events to an SNS topic, an SQS queue
+// or an HTTP endpoint. FIFO topics and queues (names ending in .fifo) get
+// the ordering key as MessageGroupId and the message ID as
+// MessageDeduplicationId; HTTP endpoints get them as X-Ordering-Key and
+// Idempotency-Key.
+type EventDestination struct {
+	Name        string   `json:"name"`
+	Type        string   `json:"type"`
+	Target      string   `json:"target"`           // topic ARN, queue URL or URL
+	Events      []string `json:"events,omitempty"` // event types, all when empty; stock for any stock change
+	Delivery    string   `json:"delivery,omitempty"`
+	OrderingKey string   `json:"ordering_key,omitempty"`
+	MaxAttempts int      `json:"max_attempts,omitempty"` // at-least-once gives up after, 0 never does
+
+	fifo  bool
+	queue chan EventMessage
+}
+
+// EventMessage is what a destination receives for a product event. ID
+// names the change, the same on every retry and on every replica, so it
+// works as a dedupe key.
+type EventMessage struct {
+	ID          string    `json:"id"`
+	Type        string    `json:"type"`
+	ProductID   string    `json:"product_id"`
+	Tenant      string    `json:"tenant,omitempty"`
+	Version     int64     `json:"version"`
+	OrderingKey string    `json:"ordering_key"`
+	Product     *Product  `json:"product,omitempty"`
+	At          time.Time `json:"at"`
+}
+
+// EventDelivery fans product events out to the configured destinations,
+// each with its own queue and a single sender so events leave in write
+// order. Queues are in memory: events still queued when the process stops
+// are lost, and a queue that fills up drops new events. With WAL_DIR set,
+// the outbox replaces the queues and nothing is lost or dropped.
+type EventDelivery struct {
+	destinations []*EventDestination
+	http         *http.Client
+	running      atomic.Bool
+}
+
+// Global event delivery, nil unless EVENT_DESTINATIONS is set
+var eventDelivery = newEventDelivery()
+
+// newEventDelivery reads EVENT_DESTINATIONS, a JSON array of
+// destinations. EVENT_QUEUE_SIZE (default 1000) bounds each queue.
+func newEventDelivery() *EventDelivery {
+	raw := os.Getenv("EVENT_DESTINATIONS")
+	if raw == "" {
+		return nil
+	}
+	var destinations []*EventDestination
+	if err := json.Unmarshal([]byte(raw), &destinations); err != nil {
+		panic(fmt.Sprintf("invalid EVENT_DESTINATIONS: %v", err))
+	}
+	queueSize := envInt("EVENT_QUEUE_SIZE", 1000)
+	names := make(map[string]bool)
+	for _, d := range destinations {
+		if err := d.init(queueSize); err != nil {
+			panic(fmt.Sprintf("invalid EVENT_DESTINATIONS: %s: %v", d.Name, err))
+		}
+		if names[d.Name] {
+			panic(fmt.Sprintf("invalid EVENT_DESTINATIONS: duplicate name %q", d.Name))
+		}
+		names[d.Name] = true
+	}
+	return &EventDelivery{
+		destinations: destinations,
+		http:         newPooledClient("event_destinations", 10*time.Second),
+	}
+}
+
+// init checks a destination and fills in the defaults
+func (d *EventDestination) init(queueSize int) error {
+	if d.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	switch d.Type {
+	case destinationSNS:
+		if !strings.HasPrefix(d.Target, "arn:aws:sns:") {
+			return fmt.Errorf("target must be an SNS topic ARN")
+		}
+	case destinationSQS, destinationHTTP:
+		if u, err := url.Parse(d.Target); err != nil || u.Scheme != "https" && u.Scheme != "http" || u.Host == "" {
+			return fmt.Errorf("target must be a URL")
+		}
+	default:
+		return fmt.Errorf("type must be sns, sqs or http")
+	}
+	for _, event := range d.Events {
+		if !slices.Contains(subscribableEvents, event) {
+			return fmt.Errorf("unknown event %q", event)
+		}
+	}
+	switch d.Delivery {
+	case "":
+		d.Delivery = deliveryAtLeastOnce
+	case deliveryAtLeastOnce, deliveryBestEffort:
+	default:
+		return fmt.Errorf("delivery must be at-least-once or best-effort")
+	}
+	switch d.OrderingKey {
+	case "":
+		d.OrderingKey = orderingProduct
+	case orderingProduct, orderingCatalog:
+	default:
+		return fmt.Errorf("ordering_key must be product or catalog")
+	}
+	d.fifo = d.Type != destinationHTTP && strings.HasSuffix(d.Target, ".fifo")
+	d.queue = make(chan EventMessage, queueSize)
+	return nil
+}
+
+// wants reports whether the destination subscribed to an event
+func (d *EventDestination) wants(e ProductEvent) bool {
+	return wantsEvent(d.Events, e)
+}
+
+// wantsEvent reports whether a subscription to events, all when empty,
+// covers an event
+func wantsEvent(events []string, e ProductEvent) bool {
+	if len(events) == 0 || slices.Contains(events, e.Type) {
+		return true
+	}
+	if !slices.Contains(events, eventStock) {
+		return false
+	}
+	switch {
+	case e.Product == nil:
+		return false
+	case e.Previous == nil:
+		return true
+	}
+	return e.Product.Stock != e.Previous.Stock
+}
+
+// enqueue queues an event for the destinations that want it. Events are
+// only delivered once run has started, so the sample data of a fresh
+// store isn't sent on every start. Callers hold store.mu, which keeps
+// queues in write order.
+func (ed *EventDelivery) enqueue(e ProductEvent) {
+	if ed == nil || !ed.running.Load() {
+		return
+	}
+	msg := newEventMessage(e)
+	for _, d := range ed.destinations {
+		if !d.wants(e) {
+			continue
+		}
+		msg := d.ordered(msg)
+		select {
+		case d.queue <- msg:
+		default:
+			eventDeliveries.Add(d.Name+".dropped", 1)
+			log.Printf("event %s for %s dropped, queue full", msg.ID, d.Name)
+		}
+	}
+}
+
+// ordered sets the ordering key of a message for the destination
+func (d *EventDestination) ordered(msg EventMessage) EventMessage {
+	msg.OrderingKey = qualifiedID(msg.Tenant, msg.ProductID)
+	if d.OrderingKey == orderingCatalog {
+		msg.OrderingKey = orderingCatalog
+	}
+	return msg
+}
+
+// newEventMessage returns the message of an event, ordered by product
+func newEventMessage(e ProductEvent) EventMessage {
+	key := qualifiedID(e.Tenant, e.ID)
+	msg := EventMessage{Type: e.Type, ProductID: e.ID, Tenant: e.Tenant, OrderingKey: key, Product: e.Product, At: time.Now().UTC()}
+	switch {
+	case e.Product != nil:
+		msg.Version = e.Product.Version
+	case e.Previous != nil:
+		msg.Version = e.Previous.Version
+	}
+	msg.ID = fmt.Sprintf("%s:%d:%s", key, msg.Version, e.Type)
+	return msg
+}
+
+// run starts a sender per destination, taking events from the outbox when
+// there is one
+func (ed *EventDelivery) run() {
+	for _, d := range ed.destinations {
+		if outbox != nil {
+			go outbox.dispatch(ed, d)
+		} else {
+			go ed.send(d)
+		}
+	}
+	ed.running.Store(true)
+}
+
+// send delivers a destination's queue in order
+func (ed *EventDelivery) send(d *EventDestination) {
+	for msg := range d.queue {
+		ed.sendWithRetries(d, msg)
+	}
+}
+
+// sendWithRetries delivers a message. An at-least-once event is retried
+// with backoff before the next one is sent.
+func (ed *EventDelivery) sendWithRetries(d *EventDestination, msg EventMessage) {
+	backoff := deliveryBackoff
+	for attempt := 1; ; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		err := ed.deliver(ctx, d, msg)
+		cancel()
+		if err == nil {
+			eventDeliveries.Add(d.Name+".sent", 1)
+			return
+		}
+		if d.Delivery == deliveryBestEffort || d.MaxAttempts > 0 && attempt >= d.MaxAttempts {
+			eventDeliveries.Add(d.Name+".failed", 1)
+			log.Printf("event %s to %s failed after %d attempts: %v", msg.ID, d.Name, attempt, err)
+			return
+		}
+		eventDeliveries.Add(d.Name+".retried", 1)
+		time.Sleep(backoff)
+		backoff = min(backoff*2, deliveryMaxBackoff)
+	}
+}
+
+// deliver makes one attempt at sending a message
+func (ed *EventDelivery) deliver(ctx context.Context, d *EventDestination, msg EventMessage) (err error) {
+	start := time.Now()
+	defer func() { eventDestinationsDependency.observe(start, err) }()
+
+	body, _ := json.Marshal(msg)
+	params := url.Values{}
+	if d.fifo {
+		params.Set("MessageGroupId", msg.OrderingKey)
+		params.Set("MessageDeduplicationId", msg.ID)
+	}
+	switch d.Type {
+	case destinationSNS:
+		params.Set("Subject", fmt.Sprintf("Product %s %s", qualifiedID(msg.Tenant, msg.ProductID), msg.Type))
+		params.Set("Message", string(body))
+		return snsPublish(ctx, ed.http, d.Target, params)
+	case destinationSQS:
+		params.Set("MessageBody", string(body))
+		return sqsSend(ctx, ed.http, d.Target, params)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.Target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Idempotency-Key", msg.ID)
+	req.Header.Set("X-Ordering-Key", msg.OrderingKey)
+	return sendChecked(ed.http, req, d.Name)
+}
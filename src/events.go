@@ -0,0 +1,97 @@
+package main
+
+import (
+	"expvar"
+	"sync"
+)
+
+// Product event types
+const (
+	eventCreated     = "created"
+	eventUpdated     = "updated"
+	eventDeleted     = "deleted" // soft-deleted
+	eventPurged      = "purged"
+	eventSuspended   = "suspended"
+	eventUnsuspended = "unsuspended"
+)
+
+// ProductEvent is a change to a product. Product is nil for purges, and
+// Previous for creates.
+type ProductEvent struct {
+	Type     string   `json:"type"`
+	ID       string   `json:"id"`
+	Tenant   string   `json:"tenant,omitempty"`
+	Product  *Product `json:"product,omitempty"`
+	Previous *Product `json:"-"`
+}
+
+// productEventsDropped counts watchers disconnected for falling behind
+var productEventsDropped = expvar.NewInt("product_events_dropped")
+
+// ProductFeed fans product changes out to watchers. Publishing never
+// blocks a write: a watcher whose buffer is full is disconnected, and can
+// watch again and re-read what it missed.
+type ProductFeed struct {
+	mu   sync.Mutex
+	subs map[chan ProductEvent]struct{}
+}
+
+// Global product feed
+var productEvents = &ProductFeed{
+	subs: make(map[chan ProductEvent]struct{}),
+}
+
+// subscribe returns a channel receiving every event from now on. It's
+// closed when the watcher falls more than buffer events behind.
+func (f *ProductFeed) subscribe(buffer int) chan ProductEvent {
+	ch := make(chan ProductEvent, buffer)
+	f.mu.Lock()
+	f.subs[ch] = struct{}{}
+	f.mu.Unlock()
+	return ch
+}
+
+// unsubscribe stops and closes a subscription
+func (f *ProductFeed) unsubscribe(ch chan ProductEvent) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, exists := f.subs[ch]; exists {
+		delete(f.subs, ch)
+		close(ch)
+	}
+}
+
+// publish sends an event to every watcher. Callers hold store.mu, which
+// keeps events in write order.
+func (f *ProductFeed) publish(e ProductEvent) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for ch := range f.subs {
+		select {
+		case ch <- e:
+		default:
+			delete(f.subs, ch)
+			close(ch)
+			productEventsDropped.Add(1)
+		}
+	}
+}
+
+// productEventType tells a save apart as a create, update, soft delete or
+// (un)suspension
+func productEventType(previous *Product, p *Product) string {
+	switch {
+	case previous == nil:
+		return eventCreated
+	case p.DeletedAt != nil && previous.DeletedAt == nil:
+		return eventDeleted
+	case p.Suspension != nil && previous.Suspension == nil:
+		return eventSuspended
+	case p.Suspension == nil && previous.Suspension != nil:
+		return eventUnsuspended
+	default:
+		return eventUpdated
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// productFieldNames are the JSON names of the product fields, in the order
+// they're written
+var productFieldNames = jsonFieldNames(reflect.TypeOf(Product{}))
+
+// jsonFieldNames returns the names a struct's fields are marshaled under
+func jsonFieldNames(t reflect.Type) []string {
+	var names []string
+	for i := range t.NumField() {
+		field := t.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if !field.IsExported() || name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+// fieldSet is the product fields a request asked for, nil for all of them
+type fieldSet map[string]bool
+
+// parseFields reads ?fields=id,name,price. The id is always included, so
+// a sparse product can still be linked to and fetched in full. While the
+// field_selection flag is off for the request, ?fields= is ignored.
+// Returns: 400 Bad Request - Unknown field (Cat never heard of it!)
+func parseFields(c *gin.Context) (fieldSet, bool) {
+	raw := c.Query("fields")
+	if raw == "" || !flagEnabled(c, flagFieldSelection) {
+		return nil, true
+	}
+	fields := fieldSet{"id": true}
+	var unknown []string
+	for _, name := range strings.Split(raw, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		if !slices.Contains(productFieldNames, name) {
+			unknown = append(unknown, name)
+			continue
+		}
+		fields[name] = true
+	}
+	if len(unknown) > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":     "Unknown fields",
+			"fields":    unknown,
+			"available": productFieldNames,
+		})
+		return nil, false
+	}
+	return fields, true
+}
+
+// project writes the selected fields of a product as a JSON object, in
+// the usual order, with links after them when there are any. Fields left
+// out because they're empty stay out.
+func (fields fieldSet) project(p Product, links map[string]string) json.RawMessage {
+	full, err := json.Marshal(p)
+	if err != nil {
+		return nil
+	}
+	var values map[string]json.RawMessage
+	json.Unmarshal(full, &values)
+
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for _, name := range productFieldNames {
+		value, exists := values[name]
+		if !exists || !fields[name] {
+			continue
+		}
+		if buf.Len() > 1 {
+			buf.WriteByte(',')
+		}
+		key, _ := json.Marshal(name)
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	if links != nil {
+		if buf.Len() > 1 {
+			buf.WriteByte(',')
+		}
+		data, _ := json.Marshal(links)
+		buf.WriteString(`"links":`)
+		buf.Write(data)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes()
+}
+
+// projectAll projects each product of a list
+func (fields fieldSet) projectAll(products []Product) []json.RawMessage {
+	projected := make([]json.RawMessage, len(products))
+	for i, p := range products {
+		projected[i] = fields.project(p, nil)
+	}
+	return projected
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Feature flags are read from FLAGS_FILE, JSON or YAML, or from an AWS
+// AppConfig feature flag profile, APPCONFIG_APPLICATION,
+// APPCONFIG_ENVIRONMENT and APPCONFIG_PROFILE. Either is polled every
+// FLAGS_POLL_INTERVAL (AppConfig may ask for longer) and changes apply
+// without a restart.
+var (
+	flagsFile         = os.Getenv("FLAGS_FILE")
+	appConfigApp      = os.Getenv("APPCONFIG_APPLICATION")
+	appConfigEnv      = os.Getenv("APPCONFIG_ENVIRONMENT")
+	appConfigProfile  = os.Getenv("APPCONFIG_PROFILE")
+	flagsPollInterval = envDuration("FLAGS_POLL_INTERVAL", 30*time.Second)
+)
+
+// The flags the service checks
+const (
+	flagReviews         = "reviews"
+	flagRelatedProducts = "related_products"
+	flagAsyncRequests   = "async_requests"
+	flagFieldSelection  = "field_selection"
+)
+
+// Flag is a feature flag, in the shape of an AppConfig feature flag
+type Flag struct {
+	Enabled bool `json:"enabled"`
+	// Percent of sessions that see the feature when it's enabled, all of
+	// them when unset
+	Percent *int `json:"percent,omitempty"`
+}
+
+// featureFlags are the flags the service checks and their values while no
+// source sets them
+var featureFlags = map[string]Flag{
+	flagReviews:         {Enabled: true},
+	flagRelatedProducts: {Enabled: true},
+	flagAsyncRequests:   {Enabled: true},
+	flagFieldSelection:  {Enabled: true},
+}
+
+// flagSet is the flags in force and where they came from
+type flagSet struct {
+	flags    map[string]Flag
+	source   string
+	loadedAt time.Time
+}
+
+// Global feature flags, swapped whole when a source changes
+var flags atomic.Pointer[flagSet]
+
+func init() {
+	if flagsFile != "" && appConfigApp != "" {
+		panic("set FLAGS_FILE or APPCONFIG_APPLICATION, not both")
+	}
+	if appConfigApp != "" && (appConfigEnv == "" || appConfigProfile == "") {
+		panic("APPCONFIG_APPLICATION needs APPCONFIG_ENVIRONMENT and APPCONFIG_PROFILE")
+	}
+	set := &flagSet{source: "defaults", loadedAt: time.Now().UTC()}
+	if flagsFile != "" {
+		loaded, err := loadFlagsFile(flagsFile)
+		if err != nil {
+			panic(fmt.Sprintf("FLAGS_FILE: %v", err))
+		}
+		set = loaded
+	}
+	flags.Store(set)
+}
+
+// parseFlags reads a flag document, {"name": {"enabled": true, "percent": 10}}.
+// Flags the service doesn't check are kept, since a profile may be shared
+// with other services.
+func parseFlags(data []byte) (map[string]Flag, error) {
+	var parsed map[string]Flag
+	if err := json.Unmarshal(data, &parsed); err != nil {
+		return nil, err
+	}
+	for name, f := range parsed {
+		if f.Percent != nil && (*f.Percent < 0 || *f.Percent > 100) {
+			return nil, fmt.Errorf("flag %s: percent must be between 0 and 100", name)
+		}
+	}
+	return parsed, nil
+}
+
+// loadFlagsFile reads and checks a flag file
+func loadFlagsFile(path string) (*flagSet, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if ext := strings.ToLower(filepath.Ext(path)); ext == ".yaml" || ext == ".yml" {
+		if data, err = yamlToJSON(data); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	parsed, err := parseFlags(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return &flagSet{flags: parsed, source: path, loadedAt: time.Now().UTC()}, nil
+}
+
+// flag returns the value of a flag in force
+func (s *flagSet) flag(name string) Flag {
+	if f, ok := s.flags[name]; ok {
+		return f
+	}
+	return featureFlags[name]
+}
+
+// flagEnabled reports whether a request sees a feature. A flag rolled out
+// to a percentage is on for the same sessions on every request, placed as
+// soft launches are; requests without a session don't see it until it
+// reaches everyone.
+func flagEnabled(c *gin.Context, name string) bool {
+	f := flags.Load().flag(name)
+	if !f.Enabled {
+		return false
+	}
+	if f.Percent == nil || *f.Percent >= 100 {
+		return true
+	}
+	addVary(c, sessionHeader)
+	session := c.GetHeader(sessionHeader)
+	return session != "" && rolloutBucket(session, "flag:"+name) < *f.Percent
+}
+
+// requireFlag keeps a route hidden from requests that don't see a feature
+// Returns: 404 Not Found - The feature is off for this request (Cat hasn't unwrapped it yet!)
+func requireFlag(name string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !flagEnabled(c, name) {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{
+				"error": "Feature is not enabled",
+				"flag":  name,
+			})
+			return
+		}
+		c.Next()
+	}
+}
+
+// watchFlags polls the flag source and swaps in what changed. A source
+// that fails leaves the flags in force as they are.
+func watchFlags() {
+	if appConfigApp != "" {
+		newAppConfigPoller().run()
+		return
+	}
+
+	var modTime time.Time
+	if info, err := os.Stat(flagsFile); err == nil {
+		modTime = info.ModTime()
+	}
+	for range time.Tick(flagsPollInterval) {
+		info, err := os.Stat(flagsFile)
+		if err != nil || info.ModTime().Equal(modTime) {
+			continue
+		}
+		modTime = info.ModTime()
+		set, err := loadFlagsFile(flagsFile)
+		if err != nil {
+			log.Printf("flags: keeping the current ones: %v", err)
+			continue
+		}
+		flags.Store(set)
+		log.Printf("flags: loaded %d from %s", len(set.flags), set.source)
+	}
+}
+
+// appConfigPoller follows a configuration profile through the AppConfig
+// data API: a session hands out a token, and each poll returns the next
+// token and, when the profile changed, its new content.
+type appConfigPoller struct {
+	client   *http.Client
+	endpoint string
+	token    string
+}
+
+func newAppConfigPoller() *appConfigPoller {
+	return &appConfigPoller{
+		client:   newAWSClient("appconfig", 10*time.Second),
+		endpoint: "https://appconfigdata." + awsRegion + ".amazonaws.com",
+	}
+}
+
+// run polls until the process exits
+func (p *appConfigPoller) run() {
+	for {
+		wait, err := p.poll(context.Background())
+		if err != nil {
+			// Tokens expire when not used for a day; start over with a new
+			// session next time
+			p.token = ""
+			log.Printf("flags: appconfig: keeping the current ones: %v", err)
+		}
+		time.Sleep(max(wait, flagsPollInterval))
+	}
+}
+
+// poll fetches the latest configuration, starting a session first if
+// there's no token, and says how long AppConfig asks to wait
+func (p *appConfigPoller) poll(ctx context.Context) (time.Duration, error) {
+	if p.token == "" {
+		token, err := p.startSession(ctx)
+		if err != nil {
+			return 0, err
+		}
+		p.token = token
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.endpoint+"/configuration?configuration_token="+url.QueryEscape(p.token), nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := p.send(ctx, req, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return 0, fmt.Errorf("appconfig getlatestconfiguration: %s: %s", resp.Status, msg)
+	}
+
+	p.token = resp.Header.Get("Next-Poll-Configuration-Token")
+	seconds, _ := strconv.Atoi(resp.Header.Get("Next-Poll-Interval-In-Seconds"))
+	wait := time.Duration(seconds) * time.Second
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return wait, err
+	}
+	// An empty body means the profile hasn't changed since the last poll
+	if len(bytes.TrimSpace(data)) == 0 {
+		return wait, nil
+	}
+	parsed, err := parseFlags(data)
+	if err != nil {
+		return wait, fmt.Errorf("profile %s: %v", appConfigProfile, err)
+	}
+	source := "appconfig:" + appConfigApp + "/" + appConfigEnv + "/" + appConfigProfile
+	flags.Store(&flagSet{flags: parsed, source: source, loadedAt: time.Now().UTC()})
+	log.Printf("flags: loaded %d from %s", len(parsed), source)
+	return wait, nil
+}
+
+// startSession starts a configuration session and returns its first token
+func (p *appConfigPoller) startSession(ctx context.Context) (string, error) {
+	body, err := json.Marshal(map[string]any{
+		"ApplicationIdentifier":                appConfigApp,
+		"EnvironmentIdentifier":                appConfigEnv,
+		"ConfigurationProfileIdentifier":       appConfigProfile,
+		"RequiredMinimumPollIntervalInSeconds": max(15, int(flagsPollInterval.Seconds())),
+	})
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.endpoint+"/configurationsessions", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := p.send(ctx, req, body)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return "", fmt.Errorf("appconfig startconfigurationsession: %s: %s", resp.Status, msg)
+	}
+	var session struct {
+		InitialConfigurationToken string
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&session); err != nil {
+		return "", fmt.Errorf("decoding appconfig session: %w", err)
+	}
+	return session.InitialConfigurationToken, nil
+}
+
+// send signs and performs an AppConfig data request
+func (p *appConfigPoller) send(ctx context.Context, req *http.Request, payload []byte) (*http.Response, error) {
+	creds, err := awsCreds.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	signV4(req, payload, "appconfig", awsRegion, creds, time.Now())
+	return p.client.Do(req)
+}
+
+// FlagView is a flag as the API shows it
+type FlagView struct {
+	Name string `json:"name"`
+	Flag
+	Known bool `json:"known"` // checked by this service
+}
+
+// getFlags reports which features are on for the caller, so a client can
+// hide what it won't be served
+// Returns: 200 OK - Success (Cat checking which doors are open!)
+func getFlags(c *gin.Context) {
+	enabled := make(map[string]bool, len(featureFlags))
+	for name := range featureFlags {
+		enabled[name] = flagEnabled(c, name)
+	}
+	c.JSON(http.StatusOK, gin.H{"flags": enabled})
+}
+
+// getAdminFlags lists the flags in force, where they came from and when
+// Returns: 200 OK - Success
+// Returns: 401 Unauthorized - Admin access required
+func getAdminFlags(c *gin.Context) {
+	set := flags.Load()
+	names := make(map[string]bool, len(featureFlags)+len(set.flags))
+	for name := range featureFlags {
+		names[name] = true
+	}
+	for name := range set.flags {
+		names[name] = true
+	}
+	views := make([]FlagView, 0, len(names))
+	for name := range names {
+		_, known := featureFlags[name]
+		views = append(views, FlagView{Name: name, Flag: set.flag(name), Known: known})
+	}
+	sort.Slice(views, func(i, j int) bool { return views[i].Name < views[j].Name })
+
+	c.JSON(http.StatusOK, gin.H{
+		"source":    set.source,
+		"loaded_at": set.loadedAt,
+		"count":     len(views),
+		"flags":     views,
+	})
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// detailPartTimeout bounds each part of a composite product response,
+// DETAIL_PART_TIMEOUT
+var detailPartTimeout = envDuration("DETAIL_PART_TIMEOUT", 250*time.Millisecond)
+
+// detailPart loads one section of the product detail page. A part behind
+// a feature flag is left out for requests that don't see the feature.
+type detailPart struct {
+	name string
+	flag string
+	load func(ctx context.Context, p Product) (any, error)
+}
+
+// detailParts are fetched concurrently for GET /products/:id/full
+var detailParts = []detailPart{
+	{name: "reviews", flag: flagReviews, load: loadReviewSummary},
+	{name: "related", flag: flagRelatedProducts, load: loadRelatedProducts},
+	{name: "availability", load: loadAvailability},
+}
+
+// maxRelatedProducts caps the related section
+const maxRelatedProducts = 5
+
+// loadReviewSummary returns the rating and the latest reviews
+func loadReviewSummary(ctx context.Context, p Product) (any, error) {
+	reviews.mu.RLock()
+	list := reviews.reviews[p.key()]
+	latest := make([]Review, 0, 3)
+	for i := len(list) - 1; i >= 0 && len(latest) < 3; i-- {
+		latest = append(latest, list[i])
+	}
+	reviews.mu.RUnlock()
+
+	return gin.H{
+		"rating":       p.Rating,
+		"review_count": p.ReviewCount,
+		"latest":       latest,
+	}, nil
+}
+
+// loadRelatedProducts returns the curated and frequently bought together
+// products of GET /products/:id/related, topped up with other products of
+// the same category
+func loadRelatedProducts(ctx context.Context, p Product) (any, error) {
+	related := make([]Product, 0, maxRelatedProducts)
+	seen := make(map[string]bool)
+	for _, r := range relatedProducts(p, "", Product.live) {
+		related = append(related, r.Product)
+		seen[r.Product.key()] = true
+	}
+	if len(related) >= maxRelatedProducts || p.Category == "" {
+		return related[:min(len(related), maxRelatedProducts)], nil
+	}
+
+	var sameCategory []Product
+	store.mu.RLock()
+	for _, other := range store.products {
+		if other.Tenant == p.Tenant && other.ID != p.ID && !seen[other.key()] && other.live() && other.Category == p.Category {
+			sameCategory = append(sameCategory, other)
+		}
+	}
+	store.mu.RUnlock()
+
+	sort.Slice(sameCategory, func(i, j int) bool { return sameCategory[i].ID < sameCategory[j].ID })
+	related = append(related, sameCategory...)
+	return related[:min(len(related), maxRelatedProducts)], nil
+}
+
+// loadAvailability returns the stock position of the product and its variants
+func loadAvailability(ctx context.Context, p Product) (any, error) {
+	inStock := make([]string, 0, len(p.Variants))
+	for _, v := range p.Variants {
+		if v.Stock > 0 {
+			inStock = append(inStock, v.SKU)
+		}
+	}
+	return gin.H{
+		"in_stock":          p.Stock > 0,
+		"stock":             p.Stock,
+		"low_stock":         p.isLowStock(),
+		"variants_in_stock": inStock,
+	}, nil
+}
+
+// partResult is the outcome of loading one part
+type partResult struct {
+	name  string
+	value any
+	err   error
+}
+
+// getProductFull returns a product with everything the detail page needs.
+// Parts are loaded concurrently, each with its own timeout; a part that
+// fails or times out is reported in "errors" and the rest is still
+// returned.
+// Returns: 200 OK - Product and parts, possibly partial (Cat with the whole toy box!)
+// Returns: 404 Not Found - Product doesn't exist
+// Returns: 504 Gateway Timeout - Took longer than REQUEST_TIMEOUT
+func getProductFull(c *gin.Context) {
+	id := c.Param("id")
+
+	product, exists := cache.load(c.Request.Context(), tenantKey(c, id))
+	if requestCanceled(c) {
+		return
+	}
+	if !exists || !product.live() || !shownTo(c, product) {
+		productNotFound(c, id)
+		return
+	}
+
+	var parts []detailPart
+	for _, part := range detailParts {
+		if part.flag == "" || flagEnabled(c, part.flag) {
+			parts = append(parts, part)
+		}
+	}
+
+	results := make(chan partResult, len(parts))
+	for _, part := range parts {
+		go func() {
+			ctx, cancel := context.WithTimeout(c.Request.Context(), detailPartTimeout)
+			defer cancel()
+
+			done := make(chan partResult, 1)
+			go func() {
+				value, err := part.load(ctx, product)
+				done <- partResult{name: part.name, value: value, err: err}
+			}()
+			select {
+			case r := <-done:
+				results <- r
+			case <-ctx.Done():
+				results <- partResult{name: part.name, err: fmt.Errorf("timed out after %s", detailPartTimeout)}
+			}
+		}()
+	}
+
+	response := gin.H{"product": product}
+	errs := gin.H{}
+	for range parts {
+		r := <-results
+		if r.err != nil {
+			response[r.name] = nil
+			errs[r.name] = r.err.Error()
+			continue
+		}
+		response[r.name] = r.value
+	}
+	if len(errs) > 0 {
+		response["errors"] = errs
+	}
+
+	c.Header("ETag", productETag(product))
+	c.JSON(http.StatusOK, response)
+}
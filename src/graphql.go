@@ -0,0 +1,855 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// A small GraphQL engine: enough of the query language for the catalog
+// (selections, aliases, arguments, variables, fragments, @skip/@include)
+// and an executor over hand-written resolvers. Mutations, subscriptions
+// and introspection are not supported; the schema is in graphqlSDL.
+
+// gqlVariable is a $variable in a query, replaced before resolvers run
+type gqlVariable string
+
+// gqlEnum is an enum value in a query
+type gqlEnum string
+
+// gqlSelection is a field, a fragment spread (spread) or an inline
+// fragment (inline, with an optional on)
+type gqlSelection struct {
+	alias      string
+	name       string
+	args       map[string]any
+	directives []gqlDirective
+	sel        []gqlSelection
+	spread     string
+	inline     bool
+	on         string
+	pos        int
+}
+
+// key is the name of the field in the response
+func (s gqlSelection) key() string {
+	if s.alias != "" {
+		return s.alias
+	}
+	return s.name
+}
+
+type gqlDirective struct {
+	name string
+	args map[string]any
+}
+
+type gqlVarDef struct {
+	name       string
+	def        any
+	hasDefault bool
+	nonNull    bool
+}
+
+type gqlOperation struct {
+	kind string
+	name string
+	vars []gqlVarDef
+	sel  []gqlSelection
+	pos  int
+}
+
+type gqlFragment struct {
+	on  string
+	sel []gqlSelection
+}
+
+type gqlDocument struct {
+	operations []*gqlOperation
+	fragments  map[string]*gqlFragment
+}
+
+// gqlError is an error of the GraphQL response
+type gqlError struct {
+	Message   string        `json:"message"`
+	Locations []gqlLocation `json:"locations,omitempty"`
+	Path      []any         `json:"path,omitempty"`
+}
+
+type gqlLocation struct {
+	Line   int `json:"line"`
+	Column int `json:"column"`
+}
+
+func (e *gqlError) Error() string { return e.Message }
+
+// location turns a byte offset of the query into a line and column
+func location(src string, pos int) []gqlLocation {
+	pos = min(pos, len(src))
+	line := strings.Count(src[:pos], "\n") + 1
+	column := utf8.RuneCountInString(src[strings.LastIndex(src[:pos], "\n")+1:pos]) + 1
+	return []gqlLocation{{Line: line, Column: column}}
+}
+
+// Token kinds
+const (
+	tokEOF    = iota
+	tokPunct  // ! $ ( ) ... : = @ [ ] { | }
+	tokName   // names and keywords
+	tokInt    // integer literals
+	tokFloat  // float literals
+	tokString // string literals, unquoted
+)
+
+type gqlToken struct {
+	kind  int
+	value string
+	pos   int
+}
+
+// lexGraphQL splits a query into tokens. Commas and comments are ignored,
+// as the spec says.
+func lexGraphQL(src string) ([]gqlToken, error) {
+	var tokens []gqlToken
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',':
+			i++
+		case strings.HasPrefix(src[i:], "\uFEFF"):
+			i += len("\uFEFF")
+		case c == '#':
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+		case strings.HasPrefix(src[i:], "..."):
+			tokens = append(tokens, gqlToken{tokPunct, "...", i})
+			i += 3
+		case strings.IndexByte("!$():=@[]{}|&", c) >= 0:
+			tokens = append(tokens, gqlToken{tokPunct, string(c), i})
+			i++
+		case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+			start := i
+			for i < len(src) && (src[i] == '_' || src[i] >= 'a' && src[i] <= 'z' || src[i] >= 'A' && src[i] <= 'Z' || src[i] >= '0' && src[i] <= '9') {
+				i++
+			}
+			tokens = append(tokens, gqlToken{tokName, src[start:i], start})
+		case c == '-' || c >= '0' && c <= '9':
+			start, kind := i, tokInt
+			i++
+			for i < len(src) {
+				d := src[i]
+				if d == '.' || d == 'e' || d == 'E' {
+					kind = tokFloat
+				} else if !(d >= '0' && d <= '9' || (d == '-' || d == '+') && (src[i-1] == 'e' || src[i-1] == 'E')) {
+					break
+				}
+				i++
+			}
+			tokens = append(tokens, gqlToken{kind, src[start:i], start})
+		case strings.HasPrefix(src[i:], `"""`):
+			end := strings.Index(src[i+3:], `"""`)
+			if end < 0 {
+				return nil, &gqlError{Message: "Syntax Error: unterminated block string", Locations: location(src, i)}
+			}
+			tokens = append(tokens, gqlToken{tokString, strings.TrimSpace(src[i+3 : i+3+end]), i})
+			i += end + 6
+		case c == '"':
+			start := i
+			end := i + 1
+			for end < len(src) && src[end] != '"' && src[end] != '\n' {
+				if src[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(src) || src[end] != '"' {
+				return nil, &gqlError{Message: "Syntax Error: unterminated string", Locations: location(src, start)}
+			}
+			value, err := unescapeGraphQL(src[start+1 : end])
+			if err != nil {
+				return nil, &gqlError{Message: "Syntax Error: invalid string", Locations: location(src, start)}
+			}
+			tokens = append(tokens, gqlToken{tokString, value, start})
+			i = end + 1
+		default:
+			return nil, &gqlError{Message: fmt.Sprintf("Syntax Error: unexpected character %q", c), Locations: location(src, i)}
+		}
+	}
+	return append(tokens, gqlToken{tokEOF, "", len(src)}), nil
+}
+
+// unescapeGraphQL decodes the escapes of a string literal: \" \\ \/ \b \f
+// \n \r \t and \uXXXX
+func unescapeGraphQL(s string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b.WriteByte(s[i])
+			continue
+		}
+		i++
+		if i == len(s) {
+			return "", strconv.ErrSyntax
+		}
+		switch s[i] {
+		case '"', '\\', '/':
+			b.WriteByte(s[i])
+		case 'b':
+			b.WriteByte('\b')
+		case 'f':
+			b.WriteByte('\f')
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case 't':
+			b.WriteByte('\t')
+		case 'u':
+			if i+5 > len(s) {
+				return "", strconv.ErrSyntax
+			}
+			r, err := strconv.ParseUint(s[i+1:i+5], 16, 32)
+			if err != nil {
+				return "", strconv.ErrSyntax
+			}
+			b.WriteRune(rune(r))
+			i += 4
+		default:
+			return "", strconv.ErrSyntax
+		}
+	}
+	return b.String(), nil
+}
+
+// gqlParser is a recursive descent parser over the tokens of a query
+type gqlParser struct {
+	src    string
+	tokens []gqlToken
+	i      int
+}
+
+func (p *gqlParser) peek() gqlToken { return p.tokens[p.i] }
+
+func (p *gqlParser) next() gqlToken {
+	t := p.tokens[p.i]
+	if t.kind != tokEOF {
+		p.i++
+	}
+	return t
+}
+
+func (p *gqlParser) errorf(t gqlToken, format string, args ...any) error {
+	return &gqlError{Message: "Syntax Error: " + fmt.Sprintf(format, args...), Locations: location(p.src, t.pos)}
+}
+
+// is reports whether the next token is the punctuator or keyword s
+func (p *gqlParser) is(s string) bool {
+	t := p.peek()
+	return (t.kind == tokPunct || t.kind == tokName) && t.value == s
+}
+
+func (p *gqlParser) expect(s string) error {
+	if t := p.next(); t.value != s || (t.kind != tokPunct && t.kind != tokName) {
+		return p.errorf(t, "expected %q, found %q", s, t.value)
+	}
+	return nil
+}
+
+func (p *gqlParser) name() (string, error) {
+	t := p.next()
+	if t.kind != tokName {
+		return "", p.errorf(t, "expected a name, found %q", t.value)
+	}
+	return t.value, nil
+}
+
+// parseGraphQL parses a query document
+func parseGraphQL(src string) (*gqlDocument, error) {
+	tokens, err := lexGraphQL(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &gqlParser{src: src, tokens: tokens}
+	doc := &gqlDocument{fragments: make(map[string]*gqlFragment)}
+
+	for p.peek().kind != tokEOF {
+		t := p.peek()
+		switch {
+		case p.is("{"):
+			sel, err := p.selectionSet()
+			if err != nil {
+				return nil, err
+			}
+			doc.operations = append(doc.operations, &gqlOperation{kind: "query", sel: sel, pos: t.pos})
+		case p.is("query") || p.is("mutation") || p.is("subscription"):
+			op, err := p.operation()
+			if err != nil {
+				return nil, err
+			}
+			doc.operations = append(doc.operations, op)
+		case p.is("fragment"):
+			p.next()
+			name, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect("on"); err != nil {
+				return nil, err
+			}
+			on, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			if _, err := p.directives(); err != nil {
+				return nil, err
+			}
+			sel, err := p.selectionSet()
+			if err != nil {
+				return nil, err
+			}
+			if _, exists := doc.fragments[name]; exists {
+				return nil, &gqlError{Message: fmt.Sprintf("There can be only one fragment named %q.", name), Locations: location(src, t.pos)}
+			}
+			doc.fragments[name] = &gqlFragment{on: on, sel: sel}
+		default:
+			return nil, p.errorf(t, "unexpected %q", t.value)
+		}
+	}
+	if len(doc.operations) == 0 {
+		return nil, &gqlError{Message: "The document has no operation."}
+	}
+	return doc, nil
+}
+
+func (p *gqlParser) operation() (*gqlOperation, error) {
+	t := p.next()
+	op := &gqlOperation{kind: t.value, pos: t.pos}
+	if p.peek().kind == tokName {
+		op.name = p.next().value
+	}
+	if p.is("(") {
+		p.next()
+		for !p.is(")") {
+			if err := p.expect("$"); err != nil {
+				return nil, err
+			}
+			name, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(":"); err != nil {
+				return nil, err
+			}
+			def := gqlVarDef{name: name}
+			if def.nonNull, err = p.typeRef(); err != nil {
+				return nil, err
+			}
+			if p.is("=") {
+				p.next()
+				if def.def, err = p.value(true); err != nil {
+					return nil, err
+				}
+				def.hasDefault = true
+			}
+			op.vars = append(op.vars, def)
+		}
+		p.next()
+	}
+	if _, err := p.directives(); err != nil {
+		return nil, err
+	}
+	sel, err := p.selectionSet()
+	if err != nil {
+		return nil, err
+	}
+	op.sel = sel
+	return op, nil
+}
+
+// typeRef skips a variable type. Variables are coerced by the resolvers,
+// so only whether the outer type is non-null matters.
+func (p *gqlParser) typeRef() (bool, error) {
+	if p.is("[") {
+		p.next()
+		if _, err := p.typeRef(); err != nil {
+			return false, err
+		}
+		if err := p.expect("]"); err != nil {
+			return false, err
+		}
+	} else if _, err := p.name(); err != nil {
+		return false, err
+	}
+	if p.is("!") {
+		p.next()
+		return true, nil
+	}
+	return false, nil
+}
+
+func (p *gqlParser) selectionSet() ([]gqlSelection, error) {
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	var sel []gqlSelection
+	for !p.is("}") {
+		if p.peek().kind == tokEOF {
+			return nil, p.errorf(p.peek(), "expected \"}\"")
+		}
+		s, err := p.selection()
+		if err != nil {
+			return nil, err
+		}
+		sel = append(sel, s)
+	}
+	p.next()
+	if len(sel) == 0 {
+		return nil, p.errorf(p.tokens[p.i-1], "empty selection set")
+	}
+	return sel, nil
+}
+
+func (p *gqlParser) selection() (gqlSelection, error) {
+	t := p.peek()
+	s := gqlSelection{pos: t.pos}
+	var err error
+
+	if p.is("...") {
+		p.next()
+		if p.peek().kind == tokName && !p.is("on") {
+			s.spread = p.next().value
+			s.directives, err = p.directives()
+			return s, err
+		}
+		s.inline = true
+		if p.is("on") {
+			p.next()
+			if s.on, err = p.name(); err != nil {
+				return s, err
+			}
+		}
+		if s.directives, err = p.directives(); err != nil {
+			return s, err
+		}
+		s.sel, err = p.selectionSet()
+		return s, err
+	}
+
+	if s.name, err = p.name(); err != nil {
+		return s, err
+	}
+	if p.is(":") {
+		p.next()
+		s.alias = s.name
+		if s.name, err = p.name(); err != nil {
+			return s, err
+		}
+	}
+	if s.args, err = p.arguments(); err != nil {
+		return s, err
+	}
+	if s.directives, err = p.directives(); err != nil {
+		return s, err
+	}
+	if p.is("{") {
+		s.sel, err = p.selectionSet()
+	}
+	return s, err
+}
+
+func (p *gqlParser) arguments() (map[string]any, error) {
+	args := make(map[string]any)
+	if !p.is("(") {
+		return args, nil
+	}
+	p.next()
+	for !p.is(")") {
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(":"); err != nil {
+			return nil, err
+		}
+		if args[name], err = p.value(false); err != nil {
+			return nil, err
+		}
+	}
+	p.next()
+	return args, nil
+}
+
+func (p *gqlParser) directives() ([]gqlDirective, error) {
+	var directives []gqlDirective
+	for p.is("@") {
+		p.next()
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		args, err := p.arguments()
+		if err != nil {
+			return nil, err
+		}
+		directives = append(directives, gqlDirective{name: name, args: args})
+	}
+	return directives, nil
+}
+
+// value parses a literal; constant values (defaults) can't use variables
+func (p *gqlParser) value(constant bool) (any, error) {
+	t := p.next()
+	switch t.kind {
+	case tokInt:
+		n, err := strconv.ParseInt(t.value, 10, 64)
+		if err != nil {
+			return nil, p.errorf(t, "invalid integer %s", t.value)
+		}
+		return n, nil
+	case tokFloat:
+		f, err := strconv.ParseFloat(t.value, 64)
+		if err != nil {
+			return nil, p.errorf(t, "invalid number %s", t.value)
+		}
+		return f, nil
+	case tokString:
+		return t.value, nil
+	case tokName:
+		switch t.value {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		case "null":
+			return nil, nil
+		}
+		return gqlEnum(t.value), nil
+	}
+
+	switch t.value {
+	case "$":
+		if constant {
+			return nil, p.errorf(t, "unexpected variable")
+		}
+		name, err := p.name()
+		return gqlVariable(name), err
+	case "[":
+		list := []any{}
+		for !p.is("]") {
+			if p.peek().kind == tokEOF {
+				return nil, p.errorf(p.peek(), "expected \"]\"")
+			}
+			v, err := p.value(constant)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+		p.next()
+		return list, nil
+	case "{":
+		object := make(map[string]any)
+		for !p.is("}") {
+			name, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(":"); err != nil {
+				return nil, err
+			}
+			if object[name], err = p.value(constant); err != nil {
+				return nil, err
+			}
+		}
+		p.next()
+		return object, nil
+	}
+	return nil, p.errorf(t, "unexpected %q", t.value)
+}
+
+// gqlField is a field of an object type. typ is its GraphQL type, like
+// "[Review!]!"; resolve gets the parent value and the arguments with
+// variables substituted.
+type gqlField struct {
+	typ     string
+	resolve func(ctx *gqlContext, parent any, args map[string]any) (any, error)
+}
+
+// gqlObjectType is an object type of the schema
+type gqlObjectType struct {
+	name   string
+	fields map[string]*gqlField
+}
+
+// gqlContext holds the state of one execution
+type gqlContext struct {
+	src       string
+	doc       *gqlDocument
+	variables map[string]any
+	types     map[string]*gqlObjectType
+	errors    []*gqlError
+	// c is the HTTP request, for resolvers that need it
+	c *gin.Context
+}
+
+// gqlMaxDepth caps how deeply selections nest
+const gqlMaxDepth = 10
+
+// gqlScalars are the built-in scalar types
+var gqlScalars = map[string]bool{"String": true, "Int": true, "Float": true, "Boolean": true, "ID": true}
+
+// gqlResponse is an ordered JSON object, since fields must come out in the
+// order they were asked for
+type gqlResponse struct {
+	keys   []string
+	values map[string]any
+}
+
+func (r *gqlResponse) set(key string, value any) {
+	if _, exists := r.values[key]; !exists {
+		r.keys = append(r.keys, key)
+	}
+	r.values[key] = value
+}
+
+func (r *gqlResponse) MarshalJSON() ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, key := range r.keys {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		k, _ := json.Marshal(key)
+		v, err := json.Marshal(r.values[key])
+		if err != nil {
+			return nil, err
+		}
+		b.Write(k)
+		b.WriteByte(':')
+		b.Write(v)
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
+
+// executeGraphQL runs the chosen operation of a document against the root
+// query type
+func executeGraphQL(ctx *gqlContext, operationName string, variables map[string]any) (any, error) {
+	var op *gqlOperation
+	for _, candidate := range ctx.doc.operations {
+		if operationName == "" || candidate.name == operationName {
+			if op != nil && operationName == "" {
+				return nil, &gqlError{Message: "Must provide operation name if query contains multiple operations."}
+			}
+			op = candidate
+		}
+	}
+	if op == nil {
+		return nil, &gqlError{Message: fmt.Sprintf("Unknown operation named %q.", operationName)}
+	}
+	if op.kind != "query" {
+		return nil, &gqlError{Message: fmt.Sprintf("%s operations are not supported.", op.kind), Locations: location(ctx.src, op.pos)}
+	}
+
+	ctx.variables = make(map[string]any, len(op.vars))
+	for _, def := range op.vars {
+		value, given := variables[def.name]
+		switch {
+		case given:
+			ctx.variables[def.name] = value
+		case def.hasDefault:
+			ctx.variables[def.name] = def.def
+		case def.nonNull:
+			return nil, &gqlError{Message: fmt.Sprintf("Variable \"$%s\" of required type was not provided.", def.name), Locations: location(ctx.src, op.pos)}
+		}
+	}
+
+	return ctx.selectionSet(ctx.types["Query"], nil, op.sel, nil, 1), nil
+}
+
+// substitute replaces variables in an argument value
+func (ctx *gqlContext) substitute(v any) any {
+	switch v := v.(type) {
+	case gqlVariable:
+		return ctx.variables[string(v)]
+	case []any:
+		out := make([]any, len(v))
+		for i, item := range v {
+			out[i] = ctx.substitute(item)
+		}
+		return out
+	case map[string]any:
+		out := make(map[string]any, len(v))
+		for k, item := range v {
+			out[k] = ctx.substitute(item)
+		}
+		return out
+	}
+	return v
+}
+
+// included applies @skip and @include
+func (ctx *gqlContext) included(directives []gqlDirective) bool {
+	for _, d := range directives {
+		cond, _ := ctx.substitute(d.args["if"]).(bool)
+		if d.name == "skip" && cond || d.name == "include" && !cond {
+			return false
+		}
+	}
+	return true
+}
+
+// collect flattens fragments into the fields to resolve on a type
+func (ctx *gqlContext) collect(typ *gqlObjectType, sel []gqlSelection, visited map[string]bool, out []gqlSelection) []gqlSelection {
+	for _, s := range sel {
+		if !ctx.included(s.directives) {
+			continue
+		}
+		switch {
+		case s.spread != "":
+			fragment, exists := ctx.doc.fragments[s.spread]
+			if !exists {
+				ctx.errors = append(ctx.errors, &gqlError{Message: fmt.Sprintf("Unknown fragment %q.", s.spread), Locations: location(ctx.src, s.pos)})
+				continue
+			}
+			if visited[s.spread] || fragment.on != typ.name {
+				continue
+			}
+			visited[s.spread] = true
+			out = ctx.collect(typ, fragment.sel, visited, out)
+		case s.inline:
+			if s.on == "" || s.on == typ.name {
+				out = ctx.collect(typ, s.sel, visited, out)
+			}
+		default:
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// selectionSet resolves the fields of an object. A field that fails is
+// null in the response, with the reason in errors.
+func (ctx *gqlContext) selectionSet(typ *gqlObjectType, parent any, sel []gqlSelection, path []any, depth int) *gqlResponse {
+	out := &gqlResponse{values: make(map[string]any)}
+
+	// Selections of the same key, e.g. from two fragments, are one field
+	// with their subselections merged
+	var fields []gqlSelection
+	byKey := make(map[string]int)
+	for _, s := range ctx.collect(typ, sel, map[string]bool{}, nil) {
+		if i, exists := byKey[s.key()]; exists {
+			fields[i].sel = append(append([]gqlSelection{}, fields[i].sel...), s.sel...)
+			continue
+		}
+		byKey[s.key()] = len(fields)
+		fields = append(fields, s)
+	}
+
+	for _, s := range fields {
+		key := s.key()
+		fieldPath := append(append([]any{}, path...), key)
+		if s.name == "__typename" {
+			out.set(key, typ.name)
+			continue
+		}
+
+		field, exists := typ.fields[s.name]
+		if !exists {
+			ctx.fail(s, fieldPath, "Cannot query field %q on type %q.", s.name, typ.name)
+			out.set(key, nil)
+			continue
+		}
+
+		args := make(map[string]any, len(s.args))
+		for name, v := range s.args {
+			args[name] = ctx.substitute(v)
+		}
+		value, err := field.resolve(ctx, parent, args)
+		if err != nil {
+			ctx.fail(s, fieldPath, "%s", err.Error())
+			out.set(key, nil)
+			continue
+		}
+		out.set(key, ctx.complete(field.typ, value, s, fieldPath, depth))
+	}
+	return out
+}
+
+// complete turns a resolved value into its response shape
+func (ctx *gqlContext) complete(typ string, value any, s gqlSelection, path []any, depth int) any {
+	typ = strings.TrimSuffix(typ, "!")
+	if value == nil {
+		return nil
+	}
+
+	if strings.HasPrefix(typ, "[") {
+		items, _ := value.([]any)
+		out := make([]any, len(items))
+		for i, item := range items {
+			out[i] = ctx.complete(typ[1:len(typ)-1], item, s, append(append([]any{}, path...), i), depth)
+		}
+		return out
+	}
+
+	if gqlScalars[typ] {
+		if len(s.sel) > 0 {
+			ctx.fail(s, path, "Field %q must not have a selection since type %q has no subfields.", s.name, typ)
+			return nil
+		}
+		return value
+	}
+
+	object := ctx.types[typ]
+	if len(s.sel) == 0 {
+		ctx.fail(s, path, "Field %q of type %q must have a selection of subfields.", s.name, typ)
+		return nil
+	}
+	if depth >= gqlMaxDepth {
+		ctx.fail(s, path, "Query is nested deeper than %d levels.", gqlMaxDepth)
+		return nil
+	}
+	return ctx.selectionSet(object, value, s.sel, path, depth+1)
+}
+
+func (ctx *gqlContext) fail(s gqlSelection, path []any, format string, args ...any) {
+	ctx.errors = append(ctx.errors, &gqlError{
+		Message:   fmt.Sprintf(format, args...),
+		Locations: location(ctx.src, s.pos),
+		Path:      path,
+	})
+}
+
+// Argument coercion. JSON variables arrive as float64, literals as int64.
+
+func argString(args map[string]any, name string) (string, bool, error) {
+	switch v := args[name].(type) {
+	case nil:
+		return "", false, nil
+	case string:
+		return v, true, nil
+	case gqlEnum:
+		return string(v), true, nil
+	}
+	return "", false, fmt.Errorf("Argument %q must be a string.", name)
+}
+
+func argInt(args map[string]any, name string, def int) (int, error) {
+	switch v := args[name].(type) {
+	case nil:
+		return def, nil
+	case int64:
+		return int(v), nil
+	case float64:
+		if v == float64(int(v)) {
+			return int(v), nil
+		}
+	}
+	return 0, fmt.Errorf("Argument %q must be an integer.", name)
+}
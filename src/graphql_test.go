@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestParseGraphQL(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		want  []gqlSelection // of the first operation, positions ignored
+	}{
+		{
+			"shorthand",
+			`{ product(id: "laser") { id name } }`,
+			[]gqlSelection{{name: "product", args: map[string]any{"id": "laser"}, sel: []gqlSelection{
+				{name: "id", args: map[string]any{}},
+				{name: "name", args: map[string]any{}},
+			}}},
+		},
+		{
+			"alias, commas and comments",
+			"query {\n  cheap: products(maxPrice: 10.5, first: -2,) # cheapest\n  { id }\n}",
+			[]gqlSelection{{alias: "cheap", name: "products", args: map[string]any{"maxPrice": 10.5, "first": int64(-2)}, sel: []gqlSelection{
+				{name: "id", args: map[string]any{}},
+			}}},
+		},
+		{
+			"values",
+			`{ f(a: true, b: null, c: RED, d: [1, "x"], e: {k: $v}, s: "\"q\" é\n", bs: """ block """) }`,
+			[]gqlSelection{{name: "f", args: map[string]any{
+				"a": true, "b": nil, "c": gqlEnum("RED"), "d": []any{int64(1), "x"},
+				"e": map[string]any{"k": gqlVariable("v")}, "s": "\"q\" é\n", "bs": "block",
+			}}},
+		},
+		{
+			"fragments and directives",
+			`query Q($skip: Boolean!) { product(id: "a") { ...Parts @skip(if: $skip) ... on Product { id } ... @include(if: true) { name } } }`,
+			[]gqlSelection{{name: "product", args: map[string]any{"id": "a"}, sel: []gqlSelection{
+				{spread: "Parts", directives: []gqlDirective{{name: "skip", args: map[string]any{"if": gqlVariable("skip")}}}},
+				{inline: true, on: "Product", sel: []gqlSelection{{name: "id", args: map[string]any{}}}},
+				{inline: true, directives: []gqlDirective{{name: "include", args: map[string]any{"if": true}}}, sel: []gqlSelection{{name: "name", args: map[string]any{}}}},
+			}}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc, err := parseGraphQL(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := doc.operations[0].sel
+			clearPositions(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("selections =\n%+v\nwant\n%+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func clearPositions(sel []gqlSelection) {
+	for i := range sel {
+		sel[i].pos = 0
+		clearPositions(sel[i].sel)
+	}
+}
+
+func TestParseGraphQLDocument(t *testing.T) {
+	doc, err := parseGraphQL(`
+		query List($first: Int = 10, $ids: [ID!]!) { products(first: $first) { id } }
+		fragment Parts on Product { name }
+		query Other { products { id } }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(doc.operations) != 2 || doc.operations[0].name != "List" || doc.operations[1].name != "Other" {
+		t.Fatalf("operations = %+v", doc.operations)
+	}
+	wantVars := []gqlVarDef{
+		{name: "first", def: int64(10), hasDefault: true},
+		{name: "ids", nonNull: true},
+	}
+	if !reflect.DeepEqual(doc.operations[0].vars, wantVars) {
+		t.Errorf("variables = %+v, want %+v", doc.operations[0].vars, wantVars)
+	}
+	if f := doc.fragments["Parts"]; f == nil || f.on != "Product" || len(f.sel) != 1 {
+		t.Errorf("fragment = %+v", f)
+	}
+}
+
+func TestParseGraphQLErrors(t *testing.T) {
+	tests := []struct {
+		name         string
+		query        string
+		line, column int // 0 for errors without a location
+	}{
+		{"empty", "", 0, 0},
+		{"only a fragment", "fragment F on Product { id }", 0, 0},
+		{"unterminated selection", "{ products { id }", 1, 18},
+		{"empty selection", "{ }", 1, 3},
+		{"unterminated string", "{\n  product(id: \"laser) { id } }", 2, 15},
+		{"invalid escape", `{ product(id: "\x") { id } }`, 1, 15},
+		{"unexpected character", "{ products { id; } }", 1, 16},
+		{"variable in a default", "query ($a: Int = $b) { products { id } }", 1, 18},
+		{"duplicate fragment", "{ products { id } } fragment F on Product { id } fragment F on Product { name }", 1, 50},
+		{"missing colon", "query ($a Int) { products { id } }", 1, 11},
+		{"unterminated list", `{ f(a: [1, 2) }`, 1, 13},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseGraphQL(tt.query)
+			var gqlErr *gqlError
+			if !errors.As(err, &gqlErr) {
+				t.Fatalf("err = %v, want a GraphQL error", err)
+			}
+			var got gqlLocation
+			if len(gqlErr.Locations) > 0 {
+				got = gqlErr.Locations[0]
+			}
+			if want := (gqlLocation{Line: tt.line, Column: tt.column}); got != want {
+				t.Errorf("%q at %+v, want %+v", gqlErr.Message, got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,562 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// graphqlSDL documents the schema served by /graphql. Keep it in sync with
+// graphqlTypes.
+const graphqlSDL = `type Query {
+  product(id: ID!): Product
+  products(first: Int = 20, after: String, category: String): ProductConnection!
+  category(name: String!): Category
+  categories: [Category!]!
+}
+
+type Product {
+  id: ID!
+  name: String!
+  description: String!
+  category: Category
+  "Decimal amount, converted when currency is given"
+  price(currency: String): String!
+  currency: String!
+  stock: Int!
+  lowStock: Boolean!
+  variants: [Variant!]!
+  rating: Float!
+  reviewCount: Int!
+  "Newest first"
+  reviews(first: Int = 20, after: String): ReviewConnection!
+  version: Int!
+  "RFC 3339, when the product was created"
+  createdAt: String
+  "RFC 3339, when the product last changed"
+  updatedAt: String
+  sku: String
+  gtin: String
+  weightGrams: Int
+  images: [String!]!
+  "Set by hand, possibly scheduled"
+  badges: [Badge!]!
+  "The labels shown now, from badges and the badge rules"
+  activeBadges: [String!]!
+}
+
+type Badge {
+  label: String!
+  "RFC 3339, shown from"
+  from: String
+  "RFC 3339, shown until"
+  until: String
+}
+
+type Variant {
+  sku: ID!
+  gtin: String
+  attributes: [Attribute!]!
+  priceDelta: String!
+  stock: Int!
+}
+
+type Attribute {
+  name: String!
+  value: String!
+}
+
+type Category {
+  name: String!
+  productCount: Int!
+  products(first: Int = 20, after: String): ProductConnection!
+}
+
+type Review {
+  id: ID!
+  author: String!
+  rating: Int!
+  title: String!
+  body: String!
+  "RFC 3339"
+  createdAt: String!
+  product: Product
+}
+
+type ProductConnection {
+  edges: [ProductEdge!]!
+  nodes: [Product!]!
+  pageInfo: PageInfo!
+  totalCount: Int!
+}
+
+type ProductEdge {
+  cursor: String!
+  node: Product!
+}
+
+type ReviewConnection {
+  edges: [ReviewEdge!]!
+  nodes: [Review!]!
+  pageInfo: PageInfo!
+  totalCount: Int!
+}
+
+type ReviewEdge {
+  cursor: String!
+  node: Review!
+}
+
+type PageInfo {
+  hasNextPage: Boolean!
+  endCursor: String
+}
+`
+
+// GraphQL page sizes
+const (
+	defaultGraphQLPage = 20
+	maxGraphQLPage     = 100
+)
+
+// gqlCategory is a category of a tenant's catalog, identified by name
+type gqlCategory struct {
+	tenant, name string
+}
+
+type gqlAttribute struct {
+	name, value string
+}
+
+// gqlConnection is a page of a list with Relay-style cursors
+type gqlConnection struct {
+	nodes   []any
+	cursors []string
+	hasNext bool
+	total   int
+}
+
+type gqlEdge struct {
+	cursor string
+	node   any
+}
+
+// paginate pages through nodes by the first and after arguments. Cursors
+// are opaque to clients; when sorted, a cursor whose node is gone still
+// resumes after where it was.
+func paginate(nodes []any, keys []string, sorted bool, args map[string]any) (*gqlConnection, error) {
+	first, err := argInt(args, "first", defaultGraphQLPage)
+	if err != nil {
+		return nil, err
+	}
+	if first < 0 || first > maxGraphQLPage {
+		return nil, fmt.Errorf("Argument \"first\" must be between 0 and %d.", maxGraphQLPage)
+	}
+	after, given, err := argString(args, "after")
+	if err != nil {
+		return nil, err
+	}
+
+	start := 0
+	if given {
+		raw, err := base64.RawURLEncoding.DecodeString(after)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid cursor %q.", after)
+		}
+		key := string(raw)
+		if sorted {
+			start = sort.Search(len(keys), func(i int) bool { return keys[i] > key })
+		} else {
+			start = -1
+			for i, k := range keys {
+				if k == key {
+					start = i + 1
+					break
+				}
+			}
+			if start < 0 {
+				return nil, fmt.Errorf("Invalid cursor %q.", after)
+			}
+		}
+	}
+
+	end := min(start+first, len(nodes))
+	conn := &gqlConnection{nodes: nodes[start:end], hasNext: end < len(nodes), total: len(nodes)}
+	for _, key := range keys[start:end] {
+		conn.cursors = append(conn.cursors, base64.RawURLEncoding.EncodeToString([]byte(key)))
+	}
+	return conn, nil
+}
+
+// visibleProducts returns the tenant's products the request sees, by ID,
+// optionally of one category
+func visibleProducts(c *gin.Context, tenant, category string) ([]any, []string) {
+	store.mu.RLock()
+	list := make([]Product, 0, len(store.products))
+	for _, p := range store.products {
+		if p.Tenant == tenant && p.live() && (category == "" || p.Category == category) && shownTo(c, p) {
+			list = append(list, p)
+		}
+	}
+	store.mu.RUnlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	nodes, keys := make([]any, len(list)), make([]string, len(list))
+	for i, p := range list {
+		nodes[i], keys[i] = p, p.ID
+	}
+	return nodes, keys
+}
+
+// lookupProduct returns a product by key that the request sees, or nil
+func lookupProduct(c *gin.Context, key string) any {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	if p, exists := store.get(key); exists && shownTo(c, p) {
+		return p
+	}
+	return nil
+}
+
+// field is a resolver reading a property of the parent
+func field[T any](typ string, get func(T) any) *gqlField {
+	return &gqlField{typ: typ, resolve: func(_ *gqlContext, parent any, _ map[string]any) (any, error) {
+		return get(parent.(T)), nil
+	}}
+}
+
+// connectionTypes returns the connection and edge types for a node type
+func connectionTypes(node string) (*gqlObjectType, *gqlObjectType) {
+	conn := &gqlObjectType{name: node + "Connection", fields: map[string]*gqlField{
+		"edges": field("["+node+"Edge!]!", func(c *gqlConnection) any {
+			edges := make([]any, len(c.nodes))
+			for i := range c.nodes {
+				edges[i] = gqlEdge{cursor: c.cursors[i], node: c.nodes[i]}
+			}
+			return edges
+		}),
+		"nodes":      field("["+node+"!]!", func(c *gqlConnection) any { return c.nodes }),
+		"pageInfo":   field("PageInfo!", func(c *gqlConnection) any { return c }),
+		"totalCount": field("Int!", func(c *gqlConnection) any { return c.total }),
+	}}
+	edge := &gqlObjectType{name: node + "Edge", fields: map[string]*gqlField{
+		"cursor": field("String!", func(e gqlEdge) any { return e.cursor }),
+		"node":   field(node+"!", func(e gqlEdge) any { return e.node }),
+	}}
+	return conn, edge
+}
+
+// graphqlTypes is the schema of graphqlSDL
+var graphqlTypes = buildGraphQLTypes()
+
+func buildGraphQLTypes() map[string]*gqlObjectType {
+	types := map[string]*gqlObjectType{
+		"Query": {name: "Query", fields: map[string]*gqlField{
+			"product": {typ: "Product", resolve: func(ctx *gqlContext, _ any, args map[string]any) (any, error) {
+				id, _, err := argString(args, "id")
+				if err != nil {
+					return nil, err
+				}
+				return lookupProduct(ctx.c, tenantKey(ctx.c, id)), nil
+			}},
+			"products": {typ: "ProductConnection!", resolve: func(ctx *gqlContext, _ any, args map[string]any) (any, error) {
+				category, _, err := argString(args, "category")
+				if err != nil {
+					return nil, err
+				}
+				nodes, keys := visibleProducts(ctx.c, tenantOf(ctx.c), category)
+				return paginate(nodes, keys, true, args)
+			}},
+			"category": {typ: "Category", resolve: func(ctx *gqlContext, _ any, args map[string]any) (any, error) {
+				name, _, err := argString(args, "name")
+				if err != nil {
+					return nil, err
+				}
+				tenant := tenantOf(ctx.c)
+				if nodes, _ := visibleProducts(ctx.c, tenant, name); name == "" || len(nodes) == 0 {
+					return nil, nil
+				}
+				return gqlCategory{tenant, name}, nil
+			}},
+			"categories": {typ: "[Category!]!", resolve: func(ctx *gqlContext, _ any, _ map[string]any) (any, error) {
+				tenant := tenantOf(ctx.c)
+				nodes, _ := visibleProducts(ctx.c, tenant, "")
+				seen := make(map[string]bool)
+				var names []string
+				for _, n := range nodes {
+					if name := n.(Product).Category; name != "" && !seen[name] {
+						seen[name] = true
+						names = append(names, name)
+					}
+				}
+				sort.Strings(names)
+				categories := make([]any, len(names))
+				for i, name := range names {
+					categories[i] = gqlCategory{tenant, name}
+				}
+				return categories, nil
+			}},
+		}},
+
+		"Product": {name: "Product", fields: map[string]*gqlField{
+			"id":          field("ID!", func(p Product) any { return p.ID }),
+			"name":        field("String!", func(p Product) any { return p.Name }),
+			"description": field("String!", func(p Product) any { return p.Description }),
+			"category": field("Category", func(p Product) any {
+				if p.Category == "" {
+					return nil
+				}
+				return gqlCategory{p.Tenant, p.Category}
+			}),
+			"price": {typ: "String!", resolve: func(ctx *gqlContext, parent any, args map[string]any) (any, error) {
+				p := parent.(Product)
+				to, given, err := argString(args, "currency")
+				if err != nil || !given {
+					return p.Price.String(), err
+				}
+				to = strings.ToUpper(to)
+				if !validCurrency(to) {
+					return nil, fmt.Errorf("Currency must be an ISO 4217 code, got %q.", to)
+				}
+				rate, err := exchangeRate(ctx.c.Request.Context(), p.Currency, to)
+				if err != nil {
+					return nil, fmt.Errorf("Currency conversion failed: %v", err)
+				}
+				return p.Price.convert(rate).String(), nil
+			}},
+			"currency": field("String!", func(p Product) any { return p.Currency }),
+			"stock":    field("Int!", func(p Product) any { return p.Stock }),
+			"lowStock": field("Boolean!", func(p Product) any { return p.isLowStock() }),
+			"variants": field("[Variant!]!", func(p Product) any {
+				variants := make([]any, len(p.Variants))
+				for i, v := range p.Variants {
+					variants[i] = v
+				}
+				return variants
+			}),
+			"rating":      field("Float!", func(p Product) any { return p.Rating }),
+			"reviewCount": field("Int!", func(p Product) any { return p.ReviewCount }),
+			"reviews": {typ: "ReviewConnection!", resolve: func(_ *gqlContext, parent any, args map[string]any) (any, error) {
+				reviews.mu.RLock()
+				list := reviews.reviews[parent.(Product).key()]
+				nodes, keys := make([]any, 0, len(list)), make([]string, 0, len(list))
+				for i := len(list) - 1; i >= 0; i-- {
+					nodes, keys = append(nodes, list[i]), append(keys, list[i].ID)
+				}
+				reviews.mu.RUnlock()
+				return paginate(nodes, keys, false, args)
+			}},
+			"version": field("Int!", func(p Product) any { return p.Version }),
+			"createdAt": field("String", func(p Product) any {
+				if p.CreatedAt.IsZero() {
+					return nil
+				}
+				return p.CreatedAt.Format(time.RFC3339Nano)
+			}),
+			"updatedAt": field("String", func(p Product) any {
+				if p.UpdatedAt.IsZero() {
+					return nil
+				}
+				return p.UpdatedAt.Format(time.RFC3339Nano)
+			}),
+			"sku": field("String", func(p Product) any {
+				if p.SKU == "" {
+					return nil
+				}
+				return p.SKU
+			}),
+			"gtin": field("String", func(p Product) any {
+				if p.GTIN == "" {
+					return nil
+				}
+				return p.GTIN
+			}),
+			"weightGrams": field("Int", func(p Product) any {
+				if p.WeightGrams == 0 {
+					return nil
+				}
+				return p.WeightGrams
+			}),
+			"images": field("[String!]!", func(p Product) any {
+				images := make([]any, len(p.Images))
+				for i, image := range p.Images {
+					images[i] = image
+				}
+				return images
+			}),
+			"badges": field("[Badge!]!", func(p Product) any {
+				badges := make([]any, len(p.Badges))
+				for i, b := range p.Badges {
+					badges[i] = b
+				}
+				return badges
+			}),
+			"activeBadges": field("[String!]!", func(p Product) any {
+				labels := newBadgeContext(time.Now().UTC()).activeBadges(&p)
+				active := make([]any, len(labels))
+				for i, label := range labels {
+					active[i] = label
+				}
+				return active
+			}),
+		}},
+
+		"Badge": {name: "Badge", fields: map[string]*gqlField{
+			"label": field("String!", func(b Badge) any { return b.Label }),
+			"from": field("String", func(b Badge) any {
+				if b.From == nil {
+					return nil
+				}
+				return b.From.Format(time.RFC3339Nano)
+			}),
+			"until": field("String", func(b Badge) any {
+				if b.Until == nil {
+					return nil
+				}
+				return b.Until.Format(time.RFC3339Nano)
+			}),
+		}},
+
+		"Variant": {name: "Variant", fields: map[string]*gqlField{
+			"sku": field("ID!", func(v Variant) any { return v.SKU }),
+			"gtin": field("String", func(v Variant) any {
+				if v.GTIN == "" {
+					return nil
+				}
+				return v.GTIN
+			}),
+			"attributes": field("[Attribute!]!", func(v Variant) any {
+				names := make([]string, 0, len(v.Attributes))
+				for name := range v.Attributes {
+					names = append(names, name)
+				}
+				sort.Strings(names)
+				attributes := make([]any, len(names))
+				for i, name := range names {
+					attributes[i] = gqlAttribute{name: name, value: v.Attributes[name]}
+				}
+				return attributes
+			}),
+			"priceDelta": field("String!", func(v Variant) any { return v.PriceDelta.String() }),
+			"stock":      field("Int!", func(v Variant) any { return v.Stock }),
+		}},
+
+		"Attribute": {name: "Attribute", fields: map[string]*gqlField{
+			"name":  field("String!", func(a gqlAttribute) any { return a.name }),
+			"value": field("String!", func(a gqlAttribute) any { return a.value }),
+		}},
+
+		"Category": {name: "Category", fields: map[string]*gqlField{
+			"name": field("String!", func(c gqlCategory) any { return c.name }),
+			"productCount": {typ: "Int!", resolve: func(ctx *gqlContext, parent any, _ map[string]any) (any, error) {
+				category := parent.(gqlCategory)
+				nodes, _ := visibleProducts(ctx.c, category.tenant, category.name)
+				return len(nodes), nil
+			}},
+			"products": {typ: "ProductConnection!", resolve: func(ctx *gqlContext, parent any, args map[string]any) (any, error) {
+				category := parent.(gqlCategory)
+				nodes, keys := visibleProducts(ctx.c, category.tenant, category.name)
+				return paginate(nodes, keys, true, args)
+			}},
+		}},
+
+		"Review": {name: "Review", fields: map[string]*gqlField{
+			"id":        field("ID!", func(r Review) any { return r.ID }),
+			"author":    field("String!", func(r Review) any { return r.Author }),
+			"rating":    field("Int!", func(r Review) any { return r.Rating }),
+			"title":     field("String!", func(r Review) any { return r.Title }),
+			"body":      field("String!", func(r Review) any { return r.Body }),
+			"createdAt": field("String!", func(r Review) any { return r.CreatedAt.Format(time.RFC3339) }),
+			"product": {typ: "Product", resolve: func(ctx *gqlContext, parent any, _ map[string]any) (any, error) {
+				return lookupProduct(ctx.c, parent.(Review).key), nil
+			}},
+		}},
+
+		"PageInfo": {name: "PageInfo", fields: map[string]*gqlField{
+			"hasNextPage": field("Boolean!", func(c *gqlConnection) any { return c.hasNext }),
+			"endCursor": field("String", func(c *gqlConnection) any {
+				if len(c.cursors) == 0 {
+					return nil
+				}
+				return c.cursors[len(c.cursors)-1]
+			}),
+		}},
+	}
+	for _, node := range []string{"Product", "Review"} {
+		conn, edge := connectionTypes(node)
+		types[conn.name], types[edge.name] = conn, edge
+	}
+	return types
+}
+
+// graphqlRequest is the body of a GraphQL request
+type graphqlRequest struct {
+	Query         string         `json:"query"`
+	OperationName string         `json:"operationName"`
+	Variables     map[string]any `json:"variables"`
+}
+
+// serveGraphQL runs a GraphQL query, from a JSON body or from ?query=,
+// ?operationName= and ?variables= on GET. Products are read from this
+// shard only.
+// Returns: 200 OK - data, and errors for fields that failed (Cat fetching exactly what it wants!)
+// Returns: 400 Bad Request - Invalid request or query
+func serveGraphQL(c *gin.Context) {
+	var req graphqlRequest
+	if c.Request.Method == http.MethodGet {
+		req.Query, req.OperationName = c.Query("query"), c.Query("operationName")
+		if raw := c.Query("variables"); raw != "" {
+			if err := json.Unmarshal([]byte(raw), &req.Variables); err != nil {
+				graphqlRequestFailed(c, &gqlError{Message: "Variables must be a JSON object."})
+				return
+			}
+		}
+	} else if err := c.ShouldBindJSON(&req); err != nil {
+		graphqlRequestFailed(c, &gqlError{Message: "Invalid GraphQL request: " + err.Error()})
+		return
+	}
+	if req.Query == "" {
+		graphqlRequestFailed(c, &gqlError{Message: "Must provide query string."})
+		return
+	}
+
+	doc, err := parseGraphQL(req.Query)
+	if err != nil {
+		graphqlRequestFailed(c, err)
+		return
+	}
+	ctx := &gqlContext{src: req.Query, doc: doc, types: graphqlTypes, c: c}
+	data, err := executeGraphQL(ctx, req.OperationName, req.Variables)
+	if err != nil {
+		graphqlRequestFailed(c, err)
+		return
+	}
+
+	response := gin.H{"data": data}
+	if len(ctx.errors) > 0 {
+		response["errors"] = ctx.errors
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// graphqlRequestFailed writes a request error, which has no data
+func graphqlRequestFailed(c *gin.Context, err error) {
+	gqlErr, ok := err.(*gqlError)
+	if !ok {
+		gqlErr = &gqlError{Message: err.Error()}
+	}
+	c.JSON(http.StatusBadRequest, gin.H{"errors": []*gqlError{gqlErr}})
+}
+
+// getGraphQLSchema returns the schema in SDL
+// Returns: 200 OK - Schema (Cat drawing the map!)
+func getGraphQLSchema(c *gin.Context) {
+	c.Data(http.StatusOK, "text/plain; charset=utf-8", []byte(graphqlSDL))
+}
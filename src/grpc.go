@@ -0,0 +1,544 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// grpcAddr enables the gRPC server, GRPC_ADDR (e.g. ":9090")
+var grpcAddr = os.Getenv("GRPC_ADDR")
+
+// grpcMaxMessage caps request messages, like grpc-go's default
+const grpcMaxMessage = 4 << 20
+
+// gRPC status codes
+const (
+	grpcOK                 = 0
+	grpcUnknown            = 2
+	grpcInvalidArgument    = 3
+	grpcDeadlineExceeded   = 4
+	grpcNotFound           = 5
+	grpcAlreadyExists      = 6
+	grpcPermissionDenied   = 7
+	grpcResourceExhausted  = 8
+	grpcFailedPrecondition = 9
+	grpcUnimplemented      = 12
+	grpcInternal           = 13
+	grpcUnavailable        = 14
+	grpcUnauthenticated    = 16
+)
+
+// grpcStatus is an error carrying a gRPC status code
+type grpcStatus struct {
+	code int
+	msg  string
+}
+
+func (s *grpcStatus) Error() string { return fmt.Sprintf("grpc: code %d: %s", s.code, s.msg) }
+
+func grpcErrorf(code int, format string, args ...any) error {
+	return &grpcStatus{code: code, msg: fmt.Sprintf(format, args...)}
+}
+
+// grpcCodes maps REST statuses to gRPC codes
+var grpcCodes = map[int]int{
+	http.StatusBadRequest:            grpcInvalidArgument,
+	http.StatusUnauthorized:          grpcUnauthenticated,
+	http.StatusForbidden:             grpcPermissionDenied,
+	http.StatusNotFound:              grpcNotFound,
+	http.StatusConflict:              grpcAlreadyExists,
+	http.StatusPreconditionFailed:    grpcFailedPrecondition,
+	http.StatusRequestEntityTooLarge: grpcResourceExhausted,
+	http.StatusPreconditionRequired:  grpcFailedPrecondition,
+	http.StatusTooManyRequests:       grpcResourceExhausted,
+	http.StatusInternalServerError:   grpcInternal,
+	http.StatusBadGateway:            grpcUnavailable,
+	http.StatusServiceUnavailable:    grpcUnavailable,
+	http.StatusGatewayTimeout:        grpcDeadlineExceeded,
+}
+
+// grpcMetadata are the request headers passed on to the REST handlers
+var grpcMetadata = []string{"Authorization", "X-Actor", "X-Request-ID", tenantHeader, sessionHeader}
+
+// grpcCall is one gRPC call
+type grpcCall struct {
+	ctx    context.Context
+	host   string // names the tenant under TENANT_DOMAIN, as for REST
+	header http.Header
+	send   func(msg []byte) error
+}
+
+// grpcMethod handles a call. Unary methods send exactly one message.
+type grpcMethod func(call *grpcCall, req []byte) error
+
+// GRPCServer serves proto/product_service.proto over HTTP/2 without TLS.
+// Calls are run through the REST router in process, so both APIs share
+// handlers, validation, versioning, auditing and sharding.
+type GRPCServer struct {
+	router  http.Handler
+	methods map[string]grpcMethod
+}
+
+func newGRPCServer(router http.Handler) *GRPCServer {
+	s := &GRPCServer{router: router}
+	s.methods = map[string]grpcMethod{
+		"/productstore.v1.ProductService/Get":    s.get,
+		"/productstore.v1.ProductService/List":   s.list,
+		"/productstore.v1.ProductService/Create": s.create,
+		"/productstore.v1.ProductService/Update": s.update,
+		"/productstore.v1.ProductService/Delete": s.delete,
+		"/productstore.v1.ProductService/Watch":  s.watch,
+	}
+	return s
+}
+
+// run serves gRPC on addr. Clients connect with HTTP/2 prior knowledge,
+// which is what grpc-go does for insecure connections.
+func (s *GRPCServer) run(addr string) {
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	server := &http.Server{Addr: addr, Handler: s, Protocols: &protocols}
+
+	log.Printf("grpc: serving on %s", addr)
+	if err := server.ListenAndServe(); err != nil {
+		log.Fatalf("grpc: %v", err)
+	}
+}
+
+func (s *GRPCServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		http.Error(w, "gRPC requests only", http.StatusUnsupportedMediaType)
+		return
+	}
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+
+	ctx := r.Context()
+	if timeout, ok := parseGRPCTimeout(r.Header.Get("Grpc-Timeout")); ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	err := func() error {
+		method, exists := s.methods[r.URL.Path]
+		if !exists {
+			return grpcErrorf(grpcUnimplemented, "unknown method %s", r.URL.Path)
+		}
+		req, err := readGRPCMessage(r.Body)
+		if err != nil {
+			return err
+		}
+		// Headers go out first, so streaming clients know the call started
+		w.WriteHeader(http.StatusOK)
+		http.NewResponseController(w).Flush()
+
+		call := &grpcCall{
+			ctx:    ctx,
+			host:   r.Host,
+			header: r.Header,
+			send: func(msg []byte) error {
+				if err := writeGRPCMessage(w, msg); err != nil {
+					return err
+				}
+				http.NewResponseController(w).Flush()
+				return nil
+			},
+		}
+		return method(call, req)
+	}()
+
+	code, msg := grpcOK, ""
+	var status *grpcStatus
+	switch {
+	case err == nil:
+	case errors.As(err, &status):
+		code, msg = status.code, status.msg
+	case errors.Is(err, context.DeadlineExceeded):
+		code, msg = grpcDeadlineExceeded, err.Error()
+	default:
+		code, msg = grpcInternal, err.Error()
+	}
+	w.Header().Set("Grpc-Status", strconv.Itoa(code))
+	w.Header().Set("Grpc-Message", encodeGRPCMessage(msg))
+}
+
+// readGRPCMessage reads the single length-prefixed request message
+func readGRPCMessage(r io.Reader) ([]byte, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return nil, grpcErrorf(grpcInvalidArgument, "reading message: %v", err)
+	}
+	if prefix[0] != 0 {
+		return nil, grpcErrorf(grpcUnimplemented, "compressed messages are not supported")
+	}
+	size := binary.BigEndian.Uint32(prefix[1:])
+	if size > grpcMaxMessage {
+		return nil, grpcErrorf(grpcResourceExhausted, "message of %d bytes exceeds %d", size, grpcMaxMessage)
+	}
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, grpcErrorf(grpcInvalidArgument, "reading message: %v", err)
+	}
+	return msg, nil
+}
+
+func writeGRPCMessage(w io.Writer, msg []byte) error {
+	frame := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+	_, err := w.Write(append(frame, msg...))
+	return err
+}
+
+// parseGRPCTimeout parses grpc-timeout values such as "250m" or "5S"
+func parseGRPCTimeout(value string) (time.Duration, bool) {
+	if len(value) < 2 {
+		return 0, false
+	}
+	units := map[byte]time.Duration{
+		'H': time.Hour, 'M': time.Minute, 'S': time.Second,
+		'm': time.Millisecond, 'u': time.Microsecond, 'n': time.Nanosecond,
+	}
+	unit, exists := units[value[len(value)-1]]
+	n, err := strconv.ParseInt(value[:len(value)-1], 10, 64)
+	if !exists || err != nil || n < 0 {
+		return 0, false
+	}
+	return time.Duration(n) * unit, true
+}
+
+// encodeGRPCMessage percent-encodes a status message as the spec requires
+func encodeGRPCMessage(msg string) string {
+	var b strings.Builder
+	for i := 0; i < len(msg); i++ {
+		if c := msg[i]; c < ' ' || c > '~' || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// restResponse buffers a response of the REST router
+type restResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (r *restResponse) Header() http.Header         { return r.header }
+func (r *restResponse) Write(b []byte) (int, error) { return r.body.Write(b) }
+func (r *restResponse) WriteHeader(status int)      { r.status = status }
+
+// rest runs a REST request for a call and decodes its JSON response into
+// out. Error responses become the matching gRPC status.
+func (s *GRPCServer) rest(call *grpcCall, method, path string, body any, header http.Header, out any) error {
+	var payload io.Reader = http.NoBody
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		payload = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(call.ctx, method, path, payload)
+	if err != nil {
+		return err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	for _, key := range grpcMetadata {
+		if value := call.header.Get(key); value != "" {
+			req.Header.Set(key, value)
+		}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Host = call.host
+
+	resp := &restResponse{header: make(http.Header), status: http.StatusOK}
+	s.router.ServeHTTP(resp, req)
+
+	if resp.status >= 400 {
+		var apiErr struct {
+			Error   string      `json:"error"`
+			Details any         `json:"details"`
+			Errors  []Violation `json:"errors"`
+		}
+		json.Unmarshal(resp.body.Bytes(), &apiErr)
+		msg := apiErr.Error
+		switch {
+		case len(apiErr.Errors) > 0:
+			msg = fmt.Sprintf("%s: %s", msg, violationSummary(apiErr.Errors))
+		case apiErr.Details != nil:
+			msg = fmt.Sprintf("%s: %v", msg, apiErr.Details)
+		}
+		code, exists := grpcCodes[resp.status]
+		if !exists {
+			code = grpcUnknown
+		}
+		return &grpcStatus{code: code, msg: msg}
+	}
+	if out != nil {
+		return json.Unmarshal(resp.body.Bytes(), out)
+	}
+	return nil
+}
+
+// productPath is the REST path of a product
+func productPath(id string) string {
+	return "/v1/products/" + url.PathEscape(id)
+}
+
+// versionHeader turns an expected version of a product into If-Match, so
+// a missing one fails the same way as on the REST API. The ETag names the
+// product too, so it's looked up first, through the list, which doesn't
+// count as a view of it. One that isn't there fails the write as on REST.
+func (s *GRPCServer) versionHeader(call *grpcCall, id string, version int64) (http.Header, error) {
+	if version == 0 {
+		return nil, nil
+	}
+	var body struct {
+		Products []Product `json:"products"`
+	}
+	if err := s.rest(call, http.MethodGet, "/v1/products?id="+url.QueryEscape(id), nil, nil, &body); err != nil {
+		return nil, err
+	}
+	current := Product{ID: id}
+	for _, p := range body.Products {
+		if p.ID == id {
+			current = p
+		}
+	}
+	current.Version = version
+	return http.Header{"If-Match": {productETag(current)}}, nil
+}
+
+func (s *GRPCServer) get(call *grpcCall, req []byte) error {
+	var id, currency string
+	if err := readProto(req, func(f protoField) error {
+		switch f.num {
+		case 1:
+			id = f.string()
+		case 2:
+			currency = f.string()
+		}
+		return nil
+	}); err != nil {
+		return grpcErrorf(grpcInvalidArgument, "%v", err)
+	}
+	if id == "" {
+		return grpcErrorf(grpcInvalidArgument, "id is required")
+	}
+
+	path := productPath(id)
+	if currency != "" {
+		path += "?currency=" + url.QueryEscape(currency)
+	}
+	var product Product
+	if err := s.rest(call, http.MethodGet, path, nil, nil, &product); err != nil {
+		return err
+	}
+	return call.send(encodeProduct(product))
+}
+
+// List pages through products by ID. A page token is the last ID of the
+// previous page, so pages stay stable while products are added.
+func (s *GRPCServer) list(call *grpcCall, req []byte) error {
+	pageSize, token, includeDeleted, currency := 0, "", false, ""
+	if err := readProto(req, func(f protoField) error {
+		switch f.num {
+		case 1:
+			pageSize = int(f.int())
+		case 2:
+			token = f.string()
+		case 3:
+			includeDeleted = f.v != 0
+		case 4:
+			currency = f.string()
+		}
+		return nil
+	}); err != nil {
+		return grpcErrorf(grpcInvalidArgument, "%v", err)
+	}
+	if pageSize <= 0 {
+		pageSize = 50
+	}
+	pageSize = min(pageSize, 500)
+	after, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return grpcErrorf(grpcInvalidArgument, "invalid page_token")
+	}
+
+	query := url.Values{}
+	if includeDeleted {
+		query.Set("include_deleted", "true")
+	}
+	if currency != "" {
+		query.Set("currency", currency)
+	}
+	var body struct {
+		Products []Product `json:"products"`
+	}
+	if err := s.rest(call, http.MethodGet, "/v1/products?"+query.Encode(), nil, nil, &body); err != nil {
+		return err
+	}
+
+	products := body.Products
+	sort.Slice(products, func(i, j int) bool { return products[i].ID < products[j].ID })
+	start := sort.Search(len(products), func(i int) bool { return products[i].ID > string(after) })
+	end := min(start+pageSize, len(products))
+
+	var resp []byte
+	for _, p := range products[start:end] {
+		resp = protoMessage(resp, 1, encodeProduct(p))
+	}
+	if end < len(products) {
+		resp = protoString(resp, 2, base64.RawURLEncoding.EncodeToString([]byte(products[end-1].ID)))
+	}
+	return call.send(resp)
+}
+
+func (s *GRPCServer) create(call *grpcCall, req []byte) error {
+	product, _, err := decodeProductRequest(req)
+	if err != nil {
+		return grpcErrorf(grpcInvalidArgument, "%v", err)
+	}
+
+	var body struct {
+		Product Product `json:"product"`
+	}
+	if err := s.rest(call, http.MethodPost, "/v1/products", product, nil, &body); err != nil {
+		return err
+	}
+	return call.send(encodeProduct(body.Product))
+}
+
+func (s *GRPCServer) update(call *grpcCall, req []byte) error {
+	product, version, err := decodeProductRequest(req)
+	if err != nil {
+		return grpcErrorf(grpcInvalidArgument, "%v", err)
+	}
+	if product.ID == "" {
+		return grpcErrorf(grpcInvalidArgument, "product.id is required")
+	}
+
+	var body struct {
+		Product Product `json:"product"`
+	}
+	header, err := s.versionHeader(call, product.ID, version)
+	if err != nil {
+		return err
+	}
+	if err := s.rest(call, http.MethodPut, productPath(product.ID), product, header, &body); err != nil {
+		return err
+	}
+	return call.send(encodeProduct(body.Product))
+}
+
+func (s *GRPCServer) delete(call *grpcCall, req []byte) error {
+	var id string
+	var version int64
+	if err := readProto(req, func(f protoField) error {
+		switch f.num {
+		case 1:
+			id = f.string()
+		case 2:
+			version = f.int()
+		}
+		return nil
+	}); err != nil {
+		return grpcErrorf(grpcInvalidArgument, "%v", err)
+	}
+	if id == "" {
+		return grpcErrorf(grpcInvalidArgument, "id is required")
+	}
+
+	header, err := s.versionHeader(call, id, version)
+	if err != nil {
+		return err
+	}
+	if err := s.rest(call, http.MethodDelete, productPath(id), nil, header, nil); err != nil {
+		return err
+	}
+	return call.send(nil)
+}
+
+// grpcEventTypes maps event types to ProductEvent.Type
+var grpcEventTypes = map[string]int64{
+	eventCreated:     1,
+	eventUpdated:     2,
+	eventDeleted:     3,
+	eventPurged:      4,
+	eventSuspended:   5,
+	eventUnsuspended: 6,
+}
+
+// watch streams product events of this instance, of the tenant in the
+// x-tenant-id metadata, until the client goes away. A client too slow to
+// keep up gets UNAVAILABLE and should re-read what it needs and watch
+// again. Without an admin token, only products the storefront shows the
+// x-session-id session are watched, as the REST stream does.
+func (s *GRPCServer) watch(call *grpcCall, req []byte) error {
+	tenant, status, msg := resolveTenant(&http.Request{Host: call.host, Header: call.header})
+	if status != 0 {
+		return grpcErrorf(grpcCodes[status], "%s: %s", msg, tenant)
+	}
+	ids := make(map[string]bool)
+	if err := readProto(req, func(f protoField) error {
+		if f.num == 1 {
+			ids[f.string()] = true
+		}
+		return nil
+	}); err != nil {
+		return grpcErrorf(grpcInvalidArgument, "%v", err)
+	}
+
+	admin, session := adminHeader(call.header, tenant), call.header.Get(sessionHeader)
+
+	events := productEvents.subscribe(256)
+	defer productEvents.unsubscribe(events)
+
+	for {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				return grpcErrorf(grpcUnavailable, "watcher fell behind")
+			}
+			if e.Tenant != tenant || len(ids) > 0 && !ids[e.ID] {
+				continue
+			}
+			if !admin {
+				if e, ok = storefrontEvent(e, session, time.Now()); !ok {
+					continue
+				}
+			}
+			var msg []byte
+			msg = protoInt(msg, 1, grpcEventTypes[e.Type])
+			msg = protoString(msg, 2, e.ID)
+			if e.Product != nil {
+				msg = protoMessage(msg, 3, encodeProduct(*e.Product))
+			}
+			if err := call.send(msg); err != nil {
+				return err
+			}
+		case <-call.ctx.Done():
+			return call.ctx.Err()
+		}
+	}
+}
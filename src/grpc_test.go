@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadGRPCMessage(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame []byte
+		want  string
+		code  int // 0 for none
+	}{
+		{"message", []byte{0, 0, 0, 0, 3, 'a', 'b', 'c'}, "abc", 0},
+		{"empty", []byte{0, 0, 0, 0, 0}, "", 0},
+		{"compressed", []byte{1, 0, 0, 0, 1, 'a'}, "", grpcUnimplemented},
+		{"too large", []byte{0, 0xff, 0xff, 0xff, 0xff}, "", grpcResourceExhausted},
+		{"short prefix", []byte{0, 0, 0}, "", grpcInvalidArgument},
+		{"short message", []byte{0, 0, 0, 0, 4, 'a'}, "", grpcInvalidArgument},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, err := readGRPCMessage(bytes.NewReader(tt.frame))
+			if tt.code != 0 {
+				var status *grpcStatus
+				if !errors.As(err, &status) || status.code != tt.code {
+					t.Fatalf("err = %v, want code %d", err, tt.code)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(msg) != tt.want {
+				t.Errorf("message = %q, want %q", msg, tt.want)
+			}
+		})
+	}
+}
+
+func TestGRPCMessageRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	want := strings.Repeat("x", 300)
+	if err := writeGRPCMessage(&buf, []byte(want)); err != nil {
+		t.Fatal(err)
+	}
+	got, err := readGRPCMessage(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("read back %d bytes, want %d", len(got), len(want))
+	}
+}
+
+func TestParseGRPCTimeout(t *testing.T) {
+	tests := []struct {
+		value string
+		want  time.Duration
+		ok    bool
+	}{
+		{"250m", 250 * time.Millisecond, true},
+		{"5S", 5 * time.Second, true},
+		{"1H", time.Hour, true},
+		{"100u", 100 * time.Microsecond, true},
+		{"S", 0, false},
+		{"5s", 0, false},
+		{"-1S", 0, false},
+		{"", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, ok := parseGRPCTimeout(tt.value)
+			if got != tt.want || ok != tt.ok {
+				t.Errorf("parseGRPCTimeout(%q) = %v, %v; want %v, %v", tt.value, got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
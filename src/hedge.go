@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// hedgeAttemptHeader marks the second attempt of a hedged request, so the
+// owner doesn't count the view twice
+const hedgeAttemptHeader = "X-Hedge-Attempt"
+
+// Hedged reads, HEDGE_READS=true. A read that takes longer than the
+// HEDGE_PERCENTILE latency of recent reads is sent a second time, and
+// whichever answers first is used. At most HEDGE_BUDGET_PERCENT of reads
+// are hedged, so a slow backend gets little extra load.
+var (
+	hedgeReads      = os.Getenv("HEDGE_READS") == "true"
+	hedgePercentile = envInt("HEDGE_PERCENTILE", 95)
+	hedgeBudget     = envInt("HEDGE_BUDGET_PERCENT", 5)
+	hedgeMinDelay   = envDuration("HEDGE_MIN_DELAY", time.Millisecond)
+)
+
+// hedgeSamples is how many recent latencies the delay is computed over,
+// and how many are needed before hedging starts
+const hedgeSamples = 256
+
+// Hedger hedges the reads of one backend
+type Hedger struct {
+	name string
+
+	mu        sync.Mutex
+	latencies [hedgeSamples]time.Duration
+	samples   int
+	delay     time.Duration // cached percentile, recomputed every 16 samples
+
+	requests atomic.Int64
+	hedged   atomic.Int64
+	wins     atomic.Int64 // the second attempt answered first
+}
+
+// HedgeStats is a hedger's entry in the hedged_reads metric
+type HedgeStats struct {
+	Requests int64   `json:"requests"`
+	Hedged   int64   `json:"hedged"`
+	Wins     int64   `json:"wins"`
+	DelayMS  float64 `json:"delay_ms"`
+}
+
+var (
+	hedgersMu sync.Mutex
+	hedgers   []*Hedger
+)
+
+func init() {
+	expvar.Publish("hedged_reads", expvar.Func(func() any {
+		hedgersMu.Lock()
+		defer hedgersMu.Unlock()
+
+		stats := make(map[string]HedgeStats, len(hedgers))
+		for _, h := range hedgers {
+			h.mu.Lock()
+			delay := h.delay
+			h.mu.Unlock()
+			stats[h.name] = HedgeStats{
+				Requests: h.requests.Load(),
+				Hedged:   h.hedged.Load(),
+				Wins:     h.wins.Load(),
+				DelayMS:  float64(delay.Microseconds()) / 1000,
+			}
+		}
+		return stats
+	}))
+}
+
+// newHedger returns the hedger of a backend, or nil when hedging is off
+func newHedger(name string) *Hedger {
+	if !hedgeReads {
+		return nil
+	}
+	h := &Hedger{name: name}
+	hedgersMu.Lock()
+	hedgers = append(hedgers, h)
+	hedgersMu.Unlock()
+	return h
+}
+
+// observe records the latency of a read
+func (h *Hedger) observe(d time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.latencies[h.samples%hedgeSamples] = d
+	h.samples++
+	if h.samples >= hedgeSamples && h.samples%16 == 0 {
+		sorted := slices.Clone(h.latencies[:])
+		slices.Sort(sorted)
+		h.delay = max(sorted[(hedgeSamples-1)*hedgePercentile/100], hedgeMinDelay)
+	}
+}
+
+// hedgeDelay returns how long to wait before hedging, or false when this
+// read may not be hedged: too few samples yet, or the budget is spent
+func (h *Hedger) hedgeDelay() (time.Duration, bool) {
+	h.mu.Lock()
+	delay := h.delay
+	h.mu.Unlock()
+
+	if delay == 0 {
+		return 0, false
+	}
+	return delay, h.hedged.Load()*100 < h.requests.Load()*int64(hedgeBudget)
+}
+
+// hedgeResult is the outcome of one attempt
+type hedgeResult[T any] struct {
+	v       T
+	err     error
+	attempt int
+	took    time.Duration
+}
+
+// hedge runs attempt, and runs it again when the first doesn't answer
+// within the hedge delay. It returns the first success, or the last error.
+// The winner's context stays alive until release is called; the loser's
+// is cancelled and its result, if any, passed to discard. A nil hedger
+// just runs attempt once.
+func hedge[T any](h *Hedger, ctx context.Context, attempt func(ctx context.Context, n int) (T, error), discard func(T)) (v T, release func(), err error) {
+	if h == nil {
+		v, err = attempt(ctx, 0)
+		return v, func() {}, err
+	}
+	h.requests.Add(1)
+
+	results := make(chan hedgeResult[T], 2)
+	var cancels []context.CancelFunc
+	launch := func(n int) {
+		attemptCtx, cancel := context.WithCancel(ctx)
+		cancels = append(cancels, cancel)
+		go func() {
+			start := time.Now()
+			v, err := attempt(attemptCtx, n)
+			results <- hedgeResult[T]{v: v, err: err, attempt: n, took: time.Since(start)}
+		}()
+	}
+	// finish cancels the attempts still running and discards what they
+	// return
+	finish := func(pending int, keep int) {
+		for i, cancel := range cancels {
+			if i != keep {
+				cancel()
+			}
+		}
+		if pending > 0 {
+			go func() {
+				for range pending {
+					if r := <-results; r.err == nil && discard != nil {
+						discard(r.v)
+					}
+				}
+			}()
+		}
+	}
+
+	launch(0)
+	pending := 1
+	var timer <-chan time.Time
+	if delay, ok := h.hedgeDelay(); ok {
+		t := time.NewTimer(delay)
+		defer t.Stop()
+		timer = t.C
+	}
+
+	for {
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				h.observe(r.took)
+				if r.attempt == 1 {
+					h.wins.Add(1)
+				}
+				finish(pending, r.attempt)
+				return r.v, cancels[r.attempt], nil
+			}
+			err = r.err
+			if pending == 0 {
+				finish(0, -1)
+				return v, func() {}, err
+			}
+		case <-timer:
+			timer = nil
+			h.hedged.Add(1)
+			launch(1)
+			pending++
+		case <-ctx.Done():
+			finish(pending, -1)
+			return v, func() {}, ctx.Err()
+		}
+	}
+}
+
+// hedgedTransport hedges GET and HEAD requests without a body
+type hedgedTransport struct {
+	base   http.RoundTripper
+	hedger *Hedger
+}
+
+func (t *hedgedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.hedger == nil || req.Method != http.MethodGet && req.Method != http.MethodHead || req.Body != nil && req.Body != http.NoBody {
+		return t.base.RoundTrip(req)
+	}
+
+	resp, release, err := hedge(t.hedger, req.Context(), func(ctx context.Context, n int) (*http.Response, error) {
+		attempt := req.Clone(ctx)
+		if n > 0 {
+			attempt.Header.Set(hedgeAttemptHeader, "2")
+		}
+		return t.base.RoundTrip(attempt)
+	}, func(resp *http.Response) { resp.Body.Close() })
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = &pooledBody{ReadCloser: resp.Body, release: sync.OnceFunc(release)}
+	return resp, nil
+}
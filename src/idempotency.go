@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// IdempotencyStore remembers responses by Idempotency-Key so retried
+// requests get the original result instead of repeating the write
+type IdempotencyStore struct {
+	mu        sync.Mutex
+	ttl       time.Duration
+	entries   map[string]*idempotencyEntry
+	lastSweep time.Time
+}
+
+type idempotencyEntry struct {
+	fingerprint string
+	done        bool
+	status      int
+	header      http.Header
+	body        []byte
+	expires     time.Time
+}
+
+// Global idempotency store, IDEMPOTENCY_TTL controls the replay window
+var idempotencyKeys = &IdempotencyStore{
+	ttl:     envDuration("IDEMPOTENCY_TTL", 24*time.Hour),
+	entries: make(map[string]*idempotencyEntry),
+}
+
+// responseRecorder captures the response body while still writing it out
+type responseRecorder struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *responseRecorder) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *responseRecorder) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+// begin claims a key. It returns the stored entry when the key was seen
+// before, or nil when the caller should run the request and finish it.
+func (s *IdempotencyStore) begin(key, fingerprint string) (*idempotencyEntry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(s.lastSweep) > time.Minute {
+		for k, e := range s.entries {
+			if e.done && now.After(e.expires) {
+				delete(s.entries, k)
+			}
+		}
+		s.lastSweep = now
+	}
+
+	if entry, exists := s.entries[key]; exists && (!entry.done || now.Before(entry.expires)) {
+		return entry, true
+	}
+	s.entries[key] = &idempotencyEntry{fingerprint: fingerprint}
+	return nil, false
+}
+
+// finish stores the final response for a key. Server errors are not
+// remembered so the client can retry them.
+func (s *IdempotencyStore) finish(key string, status int, header http.Header, body []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if status >= http.StatusInternalServerError {
+		delete(s.entries, key)
+		return
+	}
+
+	entry := s.entries[key]
+	entry.done = true
+	entry.status = status
+	entry.header = header
+	entry.body = body
+	entry.expires = time.Now().Add(s.ttl)
+}
+
+// idempotent replays the original response for requests that repeat an
+// Idempotency-Key. Requests without the header are passed through.
+// Returns: 409 Conflict - A request with this key is still in progress
+// Returns: 422 Unprocessable Entity - Key reused with a different request body
+func idempotent() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.GetHeader("Idempotency-Key")
+		if key == "" {
+			c.Next()
+			return
+		}
+
+		body, err := io.ReadAll(c.Request.Body)
+		if isBodyTooLarge(err) {
+			invalidRequest(c, "Request body too large", []Violation{bodyTooLarge()})
+			c.Abort()
+			return
+		}
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+				"error":   "Invalid request body",
+				"details": err.Error(),
+			})
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+		sum := sha256.Sum256(body)
+		fingerprint := hex.EncodeToString(sum[:])
+		// Tenants can reuse each other's keys
+		scopedKey := tenantOf(c) + " " + c.Request.Method + " " + c.Request.URL.Path + " " + key
+
+		entry, seen := idempotencyKeys.begin(scopedKey, fingerprint)
+		if seen {
+			switch {
+			case entry.fingerprint != fingerprint:
+				c.AbortWithStatusJSON(http.StatusUnprocessableEntity, gin.H{
+					"error": "Idempotency-Key was already used with a different request",
+					"key":   key,
+				})
+			case !entry.done:
+				c.AbortWithStatusJSON(http.StatusConflict, gin.H{
+					"error": "A request with this Idempotency-Key is still in progress",
+					"key":   key,
+				})
+			default:
+				for name, values := range entry.header {
+					// Merged with what the middleware in front has set
+					if name == "Vary" {
+						addVary(c, strings.Split(strings.Join(values, ", "), ", ")...)
+						continue
+					}
+					c.Writer.Header()[name] = values
+				}
+				c.Header("Idempotent-Replayed", "true")
+				c.Status(entry.status)
+				c.Writer.Write(entry.body)
+				c.Abort()
+			}
+			return
+		}
+
+		recorder := &responseRecorder{ResponseWriter: c.Writer}
+		c.Writer = recorder
+		defer func() {
+			// Release the key if the handler panics so retries aren't stuck
+			if r := recover(); r != nil {
+				idempotencyKeys.finish(scopedKey, http.StatusInternalServerError, nil, nil)
+				panic(r)
+			}
+		}()
+		c.Next()
+
+		idempotencyKeys.finish(scopedKey, recorder.Status(), replayHeader(recorder.Header()), recorder.body.Bytes())
+	}
+}
+
+// replayHeader is the part of a response's header to replay. The recorder
+// sits inside the compressor and records the body as the handler wrote
+// it, so the coding the compressor chose for this client is dropped, and
+// the compressor picks one again for the retry.
+func replayHeader(header http.Header) http.Header {
+	header = header.Clone()
+	header.Del("Content-Encoding")
+	header.Del("Content-Length")
+	return header
+}
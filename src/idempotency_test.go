@@ -0,0 +1,53 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestIdempotentReplayCompressed(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	large := strings.Repeat("x", 4*compressionMinBytes)
+	router := gin.New()
+	router.Use(compressResponses())
+	router.POST("/things", idempotent(), func(c *gin.Context) {
+		c.JSON(http.StatusCreated, gin.H{"data": large})
+	})
+
+	for _, attempt := range []string{"original", "replay", "replay without gzip"} {
+		encoding := "gzip"
+		if attempt == "replay without gzip" {
+			encoding = ""
+		}
+		w := serve(router, http.MethodPost, "/things", `{}`, "Idempotency-Key", "k1", "Accept-Encoding", encoding)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("%s: status %d", attempt, w.Code)
+		}
+		if got := w.Header().Get("Content-Encoding"); got != encoding {
+			t.Fatalf("%s: Content-Encoding = %q, want %q", attempt, got, encoding)
+		}
+		body := io.Reader(w.Body)
+		if encoding == "gzip" {
+			zr, err := gzip.NewReader(w.Body)
+			if err != nil {
+				t.Fatalf("%s: %v", attempt, err)
+			}
+			body = zr
+		}
+		data, err := io.ReadAll(body)
+		if err != nil {
+			t.Fatalf("%s: %v", attempt, err)
+		}
+		if !strings.Contains(string(data), large) {
+			t.Errorf("%s: body = %.50s...", attempt, data)
+		}
+		if vary := w.Header().Values("Vary"); len(vary) != 1 || vary[0] != "Accept-Encoding" {
+			t.Errorf("%s: Vary = %q", attempt, vary)
+		}
+	}
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net/http"
+	"reflect"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Import pipeline settings. Queues are bounded, so a client sending faster
+// than records are written is slowed down by TCP instead of filling memory.
+var (
+	importWorkers   = envInt("IMPORT_WORKERS", 4)
+	importQueueSize = envInt("IMPORT_QUEUE_SIZE", 1000)
+	importBatchSize = envInt("IMPORT_BATCH_SIZE", 100)
+)
+
+// importStages counts records through each stage, across imports
+var importStages = expvar.NewMap("import_stages")
+
+// importSlot lets one import run at a time
+var importSlot = make(chan struct{}, 1)
+
+// maxImportErrors caps the errors listed in an import summary
+const maxImportErrors = 100
+
+// importRecord is a record moving through the pipeline
+type importRecord struct {
+	n       int // position in the stream, from 1
+	product Product
+	err     string
+}
+
+// ImportError describes a record that wasn't imported
+type ImportError struct {
+	Record int    `json:"record"`
+	ID     string `json:"id,omitempty"`
+	Error  string `json:"error"`
+}
+
+// ImportSummary is the outcome of an import
+type ImportSummary struct {
+	Records   int           `json:"records"`
+	Created   int           `json:"created"`
+	Updated   int           `json:"updated"`
+	Unchanged int           `json:"unchanged"`
+	Invalid   int           `json:"invalid"`
+	Failed    int           `json:"failed"`
+	Errors    []ImportError `json:"errors,omitempty"`
+	Aborted   string        `json:"aborted,omitempty"`
+	Duration  string        `json:"duration"`
+}
+
+// fail records a rejected record in the summary
+func (s *ImportSummary) fail(rec importRecord) {
+	if len(s.Errors) < maxImportErrors {
+		s.Errors = append(s.Errors, ImportError{Record: rec.n, ID: rec.product.ID, Error: rec.err})
+	}
+}
+
+// trackedReader remembers the last read error, so a broken connection
+// isn't mistaken for a malformed record
+type trackedReader struct {
+	r   io.Reader
+	err error
+}
+
+func (t *trackedReader) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p)
+	if err != nil {
+		t.err = err
+	}
+	return n, err
+}
+
+// importParse decodes records and routes each to a validation worker by
+// product ID, so records for the same product stay in stream order.
+// resumable reports whether decoding can go on after an error.
+func importParse(ctx context.Context, dec RecordDecoder, body *trackedReader, resumable func(error) bool, shards []chan importRecord) (records int, abort error) {
+	defer func() {
+		for _, shard := range shards {
+			close(shard)
+		}
+	}()
+
+	for n := 1; ; n++ {
+		rec := importRecord{n: n}
+		err := dec.Decode(&rec.product)
+		if err == io.EOF {
+			return n - 1, nil
+		}
+		if err != nil {
+			if body.err != nil && body.err != io.EOF {
+				return n - 1, body.err
+			}
+			if !resumable(err) {
+				return n - 1, fmt.Errorf("record %d: %w", n, err)
+			}
+			rec.err = err.Error()
+		}
+		importStages.Add("parsed", 1)
+
+		h := fnv.New32a()
+		h.Write([]byte(rec.product.ID))
+		select {
+		case shards[h.Sum32()%uint32(len(shards))] <- rec:
+		case <-ctx.Done():
+			return n, ctx.Err()
+		}
+	}
+}
+
+// importValidate checks records the same way POST /products does
+func importValidate(in <-chan importRecord, out chan<- importRecord) {
+	for rec := range in {
+		if rec.err == "" {
+			if violations := productViolations(&rec.product); len(violations) > 0 {
+				rec.err = violationSummary(violations)
+			}
+		}
+		if rec.err != "" {
+			importStages.Add("invalid", 1)
+		} else {
+			importStages.Add("validated", 1)
+		}
+		out <- rec
+	}
+}
+
+// importWrite dedupes and writes a batch of records under a single lock.
+// Records identical to the stored product are skipped so they don't bump
+// versions or invalidate caches.
+func importWrite(c *gin.Context, tenant string, batch []importRecord, summary *ImportSummary) {
+	start := time.Now()
+	store.mu.Lock()
+	defer func() {
+		store.mu.Unlock()
+		importStages.Add("write_lock_ns", int64(time.Since(start)))
+		importStages.Add("write_batches", 1)
+	}()
+
+	for _, rec := range batch {
+		if rec.err != "" {
+			summary.Invalid++
+			summary.fail(rec)
+			continue
+		}
+
+		product := rec.product
+		product.Tenant = tenant
+		current, exists := store.products[product.key()]
+		if exists && !current.live() {
+			rec.err = "Product with this ID is deleted or suspended"
+			summary.Failed++
+			summary.fail(rec)
+			importStages.Add("failed", 1)
+			continue
+		}
+		violations := codes.conflicts(&product)
+		if len(violations) == 0 {
+			violations = catalogViolations(&product)
+		}
+		if len(violations) == 0 && exists {
+			violations = stockWriteViolations(&current, &product)
+		}
+		if len(violations) > 0 {
+			rec.err = violationSummary(violations)
+			summary.Failed++
+			summary.fail(rec)
+			importStages.Add("failed", 1)
+			continue
+		}
+
+		// Versions, ratings and timestamps are managed by the server
+		product.DeletedAt, product.Suspension, product.ActiveBadges = nil, nil, nil
+		if exists {
+			product.Version, product.CreatedAt, product.UpdatedAt = current.Version, current.CreatedAt, current.UpdatedAt
+			product.Rating, product.ReviewCount = current.Rating, current.ReviewCount
+			syncVariantStock(&product)
+			if reflect.DeepEqual(product, current) {
+				summary.Unchanged++
+				importStages.Add("unchanged", 1)
+				continue
+			}
+			if err := store.save(&product); err != nil {
+				rec.err = "Write failed: " + err.Error()
+				summary.Failed++
+				summary.fail(rec)
+				importStages.Add("failed", 1)
+				continue
+			}
+			audit.record(c, "import", &current, &product)
+			summary.Updated++
+		} else {
+			product.Version = 0
+			product.Rating, product.ReviewCount = 0, 0
+			if err := store.save(&product); err != nil {
+				rec.err = "Write failed: " + err.Error()
+				summary.Failed++
+				summary.fail(rec)
+				importStages.Add("failed", 1)
+				continue
+			}
+			audit.record(c, "import", nil, &product)
+			summary.Created++
+		}
+		importStages.Add("written", 1)
+	}
+}
+
+// importProducts streams a catalog import through a bounded pipeline:
+// parse → validate (IMPORT_WORKERS in parallel) → dedupe → write. The body
+// is never held in memory. Writes take the store lock one batch at a time,
+// so reads and other writes interleave with a long import. Later records
+// for a product replace earlier ones.
+// With ?mapping=name the body is a CSV or XML feed read through that
+// import mapping instead.
+// Returns: 200 OK - Import summary (Cat unloading the groceries!)
+// Returns: 400 Bad Request - Stream is malformed, summary of what was imported before
+// Returns: 404 Not Found - No such mapping
+// Returns: 409 Conflict - Another import is running
+func importProducts(c *gin.Context) {
+	body := &trackedReader{r: c.Request.Body}
+	dec, resumable := recordCodec.NewDecoder(body), recordCodec.Resumable
+	if name := c.Query("mapping"); name != "" {
+		mapping, exists := importMappings.lookup(name)
+		if !exists {
+			importMappingNotFound(c, name)
+			return
+		}
+		dec, resumable = mapping.newDecoder(body), mappingResumable
+	}
+
+	select {
+	case importSlot <- struct{}{}:
+		defer func() { <-importSlot }()
+	default:
+		c.JSON(http.StatusConflict, gin.H{
+			"error": "Another import is already running",
+		})
+		return
+	}
+
+	summary, abort := runImport(c.Request.Context(), c, tenantOf(c), dec, body, resumable)
+	if abort != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":   "Import stream is malformed",
+			"summary": summary,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, summary)
+}
+
+// runImport runs the pipeline over a decoded stream into a tenant's
+// catalog. c attributes the writes in the audit trail, nil for
+// productctl. abort is why the stream ended early; the summary covers
+// what was imported before.
+func runImport(ctx context.Context, c *gin.Context, tenant string, dec RecordDecoder, body *trackedReader, resumable func(error) bool) (summary ImportSummary, abort error) {
+	start := time.Now()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	workers := max(importWorkers, 1)
+	shards := make([]chan importRecord, workers)
+	for i := range shards {
+		shards[i] = make(chan importRecord, max(importQueueSize/workers, 1))
+	}
+	validated := make(chan importRecord, importQueueSize)
+
+	var parsed int
+	parseDone := make(chan struct{})
+	go func() {
+		defer close(parseDone)
+		parsed, abort = importParse(ctx, dec, body, resumable, shards)
+	}()
+
+	var wg sync.WaitGroup
+	for _, shard := range shards {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			importValidate(shard, validated)
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(validated)
+	}()
+
+	batch := make([]importRecord, 0, importBatchSize)
+	for rec := range validated {
+		batch = append(batch, rec)
+		// Take whatever else is ready, but don't wait for a full batch
+		for len(batch) < importBatchSize {
+			more := false
+			select {
+			case rec, ok := <-validated:
+				if ok {
+					batch = append(batch, rec)
+					more = true
+				}
+			default:
+			}
+			if !more {
+				break
+			}
+		}
+		importWrite(c, tenant, batch, &summary)
+		batch = batch[:0]
+		// Give interactive requests a turn between batches
+		runtime.Gosched()
+	}
+	<-parseDone
+
+	summary.Records = parsed
+	summary.Duration = time.Since(start).String()
+	if abort != nil {
+		summary.Aborted = abort.Error()
+	}
+	return summary, abort
+}
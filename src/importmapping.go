@@ -0,0 +1,530 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Import mapping formats
+const (
+	mappingCSV = "csv"
+	mappingXML = "xml"
+)
+
+// mappingName is what mapping names may look like, since they're used in
+// URLs
+var mappingName = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// mappableFields are the product fields a mapping can fill. Variants
+// don't fit a flat row and are left to JSON imports; images are URLs
+// separated by semicolons.
+var mappableFields = []string{"id", "name", "description", "category", "price", "currency", "stock", "low_stock_threshold", "sku", "gtin", "weight_grams", "images"}
+
+// ImportMapping describes how one partner's CSV or XML feed maps onto
+// products, so POST /admin/import?mapping=name can read it directly
+type ImportMapping struct {
+	Name   string `json:"name"`
+	Format string `json:"format"`
+	// Delimiter separates CSV columns, "," by default
+	Delimiter string `json:"delimiter,omitempty"`
+	// RecordElement is the XML element holding one product, e.g. "item"
+	RecordElement string         `json:"record_element,omitempty"`
+	Fields        []FieldMapping `json:"fields"`
+	UpdatedAt     time.Time      `json:"updated_at"`
+}
+
+// FieldMapping fills one product field. Column is the CSV header, or for
+// XML a child element of the record, a path such as "pricing/list", or
+// "@sku" for an attribute of the record. Transform is applied to the
+// value, and Default used when the result is empty.
+type FieldMapping struct {
+	Field     string `json:"field"`
+	Column    string `json:"column,omitempty"`
+	Default   string `json:"default,omitempty"`
+	Transform string `json:"transform,omitempty"`
+
+	steps []transformStep
+}
+
+// ImportMappingStore manages our in-memory import mappings
+type ImportMappingStore struct {
+	mu       sync.RWMutex
+	mappings map[string]ImportMapping
+}
+
+// Global import mapping store
+var importMappings = &ImportMappingStore{
+	mappings: make(map[string]ImportMapping),
+}
+
+// lookup returns a mapping by name
+func (s *ImportMappingStore) lookup(name string) (ImportMapping, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	m, exists := s.mappings[name]
+	return m, exists
+}
+
+// transformStep is one function of a transform expression
+type transformStep struct {
+	name string
+	args []string
+}
+
+// transformArgs is how many arguments each transform takes, -1 for any
+var transformArgs = map[string]int{
+	"trim":    0,
+	"upper":   0,
+	"lower":   0,
+	"cents":   0,
+	"prefix":  1,
+	"suffix":  1,
+	"replace": 2,
+	"scale":   1,
+	"map":     -1,
+}
+
+// parseTransform parses an expression such as
+// "trim | upper | replace(-,_) | map(EL=Electronics,HG=Home)". cents turns
+// integer cents into a decimal amount, scale(1.2) multiplies a number and
+// map swaps listed values, leaving others as they are.
+func parseTransform(expr string) ([]transformStep, error) {
+	var steps []transformStep
+	for _, part := range strings.Split(expr, "|") {
+		part = strings.TrimSpace(part)
+		step := transformStep{name: part}
+		if open := strings.Index(part, "("); open >= 0 {
+			if !strings.HasSuffix(part, ")") {
+				return nil, fmt.Errorf("missing ) in %q", part)
+			}
+			step.name = strings.TrimSpace(part[:open])
+			step.args = strings.Split(part[open+1:len(part)-1], ",")
+		}
+		want, known := transformArgs[step.name]
+		switch {
+		case !known:
+			return nil, fmt.Errorf("unknown transform %q", step.name)
+		case want >= 0 && len(step.args) != want:
+			return nil, fmt.Errorf("%s takes %d arguments", step.name, want)
+		}
+		switch step.name {
+		case "scale":
+			if _, err := strconv.ParseFloat(strings.TrimSpace(step.args[0]), 64); err != nil {
+				return nil, fmt.Errorf("scale takes a number, not %q", step.args[0])
+			}
+		case "map":
+			for _, pair := range step.args {
+				if !strings.Contains(pair, "=") {
+					return nil, fmt.Errorf("map takes from=to pairs, not %q", pair)
+				}
+			}
+		}
+		steps = append(steps, step)
+	}
+	return steps, nil
+}
+
+// applyTransform runs a parsed expression over a value
+func applyTransform(steps []transformStep, value string) (string, error) {
+	for _, step := range steps {
+		switch step.name {
+		case "trim":
+			value = strings.TrimSpace(value)
+		case "upper":
+			value = strings.ToUpper(value)
+		case "lower":
+			value = strings.ToLower(value)
+		case "prefix":
+			value = step.args[0] + value
+		case "suffix":
+			value += step.args[0]
+		case "replace":
+			value = strings.ReplaceAll(value, step.args[0], step.args[1])
+		case "cents":
+			cents, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+			if err != nil {
+				return "", fmt.Errorf("cents: %q is not a whole number", value)
+			}
+			value = Money(cents).String()
+		case "scale":
+			n, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			if err != nil {
+				return "", fmt.Errorf("scale: %q is not a number", value)
+			}
+			factor, _ := strconv.ParseFloat(strings.TrimSpace(step.args[0]), 64)
+			value = strconv.FormatFloat(math.Round(n*factor*100)/100, 'f', -1, 64)
+		case "map":
+			for _, pair := range step.args {
+				from, to, _ := strings.Cut(pair, "=")
+				if strings.EqualFold(strings.TrimSpace(from), strings.TrimSpace(value)) {
+					value = strings.TrimSpace(to)
+					break
+				}
+			}
+		}
+	}
+	return value, nil
+}
+
+// mappingViolations normalizes a mapping and returns everything wrong with it
+func mappingViolations(m *ImportMapping) []Violation {
+	var violations []Violation
+	add := func(code, field, message string) {
+		violations = append(violations, Violation{Code: code, Field: field, Message: message})
+	}
+
+	m.Format = strings.ToLower(strings.TrimSpace(m.Format))
+	switch m.Format {
+	case mappingCSV:
+		if m.Delimiter != "" && utf8.RuneCountInString(m.Delimiter) != 1 {
+			add(violationInvalid, "delimiter", "Must be a single character")
+		}
+	case mappingXML:
+		if m.RecordElement = strings.TrimSpace(m.RecordElement); m.RecordElement == "" {
+			add(violationRequired, "record_element", "Is required for XML")
+		}
+	case "":
+		add(violationRequired, "format", "Is required")
+	default:
+		add(violationInvalid, "format", "Must be csv or xml")
+	}
+
+	if len(m.Fields) == 0 {
+		add(violationRequired, "fields", "Is required")
+	}
+	seen := make(map[string]bool, len(m.Fields))
+	for i := range m.Fields {
+		f := &m.Fields[i]
+		prefix := fmt.Sprintf("fields[%d]", i)
+		f.Field, f.Column = strings.TrimSpace(f.Field), strings.TrimSpace(f.Column)
+		switch {
+		case f.Field == "":
+			add(violationRequired, prefix+".field", "Is required")
+		case !slices.Contains(mappableFields, f.Field):
+			add(violationInvalid, prefix+".field", "Must be one of "+strings.Join(mappableFields, ", "))
+		case seen[f.Field]:
+			add(violationDuplicate, prefix+".field", fmt.Sprintf("%s is mapped twice", f.Field))
+		}
+		seen[f.Field] = true
+		if f.Column == "" && f.Default == "" {
+			add(violationRequired, prefix+".column", "A column or a default is required")
+		}
+		if f.Transform != "" {
+			steps, err := parseTransform(f.Transform)
+			if err != nil {
+				add(violationInvalid, prefix+".transform", err.Error())
+			}
+			f.steps = steps
+		}
+	}
+	if len(m.Fields) > 0 && !seen["id"] {
+		add(violationRequired, "fields", "id must be mapped")
+	}
+	return violations
+}
+
+// mappingError is a record the mapping couldn't turn into a product. The
+// import goes on with the next record.
+type mappingError struct{ msg string }
+
+func (e mappingError) Error() string { return e.msg }
+
+// product builds a product from the values of one record, looked up by
+// column
+func (m ImportMapping) product(value func(column string) string) (Product, error) {
+	var p Product
+	for _, f := range m.Fields {
+		v := ""
+		if f.Column != "" {
+			v = value(f.Column)
+		}
+		if v != "" && f.steps != nil {
+			var err error
+			if v, err = applyTransform(f.steps, v); err != nil {
+				return p, mappingError{f.Field + ": " + err.Error()}
+			}
+		}
+		if strings.TrimSpace(v) == "" {
+			v = f.Default
+		}
+		if v == "" {
+			continue
+		}
+
+		switch f.Field {
+		case "id":
+			p.ID = v
+		case "name":
+			p.Name = v
+		case "description":
+			p.Description = v
+		case "category":
+			p.Category = v
+		case "currency":
+			p.Currency = v
+		case "sku":
+			p.SKU = v
+		case "gtin":
+			p.GTIN = v
+		case "images":
+			for _, image := range strings.Split(v, ";") {
+				if image = strings.TrimSpace(image); image != "" {
+					p.Images = append(p.Images, image)
+				}
+			}
+		case "price":
+			price, err := parseMoney(strings.TrimSpace(v))
+			if err != nil {
+				return p, mappingError{fmt.Sprintf("price: %q is not an amount", v)}
+			}
+			p.Price = price
+		case "stock", "low_stock_threshold", "weight_grams":
+			n, err := strconv.Atoi(strings.TrimSpace(v))
+			if err != nil {
+				return p, mappingError{fmt.Sprintf("%s: %q is not a whole number", f.Field, v)}
+			}
+			switch f.Field {
+			case "stock":
+				p.Stock = n
+			case "weight_grams":
+				p.WeightGrams = n
+			default:
+				p.LowStockThreshold = &n
+			}
+		}
+	}
+	return p, nil
+}
+
+// newDecoder reads a partner feed as products
+func (m ImportMapping) newDecoder(r io.Reader) RecordDecoder {
+	if m.Format == mappingXML {
+		return &xmlMappingDecoder{mapping: m, dec: xml.NewDecoder(r)}
+	}
+	cr := csv.NewReader(r)
+	if m.Delimiter != "" {
+		cr.Comma, _ = utf8.DecodeRuneInString(m.Delimiter)
+	}
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+	cr.ReuseRecord = true
+	return &csvMappingDecoder{mapping: m, r: cr}
+}
+
+// mappingResumable reports whether a mapped import can go on after err:
+// only a record that didn't map is skipped, malformed CSV or XML aborts
+func mappingResumable(err error) bool {
+	var mapErr mappingError
+	return errors.As(err, &mapErr)
+}
+
+// csvMappingDecoder reads a CSV feed with a header row
+type csvMappingDecoder struct {
+	mapping ImportMapping
+	r       *csv.Reader
+	columns map[string]int // lower-cased header -> index
+}
+
+func (d *csvMappingDecoder) Decode(v any) error {
+	if d.columns == nil {
+		header, err := d.r.Read()
+		if err != nil {
+			return err
+		}
+		d.columns = make(map[string]int, len(header))
+		for i, name := range header {
+			d.columns[strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))] = i
+		}
+		for _, f := range d.mapping.Fields {
+			if _, exists := d.columns[strings.ToLower(f.Column)]; f.Column != "" && f.Default == "" && !exists {
+				return fmt.Errorf("column %q of %s is not in the header", f.Column, f.Field)
+			}
+		}
+	}
+
+	row, err := d.r.Read()
+	if err != nil {
+		return err
+	}
+	p, err := d.mapping.product(func(column string) string {
+		if i, exists := d.columns[strings.ToLower(column)]; exists && i < len(row) {
+			return row[i]
+		}
+		return ""
+	})
+	*v.(*Product) = p
+	return err
+}
+
+// xmlNode is an element of an XML record, kept whole so fields can be
+// looked up by path
+type xmlNode struct {
+	XMLName  xml.Name
+	Attrs    []xml.Attr `xml:",any,attr"`
+	Text     string     `xml:",chardata"`
+	Children []xmlNode  `xml:",any"`
+}
+
+// lookup returns the text at a path such as "pricing/list" or "@sku"
+func (n *xmlNode) lookup(path string) string {
+	node := n
+	for _, part := range strings.Split(path, "/") {
+		if attr, ok := strings.CutPrefix(part, "@"); ok {
+			for _, a := range node.Attrs {
+				if a.Name.Local == attr {
+					return a.Value
+				}
+			}
+			return ""
+		}
+		var next *xmlNode
+		for i := range node.Children {
+			if node.Children[i].XMLName.Local == part {
+				next = &node.Children[i]
+				break
+			}
+		}
+		if next == nil {
+			return ""
+		}
+		node = next
+	}
+	return strings.TrimSpace(node.Text)
+}
+
+// xmlMappingDecoder reads every RecordElement of an XML feed, wherever it
+// is in the document
+type xmlMappingDecoder struct {
+	mapping ImportMapping
+	dec     *xml.Decoder
+}
+
+func (d *xmlMappingDecoder) Decode(v any) error {
+	for {
+		tok, err := d.dec.Token()
+		if err != nil {
+			return err
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok || start.Name.Local != d.mapping.RecordElement {
+			continue
+		}
+		var node xmlNode
+		if err := d.dec.DecodeElement(&node, &start); err != nil {
+			return err
+		}
+		p, err := d.mapping.product(node.lookup)
+		*v.(*Product) = p
+		return err
+	}
+}
+
+// getImportMappings returns all import mappings
+// Returns: 200 OK - Success
+func getImportMappings(c *gin.Context) {
+	importMappings.mu.RLock()
+	list := make([]ImportMapping, 0, len(importMappings.mappings))
+	for _, m := range importMappings.mappings {
+		list = append(list, m)
+	}
+	importMappings.mu.RUnlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+
+	c.JSON(http.StatusOK, gin.H{
+		"count":    len(list),
+		"mappings": list,
+	})
+}
+
+// getImportMapping returns a single import mapping
+// Returns: 200 OK - Found
+// Returns: 404 Not Found - Mapping doesn't exist
+func getImportMapping(c *gin.Context) {
+	m, exists := importMappings.lookup(c.Param("name"))
+	if !exists {
+		importMappingNotFound(c, c.Param("name"))
+		return
+	}
+	c.JSON(http.StatusOK, m)
+}
+
+// putImportMapping creates or replaces an import mapping
+// Returns: 200 OK - Replaced
+// Returns: 201 Created - Created (Cat learning a new language!)
+// Returns: 400 Bad Request - Invalid mapping, problem+json
+func putImportMapping(c *gin.Context) {
+	name := c.Param("name")
+	var m ImportMapping
+	if violations := bindStrict(c, &m); len(violations) > 0 {
+		invalidRequest(c, "Invalid import mapping", violations)
+		return
+	}
+	violations := mappingViolations(&m)
+	switch {
+	case !mappingName.MatchString(name):
+		violations = append([]Violation{{Code: violationInvalid, Field: "name", Message: "Must be 1 to 64 letters, digits, - or _"}}, violations...)
+	case m.Name != "" && m.Name != name:
+		violations = append([]Violation{{Code: violationMismatch, Field: "name", Message: "Must match the name in the URL"}}, violations...)
+	}
+	if len(violations) > 0 {
+		invalidRequest(c, "Invalid import mapping", violations)
+		return
+	}
+	m.Name = name
+	m.UpdatedAt = time.Now().UTC()
+
+	importMappings.mu.Lock()
+	_, replaced := importMappings.mappings[name]
+	importMappings.mappings[name] = m
+	importMappings.mu.Unlock()
+
+	if replaced {
+		c.JSON(http.StatusOK, m)
+		return
+	}
+	c.JSON(http.StatusCreated, m)
+}
+
+// deleteImportMapping removes an import mapping
+// Returns: 204 No Content - Success
+// Returns: 404 Not Found - Mapping doesn't exist
+func deleteImportMapping(c *gin.Context) {
+	name := c.Param("name")
+
+	importMappings.mu.Lock()
+	defer importMappings.mu.Unlock()
+
+	if _, exists := importMappings.mappings[name]; !exists {
+		importMappingNotFound(c, name)
+		return
+	}
+	delete(importMappings.mappings, name)
+
+	c.Status(http.StatusNoContent)
+}
+
+// importMappingNotFound writes the standard 404 response for a missing
+// mapping
+func importMappingNotFound(c *gin.Context, name string) {
+	c.JSON(http.StatusNotFound, gin.H{
+		"error": "Import mapping not found",
+		"name":  name,
+	})
+}
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Stock reason codes. Clients adjust stock with the first five; the rest
+// are written by the server for stock that arrives some other way.
+const (
+	reasonRestock    = "restock"
+	reasonSale       = "sale"
+	reasonReturn     = "return"
+	reasonDamage     = "damage"
+	reasonCorrection = "correction"
+	reasonReceipt    = "receipt" // POST /products/:id/receipts
+	reasonOpening    = "opening" // stock a product or variant was created with
+	reasonSet        = "set"     // an absolute write, with STOCK_LEDGER_ONLY=false
+)
+
+// stockLedgerOnly turns absolute stock writes of existing products into
+// 400s, so every change after creation goes through an adjustment with a
+// reason. STOCK_LEDGER_ONLY=false lets them through as set entries.
+var stockLedgerOnly = os.Getenv("STOCK_LEDGER_ONLY") != "false"
+
+// StockEntry is one change in the stock ledger. Balance is the stock of
+// the product, or of its variant SKU, after the change, and Version the
+// product version it was written in, which its audit entry shares.
+type StockEntry struct {
+	ID        int64     `json:"id"`
+	ProductID string    `json:"product_id"`
+	SKU       string    `json:"sku,omitempty"`
+	Delta     int       `json:"delta"`
+	Balance   int       `json:"balance"`
+	Reason    string    `json:"reason"`
+	Note      string    `json:"note,omitempty"`
+	Actor     string    `json:"actor,omitempty"`
+	RequestID string    `json:"request_id,omitempty"`
+	Version   int64     `json:"version"`
+	At        time.Time `json:"at"`
+
+	key string // the product's key
+}
+
+// StockLedger is our append-only record of stock changes, and the stock
+// of a product is the balance of its entries. A write that changes stock
+// logs the entries that add up to it in its WAL record, so the ledger is
+// replayed, replicated and snapshotted along with the products.
+type StockLedger struct {
+	mu       sync.Mutex
+	seq      int64
+	entries  map[string][]StockEntry
+	balances map[string]map[string]int // product key -> SKU ("" without variants) -> stock
+}
+
+// LedgeredProduct is a product as it's persisted, in WAL and Raft
+// snapshots and STORE_FILE, with its stock ledger
+type LedgeredProduct struct {
+	Product
+	StockLedger []StockEntry `json:"stock_ledger,omitempty"`
+}
+
+// Global stock ledger
+var stockLedger = newStockLedger()
+
+func newStockLedger() *StockLedger {
+	return &StockLedger{
+		entries:  make(map[string][]StockEntry),
+		balances: make(map[string]map[string]int),
+	}
+}
+
+// stockLevels returns the stock of a product by SKU, or under "" when it
+// has no variants
+func stockLevels(p *Product) map[string]int {
+	if len(p.Variants) == 0 {
+		return map[string]int{"": p.Stock}
+	}
+	levels := make(map[string]int, len(p.Variants))
+	for _, v := range p.Variants {
+		levels[v.SKU] = v.Stock
+	}
+	return levels
+}
+
+// stockChanged reports whether a write changes any stock level; a SKU
+// that isn't there has none
+func stockChanged(before, after *Product) bool {
+	old, levels := stockLevels(before), stockLevels(after)
+	for sku, stock := range levels {
+		if old[sku] != stock {
+			return true
+		}
+	}
+	for sku, stock := range old {
+		if _, exists := levels[sku]; !exists && stock != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// stockWriteViolations rejects an absolute stock write, unless
+// STOCK_LEDGER_ONLY=false
+func stockWriteViolations(before, after *Product) []Violation {
+	if !stockLedgerOnly || !stockChanged(before, after) {
+		return nil
+	}
+	return []Violation{{Code: violationInvalid, Field: "stock", Message: "Is changed with POST /products/{id}/stock-adjustments"}}
+}
+
+// stockEntry returns a change an actor is about to save with store.save,
+// which gives it its ID and balance
+func stockEntry(c *gin.Context, p *Product, sku string, delta int, reason, note string) StockEntry {
+	entry := StockEntry{ProductID: p.ID, SKU: sku, Delta: delta, Reason: reason, Note: note}
+	if c != nil {
+		entry.Actor = actor(c)
+		entry.RequestID = c.GetString(requestIDKey)
+	}
+	return entry
+}
+
+// changes returns the entries a write of p logs: the staged ones, then an
+// opening entry for stock the ledger hasn't seen and a set entry for
+// stock written outright, so the balances add up to p's stock. Variants
+// that are gone are set to 0. Callers must hold store.mu until the write
+// is applied, so the IDs given here are still the next ones.
+func (s *StockLedger) changes(p *Product, staged []StockEntry) []StockEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	balances := maps.Clone(s.balances[p.key()])
+	if balances == nil {
+		balances = make(map[string]int)
+	}
+	seq, now := s.seq, time.Now().UTC()
+	var entries []StockEntry
+	add := func(entry StockEntry) {
+		seq++
+		entry.ID, entry.ProductID, entry.Version, entry.At = seq, p.ID, p.Version, now
+		balances[entry.SKU] += entry.Delta
+		entry.Balance = balances[entry.SKU]
+		entries = append(entries, entry)
+	}
+	for _, entry := range staged {
+		add(entry)
+	}
+
+	levels := stockLevels(p)
+	skus := slices.Collect(maps.Keys(levels))
+	for sku := range balances {
+		if _, exists := levels[sku]; !exists {
+			skus = append(skus, sku)
+		}
+	}
+	sort.Strings(skus)
+	for _, sku := range skus {
+		balance, seen := balances[sku]
+		if stock := levels[sku]; stock != balance {
+			reason := reasonSet
+			if !seen {
+				reason = reasonOpening
+			}
+			add(StockEntry{SKU: sku, Delta: stock - balance, Reason: reason})
+		}
+	}
+	return entries
+}
+
+// apply appends the entries a write of p logged, and makes the ledger's
+// SKUs those of p. Records logged before entries were have none, and get
+// theirs from changes.
+func (s *StockLedger) apply(p *Product, entries []StockEntry) {
+	if entries == nil {
+		entries = s.changes(p, nil)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := p.key()
+	balances := s.balances[key]
+	if balances == nil {
+		balances = make(map[string]int)
+		s.balances[key] = balances
+	}
+	for _, entry := range entries {
+		entry.key = key
+		s.entries[key] = append(s.entries[key], entry)
+		balances[entry.SKU] = entry.Balance
+		s.seq = max(s.seq, entry.ID)
+	}
+	levels := stockLevels(p)
+	for sku := range balances {
+		if _, exists := levels[sku]; !exists {
+			delete(balances, sku)
+		}
+	}
+	for sku := range levels {
+		if _, seen := balances[sku]; !seen {
+			balances[sku] = 0
+		}
+	}
+}
+
+// restore replaces the ledger with persisted entries, by product key, and
+// opens or sets the stock of products they don't add up to, such as those
+// persisted before the ledger was. Callers must hold store.mu.
+func (s *StockLedger) restore(products map[string]Product, ledgers map[string][]StockEntry) {
+	s.mu.Lock()
+	s.seq = 0
+	s.entries = make(map[string][]StockEntry, len(ledgers))
+	s.balances = make(map[string]map[string]int, len(ledgers))
+	for key, entries := range ledgers {
+		balances := make(map[string]int)
+		for i := range entries {
+			entries[i].key = key
+			balances[entries[i].SKU] = entries[i].Balance
+			s.seq = max(s.seq, entries[i].ID)
+		}
+		s.entries[key] = entries
+		s.balances[key] = balances
+	}
+	s.mu.Unlock()
+
+	for _, p := range products {
+		s.apply(&p, nil)
+	}
+}
+
+// ledgered attaches its ledger to a product, for persisting it. Callers
+// must hold store.mu.
+func (s *StockLedger) ledgered(p Product) LedgeredProduct {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return LedgeredProduct{Product: p, StockLedger: s.entries[p.key()]}
+}
+
+// splitLedgers splits persisted products into the catalog and their
+// ledgers, by product key
+func splitLedgers(persisted []LedgeredProduct) (map[string]Product, map[string][]StockEntry) {
+	products := make(map[string]Product, len(persisted))
+	ledgers := make(map[string][]StockEntry)
+	for _, p := range persisted {
+		products[p.key()] = p.Product
+		if len(p.StockLedger) > 0 {
+			ledgers[p.key()] = p.StockLedger
+		}
+	}
+	return products, ledgers
+}
+
+// last returns the last entry of a product, such as the adjustment its
+// save just logged
+func (s *StockLedger) last(key string) StockEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries := s.entries[key]
+	if len(entries) == 0 {
+		return StockEntry{}
+	}
+	return entries[len(entries)-1]
+}
+
+// removeProduct forgets the ledger of a purged product
+func (s *StockLedger) removeProduct(productID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.entries, productID)
+	delete(s.balances, productID)
+}
+
+// adjustStock applies a stock adjustment to a product and records it in
+// the ledger, writing the error response when it can't. Callers must
+// hold store.mu.
+func adjustStock(c *gin.Context, id string, adj StockAdjustment) (Product, StockEntry, bool) {
+	product, exists := store.get(tenantKey(c, id))
+	if !exists {
+		productNotFound(c, id)
+		return Product{}, StockEntry{}, false
+	}
+
+	before := product
+	if len(product.Variants) > 0 {
+		if adj.SKU == "" {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error":   "Invalid stock adjustment",
+				"details": "Product has variants, sku is required",
+			})
+			return Product{}, StockEntry{}, false
+		}
+		i := product.variantIndex(adj.SKU)
+		if i < 0 {
+			variantNotFound(c, id, adj.SKU)
+			return Product{}, StockEntry{}, false
+		}
+		if product.Variants[i].Stock+adj.Delta < 0 {
+			c.JSON(http.StatusConflict, gin.H{
+				"error": "Insufficient stock",
+				"id":    id,
+				"sku":   adj.SKU,
+				"stock": product.Variants[i].Stock,
+			})
+			return Product{}, StockEntry{}, false
+		}
+		product.Variants = append([]Variant(nil), product.Variants...)
+		product.Variants[i].Stock += adj.Delta
+	} else {
+		if adj.SKU != "" {
+			variantNotFound(c, id, adj.SKU)
+			return Product{}, StockEntry{}, false
+		}
+		if product.Stock+adj.Delta < 0 {
+			c.JSON(http.StatusConflict, gin.H{
+				"error": "Insufficient stock",
+				"id":    id,
+				"stock": product.Stock,
+			})
+			return Product{}, StockEntry{}, false
+		}
+		product.Stock += adj.Delta
+	}
+
+	if adj.Reason == "" {
+		adj.Reason = reasonCorrection
+	}
+	if err := store.save(&product, stockEntry(c, &product, adj.SKU, adj.Delta, adj.Reason, adj.Note)); err != nil {
+		writeFailed(c, err)
+		return Product{}, StockEntry{}, false
+	}
+	audit.record(c, "stock.adjust", &before, &product)
+	return product, stockLedger.last(product.key()), true
+}
+
+// createStockAdjustment changes stock by a delta with a reason code, such
+// as +5 restock or -3 sale, and appends it to the ledger. Deltas add up
+// under the store lock, so concurrent restocks and sales never overwrite
+// each other.
+// Returns: 201 Created - Adjustment and product (Cat counting boxes!)
+// Returns: 400 Bad Request - Invalid input, missing reason or SKU
+// Returns: 404 Not Found - Product or variant doesn't exist
+// Returns: 409 Conflict - Not enough stock
+func createStockAdjustment(c *gin.Context) {
+	id := c.Param("id")
+
+	var adj StockAdjustment
+	if err := c.ShouldBindJSON(&adj); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":   "Invalid stock adjustment",
+			"details": err.Error(),
+		})
+		return
+	}
+	if adj.Reason == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":   "Invalid stock adjustment",
+			"details": "reason is required: restock, sale, return, damage or correction",
+		})
+		return
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	product, entry, ok := adjustStock(c, id, adj)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{
+		"message":    "Stock adjusted successfully",
+		"adjustment": entry,
+		"product":    product,
+	})
+}
+
+// getStockAdjustments lists the ledger of a product, newest first, of a
+// ?sku= if given, with the balance it adds up to
+// Returns: 200 OK - Success
+// Returns: 404 Not Found - Product doesn't exist
+func getStockAdjustments(c *gin.Context) {
+	id := c.Param("id")
+	sku, filtered := c.GetQuery("sku")
+
+	key := tenantKey(c, id)
+	store.mu.RLock()
+	_, exists := store.products[key]
+	store.mu.RUnlock()
+	if !exists {
+		productNotFound(c, id)
+		return
+	}
+
+	stockLedger.mu.Lock()
+	list := []StockEntry{}
+	balance := 0
+	for _, entry := range stockLedger.entries[key] {
+		if !filtered || entry.SKU == sku {
+			list = append(list, entry)
+			balance += entry.Delta
+		}
+	}
+	stockLedger.mu.Unlock()
+	slices.Reverse(list)
+
+	c.JSON(http.StatusOK, gin.H{
+		"count":       len(list),
+		"balance":     balance,
+		"adjustments": list,
+	})
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const crate = `{"id": "crate", "name": "Crate", "description": "Wooden crate", "category": "storage", "price": "5.00", "currency": "USD", "stock": 5}`
+
+func TestAbsoluteStockWritesRejected(t *testing.T) {
+	router := newTestRouter(t)
+	mustCreate(t, router, crate)
+
+	tests := []struct {
+		name, method, path, body string
+		status                   int
+	}{
+		{"PUT", "PUT", "/v1/products/crate", `{"id": "crate", "name": "Crate", "description": "Wooden crate", "category": "storage", "price": "5.00", "currency": "USD", "stock": 9}`, http.StatusBadRequest},
+		{"PATCH", "PATCH", "/v1/products/crate", `{"stock": 9}`, http.StatusBadRequest},
+		{"adjustment", "POST", "/v1/products/crate/stock-adjustments", `{"delta": 4, "reason": "restock"}`, http.StatusCreated},
+		{"PATCH without stock", "PATCH", "/v1/products/crate", `{"name": "Big crate"}`, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(router, tt.method, tt.path, tt.body, append(asAdmin, "If-Match", productETag(store.products["crate"]))...)
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+		})
+	}
+	if stock := store.products["crate"].Stock; stock != 9 {
+		t.Errorf("stock = %d, want 9", stock)
+	}
+}
+
+func TestStockLedgerPersisted(t *testing.T) {
+	tests := []struct {
+		name    string
+		open    func(dir string) error
+		persist func() error
+	}{
+		{
+			"WAL",
+			func(dir string) error { return store.recoverFromWAL(dir) },
+			func() error { return store.wal.file.Close() },
+		},
+		{
+			"store file",
+			func(dir string) error { return store.loadStoreFile(filepath.Join(dir, "products.json")) },
+			func() error { return store.file.save() },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router := newTestRouter(t)
+			dir := t.TempDir()
+			if err := tt.open(dir); err != nil {
+				t.Fatal(err)
+			}
+			mustCreate(t, router, crate)
+			if w := serve(router, "POST", "/v1/products/crate/stock-adjustments", `{"delta": -2, "reason": "damage", "note": "dropped"}`, asAdmin...); w.Code != http.StatusCreated {
+				t.Fatalf("adjust: %d %s", w.Code, w.Body)
+			}
+			want := serve(router, "GET", "/v1/products/crate/stock-adjustments", "", asAdmin...).Body.String()
+
+			// Restarting twice reads the WAL back from the log, then from
+			// the snapshot its recovery compacted it into
+			for restart := 1; restart <= 2; restart++ {
+				if err := tt.persist(); err != nil {
+					t.Fatal(err)
+				}
+				store = &ProductStore{products: make(map[string]Product), removed: time.Now().UTC()}
+				stockLedger = newStockLedger()
+				if err := tt.open(dir); err != nil {
+					t.Fatal(err)
+				}
+				if got := serve(router, "GET", "/v1/products/crate/stock-adjustments", "", asAdmin...).Body.String(); got != want {
+					t.Errorf("restart %d: ledger =\n%s\nwant\n%s", restart, got, want)
+				}
+			}
+
+			// The next adjustment carries on from the restored ledger
+			w := serve(router, "POST", "/v1/products/crate/stock-adjustments", `{"delta": 1, "reason": "return"}`, asAdmin...)
+			var body struct{ Adjustment StockEntry }
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			if body.Adjustment.ID != 3 || body.Adjustment.Balance != 4 {
+				t.Errorf("adjustment = %+v, want ID 3 and balance 4", body.Adjustment)
+			}
+		})
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Request limits. MAX_BODY_BYTES (default 1 MiB) caps request bodies,
+// except imports, which are streamed and never held in memory.
+// MAX_JSON_DEPTH (default 32) caps how deeply JSON bodies nest; a product
+// needs 4.
+var (
+	maxBodyBytes = int64(envInt("MAX_BODY_BYTES", 1<<20))
+	maxJSONDepth = envInt("MAX_JSON_DEPTH", 32)
+)
+
+// maxPrice is the highest price a product or variant can have, MAX_PRICE
+// (default 1000000.00), so a typo can't list a product at a billion
+var maxPrice = newMaxPrice()
+
+func newMaxPrice() Money {
+	raw := os.Getenv("MAX_PRICE")
+	if raw == "" {
+		return 1000000_00
+	}
+	amount, err := parseMoney(raw)
+	if err != nil || amount <= 0 {
+		log.Printf("invalid MAX_PRICE=%q, using 1000000.00", raw)
+		return 1000000_00
+	}
+	return amount
+}
+
+// limitRequestBodies rejects bodies over maxBodyBytes: at once when the
+// Content-Length says so, otherwise when the handler reads past the limit
+// and bindStrict reports it.
+// Returns: 413 Content Too Large - Body over MAX_BODY_BYTES
+func limitRequestBodies() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if maxBodyBytes <= 0 || c.Request.Body == nil || strings.HasSuffix(c.Request.URL.Path, "/admin/import") {
+			c.Next()
+			return
+		}
+		if c.Request.ContentLength > maxBodyBytes {
+			invalidRequest(c, "Request body too large", []Violation{bodyTooLarge()})
+			c.Abort()
+			return
+		}
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxBodyBytes)
+		c.Next()
+	}
+}
+
+// bodyTooLarge is the violation of a body over maxBodyBytes
+func bodyTooLarge() Violation {
+	return Violation{Code: violationTooLarge, Message: fmt.Sprintf("Request body must be at most %d bytes", maxBodyBytes)}
+}
+
+// isBodyTooLarge reports whether reading a body failed on the limit
+func isBodyTooLarge(err error) bool {
+	var maxErr *http.MaxBytesError
+	return errors.As(err, &maxErr)
+}
+
+// jsonDepth returns how deeply a JSON value nests objects and arrays,
+// stopping early once it's past limit. Brackets in strings don't count.
+func jsonDepth(data []byte, limit int) int {
+	depth, deepest := 0, 0
+	inString, escaped := false, false
+	for _, b := range data {
+		switch {
+		case escaped:
+			escaped = false
+		case inString:
+			switch b {
+			case '\\':
+				escaped = true
+			case '"':
+				inString = false
+			}
+		case b == '"':
+			inString = true
+		case b == '{' || b == '[':
+			depth++
+			if depth > deepest {
+				deepest = depth
+				if deepest > limit {
+					return deepest
+				}
+			}
+		case b == '}' || b == ']':
+			depth--
+		}
+	}
+	return deepest
+}
+
+// problemStatus is the status of a validation problem: 413 and 422 for
+// bodies too large or too deep to look at, 400 for everything else
+func problemStatus(violations []Violation) int {
+	switch violations[0].Code {
+	case violationTooLarge:
+		return http.StatusRequestEntityTooLarge
+	case violationTooDeep:
+		return http.StatusUnprocessableEntity
+	}
+	return http.StatusBadRequest
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxListIDs caps the ids of one ?id= list filter
+const maxListIDs = 100
+
+// Cache tags. A cached list is tagged with what it depends on, and a write
+// drops only the lists tagged with the product or categories it touched.
+// Tags are per tenant, as lists are.
+const (
+	// tagCatalog marks lists that any write to the tenant's catalog can
+	// change
+	tagCatalog = "catalog"
+)
+
+func catalogTag(tenant string) string {
+	return productKey(tenant, tagCatalog)
+}
+
+func productTag(key string) string {
+	return "product:" + key
+}
+
+func categoryTag(tenant, category string) string {
+	return "category:" + productKey(tenant, strings.ToLower(category))
+}
+
+// listQuery is a normalized product list filter: the same products asked
+// for in any order or case give the same query, and so share a cache entry
+type listQuery struct {
+	tenant   string   // only this tenant's products are listed
+	ids      []string // sorted, without duplicates
+	category string   // lower case
+	text     string   // lower case, matched against name and description
+}
+
+// parseListQuery reads ?id=1,2, ?category= and ?q= from a request, for
+// its tenant's products
+// Returns: 400 Bad Request - More than maxListIDs ids (Cat can't count that high!)
+func parseListQuery(c *gin.Context) (listQuery, bool) {
+	q := listQuery{
+		tenant:   tenantOf(c),
+		category: strings.ToLower(strings.TrimSpace(c.Query("category"))),
+		text:     strings.ToLower(strings.TrimSpace(c.Query("q"))),
+	}
+	for _, v := range c.QueryArray("id") {
+		for _, id := range strings.Split(v, ",") {
+			if id = strings.TrimSpace(id); id != "" {
+				q.ids = append(q.ids, id)
+			}
+		}
+	}
+	slices.Sort(q.ids)
+	q.ids = slices.Compact(q.ids)
+	if len(q.ids) > maxListIDs {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Too many ids", "max": maxListIDs})
+		return listQuery{}, false
+	}
+	return q, true
+}
+
+// key is the query's cache key; the default tenant's unfiltered list
+// keeps the plain key
+func (q listQuery) key() string {
+	values := url.Values{}
+	if q.tenant != "" {
+		values.Set("tenant", q.tenant)
+	}
+	if len(q.ids) > 0 {
+		values.Set("id", strings.Join(q.ids, ","))
+	}
+	if q.category != "" {
+		values.Set("category", q.category)
+	}
+	if q.text != "" {
+		values.Set("q", q.text)
+	}
+	if len(values) == 0 {
+		return listCacheKey
+	}
+	return listCacheKey + "?" + values.Encode()
+}
+
+func (q listQuery) matches(p Product) bool {
+	if p.Tenant != q.tenant {
+		return false
+	}
+	if q.category != "" && strings.ToLower(p.Category) != q.category {
+		return false
+	}
+	if q.text != "" && !strings.Contains(strings.ToLower(p.Name), q.text) && !strings.Contains(strings.ToLower(p.Description), q.text) {
+		return false
+	}
+	return true
+}
+
+// tags are what the query's result depends on. Only a write to one of the
+// requested ids can change an id query, and only a write to a product
+// that is, or was, in the category can change a category query, whether
+// it's in the result or joining or leaving it. Any write can change the
+// other lists.
+func (q listQuery) tags() []string {
+	switch {
+	case len(q.ids) > 0:
+		tags := make([]string, len(q.ids))
+		for i, id := range q.ids {
+			tags[i] = productTag(productKey(q.tenant, id))
+		}
+		return tags
+	case q.category != "":
+		return []string{categoryTag(q.tenant, q.category)}
+	}
+	return []string{catalogTag(q.tenant)}
+}
+
+// writeTags are the tags a write to a product invalidates, given its key
+// and the product before and after it; either may be nil
+func writeTags(key string, before, after *Product) []string {
+	tenant, _ := splitProductKey(key)
+	tags := []string{catalogTag(tenant), productTag(key)}
+	for _, p := range []*Product{before, after} {
+		if p != nil && !slices.Contains(tags, categoryTag(tenant, p.Category)) {
+			tags = append(tags, categoryTag(tenant, p.Category))
+		}
+	}
+	return tags
+}
+
+// run reads the query's products from the store. Callers must hold store.mu.
+func (q listQuery) run(products map[string]Product) []Product {
+	if len(q.ids) > 0 {
+		result := make([]Product, 0, len(q.ids))
+		for _, id := range q.ids {
+			if p, exists := products[productKey(q.tenant, id)]; exists && q.matches(p) {
+				result = append(result, p)
+			}
+		}
+		return result
+	}
+
+	result := make([]Product, 0, len(products))
+	for _, p := range products {
+		if q.matches(p) {
+			result = append(result, p)
+		}
+	}
+	return result
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"net/http"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// defaultLocale is the language of products' own name and description,
+// DEFAULT_LOCALE
+var defaultLocale = canonicalLocale(envString("DEFAULT_LOCALE", "en"))
+
+// maxTranslations caps the locales a product is translated into
+const maxTranslations = 50
+
+// localeTag matches a BCP 47 language tag: a language, then optional
+// script, region and variant subtags, such as fr, fr-CA or zh-Hant-TW
+var localeTag = regexp.MustCompile(`^[A-Za-z]{2,3}(-[A-Za-z0-9]{2,8})*$`)
+
+// Translation is a product's name and description in another language.
+// A field left empty falls back to the product's own.
+type Translation struct {
+	Name        string `json:"name,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+// canonicalLocale writes a tag in its usual case: fr-CA, zh-Hant-TW
+func canonicalLocale(tag string) string {
+	parts := strings.Split(strings.TrimSpace(tag), "-")
+	parts[0] = strings.ToLower(parts[0])
+	for i := 1; i < len(parts); i++ {
+		switch len(parts[i]) {
+		case 2:
+			parts[i] = strings.ToUpper(parts[i])
+		case 4:
+			parts[i] = strings.ToUpper(parts[i][:1]) + strings.ToLower(parts[i][1:])
+		default:
+			parts[i] = strings.ToLower(parts[i])
+		}
+	}
+	return strings.Join(parts, "-")
+}
+
+// translationViolations checks and normalizes a product's translations,
+// for productViolations
+func translationViolations(p *Product, violations *[]Violation) {
+	if len(p.Translations) > maxTranslations {
+		*violations = append(*violations, Violation{Code: violationOutOfRange, Field: "translations", Message: fmt.Sprintf("Must have at most %d locales", maxTranslations)})
+	}
+	if len(p.Translations) == 0 {
+		p.Translations = nil
+		return
+	}
+	normalized := make(map[string]Translation, len(p.Translations))
+	for _, tag := range slices.Sorted(maps.Keys(p.Translations)) {
+		t := p.Translations[tag]
+		prefix := "translations." + tag
+		locale := canonicalLocale(tag)
+		switch {
+		case !localeTag.MatchString(tag):
+			*violations = append(*violations, Violation{Code: violationInvalid, Field: prefix, Message: "Must be a BCP 47 language tag such as fr or fr-CA"})
+		case locale == defaultLocale:
+			*violations = append(*violations, Violation{Code: violationInvalid, Field: prefix, Message: "Is the default locale, set with name and description"})
+		case normalized[locale] != (Translation{}):
+			*violations = append(*violations, Violation{Code: violationDuplicate, Field: prefix, Message: "Another tag names the same locale"})
+		}
+		normalizeText(&t.Name, prefix+".name", maxNameLength, violations)
+		normalizeText(&t.Description, prefix+".description", maxDescriptionLength, violations)
+		if t == (Translation{}) {
+			*violations = append(*violations, Violation{Code: violationRequired, Field: prefix, Message: "Needs a name or a description"})
+		}
+		normalized[locale] = t
+	}
+	p.Translations = normalized
+}
+
+// acceptedLocales reads Accept-Language, most preferred first. Tags with
+// q=0 are left out.
+func acceptedLocales(header string) []string {
+	type weighted struct {
+		tag string
+		q   float64
+	}
+	var tags []weighted
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			parsed, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				continue
+			}
+			q = parsed
+		}
+		if tag = strings.TrimSpace(tag); tag == "" || q <= 0 || tag != "*" && !localeTag.MatchString(tag) {
+			continue
+		}
+		tags = append(tags, weighted{tag: canonicalLocale(tag), q: q})
+	}
+	sort.SliceStable(tags, func(i, j int) bool { return tags[i].q > tags[j].q })
+	locales := make([]string, len(tags))
+	for i, t := range tags {
+		locales[i] = t.tag
+	}
+	return locales
+}
+
+// bestLocale picks the locale of a product to show for a list of
+// preferences, falling back from fr-CA to fr as RFC 4647 lookup does, and
+// to the default locale when none of them is available
+func bestLocale(p Product, preferred []string) string {
+	for _, tag := range preferred {
+		if tag == "*" {
+			return defaultLocale
+		}
+		for candidate := tag; candidate != ""; {
+			if _, ok := p.Translations[candidate]; ok || candidate == defaultLocale {
+				return candidate
+			}
+			i := strings.LastIndex(candidate, "-")
+			if i < 0 {
+				break
+			}
+			candidate = candidate[:i]
+		}
+	}
+	return defaultLocale
+}
+
+// translateProducts shows products in the caller's language, from
+// Accept-Language, and sets Content-Language to the locales shown. The
+// translations themselves are only returned to admins, who manage them.
+func translateProducts(c *gin.Context, products []Product) []Product {
+	addVary(c, "Accept-Language")
+	preferred := acceptedLocales(c.GetHeader("Accept-Language"))
+	admin := isAdmin(c)
+
+	var shown []string
+	translated := make([]Product, len(products))
+	for i, p := range products {
+		locale := bestLocale(p, preferred)
+		if t, ok := p.Translations[locale]; ok {
+			if t.Name != "" {
+				p.Name = t.Name
+			}
+			if t.Description != "" {
+				p.Description = t.Description
+			}
+		}
+		if !admin {
+			p.Translations = nil
+		}
+		if !slices.Contains(shown, locale) {
+			shown = append(shown, locale)
+		}
+		translated[i] = p
+	}
+	if len(shown) == 0 {
+		shown = append(shown, defaultLocale)
+	}
+	c.Header("Content-Language", strings.Join(shown, ", "))
+	return translated
+}
+
+// localeParam reads the :locale of a translation route. It writes a 400
+// and returns false when it isn't a tag, or is the default locale.
+func localeParam(c *gin.Context) (string, bool) {
+	tag := c.Param("locale")
+	if !localeTag.MatchString(tag) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":  "Locale must be a BCP 47 language tag such as fr or fr-CA",
+			"locale": tag,
+		})
+		return "", false
+	}
+	locale := canonicalLocale(tag)
+	if locale == defaultLocale {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":  "The default locale is the product's own name and description",
+			"locale": locale,
+		})
+		return "", false
+	}
+	return locale, true
+}
+
+// getTranslations lists a product's translations
+// Returns: 200 OK - Success (Cat speaking every language!)
+// Returns: 401 Unauthorized - Admin access required
+// Returns: 404 Not Found - Product doesn't exist
+func getTranslations(c *gin.Context) {
+	id := c.Param("id")
+	store.mu.RLock()
+	product, exists := store.get(tenantKey(c, id))
+	store.mu.RUnlock()
+	if !exists {
+		productNotFound(c, id)
+		return
+	}
+	translations := product.Translations
+	if translations == nil {
+		translations = map[string]Translation{}
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"id":             product.ID,
+		"default_locale": defaultLocale,
+		"count":          len(translations),
+		"translations":   translations,
+	})
+}
+
+// putTranslation adds or replaces a product's translation into a locale
+// Returns: 200 OK - Saved, the product's translations
+// Returns: 400 Bad Request - Invalid locale or translation
+// Returns: 401 Unauthorized - Admin access required
+// Returns: 404 Not Found - Product doesn't exist
+func putTranslation(c *gin.Context) {
+	id := c.Param("id")
+	locale, ok := localeParam(c)
+	if !ok {
+		return
+	}
+	var t Translation
+	if violations := bindStrict(c, &t); violations != nil {
+		invalidRequest(c, "Invalid translation", violations)
+		return
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	product, exists := store.get(tenantKey(c, id))
+	if !exists {
+		productNotFound(c, id)
+		return
+	}
+	before := product
+	product = product.clone()
+	if product.Translations == nil {
+		product.Translations = make(map[string]Translation)
+	}
+	product.Translations[locale] = t
+	if violations := productViolations(&product); len(violations) > 0 {
+		invalidRequest(c, "Invalid translation", violations)
+		return
+	}
+	if err := store.save(&product); err != nil {
+		writeFailed(c, err)
+		return
+	}
+	audit.record(c, "translation.put", &before, &product)
+
+	c.JSON(http.StatusOK, gin.H{
+		"id":             product.ID,
+		"default_locale": defaultLocale,
+		"count":          len(product.Translations),
+		"translations":   product.Translations,
+	})
+}
+
+// deleteTranslation removes a product's translation into a locale, which
+// then falls back to the next best
+// Returns: 204 No Content - Deleted
+// Returns: 400 Bad Request - Invalid locale
+// Returns: 401 Unauthorized - Admin access required
+// Returns: 404 Not Found - Product or translation doesn't exist
+func deleteTranslation(c *gin.Context) {
+	id := c.Param("id")
+	locale, ok := localeParam(c)
+	if !ok {
+		return
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	product, exists := store.get(tenantKey(c, id))
+	if !exists {
+		productNotFound(c, id)
+		return
+	}
+	if _, ok := product.Translations[locale]; !ok {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error":  "Product has no translation into this locale",
+			"id":     id,
+			"locale": locale,
+		})
+		return
+	}
+	before := product
+	product = product.clone()
+	delete(product.Translations, locale)
+	if len(product.Translations) == 0 {
+		product.Translations = nil
+	}
+	if err := store.save(&product); err != nil {
+		writeFailed(c, err)
+		return
+	}
+	audit.record(c, "translation.delete", &before, &product)
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// CodeIndex maps the SKUs and barcodes of the catalog to the products
+// carrying them, so scanners can resolve a product without its ID. A
+// product without variants has its own SKU; one with variants has a SKU
+// per variant. Barcodes are GTINs, kept as GTIN-14 so a UPC-A scanned as
+// 12 digits finds the EAN-13 of the same item. Deleted products keep
+// their codes until they're purged, so they can still be restored. Codes
+// are unique within a tenant; tenants may use the same ones.
+type CodeIndex struct {
+	skus  map[tenantCode]string // to the product's key
+	gtins map[tenantCode]string
+}
+
+// tenantCode is a SKU or barcode of a tenant's catalog
+type tenantCode struct {
+	tenant, code string
+}
+
+// Global SKU and barcode index. Callers must hold store.mu.
+var codes = &CodeIndex{
+	skus:  make(map[tenantCode]string),
+	gtins: make(map[tenantCode]string),
+}
+
+// normalizeGTIN pads a GTIN-8, 12 or 13 to GTIN-14
+func normalizeGTIN(code string) string {
+	if len(code) >= 14 {
+		return code
+	}
+	return strings.Repeat("0", 14-len(code)) + code
+}
+
+// productCode is a SKU or barcode of a product and the field it's in
+type productCode struct {
+	field, sku, gtin string
+}
+
+// productCodes returns the SKUs and barcodes of a product
+func productCodes(p *Product) []productCode {
+	var list []productCode
+	if p.SKU != "" {
+		list = append(list, productCode{field: "sku", sku: p.SKU})
+	}
+	if p.GTIN != "" {
+		list = append(list, productCode{field: "gtin", gtin: normalizeGTIN(p.GTIN)})
+	}
+	for i, v := range p.Variants {
+		prefix := fmt.Sprintf("variants[%d]", i)
+		list = append(list, productCode{field: prefix + ".sku", sku: v.SKU})
+		if v.GTIN != "" {
+			list = append(list, productCode{field: prefix + ".gtin", gtin: normalizeGTIN(v.GTIN)})
+		}
+	}
+	return list
+}
+
+// update moves the codes of a product from before to after; either is nil
+// for creates and purges
+func (x *CodeIndex) update(before, after *Product) {
+	if before != nil {
+		for _, code := range productCodes(before) {
+			sku, gtin := tenantCode{before.Tenant, code.sku}, tenantCode{before.Tenant, code.gtin}
+			if code.sku != "" && x.skus[sku] == before.key() {
+				delete(x.skus, sku)
+			}
+			if code.gtin != "" && x.gtins[gtin] == before.key() {
+				delete(x.gtins, gtin)
+			}
+		}
+	}
+	if after != nil {
+		for _, code := range productCodes(after) {
+			if code.sku != "" {
+				x.skus[tenantCode{after.Tenant, code.sku}] = after.key()
+			}
+			if code.gtin != "" {
+				x.gtins[tenantCode{after.Tenant, code.gtin}] = after.key()
+			}
+		}
+	}
+}
+
+// rebuild indexes a whole catalog, after the store is replaced with one
+// recovered from disk or a Raft snapshot
+func (x *CodeIndex) rebuild(products map[string]Product) {
+	clear(x.skus)
+	clear(x.gtins)
+	for _, p := range products {
+		x.update(nil, &p)
+	}
+}
+
+// conflicts returns the SKUs and barcodes of p that another product of
+// its tenant has
+func (x *CodeIndex) conflicts(p *Product) []Violation {
+	var violations []Violation
+	for _, code := range productCodes(p) {
+		index, key := x.skus, tenantCode{p.Tenant, code.sku}
+		if code.gtin != "" {
+			index, key = x.gtins, tenantCode{p.Tenant, code.gtin}
+		}
+		if owner, taken := index[key]; taken && owner != p.key() {
+			_, id := splitProductKey(owner)
+			violations = append(violations, Violation{Code: violationDuplicate, Field: code.field, Message: "Is already used by product " + id})
+		}
+	}
+	return violations
+}
+
+// codeConflict writes the 409 response for codes another product has
+func codeConflict(c *gin.Context, violations []Violation) {
+	c.JSON(http.StatusConflict, gin.H{
+		"error":  "SKU or barcode is already used by another product",
+		"errors": violations,
+	})
+}
+
+// lookupResponse is a product found by one of its codes, with the variant
+// when the code is a variant's
+func lookupResponse(p Product, sku, gtin string) gin.H {
+	response := gin.H{"product": p}
+	for _, v := range p.Variants {
+		if v.SKU == sku || gtin != "" && v.GTIN != "" && normalizeGTIN(v.GTIN) == gtin {
+			response["variant"] = variantResponse(p, v)
+		}
+	}
+	return response
+}
+
+// findByCode writes the tenant's product holding a code in index, asking
+// the other shards when sharding is on and it isn't local. It returns
+// false when no product has it.
+func findByCode(c *gin.Context, index map[tenantCode]string, code, sku, gtin string) bool {
+	store.mu.RLock()
+	key, found := index[tenantCode{tenantOf(c), code}]
+	product, exists := store.get(key)
+	store.mu.RUnlock()
+
+	if exists {
+		exists = shownTo(c, product)
+	}
+	if found && exists {
+		c.JSON(http.StatusOK, lookupResponse(product, sku, gtin))
+		return true
+	}
+	if cluster != nil {
+		if body, ok := cluster.findProduct(c); ok {
+			c.Data(http.StatusOK, "application/json; charset=utf-8", body)
+			return true
+		}
+	}
+	return false
+}
+
+// getProductBySKU finds the product, or the variant, with a SKU
+// Returns: 200 OK - Product, and variant when the SKU is a variant's (Cat with a scanner!)
+// Returns: 404 Not Found - No product has the SKU
+func getProductBySKU(c *gin.Context) {
+	sku := strings.TrimSpace(c.Param("sku"))
+	if !findByCode(c, codes.skus, sku, sku, "") {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No product has this SKU", "sku": sku})
+	}
+}
+
+// getProductByBarcode finds the product, or the variant, with a GTIN
+// (EAN or UPC) barcode
+// Returns: 200 OK - Product, and variant when the barcode is a variant's
+// Returns: 400 Bad Request - Not a valid GTIN
+// Returns: 404 Not Found - No product has the barcode
+func getProductByBarcode(c *gin.Context) {
+	code := strings.TrimSpace(c.Param("code"))
+	if !validGTIN(code) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Barcode must be a GTIN-8, 12, 13 or 14 with a valid check digit",
+			"code":  code,
+		})
+		return
+	}
+	gtin := normalizeGTIN(code)
+	if !findByCode(c, codes.gtins, gtin, "", gtin) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No product has this barcode", "code": code})
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// globalLowStockThreshold applies to products without their own
+// threshold, LOW_STOCK_THRESHOLD. 0 disables alerts for those products.
+var globalLowStockThreshold = envInt("LOW_STOCK_THRESHOLD", 0)
+
+var (
+	lowStockAlertsSent    = expvar.NewInt("low_stock_alerts_sent")
+	lowStockAlertsFailed  = expvar.NewInt("low_stock_alerts_failed")
+	lowStockAlertsDropped = expvar.NewInt("low_stock_alerts_dropped")
+)
+
+// lowStockThreshold returns the threshold that applies to a product
+func (p *Product) lowStockThreshold() int {
+	if p.LowStockThreshold != nil {
+		return *p.LowStockThreshold
+	}
+	return globalLowStockThreshold
+}
+
+// isLowStock reports whether a live product is below its threshold
+func (p *Product) isLowStock() bool {
+	return p.DeletedAt == nil && p.Stock < p.lowStockThreshold()
+}
+
+// LowStockAlert is published when a product's stock falls below its
+// threshold
+type LowStockAlert struct {
+	Tenant    string    `json:"tenant,omitempty"`
+	ProductID string    `json:"product_id"`
+	Name      string    `json:"name"`
+	Stock     int       `json:"stock"`
+	Threshold int       `json:"threshold"`
+	At        time.Time `json:"at"`
+}
+
+// AlertNotifier publishes low-stock alerts to an SNS topic and/or a Slack
+// incoming webhook. Alerts are queued so writes never wait on delivery.
+type AlertNotifier struct {
+	snsTopic string
+	slackURL string
+	http     *http.Client
+	sns      *http.Client // retried, behind the sns circuit breaker
+	queue    chan LowStockAlert
+}
+
+// Global notifier, nil unless LOW_STOCK_SNS_TOPIC_ARN or
+// LOW_STOCK_SLACK_WEBHOOK_URL is set
+var lowStockAlerts = newAlertNotifier()
+
+func newAlertNotifier() *AlertNotifier {
+	topic, slack := os.Getenv("LOW_STOCK_SNS_TOPIC_ARN"), os.Getenv("LOW_STOCK_SLACK_WEBHOOK_URL")
+	if topic == "" && slack == "" {
+		return nil
+	}
+	return &AlertNotifier{
+		snsTopic: topic,
+		slackURL: slack,
+		http:     newPooledClient("notifications", 10*time.Second),
+		sns:      newAWSClient("sns", 10*time.Second),
+		queue:    make(chan LowStockAlert, 256),
+	}
+}
+
+// checkLowStock queues an alert when a write takes a product below its
+// threshold. Products already below it don't alert again until they have
+// been restocked. Callers must hold store.mu.
+func checkLowStock(previous *Product, p *Product) {
+	if lowStockAlerts == nil || !p.isLowStock() {
+		return
+	}
+	if previous != nil && previous.DeletedAt == nil && previous.Stock < p.lowStockThreshold() {
+		return
+	}
+
+	alert := LowStockAlert{
+		Tenant:    p.Tenant,
+		ProductID: p.ID,
+		Name:      p.Name,
+		Stock:     p.Stock,
+		Threshold: p.lowStockThreshold(),
+		At:        time.Now().UTC(),
+	}
+	select {
+	case lowStockAlerts.queue <- alert:
+	default:
+		lowStockAlertsDropped.Add(1)
+		log.Printf("low stock alert for %s dropped, queue full", p.ID)
+	}
+}
+
+// run delivers queued alerts
+func (n *AlertNotifier) run() {
+	for alert := range n.queue {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		if err := n.deliver(ctx, alert); err != nil {
+			lowStockAlertsFailed.Add(1)
+			log.Printf("low stock alert for %s: %v", qualifiedID(alert.Tenant, alert.ProductID), err)
+		} else {
+			lowStockAlertsSent.Add(1)
+		}
+		cancel()
+	}
+}
+
+// deliver sends an alert to every configured channel
+func (n *AlertNotifier) deliver(ctx context.Context, alert LowStockAlert) error {
+	var errs []error
+	if n.snsTopic != "" {
+		errs = append(errs, n.publishSNS(ctx, alert))
+	}
+	if n.slackURL != "" {
+		errs = append(errs, n.postSlack(ctx, alert))
+	}
+	return errors.Join(errs...)
+}
+
+// publishSNS publishes the alert as JSON to the SNS topic
+func (n *AlertNotifier) publishSNS(ctx context.Context, alert LowStockAlert) (err error) {
+	start := time.Now()
+	defer func() { notificationsDependency.observe(start, err) }()
+
+	message, _ := json.Marshal(alert)
+	return snsPublish(ctx, n.sns, n.snsTopic, url.Values{
+		"Subject": {"Low stock: " + alert.Name},
+		"Message": {string(message)},
+	})
+}
+
+// postSlack posts the alert to the Slack incoming webhook
+func (n *AlertNotifier) postSlack(ctx context.Context, alert LowStockAlert) (err error) {
+	start := time.Now()
+	defer func() { notificationsDependency.observe(start, err) }()
+
+	body, _ := json.Marshal(gin.H{
+		"text": fmt.Sprintf(":warning: Low stock: *%s* (%s) has %d left, threshold is %d",
+			alert.Name, qualifiedID(alert.Tenant, alert.ProductID), alert.Stock, alert.Threshold),
+	})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.slackURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return sendChecked(n.http, req, "slack webhook")
+}
+
+// getLowStockProducts lists products below their low-stock threshold,
+// lowest stock first, so ops can reorder before they sell out
+// Returns: 200 OK - Success (Cat peering into an empty bowl!)
+func getLowStockProducts(c *gin.Context) {
+	tenant := tenantOf(c)
+	store.mu.RLock()
+	low := make([]Product, 0)
+	for _, p := range store.products {
+		if p.Tenant == tenant && p.isLowStock() && shownTo(c, p) {
+			low = append(low, p)
+		}
+	}
+	store.mu.RUnlock()
+
+	sort.Slice(low, func(i, j int) bool {
+		if low[i].Stock != low[j].Stock {
+			return low[i].Stock < low[j].Stock
+		}
+		return low[i].ID < low[j].ID
+	})
+
+	products := make([]gin.H, 0, len(low))
+	for _, p := range low {
+		products = append(products, gin.H{
+			"id":        p.ID,
+			"name":      p.Name,
+			"category":  p.Category,
+			"stock":     p.Stock,
+			"threshold": p.lowStockThreshold(),
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"count":    len(products),
+		"products": products,
+	})
+}
@@ -1,84 +1,511 @@
 package main
 
 import (
+	"expvar"
+	"flag"
+	"log"
+	"maps"
 	"net/http"
+	"os"
+	"slices"
 	"sync"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
-// Product represents data about a product
+// Product represents data about a product. LowStockThreshold overrides
+// LOW_STOCK_THRESHOLD for this product.
 type Product struct {
-	ID          string  `json:"id" binding:"required"`
-	Name        string  `json:"name" binding:"required"`
-	Description string  `json:"description"`
-	Price       float64 `json:"price" binding:"required,gt=0"`
-	Stock       int     `json:"stock" binding:"min=0"`
+	ID                string                 `json:"id"`
+	Tenant            string                 `json:"tenant,omitempty"` // set from the request, see tenantScope
+	Name              string                 `json:"name"`
+	Description       string                 `json:"description"`
+	Category          string                 `json:"category,omitempty"`
+	Price             Money                  `json:"price"`
+	Currency          string                 `json:"currency"`
+	Stock             int                    `json:"stock"`
+	Variants          []Variant              `json:"variants,omitempty"`
+	LowStockThreshold *int                   `json:"low_stock_threshold,omitempty"`
+	SKU               string                 `json:"sku,omitempty"` // variants have their own
+	GTIN              string                 `json:"gtin,omitempty"`
+	WeightGrams       int                    `json:"weight_grams,omitempty"`
+	Images            []string               `json:"images,omitempty"`
+	Badges            []Badge                `json:"badges,omitempty"`
+	RolloutPercent    *int                   `json:"rollout_percent,omitempty"` // soft launch to this share of sessions
+	Related           []RelatedLink          `json:"related,omitempty"`         // curated cross-sells
+	PublishAt         *time.Time             `json:"publish_at,omitempty"`      // hidden from the storefront before
+	UnpublishAt       *time.Time             `json:"unpublish_at,omitempty"`    // and from then on
+	ScheduledPrices   []ScheduledPrice       `json:"scheduled_prices,omitempty"`
+	SalePrice         *Money                 `json:"sale_price,omitempty"`    // charged instead of price
+	Components        []BundleComponent      `json:"components,omitempty"`    // set on bundles
+	Translations      map[string]Translation `json:"translations,omitempty"`  // by BCP 47 tag, other than DEFAULT_LOCALE
+	ActiveBadges      []string               `json:"active_badges,omitempty"` // badges shown now, set in list responses
+	Rating            float64                `json:"rating"`
+	ReviewCount       int                    `json:"review_count"`
+	Version           int64                  `json:"version"`
+	CreatedAt         time.Time              `json:"created_at,omitzero"`
+	UpdatedAt         time.Time              `json:"updated_at,omitzero"`
+	DeletedAt         *time.Time             `json:"deleted_at,omitempty"`
+	Suspension        *Suspension            `json:"suspension,omitempty"` // set by the kill switch
 }
 
 // ProductStore manages our in-memory product storage
 type ProductStore struct {
-	mu       sync.RWMutex
-	products map[string]Product
+	mu        storeLock
+	products  map[string]Product // by productKey
+	wal       *WriteAheadLog     // nil unless WAL_DIR is set
+	file      *CatalogFile       // nil unless STORE_FILE is set
+	recovered bool               // the products were loaded from WAL_DIR or STORE_FILE, not a fresh store
+	removed   time.Time          // last purge, or startup, so a shrinking list still looks modified
+	applied   uint64             // writes applied since startup, numbering points in time
+}
+
+// storeLock is the store's lock. Writes leave the cache entries they made
+// stale with it, and Unlock invalidates them once the lock is released,
+// so neither readers nor the next writer wait on Redis. Until then a
+// reader may still get the entry from before the write, as a reader on
+// another instance may anyway; it can't cache one, as reads fill the
+// cache under the lock.
+type storeLock struct {
+	sync.RWMutex
+	stale   []staleProduct // written under the write lock
+	cleared bool           // the whole store was replaced
+}
+
+// staleProduct is a write whose cache entries must go
+type staleProduct struct {
+	key           string
+	before, after *Product
+}
+
+// Unlock releases the write lock, then invalidates what the writes made
+// under it made stale
+func (l *storeLock) Unlock() {
+	stale, cleared := l.stale, l.cleared
+	l.stale, l.cleared = nil, false
+	l.RWMutex.Unlock()
+
+	if cleared {
+		cache.clear()
+		return
+	}
+	for _, w := range stale {
+		cache.invalidate(w.key, w.before, w.after)
+	}
+}
+
+// save stores a product and bumps its version. Callers must hold s.mu.
+// Cuts share the slices of stored products, so p must not share them with
+// the stored product it replaces if it changed them in place; see clone.
+// stock are the ledger entries of an adjustment p makes; the ledger logs
+// any other change to its stock as opening or set.
+// On error nothing is stored and the caller should answer writeFailed.
+func (s *ProductStore) save(p *Product, stock ...StockEntry) error {
+	syncVariantStock(p)
+	p.Version++
+	p.UpdatedAt = time.Now().UTC()
+	p.CreatedAt = p.UpdatedAt
+	p.ActiveBadges = nil
+	var before *Product
+	if previous, exists := s.products[p.key()]; exists {
+		before = &previous
+		p.CreatedAt = previous.CreatedAt
+	}
+	stored := *p
+	if err := s.write(walRecord{Op: walPut, ID: p.key(), Product: &stored, Stock: stockLedger.changes(&stored, stock)}); err != nil {
+		return err
+	}
+	checkLowStock(before, p)
+	return nil
+}
+
+// remove deletes a product by its key. Callers must hold s.mu.
+func (s *ProductStore) remove(key string) error {
+	return s.write(walRecord{Op: walDelete, ID: key})
+}
+
+// write replicates a write when Raft is on, which applies it in log
+// order, or applies it right away. Callers must hold s.mu.
+func (s *ProductStore) write(rec walRecord) error {
+	if replication != nil {
+		return replication.propose(rec)
+	}
+	return s.apply(rec)
+}
+
+// apply makes a write durable, then visible: the WAL first, then the map,
+// the watchers, and the caches once s.mu is released. A write the WAL
+// doesn't take isn't applied at all. Events go out to destinations from
+// the instance taking the write, the leader under Raft. Callers must hold
+// s.mu, and n.mu with Raft.
+func (s *ProductStore) apply(rec walRecord) error {
+	var before *Product
+	if previous, exists := s.products[rec.ID]; exists {
+		before = &previous
+	}
+
+	event := ProductEvent{Type: eventPurged, Previous: before}
+	if rec.Op == walPut {
+		event = ProductEvent{Type: productEventType(before, rec.Product), Product: rec.Product, Previous: before}
+	}
+	event.Tenant, event.ID = splitProductKey(rec.ID)
+	publishes := replication == nil || replication.role == raftLeader
+	if publishes && outbox != nil {
+		rec.Outbox = outbox.messages(event)
+	}
+	if s.wal != nil {
+		if err := s.wal.append(rec); err != nil {
+			return err
+		}
+	}
+
+	switch rec.Op {
+	case walPut:
+		s.products[rec.ID] = *rec.Product
+		codes.update(before, rec.Product)
+		suggestions.update(before, rec.Product)
+		analytics.recordStock(rec.ID, rec.Product.Stock, before == nil, time.Now())
+		costs.recordStock(rec.ID, rec.Product.Stock)
+		stockLedger.apply(rec.Product, rec.Stock)
+	case walDelete:
+		delete(s.products, rec.ID)
+		codes.update(before, nil)
+		suggestions.update(before, nil)
+		s.removed = time.Now().UTC()
+		reviews.removeProduct(rec.ID)
+		analytics.removeAging(rec.ID)
+		coPurchases.removeProduct(rec.ID)
+		costs.removeProduct(rec.ID)
+		stockLedger.removeProduct(rec.ID)
+	}
+	s.applied++
+	productEvents.publish(event)
+	if publishes {
+		if outbox == nil {
+			eventDelivery.enqueue(event)
+		}
+		webhooks.enqueue(event)
+	}
+	outbox.add(rec.Outbox)
+	if s.file != nil {
+		s.file.changed()
+	}
+	s.mu.stale = append(s.mu.stale, staleProduct{key: rec.ID, before: before, after: rec.Product})
+	return nil
+}
+
+// writeFailed answers a write the store couldn't make durable, or
+// replicate, so it wasn't made
+// Returns: 503 Service Unavailable - The write failed, retry later (Cat knocked the ledger off the desk!)
+func writeFailed(c *gin.Context, err error) {
+	c.Header("Retry-After", "1")
+	c.JSON(http.StatusServiceUnavailable, gin.H{
+		"error":   "Write failed, try again later",
+		"details": err.Error(),
+	})
+}
+
+// listModified returns when a list of products last changed: the newest
+// product, or the last purge if that's later
+func (s *ProductStore) listModified(products []Product) time.Time {
+	s.mu.RLock()
+	modified := s.removed
+	s.mu.RUnlock()
+
+	for _, p := range products {
+		if p.UpdatedAt.After(modified) {
+			modified = p.UpdatedAt
+		}
+	}
+	return modified
+}
+
+// clone returns a copy of p whose slices and maps can be changed in place without
+// touching p's. Products read from the store share their slices with it,
+// and with every cut taken since, so writers clone before normalizing.
+func (p Product) clone() Product {
+	p.Variants = slices.Clone(p.Variants)
+	p.Images = slices.Clone(p.Images)
+	p.Badges = slices.Clone(p.Badges)
+	p.Related = slices.Clone(p.Related)
+	p.ScheduledPrices = slices.Clone(p.ScheduledPrices)
+	p.Components = slices.Clone(p.Components)
+	p.Translations = maps.Clone(p.Translations)
+	return p
 }
 
 // Global product store
 var store = &ProductStore{
 	products: make(map[string]Product),
+	removed:  time.Now().UTC(),
 }
 
-// Initialize with some sample data
-func init() {
-	sampleProducts := []Product{
-		{ID: "1", Name: "Laptop", Description: "High-performance laptop", Price: 999.99, Stock: 10},
-		{ID: "2", Name: "Mouse", Description: "Wireless mouse", Price: 29.99, Stock: 50},
-		{ID: "3", Name: "Keyboard", Description: "Mechanical keyboard", Price: 89.99, Stock: 25},
+func main() {
+	if args, ok := productctlArgs(); ok {
+		os.Exit(productctl(args))
 	}
+	seedSource := flag.String("seed", "", "fixture to seed the catalog from, off for none (default SEED_FILE)")
+	flag.Parse()
 
-	for _, p := range sampleProducts {
-		store.products[p.ID] = p
+	if walDir != "" && storeFile != "" {
+		log.Fatal("set WAL_DIR or STORE_FILE, not both")
+	}
+	if walDir != "" {
+		if err := store.recoverFromWAL(walDir); err != nil {
+			log.Fatalf("wal: %v", err)
+		}
+		go store.runWAL()
+	}
+	if storeFile != "" {
+		if err := store.loadStoreFile(storeFile); err != nil {
+			log.Fatalf("store file: %v", err)
+		}
+		go store.file.run()
+	}
+	// Before Raft starts, so every member seeds alike
+	if err := seedStore(*seedSource); err != nil {
+		log.Fatalf("seed: %v", err)
 	}
-}
 
-func main() {
 	router := gin.Default()
+	// Client IPs, which rate limits tell clients apart by, only come from
+	// X-Forwarded-For through the proxies in TRUSTED_PROXIES
+	if err := router.SetTrustedProxies(trustedProxies); err != nil {
+		log.Fatalf("TRUSTED_PROXIES: %v", err)
+	}
+	router.Use(requestID(), securityHeaders(), requestDeadline(), limitRequestBodies(), compressResponses())
+	if corsPolicy != nil {
+		router.Use(corsPolicy.handle)
+	}
+	// After CORS, so rejections and the 202 of a deferred request carry
+	// its headers, and after the tenant, which admin checks need
+	router.Use(tenantScope(), applyRoutePolicies(), respondAsync(router))
+	// Last, so faults hit the request itself, or the job of an async one
+	if faults := injectFaults(); faults != nil {
+		router.Use(faults)
+	}
 
-	// Product routes
-	router.GET("/products", getProducts)
-	router.GET("/products/:id", getProductByID)
-	router.POST("/products", createProduct)
+	// Metrics
+	router.GET("/debug/vars", gin.WrapH(expvar.Handler()))
+
+	// API documentation
+	router.GET("/openapi.json", getOpenAPISpec)
+	router.GET("/docs", getDocs)
+	router.GET("/.well-known/api-capabilities", getCapabilities)
+
+	// Admin dashboard, calling the API with the admin token
+	router.GET("/admin", adminUI(), getAdminDashboard)
+	router.GET("/admin/ui/*filepath", adminUI(), getAdminAsset)
+
+	// Health
+	router.GET("/readyz", getReadiness)
+
+	// Cluster membership, when sharding is enabled
+	router.GET("/internal/cluster/members", getClusterMembers)
+	router.POST("/internal/cluster/members", exchangeClusterMembers)
+
+	// Raft, when replication is enabled
+	router.GET("/internal/raft/status", getRaftStatus)
+	router.POST("/internal/raft/vote", raftRPC((*RaftNode).handleVote))
+	router.POST("/internal/raft/append", raftRPC((*RaftNode).handleAppend))
+	router.POST("/internal/raft/snapshot", raftRPC((*RaftNode).handleSnapshot))
+
+	// Versioned API, unversioned paths are negotiated by unversionedRoute
+	for version, register := range apiVersions {
+		group := router.Group("/"+version, apiVersionHeader(version), shardRoute(), raftRoute())
+		register(group)
+	}
+	router.NoRoute(unversionedRoute(router))
+
+	if migrator != nil {
+		go migrator.run()
+	}
+	if cluster != nil {
+		go cluster.run()
+	}
+	if replication != nil {
+		go replication.run()
+	}
+	if grpcAddr != "" {
+		go newGRPCServer(router).run(grpcAddr)
+	}
+	go runRetention(envDuration("RETENTION_INTERVAL", time.Hour))
+	go runSchedules(envDuration("SCHEDULE_INTERVAL", time.Minute))
+	if routePoliciesFile != "" {
+		go watchRoutePolicies()
+	}
+	if flagsFile != "" || appConfigApp != "" {
+		go watchFlags()
+	}
+	if lowStockAlerts != nil {
+		go lowStockAlerts.run()
+	}
+	if eventDelivery != nil {
+		eventDelivery.run()
+	}
+	if segmentExporter != nil {
+		go segmentExporter.run(envDuration("AUDIT_EXPORT_INTERVAL", time.Hour))
+	}
 
 	router.Run(":8080")
 }
 
-// getProducts returns all products
+// getProducts returns all products, soft-deleted ones only for admins
+// with ?include_deleted=true and unpublished ones only for admins.
+// ?id=1,2, ?category= and ?q= (a word in the name or description) narrow
+// the list down. ?currency=EUR converts prices. Each product carries the
+// badges it shows now as active_badges. Accept picks JSON, XML or CSV.
+// With sharding the other shards are asked for theirs and the lists
+// merged. X-Catalog-Snapshot reads a snapshot instead. ?fields=id,name
+// trims JSON products down to those fields.
 // Returns: 200 OK - Success (Happy cat with coffee!)
+// Returns: 304 Not Modified - If-None-Match or If-Modified-Since matches (Cat already has it!)
+// Returns: 400 Bad Request - Unsupported currency, too many ids or unknown fields (Confused cat!)
+// Returns: 403 Forbidden - include_deleted without admin access (Grumpy cat!)
+// Returns: 406 Not Acceptable - Accept rules out JSON, XML and CSV (Cat only speaks JSON, XML and CSV!)
+// Returns: 504 Gateway Timeout - Took longer than REQUEST_TIMEOUT
 func getProducts(c *gin.Context) {
-	store.mu.RLock()
-	defer store.mu.RUnlock()
+	include, ok := includeDeleted(c)
+	if !ok {
+		return
+	}
+	currency, ok := requestedCurrency(c)
+	if !ok {
+		return
+	}
 
-	// Convert map to slice for response
-	products := make([]Product, 0, len(store.products))
-	for _, product := range store.products {
-		products = append(products, product)
+	query, ok := parseListQuery(c)
+	if !ok {
+		return
+	}
+	format, ok := negotiate(c, productFormats...)
+	if !ok {
+		return
+	}
+	fields, ok := parseFields(c)
+	if !ok {
+		return
+	}
+	snap, ok := pinnedSnapshot(c)
+	if !ok {
+		return
+	}
+	if snap != nil {
+		getSnapshotProducts(c, snap, query, format, currency, fields)
+		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{
-		"count":    len(products),
-		"products": products,
-	})
+	products := cache.loadList(c.Request.Context(), query)
+	if requestCanceled(c) {
+		return
+	}
+	if !include {
+		visible := make([]Product, 0, len(products))
+		for _, p := range products {
+			if p.live() {
+				visible = append(visible, p)
+			}
+		}
+		products = visible
+	}
+	products = shownProducts(c, products)
+	if products, ok = localizeProducts(c, products, currency); !ok {
+		return
+	}
+	products = translateProducts(c, products)
+	products = withActiveBadges(products)
+	if cluster != nil {
+		products = cluster.gatherProducts(c, products)
+		if requestCanceled(c) {
+			return
+		}
+	}
+
+	setCacheHeaders(c, cache.list)
+	etag := listETag(products, currency)
+	c.Header("ETag", etag)
+	modified := store.listModified(products)
+	setLastModified(c, modified)
+	if notModified(c, etag) || notModifiedSince(c, modified) {
+		return
+	}
+	renderProducts(c, format, products, fields)
 }
 
-// getProductByID returns a single product by ID
+// getProductByID returns a single product by ID, ?currency=EUR converts prices.
+// Accept picks JSON, XML or CSV, and X-Catalog-Snapshot reads it from a snapshot.
+// ?fields=id,name trims a JSON product down to those fields.
 // Returns: 200 OK - Found (Happy cat!)
+// Returns: 304 Not Modified - If-None-Match or If-Modified-Since matches (Cat already has it!)
+// Returns: 400 Bad Request - Unsupported currency or unknown fields (Confused cat!)
+// Returns: 403 Forbidden - include_deleted without admin access (Grumpy cat!)
 // Returns: 404 Not Found - Product doesn't exist (Cat hiding in a box!)
+// Returns: 406 Not Acceptable - Accept rules out JSON, XML and CSV (Cat only speaks JSON, XML and CSV!)
+// Returns: 504 Gateway Timeout - Took longer than REQUEST_TIMEOUT
 func getProductByID(c *gin.Context) {
 	id := c.Param("id")
 
-	store.mu.RLock()
-	defer store.mu.RUnlock()
+	include, ok := includeDeleted(c)
+	if !ok {
+		return
+	}
+	currency, ok := requestedCurrency(c)
+	if !ok {
+		return
+	}
+	format, ok := negotiate(c, productFormats...)
+	if !ok {
+		return
+	}
+	fields, ok := parseFields(c)
+	if !ok {
+		return
+	}
+	snap, ok := pinnedSnapshot(c)
+	if !ok {
+		return
+	}
+	if snap != nil {
+		getSnapshotProduct(c, snap, id, format, currency, fields)
+		return
+	}
 
-	product, exists := store.products[id]
+	key := tenantKey(c, id)
+	product, exists := cache.load(c.Request.Context(), key)
+	if requestCanceled(c) {
+		return
+	}
+	// Repair first, so the checks below apply to the product that's served,
+	// which may have been deleted, suspended or unpublished since it was
+	// cached
+	ifNoneMatch := c.GetHeader("If-None-Match")
+	if exists && ifNoneMatch != "" {
+		product, exists = cache.repair(product, ifNoneMatch)
+	}
+	if exists && !product.live() && !include {
+		exists = false
+	}
+	if exists {
+		exists = shownTo(c, product)
+	}
+	if exists {
+		etag := readETag(c, product, format, currency, fields)
+		if ifNoneMatch != "" {
+			if etagMatches(ifNoneMatch, etag) {
+				setCacheHeaders(c, cache.product)
+				c.Header("ETag", etag)
+				setLastModified(c, product.UpdatedAt)
+				c.Status(http.StatusNotModified)
+				return
+			}
+		} else if notModifiedSince(c, product.UpdatedAt) {
+			setCacheHeaders(c, cache.product)
+			c.Header("ETag", etag)
+			setLastModified(c, product.UpdatedAt)
+			return
+		}
+	}
 	if !exists {
 		c.JSON(http.StatusNotFound, gin.H{
 			"error": "Product not found",
@@ -87,65 +514,337 @@ func getProductByID(c *gin.Context) {
 		return
 	}
 
-	c.JSON(http.StatusOK, product)
+	// A hedged read reaches the owner twice, count it once
+	if c.GetHeader(hedgeAttemptHeader) == "" {
+		analytics.record(key, eventView, 1, time.Now())
+	}
+
+	localized, ok := localizeProducts(c, []Product{product}, currency)
+	if !ok {
+		return
+	}
+	localized = translateProducts(c, localized)
+
+	setCacheHeaders(c, cache.product)
+	c.Header("ETag", readETag(c, product, format, currency, fields))
+	setLastModified(c, product.UpdatedAt)
+	renderProduct(c, format, localized[0], fields)
 }
 
-// createProduct adds a new product
+// createProduct adds a new product, checked against the profile query
+// parameter's validation profile
 // Returns: 201 Created - Success (Cat with a party hat!)
 // Returns: 400 Bad Request - Invalid input (Confused cat!)
-// Returns: 409 Conflict - Product ID already exists (Fighting cats!)
+// Returns: 409 Conflict - Product ID already exists, or another product has the SKU or barcode (Fighting cats!)
 func createProduct(c *gin.Context) {
+	profile, ok := writeProfile(c)
+	if !ok {
+		return
+	}
 	var newProduct Product
-
-	// Validate and bind JSON
-	if err := c.ShouldBindJSON(&newProduct); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"error":   "Invalid product data",
-			"details": err.Error(),
-		})
+	violations := bindStrict(c, &newProduct)
+	newProduct.Tenant = tenantOf(c)
+	if violations == nil {
+		violations = append(productViolations(&newProduct), profile.gaps(&newProduct)...)
+	}
+	if len(violations) > 0 {
+		invalidRequest(c, "Invalid product data", violations)
 		return
 	}
 
 	store.mu.Lock()
 	defer store.mu.Unlock()
 
-	// Check if product ID already exists
-	if _, exists := store.products[newProduct.ID]; exists {
+	// Check if product ID already exists, deleted products keep their ID
+	// until they are purged so they can still be restored
+	if existing, exists := store.products[newProduct.key()]; exists {
 		c.JSON(http.StatusConflict, gin.H{
-			"error": "Product with this ID already exists",
-			"id":    newProduct.ID,
+			"error":   "Product with this ID already exists",
+			"id":      newProduct.ID,
+			"deleted": existing.DeletedAt != nil,
 		})
 		return
 	}
+	if violations := codes.conflicts(&newProduct); len(violations) > 0 {
+		codeConflict(c, violations)
+		return
+	}
+	if violations := catalogViolations(&newProduct); len(violations) > 0 {
+		invalidRequest(c, "Invalid product data", violations)
+		return
+	}
 
-	// Add the new product
-	store.products[newProduct.ID] = newProduct
+	// Add the new product, versions and ratings are managed by the server
+	newProduct.Version = 0
+	newProduct.DeletedAt, newProduct.Suspension = nil, nil
+	newProduct.Rating, newProduct.ReviewCount = 0, 0
+	if err := store.save(&newProduct); err != nil {
+		writeFailed(c, err)
+		return
+	}
+	audit.record(c, "create", nil, &newProduct)
 
+	c.Header("ETag", productETag(newProduct))
 	c.JSON(http.StatusCreated, gin.H{
 		"message": "Product created successfully",
 		"product": newProduct,
 	})
 }
 
-// Additional validation helper (optional)
-func validateProduct(p Product) []string {
-	var errors []string
+// updateProduct replaces an existing product
+// Requires: If-Match header with the current ETag
+// Returns: 200 OK - Success (Cat with a fresh coat!)
+// Returns: 400 Bad Request - Invalid input (Confused cat!)
+// Returns: 404 Not Found - Product doesn't exist (Cat hiding in a box!)
+// Returns: 409 Conflict - Another product has the SKU or barcode
+// Returns: 412 Precondition Failed - Stale ETag (Cat knocked it off the table first!)
+// Returns: 428 Precondition Required - Missing If-Match (Suspicious cat!)
+func updateProduct(c *gin.Context) {
+	id := c.Param("id")
+	profile, ok := writeProfile(c)
+	if !ok {
+		return
+	}
+
+	var product Product
+	violations := bindStrict(c, &product)
+	product.Tenant = tenantOf(c)
+	if violations == nil {
+		violations = append(productViolations(&product), profile.gaps(&product)...)
+		if product.ID != id {
+			violations = append(violations, Violation{Code: violationMismatch, Field: "id", Message: "Must match the ID in the URL"})
+		}
+	}
+	if len(violations) > 0 {
+		invalidRequest(c, "Invalid product data", violations)
+		return
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	current, exists := store.get(tenantKey(c, id))
+	if !exists {
+		productNotFound(c, id)
+		return
+	}
+	if !checkIfMatch(c, current) {
+		return
+	}
 
-	if p.Name == "" {
-		errors = append(errors, "Product name is required")
+	if violations := stockWriteViolations(&current, &product); len(violations) > 0 {
+		invalidRequest(c, "Invalid product data", violations)
+		return
+	}
+	if violations := codes.conflicts(&product); len(violations) > 0 {
+		codeConflict(c, violations)
+		return
+	}
+	if violations := catalogViolations(&product); len(violations) > 0 {
+		invalidRequest(c, "Invalid product data", violations)
+		return
 	}
 
-	if len(p.Name) > 100 {
-		errors = append(errors, "Product name too long (max 100 characters)")
+	product.Version = current.Version
+	product.DeletedAt, product.Suspension = nil, nil
+	product.Rating, product.ReviewCount = current.Rating, current.ReviewCount
+	if err := store.save(&product); err != nil {
+		writeFailed(c, err)
+		return
 	}
+	audit.record(c, "update", &current, &product)
 
-	if p.Price <= 0 {
-		errors = append(errors, "Price must be greater than 0")
+	c.Header("ETag", productETag(product))
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Product updated successfully",
+		"product": product,
+	})
+}
+
+// ProductPatch holds the fields that can be changed with PATCH.
+// Nil fields are left untouched.
+type ProductPatch struct {
+	Name              *string                 `json:"name"`
+	Description       *string                 `json:"description"`
+	Category          *string                 `json:"category"`
+	Price             *Money                  `json:"price"`
+	Stock             *int                    `json:"stock"`
+	Currency          *string                 `json:"currency"`
+	LowStockThreshold *int                    `json:"low_stock_threshold"`
+	SKU               *string                 `json:"sku"`
+	GTIN              *string                 `json:"gtin"`
+	WeightGrams       *int                    `json:"weight_grams"`
+	Images            *[]string               `json:"images"`
+	Badges            *[]Badge                `json:"badges"`
+	RolloutPercent    *int                    `json:"rollout_percent"`
+	Related           *[]RelatedLink          `json:"related"`
+	PublishAt         *time.Time              `json:"publish_at"`
+	UnpublishAt       *time.Time              `json:"unpublish_at"`
+	ScheduledPrices   *[]ScheduledPrice       `json:"scheduled_prices"`
+	SalePrice         *Money                  `json:"sale_price"`
+	Components        *[]BundleComponent      `json:"components"`
+	Translations      *map[string]Translation `json:"translations"`
+}
+
+// patchProduct partially updates an existing product
+// Requires: If-Match header with the current ETag
+// Returns: 200 OK - Success
+// Returns: 400 Bad Request - Invalid input
+// Returns: 404 Not Found - Product doesn't exist
+// Returns: 409 Conflict - Another product has the SKU or barcode
+// Returns: 412 Precondition Failed - Stale ETag
+// Returns: 428 Precondition Required - Missing If-Match
+func patchProduct(c *gin.Context) {
+	id := c.Param("id")
+	profile, ok := writeProfile(c)
+	if !ok {
+		return
 	}
 
-	if p.Stock < 0 {
-		errors = append(errors, "Stock cannot be negative")
+	var patch ProductPatch
+	if violations := bindStrict(c, &patch); violations != nil {
+		invalidRequest(c, "Invalid product data", violations)
+		return
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	product, exists := store.get(tenantKey(c, id))
+	if !exists {
+		productNotFound(c, id)
+		return
+	}
+	if !checkIfMatch(c, product) {
+		return
+	}
+	before := product
+	product = product.clone()
+
+	if patch.Name != nil {
+		product.Name = *patch.Name
+	}
+	if patch.Description != nil {
+		product.Description = *patch.Description
+	}
+	if patch.Category != nil {
+		product.Category = *patch.Category
+	}
+	if patch.Price != nil {
+		product.Price = *patch.Price
+	}
+	if patch.Currency != nil {
+		product.Currency = *patch.Currency
+	}
+	if patch.LowStockThreshold != nil {
+		product.LowStockThreshold = patch.LowStockThreshold
+	}
+	if patch.SKU != nil {
+		product.SKU = *patch.SKU
+	}
+	if patch.GTIN != nil {
+		product.GTIN = *patch.GTIN
+	}
+	if patch.WeightGrams != nil {
+		product.WeightGrams = *patch.WeightGrams
+	}
+	if patch.Images != nil {
+		product.Images = *patch.Images
+	}
+	if patch.Badges != nil {
+		product.Badges = *patch.Badges
+	}
+	if patch.RolloutPercent != nil {
+		product.RolloutPercent = patch.RolloutPercent
+	}
+	if patch.Related != nil {
+		product.Related = *patch.Related
+	}
+	if patch.PublishAt != nil {
+		product.PublishAt = patch.PublishAt
+	}
+	if patch.UnpublishAt != nil {
+		product.UnpublishAt = patch.UnpublishAt
+	}
+	if patch.ScheduledPrices != nil {
+		product.ScheduledPrices = *patch.ScheduledPrices
+	}
+	if patch.SalePrice != nil {
+		product.SalePrice = patch.SalePrice
+	}
+	if patch.Components != nil {
+		product.Components = *patch.Components
+	}
+	if patch.Translations != nil {
+		product.Translations = *patch.Translations
+	}
+	var violations []Violation
+	if patch.Stock != nil {
+		if len(product.Variants) > 0 {
+			violations = append(violations, Violation{Code: violationInvalid, Field: "stock", Message: "Stock of a product with variants is managed per variant"})
+		}
+		product.Stock = *patch.Stock
+	}
+
+	violations = append(violations, productViolations(&product)...)
+	violations = append(violations, profile.gaps(&product)...)
+	violations = append(violations, stockWriteViolations(&before, &product)...)
+	if len(violations) > 0 {
+		invalidRequest(c, "Invalid product data", violations)
+		return
+	}
+	if violations := codes.conflicts(&product); len(violations) > 0 {
+		codeConflict(c, violations)
+		return
+	}
+	if violations := catalogViolations(&product); len(violations) > 0 {
+		invalidRequest(c, "Invalid product data", violations)
+		return
+	}
+
+	if err := store.save(&product); err != nil {
+		writeFailed(c, err)
+		return
+	}
+	audit.record(c, "update", &before, &product)
+
+	c.Header("ETag", productETag(product))
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Product updated successfully",
+		"product": product,
+	})
+}
+
+// deleteProduct soft-deletes a product. It stays restorable until the
+// purge job removes it after PURGE_AFTER_DAYS.
+// Requires: If-Match header with the current ETag
+// Returns: 204 No Content - Success (Cat waving goodbye!)
+// Returns: 404 Not Found - Product doesn't exist
+// Returns: 412 Precondition Failed - Stale ETag
+// Returns: 428 Precondition Required - Missing If-Match
+func deleteProduct(c *gin.Context) {
+	id := c.Param("id")
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	product, exists := store.get(tenantKey(c, id))
+	if !exists {
+		productNotFound(c, id)
+		return
+	}
+	if !checkIfMatch(c, product) {
+		return
+	}
+	before := product
+
+	now := time.Now().UTC()
+	product.DeletedAt = &now
+	if err := store.save(&product); err != nil {
+		writeFailed(c, err)
+		return
 	}
+	audit.record(c, "delete", &before, &product)
 
-	return errors
+	c.Status(http.StatusNoContent)
 }
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// testAdminToken is the admin token of newTestRouter
+const testAdminToken = "test-admin-token"
+
+// newTestRouter empties the catalog and stock ledger and returns a router
+// serving the v1 API behind the tenant scope, with testAdminToken as the
+// admin token. All are put back when the test ends.
+func newTestRouter(t *testing.T) *gin.Engine {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	saved, savedLedger, savedToken := store, stockLedger, adminToken
+	store = &ProductStore{products: make(map[string]Product), removed: time.Now().UTC()}
+	stockLedger = newStockLedger()
+	adminToken = testAdminToken
+	t.Cleanup(func() { store, stockLedger, adminToken = saved, savedLedger, savedToken })
+
+	router := gin.New()
+	router.Use(tenantScope())
+	registerV1Routes(router.Group("/v1"))
+	return router
+}
+
+// serve runs a request through a router. header is name, value pairs.
+func serve(router http.Handler, method, path, body string, header ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	if body != "" {
+		r.Header.Set("Content-Type", "application/json")
+	}
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	return w
+}
+
+// asAdmin is the header of a request with testAdminToken
+var asAdmin = []string{"Authorization", "Bearer " + testAdminToken}
+
+// mustCreate creates a product as the admin, failing the test otherwise
+func mustCreate(t *testing.T, router http.Handler, product string, header ...string) {
+	t.Helper()
+	if w := serve(router, http.MethodPost, "/v1/products", product, append(asAdmin, header...)...); w.Code != http.StatusCreated {
+		t.Fatalf("create %s: %d %s", product, w.Code, w.Body)
+	}
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// migration is one setup step for shared infrastructure (tables, indexes,
+// bucket layout). It runs once per environment, so apply must be safe to
+// retry if an instance dies halfway through.
+type migration struct {
+	id    string
+	apply func(ctx context.Context) error
+}
+
+// migrations lists setup steps in the order they're applied. Subsystems
+// that need shared setup register theirs here; IDs must never change once
+// deployed.
+var migrations = []*migration{}
+
+// Migration runner states
+const (
+	migrationsPending  = "pending"
+	migrationsWaiting  = "waiting"
+	migrationsRunning  = "running"
+	migrationsFailed   = "failed"
+	migrationsComplete = "complete"
+)
+
+const (
+	migrationLockKey       = "migrations/lock"
+	migrationAppliedPrefix = "migrations/applied/"
+)
+
+// migrationLock is the body of the lock object
+type migrationLock struct {
+	Owner   string    `json:"owner"`
+	Expires time.Time `json:"expires"`
+}
+
+// MigrationRunner applies pending migrations on start. Instances share a
+// lock object in S3 created with a conditional PUT, so exactly one of them
+// applies migrations while the others wait for it to finish.
+type MigrationRunner struct {
+	s3      *S3Client
+	owner   string
+	lockTTL time.Duration
+	poll    time.Duration
+
+	mu        sync.Mutex
+	status    string
+	applied   []string
+	lastError string
+	lockETag  string
+}
+
+// Global runner, nil unless RUN_MIGRATIONS=true
+var migrator = newMigrationRunner()
+
+func newMigrationRunner() *MigrationRunner {
+	if os.Getenv("RUN_MIGRATIONS") != "true" {
+		return nil
+	}
+	bucket := os.Getenv("MIGRATIONS_BUCKET")
+	if bucket == "" {
+		panic("RUN_MIGRATIONS requires MIGRATIONS_BUCKET")
+	}
+	return migrationRunnerFor(bucket)
+}
+
+// migrationRunnerFor returns a runner sharing the lock in bucket
+func migrationRunnerFor(bucket string) *MigrationRunner {
+	host, _ := os.Hostname()
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	return &MigrationRunner{
+		s3:      newS3Client(bucket),
+		owner:   host + "-" + hex.EncodeToString(suffix),
+		lockTTL: envDuration("MIGRATIONS_LOCK_TTL", 5*time.Minute),
+		poll:    envDuration("MIGRATIONS_POLL_INTERVAL", 5*time.Second),
+		status:  migrationsPending,
+	}
+}
+
+// setStatus updates the state reported by /readyz
+func (m *MigrationRunner) setStatus(status string, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.status = status
+	m.lastError = ""
+	if err != nil {
+		m.lastError = err.Error()
+	}
+}
+
+// ready reports whether every migration has been applied
+func (m *MigrationRunner) ready() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.status == migrationsComplete
+}
+
+// run applies migrations, or waits for the instance holding the lock to
+// apply them, retrying until everything is applied
+func (m *MigrationRunner) run() {
+	for {
+		err := m.attempt(context.Background())
+		if err == nil {
+			m.setStatus(migrationsComplete, nil)
+			log.Printf("migrations complete")
+			return
+		}
+		log.Printf("migrations: %v", err)
+		time.Sleep(m.poll)
+	}
+}
+
+// attempt makes one pass: it returns nil once every migration is applied,
+// by this instance or another one
+func (m *MigrationRunner) attempt(ctx context.Context) error {
+	pending, err := m.pending(ctx)
+	if err != nil {
+		m.setStatus(migrationsFailed, err)
+		return err
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+
+	acquired, err := m.acquire(ctx)
+	if err != nil {
+		m.setStatus(migrationsFailed, err)
+		return err
+	}
+	if !acquired {
+		m.setStatus(migrationsWaiting, nil)
+		return errMigrationsLocked
+	}
+	defer m.release(ctx)
+
+	m.setStatus(migrationsRunning, nil)
+	// Another instance may have finished between the check and the lock
+	if pending, err = m.pending(ctx); err != nil {
+		m.setStatus(migrationsFailed, err)
+		return err
+	}
+	for _, mig := range pending {
+		if err := m.renew(ctx); err != nil {
+			m.setStatus(migrationsFailed, err)
+			return err
+		}
+		log.Printf("migrations: applying %s", mig.id)
+		if err := mig.apply(ctx); err != nil {
+			m.setStatus(migrationsFailed, err)
+			return err
+		}
+		marker, _ := json.Marshal(gin.H{"owner": m.owner, "applied_at": time.Now().UTC()})
+		if err := m.s3.putObject(ctx, migrationAppliedPrefix+mig.id, marker, nil); err != nil {
+			m.setStatus(migrationsFailed, err)
+			return err
+		}
+
+		m.mu.Lock()
+		m.applied = append(m.applied, mig.id)
+		m.mu.Unlock()
+	}
+	return nil
+}
+
+// errMigrationsLocked means another instance is applying migrations
+var errMigrationsLocked = errors.New("waiting for another instance to apply migrations")
+
+// errLockLost means the lock expired and another instance took it over
+var errLockLost = errors.New("migration lock was taken over by another instance")
+
+// pending returns the migrations without an applied marker in S3
+func (m *MigrationRunner) pending(ctx context.Context) ([]*migration, error) {
+	var pending []*migration
+	for _, mig := range migrations {
+		_, _, err := m.s3.getObject(ctx, migrationAppliedPrefix+mig.id, nil)
+		switch {
+		case s3Status(err) == http.StatusNotFound:
+			pending = append(pending, mig)
+		case err != nil:
+			return nil, err
+		}
+	}
+	return pending, nil
+}
+
+// acquire takes the lock. A lock whose holder stopped renewing it is taken
+// over with a PUT conditional on its ETag, so only one instance wins.
+func (m *MigrationRunner) acquire(ctx context.Context) (bool, error) {
+	header := http.Header{}
+	header.Set("If-None-Match", "*")
+	acquired, err := m.writeLock(ctx, header)
+	if acquired || err != nil {
+		return acquired, err
+	}
+
+	body, respHeader, err := m.s3.getObject(ctx, migrationLockKey, nil)
+	if s3Status(err) == http.StatusNotFound {
+		return false, nil // released meanwhile, try again next pass
+	}
+	if err != nil {
+		return false, err
+	}
+	var lock migrationLock
+	if json.Unmarshal(body, &lock) == nil && time.Now().Before(lock.Expires) {
+		return false, nil
+	}
+
+	log.Printf("migrations: taking over expired lock from %s", lock.Owner)
+	header = http.Header{}
+	header.Set("If-Match", respHeader.Get("ETag"))
+	return m.writeLock(ctx, header)
+}
+
+// renew extends the lock held by this instance
+func (m *MigrationRunner) renew(ctx context.Context) error {
+	m.mu.Lock()
+	etag := m.lockETag
+	m.mu.Unlock()
+
+	header := http.Header{}
+	header.Set("If-Match", etag)
+	renewed, err := m.writeLock(ctx, header)
+	if err == nil && !renewed {
+		err = errLockLost
+	}
+	return err
+}
+
+// writeLock writes the lock object with a precondition. It returns false
+// when the precondition failed, i.e. another instance holds the lock.
+func (m *MigrationRunner) writeLock(ctx context.Context, header http.Header) (bool, error) {
+	body, _ := json.Marshal(migrationLock{Owner: m.owner, Expires: time.Now().Add(m.lockTTL).UTC()})
+	resp, err := m.s3.do(ctx, http.MethodPut, migrationLockKey, body, header)
+	switch s3Status(err) {
+	case http.StatusPreconditionFailed, http.StatusConflict:
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+
+	m.mu.Lock()
+	m.lockETag = resp.Header.Get("ETag")
+	m.mu.Unlock()
+	return true, nil
+}
+
+// release deletes the lock so waiting instances can see migrations are
+// done. The delete is conditional so a lock taken over isn't removed.
+func (m *MigrationRunner) release(ctx context.Context) {
+	m.mu.Lock()
+	header := http.Header{}
+	header.Set("If-Match", m.lockETag)
+	m.mu.Unlock()
+
+	err := m.s3.deleteObject(ctx, migrationLockKey, header)
+	if err != nil && s3Status(err) != http.StatusPreconditionFailed {
+		log.Printf("migrations: releasing lock: %v", err)
+	}
+}
+
+// readinessTimeout bounds the dependency probes of /readyz, READINESS_TIMEOUT
+var readinessTimeout = envDuration("READINESS_TIMEOUT", time.Second)
+
+// getReadiness reports whether the instance can take traffic. It stays
+// unavailable until startup migrations are complete, and while a critical
+// dependency doesn't answer its probe within READINESS_TIMEOUT.
+// Returns: 200 OK - Ready (Cat stretching after a nap!)
+// Returns: 503 Service Unavailable - Migrations still pending, or a dependency failing
+func getReadiness(c *gin.Context) {
+	if migrator == nil || migrator.ready() {
+		ctx, cancel := context.WithTimeout(c.Request.Context(), readinessTimeout)
+		defer cancel()
+
+		if failures := probeCritical(ctx); len(failures) > 0 {
+			c.JSON(http.StatusServiceUnavailable, gin.H{
+				"status":       "not ready",
+				"dependencies": failures,
+			})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "ready"})
+		return
+	}
+
+	migrator.mu.Lock()
+	defer migrator.mu.Unlock()
+
+	c.JSON(http.StatusServiceUnavailable, gin.H{
+		"status": "not ready",
+		"migrations": gin.H{
+			"status":     migrator.status,
+			"total":      len(migrations),
+			"applied":    append([]string{}, migrator.applied...),
+			"last_error": migrator.lastError,
+		},
+	})
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"math/big"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Money is a fixed-point amount with two decimal places, stored as integer
+// minor units (cents) so arithmetic never rounds.
+//
+// In JSON it is written as a decimal string ("999.99"). Requests may send
+// either a string or, for older clients, a plain number. Deployments whose
+// clients still expect numbers can set PRICE_JSON_FORMAT=number until
+// they have migrated.
+type Money int64
+
+// defaultCurrency is used for products created without a currency
+const defaultCurrency = "USD"
+
+// moneyAsNumber switches JSON output back to numbers for legacy clients
+var moneyAsNumber = os.Getenv("PRICE_JSON_FORMAT") == "number"
+
+// String formats the amount as a decimal such as "-3.50"
+func (m Money) String() string {
+	sign := ""
+	units := int64(m)
+	if units < 0 {
+		sign = "-"
+		if units == math.MinInt64 {
+			return "-92233720368547758.08"
+		}
+		units = -units
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, units/100, units%100)
+}
+
+// MarshalJSON writes the amount as a decimal string
+func (m Money) MarshalJSON() ([]byte, error) {
+	if moneyAsNumber {
+		return []byte(m.String()), nil
+	}
+	return []byte(strconv.Quote(m.String())), nil
+}
+
+// MarshalText writes the amount as a decimal, for XML and other text
+// formats
+func (m Money) MarshalText() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+// UnmarshalJSON accepts a decimal string or a number with at most two
+// decimal places
+func (m *Money) UnmarshalJSON(data []byte) error {
+	if bytes.Equal(data, []byte("null")) {
+		return nil
+	}
+	text := string(data)
+	if len(data) > 0 && data[0] == '"' {
+		unquoted, err := strconv.Unquote(text)
+		if err != nil {
+			return fmt.Errorf("invalid amount %s", text)
+		}
+		text = unquoted
+	}
+
+	parsed, err := parseMoney(text)
+	if err != nil {
+		return err
+	}
+	*m = parsed
+	return nil
+}
+
+// parseMoney parses a decimal amount such as "12.5" or "1e2"
+func parseMoney(text string) (Money, error) {
+	r, ok := new(big.Rat).SetString(text)
+	if !ok {
+		return 0, fmt.Errorf("invalid amount %q", text)
+	}
+	r.Mul(r, big.NewRat(100, 1))
+	if !r.IsInt() {
+		return 0, fmt.Errorf("amount %q has more than two decimal places", text)
+	}
+	if !r.Num().IsInt64() {
+		return 0, fmt.Errorf("amount %q is out of range", text)
+	}
+	return Money(r.Num().Int64()), nil
+}
+
+// normalizeCurrency upper-cases the currency and applies the default
+func normalizeCurrency(p *Product) {
+	p.Currency = strings.ToUpper(p.Currency)
+	if p.Currency == "" {
+		p.Currency = defaultCurrency
+	}
+}
+
+// validCurrency reports whether code looks like an ISO 4217 currency code
+func validCurrency(code string) bool {
+	if len(code) != 3 {
+		return false
+	}
+	for _, r := range code {
+		if r < 'A' || r > 'Z' {
+			return false
+		}
+	}
+	return true
+}
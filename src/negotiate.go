@@ -0,0 +1,375 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/xml"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Representations of product reads, picked by the Accept header
+const (
+	mimeJSON = "application/json"
+	mimeXML  = "application/xml"
+	mimeCSV  = "text/csv"
+)
+
+// productFormats are what product reads can be served as, JSON first so
+// it wins when the client doesn't mind
+var productFormats = []string{mimeJSON, mimeXML, mimeCSV}
+
+// negotiate picks the offer the Accept header prefers, honoring q-values
+// and wildcards. text/xml counts as XML, and any +json type such as the
+// versioned application/vnd.productstore.v1+json as JSON. No Accept
+// header gets the first offer.
+// Returns: 406 Not Acceptable - Accept rules out every offer (Cat only speaks JSON, XML and CSV!)
+func negotiate(c *gin.Context, offers ...string) (string, bool) {
+	header := c.GetHeader("Accept")
+	if strings.TrimSpace(header) == "" {
+		return offers[0], true
+	}
+
+	best, bestQ := "", 0.0
+	for _, offer := range offers {
+		// The most specific matching range sets the offer's quality
+		q, specificity := 0.0, -1
+		for _, part := range strings.Split(header, ",") {
+			mediaType, params, _ := strings.Cut(part, ";")
+			mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+			switch {
+			case mediaType == "text/xml":
+				mediaType = mimeXML
+			case strings.HasSuffix(mediaType, "+json"):
+				mediaType = mimeJSON
+			}
+
+			s := -1
+			switch {
+			case mediaType == offer:
+				s = 2
+			case strings.HasSuffix(mediaType, "/*") && strings.HasPrefix(offer, strings.TrimSuffix(mediaType, "*")):
+				s = 1
+			case mediaType == "*/*":
+				s = 0
+			}
+			if s <= specificity {
+				continue
+			}
+			specificity, q = s, 1
+			for _, param := range strings.Split(params, ";") {
+				if name, value, ok := strings.Cut(strings.TrimSpace(param), "="); ok && strings.EqualFold(name, "q") {
+					if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+						q = parsed
+					}
+				}
+			}
+		}
+		if q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+	if best == "" {
+		c.JSON(http.StatusNotAcceptable, gin.H{
+			"error":     "None of the accepted types can be served",
+			"available": offers,
+		})
+		return "", false
+	}
+	return best, true
+}
+
+// renderProducts writes a product list in the negotiated format, JSON
+// with only the selected fields
+func renderProducts(c *gin.Context, format string, products []Product, fields fieldSet) {
+	switch format {
+	case mimeXML:
+		c.XML(http.StatusOK, xmlProductList{Count: len(products), Products: products})
+	case mimeCSV:
+		writeProductsCSV(c, products)
+	default:
+		if enveloped(c) {
+			renderProductPage(c, products, fields)
+			return
+		}
+		if fields != nil {
+			c.JSON(http.StatusOK, gin.H{
+				"count":    len(products),
+				"products": fields.projectAll(products),
+			})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"count":    len(products),
+			"products": products,
+		})
+	}
+}
+
+// renderProduct writes one product in the negotiated format, JSON with
+// only the selected fields
+func renderProduct(c *gin.Context, format string, product Product, fields fieldSet) {
+	switch format {
+	case mimeXML:
+		c.XML(http.StatusOK, product)
+	case mimeCSV:
+		writeProductsCSV(c, []Product{product})
+	default:
+		if enveloped(c) {
+			renderProductEnvelope(c, product, fields)
+			return
+		}
+		if fields != nil {
+			c.Data(http.StatusOK, "application/json; charset=utf-8", fields.project(product, nil))
+			return
+		}
+		c.JSON(http.StatusOK, product)
+	}
+}
+
+// xmlProductList is the root element of an XML product list
+type xmlProductList struct {
+	XMLName  xml.Name  `xml:"products"`
+	Count    int       `xml:"count,attr"`
+	Products []Product `xml:"product"`
+}
+
+// xmlProduct is how a product is written as XML. Element names follow
+// the JSON field names, and variant attributes, a map in JSON, become
+// name/value elements.
+type xmlProduct struct {
+	XMLName           xml.Name         `xml:"product"`
+	ID                string           `xml:"id,attr"`
+	Name              string           `xml:"name"`
+	Description       string           `xml:"description"`
+	Category          string           `xml:"category,omitempty"`
+	Price             Money            `xml:"price"`
+	Currency          string           `xml:"currency"`
+	Stock             int              `xml:"stock"`
+	Variants          *xmlVariants     `xml:"variants,omitempty"`
+	LowStockThreshold *int             `xml:"low_stock_threshold,omitempty"`
+	SKU               string           `xml:"sku,omitempty"`
+	GTIN              string           `xml:"gtin,omitempty"`
+	WeightGrams       int              `xml:"weight_grams,omitempty"`
+	Images            *xmlImages       `xml:"images,omitempty"`
+	Badges            *xmlBadges       `xml:"badges,omitempty"`
+	RolloutPercent    *int             `xml:"rollout_percent,omitempty"`
+	Related           *xmlRelated      `xml:"related,omitempty"`
+	PublishAt         *time.Time       `xml:"publish_at,omitempty"`
+	UnpublishAt       *time.Time       `xml:"unpublish_at,omitempty"`
+	ScheduledPrices   *xmlPrices       `xml:"scheduled_prices,omitempty"`
+	SalePrice         *Money           `xml:"sale_price,omitempty"`
+	Components        *xmlComponents   `xml:"components,omitempty"`
+	Translations      *xmlTranslations `xml:"translations,omitempty"`
+	ActiveBadges      *xmlLabels       `xml:"active_badges,omitempty"`
+	Rating            float64          `xml:"rating"`
+	ReviewCount       int              `xml:"review_count"`
+	Version           int64            `xml:"version"`
+	CreatedAt         *time.Time       `xml:"created_at,omitempty"`
+	UpdatedAt         *time.Time       `xml:"updated_at,omitempty"`
+	DeletedAt         *time.Time       `xml:"deleted_at,omitempty"`
+}
+
+// xmlVariants and xmlAttributes are pointers in their parents, so that
+// products without variants and variants without attributes leave the
+// element out
+type xmlVariants struct {
+	Variants []xmlVariant `xml:"variant"`
+}
+
+type xmlVariant struct {
+	SKU        string         `xml:"sku,attr"`
+	GTIN       string         `xml:"gtin,omitempty"`
+	Attributes *xmlAttributes `xml:"attributes,omitempty"`
+	PriceDelta Money          `xml:"price_delta"`
+	Stock      int            `xml:"stock"`
+}
+
+type xmlAttributes struct {
+	Attributes []xmlAttribute `xml:"attribute"`
+}
+
+type xmlImages struct {
+	Images []string `xml:"image"`
+}
+
+type xmlBadges struct {
+	Badges []xmlBadge `xml:"badge"`
+}
+
+type xmlBadge struct {
+	Label string     `xml:",chardata"`
+	From  *time.Time `xml:"from,attr,omitempty"`
+	Until *time.Time `xml:"until,attr,omitempty"`
+}
+
+type xmlRelated struct {
+	Links []xmlRelatedLink `xml:"product"`
+}
+
+type xmlRelatedLink struct {
+	ID   string `xml:"id,attr"`
+	Kind string `xml:"kind,attr"`
+}
+
+type xmlComponents struct {
+	Components []BundleComponent `xml:"product"`
+}
+
+type xmlTranslations struct {
+	Translations []xmlTranslation `xml:"translation"`
+}
+
+type xmlTranslation struct {
+	Locale      string `xml:"locale,attr"`
+	Name        string `xml:"name,omitempty"`
+	Description string `xml:"description,omitempty"`
+}
+
+type xmlPrices struct {
+	Prices []xmlPrice `xml:"price"`
+}
+
+type xmlPrice struct {
+	Price       Money     `xml:",chardata"`
+	EffectiveAt time.Time `xml:"effective_at,attr"`
+}
+
+type xmlLabels struct {
+	Labels []string `xml:"badge"`
+}
+
+type xmlAttribute struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:",chardata"`
+}
+
+// MarshalXML writes a product as a <product> element
+func (p Product) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	x := xmlProduct{
+		ID:                p.ID,
+		Name:              p.Name,
+		Description:       p.Description,
+		Category:          p.Category,
+		Price:             p.Price,
+		Currency:          p.Currency,
+		Stock:             p.Stock,
+		LowStockThreshold: p.LowStockThreshold,
+		SKU:               p.SKU,
+		GTIN:              p.GTIN,
+		WeightGrams:       p.WeightGrams,
+		RolloutPercent:    p.RolloutPercent,
+		PublishAt:         p.PublishAt,
+		SalePrice:         p.SalePrice,
+		UnpublishAt:       p.UnpublishAt,
+		Rating:            p.Rating,
+		ReviewCount:       p.ReviewCount,
+		Version:           p.Version,
+		DeletedAt:         p.DeletedAt,
+	}
+	if !p.CreatedAt.IsZero() {
+		x.CreatedAt = &p.CreatedAt
+	}
+	if !p.UpdatedAt.IsZero() {
+		x.UpdatedAt = &p.UpdatedAt
+	}
+	if len(p.Images) > 0 {
+		x.Images = &xmlImages{Images: p.Images}
+	}
+	if len(p.Badges) > 0 {
+		x.Badges = &xmlBadges{}
+	}
+	for _, b := range p.Badges {
+		x.Badges.Badges = append(x.Badges.Badges, xmlBadge{Label: b.Label, From: b.From, Until: b.Until})
+	}
+	if len(p.ScheduledPrices) > 0 {
+		x.ScheduledPrices = &xmlPrices{}
+	}
+	for _, sp := range p.ScheduledPrices {
+		x.ScheduledPrices.Prices = append(x.ScheduledPrices.Prices, xmlPrice{Price: sp.Price, EffectiveAt: sp.EffectiveAt})
+	}
+	if len(p.Related) > 0 {
+		x.Related = &xmlRelated{}
+	}
+	for _, link := range p.Related {
+		x.Related.Links = append(x.Related.Links, xmlRelatedLink{ID: link.ID, Kind: link.Kind})
+	}
+	if len(p.Components) > 0 {
+		x.Components = &xmlComponents{Components: p.Components}
+	}
+	if len(p.Translations) > 0 {
+		x.Translations = &xmlTranslations{}
+	}
+	for _, locale := range slices.Sorted(maps.Keys(p.Translations)) {
+		t := p.Translations[locale]
+		x.Translations.Translations = append(x.Translations.Translations, xmlTranslation{Locale: locale, Name: t.Name, Description: t.Description})
+	}
+	if len(p.ActiveBadges) > 0 {
+		x.ActiveBadges = &xmlLabels{Labels: p.ActiveBadges}
+	}
+	if len(p.Variants) > 0 {
+		x.Variants = &xmlVariants{}
+	}
+	for _, v := range p.Variants {
+		xv := xmlVariant{SKU: v.SKU, GTIN: v.GTIN, PriceDelta: v.PriceDelta, Stock: v.Stock}
+		if len(v.Attributes) > 0 {
+			xv.Attributes = &xmlAttributes{}
+		}
+		for _, name := range slices.Sorted(maps.Keys(v.Attributes)) {
+			xv.Attributes.Attributes = append(xv.Attributes.Attributes, xmlAttribute{Name: name, Value: v.Attributes[name]})
+		}
+		x.Variants.Variants = append(x.Variants.Variants, xv)
+	}
+	return e.Encode(x)
+}
+
+// productCSVHeader are the columns of CSV product lists. Variants don't
+// fit a row; their SKUs are listed, separated by semicolons, as are
+// image URLs.
+var productCSVHeader = []string{"id", "name", "description", "category", "price", "currency", "stock", "low_stock_threshold", "rating", "review_count", "version", "updated_at", "deleted_at", "variant_skus", "gtin", "weight_grams", "images", "sku"}
+
+// writeProductsCSV writes products as CSV with a header row
+func writeProductsCSV(c *gin.Context, products []Product) {
+	c.Header("Content-Type", mimeCSV+"; charset=utf-8")
+	c.Status(http.StatusOK)
+	encodeProductsCSV(c.Writer, products)
+}
+
+// encodeProductsCSV writes the CSV rows of products, header first
+func encodeProductsCSV(out io.Writer, products []Product) error {
+	w := csv.NewWriter(out)
+	w.Write(productCSVHeader)
+	for _, p := range products {
+		threshold, updated, deleted, weight := "", "", "", ""
+		if p.LowStockThreshold != nil {
+			threshold = strconv.Itoa(*p.LowStockThreshold)
+		}
+		if !p.UpdatedAt.IsZero() {
+			updated = p.UpdatedAt.Format(time.RFC3339)
+		}
+		if p.DeletedAt != nil {
+			deleted = p.DeletedAt.Format(time.RFC3339)
+		}
+		if p.WeightGrams != 0 {
+			weight = strconv.Itoa(p.WeightGrams)
+		}
+		skus := make([]string, len(p.Variants))
+		for i, v := range p.Variants {
+			skus[i] = v.SKU
+		}
+		w.Write([]string{
+			p.ID, p.Name, p.Description, p.Category, p.Price.String(), p.Currency,
+			strconv.Itoa(p.Stock), threshold, strconv.FormatFloat(p.Rating, 'f', -1, 64),
+			strconv.Itoa(p.ReviewCount), strconv.FormatInt(p.Version, 10), updated, deleted,
+			strings.Join(skus, ";"), p.GTIN, weight, strings.Join(p.Images, ";"), p.SKU,
+		})
+	}
+	w.Flush()
+	return w.Error()
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// OutboxMessage is an event waiting in the outbox for a destination.
+// Seq orders the outbox and names the message in delivered records.
+type OutboxMessage struct {
+	Seq         int64        `json:"seq"`
+	Destination string       `json:"destination"`
+	Message     EventMessage `json:"message"`
+}
+
+// Outbox makes event delivery survive crashes. With WAL_DIR set, the
+// events of a write are logged in the same WAL record as the write, so
+// both are on disk or neither is, and a destination's sender takes them
+// from here rather than from its in-memory queue. Each is marked
+// delivered once it's sent, or given up on, with a record of its own;
+// on start, the log is replayed and the messages not marked are sent
+// again. A crash between sending and marking sends a message twice,
+// which consumers already drop by the message ID.
+type Outbox struct {
+	mu      sync.Mutex
+	seq     int64
+	pending map[string][]OutboxMessage // by destination, oldest first
+	wake    map[string]chan struct{}
+}
+
+// Global outbox, nil unless WAL_DIR and EVENT_DESTINATIONS are set
+var outbox = newOutbox()
+
+func newOutbox() *Outbox {
+	if walDir == "" || eventDelivery == nil {
+		return nil
+	}
+	o := &Outbox{
+		pending: make(map[string][]OutboxMessage),
+		wake:    make(map[string]chan struct{}),
+	}
+	for _, d := range eventDelivery.destinations {
+		o.wake[d.Name] = make(chan struct{}, 1)
+	}
+	return o
+}
+
+// messages returns the outbox messages of an event, one per destination
+// that wants it, for the WAL record of the write. Like enqueue, nothing
+// is sent before delivery has started. Callers must hold store.mu.
+func (o *Outbox) messages(e ProductEvent) []OutboxMessage {
+	if !eventDelivery.running.Load() {
+		return nil
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	var list []OutboxMessage
+	msg := newEventMessage(e)
+	for _, d := range eventDelivery.destinations {
+		if !d.wants(e) {
+			continue
+		}
+		o.seq++
+		list = append(list, OutboxMessage{Seq: o.seq, Destination: d.Name, Message: d.ordered(msg)})
+	}
+	return list
+}
+
+// add makes messages available to their senders, once their record is in
+// the WAL. Messages for a destination that's no longer configured are
+// dropped.
+func (o *Outbox) add(list []OutboxMessage) {
+	if o == nil || len(list) == 0 {
+		return
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	for _, m := range list {
+		o.seq = max(o.seq, m.Seq)
+		wake, exists := o.wake[m.Destination]
+		if !exists {
+			log.Printf("outbox: dropping event %s for unknown destination %s", m.Message.ID, m.Destination)
+			continue
+		}
+		o.pending[m.Destination] = append(o.pending[m.Destination], m)
+		select {
+		case wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// pendingMessages returns every message not yet delivered, in order, for
+// compaction to carry over into the new log
+func (o *Outbox) pendingMessages() []OutboxMessage {
+	if o == nil {
+		return nil
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	var list []OutboxMessage
+	for _, messages := range o.pending {
+		list = append(list, messages...)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Seq < list[j].Seq })
+	return list
+}
+
+// next returns the oldest message of a destination, waiting for one
+func (o *Outbox) next(destination string) OutboxMessage {
+	for {
+		o.mu.Lock()
+		if messages := o.pending[destination]; len(messages) > 0 {
+			o.mu.Unlock()
+			return messages[0]
+		}
+		o.mu.Unlock()
+		<-o.wake[destination]
+	}
+}
+
+// delivered logs that a destination's oldest message is done, then takes
+// it off the outbox. A message whose record isn't logged stays pending, so
+// a restart sends it again rather than losing it.
+func (o *Outbox) delivered(m OutboxMessage) error {
+	if err := store.wal.append(walRecord{Op: walDelivered, Delivered: []int64{m.Seq}}); err != nil {
+		return err
+	}
+	o.mu.Lock()
+	o.pending[m.Destination] = o.pending[m.Destination][1:]
+	o.mu.Unlock()
+	return nil
+}
+
+// dispatch sends a destination's messages in order, each retried as its
+// delivery asks before the next one. A message that's sent but can't be
+// marked delivered holds up the ones after it until the mark is logged.
+func (o *Outbox) dispatch(ed *EventDelivery, d *EventDestination) {
+	for {
+		m := o.next(d.Name)
+		ed.sendWithRetries(d, m.Message)
+		backoff := deliveryBackoff
+		for {
+			err := o.delivered(m)
+			if err == nil {
+				break
+			}
+			log.Printf("outbox: marking event %s delivered to %s: %v", m.Message.ID, d.Name, err)
+			time.Sleep(backoff)
+			backoff = min(backoff*2, deliveryMaxBackoff)
+		}
+	}
+}
+
+// OutboxStatus is what a destination has waiting in the outbox
+type OutboxStatus struct {
+	Destination string     `json:"destination"`
+	Pending     int        `json:"pending"`
+	OldestAt    *time.Time `json:"oldest_at,omitempty"`
+}
+
+// getOutbox shows the events waiting in the outbox, per destination
+// Returns: 200 OK - Outbox status (Cat guarding the mailbox!)
+// Returns: 401 Unauthorized - Admin access required
+// Returns: 404 Not Found - The outbox is off
+func getOutbox(c *gin.Context) {
+	if outbox == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "The outbox needs WAL_DIR and EVENT_DESTINATIONS"})
+		return
+	}
+	outbox.mu.Lock()
+	statuses := make([]OutboxStatus, 0, len(outbox.wake))
+	total := 0
+	for name := range outbox.wake {
+		status := OutboxStatus{Destination: name, Pending: len(outbox.pending[name])}
+		if status.Pending > 0 {
+			oldest := outbox.pending[name][0].Message.At
+			status.OldestAt = &oldest
+		}
+		total += status.Pending
+		statuses = append(statuses, status)
+	}
+	outbox.mu.Unlock()
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Destination < statuses[j].Destination })
+
+	c.JSON(http.StatusOK, gin.H{
+		"pending":      total,
+		"destinations": statuses,
+	})
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Connection pool settings shared by every outbound client. Each backend
+// (S3, SNS, Slack, exchange rates, cluster peers, Redis) keeps its own pool.
+var (
+	// poolMaxOpen caps connections per host, 0 for no cap, HTTP_POOL_MAX_OPEN
+	poolMaxOpen = envInt("HTTP_POOL_MAX_OPEN", 32)
+	// poolMaxIdle is how many idle connections per host are kept, HTTP_POOL_MAX_IDLE
+	poolMaxIdle = envInt("HTTP_POOL_MAX_IDLE", 8)
+	// poolIdleTimeout closes connections idle this long, HTTP_POOL_IDLE_TIMEOUT
+	poolIdleTimeout = envDuration("HTTP_POOL_IDLE_TIMEOUT", 90*time.Second)
+	// poolMaxLifetime recycles connections at least this often, so new DNS
+	// answers get picked up, 0 to keep them, HTTP_POOL_MAX_LIFETIME
+	poolMaxLifetime = envDuration("HTTP_POOL_MAX_LIFETIME", 10*time.Minute)
+)
+
+// connPool is the connection pool of one outbound client, with the stats
+// database/sql keeps for its pools
+type connPool struct {
+	name      string
+	maxOpen   int
+	maxIdle   int
+	transport *http.Transport // nil for non-HTTP pools
+
+	open      atomic.Int64
+	inUse     atomic.Int64
+	dials     atomic.Int64
+	reused    atomic.Int64
+	waitCount atomic.Int64
+	waitTime  atomic.Int64 // nanoseconds
+}
+
+// PoolStats is a pool's entry in the connection_pools metric
+type PoolStats struct {
+	MaxOpen        int     `json:"max_open"`
+	MaxIdle        int     `json:"max_idle"`
+	Open           int64   `json:"open"`
+	InUse          int64   `json:"in_use"`
+	Idle           int64   `json:"idle"`
+	Dials          int64   `json:"dials"`
+	Reused         int64   `json:"reused"`
+	WaitCount      int64   `json:"wait_count"`
+	WaitDurationMS float64 `json:"wait_duration_ms"`
+}
+
+var (
+	poolsMu sync.Mutex
+	pools   []*connPool
+)
+
+func init() {
+	expvar.Publish("connection_pools", expvar.Func(func() any {
+		poolsMu.Lock()
+		defer poolsMu.Unlock()
+
+		stats := make(map[string]PoolStats, len(pools))
+		for _, p := range pools {
+			stats[p.name] = p.stats()
+		}
+		return stats
+	}))
+}
+
+// newPooledClient returns an HTTP client using the instrumented
+// connection pool published as name in connection_pools. Clients of the
+// same backend share its pool.
+func newPooledClient(name string, timeout time.Duration) *http.Client {
+	poolsMu.Lock()
+	defer poolsMu.Unlock()
+
+	for _, p := range pools {
+		if p.name == name {
+			return &http.Client{Timeout: timeout, Transport: p}
+		}
+	}
+
+	p := &connPool{name: name, maxOpen: poolMaxOpen, maxIdle: poolMaxIdle}
+	dialer := &net.Dialer{Timeout: 5 * time.Second, KeepAlive: 30 * time.Second}
+	p.transport = &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		MaxConnsPerHost:     poolMaxOpen,
+		MaxIdleConns:        poolMaxIdle * 4,
+		MaxIdleConnsPerHost: poolMaxIdle,
+		IdleConnTimeout:     poolIdleTimeout,
+		TLSHandshakeTimeout: 10 * time.Second,
+		ForceAttemptHTTP2:   true,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := dialer.DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			p.open.Add(1)
+			p.dials.Add(1)
+			return &pooledConn{Conn: conn, pool: p}, nil
+		},
+	}
+
+	pools = append(pools, p)
+	if poolMaxLifetime > 0 {
+		go p.recycle(poolMaxLifetime)
+	}
+	return &http.Client{Timeout: timeout, Transport: p}
+}
+
+// RoundTrip sends a request through the pool, timing how long it waited
+// for a connection. A connection stays in use until the body is closed.
+func (p *connPool) RoundTrip(req *http.Request) (*http.Response, error) {
+	var got atomic.Bool
+	var start time.Time
+	waited := false
+	trace := &httptrace.ClientTrace{
+		GetConn: func(string) {
+			start = time.Now()
+			waited = p.maxOpen > 0 && p.inUse.Load() >= int64(p.maxOpen)
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			got.Store(true)
+			p.inUse.Add(1)
+			if info.Reused {
+				p.reused.Add(1)
+			}
+			if waited {
+				p.waitCount.Add(1)
+				p.waitTime.Add(int64(time.Since(start)))
+			}
+		},
+	}
+
+	resp, err := p.transport.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+	if err != nil {
+		if got.Load() {
+			p.inUse.Add(-1)
+		}
+		return nil, err
+	}
+	resp.Body = &pooledBody{ReadCloser: resp.Body, release: sync.OnceFunc(func() { p.inUse.Add(-1) })}
+	return resp, nil
+}
+
+// registerPool publishes the stats of a pool that isn't an HTTP client
+func registerPool(name string, maxOpen, maxIdle int) *connPool {
+	poolsMu.Lock()
+	defer poolsMu.Unlock()
+
+	p := &connPool{name: name, maxOpen: maxOpen, maxIdle: maxIdle}
+	pools = append(pools, p)
+	return p
+}
+
+// recycle closes idle connections every lifetime, so none is reused for
+// much longer than that
+func (p *connPool) recycle(lifetime time.Duration) {
+	ticker := time.NewTicker(lifetime)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		p.transport.CloseIdleConnections()
+	}
+}
+
+func (p *connPool) stats() PoolStats {
+	open, inUse := p.open.Load(), p.inUse.Load()
+	return PoolStats{
+		MaxOpen:        p.maxOpen,
+		MaxIdle:        p.maxIdle,
+		Open:           open,
+		InUse:          inUse,
+		Idle:           max(open-inUse, 0),
+		Dials:          p.dials.Load(),
+		Reused:         p.reused.Load(),
+		WaitCount:      p.waitCount.Load(),
+		WaitDurationMS: float64(time.Duration(p.waitTime.Load()).Microseconds()) / 1000,
+	}
+}
+
+// pooledConn counts a connection as open until it's closed
+type pooledConn struct {
+	net.Conn
+	pool   *connPool
+	closed atomic.Bool
+}
+
+func (c *pooledConn) Close() error {
+	if c.closed.CompareAndSwap(false, true) {
+		c.pool.open.Add(-1)
+	}
+	return c.Conn.Close()
+}
+
+// pooledBody hands the connection back when the body is closed
+type pooledBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *pooledBody) Close() error {
+	b.release()
+	return b.ReadCloser.Close()
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// PricingEngine computes what a product is charged at. Quotes and price
+// explanations both go through it, so a price is derived the same way
+// wherever it's shown.
+type PricingEngine interface {
+	Price(ctx context.Context, req PriceRequest) (PriceResult, error)
+}
+
+// PriceRequest is a unit of a product to price
+type PriceRequest struct {
+	Product  Product
+	SKU      string  // the variant, required for products that have variants
+	Currency string  // the product's own when empty
+	Coupon   *Coupon // a usable coupon to take off the unit, if any
+}
+
+// PriceResult is a unit price and how it was derived
+type PriceResult struct {
+	Price    Money       `json:"price"`
+	Currency string      `json:"currency"`
+	Steps    []PriceStep `json:"steps"`
+}
+
+// PriceStep is one stage of a price's derivation. Stages that don't apply
+// to the product are listed too, so every explanation has the same steps.
+type PriceStep struct {
+	Stage    string `json:"stage"`
+	Applied  bool   `json:"applied"`
+	Detail   string `json:"detail"`
+	Price    Money  `json:"price"` // after the stage
+	Currency string `json:"currency"`
+}
+
+// pricingStage is one stage of the evaluation order. apply changes the
+// price in result and describes what it did; it returns false when the
+// stage doesn't apply.
+type pricingStage struct {
+	name  string
+	apply func(ctx context.Context, req PriceRequest, result *PriceResult) (bool, string, error)
+}
+
+// pricingStages run in this order on every price. Sale prices replace the
+// product's price, not its variants' deltas, and coupons are taken off in
+// the currency the price is quoted in, as baskets are.
+var pricingStages = []pricingStage{
+	{name: "base", apply: basePriceStage},
+	{name: "sale_price", apply: salePriceStage},
+	{name: "variant", apply: variantPriceStage},
+	{name: "currency", apply: currencyPriceStage},
+	{name: "coupon", apply: couponPriceStage},
+}
+
+// stagedPricing runs its stages in order
+type stagedPricing struct {
+	stages []pricingStage
+}
+
+func (e stagedPricing) Price(ctx context.Context, req PriceRequest) (PriceResult, error) {
+	result := PriceResult{Currency: req.Product.Currency, Steps: make([]PriceStep, 0, len(e.stages))}
+	for _, stage := range e.stages {
+		applied, detail, err := stage.apply(ctx, req, &result)
+		if err != nil {
+			return PriceResult{}, err
+		}
+		result.Steps = append(result.Steps, PriceStep{
+			Stage:    stage.name,
+			Applied:  applied,
+			Detail:   detail,
+			Price:    result.Price,
+			Currency: result.Currency,
+		})
+	}
+	return result, nil
+}
+
+// pricing is the engine every price is computed with
+var pricing PricingEngine = stagedPricing{stages: pricingStages}
+
+func basePriceStage(ctx context.Context, req PriceRequest, result *PriceResult) (bool, string, error) {
+	result.Price = req.Product.Price
+	return true, "List price", nil
+}
+
+func salePriceStage(ctx context.Context, req PriceRequest, result *PriceResult) (bool, string, error) {
+	if req.Product.SalePrice == nil {
+		return false, "Not on sale", nil
+	}
+	result.Price = *req.Product.SalePrice
+	return true, "Sale price replaces the list price", nil
+}
+
+func variantPriceStage(ctx context.Context, req PriceRequest, result *PriceResult) (bool, string, error) {
+	p := req.Product
+	switch {
+	case req.SKU != "":
+		v := p.variantIndex(req.SKU)
+		if v < 0 {
+			return false, "", basketError(fmt.Sprintf("variant %q not found", req.SKU))
+		}
+		result.Price += p.Variants[v].PriceDelta
+		return true, fmt.Sprintf("Variant %s adds %s", req.SKU, p.Variants[v].PriceDelta), nil
+	case len(p.Variants) > 0:
+		return false, "", basketError(fmt.Sprintf("product %q has variants, sku is required", p.ID))
+	}
+	return false, "No variant", nil
+}
+
+func currencyPriceStage(ctx context.Context, req PriceRequest, result *PriceResult) (bool, string, error) {
+	if req.Currency == "" || req.Currency == result.Currency {
+		return false, "Priced in " + result.Currency, nil
+	}
+	rate, err := exchangeRate(ctx, result.Currency, req.Currency)
+	if err != nil {
+		return false, "", err
+	}
+	detail := fmt.Sprintf("Converted from %s at %s", result.Currency, rate.FloatString(6))
+	result.Price = result.Price.convert(rate)
+	result.Currency = req.Currency
+	return true, detail, nil
+}
+
+func couponPriceStage(ctx context.Context, req PriceRequest, result *PriceResult) (bool, string, error) {
+	cp := req.Coupon
+	switch {
+	case cp == nil:
+		return false, "No coupon", nil
+	case !cp.appliesTo(req.Product):
+		return false, fmt.Sprintf("Coupon %s doesn't apply to the product", cp.Code), nil
+	case cp.Type == "percentage":
+		discount := result.Price.convert(big.NewRat(int64(cp.Percent), 100))
+		result.Price -= discount
+		return true, fmt.Sprintf("Coupon %s takes %d%% off", cp.Code, cp.Percent), nil
+	}
+	rate, err := exchangeRate(ctx, cp.Currency, result.Currency)
+	if err != nil {
+		return false, "", err
+	}
+	discount := min(cp.Amount.convert(rate), result.Price)
+	result.Price -= discount
+	return true, fmt.Sprintf("Coupon %s takes %s off", cp.Code, discount), nil
+}
+
+// explainPrice shows how the price of a product is derived, stage by
+// stage: ?sku= picks a variant, ?currency=EUR converts and ?coupon=CODE
+// takes a coupon off one unit, as a quote would
+// Returns: 200 OK - The price and its steps (Cat doing the maths!)
+// Returns: 400 Bad Request - Unsupported currency, or a missing or unknown sku
+// Returns: 404 Not Found - Product doesn't exist
+// Returns: 502 Bad Gateway - Exchange rate provider unavailable
+// Returns: 504 Gateway Timeout - Took longer than REQUEST_TIMEOUT
+func explainPrice(c *gin.Context) {
+	id := c.Param("id")
+	currency, ok := requestedCurrency(c)
+	if !ok {
+		return
+	}
+
+	store.mu.RLock()
+	product, exists := store.getShown(c, id)
+	store.mu.RUnlock()
+	if !exists {
+		productNotFound(c, id)
+		return
+	}
+
+	req := PriceRequest{Product: product, SKU: c.Query("sku"), Currency: currency}
+	var coupon *CouponResult
+	if code := c.Query("coupon"); code != "" {
+		code = normalizeCouponCode(code)
+		coupon = &CouponResult{Code: code}
+
+		coupons.mu.RLock()
+		cp, exists := coupons.coupons[code]
+		coupons.mu.RUnlock()
+
+		switch {
+		case !exists:
+			coupon.Reason = "Coupon not found"
+		case cp.unusableReason(time.Now()) != "":
+			coupon.Reason = cp.unusableReason(time.Now())
+		case !cp.appliesTo(product):
+			coupon.Reason = "Coupon doesn't apply to the product"
+		default:
+			req.Coupon = &cp
+			coupon.Applied = true
+		}
+	}
+
+	result, err := pricing.Price(c.Request.Context(), req)
+	if err != nil {
+		var invalid basketError
+		if errors.As(err, &invalid) {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error":   "Invalid price request",
+				"details": err.Error(),
+			})
+		} else {
+			conversionFailed(c, err)
+		}
+		return
+	}
+
+	response := gin.H{
+		"product_id": product.ID,
+		"price":      result.Price,
+		"currency":   result.Currency,
+		"steps":      result.Steps,
+	}
+	if req.SKU != "" {
+		response["sku"] = req.SKU
+	}
+	if coupon != nil {
+		response["coupon"] = coupon
+	}
+	c.JSON(http.StatusOK, response)
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// QuoteRequest is a basket to price, optionally with a coupon code
+type QuoteRequest struct {
+	Items    []QuoteItem `json:"items" binding:"required,min=1,dive"`
+	Coupon   string      `json:"coupon"`
+	Currency string      `json:"currency"`
+}
+
+// QuoteItem is one basket line. SKU selects a variant and is required for
+// products that have variants.
+type QuoteItem struct {
+	ProductID string `json:"product_id" binding:"required"`
+	SKU       string `json:"sku,omitempty"`
+	Quantity  int    `json:"quantity" binding:"required,min=1"`
+}
+
+// QuoteLine is a priced basket line
+type QuoteLine struct {
+	ProductID string `json:"product_id"`
+	SKU       string `json:"sku,omitempty"`
+	Quantity  int    `json:"quantity"`
+	UnitPrice Money  `json:"unit_price"`
+	Subtotal  Money  `json:"subtotal"`
+	Discount  Money  `json:"discount"`
+	Total     Money  `json:"total"`
+	eligible  bool
+}
+
+// Quote is the priced basket
+type Quote struct {
+	Currency string        `json:"currency"`
+	Lines    []QuoteLine   `json:"lines"`
+	Subtotal Money         `json:"subtotal"`
+	Discount Money         `json:"discount"`
+	Total    Money         `json:"total"`
+	Coupon   *CouponResult `json:"coupon,omitempty"`
+}
+
+// CouponResult tells the client whether their coupon was applied
+type CouponResult struct {
+	Code    string `json:"code"`
+	Applied bool   `json:"applied"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+// basketError reports a problem with what was asked to be priced, as
+// opposed to a failing rate provider
+type basketError string
+
+func (e basketError) Error() string { return string(e) }
+
+// priceLines looks up unit prices for a basket in the quote currency,
+// through the pricing engine
+func priceLines(c *gin.Context, req QuoteRequest, currency string) ([]QuoteLine, []Product, error) {
+	products := make([]Product, 0, len(req.Items))
+	store.mu.RLock()
+	for i, item := range req.Items {
+		product, exists := store.getShown(c, item.ProductID)
+		if !exists {
+			store.mu.RUnlock()
+			return nil, nil, basketError(fmt.Sprintf("item %d: product %q not found", i, item.ProductID))
+		}
+		products = append(products, product)
+	}
+	store.mu.RUnlock()
+
+	// Rates may come from a remote provider, so price outside the lock.
+	// Coupons are taken off the whole basket, not each unit.
+	lines := make([]QuoteLine, 0, len(req.Items))
+	for i, item := range req.Items {
+		priced, err := pricing.Price(c.Request.Context(), PriceRequest{Product: products[i], SKU: item.SKU, Currency: currency})
+		if err != nil {
+			var invalid basketError
+			if errors.As(err, &invalid) {
+				return nil, nil, basketError(fmt.Sprintf("item %d: %s", i, invalid))
+			}
+			return nil, nil, err
+		}
+		unit := priced.Price
+
+		lines = append(lines, QuoteLine{
+			ProductID: item.ProductID,
+			SKU:       item.SKU,
+			Quantity:  item.Quantity,
+			UnitPrice: unit,
+			Subtotal:  unit * Money(item.Quantity),
+		})
+	}
+	return lines, products, nil
+}
+
+// applyCoupon computes per-line discounts. Fixed amounts are spread over
+// eligible lines in proportion to their subtotal.
+func applyCoupon(c *gin.Context, cp Coupon, lines []QuoteLine, products []Product, currency string) error {
+	var eligibleSubtotal Money
+	for i := range lines {
+		lines[i].eligible = cp.appliesTo(products[i])
+		if lines[i].eligible {
+			eligibleSubtotal += lines[i].Subtotal
+		}
+	}
+	if eligibleSubtotal == 0 {
+		return nil
+	}
+
+	if cp.Type == "percentage" {
+		pct := big.NewRat(int64(cp.Percent), 100)
+		for i := range lines {
+			if lines[i].eligible {
+				lines[i].Discount = lines[i].Subtotal.convert(pct)
+			}
+		}
+		return nil
+	}
+
+	rate, err := exchangeRate(c.Request.Context(), cp.Currency, currency)
+	if err != nil {
+		return err
+	}
+	discount := min(cp.Amount.convert(rate), eligibleSubtotal)
+
+	remaining, last := discount, -1
+	for i := range lines {
+		if !lines[i].eligible {
+			continue
+		}
+		share := Money(int64(discount) * int64(lines[i].Subtotal) / int64(eligibleSubtotal))
+		lines[i].Discount = share
+		remaining -= share
+		last = i
+	}
+	lines[last].Discount += remaining
+	return nil
+}
+
+// quoteBasket prices a basket and applies a coupon. Quotes never consume
+// coupon uses.
+// Returns: 200 OK - Priced basket (Cat with a shopping bag!)
+// Returns: 400 Bad Request - Invalid basket or unsupported currency
+// Returns: 502 Bad Gateway - Exchange rate provider unavailable
+func quoteBasket(c *gin.Context) {
+	var req QuoteRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":   "Invalid quote request",
+			"details": err.Error(),
+		})
+		return
+	}
+	currency := strings.ToUpper(req.Currency)
+	if currency == "" {
+		currency = defaultCurrency
+	}
+	if !validCurrency(currency) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":    "Currency must be an ISO 4217 code",
+			"currency": currency,
+		})
+		return
+	}
+
+	lines, products, err := priceLines(c, req, currency)
+	if err != nil {
+		var invalid basketError
+		if errors.As(err, &invalid) {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error":   "Invalid quote request",
+				"details": err.Error(),
+			})
+		} else {
+			conversionFailed(c, err)
+		}
+		return
+	}
+
+	quote := Quote{Currency: currency}
+	if req.Coupon != "" {
+		code := normalizeCouponCode(req.Coupon)
+		quote.Coupon = &CouponResult{Code: code}
+
+		coupons.mu.RLock()
+		cp, exists := coupons.coupons[code]
+		coupons.mu.RUnlock()
+
+		switch {
+		case !exists:
+			quote.Coupon.Reason = "Coupon not found"
+		case cp.unusableReason(time.Now()) != "":
+			quote.Coupon.Reason = cp.unusableReason(time.Now())
+		default:
+			if err := applyCoupon(c, cp, lines, products, currency); err != nil {
+				conversionFailed(c, err)
+				return
+			}
+			quote.Coupon.Applied = true
+		}
+	}
+
+	for i := range lines {
+		lines[i].Total = lines[i].Subtotal - lines[i].Discount
+		quote.Subtotal += lines[i].Subtotal
+		quote.Discount += lines[i].Discount
+		quote.Total += lines[i].Total
+	}
+	if quote.Coupon != nil && quote.Coupon.Applied && quote.Discount == 0 {
+		quote.Coupon.Applied = false
+		quote.Coupon.Reason = "Coupon doesn't apply to any item in the basket"
+	}
+	quote.Lines = lines
+
+	c.JSON(http.StatusOK, quote)
+}
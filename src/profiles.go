@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// defaultProfile is the profile of writes that don't name one. It only
+// has the base rules every product must pass.
+const defaultProfile = "internal"
+
+// profileFields are the fields a profile can require
+var profileFields = []string{"description", "category", "gtin", "weight_grams", "images", "low_stock_threshold", "variants"}
+
+// ValidationProfile adds rules on top of the base validation, for the
+// channels a product is sold through. A marketplace wants images, a
+// weight and a GTIN before it lists anything; the internal catalog
+// doesn't.
+type ValidationProfile struct {
+	Name                 string   `json:"name"`
+	Description          string   `json:"description,omitempty"`
+	Requires             []string `json:"requires"`
+	MinImages            int      `json:"min_images,omitempty"`
+	MinDescriptionLength int      `json:"min_description_length,omitempty"`
+}
+
+// Global validation profiles by name
+var validationProfiles = newValidationProfiles()
+
+// newValidationProfiles returns the built-in profiles, plus those in
+// VALIDATION_PROFILES, a JSON array of profiles. A profile there with a
+// built-in name replaces it.
+func newValidationProfiles() map[string]ValidationProfile {
+	profiles := map[string]ValidationProfile{
+		defaultProfile: {
+			Name:        defaultProfile,
+			Description: "Base rules only",
+			Requires:    []string{},
+		},
+		"marketplace-ready": {
+			Name:                 "marketplace-ready",
+			Description:          "Everything marketplaces need to list a product",
+			Requires:             []string{"description", "category", "gtin", "weight_grams", "images"},
+			MinImages:            1,
+			MinDescriptionLength: 20,
+		},
+	}
+	raw := os.Getenv("VALIDATION_PROFILES")
+	if raw == "" {
+		return profiles
+	}
+	var configured []ValidationProfile
+	if err := json.Unmarshal([]byte(raw), &configured); err != nil {
+		panic(fmt.Sprintf("invalid VALIDATION_PROFILES: %v", err))
+	}
+	for _, p := range configured {
+		if !mappingName.MatchString(p.Name) {
+			panic(fmt.Sprintf("invalid VALIDATION_PROFILES: bad profile name %q", p.Name))
+		}
+		for _, field := range p.Requires {
+			if !slices.Contains(profileFields, field) {
+				panic(fmt.Sprintf("invalid VALIDATION_PROFILES: profile %s can't require %q", p.Name, field))
+			}
+		}
+		if p.Requires == nil {
+			p.Requires = []string{}
+		}
+		profiles[p.Name] = p
+	}
+	return profiles
+}
+
+// gaps returns what p lacks to pass the profile, as violations. It
+// doesn't repeat the base rules, so p should already be normalized.
+func (vp ValidationProfile) gaps(p *Product) []Violation {
+	violations := []Violation{}
+	message := fmt.Sprintf("Required by the %s profile", vp.Name)
+	for _, field := range vp.Requires {
+		missing := false
+		switch field {
+		case "description":
+			missing = p.Description == ""
+		case "category":
+			missing = p.Category == ""
+		case "gtin":
+			missing = p.GTIN == ""
+		case "weight_grams":
+			missing = p.WeightGrams == 0
+		case "images":
+			missing = len(p.Images) == 0
+		case "low_stock_threshold":
+			missing = p.LowStockThreshold == nil
+		case "variants":
+			missing = len(p.Variants) == 0
+		}
+		if missing {
+			violations = append(violations, Violation{Code: violationRequired, Field: field, Message: message})
+		}
+	}
+	if n := len(p.Images); n > 0 && n < vp.MinImages {
+		violations = append(violations, Violation{Code: violationOutOfRange, Field: "images", Message: fmt.Sprintf("The %s profile needs at least %d images", vp.Name, vp.MinImages)})
+	}
+	if n := utf8.RuneCountInString(p.Description); n > 0 && n < vp.MinDescriptionLength {
+		violations = append(violations, Violation{Code: violationOutOfRange, Field: "description", Message: fmt.Sprintf("The %s profile needs at least %d characters", vp.Name, vp.MinDescriptionLength)})
+	}
+	return violations
+}
+
+// writeProfile returns the profile named by the profile query parameter
+// of a write, the internal one when there's none
+// Returns: 400 Bad Request - Unknown profile (Cat never heard of that channel!)
+func writeProfile(c *gin.Context) (ValidationProfile, bool) {
+	name := strings.TrimSpace(c.DefaultQuery("profile", defaultProfile))
+	profile, ok := validationProfiles[name]
+	if !ok {
+		invalidRequest(c, "Unknown validation profile", []Violation{{
+			Code:    violationInvalid,
+			Field:   "profile",
+			Message: fmt.Sprintf("Must be one of %s", strings.Join(profileNames(), ", ")),
+		}})
+	}
+	return profile, ok
+}
+
+// profileNames lists the profile names in order
+func profileNames() []string {
+	names := make([]string, 0, len(validationProfiles))
+	for name := range validationProfiles {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// getValidationProfiles lists the validation profiles
+// Returns: 200 OK - Success
+func getValidationProfiles(c *gin.Context) {
+	profiles := make([]ValidationProfile, 0, len(validationProfiles))
+	for _, name := range profileNames() {
+		profiles = append(profiles, validationProfiles[name])
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"count":    len(profiles),
+		"profiles": profiles,
+	})
+}
+
+// validateProduct checks a stored product against a profile without
+// changing it, listing the gaps to fill before it passes
+// Returns: 200 OK - The result, valid or not (Cat with a checklist!)
+// Returns: 400 Bad Request - Unknown profile
+// Returns: 404 Not Found - Product doesn't exist (Cat hiding in a box!)
+func validateProduct(c *gin.Context) {
+	id := c.Param("id")
+	profile, ok := writeProfile(c)
+	if !ok {
+		return
+	}
+
+	store.mu.RLock()
+	product, exists := store.getShown(c, id)
+	store.mu.RUnlock()
+	if !exists {
+		productNotFound(c, id)
+		return
+	}
+
+	gaps := profile.gaps(&product)
+	c.JSON(http.StatusOK, gin.H{
+		"id":      id,
+		"profile": profile.Name,
+		"valid":   len(gaps) == 0,
+		"gaps":    gaps,
+	})
+}
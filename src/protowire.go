@@ -0,0 +1,515 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"maps"
+	"math"
+	"slices"
+	"sort"
+	"time"
+)
+
+// Protobuf wire types
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+var errProtoTruncated = errors.New("proto: truncated message")
+
+// Appending fields. Like proto3, zero values are left out.
+
+func protoTag(b []byte, num, typ int) []byte {
+	return binary.AppendUvarint(b, uint64(num)<<3|uint64(typ))
+}
+
+func protoUint(b []byte, num int, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	return binary.AppendUvarint(protoTag(b, num, wireVarint), v)
+}
+
+func protoInt(b []byte, num int, v int64) []byte {
+	return protoUint(b, num, uint64(v))
+}
+
+func protoDouble(b []byte, num int, v float64) []byte {
+	if v == 0 {
+		return b
+	}
+	return binary.LittleEndian.AppendUint64(protoTag(b, num, wireFixed64), math.Float64bits(v))
+}
+
+// protoMessage appends an embedded message, even an empty one
+func protoMessage(b []byte, num int, msg []byte) []byte {
+	b = binary.AppendUvarint(protoTag(b, num, wireBytes), uint64(len(msg)))
+	return append(b, msg...)
+}
+
+func protoString(b []byte, num int, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = binary.AppendUvarint(protoTag(b, num, wireBytes), uint64(len(s)))
+	return append(b, s...)
+}
+
+// protoField is one decoded field. data holds the payload of length
+// delimited fields, v the value of the others.
+type protoField struct {
+	num  int
+	typ  int
+	v    uint64
+	data []byte
+}
+
+func (f protoField) int() int64     { return int64(f.v) }
+func (f protoField) string() string { return string(f.data) }
+func (f protoField) expect(typ int) error {
+	if f.typ != typ {
+		return fmt.Errorf("proto: field %d has wire type %d, want %d", f.num, f.typ, typ)
+	}
+	return nil
+}
+
+// readProto calls fn for every field of a message. Unknown fields are
+// the caller's to skip, which keeps old servers reading newer clients.
+func readProto(b []byte, fn func(f protoField) error) error {
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errProtoTruncated
+		}
+		b = b[n:]
+		f := protoField{num: int(key >> 3), typ: int(key & 7)}
+
+		switch f.typ {
+		case wireVarint:
+			f.v, n = binary.Uvarint(b)
+			if n <= 0 {
+				return errProtoTruncated
+			}
+			b = b[n:]
+		case wireFixed64:
+			if len(b) < 8 {
+				return errProtoTruncated
+			}
+			f.v, b = binary.LittleEndian.Uint64(b), b[8:]
+		case wireFixed32:
+			if len(b) < 4 {
+				return errProtoTruncated
+			}
+			f.v, b = uint64(binary.LittleEndian.Uint32(b)), b[4:]
+		case wireBytes:
+			size, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < size {
+				return errProtoTruncated
+			}
+			f.data, b = b[n:n+int(size)], b[n+int(size):]
+		default:
+			return fmt.Errorf("proto: unsupported wire type %d", f.typ)
+		}
+
+		if err := fn(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Messages of proto/product_service.proto. Products are converted from and
+// to the JSON of the REST API, so prices keep their decimal strings.
+
+func encodeVariant(v Variant) []byte {
+	var b []byte
+	b = protoString(b, 1, v.SKU)
+	keys := make([]string, 0, len(v.Attributes))
+	for k := range v.Attributes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		var entry []byte
+		entry = protoString(entry, 1, k)
+		entry = protoString(entry, 2, v.Attributes[k])
+		b = protoMessage(b, 2, entry)
+	}
+	if v.PriceDelta != 0 {
+		b = protoString(b, 3, v.PriceDelta.String())
+	}
+	b = protoInt(b, 4, int64(v.Stock))
+	return protoString(b, 5, v.GTIN)
+}
+
+func decodeVariant(data []byte) (Variant, error) {
+	var v Variant
+	err := readProto(data, func(f protoField) error {
+		switch f.num {
+		case 1:
+			v.SKU = f.string()
+		case 2:
+			if err := f.expect(wireBytes); err != nil {
+				return err
+			}
+			var key, value string
+			if err := readProto(f.data, func(e protoField) error {
+				switch e.num {
+				case 1:
+					key = e.string()
+				case 2:
+					value = e.string()
+				}
+				return nil
+			}); err != nil {
+				return err
+			}
+			if v.Attributes == nil {
+				v.Attributes = make(map[string]string)
+			}
+			v.Attributes[key] = value
+		case 3:
+			amount, err := parseMoney(f.string())
+			if err != nil {
+				return err
+			}
+			v.PriceDelta = amount
+		case 4:
+			v.Stock = int(f.int())
+		case 5:
+			v.GTIN = f.string()
+		}
+		return nil
+	})
+	return v, err
+}
+
+func encodeProduct(p Product) []byte {
+	var b []byte
+	b = protoString(b, 1, p.ID)
+	b = protoString(b, 2, p.Name)
+	b = protoString(b, 3, p.Description)
+	b = protoString(b, 4, p.Category)
+	b = protoString(b, 5, p.Price.String())
+	b = protoString(b, 6, p.Currency)
+	b = protoInt(b, 7, int64(p.Stock))
+	for _, v := range p.Variants {
+		b = protoMessage(b, 8, encodeVariant(v))
+	}
+	if p.LowStockThreshold != nil {
+		// optional, so an explicit 0 is sent too
+		b = binary.AppendUvarint(protoTag(b, 9, wireVarint), uint64(*p.LowStockThreshold))
+	}
+	b = protoDouble(b, 10, p.Rating)
+	b = protoInt(b, 11, int64(p.ReviewCount))
+	b = protoInt(b, 12, p.Version)
+	if p.DeletedAt != nil {
+		b = protoString(b, 13, p.DeletedAt.Format(time.RFC3339Nano))
+	}
+	if !p.UpdatedAt.IsZero() {
+		b = protoString(b, 14, p.UpdatedAt.Format(time.RFC3339Nano))
+	}
+	b = protoString(b, 15, p.GTIN)
+	b = protoInt(b, 16, int64(p.WeightGrams))
+	for _, image := range p.Images {
+		b = protoMessage(b, 17, []byte(image))
+	}
+	if !p.CreatedAt.IsZero() {
+		b = protoString(b, 18, p.CreatedAt.Format(time.RFC3339Nano))
+	}
+	for _, badge := range p.Badges {
+		b = protoMessage(b, 19, encodeBadge(badge))
+	}
+	for _, label := range p.ActiveBadges {
+		b = protoMessage(b, 20, []byte(label))
+	}
+	b = protoString(b, 21, p.SKU)
+	if p.RolloutPercent != nil {
+		// optional, so an explicit 0 is sent too
+		b = binary.AppendUvarint(protoTag(b, 22, wireVarint), uint64(*p.RolloutPercent))
+	}
+	for _, link := range p.Related {
+		b = protoMessage(b, 23, protoString(protoString(nil, 1, link.ID), 2, link.Kind))
+	}
+	if p.PublishAt != nil {
+		b = protoString(b, 24, p.PublishAt.Format(time.RFC3339Nano))
+	}
+	if p.UnpublishAt != nil {
+		b = protoString(b, 25, p.UnpublishAt.Format(time.RFC3339Nano))
+	}
+	for _, sp := range p.ScheduledPrices {
+		b = protoMessage(b, 26, protoString(protoString(nil, 1, sp.Price.String()), 2, sp.EffectiveAt.Format(time.RFC3339Nano)))
+	}
+	if p.SalePrice != nil {
+		b = protoString(b, 27, p.SalePrice.String())
+	}
+	for _, component := range p.Components {
+		b = protoMessage(b, 28, protoInt(protoString(nil, 1, component.ID), 2, int64(component.Quantity)))
+	}
+	for _, locale := range slices.Sorted(maps.Keys(p.Translations)) {
+		t := p.Translations[locale]
+		translation := protoString(protoString(nil, 1, t.Name), 2, t.Description)
+		b = protoMessage(b, 29, protoMessage(protoString(nil, 1, locale), 2, translation))
+	}
+	return b
+}
+
+func encodeBadge(badge Badge) []byte {
+	b := protoString(nil, 1, badge.Label)
+	if badge.From != nil {
+		b = protoString(b, 2, badge.From.Format(time.RFC3339Nano))
+	}
+	if badge.Until != nil {
+		b = protoString(b, 3, badge.Until.Format(time.RFC3339Nano))
+	}
+	return b
+}
+
+func decodeRelatedLink(data []byte) (RelatedLink, error) {
+	var link RelatedLink
+	err := readProto(data, func(f protoField) error {
+		switch f.num {
+		case 1:
+			link.ID = f.string()
+		case 2:
+			link.Kind = f.string()
+		}
+		return nil
+	})
+	return link, err
+}
+
+func decodeBundleComponent(data []byte) (BundleComponent, error) {
+	var component BundleComponent
+	err := readProto(data, func(f protoField) error {
+		switch f.num {
+		case 1:
+			component.ID = f.string()
+		case 2:
+			component.Quantity = int(f.int())
+		}
+		return nil
+	})
+	return component, err
+}
+
+// decodeTranslationEntry decodes an entry of the translations map: the
+// locale in field 1 and the Translation in field 2
+func decodeTranslationEntry(data []byte) (string, Translation, error) {
+	var locale string
+	var t Translation
+	err := readProto(data, func(f protoField) error {
+		switch f.num {
+		case 1:
+			locale = f.string()
+		case 2:
+			if err := f.expect(wireBytes); err != nil {
+				return err
+			}
+			return readProto(f.data, func(e protoField) error {
+				switch e.num {
+				case 1:
+					t.Name = e.string()
+				case 2:
+					t.Description = e.string()
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	return locale, t, err
+}
+
+func decodeScheduledPrice(data []byte) (ScheduledPrice, error) {
+	var sp ScheduledPrice
+	err := readProto(data, func(f protoField) error {
+		switch f.num {
+		case 1:
+			amount, err := parseMoney(f.string())
+			if err != nil {
+				return err
+			}
+			sp.Price = amount
+		case 2:
+			t, err := time.Parse(time.RFC3339Nano, f.string())
+			if err != nil {
+				return fmt.Errorf("effective_at must be RFC 3339: %w", err)
+			}
+			sp.EffectiveAt = t
+		}
+		return nil
+	})
+	return sp, err
+}
+
+func decodeBadge(data []byte) (Badge, error) {
+	var badge Badge
+	err := readProto(data, func(f protoField) error {
+		switch f.num {
+		case 1:
+			badge.Label = f.string()
+		case 2, 3:
+			t, err := time.Parse(time.RFC3339Nano, f.string())
+			if err != nil {
+				return fmt.Errorf("badge times must be RFC 3339: %w", err)
+			}
+			if f.num == 2 {
+				badge.From = &t
+			} else {
+				badge.Until = &t
+			}
+		}
+		return nil
+	})
+	return badge, err
+}
+
+func decodeProduct(data []byte) (Product, error) {
+	var p Product
+	err := readProto(data, func(f protoField) error {
+		switch f.num {
+		case 1:
+			p.ID = f.string()
+		case 2:
+			p.Name = f.string()
+		case 3:
+			p.Description = f.string()
+		case 4:
+			p.Category = f.string()
+		case 5:
+			amount, err := parseMoney(f.string())
+			if err != nil {
+				return err
+			}
+			p.Price = amount
+		case 6:
+			p.Currency = f.string()
+		case 7:
+			p.Stock = int(f.int())
+		case 8:
+			if err := f.expect(wireBytes); err != nil {
+				return err
+			}
+			v, err := decodeVariant(f.data)
+			if err != nil {
+				return err
+			}
+			p.Variants = append(p.Variants, v)
+		case 9:
+			threshold := int(f.int())
+			p.LowStockThreshold = &threshold
+		case 12:
+			p.Version = f.int()
+		case 15:
+			p.GTIN = f.string()
+		case 16:
+			p.WeightGrams = int(f.int())
+		case 17:
+			if err := f.expect(wireBytes); err != nil {
+				return err
+			}
+			p.Images = append(p.Images, string(f.data))
+		case 19:
+			if err := f.expect(wireBytes); err != nil {
+				return err
+			}
+			badge, err := decodeBadge(f.data)
+			if err != nil {
+				return err
+			}
+			p.Badges = append(p.Badges, badge)
+		case 21:
+			p.SKU = f.string()
+		case 22:
+			percent := int(f.int())
+			p.RolloutPercent = &percent
+		case 23:
+			if err := f.expect(wireBytes); err != nil {
+				return err
+			}
+			link, err := decodeRelatedLink(f.data)
+			if err != nil {
+				return err
+			}
+			p.Related = append(p.Related, link)
+		case 24, 25:
+			t, err := time.Parse(time.RFC3339Nano, f.string())
+			if err != nil {
+				return fmt.Errorf("publishing times must be RFC 3339: %w", err)
+			}
+			if f.num == 24 {
+				p.PublishAt = &t
+			} else {
+				p.UnpublishAt = &t
+			}
+		case 26:
+			if err := f.expect(wireBytes); err != nil {
+				return err
+			}
+			sp, err := decodeScheduledPrice(f.data)
+			if err != nil {
+				return err
+			}
+			p.ScheduledPrices = append(p.ScheduledPrices, sp)
+		case 27:
+			amount, err := parseMoney(f.string())
+			if err != nil {
+				return err
+			}
+			p.SalePrice = &amount
+		case 28:
+			if err := f.expect(wireBytes); err != nil {
+				return err
+			}
+			component, err := decodeBundleComponent(f.data)
+			if err != nil {
+				return err
+			}
+			p.Components = append(p.Components, component)
+		case 29:
+			if err := f.expect(wireBytes); err != nil {
+				return err
+			}
+			locale, t, err := decodeTranslationEntry(f.data)
+			if err != nil {
+				return err
+			}
+			if p.Translations == nil {
+				p.Translations = make(map[string]Translation)
+			}
+			p.Translations[locale] = t
+		}
+		// Rating, review count, timestamps and active badges are
+		// server-managed
+		return nil
+	})
+	return p, err
+}
+
+// decodeProductRequest decodes a request holding a product in field 1 and
+// an int64 in field 2, the shape of CreateProductRequest and
+// UpdateProductRequest
+func decodeProductRequest(data []byte) (Product, int64, error) {
+	var p Product
+	var version int64
+	err := readProto(data, func(f protoField) error {
+		switch f.num {
+		case 1:
+			if err := f.expect(wireBytes); err != nil {
+				return err
+			}
+			var err error
+			p, err = decodeProduct(f.data)
+			return err
+		case 2:
+			version = f.int()
+		}
+		return nil
+	})
+	return p, version, err
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestReadProto(t *testing.T) {
+	tests := []struct {
+		name  string
+		input []byte
+		want  []protoField
+		err   error
+	}{
+		{"empty", nil, nil, nil},
+		{"varint", []byte{0x08, 0x96, 0x01}, []protoField{{num: 1, typ: wireVarint, v: 150}}, nil},
+		{"unterminated varint", append([]byte{0x20}, bytes.Repeat([]byte{0xff}, 9)...), nil, errProtoTruncated},
+		{"string", []byte{0x12, 0x07, 't', 'e', 's', 't', 'i', 'n', 'g'}, []protoField{{num: 2, typ: wireBytes, data: []byte("testing")}}, nil},
+		{"empty message", []byte{0x1a, 0x00}, []protoField{{num: 3, typ: wireBytes, data: []byte{}}}, nil},
+		{"double", []byte{0x29, 0, 0, 0, 0, 0, 0, 0xf8, 0x3f}, []protoField{{num: 5, typ: wireFixed64, v: 0x3ff8000000000000}}, nil},
+		{"fixed32", []byte{0x35, 1, 0, 0, 0}, []protoField{{num: 6, typ: wireFixed32, v: 1}}, nil},
+		{"high field number", []byte{0x80, 0x01, 0x01}, []protoField{{num: 16, typ: wireVarint, v: 1}}, nil},
+		{"fields in order", []byte{0x08, 0x01, 0x12, 0x01, 'a', 0x08, 0x02}, []protoField{
+			{num: 1, typ: wireVarint, v: 1},
+			{num: 2, typ: wireBytes, data: []byte("a")},
+			{num: 1, typ: wireVarint, v: 2},
+		}, nil},
+		{"truncated key", []byte{0x80}, nil, errProtoTruncated},
+		{"truncated varint", []byte{0x08, 0x96}, nil, errProtoTruncated},
+		{"truncated length", []byte{0x12}, nil, errProtoTruncated},
+		{"length past the end", []byte{0x12, 0x05, 'a', 'b'}, nil, errProtoTruncated},
+		{"huge length", []byte{0x12, 0xff, 0xff, 0xff, 0xff, 0x0f}, nil, errProtoTruncated},
+		{"truncated double", []byte{0x29, 0, 0, 0}, nil, errProtoTruncated},
+		{"truncated fixed32", []byte{0x35, 1}, nil, errProtoTruncated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []protoField
+			err := readProto(tt.input, func(f protoField) error {
+				got = append(got, f)
+				return nil
+			})
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("err = %v, want %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("fields = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadProtoWireTypes(t *testing.T) {
+	for _, typ := range []byte{3, 4, 6, 7} {
+		if err := readProto([]byte{0x08 | typ}, func(protoField) error { return nil }); err == nil {
+			t.Errorf("wire type %d accepted", typ)
+		}
+	}
+}
+
+func TestVariantRoundTrip(t *testing.T) {
+	want := Variant{
+		SKU:        "LAPTOP-16GB",
+		Attributes: map[string]string{"memory": "16GB", "colour": "grey"},
+		PriceDelta: 10000,
+		Stock:      -2,
+		GTIN:       "4006381333931",
+	}
+	got, err := decodeVariant(encodeVariant(want))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("decoded %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,954 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Raft roles
+const (
+	raftFollower  = "follower"
+	raftCandidate = "candidate"
+	raftLeader    = "leader"
+)
+
+// walNoop is the entry a new leader appends to commit the entries of
+// earlier terms
+const walNoop = "noop"
+
+// raftForwardedHeader marks a write forwarded to the leader
+const raftForwardedHeader = "X-Raft-Forwarded"
+
+var (
+	errNotLeader      = errors.New("raft: not the leader")
+	errLostLeadership = errors.New("raft: lost leadership before the write committed")
+	errCommitTimeout  = errors.New("raft: write not replicated to a majority in time")
+)
+
+// raftEntry is one product write in the replicated log
+type raftEntry struct {
+	Term   uint64    `json:"term"`
+	Index  uint64    `json:"index"`
+	Record walRecord `json:"record"`
+}
+
+// RaftNode replicates product writes to every member with Raft, so a
+// cluster of in-memory instances keeps one catalog and elects a new leader
+// when the current one fails.
+//
+// Writes go to the leader, which appends them to its log and applies and
+// acknowledges them once a majority has them; followers apply them once
+// the leader tells them they're committed. No member applies an entry
+// that isn't committed, so none has to take one back.
+// Reads are served by whichever instance gets them, so a follower may be a
+// heartbeat behind. A member whose log diverged from the leader's, or that
+// is missing entries the leader already dropped, is sent a snapshot of the
+// whole catalog. Only products are replicated; reviews, coupons and the
+// audit trail live on the instance that served the write.
+type RaftNode struct {
+	self            string
+	peers           []string
+	secret          string
+	electionTimeout time.Duration
+	heartbeat       time.Duration
+	commitTimeout   time.Duration
+	maxLog          int
+	statePath       string // term and vote, kept across restarts with WAL_DIR
+	http            *http.Client
+	applyFn         func(walRecord) error // in place of store.apply, in tests
+
+	mu          sync.Mutex
+	started     bool
+	synced      bool // has taken a snapshot from a leader
+	role        string
+	term        uint64
+	votedFor    string
+	leader      string
+	log         []raftEntry // entries after snapIndex
+	snapIndex   uint64
+	snapTerm    uint64
+	commitIndex uint64
+	lastApplied uint64
+	nextIndex   map[string]uint64
+	matchIndex  map[string]uint64
+	contact     map[string]time.Time // last answer from each peer, on the leader
+	deadline    time.Time            // of the election timer
+	changed     chan struct{}        // closed when commitIndex or the role changes
+	wake        map[string]chan struct{}
+	applyWake   chan struct{}
+	proxy       *httputil.ReverseProxy
+	proxyFor    string
+}
+
+// Global Raft node, nil unless RAFT_SELF is set
+var replication = newRaftNode()
+
+func newRaftNode() *RaftNode {
+	self := strings.TrimSuffix(os.Getenv("RAFT_SELF"), "/")
+	if self == "" {
+		return nil
+	}
+	if os.Getenv("SHARD_SELF") != "" {
+		panic("RAFT_SELF and SHARD_SELF can't be used together")
+	}
+
+	n := &RaftNode{
+		self:            self,
+		secret:          os.Getenv("RAFT_SECRET"),
+		electionTimeout: envDuration("RAFT_ELECTION_TIMEOUT", time.Second),
+		heartbeat:       envDuration("RAFT_HEARTBEAT", 100*time.Millisecond),
+		commitTimeout:   envDuration("RAFT_COMMIT_TIMEOUT", 2*time.Second),
+		maxLog:          envInt("RAFT_MAX_LOG", 10000),
+		http:            newPooledClient("raft", 5*time.Second),
+		role:            raftFollower,
+		nextIndex:       make(map[string]uint64),
+		matchIndex:      make(map[string]uint64),
+		contact:         make(map[string]time.Time),
+		changed:         make(chan struct{}),
+		wake:            make(map[string]chan struct{}),
+		applyWake:       make(chan struct{}, 1),
+	}
+	for _, peer := range strings.Split(os.Getenv("RAFT_PEERS"), ",") {
+		if peer = strings.TrimSuffix(strings.TrimSpace(peer), "/"); peer != "" && peer != self {
+			n.peers = append(n.peers, peer)
+			n.wake[peer] = make(chan struct{}, 1)
+		}
+	}
+	if walDir != "" {
+		n.statePath = filepath.Join(walDir, "raft.state")
+		if err := n.loadState(); err != nil {
+			panic(fmt.Sprintf("raft: reading %s: %v", n.statePath, err))
+		}
+	}
+	return n
+}
+
+// raftState is what Raft needs to keep across restarts so a member never
+// votes twice in a term
+type raftState struct {
+	Term     uint64 `json:"term"`
+	VotedFor string `json:"voted_for"`
+}
+
+func (n *RaftNode) loadState() error {
+	data, err := os.ReadFile(n.statePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var state raftState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+	n.term, n.votedFor = state.Term, state.VotedFor
+	return nil
+}
+
+// persist saves the term and vote. Callers must hold n.mu.
+func (n *RaftNode) persist() {
+	if n.statePath == "" {
+		return
+	}
+	data, _ := json.Marshal(raftState{Term: n.term, VotedFor: n.votedFor})
+	tmp := n.statePath + ".tmp"
+	file, err := os.Create(tmp)
+	if err == nil {
+		_, err = file.Write(data)
+		if err == nil {
+			err = file.Sync()
+		}
+		file.Close()
+	}
+	if err == nil {
+		err = os.Rename(tmp, n.statePath)
+	}
+	if err != nil {
+		log.Printf("raft: saving state: %v", err)
+	}
+}
+
+// Log positions. Callers must hold n.mu.
+
+func (n *RaftNode) lastIndex() uint64 { return n.snapIndex + uint64(len(n.log)) }
+
+func (n *RaftNode) termAt(index uint64) uint64 {
+	switch {
+	case index == n.snapIndex:
+		return n.snapTerm
+	case index < n.snapIndex || index > n.lastIndex():
+		return 0
+	}
+	return n.log[index-n.snapIndex-1].Term
+}
+
+func (n *RaftNode) entry(index uint64) raftEntry { return n.log[index-n.snapIndex-1] }
+
+func (n *RaftNode) majority() int { return (len(n.peers)+1)/2 + 1 }
+
+// quorum reports whether a majority answered the leader within an
+// election timeout, so a leader cut off from the rest stops taking
+// writes. Callers must hold n.mu.
+func (n *RaftNode) quorum() bool {
+	count := 1
+	for _, peer := range n.peers {
+		if time.Since(n.contact[peer]) < n.electionTimeout {
+			count++
+		}
+	}
+	return count >= n.majority()
+}
+
+// notify wakes everyone waiting on a commit or role change. Callers must
+// hold n.mu.
+func (n *RaftNode) notify() {
+	close(n.changed)
+	n.changed = make(chan struct{})
+}
+
+// resetTimer restarts the election timer with jitter, so members rarely
+// time out together. Callers must hold n.mu.
+func (n *RaftNode) resetTimer() {
+	n.deadline = time.Now().Add(n.electionTimeout + rand.N(n.electionTimeout))
+}
+
+// stepDown follows a newer term. Callers must hold n.mu.
+func (n *RaftNode) stepDown(term uint64) {
+	if term > n.term {
+		n.term, n.votedFor = term, ""
+		n.persist()
+	}
+	if n.role != raftFollower {
+		log.Printf("raft: %s becomes follower in term %d", n.self, n.term)
+		n.role = raftFollower
+		n.notify()
+	}
+}
+
+// leading reports whether this member is the leader
+func (n *RaftNode) leading() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return n.role == raftLeader
+}
+
+// propose appends a write to the log, waits for a majority to have it and
+// applies it. Only the leader writes; other members refuse, which keeps
+// background jobs from forking their catalog. Writes made before the node
+// starts, the seed data, are applied on every member alike. Callers must
+// hold store.mu, which keeps writes in log order and reads from seeing one
+// before it's committed.
+//
+// A write that doesn't commit within RAFT_COMMIT_TIMEOUT, or whose leader
+// loses leadership first, fails. It may still commit later, when the next
+// leader has it, like any write whose answer was lost.
+func (n *RaftNode) propose(rec walRecord) error {
+	n.mu.Lock()
+	if !n.started {
+		n.mu.Unlock()
+		return n.apply(rec)
+	}
+	if n.role != raftLeader {
+		n.mu.Unlock()
+		log.Printf("raft: dropping %s %s on %s, writes go to the leader", rec.Op, rec.ID, n.role)
+		return errNotLeader
+	}
+	n.appendEntry(rec)
+	index, term := n.lastIndex(), n.term
+	n.mu.Unlock()
+
+	if err := n.waitCommitted(context.Background(), index, term); err != nil {
+		return err
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.applyTo(index)
+}
+
+// apply makes a write to the store
+func (n *RaftNode) apply(rec walRecord) error {
+	if n.applyFn != nil {
+		return n.applyFn(rec)
+	}
+	return store.apply(rec)
+}
+
+// appendEntry adds an entry of the current term and starts replicating
+// it. Callers must hold n.mu.
+func (n *RaftNode) appendEntry(rec walRecord) {
+	n.log = append(n.log, raftEntry{Term: n.term, Index: n.lastIndex() + 1, Record: rec})
+	n.advanceCommit()
+	for _, ch := range n.wake {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// applyTo applies entries up to index, which must be committed, to the
+// store. An entry the store
+// can't apply stops it there, to be tried again. Callers must hold
+// store.mu and n.mu.
+func (n *RaftNode) applyTo(index uint64) error {
+	for n.lastApplied < index {
+		if e := n.entry(n.lastApplied + 1); e.Record.Op != walNoop {
+			if err := n.apply(e.Record); err != nil {
+				return err
+			}
+		}
+		n.lastApplied++
+	}
+	return nil
+}
+
+// applyLoop applies committed entries: on followers, all of them, and on
+// the leader the ones no propose is waiting to apply, such as the entries
+// of earlier terms a new leader commits
+func (n *RaftNode) applyLoop() {
+	for range n.applyWake {
+		store.mu.Lock()
+		n.mu.Lock()
+		if err := n.applyTo(n.commitIndex); err != nil {
+			log.Printf("raft: applying entry %d: %v", n.lastApplied+1, err)
+		}
+		n.compact()
+		n.mu.Unlock()
+		store.mu.Unlock()
+	}
+}
+
+func (n *RaftNode) wakeApply() {
+	select {
+	case n.applyWake <- struct{}{}:
+	default:
+	}
+}
+
+// compact drops applied entries beyond RAFT_MAX_LOG. Members that still
+// need them get a snapshot instead. Callers must hold n.mu.
+func (n *RaftNode) compact() {
+	if len(n.log) <= n.maxLog {
+		return
+	}
+	upTo := min(n.commitIndex, n.lastApplied, n.lastIndex()-uint64(n.maxLog/2))
+	if upTo <= n.snapIndex {
+		return
+	}
+	n.snapTerm = n.termAt(upTo)
+	n.log = append([]raftEntry(nil), n.log[upTo-n.snapIndex:]...)
+	n.snapIndex = upTo
+}
+
+// advanceCommit commits the newest entry of this term that a majority
+// has. Callers must hold n.mu.
+func (n *RaftNode) advanceCommit() {
+	for index := n.lastIndex(); index > n.commitIndex; index-- {
+		if n.termAt(index) != n.term {
+			break
+		}
+		count := 1
+		for _, peer := range n.peers {
+			if n.matchIndex[peer] >= index {
+				count++
+			}
+		}
+		if count >= n.majority() {
+			n.commitIndex = index
+			n.notify()
+			n.wakeApply()
+			return
+		}
+	}
+}
+
+// waitCommitted blocks until the entry at index, written in term, is
+// committed
+func (n *RaftNode) waitCommitted(ctx context.Context, index, term uint64) error {
+	timeout := time.NewTimer(n.commitTimeout)
+	defer timeout.Stop()
+
+	for {
+		n.mu.Lock()
+		if n.term != term || n.role != raftLeader {
+			n.mu.Unlock()
+			return errLostLeadership
+		}
+		if n.commitIndex >= index {
+			n.mu.Unlock()
+			return nil
+		}
+		changed := n.changed
+		n.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-timeout.C:
+			return errCommitTimeout
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// run starts the election timer, replication and applying
+func (n *RaftNode) run() {
+	n.mu.Lock()
+	n.started = true
+	n.resetTimer()
+	n.mu.Unlock()
+	log.Printf("raft: %s starting with %d peers", n.self, len(n.peers))
+
+	go n.applyLoop()
+	for _, peer := range n.peers {
+		go n.replicate(peer)
+	}
+
+	ticker := time.NewTicker(n.heartbeat / 2)
+	defer ticker.Stop()
+	for range ticker.C {
+		n.mu.Lock()
+		expired := n.role != raftLeader && time.Now().After(n.deadline)
+		if n.role == raftLeader && !n.quorum() {
+			log.Printf("raft: %s lost contact with a majority", n.self)
+			n.leader = ""
+			n.stepDown(n.term)
+			n.resetTimer()
+		}
+		n.mu.Unlock()
+		if expired {
+			n.campaign()
+		}
+	}
+}
+
+// Raft RPCs, sent as JSON to /internal/raft/*
+
+type voteRequest struct {
+	Term         uint64 `json:"term"`
+	Candidate    string `json:"candidate"`
+	LastLogIndex uint64 `json:"last_log_index"`
+	LastLogTerm  uint64 `json:"last_log_term"`
+}
+
+type voteResponse struct {
+	Term    uint64 `json:"term"`
+	Granted bool   `json:"granted"`
+}
+
+type appendRequest struct {
+	Term         uint64      `json:"term"`
+	Leader       string      `json:"leader"`
+	PrevLogIndex uint64      `json:"prev_log_index"`
+	PrevLogTerm  uint64      `json:"prev_log_term"`
+	Entries      []raftEntry `json:"entries"`
+	LeaderCommit uint64      `json:"leader_commit"`
+}
+
+type appendResponse struct {
+	Term    uint64 `json:"term"`
+	Success bool   `json:"success"`
+	// NextIndex is where the leader should continue, on failures
+	NextIndex uint64 `json:"next_index"`
+	// NeedSnapshot asks for the whole catalog, after the member's log
+	// diverged from entries it already applied
+	NeedSnapshot bool `json:"need_snapshot"`
+}
+
+type snapshotRequest struct {
+	Term      uint64            `json:"term"`
+	Leader    string            `json:"leader"`
+	LastIndex uint64            `json:"last_index"`
+	LastTerm  uint64            `json:"last_term"`
+	Products  []LedgeredProduct `json:"products"`
+}
+
+func (n *RaftNode) call(ctx context.Context, peer, rpc string, req, resp any) error {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, peer+"/internal/raft/"+rpc, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if n.secret != "" {
+		httpReq.Header.Set("X-Cluster-Secret", n.secret)
+	}
+	httpResp, err := n.http.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		return fmt.Errorf("raft: %s %s: %s", peer, rpc, httpResp.Status)
+	}
+	return json.NewDecoder(httpResp.Body).Decode(resp)
+}
+
+// campaign runs an election for the next term
+func (n *RaftNode) campaign() {
+	n.mu.Lock()
+	n.role = raftCandidate
+	n.term++
+	n.votedFor = n.self
+	n.leader = ""
+	n.persist()
+	n.resetTimer()
+	term := n.term
+	req := voteRequest{Term: term, Candidate: n.self, LastLogIndex: n.lastIndex(), LastLogTerm: n.termAt(n.lastIndex())}
+	n.mu.Unlock()
+
+	votes := make(chan bool, len(n.peers))
+	for _, peer := range n.peers {
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), n.electionTimeout)
+			defer cancel()
+
+			var resp voteResponse
+			if err := n.call(ctx, peer, "vote", req, &resp); err != nil {
+				votes <- false
+				return
+			}
+			n.mu.Lock()
+			if resp.Term > n.term {
+				n.stepDown(resp.Term)
+			}
+			n.mu.Unlock()
+			votes <- resp.Granted
+		}()
+	}
+
+	granted := 1
+	for range n.peers {
+		if granted >= n.majority() {
+			break
+		}
+		if <-votes {
+			granted++
+		}
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if granted < n.majority() || n.role != raftCandidate || n.term != term {
+		return
+	}
+
+	log.Printf("raft: %s is leader for term %d", n.self, n.term)
+	n.role, n.leader = raftLeader, n.self
+	for _, peer := range n.peers {
+		n.nextIndex[peer], n.matchIndex[peer] = n.lastIndex()+1, 0
+		n.contact[peer] = time.Now() // it just voted, or will hear from us shortly
+	}
+	n.notify()
+	n.wakeApply()
+	n.appendEntry(walRecord{Op: walNoop})
+}
+
+// replicate keeps one peer's log in step with the leader's, sending
+// heartbeats when there's nothing new
+func (n *RaftNode) replicate(peer string) {
+	ticker := time.NewTicker(n.heartbeat)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-n.wake[peer]:
+		}
+		for n.replicateOnce(peer) {
+		}
+	}
+}
+
+// replicateOnce sends one AppendEntries or snapshot to a peer and reports
+// whether there is more to send
+func (n *RaftNode) replicateOnce(peer string) bool {
+	n.mu.Lock()
+	if n.role != raftLeader {
+		n.mu.Unlock()
+		return false
+	}
+	next := n.nextIndex[peer]
+	if next <= n.snapIndex || next == 0 {
+		n.mu.Unlock()
+		return n.sendSnapshot(peer)
+	}
+	req := appendRequest{
+		Term:         n.term,
+		Leader:       n.self,
+		PrevLogIndex: next - 1,
+		PrevLogTerm:  n.termAt(next - 1),
+		LeaderCommit: n.commitIndex,
+	}
+	if last := n.lastIndex(); next <= last {
+		end := min(last, next+499)
+		req.Entries = append([]raftEntry(nil), n.log[next-n.snapIndex-1:end-n.snapIndex]...)
+	}
+	n.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), n.electionTimeout)
+	defer cancel()
+	var resp appendResponse
+	if err := n.call(ctx, peer, "append", req, &resp); err != nil {
+		return false
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if resp.Term > n.term {
+		n.stepDown(resp.Term)
+		return false
+	}
+	if n.role != raftLeader || n.term != req.Term {
+		return false
+	}
+	n.contact[peer] = time.Now()
+	switch {
+	case resp.Success:
+		n.matchIndex[peer] = req.PrevLogIndex + uint64(len(req.Entries))
+		n.nextIndex[peer] = n.matchIndex[peer] + 1
+		n.advanceCommit()
+		return n.nextIndex[peer] <= n.lastIndex()
+	case resp.NeedSnapshot:
+		n.nextIndex[peer] = 0
+	default:
+		n.nextIndex[peer] = max(min(resp.NextIndex, next-1), 1)
+	}
+	return true
+}
+
+// sendSnapshot sends the leader's catalog to a peer
+func (n *RaftNode) sendSnapshot(peer string) bool {
+	store.mu.RLock()
+	n.mu.Lock()
+	if n.role != raftLeader {
+		n.mu.Unlock()
+		store.mu.RUnlock()
+		return false
+	}
+	req := snapshotRequest{Term: n.term, Leader: n.self, LastIndex: n.lastApplied, LastTerm: n.termAt(n.lastApplied)}
+	n.mu.Unlock()
+	req.Products = make([]LedgeredProduct, 0, len(store.products))
+	for _, p := range store.products {
+		req.Products = append(req.Products, stockLedger.ledgered(p))
+	}
+	store.mu.RUnlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	var resp appendResponse
+	if err := n.call(ctx, peer, "snapshot", req, &resp); err != nil {
+		log.Printf("raft: snapshot to %s: %v", peer, err)
+		return false
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if resp.Term > n.term {
+		n.stepDown(resp.Term)
+		return false
+	}
+	if n.role == raftLeader && n.term == req.Term {
+		n.contact[peer] = time.Now()
+		n.matchIndex[peer], n.nextIndex[peer] = req.LastIndex, req.LastIndex+1
+		log.Printf("raft: sent %d products to %s at index %d", len(req.Products), peer, req.LastIndex)
+		n.advanceCommit()
+	}
+	return true
+}
+
+// handleVote answers RequestVote
+func (n *RaftNode) handleVote(req voteRequest) voteResponse {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if req.Term > n.term {
+		n.stepDown(req.Term)
+	}
+	upToDate := req.LastLogTerm > n.termAt(n.lastIndex()) ||
+		req.LastLogTerm == n.termAt(n.lastIndex()) && req.LastLogIndex >= n.lastIndex()
+	granted := req.Term == n.term && (n.votedFor == "" || n.votedFor == req.Candidate) && upToDate
+	if granted {
+		n.votedFor = req.Candidate
+		n.persist()
+		n.resetTimer()
+	}
+	return voteResponse{Term: n.term, Granted: granted}
+}
+
+// handleAppend answers AppendEntries
+func (n *RaftNode) handleAppend(req appendRequest) appendResponse {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if req.Term < n.term {
+		return appendResponse{Term: n.term}
+	}
+	n.stepDown(req.Term)
+	n.leader = req.Leader
+	n.resetTimer()
+
+	// A member joins by taking the leader's catalog, which replaces
+	// whatever it recovered or seeded locally
+	if !n.synced {
+		return appendResponse{Term: n.term, NeedSnapshot: true}
+	}
+	if req.PrevLogIndex > n.lastIndex() {
+		return appendResponse{Term: n.term, NextIndex: n.lastIndex() + 1}
+	}
+	if req.PrevLogIndex < n.snapIndex {
+		return appendResponse{Term: n.term, NeedSnapshot: true}
+	}
+	if n.termAt(req.PrevLogIndex) != req.PrevLogTerm {
+		return n.truncate(req.PrevLogIndex)
+	}
+
+	for _, e := range req.Entries {
+		if e.Index <= n.lastIndex() {
+			if n.termAt(e.Index) == e.Term {
+				continue
+			}
+			if resp, ok := n.truncateAt(e.Index); !ok {
+				return resp
+			}
+		}
+		n.log = append(n.log, e)
+	}
+
+	last := req.PrevLogIndex + uint64(len(req.Entries))
+	if commit := min(req.LeaderCommit, last); commit > n.commitIndex {
+		n.commitIndex = commit
+		n.wakeApply()
+	}
+	return appendResponse{Term: n.term, Success: true}
+}
+
+// truncate answers a log mismatch at index. Callers must hold n.mu.
+func (n *RaftNode) truncate(index uint64) appendResponse {
+	if resp, ok := n.truncateAt(index); !ok {
+		return resp
+	}
+	return appendResponse{Term: n.term, NextIndex: max(n.commitIndex+1, n.snapIndex+1)}
+}
+
+// truncateAt drops the log from index on. Entries this member already
+// applied can't be taken back, so it asks for a snapshot instead.
+// Callers must hold n.mu.
+func (n *RaftNode) truncateAt(index uint64) (appendResponse, bool) {
+	if index <= n.lastApplied {
+		return appendResponse{Term: n.term, NeedSnapshot: true}, false
+	}
+	n.log = n.log[:index-n.snapIndex-1]
+	return appendResponse{}, true
+}
+
+// handleSnapshot replaces the catalog with the leader's
+func (n *RaftNode) handleSnapshot(req snapshotRequest) appendResponse {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if req.Term < n.term {
+		return appendResponse{Term: n.term}
+	}
+	n.stepDown(req.Term)
+	n.leader = req.Leader
+	n.resetTimer()
+
+	products, ledgers := splitLedgers(req.Products)
+	store.products = products
+	stockLedger.restore(products, ledgers)
+	codes.rebuild(products)
+	suggestions.rebuild(products)
+	store.removed = time.Now().UTC()
+	store.mu.cleared = true
+	if store.wal != nil {
+		start := time.Now()
+		err := store.wal.compact(store.products)
+		walDependency.observe(start, err)
+		if err != nil {
+			log.Printf("raft: writing snapshot to the WAL: %v", err)
+		}
+	}
+
+	if req.LastIndex <= n.lastIndex() && n.termAt(req.LastIndex) == req.LastTerm && req.LastIndex >= n.snapIndex {
+		n.log = append([]raftEntry(nil), n.log[req.LastIndex-n.snapIndex:]...)
+	} else {
+		n.log = nil
+	}
+	n.snapIndex, n.snapTerm = req.LastIndex, req.LastTerm
+	n.synced = true
+	n.commitIndex = max(n.commitIndex, req.LastIndex)
+	n.lastApplied = req.LastIndex
+	log.Printf("raft: installed snapshot of %d products at index %d", len(products), req.LastIndex)
+	n.wakeApply()
+	return appendResponse{Term: n.term, Success: true}
+}
+
+// leaderProxy returns the reverse proxy to the current leader, or nil
+func (n *RaftNode) leaderProxy() (*httputil.ReverseProxy, string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.leader == "" || n.leader == n.self {
+		return nil, n.leader
+	}
+	if n.proxyFor != n.leader {
+		target, err := url.Parse(n.leader)
+		if err != nil {
+			return nil, n.leader
+		}
+		leader := n.leader
+		n.proxy = httputil.NewSingleHostReverseProxy(target)
+		n.proxy.Transport = n.http.Transport
+		n.proxy.ModifyResponse = dropEdgeHeaders
+		n.proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			json.NewEncoder(w).Encode(gin.H{"error": "Leader unreachable", "leader": leader})
+		}
+		n.proxyFor = leader
+	}
+	return n.proxy, n.leader
+}
+
+// raftLocalReads are the routes followers answer from their own copy of
+// the catalog. Everything else reads or writes state that isn't
+// replicated and goes to the leader.
+var raftLocalReads = map[string]bool{
+	"/products":                   true,
+	"/products/low-stock":         true,
+	"/products/stream":            true,
+	"/products/:id":               true,
+	"/products/:id/variants":      true,
+	"/products/:id/variants/:sku": true,
+}
+
+// raftRoute sends requests followers can't serve to the leader. The
+// leader answers writes once they're committed, as propose waits for it.
+// Returns: 503 Service Unavailable - No leader
+func raftRoute() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if replication == nil {
+			c.Next()
+			return
+		}
+		// The route without its /v1 prefix
+		path := c.FullPath()
+		if i := strings.IndexByte(path[1:], '/'); i >= 0 {
+			path = path[i+1:]
+		}
+		localRead := (c.Request.Method == http.MethodGet || c.Request.Method == http.MethodHead) && raftLocalReads[path]
+
+		if !replication.leading() {
+			if localRead {
+				c.Next()
+				return
+			}
+			proxy, leader := replication.leaderProxy()
+			if proxy == nil || c.GetHeader(raftForwardedHeader) != "" {
+				c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{
+					"error":  "No leader available",
+					"leader": leader,
+				})
+				return
+			}
+			c.Request.Header.Set("X-Request-ID", c.GetString(requestIDKey))
+			c.Writer.Header().Del("X-Request-ID")
+			c.Writer.Header().Del("API-Version")
+			c.Request.Header.Set(raftForwardedHeader, replication.self)
+			c.Header("X-Raft-Leader", leader)
+			proxy.ServeHTTP(c.Writer, c.Request)
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// checkRaftSecret rejects Raft calls without RAFT_SECRET, when set
+func checkRaftSecret(c *gin.Context) bool {
+	if replication == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Replication is not enabled"})
+		return false
+	}
+	if replication.secret != "" && subtle.ConstantTimeCompare([]byte(c.GetHeader("X-Cluster-Secret")), []byte(replication.secret)) != 1 {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid cluster secret"})
+		return false
+	}
+	return true
+}
+
+// raftRPC serves one Raft RPC
+func raftRPC[Req, Resp any](handle func(n *RaftNode, req Req) Resp) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !checkRaftSecret(c) {
+			return
+		}
+		var req Req
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error":   "Invalid Raft request",
+				"details": err.Error(),
+			})
+			return
+		}
+		c.JSON(http.StatusOK, handle(replication, req))
+	}
+}
+
+// getRaftStatus returns this member's view of the cluster
+// Returns: 200 OK - Role, term, leader and log positions (Cat counting votes!)
+// Returns: 404 Not Found - Replication is not enabled
+func getRaftStatus(c *gin.Context) {
+	if replication == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Replication is not enabled"})
+		return
+	}
+
+	n := replication
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	status := gin.H{
+		"self":         n.self,
+		"role":         n.role,
+		"term":         n.term,
+		"leader":       n.leader,
+		"last_index":   n.lastIndex(),
+		"commit_index": n.commitIndex,
+		"last_applied": n.lastApplied,
+		"snapshot":     n.snapIndex,
+	}
+	if n.role == raftLeader {
+		match := gin.H{}
+		for _, peer := range n.peers {
+			match[peer] = n.matchIndex[peer]
+		}
+		status["match_index"] = match
+	}
+	c.JSON(http.StatusOK, status)
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// raftTestCluster runs Raft members in one process. Their RPCs go through
+// a transport that calls the other members directly and drops the calls
+// between members on either side of a partition.
+type raftTestCluster struct {
+	t     *testing.T
+	nodes map[string]*RaftNode
+
+	mu      sync.Mutex
+	cut     map[string]bool // members cut off from the rest
+	applied map[string][]walRecord
+}
+
+func newRaftTestCluster(t *testing.T, names ...string) *raftTestCluster {
+	tc := &raftTestCluster{
+		t:       t,
+		nodes:   make(map[string]*RaftNode),
+		cut:     make(map[string]bool),
+		applied: make(map[string][]walRecord),
+	}
+	for _, name := range names {
+		self := "http://" + name
+		n := &RaftNode{
+			self:            self,
+			electionTimeout: 50 * time.Millisecond,
+			heartbeat:       10 * time.Millisecond,
+			commitTimeout:   500 * time.Millisecond,
+			maxLog:          1000,
+			http:            &http.Client{Transport: raftTestTransport{tc, self}},
+			role:            raftFollower,
+			synced:          true,
+			nextIndex:       make(map[string]uint64),
+			matchIndex:      make(map[string]uint64),
+			contact:         make(map[string]time.Time),
+			changed:         make(chan struct{}),
+			wake:            make(map[string]chan struct{}),
+			applyWake:       make(chan struct{}, 1),
+		}
+		for _, peer := range names {
+			if peer != name {
+				n.peers = append(n.peers, "http://"+peer)
+				n.wake["http://"+peer] = make(chan struct{}, 1)
+			}
+		}
+		n.applyFn = func(rec walRecord) error {
+			tc.mu.Lock()
+			defer tc.mu.Unlock()
+			tc.applied[self] = append(tc.applied[self], rec)
+			return nil
+		}
+		tc.nodes[self] = n
+	}
+	for _, n := range tc.nodes {
+		go n.run()
+	}
+	return tc
+}
+
+// partition cuts members off from everyone else, or heals the cluster
+// when called with none
+func (tc *raftTestCluster) partition(names ...string) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	tc.cut = make(map[string]bool)
+	for _, name := range names {
+		tc.cut[name] = true
+	}
+}
+
+func (tc *raftTestCluster) reachable(from, to string) bool {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	return tc.cut[from] == tc.cut[to]
+}
+
+// appliedIDs lists the IDs of the records a member applied, in order
+func (tc *raftTestCluster) appliedIDs(self string) string {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	var ids []string
+	for _, rec := range tc.applied[self] {
+		ids = append(ids, rec.ID)
+	}
+	return strings.Join(ids, ",")
+}
+
+// leader waits for exactly one leader among the members given, all
+// following it in its term
+func (tc *raftTestCluster) leader(among ...string) *RaftNode {
+	tc.t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		var leader *RaftNode
+		leaders, agreed := 0, true
+		for _, self := range among {
+			n := tc.nodes[self]
+			n.mu.Lock()
+			if n.role == raftLeader {
+				leaders++
+				leader = n
+			}
+			n.mu.Unlock()
+		}
+		if leaders == 1 {
+			leader.mu.Lock()
+			term := leader.term
+			leader.mu.Unlock()
+			for _, self := range among {
+				n := tc.nodes[self]
+				n.mu.Lock()
+				agreed = agreed && n.term == term && n.leader == leader.self
+				n.mu.Unlock()
+			}
+			if agreed {
+				return leader
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	tc.t.Fatalf("no single leader among %v", among)
+	return nil
+}
+
+// propose writes a product through a member, as a handler would
+func (tc *raftTestCluster) propose(n *RaftNode, id string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	return n.propose(walRecord{Op: walPut, ID: id, Product: &Product{ID: id}})
+}
+
+// waitApplied waits for a member to have applied exactly the IDs given
+func (tc *raftTestCluster) waitApplied(self, want string) {
+	tc.t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if tc.appliedIDs(self) == want {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	tc.t.Fatalf("%s applied %q, want %q", self, tc.appliedIDs(self), want)
+}
+
+func (tc *raftTestCluster) others(self string) []string {
+	var list []string
+	for name := range tc.nodes {
+		if name != self {
+			list = append(list, name)
+		}
+	}
+	return list
+}
+
+// raftTestTransport delivers one member's RPCs to the others
+type raftTestTransport struct {
+	tc   *raftTestCluster
+	from string
+}
+
+func (rt raftTestTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	to := "http://" + req.URL.Host
+	n, exists := rt.tc.nodes[to]
+	if !exists || !rt.tc.reachable(rt.from, to) {
+		return nil, errors.New("unreachable")
+	}
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp any
+	switch rpc := strings.TrimPrefix(req.URL.Path, "/internal/raft/"); rpc {
+	case "vote":
+		var vote voteRequest
+		if err := json.Unmarshal(body, &vote); err != nil {
+			return nil, err
+		}
+		resp = n.handleVote(vote)
+	case "append":
+		var app appendRequest
+		if err := json.Unmarshal(body, &app); err != nil {
+			return nil, err
+		}
+		resp = n.handleAppend(app)
+	default:
+		return nil, errors.New("unexpected RPC " + rpc)
+	}
+	data, err := json.Marshal(resp)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body:       io.NopCloser(bytes.NewReader(data)),
+		Request:    req,
+	}, nil
+}
+
+func TestRaftElectsOneLeader(t *testing.T) {
+	tc := newRaftTestCluster(t, "a", "b", "c")
+	leader := tc.leader("http://a", "http://b", "http://c")
+
+	if err := tc.propose(leader, "p1"); err != nil {
+		t.Fatalf("propose on the leader: %v", err)
+	}
+	for self := range tc.nodes {
+		tc.waitApplied(self, "p1")
+	}
+	for _, self := range tc.others(leader.self) {
+		if err := tc.propose(tc.nodes[self], "p2"); !errors.Is(err, errNotLeader) {
+			t.Errorf("propose on follower %s: got %v, want errNotLeader", self, err)
+		}
+	}
+}
+
+func TestRaftLeaderWithoutMajorityAppliesNothing(t *testing.T) {
+	tc := newRaftTestCluster(t, "a", "b", "c")
+	leader := tc.leader("http://a", "http://b", "http://c")
+	if err := tc.propose(leader, "p1"); err != nil {
+		t.Fatalf("propose: %v", err)
+	}
+	tc.waitApplied(leader.self, "p1")
+
+	tc.partition(leader.self)
+	err := tc.propose(leader, "lost")
+	if !errors.Is(err, errCommitTimeout) && !errors.Is(err, errLostLeadership) {
+		t.Fatalf("propose without a majority: got %v, want a commit failure", err)
+	}
+	if got := tc.appliedIDs(leader.self); got != "p1" {
+		t.Errorf("isolated leader applied %q, want only the committed p1", got)
+	}
+}
+
+func TestRaftPartitionElectsNewLeaderAndHeals(t *testing.T) {
+	tc := newRaftTestCluster(t, "a", "b", "c")
+	old := tc.leader("http://a", "http://b", "http://c")
+	if err := tc.propose(old, "p1"); err != nil {
+		t.Fatalf("propose: %v", err)
+	}
+	old.mu.Lock()
+	oldTerm := old.term
+	old.mu.Unlock()
+
+	// The old leader takes a write it can't commit while the majority
+	// elects a leader of its own
+	tc.partition(old.self)
+	if err := tc.propose(old, "lost"); err == nil {
+		t.Fatal("propose on a cut-off leader succeeded")
+	}
+	rest := tc.others(old.self)
+	leader := tc.leader(rest...)
+	leader.mu.Lock()
+	term := leader.term
+	leader.mu.Unlock()
+	if term <= oldTerm {
+		t.Fatalf("new leader's term %d isn't past the old one's %d", term, oldTerm)
+	}
+	if err := tc.propose(leader, "p2"); err != nil {
+		t.Fatalf("propose on the new leader: %v", err)
+	}
+
+	// Healed, the old leader drops its uncommitted entry for the new
+	// leader's log
+	tc.partition()
+	tc.leader("http://a", "http://b", "http://c")
+	for self := range tc.nodes {
+		tc.waitApplied(self, "p1,p2")
+	}
+}
+
+func TestRaftAppendResolvesLogConflicts(t *testing.T) {
+	entry := func(term, index uint64, id string) raftEntry {
+		return raftEntry{Term: term, Index: index, Record: walRecord{Op: walPut, ID: id, Product: &Product{ID: id}}}
+	}
+	tests := []struct {
+		name        string
+		log         []raftEntry
+		lastApplied uint64
+		req         appendRequest
+		want        appendResponse
+		wantLog     string // term:id of each entry after the request
+	}{
+		{
+			name: "appends after a matching entry",
+			log:  []raftEntry{entry(1, 1, "a")},
+			req:  appendRequest{Term: 1, PrevLogIndex: 1, PrevLogTerm: 1, Entries: []raftEntry{entry(1, 2, "b")}},
+			want: appendResponse{Term: 1, Success: true}, wantLog: "1:a,1:b",
+		},
+		{
+			name: "skips entries it already has",
+			log:  []raftEntry{entry(1, 1, "a"), entry(1, 2, "b")},
+			req:  appendRequest{Term: 1, PrevLogIndex: 0, Entries: []raftEntry{entry(1, 1, "a"), entry(1, 2, "b")}},
+			want: appendResponse{Term: 1, Success: true}, wantLog: "1:a,1:b",
+		},
+		{
+			name: "replaces a conflicting unapplied tail",
+			log:  []raftEntry{entry(1, 1, "a"), entry(1, 2, "stale"), entry(1, 3, "stale")},
+			req:  appendRequest{Term: 2, PrevLogIndex: 1, PrevLogTerm: 1, Entries: []raftEntry{entry(2, 2, "b")}},
+			want: appendResponse{Term: 2, Success: true}, wantLog: "1:a,2:b",
+		},
+		{
+			name: "asks for earlier entries when it's behind",
+			log:  []raftEntry{entry(1, 1, "a")},
+			req:  appendRequest{Term: 1, PrevLogIndex: 3, PrevLogTerm: 1},
+			want: appendResponse{Term: 1, NextIndex: 2}, wantLog: "1:a",
+		},
+		{
+			name: "drops a mismatched previous entry and backs up",
+			log:  []raftEntry{entry(1, 1, "a"), entry(1, 2, "stale")},
+			req:  appendRequest{Term: 2, PrevLogIndex: 2, PrevLogTerm: 2},
+			want: appendResponse{Term: 2, NextIndex: 1}, wantLog: "1:a",
+		},
+		{
+			name:        "asks for a snapshot when an applied entry conflicts",
+			log:         []raftEntry{entry(1, 1, "a"), entry(1, 2, "b")},
+			lastApplied: 2,
+			req:         appendRequest{Term: 2, PrevLogIndex: 1, PrevLogTerm: 1, Entries: []raftEntry{entry(2, 2, "c")}},
+			want:        appendResponse{Term: 2, NeedSnapshot: true}, wantLog: "1:a,1:b",
+		},
+		{
+			name: "rejects an older term",
+			log:  []raftEntry{entry(3, 1, "a")},
+			req:  appendRequest{Term: 2, PrevLogIndex: 1, PrevLogTerm: 3, Entries: []raftEntry{entry(2, 2, "b")}},
+			want: appendResponse{Term: 3}, wantLog: "3:a",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n := &RaftNode{
+				role:            raftFollower,
+				synced:          true,
+				electionTimeout: time.Second,
+				term:            tt.log[len(tt.log)-1].Term,
+				log:             tt.log,
+				commitIndex:     tt.lastApplied,
+				lastApplied:     tt.lastApplied,
+				changed:         make(chan struct{}),
+				applyWake:       make(chan struct{}, 1),
+			}
+			tt.req.Leader = "http://leader"
+			if got := n.handleAppend(tt.req); got != tt.want {
+				t.Errorf("handleAppend = %+v, want %+v", got, tt.want)
+			}
+			var entries []string
+			for _, e := range n.log {
+				entries = append(entries, fmt.Sprintf("%d:%s", e.Term, e.Record.ID))
+			}
+			if got := strings.Join(entries, ","); got != tt.wantLog {
+				t.Errorf("log = %s, want %s", got, tt.wantLog)
+			}
+		})
+	}
+}
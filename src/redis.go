@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// redisError is an error reply from Redis
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+// RedisClient is a minimal Redis client speaking RESP2, enough for the
+// response cache. REDIS_URL takes the redis:// or rediss:// (TLS, as
+// ElastiCache uses with in-transit encryption) form, with an optional
+// password and database number: rediss://:secret@host:6379/0.
+type RedisClient struct {
+	addr     string
+	username string
+	password string
+	db       int
+	tls      bool
+	timeout  time.Duration
+
+	pool  *connPool
+	slots chan struct{} // one per open connection, REDIS_POOL_SIZE
+	idle  chan *redisConn
+}
+
+type redisConn struct {
+	net.Conn
+	r        *bufio.Reader
+	created  time.Time
+	returned time.Time
+}
+
+func newRedisClient(rawURL string) (*RedisClient, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "redis" && u.Scheme != "rediss" {
+		return nil, fmt.Errorf("unsupported scheme %q, want redis:// or rediss://", u.Scheme)
+	}
+	r := &RedisClient{
+		addr:    u.Host,
+		tls:     u.Scheme == "rediss",
+		timeout: envDuration("REDIS_TIMEOUT", 200*time.Millisecond),
+	}
+	if u.Port() == "" {
+		r.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		r.username = u.User.Username()
+		r.password, _ = u.User.Password()
+	}
+	if db := strings.TrimPrefix(u.Path, "/"); db != "" {
+		if r.db, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("invalid database %q", db)
+		}
+	}
+
+	size := max(envInt("REDIS_POOL_SIZE", 16), 1)
+	r.pool = registerPool("redis", size, size)
+	r.slots = make(chan struct{}, size)
+	r.idle = make(chan *redisConn, size)
+	return r, nil
+}
+
+// do runs one command and returns its reply: a string, an int64, []byte
+// or nil for bulk strings, []any for arrays
+func (r *RedisClient) do(ctx context.Context, args ...string) (any, error) {
+	conn, err := r.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Now().Add(r.timeout))
+	reply, err := roundTrip(conn, args)
+	r.put(conn, err)
+	return reply, err
+}
+
+// pipeline sends commands in one round trip and returns their replies,
+// with error replies in place as redisError values
+func (r *RedisClient) pipeline(ctx context.Context, cmds [][]string) ([]any, error) {
+	conn, err := r.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Now().Add(r.timeout))
+	var buf []byte
+	for _, args := range cmds {
+		buf = append(buf, encodeRedisCommand(args)...)
+	}
+	replies := make([]any, len(cmds))
+	if _, err = conn.Write(buf); err == nil {
+		for i := range replies {
+			if replies[i], err = readRedisReply(conn.r); err != nil {
+				var reply redisError
+				if !errors.As(err, &reply) {
+					break
+				}
+				replies[i], err = err, nil
+			}
+		}
+	}
+	r.put(conn, err)
+	if err != nil {
+		return nil, err
+	}
+	return replies, nil
+}
+
+func roundTrip(conn *redisConn, args []string) (any, error) {
+	if _, err := conn.Write(encodeRedisCommand(args)); err != nil {
+		return nil, err
+	}
+	return readRedisReply(conn.r)
+}
+
+// get takes an idle connection or dials one, waiting while all
+// REDIS_POOL_SIZE connections are in use
+func (r *RedisClient) get(ctx context.Context) (*redisConn, error) {
+	for {
+		select {
+		case conn := <-r.idle:
+			if r.expired(conn) {
+				r.discard(conn)
+				continue
+			}
+			return r.checkout(conn), nil
+		default:
+		}
+		select {
+		case r.slots <- struct{}{}:
+			return r.open(ctx)
+		default:
+		}
+
+		// Every connection is in use, wait for one to come back
+		start := time.Now()
+		timeout := time.NewTimer(r.timeout)
+		select {
+		case conn := <-r.idle:
+			timeout.Stop()
+			r.pool.waitCount.Add(1)
+			r.pool.waitTime.Add(int64(time.Since(start)))
+			if r.expired(conn) {
+				r.discard(conn)
+				continue
+			}
+			return r.checkout(conn), nil
+		case r.slots <- struct{}{}:
+			timeout.Stop()
+			r.pool.waitCount.Add(1)
+			r.pool.waitTime.Add(int64(time.Since(start)))
+			return r.open(ctx)
+		case <-ctx.Done():
+			timeout.Stop()
+			return nil, ctx.Err()
+		case <-timeout.C:
+			return nil, errors.New("redis: timed out waiting for a connection")
+		}
+	}
+}
+
+// expired reports whether an idle connection outlived HTTP_POOL_IDLE_TIMEOUT
+// or HTTP_POOL_MAX_LIFETIME
+func (r *RedisClient) expired(conn *redisConn) bool {
+	return time.Since(conn.returned) > poolIdleTimeout || poolMaxLifetime > 0 && time.Since(conn.created) > poolMaxLifetime
+}
+
+func (r *RedisClient) checkout(conn *redisConn) *redisConn {
+	r.pool.inUse.Add(1)
+	r.pool.reused.Add(1)
+	return conn
+}
+
+// open dials a connection into a slot already taken
+func (r *RedisClient) open(ctx context.Context) (*redisConn, error) {
+	conn, err := r.dial(ctx)
+	if err != nil {
+		<-r.slots
+		return nil, err
+	}
+	r.pool.inUse.Add(1)
+	return conn, nil
+}
+
+// put returns a connection to the pool, or closes it after an I/O error.
+// Error replies leave the connection usable.
+func (r *RedisClient) put(conn *redisConn, err error) {
+	r.pool.inUse.Add(-1)
+	var reply redisError
+	if err != nil && !errors.As(err, &reply) {
+		r.discard(conn)
+		return
+	}
+	conn.returned = time.Now()
+	r.idle <- conn
+}
+
+func (r *RedisClient) discard(conn *redisConn) {
+	conn.Close()
+	r.pool.open.Add(-1)
+	<-r.slots
+}
+
+// dial connects, authenticates and selects the database
+func (r *RedisClient) dial(ctx context.Context) (*redisConn, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*r.timeout)
+	defer cancel()
+
+	var conn net.Conn
+	var err error
+	dialer := &net.Dialer{KeepAlive: 30 * time.Second}
+	if r.tls {
+		host, _, _ := net.SplitHostPort(r.addr)
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: &tls.Config{ServerName: host}}).DialContext(ctx, "tcp", r.addr)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", r.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	rc := &redisConn{Conn: conn, r: bufio.NewReader(conn), created: time.Now()}
+	r.pool.open.Add(1)
+	r.pool.dials.Add(1)
+
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	var setup [][]string
+	switch {
+	case r.username != "":
+		setup = append(setup, []string{"AUTH", r.username, r.password})
+	case r.password != "":
+		setup = append(setup, []string{"AUTH", r.password})
+	}
+	if r.db != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(r.db)})
+	}
+	for _, cmd := range setup {
+		if _, err := roundTrip(rc, cmd); err != nil {
+			conn.Close()
+			r.pool.open.Add(-1)
+			return nil, err
+		}
+	}
+	return rc, nil
+}
+
+// encodeRedisCommand writes a command as a RESP array of bulk strings
+func encodeRedisCommand(args []string) []byte {
+	b := make([]byte, 0, 64)
+	b = fmt.Appendf(b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		b = fmt.Appendf(b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	return b
+}
+
+// readRedisReply reads one RESP2 reply
+func readRedisReply(r *bufio.Reader) (any, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("redis: malformed reply %q", line)
+	}
+	kind, body := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return body, nil
+	case '-':
+		return nil, redisError(body)
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(body)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		return data[:n], nil
+	case '*':
+		n, err := strconv.Atoi(body)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		items := make([]any, n)
+		for i := range items {
+			if items[i], err = readRedisReply(r); err != nil {
+				var reply redisError
+				if !errors.As(err, &reply) {
+					return nil, err
+				}
+				items[i] = err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadRedisReply(t *testing.T) {
+	tests := []struct {
+		name  string
+		reply string
+		want  any
+		err   bool
+	}{
+		{"simple string", "+OK\r\n", "OK", false},
+		{"integer", ":-42\r\n", int64(-42), false},
+		{"bulk string", "$5\r\nhello\r\n", []byte("hello"), false},
+		{"bulk string with CRLF", "$4\r\na\r\nb\r\n", []byte("a\r\nb"), false},
+		{"empty bulk string", "$0\r\n\r\n", []byte{}, false},
+		{"null bulk string", "$-1\r\n", nil, false},
+		{"null array", "*-1\r\n", nil, false},
+		{"array", "*3\r\n$3\r\nfoo\r\n$-1\r\n:7\r\n", []any{[]byte("foo"), nil, int64(7)}, false},
+		{"nested array", "*1\r\n*1\r\n+a\r\n", []any{[]any{"a"}}, false},
+		{"error in an array", "*2\r\n-ERR wrong type\r\n+OK\r\n", []any{redisError("ERR wrong type"), "OK"}, false},
+		{"error", "-ERR unknown command\r\n", nil, true},
+		{"bare LF", "+OK\n", nil, true},
+		{"unknown type", "%1\r\n", nil, true},
+		{"bad integer", ":x\r\n", nil, true},
+		{"truncated bulk string", "$5\r\nhel", nil, true},
+		{"truncated array", "*2\r\n+a\r\n", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readRedisReply(bufio.NewReader(strings.NewReader(tt.reply)))
+			if tt.err {
+				if err == nil {
+					t.Fatalf("read %#v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("reply = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadRedisReplyError(t *testing.T) {
+	_, err := readRedisReply(bufio.NewReader(strings.NewReader("-WRONGPASS invalid password\r\n")))
+	var reply redisError
+	if !errors.As(err, &reply) || reply != "WRONGPASS invalid password" {
+		t.Errorf("err = %v, want the error reply", err)
+	}
+}
+
+func TestEncodeRedisCommand(t *testing.T) {
+	got := string(encodeRedisCommand([]string{"SET", "key", "", "a\r\nb"}))
+	want := "*4\r\n$3\r\nSET\r\n$3\r\nkey\r\n$0\r\n\r\n$4\r\na\r\nb\r\n"
+	if got != want {
+		t.Errorf("encoded %q, want %q", got, want)
+	}
+}
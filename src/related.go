@@ -0,0 +1,252 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Related product kinds. Curated links are related or accessory; the rest
+// come from orders.
+const (
+	relatedKindRelated        = "related"
+	relatedKindAccessory      = "accessory"
+	relatedKindBoughtTogether = "bought_together"
+)
+
+// Limits of related products
+const (
+	maxRelatedLinks     = 20
+	defaultRelatedLimit = 10
+	maxRelatedLimit     = 50
+	maxTrackedOrders    = 10000
+)
+
+// minCoPurchases is how many orders must have two products together
+// before one is suggested with the other, RELATED_MIN_ORDERS
+var minCoPurchases = envInt("RELATED_MIN_ORDERS", 2)
+
+// RelatedLink is a product curated as related to, or an accessory of,
+// another
+type RelatedLink struct {
+	ID   string `json:"id"`
+	Kind string `json:"kind,omitempty"` // related when left out
+}
+
+// relatedViolations checks and normalizes a product's related links, for
+// productViolations. Links to products that don't exist are allowed, so
+// products can be linked before they're created; they're skipped when
+// read.
+func relatedViolations(p *Product, violations *[]Violation) {
+	if len(p.Related) > maxRelatedLinks {
+		*violations = append(*violations, Violation{Code: violationOutOfRange, Field: "related", Message: fmt.Sprintf("Must have at most %d links", maxRelatedLinks)})
+	}
+	seen := make(map[string]bool, len(p.Related))
+	for i := range p.Related {
+		link := &p.Related[i]
+		prefix := fmt.Sprintf("related[%d]", i)
+		normalizeText(&link.ID, prefix+".id", maxIDLength, violations)
+		switch {
+		case link.ID == "":
+			*violations = append(*violations, Violation{Code: violationRequired, Field: prefix + ".id", Message: "Is required"})
+		case link.ID == p.ID:
+			*violations = append(*violations, Violation{Code: violationInvalid, Field: prefix + ".id", Message: "Must not be the product itself"})
+		case seen[link.ID]:
+			*violations = append(*violations, Violation{Code: violationDuplicate, Field: prefix + ".id", Message: fmt.Sprintf("Duplicate link to %q", link.ID)})
+		}
+		seen[link.ID] = true
+		switch link.Kind {
+		case "":
+			link.Kind = relatedKindRelated
+		case relatedKindRelated, relatedKindAccessory:
+		default:
+			*violations = append(*violations, Violation{Code: violationInvalid, Field: prefix + ".kind", Message: "Must be related or accessory"})
+		}
+	}
+}
+
+// CoPurchases counts how often products are bought together, from sale
+// events that carry an order ID. The products of the last
+// maxTrackedOrders orders are kept, so items of an order reported in
+// several batches still pair up. Like analytics, it's in memory since the
+// process started. Orders and products are by productKey, so tenants'
+// orders never pair up.
+type CoPurchases struct {
+	mu     sync.Mutex
+	orders map[string][]string // order key to its products
+	recent []string            // order IDs, oldest first
+	pairs  map[string]map[string]int
+}
+
+// Global co-purchase counts
+var coPurchases = &CoPurchases{
+	orders: make(map[string][]string),
+	pairs:  make(map[string]map[string]int),
+}
+
+// recordSale adds a product to an order, pairing it with the products
+// already in it
+func (cp *CoPurchases) recordSale(orderID, productID string) {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+
+	products, exists := cp.orders[orderID]
+	if !exists {
+		if len(cp.recent) >= maxTrackedOrders {
+			delete(cp.orders, cp.recent[0])
+			cp.recent = cp.recent[1:]
+		}
+		cp.recent = append(cp.recent, orderID)
+	}
+	for _, other := range products {
+		if other == productID {
+			return
+		}
+	}
+	for _, other := range products {
+		cp.pair(productID, other)
+		cp.pair(other, productID)
+	}
+	cp.orders[orderID] = append(products, productID)
+}
+
+// pair counts one more order with both products. Callers must hold cp.mu.
+func (cp *CoPurchases) pair(a, b string) {
+	counts, exists := cp.pairs[a]
+	if !exists {
+		counts = make(map[string]int)
+		cp.pairs[a] = counts
+	}
+	counts[b]++
+}
+
+// removeProduct forgets a purged product
+func (cp *CoPurchases) removeProduct(id string) {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+
+	for other := range cp.pairs[id] {
+		delete(cp.pairs[other], id)
+	}
+	delete(cp.pairs, id)
+}
+
+// coPurchase is a product bought together with another, by key, and in
+// how many orders
+type coPurchase struct {
+	key    string
+	orders int
+}
+
+// boughtWith returns the products bought with a product in at least
+// minCoPurchases orders, most often first
+func (cp *CoPurchases) boughtWith(id string) []coPurchase {
+	cp.mu.Lock()
+	list := make([]coPurchase, 0, len(cp.pairs[id]))
+	for other, orders := range cp.pairs[id] {
+		if orders >= minCoPurchases {
+			list = append(list, coPurchase{key: other, orders: orders})
+		}
+	}
+	cp.mu.Unlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].orders != list[j].orders {
+			return list[i].orders > list[j].orders
+		}
+		return list[i].key < list[j].key
+	})
+	return list
+}
+
+// RelatedProduct is an entry of GET /products/:id/related
+type RelatedProduct struct {
+	Product Product `json:"product"`
+	Kind    string  `json:"kind"`
+	Orders  int     `json:"orders,omitempty"` // for bought_together
+}
+
+// relatedProducts lists the products related to p: curated links first,
+// in their order, then those frequently bought with it. visible drops
+// products the caller doesn't see; kind, when set, keeps only that kind.
+func relatedProducts(p Product, kind string, visible func(Product) bool) []RelatedProduct {
+	var bought []coPurchase
+	if kind == "" || kind == relatedKindBoughtTogether {
+		bought = coPurchases.boughtWith(p.key())
+	}
+
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	var related []RelatedProduct
+	seen := map[string]bool{p.key(): true}
+	for _, link := range p.Related {
+		key := productKey(p.Tenant, link.ID)
+		other, exists := store.get(key)
+		if !exists || seen[key] || !visible(other) || kind != "" && kind != link.Kind {
+			continue
+		}
+		seen[key] = true
+		related = append(related, RelatedProduct{Product: other, Kind: link.Kind})
+	}
+	for _, b := range bought {
+		other, exists := store.get(b.key)
+		if !exists || seen[b.key] || !visible(other) {
+			continue
+		}
+		seen[b.key] = true
+		related = append(related, RelatedProduct{Product: other, Kind: relatedKindBoughtTogether, Orders: b.orders})
+	}
+	return related
+}
+
+// getRelatedProducts returns the products to cross-sell with a product,
+// ?kind= related, accessory or bought_together and ?limit= (default 10,
+// at most 50)
+// Returns: 200 OK - Related products, curated first (Cat with friends!)
+// Returns: 400 Bad Request - Invalid kind or limit
+// Returns: 404 Not Found - Product doesn't exist
+func getRelatedProducts(c *gin.Context) {
+	id := c.Param("id")
+
+	kind := c.Query("kind")
+	switch kind {
+	case "", relatedKindRelated, relatedKindAccessory, relatedKindBoughtTogether:
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "kind must be related, accessory or bought_together",
+		})
+		return
+	}
+	limit := defaultRelatedLimit
+	if raw := c.Query("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > maxRelatedLimit {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": fmt.Sprintf("limit must be between 1 and %d", maxRelatedLimit),
+			})
+			return
+		}
+		limit = n
+	}
+
+	store.mu.RLock()
+	product, exists := store.getShown(c, id)
+	store.mu.RUnlock()
+	if !exists {
+		productNotFound(c, id)
+		return
+	}
+
+	related := relatedProducts(product, kind, func(p Product) bool { return shownTo(c, p) })
+	related = related[:min(len(related), limit)]
+	c.JSON(http.StatusOK, gin.H{
+		"id":      id,
+		"count":   len(related),
+		"related": related,
+	})
+}
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Find-and-replace job statuses. A job is always previewed first and only
+// applied from its preview, so nobody rewrites the catalog blind.
+const (
+	replacePreviewed  = "previewed"
+	replaceApplied    = "applied"
+	replaceRolledBack = "rolled_back"
+)
+
+// replaceFields are the fields a job can rewrite
+var replaceFields = []string{"name", "description"}
+
+// ReplaceRequest is the body of a find-and-replace job. Find is a literal
+// unless Regex is set, in which case Replace can use $1 and ${name}. The
+// filter is that of the product list: IDs, category and q, live products
+// only.
+type ReplaceRequest struct {
+	Find       string   `json:"find" binding:"required"`
+	Replace    string   `json:"replace"`
+	Regex      bool     `json:"regex"`
+	IgnoreCase bool     `json:"ignore_case"`
+	Fields     []string `json:"fields"` // name and description by default
+	IDs        []string `json:"ids,omitempty"`
+	Category   string   `json:"category,omitempty"`
+	Query      string   `json:"q,omitempty"`
+}
+
+// ReplaceResult is a job's change to one product. Version is the one that
+// was previewed, AppliedVersion the one the job wrote, which rollback
+// needs to still be current.
+type ReplaceResult struct {
+	ID             string                 `json:"id"`
+	Version        int64                  `json:"version"`
+	Changes        map[string]FieldChange `json:"changes"`
+	Status         int                    `json:"status,omitempty"` // once applied
+	Error          string                 `json:"error,omitempty"`
+	Errors         []Violation            `json:"errors,omitempty"`
+	AppliedVersion int64                  `json:"applied_version,omitempty"`
+	RollbackStatus int                    `json:"rollback_status,omitempty"`
+	RollbackError  string                 `json:"rollback_error,omitempty"`
+}
+
+// ReplaceJob is a find-and-replace across a tenant's catalog, with its
+// preview and the outcome of each product. Other tenants can't see it.
+type ReplaceJob struct {
+	ID           string          `json:"id"`
+	Tenant       string          `json:"tenant,omitempty"`
+	Status       string          `json:"status"`
+	Request      ReplaceRequest  `json:"request"`
+	CreatedBy    string          `json:"created_by"`
+	CreatedAt    time.Time       `json:"created_at"`
+	AppliedAt    *time.Time      `json:"applied_at,omitempty"`
+	RolledBackAt *time.Time      `json:"rolled_back_at,omitempty"`
+	Count        int             `json:"count"`
+	Results      []ReplaceResult `json:"results,omitempty"` // left out of lists
+
+	pattern *regexp.Regexp
+}
+
+// ReplaceJobStore keeps our in-memory find-and-replace jobs, until the
+// replace_jobs retention policy drops them
+type ReplaceJobStore struct {
+	mu   sync.Mutex
+	seq  int64
+	jobs map[string]*ReplaceJob
+}
+
+// Global find-and-replace job store
+var replaceJobs = &ReplaceJobStore{
+	jobs: make(map[string]*ReplaceJob),
+}
+
+// compileReplace checks a request and returns its pattern, or why it's
+// invalid
+func compileReplace(req *ReplaceRequest) (*regexp.Regexp, []Violation) {
+	var violations []Violation
+	if len(req.Fields) == 0 {
+		req.Fields = replaceFields
+	}
+	for i, field := range req.Fields {
+		if !slices.Contains(replaceFields, field) {
+			violations = append(violations, Violation{Code: violationInvalid, Field: "fields[" + strconv.Itoa(i) + "]", Message: "Must be name or description"})
+		}
+	}
+	if len(req.IDs) > maxListIDs {
+		violations = append(violations, Violation{Code: violationOutOfRange, Field: "ids", Message: "Must have at most " + strconv.Itoa(maxListIDs) + " ids"})
+	}
+
+	expr := req.Find
+	if !req.Regex {
+		expr = regexp.QuoteMeta(expr)
+	}
+	if req.IgnoreCase {
+		expr = "(?i)" + expr
+	}
+	pattern, err := regexp.Compile(expr)
+	if err != nil {
+		violations = append(violations, Violation{Code: violationInvalid, Field: "find", Message: err.Error()})
+	}
+	return pattern, violations
+}
+
+// rewrite applies the job to a product's fields and returns what changed
+func (j *ReplaceJob) rewrite(p *Product) map[string]FieldChange {
+	changes := make(map[string]FieldChange)
+	for _, field := range j.Request.Fields {
+		value := &p.Name
+		if field == "description" {
+			value = &p.Description
+		}
+		var after string
+		if j.Request.Regex {
+			after = j.pattern.ReplaceAllString(*value, j.Request.Replace)
+		} else {
+			after = j.pattern.ReplaceAllLiteralString(*value, j.Request.Replace)
+		}
+		if after != *value {
+			changes[field] = FieldChange{Before: *value, After: after}
+			*value = after
+		}
+	}
+	return changes
+}
+
+// setFields sets the fields of a product to one side of a preview's
+// changes
+func setFields(p *Product, changes map[string]FieldChange, after bool) {
+	for field, change := range changes {
+		value := change.Before
+		if after {
+			value = change.After
+		}
+		if field == "name" {
+			p.Name = value.(string)
+		} else {
+			p.Description = value.(string)
+		}
+	}
+}
+
+func replaceJobNotFound(c *gin.Context, id string) {
+	c.JSON(http.StatusNotFound, gin.H{
+		"error": "Replace job not found",
+		"id":    id,
+	})
+}
+
+// jobFor returns a job for an action, writing 404 or 409 when it doesn't
+// exist or isn't in the status the action needs
+func jobFor(c *gin.Context, status string) (*ReplaceJob, bool) {
+	id := c.Param("id")
+	job, exists := replaceJobs.jobs[id]
+	if !exists || job.Tenant != tenantOf(c) {
+		replaceJobNotFound(c, id)
+		return nil, false
+	}
+	if job.Status != status {
+		c.JSON(http.StatusConflict, gin.H{"error": "Replace job is " + job.Status, "id": id})
+		return nil, false
+	}
+	return job, true
+}
+
+// createReplaceJob previews a find-and-replace: the products it matches
+// and, for each, the fields before and after. Nothing is written until
+// the job is applied.
+// Returns: 201 Created - Preview (Cat with a red pen!)
+// Returns: 400 Bad Request - Invalid request, or it matches too many products
+func createReplaceJob(c *gin.Context) {
+	var req ReplaceRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":   "Invalid replace job",
+			"details": err.Error(),
+		})
+		return
+	}
+	pattern, violations := compileReplace(&req)
+	if len(violations) > 0 {
+		invalidRequest(c, "Invalid replace job", violations)
+		return
+	}
+
+	job := &ReplaceJob{
+		Tenant:    tenantOf(c),
+		Status:    replacePreviewed,
+		Request:   req,
+		CreatedBy: actor(c),
+		CreatedAt: time.Now().UTC(),
+		Results:   []ReplaceResult{},
+		pattern:   pattern,
+	}
+	query := listQuery{
+		tenant:   job.Tenant,
+		category: strings.ToLower(strings.TrimSpace(req.Category)),
+		text:     strings.ToLower(strings.TrimSpace(req.Query)),
+	}
+	query.ids = slices.Compact(slices.Sorted(slices.Values(req.IDs)))
+
+	store.mu.RLock()
+	for _, p := range query.run(store.products) {
+		if !p.live() {
+			continue
+		}
+		if changes := job.rewrite(&p); len(changes) > 0 {
+			job.Results = append(job.Results, ReplaceResult{ID: p.ID, Version: p.Version, Changes: changes})
+		}
+	}
+	store.mu.RUnlock()
+	sort.Slice(job.Results, func(i, j int) bool { return job.Results[i].ID < job.Results[j].ID })
+
+	job.Count = len(job.Results)
+	if job.Count > maxBatchItems {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Replace job matches too many products, narrow the filter",
+			"count": job.Count,
+			"max":   maxBatchItems,
+		})
+		return
+	}
+
+	replaceJobs.mu.Lock()
+	replaceJobs.seq++
+	job.ID = strconv.FormatInt(replaceJobs.seq, 10)
+	replaceJobs.jobs[job.ID] = job
+	replaceJobs.mu.Unlock()
+
+	c.JSON(http.StatusCreated, job)
+}
+
+// getReplaceJobs lists the tenant's find-and-replace jobs, newest first,
+// without their results
+// Returns: 200 OK - Success
+func getReplaceJobs(c *gin.Context) {
+	replaceJobs.mu.Lock()
+	list := make([]ReplaceJob, 0, len(replaceJobs.jobs))
+	for _, job := range replaceJobs.jobs {
+		if job.Tenant != tenantOf(c) {
+			continue
+		}
+		summary := *job
+		summary.Results = nil
+		list = append(list, summary)
+	}
+	replaceJobs.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.After(list[j].CreatedAt) })
+
+	c.JSON(http.StatusOK, gin.H{
+		"count": len(list),
+		"jobs":  list,
+	})
+}
+
+// getReplaceJob returns a find-and-replace job with its results
+// Returns: 200 OK - Success
+// Returns: 404 Not Found - Job doesn't exist
+func getReplaceJob(c *gin.Context) {
+	replaceJobs.mu.Lock()
+	defer replaceJobs.mu.Unlock()
+
+	id := c.Param("id")
+	job, exists := replaceJobs.jobs[id]
+	if !exists || job.Tenant != tenantOf(c) {
+		replaceJobNotFound(c, id)
+		return
+	}
+	c.JSON(http.StatusOK, job)
+}
+
+// applyReplaceJob writes a previewed job, exactly as previewed. Each
+// product is applied on its own and checked like a PATCH: one that changed
+// since the preview is left alone with 409, like a stale If-Match, one the
+// change would make invalid or break a catalog rule with 400, and one
+// whose SKU or barcode another product took since with 409.
+// Returns: 200 OK - Per-item results
+// Returns: 404 Not Found - Job doesn't exist
+// Returns: 409 Conflict - Job isn't previewed
+func applyReplaceJob(c *gin.Context) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	replaceJobs.mu.Lock()
+	defer replaceJobs.mu.Unlock()
+
+	job, ok := jobFor(c, replacePreviewed)
+	if !ok {
+		return
+	}
+	for i := range job.Results {
+		r := &job.Results[i]
+		product, exists := store.get(productKey(job.Tenant, r.ID))
+		switch {
+		case !exists:
+			r.Status, r.Error = http.StatusNotFound, "Product not found"
+			continue
+		case product.Version != r.Version:
+			r.Status, r.Error = http.StatusConflict, "Product changed since the preview"
+			continue
+		}
+		before := product
+		product = product.clone()
+		setFields(&product, r.Changes, true)
+		if violations := productViolations(&product); len(violations) > 0 {
+			r.Status, r.Error, r.Errors = http.StatusBadRequest, "Invalid product data", violations
+			continue
+		}
+		if violations := codes.conflicts(&product); len(violations) > 0 {
+			r.Status, r.Error, r.Errors = http.StatusConflict, "SKU or barcode is already used by another product", violations
+			continue
+		}
+		if violations := catalogViolations(&product); len(violations) > 0 {
+			r.Status, r.Error, r.Errors = http.StatusBadRequest, "Invalid product data", violations
+			continue
+		}
+		if err := store.save(&product); err != nil {
+			r.Status, r.Error = http.StatusServiceUnavailable, "Write failed: "+err.Error()
+			continue
+		}
+		audit.record(c, "replace", &before, &product)
+		r.Status, r.AppliedVersion = http.StatusOK, product.Version
+	}
+	now := time.Now().UTC()
+	job.Status, job.AppliedAt = replaceApplied, &now
+
+	c.JSON(http.StatusOK, job)
+}
+
+// rollbackReplaceJob puts back the fields an applied job rewrote, on each
+// product still at the version the job wrote; later edits win, with 409.
+// Returns: 200 OK - Per-item results
+// Returns: 404 Not Found - Job doesn't exist
+// Returns: 409 Conflict - Job isn't applied
+func rollbackReplaceJob(c *gin.Context) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	replaceJobs.mu.Lock()
+	defer replaceJobs.mu.Unlock()
+
+	job, ok := jobFor(c, replaceApplied)
+	if !ok {
+		return
+	}
+	for i := range job.Results {
+		r := &job.Results[i]
+		if r.Status != http.StatusOK {
+			continue
+		}
+		product, exists := store.get(productKey(job.Tenant, r.ID))
+		switch {
+		case !exists:
+			r.RollbackStatus, r.RollbackError = http.StatusNotFound, "Product not found"
+			continue
+		case product.Version != r.AppliedVersion:
+			r.RollbackStatus, r.RollbackError = http.StatusConflict, "Product changed since the job"
+			continue
+		}
+		before := product
+		setFields(&product, r.Changes, false)
+		if err := store.save(&product); err != nil {
+			r.RollbackStatus, r.RollbackError = http.StatusServiceUnavailable, "Write failed: "+err.Error()
+			continue
+		}
+		audit.record(c, "replace.rollback", &before, &product)
+		r.RollbackStatus = http.StatusOK
+	}
+	now := time.Now().UTC()
+	job.Status, job.RolledBackAt = replaceRolledBack, &now
+
+	c.JSON(http.StatusOK, job)
+}
+
+// replaceJobRetention is how long jobs are kept after they were last
+// previewed, applied or rolled back, REPLACE_JOB_RETENTION_DAYS. An applied
+// job can't be rolled back once it's gone.
+var replaceJobRetention = time.Duration(envInt("REPLACE_JOB_RETENTION_DAYS", 30)) * 24 * time.Hour
+
+// purgeBefore drops the jobs last touched before the cutoff
+func (s *ReplaceJobStore) purgeBefore(cutoff time.Time, dryRun bool) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	purged := 0
+	for id, job := range s.jobs {
+		last := job.CreatedAt
+		for _, at := range []*time.Time{job.AppliedAt, job.RolledBackAt} {
+			if at != nil && at.After(last) {
+				last = *at
+			}
+		}
+		if last.Before(cutoff) {
+			purged++
+			if !dryRun {
+				delete(s.jobs, id)
+			}
+		}
+	}
+	return purged
+}
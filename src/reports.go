@@ -0,0 +1,278 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// defaultReportRange is the window of reports over time without ?from=
+const defaultReportRange = 30 * 24 * time.Hour
+
+// stockReasons are every reason a stock entry can have
+var stockReasons = []string{reasonRestock, reasonSale, reasonReturn, reasonDamage, reasonCorrection, reasonReceipt, reasonOpening, reasonSet}
+
+// reportRange reads ?from= and ?to= as RFC 3339 times or dates, to
+// excluded. to defaults to now and from to 30 days before it.
+// Returns: 400 Bad Request - Invalid from or to, or from not before to
+func reportRange(c *gin.Context) (time.Time, time.Time, bool) {
+	parse := func(name string, fallback time.Time) (time.Time, bool) {
+		raw := c.Query(name)
+		if raw == "" {
+			return fallback, true
+		}
+		if t, err := time.Parse(time.RFC3339, raw); err == nil {
+			return t.UTC(), true
+		}
+		if t, err := time.Parse(time.DateOnly, raw); err == nil {
+			return t, true
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": name + " must be an RFC 3339 time or a date", name: raw})
+		return time.Time{}, false
+	}
+	to, ok := parse("to", time.Now().UTC())
+	if !ok {
+		return time.Time{}, time.Time{}, false
+	}
+	from, ok := parse("from", to.Add(-defaultReportRange))
+	if !ok {
+		return time.Time{}, time.Time{}, false
+	}
+	if !from.Before(to) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "from must be before to", "from": from, "to": to})
+		return time.Time{}, time.Time{}, false
+	}
+	return from, to, true
+}
+
+// CategoryValue is the stock on hand of a category in one currency, at
+// list price
+type CategoryValue struct {
+	Category string `json:"category"` // "" for products without one
+	Currency string `json:"currency"`
+	Products int    `json:"products"`
+	Units    int    `json:"units"`
+	Value    Money  `json:"value"`
+}
+
+// getInventoryValueReport sums the stock on hand at list price by
+// category, with totals per currency. Variants are valued at their own
+// price. ?category= narrows it down.
+// Returns: 200 OK - Report (Cat adding up the shelves!)
+func getInventoryValueReport(c *gin.Context) {
+	products, _ := reportProducts(c)
+
+	type key struct{ category, currency string }
+	groups := map[key]*CategoryValue{}
+	totals := map[string]*CategoryValue{}
+	for _, p := range products {
+		units, value := 0, Money(0)
+		if len(p.Variants) == 0 {
+			units, value = max(p.Stock, 0), p.Price*Money(max(p.Stock, 0))
+		}
+		for _, v := range p.Variants {
+			units += max(v.Stock, 0)
+			value += (p.Price + v.PriceDelta) * Money(max(v.Stock, 0))
+		}
+		if units == 0 {
+			continue
+		}
+
+		k := key{p.Category, p.Currency}
+		if groups[k] == nil {
+			groups[k] = &CategoryValue{Category: p.Category, Currency: p.Currency}
+		}
+		if totals[p.Currency] == nil {
+			totals[p.Currency] = &CategoryValue{Currency: p.Currency}
+		}
+		for _, g := range []*CategoryValue{groups[k], totals[p.Currency]} {
+			g.Products++
+			g.Units += units
+			g.Value += value
+		}
+	}
+
+	rows := make([]CategoryValue, 0, len(groups))
+	for _, g := range groups {
+		rows = append(rows, *g)
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].Category != rows[j].Category {
+			return rows[i].Category < rows[j].Category
+		}
+		return rows[i].Currency < rows[j].Currency
+	})
+	byCurrency := make([]CategoryValue, 0, len(totals))
+	for _, total := range totals {
+		byCurrency = append(byCurrency, *total)
+	}
+	sort.Slice(byCurrency, func(i, j int) bool { return byCurrency[i].Currency < byCurrency[j].Currency })
+
+	c.JSON(http.StatusOK, gin.H{
+		"count":      len(rows),
+		"categories": rows,
+		"totals":     byCurrency,
+	})
+}
+
+// ProductActivity is what a product sold over a report's range
+type ProductActivity struct {
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	Category   string `json:"category,omitempty"`
+	UnitsSold  int64  `json:"units_sold"`
+	AddsToCart int64  `json:"adds_to_cart"`
+	Views      int64  `json:"views"`
+}
+
+// activityBetween sums the events of every product in [from, to), by
+// product key
+func (a *AnalyticsStore) activityBetween(from, to time.Time) map[string]ProductActivity {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	first, end := from.Unix()/60, (to.Unix()+59)/60
+	activity := make(map[string]ProductActivity)
+	for key, buckets := range a.series {
+		var sum ProductActivity
+		for minute, b := range buckets {
+			if minute >= first && minute < end {
+				sum.UnitsSold += b.sales
+				sum.AddsToCart += b.addsToCart
+				sum.Views += b.views
+			}
+		}
+		if sum.UnitsSold > 0 {
+			activity[key] = sum
+		}
+	}
+	return activity
+}
+
+// getTopProductsReport lists the best sellers between ?from= and ?to=
+// (default the last 30 days) by units sold, up to ?limit= (default 10, at
+// most 100). ?category= narrows it down. Sales are the sale events sent
+// to POST /analytics/events, kept for ANALYTICS_RETENTION_DAYS.
+// Returns: 200 OK - Report
+// Returns: 400 Bad Request - Invalid range or limit
+func getTopProductsReport(c *gin.Context) {
+	from, to, ok := reportRange(c)
+	if !ok {
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "10"))
+	if err != nil || limit < 1 || limit > 100 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and 100", "limit": c.Query("limit")})
+		return
+	}
+	products, _ := reportProducts(c)
+	activity := analytics.activityBetween(from, to)
+
+	rows := make([]ProductActivity, 0)
+	for _, p := range products {
+		if a, sold := activity[p.key()]; sold {
+			a.ID, a.Name, a.Category = p.ID, p.Name, p.Category
+			rows = append(rows, a)
+		}
+	}
+	sort.SliceStable(rows, func(i, j int) bool { return rows[i].UnitsSold > rows[j].UnitsSold })
+	if len(rows) > limit {
+		rows = rows[:limit]
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"from":     from,
+		"to":       to,
+		"count":    len(rows),
+		"products": rows,
+	})
+}
+
+// StockMovement sums the stock entries of a reason, or of a product
+type StockMovement struct {
+	Reason   string `json:"reason,omitempty"`
+	ID       string `json:"id,omitempty"`
+	Name     string `json:"name,omitempty"`
+	Category string `json:"category,omitempty"`
+	Entries  int    `json:"entries"`
+	UnitsIn  int    `json:"units_in"`
+	UnitsOut int    `json:"units_out"`
+	Net      int    `json:"net"`
+}
+
+func (m *StockMovement) add(delta int) {
+	m.Entries++
+	m.Net += delta
+	if delta > 0 {
+		m.UnitsIn += delta
+	} else {
+		m.UnitsOut -= delta
+	}
+}
+
+// getStockMovementsReport sums the stock ledger between ?from= and ?to=
+// (default the last 30 days) by reason and by product, most moved first.
+// ?category=, ?reason= and ?product_id= narrow it down.
+// Returns: 200 OK - Report (Cat tracking every box in and out!)
+// Returns: 400 Bad Request - Invalid range or reason
+func getStockMovementsReport(c *gin.Context) {
+	from, to, ok := reportRange(c)
+	if !ok {
+		return
+	}
+	reason := c.Query("reason")
+	if reason != "" && !slices.Contains(stockReasons, reason) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown reason", "reason": reason, "reasons": stockReasons})
+		return
+	}
+	productID := c.Query("product_id")
+	products, _ := reportProducts(c)
+
+	byReason := map[string]*StockMovement{}
+	rows := make([]StockMovement, 0)
+	total := StockMovement{}
+	stockLedger.mu.Lock()
+	for _, p := range products {
+		if productID != "" && p.ID != productID {
+			continue
+		}
+		row := StockMovement{ID: p.ID, Name: p.Name, Category: p.Category}
+		for _, e := range stockLedger.entries[p.key()] {
+			if e.At.Before(from) || !e.At.Before(to) || reason != "" && e.Reason != reason {
+				continue
+			}
+			if byReason[e.Reason] == nil {
+				byReason[e.Reason] = &StockMovement{Reason: e.Reason}
+			}
+			byReason[e.Reason].add(e.Delta)
+			row.add(e.Delta)
+			total.add(e.Delta)
+		}
+		if row.Entries > 0 {
+			rows = append(rows, row)
+		}
+	}
+	stockLedger.mu.Unlock()
+
+	reasons := make([]StockMovement, 0, len(byReason))
+	for _, m := range byReason {
+		reasons = append(reasons, *m)
+	}
+	sort.Slice(reasons, func(i, j int) bool { return reasons[i].Reason < reasons[j].Reason })
+	sort.SliceStable(rows, func(i, j int) bool {
+		return rows[i].UnitsIn+rows[i].UnitsOut > rows[j].UnitsIn+rows[j].UnitsOut
+	})
+
+	c.JSON(http.StatusOK, gin.H{
+		"from":     from,
+		"to":       to,
+		"total":    total,
+		"reasons":  reasons,
+		"count":    len(rows),
+		"products": rows,
+	})
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// retentionPolicy purges one kind of history once it is older than maxAge
+type retentionPolicy struct {
+	name   string
+	maxAge time.Duration
+	purge  func(cutoff time.Time, dryRun bool) int
+}
+
+// RetentionReport is the outcome of applying one policy
+type RetentionReport struct {
+	Policy string    `json:"policy"`
+	MaxAge string    `json:"max_age"`
+	Cutoff time.Time `json:"cutoff"`
+	Purged int       `json:"purged"`
+	DryRun bool      `json:"dry_run"`
+}
+
+// retentionPolicies lists everything the purger enforces. Subsystems that
+// keep history register their policy here.
+var retentionPolicies = []*retentionPolicy{
+	{
+		name:   "deleted_products",
+		maxAge: purgeAfter,
+		purge:  store.purgeDeleted,
+	},
+	{
+		name:   "analytics_events",
+		maxAge: time.Duration(envInt("ANALYTICS_RETENTION_DAYS", 30)) * 24 * time.Hour,
+		purge:  analytics.purgeBefore,
+	},
+	{
+		// The audit trail kept in memory for GET /audit. Sealed segments
+		// in AUDIT_EXPORT_BUCKET are kept much longer, AUDIT_RETENTION_DAYS,
+		// by S3 Object Lock rather than this purger, and with the export
+		// on, entries aren't purged here until they're sealed.
+		name:   "audit_log",
+		maxAge: time.Duration(envInt("AUDIT_LOG_RETENTION_DAYS", 90)) * 24 * time.Hour,
+		purge:  audit.purgeBefore,
+	},
+	{
+		name:   "replace_jobs",
+		maxAge: replaceJobRetention,
+		purge:  replaceJobs.purgeBefore,
+	},
+	{
+		name:   "async_jobs",
+		maxAge: asyncResultTTL,
+		purge:  asyncJobs.purgeBefore,
+	},
+	{
+		name:   "webhook_deliveries",
+		maxAge: webhookDeliveryRetention,
+		purge:  webhooks.purgeDeliveriesBefore,
+	},
+}
+
+// retentionDryRun makes the scheduled purger only report, RETENTION_DRY_RUN
+var retentionDryRun = os.Getenv("RETENTION_DRY_RUN") == "true"
+
+// applyRetention runs every policy and reports what was purged
+func applyRetention(now time.Time, dryRun bool) []RetentionReport {
+	reports := make([]RetentionReport, 0, len(retentionPolicies))
+	for _, policy := range retentionPolicies {
+		cutoff := now.Add(-policy.maxAge)
+		reports = append(reports, RetentionReport{
+			Policy: policy.name,
+			MaxAge: policy.maxAge.String(),
+			Cutoff: cutoff,
+			Purged: policy.purge(cutoff, dryRun),
+			DryRun: dryRun,
+		})
+	}
+	return reports
+}
+
+// runRetention applies retention policies on every tick
+func runRetention(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		// Followers get the leader's purges through the log
+		if replication != nil && !replication.leading() {
+			continue
+		}
+		for _, r := range applyRetention(time.Now(), retentionDryRun) {
+			if r.Purged > 0 {
+				log.Printf("retention %s: purged %d (dry run: %t)", r.Policy, r.Purged, r.DryRun)
+			}
+		}
+	}
+}
+
+// getRetentionReport shows what each policy would purge right now
+// Returns: 200 OK - Dry-run report
+func getRetentionReport(c *gin.Context) {
+	reports := applyRetention(time.Now(), true)
+
+	c.JSON(http.StatusOK, gin.H{
+		"count":    len(reports),
+		"policies": reports,
+	})
+}
+
+// runRetentionNow applies retention policies immediately.
+// ?dry_run=true only reports.
+// Returns: 200 OK - Purge report
+func runRetentionNow(c *gin.Context) {
+	reports := applyRetention(time.Now(), c.Query("dry_run") == "true")
+
+	c.JSON(http.StatusOK, gin.H{
+		"count":    len(reports),
+		"policies": reports,
+	})
+}
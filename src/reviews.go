@@ -0,0 +1,298 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Review is a customer's rating of a product. Each author can review a
+// product once.
+type Review struct {
+	ID        string    `json:"id"`
+	ProductID string    `json:"product_id"`
+	Author    string    `json:"author"`
+	Rating    int       `json:"rating" binding:"required,min=1,max=5"`
+	Title     string    `json:"title" binding:"max=200"`
+	Body      string    `json:"body" binding:"max=5000"`
+	CreatedAt time.Time `json:"created_at"`
+
+	key string // the product's key
+}
+
+// ReviewStore manages our in-memory reviews, per product key in the order
+// they were written
+type ReviewStore struct {
+	mu      sync.RWMutex
+	seq     int64
+	reviews map[string][]Review
+}
+
+// Global review store
+var reviews = &ReviewStore{
+	reviews: make(map[string][]Review),
+}
+
+// Review page sizes
+const (
+	defaultReviewLimit = 20
+	maxReviewLimit     = 100
+)
+
+// findByAuthor returns the position of an author's review, or -1.
+// Callers must hold r.mu.
+func (r *ReviewStore) findByAuthor(key, author string) int {
+	for i, review := range r.reviews[key] {
+		if review.Author == author {
+			return i
+		}
+	}
+	return -1
+}
+
+// find returns the position of a review, or -1. Callers must hold r.mu.
+func (r *ReviewStore) find(key, reviewID string) int {
+	for i, review := range r.reviews[key] {
+		if review.ID == reviewID {
+			return i
+		}
+	}
+	return -1
+}
+
+// remove takes back a review whose write failed
+func (r *ReviewStore) remove(key, reviewID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if i := r.find(key, reviewID); i >= 0 {
+		r.reviews[key] = slices.Delete(r.reviews[key], i, i+1)
+	}
+}
+
+// restore puts back a deleted review whose write failed, where it was
+func (r *ReviewStore) restore(key string, i int, review Review) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	list := r.reviews[key]
+	r.reviews[key] = slices.Insert(list, min(i, len(list)), review)
+}
+
+// removeProduct drops every review of a product, used when the product is
+// purged so a new product with the same ID starts without reviews
+func (r *ReviewStore) removeProduct(key string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.reviews, key)
+}
+
+// summarize sets the aggregated rating on a product from its reviews.
+// Callers must hold r.mu.
+func (r *ReviewStore) summarize(p *Product) {
+	list := r.reviews[p.key()]
+	p.ReviewCount = len(list)
+	p.Rating = 0
+	if len(list) == 0 {
+		return
+	}
+	total := 0
+	for _, review := range list {
+		total += review.Rating
+	}
+	p.Rating = math.Round(float64(total)/float64(len(list))*100) / 100
+}
+
+// reviewNotFound writes the standard 404 response for a missing review
+func reviewNotFound(c *gin.Context, id, reviewID string) {
+	c.JSON(http.StatusNotFound, gin.H{
+		"error":     "Review not found",
+		"id":        id,
+		"review_id": reviewID,
+	})
+}
+
+// getReviews returns a page of a product's reviews, newest first, e.g.
+// ?limit=20&offset=40
+// Returns: 200 OK - Success (Cat reading its fan mail!)
+// Returns: 400 Bad Request - Invalid limit or offset
+// Returns: 404 Not Found - Product doesn't exist
+func getReviews(c *gin.Context) {
+	id := c.Param("id")
+
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(defaultReviewLimit)))
+	if err != nil || limit < 1 || limit > maxReviewLimit {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": fmt.Sprintf("limit must be between 1 and %d", maxReviewLimit),
+			"limit": c.Query("limit"),
+		})
+		return
+	}
+	offset, err := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	if err != nil || offset < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":  "offset must be a non-negative integer",
+			"offset": c.Query("offset"),
+		})
+		return
+	}
+
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	key := tenantKey(c, id)
+	product, exists := store.getShown(c, id)
+	if !exists {
+		productNotFound(c, id)
+		return
+	}
+
+	reviews.mu.RLock()
+	list := reviews.reviews[key]
+	page := make([]Review, 0, limit)
+	for i := len(list) - 1 - offset; i >= 0 && len(page) < limit; i-- {
+		page = append(page, list[i])
+	}
+	reviews.mu.RUnlock()
+
+	c.JSON(http.StatusOK, gin.H{
+		"id":           id,
+		"rating":       product.Rating,
+		"review_count": product.ReviewCount,
+		"limit":        limit,
+		"offset":       offset,
+		"count":        len(page),
+		"reviews":      page,
+	})
+}
+
+// createReview adds the caller's review of a product. The author comes
+// from the request identity, anonymous callers can't review.
+// Returns: 201 Created - Success (Cat giving five paws!)
+// Returns: 400 Bad Request - Invalid input
+// Returns: 401 Unauthorized - No X-Actor identity
+// Returns: 404 Not Found - Product doesn't exist
+// Returns: 409 Conflict - Author already reviewed this product
+func createReview(c *gin.Context) {
+	id := c.Param("id")
+
+	author := actor(c)
+	if author == "anonymous" {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error": "Reviews require an X-Actor identity",
+		})
+		return
+	}
+
+	var review Review
+	if err := c.ShouldBindJSON(&review); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":   "Invalid review data",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	key := tenantKey(c, id)
+	product, exists := store.getShown(c, id)
+	if !exists {
+		productNotFound(c, id)
+		return
+	}
+
+	reviews.mu.Lock()
+	if i := reviews.findByAuthor(key, author); i >= 0 {
+		existing := reviews.reviews[key][i]
+		reviews.mu.Unlock()
+		c.JSON(http.StatusConflict, gin.H{
+			"error":     "You have already reviewed this product",
+			"id":        id,
+			"review_id": existing.ID,
+		})
+		return
+	}
+	reviews.seq++
+	review.ID = strconv.FormatInt(reviews.seq, 10)
+	review.ProductID, review.key = id, key
+	review.Author = author
+	review.CreatedAt = time.Now().UTC()
+	reviews.reviews[key] = append(reviews.reviews[key], review)
+
+	before := product
+	reviews.summarize(&product)
+	reviews.mu.Unlock()
+
+	if err := store.save(&product); err != nil {
+		reviews.remove(key, review.ID)
+		writeFailed(c, err)
+		return
+	}
+	audit.record(c, "review.create", &before, &product)
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message":      "Review created successfully",
+		"review":       review,
+		"rating":       product.Rating,
+		"review_count": product.ReviewCount,
+	})
+}
+
+// deleteReview removes a review. Only its author or an admin may do so.
+// Returns: 204 No Content - Success
+// Returns: 403 Forbidden - Not the author
+// Returns: 404 Not Found - Product or review doesn't exist
+func deleteReview(c *gin.Context) {
+	id, reviewID := c.Param("id"), c.Param("review_id")
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	key := tenantKey(c, id)
+	product, exists := store.getShown(c, id)
+	if !exists {
+		productNotFound(c, id)
+		return
+	}
+
+	reviews.mu.Lock()
+	i := reviews.find(key, reviewID)
+	if i < 0 {
+		reviews.mu.Unlock()
+		reviewNotFound(c, id, reviewID)
+		return
+	}
+	if !isAdmin(c) && reviews.reviews[key][i].Author != actor(c) {
+		reviews.mu.Unlock()
+		c.JSON(http.StatusForbidden, gin.H{
+			"error":     "Only the author or an admin can delete this review",
+			"review_id": reviewID,
+		})
+		return
+	}
+	list := reviews.reviews[key]
+	removed := list[i]
+	reviews.reviews[key] = append(list[:i:i], list[i+1:]...)
+
+	before := product
+	reviews.summarize(&product)
+	reviews.mu.Unlock()
+
+	if err := store.save(&product); err != nil {
+		reviews.restore(key, i, removed)
+		writeFailed(c, err)
+		return
+	}
+	audit.record(c, "review.delete", &before, &product)
+
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"hash/fnv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// sessionHeader identifies a storefront session, so a soft-launched
+// product is shown to the same sessions on every request and every shard
+const sessionHeader = "X-Session-ID"
+
+// rolloutBucket places a session in 0-99 for a product. The product ID is
+// hashed in, so each soft launch reaches a different share of sessions.
+func rolloutBucket(session, id string) int {
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	h.Write([]byte{0})
+	h.Write([]byte(session))
+	return int(h.Sum32() % 100)
+}
+
+// inRollout reports whether a storefront session sees a product.
+// Products without a rollout are launched, and requests without a session
+// only see launched ones.
+func (p Product) inRollout(session string) bool {
+	if p.RolloutPercent == nil || *p.RolloutPercent >= 100 {
+		return true
+	}
+	return session != "" && rolloutBucket(session, p.ID) < *p.RolloutPercent
+}
+
+// shownAt reports whether a storefront session sees a product at a time:
+// it's inside its publishing window and, when soft launched, the session
+// is in the rollout. Streams, which have no request per product, check
+// their events with it.
+func (p Product) shownAt(session string, at time.Time) bool {
+	return p.published(at) && p.inRollout(session)
+}
+
+// shownTo reports whether a storefront request sees a product now. Admins
+// see every product. A soft-launched product makes the response depend on
+// the session, so caches are told to vary on it.
+func shownTo(c *gin.Context, p Product) bool {
+	return shownToAt(c, p, time.Now())
+}
+
+// shownToAt is shownTo for the catalog as it was at a time, as snapshots
+// serve it
+func shownToAt(c *gin.Context, p Product, at time.Time) bool {
+	if p.RolloutPercent != nil {
+		addVary(c, sessionHeader)
+	}
+	return isAdmin(c) || p.shownAt(c.GetHeader(sessionHeader), at)
+}
+
+// shownProducts drops the products a request doesn't see
+func shownProducts(c *gin.Context, products []Product) []Product {
+	return shownProductsAt(c, products, time.Now())
+}
+
+// shownProductsAt is shownProducts for the catalog as it was at a time
+func shownProductsAt(c *gin.Context, products []Product, at time.Time) []Product {
+	visible := make([]Product, 0, len(products))
+	for _, p := range products {
+		if shownToAt(c, p, at) {
+			visible = append(visible, p)
+		}
+	}
+	return visible
+}
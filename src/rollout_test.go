@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestRolloutHidesProducts(t *testing.T) {
+	checkHidden(t, "unlaunched", "RLT-1", `"rollout_percent": 0`, sessionHeader, "session-1")
+}
+
+func TestRolloutWithoutSession(t *testing.T) {
+	checkHidden(t, "unlaunched", "RLT-2", `"rollout_percent": 50`)
+}
+
+func TestRolloutSessionOverGRPC(t *testing.T) {
+	router := newTestRouter(t)
+	mustCreate(t, router, hiddenProduct("half", "RLT-3", `"rollout_percent": 50`))
+
+	// A session inside the rollout and one outside it
+	var in, out string
+	for i := 0; in == "" || out == ""; i++ {
+		session := fmt.Sprintf("session-%d", i)
+		if rolloutBucket(session, "half") < 50 {
+			in = session
+		} else {
+			out = session
+		}
+	}
+
+	tests := []struct {
+		session string
+		shown   bool
+	}{
+		{in, true},
+		{out, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.session, func(t *testing.T) {
+			call := &grpcCall{ctx: context.Background(), header: http.Header{}, send: func([]byte) error { return nil }}
+			call.header.Set(sessionHeader, tt.session)
+			err := newGRPCServer(router).get(call, protoString(nil, 1, "half"))
+			if shown := err == nil; shown != tt.shown {
+				t.Errorf("shown = %v, want %v (%v)", shown, tt.shown, err)
+			}
+		})
+	}
+}
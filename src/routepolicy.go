@@ -0,0 +1,418 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// routePoliciesFile declares per-route middleware, ROUTE_POLICIES_FILE,
+// JSON or YAML. It's read at startup and again on SIGHUP or
+// POST /admin/route-policies/reload, without a restart.
+var routePoliciesFile = os.Getenv("ROUTE_POLICIES_FILE")
+
+// noCompressionKey is the gin context key that keeps compressResponses
+// off a response
+const noCompressionKey = "no_compression"
+
+// rateLimitMaxClients is how many clients a limiter tracks. Past it, it
+// drops those whose buckets have refilled and, if that's not enough,
+// arbitrary ones, which at worst start over with a full bucket.
+const rateLimitMaxClients = 10000
+
+// trustedProxies are the load balancers in front, TRUSTED_PROXIES: a
+// comma-separated list of addresses or CIDRs such as 10.0.0.0/8. A
+// client's IP is only taken from X-Forwarded-For when the request comes
+// through one of them, so clients can't pick their own rate limit. None
+// by default.
+var trustedProxies = parseTrustedProxies(os.Getenv("TRUSTED_PROXIES"))
+
+func parseTrustedProxies(raw string) []string {
+	var proxies []string
+	for _, proxy := range strings.Split(raw, ",") {
+		if proxy = strings.TrimSpace(proxy); proxy != "" {
+			proxies = append(proxies, proxy)
+		}
+	}
+	return proxies
+}
+
+// RoutePolicy tightens the middleware of the routes it matches. The first
+// policy matching a request's route and method applies; the rest are
+// skipped.
+type RoutePolicy struct {
+	Name string `json:"name"`
+	// Routes are route patterns without the version, such as /products,
+	// /products/:id or /admin/*
+	Routes       []string         `json:"routes"`
+	Methods      []string         `json:"methods,omitempty"` // all when empty
+	Auth         string           `json:"auth,omitempty"`    // admin, or empty for the route's own
+	RateLimit    *RateLimitConfig `json:"rate_limit,omitempty"`
+	CacheControl string           `json:"cache_control,omitempty"` // replaces the route's own on 2xx and 3xx
+	Compression  *bool            `json:"compression,omitempty"`   // false turns it off
+
+	limiter  *rateLimiter
+	rejected atomic.Int64
+}
+
+// RateLimitConfig allows Requests per Per from each client, in bursts of
+// up to Burst (Requests by default). Key picks what a client is: ip, or
+// actor for the holder of the admin or a tenant token, and the IP of
+// requests without one.
+type RateLimitConfig struct {
+	Requests int    `json:"requests"`
+	Per      string `json:"per"`
+	Burst    int    `json:"burst,omitempty"`
+	Key      string `json:"key,omitempty"`
+}
+
+// routePolicySet is the policies in force and where they came from
+type routePolicySet struct {
+	policies []*RoutePolicy
+	source   string
+	loadedAt time.Time
+}
+
+// Global route policies, swapped whole on reload so requests in flight
+// keep the set they started with
+var routePolicies atomic.Pointer[routePolicySet]
+
+func init() {
+	set := &routePolicySet{loadedAt: time.Now().UTC()}
+	if routePoliciesFile != "" {
+		loaded, err := loadRoutePolicies(routePoliciesFile)
+		if err != nil {
+			panic(fmt.Sprintf("ROUTE_POLICIES_FILE: %v", err))
+		}
+		set = loaded
+	}
+	routePolicies.Store(set)
+}
+
+// loadRoutePolicies reads and checks a policy file
+func loadRoutePolicies(path string) (*routePolicySet, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if ext := strings.ToLower(filepath.Ext(path)); ext == ".yaml" || ext == ".yml" {
+		if data, err = yamlToJSON(data); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	var file struct {
+		Policies []*RoutePolicy `json:"policies"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	names := make(map[string]bool, len(file.Policies))
+	for i, p := range file.Policies {
+		if p.Name == "" {
+			p.Name = "policy-" + strconv.Itoa(i+1)
+		}
+		if names[p.Name] {
+			return nil, fmt.Errorf("%s: policy %s is declared twice", path, p.Name)
+		}
+		names[p.Name] = true
+		if err := p.prepare(); err != nil {
+			return nil, fmt.Errorf("%s: policy %s: %v", path, p.Name, err)
+		}
+	}
+	return &routePolicySet{policies: file.Policies, source: path, loadedAt: time.Now().UTC()}, nil
+}
+
+// prepare checks a policy and builds its rate limiter
+func (p *RoutePolicy) prepare() error {
+	if len(p.Routes) == 0 {
+		return fmt.Errorf("routes is required")
+	}
+	for _, route := range p.Routes {
+		if !strings.HasPrefix(route, "/") {
+			return fmt.Errorf("route %q must start with /", route)
+		}
+	}
+	for i, method := range p.Methods {
+		p.Methods[i] = strings.ToUpper(method)
+	}
+	if p.Auth != "" && p.Auth != "admin" {
+		return fmt.Errorf("auth must be admin, not %q", p.Auth)
+	}
+	if rl := p.RateLimit; rl != nil {
+		per, err := time.ParseDuration(rl.Per)
+		if err != nil || per <= 0 || rl.Requests <= 0 {
+			return fmt.Errorf("rate_limit needs requests above 0 and a duration such as 1s in per")
+		}
+		if rl.Burst <= 0 {
+			rl.Burst = rl.Requests
+		}
+		if rl.Key == "" {
+			rl.Key = "ip"
+		}
+		if rl.Key != "ip" && rl.Key != "actor" {
+			return fmt.Errorf("rate_limit key must be ip or actor, not %q", rl.Key)
+		}
+		p.limiter = &rateLimiter{
+			rate:    float64(rl.Requests) / per.Seconds(),
+			burst:   float64(rl.Burst),
+			buckets: make(map[string]*tokenBucket),
+		}
+	}
+	return nil
+}
+
+// matches reports whether a policy applies to a route and method
+func (p *RoutePolicy) matches(route, method string) bool {
+	return routeMatches(p.Routes, p.Methods, route, method)
+}
+
+// routeMatches reports whether a route and method are among patterns such
+// as /products/:id or /admin/*, and methods, all when empty
+func routeMatches(patterns, methods []string, route, method string) bool {
+	if len(methods) > 0 && !slices.Contains(methods, method) {
+		return false
+	}
+	for _, pattern := range patterns {
+		if prefix, ok := strings.CutSuffix(pattern, "*"); ok && strings.HasPrefix(route, prefix) || pattern == route {
+			return true
+		}
+	}
+	return false
+}
+
+// applyRoutePolicies runs the policy of the request's route, if any
+// Returns: 401 Unauthorized - The policy needs the admin token
+// Returns: 429 Too Many Requests - Over the policy's rate limit, with Retry-After (Cat says slow down!)
+func applyRoutePolicies() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Unversioned paths get their route when unversionedRoute routes
+		// them again, and the policy then
+		route := versionedPath.ReplaceAllString(c.FullPath(), "/")
+		if route == "" {
+			c.Next()
+			return
+		}
+		var policy *RoutePolicy
+		for _, p := range routePolicies.Load().policies {
+			if p.matches(route, c.Request.Method) {
+				policy = p
+				break
+			}
+		}
+		if policy == nil {
+			c.Next()
+			return
+		}
+
+		if policy.Auth == "admin" && !isAdmin(c) {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+				"error": "Admin access required",
+			})
+			return
+		}
+		if policy.limiter != nil {
+			if wait, ok := policy.limiter.allow(rateLimitKey(c, policy.RateLimit.Key), time.Now()); !ok {
+				policy.rejected.Add(1)
+				c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{
+					"error":  "Rate limit exceeded",
+					"policy": policy.Name,
+				})
+				return
+			}
+		}
+		if policy.Compression != nil && !*policy.Compression {
+			c.Set(noCompressionKey, true)
+		}
+		if policy.CacheControl != "" {
+			c.Writer = &cacheControlWriter{ResponseWriter: c.Writer, value: policy.CacheControl}
+		}
+		c.Next()
+	}
+}
+
+// rateLimitKey is the client a request counts against. Actors are only
+// told apart by their token: X-Actor is whatever the client says, so it
+// would hand out a fresh bucket per request.
+func rateLimitKey(c *gin.Context, key string) string {
+	if key == "actor" && isAdmin(c) {
+		return actor(c)
+	}
+	return "ip " + c.ClientIP()
+}
+
+// rateLimiter is a token bucket per client
+type rateLimiter struct {
+	rate  float64 // tokens per second
+	burst float64
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// allow takes a token from a client's bucket, or says how long until
+// there is one
+func (l *rateLimiter) allow(key string, now time.Time) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, exists := l.buckets[key]
+	if !exists {
+		if len(l.buckets) >= rateLimitMaxClients {
+			l.sweep(now)
+		}
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return time.Duration((1 - b.tokens) / l.rate * float64(time.Second)), false
+	}
+	b.tokens--
+	return 0, true
+}
+
+// sweep drops the buckets that have refilled, which are the same as new
+// ones, then arbitrary ones until a tenth of rateLimitMaxClients is free,
+// so a flood of clients doesn't sweep on every request. Callers must hold
+// l.mu.
+func (l *rateLimiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+	for key := range l.buckets {
+		if len(l.buckets) < rateLimitMaxClients*9/10 {
+			break
+		}
+		delete(l.buckets, key)
+	}
+}
+
+// cacheControlWriter replaces the Cache-Control a handler set, on
+// responses that aren't errors
+type cacheControlWriter struct {
+	gin.ResponseWriter
+	value string
+	done  bool
+}
+
+func (w *cacheControlWriter) override() {
+	if w.done {
+		return
+	}
+	w.done = true
+	if w.Status() < http.StatusBadRequest {
+		w.Header().Set("Cache-Control", w.value)
+	}
+}
+
+func (w *cacheControlWriter) WriteHeaderNow() {
+	w.override()
+	w.ResponseWriter.WriteHeaderNow()
+}
+
+func (w *cacheControlWriter) Write(b []byte) (int, error) {
+	w.override()
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *cacheControlWriter) WriteString(s string) (int, error) {
+	w.override()
+	return w.ResponseWriter.WriteString(s)
+}
+
+func (w *cacheControlWriter) Flush() {
+	w.override()
+	w.ResponseWriter.Flush()
+}
+
+// reloadRoutePolicies reads ROUTE_POLICIES_FILE again. A file that
+// doesn't load leaves the policies in force as they are.
+func reloadRoutePolicies() (*routePolicySet, error) {
+	if routePoliciesFile == "" {
+		return nil, fmt.Errorf("ROUTE_POLICIES_FILE is not set")
+	}
+	set, err := loadRoutePolicies(routePoliciesFile)
+	if err != nil {
+		return nil, err
+	}
+	routePolicies.Store(set)
+	log.Printf("route policies: loaded %d from %s", len(set.policies), set.source)
+	return set, nil
+}
+
+// watchRoutePolicies reloads the route policies on SIGHUP
+func watchRoutePolicies() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		if _, err := reloadRoutePolicies(); err != nil {
+			log.Printf("route policies: keeping the current ones: %v", err)
+		}
+	}
+}
+
+// routePolicyView is a policy as the admin API shows it
+type routePolicyView struct {
+	*RoutePolicy
+	Rejected int64 `json:"rejected"` // by the rate limit, since it was loaded
+}
+
+func viewRoutePolicies(set *routePolicySet) gin.H {
+	views := make([]routePolicyView, len(set.policies))
+	for i, p := range set.policies {
+		views[i] = routePolicyView{RoutePolicy: p, Rejected: p.rejected.Load()}
+	}
+	return gin.H{
+		"source":    set.source,
+		"loaded_at": set.loadedAt,
+		"count":     len(views),
+		"policies":  views,
+	}
+}
+
+// getRoutePolicies lists the route policies in force
+// Returns: 200 OK - Success
+// Returns: 401 Unauthorized - Admin access required
+func getRoutePolicies(c *gin.Context) {
+	c.JSON(http.StatusOK, viewRoutePolicies(routePolicies.Load()))
+}
+
+// reloadRoutePoliciesNow reads ROUTE_POLICIES_FILE again, on this
+// instance. Rate limits start over for every policy.
+// Returns: 200 OK - Reloaded, the new policies (Cat rearranging the furniture!)
+// Returns: 400 Bad Request - The file doesn't load, the current policies stay
+// Returns: 401 Unauthorized - Admin access required
+func reloadRoutePoliciesNow(c *gin.Context) {
+	set, err := reloadRoutePolicies()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":   "Failed to load route policies",
+			"details": err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, viewRoutePolicies(set))
+}
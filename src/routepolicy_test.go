@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestRateLimitKey(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	defer func(token string) { adminToken = token }(adminToken)
+	adminToken = testAdminToken
+	saved := routePolicies.Load()
+	defer routePolicies.Store(saved)
+
+	tests := []struct {
+		name    string
+		key     string
+		proxies []string
+		header  func(i int) []string // of the ith request
+		limited bool
+	}{
+		{"spoofed X-Forwarded-For", "ip", nil, func(i int) []string {
+			return []string{"X-Forwarded-For", fmt.Sprintf("10.0.0.%d", i)}
+		}, true},
+		{"X-Forwarded-For from a trusted proxy", "ip", []string{"192.0.2.1"}, func(i int) []string {
+			return []string{"X-Forwarded-For", fmt.Sprintf("10.0.0.%d", i)}
+		}, false},
+		{"spoofed X-Actor", "actor", nil, func(i int) []string {
+			return []string{"X-Actor", fmt.Sprintf("user-%d", i)}
+		}, true},
+		{"admin token", "actor", nil, func(i int) []string {
+			return append([]string{"X-Forwarded-For", fmt.Sprintf("10.0.0.%d", i)}, asAdmin...)
+		}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy := &RoutePolicy{Routes: []string{"/things"}, RateLimit: &RateLimitConfig{Requests: 2, Per: "1h", Key: tt.key}}
+			if err := policy.prepare(); err != nil {
+				t.Fatal(err)
+			}
+			routePolicies.Store(&routePolicySet{policies: []*RoutePolicy{policy}})
+			router := gin.New()
+			if err := router.SetTrustedProxies(tt.proxies); err != nil {
+				t.Fatal(err)
+			}
+			router.Use(applyRoutePolicies())
+			router.GET("/things", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+			limited := false
+			for i := range 5 {
+				// httptest requests come from 192.0.2.1
+				if serve(router, "GET", "/things", "", tt.header(i)...).Code == http.StatusTooManyRequests {
+					limited = true
+				}
+			}
+			if limited != tt.limited {
+				t.Errorf("limited = %v, want %v", limited, tt.limited)
+			}
+		})
+	}
+}
+
+func TestRateLimiterCapsClients(t *testing.T) {
+	l := &rateLimiter{rate: 1, burst: 1, buckets: make(map[string]*tokenBucket)}
+	now := time.Now()
+	for i := range 3 * rateLimitMaxClients {
+		// Each client spends its token, so no bucket has refilled
+		l.allow(fmt.Sprintf("client-%d", i), now)
+		if len(l.buckets) > rateLimitMaxClients {
+			t.Fatalf("%d buckets after %d clients", len(l.buckets), i+1)
+		}
+	}
+}
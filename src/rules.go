@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Rule scopes
+const (
+	ruleScopeProduct = "product" // fields of the product together
+	ruleScopeCatalog = "catalog" // the product against others in the store
+)
+
+// maxBundleComponents caps the products a bundle is made of
+const maxBundleComponents = 20
+
+// BundleComponent is a product sold as part of a bundle, and how many of
+// it
+type BundleComponent struct {
+	ID       string `json:"id" xml:"id,attr"`
+	Quantity int    `json:"quantity" xml:"quantity,attr"`
+}
+
+// ProductRule is a validation rule across fields of a product, or
+// across products. Field-level checks stay in productViolations; rules
+// are for what can only be judged together, such as a sale price against
+// the price or a bundle against its components. Every violation a rule
+// finds carries its name.
+type ProductRule struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Scope       string `json:"scope"`
+
+	check ruleCheck
+}
+
+// Global product rules, in the order they run
+var productRules []ProductRule
+
+// registerRule adds a rule to every product write. Names must be unique,
+// as clients match violations on them.
+func registerRule(rule ProductRule) {
+	for _, r := range productRules {
+		if r.Name == rule.Name {
+			panic(fmt.Sprintf("product rule %s registered twice", rule.Name))
+		}
+	}
+	if rule.Scope != ruleScopeProduct && rule.Scope != ruleScopeCatalog {
+		panic(fmt.Sprintf("product rule %s has an unknown scope %q", rule.Name, rule.Scope))
+	}
+	productRules = append(productRules, rule)
+}
+
+// ruleCheck is the check of a rule. Catalog rules look other products up
+// with lookup; product rules get nil.
+type ruleCheck func(p *Product, lookup func(id string) (Product, bool)) []Violation
+
+// when restricts a check to the products cond holds for, so rules can be
+// built from smaller checks
+func when(cond func(p *Product) bool, check ruleCheck) ruleCheck {
+	return func(p *Product, lookup func(id string) (Product, bool)) []Violation {
+		if !cond(p) {
+			return nil
+		}
+		return check(p, lookup)
+	}
+}
+
+// runRules runs the rules of a scope against p
+func runRules(scope string, p *Product, lookup func(id string) (Product, bool)) []Violation {
+	var violations []Violation
+	for _, rule := range productRules {
+		if rule.Scope != scope {
+			continue
+		}
+		for _, v := range rule.check(p, lookup) {
+			v.Rule = rule.Name
+			violations = append(violations, v)
+		}
+	}
+	return violations
+}
+
+// catalogViolations runs the catalog rules against p, for writes that
+// already passed productViolations. Callers must hold store.mu.
+func catalogViolations(p *Product) []Violation {
+	return runRules(ruleScopeCatalog, p, func(id string) (Product, bool) {
+		other, exists := store.products[productKey(p.Tenant, id)]
+		return other, exists
+	})
+}
+
+func init() {
+	registerRule(ProductRule{
+		Name:        "sale_price_below_price",
+		Description: "A sale price is positive and below the price",
+		Scope:       ruleScopeProduct,
+		check: when(hasSalePrice, func(p *Product, _ func(string) (Product, bool)) []Violation {
+			if *p.SalePrice <= 0 {
+				return []Violation{{Code: violationOutOfRange, Field: "sale_price", Message: "Must be greater than 0"}}
+			}
+			if p.Price > 0 && *p.SalePrice >= p.Price {
+				return []Violation{{Code: violationOutOfRange, Field: "sale_price", Message: "Must be less than price"}}
+			}
+			return nil
+		}),
+	})
+	registerRule(ProductRule{
+		Name:        "variant_skus_unique",
+		Description: "Variants of a product have different SKUs",
+		Scope:       ruleScopeProduct,
+		check: func(p *Product, _ func(string) (Product, bool)) []Violation {
+			var violations []Violation
+			seen := make(map[string]bool, len(p.Variants))
+			for i, v := range p.Variants {
+				if v.SKU == "" {
+					continue
+				}
+				if seen[v.SKU] {
+					violations = append(violations, Violation{Code: violationDuplicate, Field: fmt.Sprintf("variants[%d].sku", i), Message: fmt.Sprintf("Duplicate SKU %q", v.SKU)})
+				}
+				seen[v.SKU] = true
+			}
+			return violations
+		},
+	})
+	registerRule(ProductRule{
+		Name:        "bundle_components_well_formed",
+		Description: "Bundle components are distinct products other than the bundle, each at least once",
+		Scope:       ruleScopeProduct,
+		check: when(isBundle, func(p *Product, _ func(string) (Product, bool)) []Violation {
+			var violations []Violation
+			if len(p.Components) > maxBundleComponents {
+				violations = append(violations, Violation{Code: violationOutOfRange, Field: "components", Message: fmt.Sprintf("Must have at most %d components", maxBundleComponents)})
+			}
+			seen := make(map[string]bool, len(p.Components))
+			for i := range p.Components {
+				component := &p.Components[i]
+				prefix := fmt.Sprintf("components[%d]", i)
+				normalizeText(&component.ID, prefix+".id", maxIDLength, &violations)
+				switch {
+				case component.ID == "":
+					violations = append(violations, Violation{Code: violationRequired, Field: prefix + ".id", Message: "Is required"})
+				case component.ID == p.ID:
+					violations = append(violations, Violation{Code: violationInvalid, Field: prefix + ".id", Message: "Must not be the bundle itself"})
+				case seen[component.ID]:
+					violations = append(violations, Violation{Code: violationDuplicate, Field: prefix + ".id", Message: fmt.Sprintf("Duplicate component %q", component.ID)})
+				}
+				seen[component.ID] = true
+				if component.Quantity == 0 {
+					component.Quantity = 1
+				}
+				if component.Quantity < 0 {
+					violations = append(violations, Violation{Code: violationOutOfRange, Field: prefix + ".quantity", Message: "Must be greater than 0"})
+				}
+			}
+			return violations
+		}),
+	})
+	registerRule(ProductRule{
+		Name:        "bundle_components_active",
+		Description: "Bundle components exist, are live and aren't bundles themselves",
+		Scope:       ruleScopeCatalog,
+		check: when(isBundle, func(p *Product, lookup func(string) (Product, bool)) []Violation {
+			var violations []Violation
+			for i, component := range p.Components {
+				field := fmt.Sprintf("components[%d].id", i)
+				other, exists := lookup(component.ID)
+				switch {
+				case !exists:
+					violations = append(violations, Violation{Code: violationInvalid, Field: field, Message: fmt.Sprintf("Product %q doesn't exist", component.ID)})
+				case !other.live():
+					violations = append(violations, Violation{Code: violationInvalid, Field: field, Message: fmt.Sprintf("Product %q is deleted or suspended", component.ID)})
+				case isBundle(&other):
+					violations = append(violations, Violation{Code: violationInvalid, Field: field, Message: fmt.Sprintf("Product %q is a bundle, bundles can't be nested", component.ID)})
+				}
+			}
+			return violations
+		}),
+	})
+}
+
+// hasSalePrice reports whether a product is on sale
+func hasSalePrice(p *Product) bool {
+	return p.SalePrice != nil
+}
+
+// isBundle reports whether a product is made of others
+func isBundle(p *Product) bool {
+	return len(p.Components) > 0
+}
+
+// getProductRules lists the rules every product write is checked
+// against, beyond the per-field ones
+// Returns: 200 OK - Success
+func getProductRules(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"count": len(productRules),
+		"rules": productRules,
+	})
+}
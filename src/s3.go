@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// S3Client is a minimal S3 client for putting and getting objects
+type S3Client struct {
+	bucket   string
+	region   string
+	endpoint string // optional, e.g. a local MinIO; uses path-style URLs
+	http     *http.Client
+}
+
+// newS3Client returns a client for the bucket. S3_ENDPOINT overrides the
+// AWS endpoint for local testing.
+func newS3Client(bucket string) *S3Client {
+	return &S3Client{
+		bucket:   bucket,
+		region:   awsRegion,
+		endpoint: os.Getenv("S3_ENDPOINT"),
+		http:     newAWSClient("s3", 30*time.Second),
+	}
+}
+
+// s3Error is a non-2xx response from S3
+type s3Error struct {
+	method string
+	key    string
+	status int
+	msg    string
+}
+
+func (e *s3Error) Error() string {
+	return fmt.Sprintf("s3 %s %s: %d %s: %s", e.method, e.key, e.status, http.StatusText(e.status), e.msg)
+}
+
+// s3Status returns the HTTP status of an S3 error, or 0 for other errors
+func s3Status(err error) int {
+	var e *s3Error
+	if errors.As(err, &e) {
+		return e.status
+	}
+	return 0
+}
+
+// objectURL returns the URL of an object key
+func (s *S3Client) objectURL(key string) string {
+	escaped := (&url.URL{Path: key}).EscapedPath()
+	if s.endpoint != "" {
+		return strings.TrimSuffix(s.endpoint, "/") + "/" + s.bucket + "/" + escaped
+	}
+	return fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s", s.bucket, s.region, escaped)
+}
+
+// do signs and sends a request for an object, returning an error for
+// non-2xx responses
+func (s *S3Client) do(ctx context.Context, method, key string, body []byte, header http.Header) (*http.Response, error) {
+	return s.send(ctx, method, s.objectURL(key), key, body, header)
+}
+
+// send signs and sends a request to a URL of the bucket. key names it in
+// errors.
+func (s *S3Client) send(ctx context.Context, method, rawURL, key string, body []byte, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, rawURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+
+	start := time.Now()
+	creds, err := awsCreds.get(ctx)
+	if err != nil {
+		s3Dependency.observe(start, err)
+		return nil, err
+	}
+	signV4(req, body, "s3", s.region, creds, time.Now())
+
+	resp, err := s.http.Do(req)
+	if err != nil {
+		s3Dependency.observe(start, err)
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		err := &s3Error{method: method, key: key, status: resp.StatusCode, msg: string(msg)}
+		// 4xx like a missing key means S3 itself is healthy
+		if resp.StatusCode >= 500 {
+			s3Dependency.observe(start, err)
+		} else {
+			s3Dependency.observe(start, nil)
+		}
+		return nil, err
+	}
+	s3Dependency.observe(start, nil)
+	return resp, nil
+}
+
+// putObject uploads an object with the given extra headers
+func (s *S3Client) putObject(ctx context.Context, key string, body []byte, header http.Header) error {
+	resp, err := s.do(ctx, http.MethodPut, key, body, header)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// getObject downloads an object along with its response headers
+func (s *S3Client) getObject(ctx context.Context, key string, header http.Header) ([]byte, http.Header, error) {
+	resp, err := s.do(ctx, http.MethodGet, key, nil, header)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	return body, resp.Header, err
+}
+
+// deleteObject removes an object, header may carry conditions like If-Match
+func (s *S3Client) deleteObject(ctx context.Context, key string, header http.Header) error {
+	resp, err := s.do(ctx, http.MethodDelete, key, nil, header)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// s3Object is an entry of a bucket listing
+type s3Object struct {
+	Key          string    `xml:"Key"`
+	LastModified time.Time `xml:"LastModified"`
+	Size         int64     `xml:"Size"`
+}
+
+// listObjects lists the objects under a prefix, following continuation
+// tokens until the listing is complete
+func (s *S3Client) listObjects(ctx context.Context, prefix string) ([]s3Object, error) {
+	var objects []s3Object
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, err := s.send(ctx, http.MethodGet, s.objectURL("")+"?"+query.Encode(), prefix, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			Contents              []s3Object `xml:"Contents"`
+			IsTruncated           bool       `xml:"IsTruncated"`
+			NextContinuationToken string     `xml:"NextContinuationToken"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("s3 list %s: %w", prefix, err)
+		}
+		objects = append(objects, page.Contents...)
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			return objects, nil
+		}
+		token = page.NextContinuationToken
+	}
+}
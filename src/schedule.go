@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
+
+// maxScheduledPrices caps the price changes queued on a product
+const maxScheduledPrices = 10
+
+// ScheduledPrice is a price a product takes from EffectiveAt on, in the
+// product's currency
+type ScheduledPrice struct {
+	Price       Money     `json:"price"`
+	EffectiveAt time.Time `json:"effective_at"`
+}
+
+// published reports whether a product is inside its publishing window.
+// PublishAt and UnpublishAt are checked on every read, so a product
+// appears and disappears on time whatever the scheduler's interval.
+func (p Product) published(now time.Time) bool {
+	return (p.PublishAt == nil || !now.Before(*p.PublishAt)) && (p.UnpublishAt == nil || now.Before(*p.UnpublishAt))
+}
+
+// scheduleViolations checks a product's publishing window and scheduled
+// prices, sorting the prices by when they take effect, for
+// productViolations
+func scheduleViolations(p *Product, violations *[]Violation) {
+	if p.PublishAt != nil && p.UnpublishAt != nil && !p.UnpublishAt.After(*p.PublishAt) {
+		*violations = append(*violations, Violation{Code: violationInvalid, Field: "unpublish_at", Message: "Must be after publish_at"})
+	}
+
+	if len(p.ScheduledPrices) > maxScheduledPrices {
+		*violations = append(*violations, Violation{Code: violationOutOfRange, Field: "scheduled_prices", Message: fmt.Sprintf("Must have at most %d prices", maxScheduledPrices)})
+	}
+	seen := make(map[time.Time]bool, len(p.ScheduledPrices))
+	for i, sp := range p.ScheduledPrices {
+		prefix := fmt.Sprintf("scheduled_prices[%d]", i)
+		switch {
+		case sp.Price <= 0:
+			*violations = append(*violations, Violation{Code: violationOutOfRange, Field: prefix + ".price", Message: "Must be greater than 0"})
+		case sp.Price > maxPrice:
+			*violations = append(*violations, Violation{Code: violationOutOfRange, Field: prefix + ".price", Message: fmt.Sprintf("Must be at most %s", maxPrice)})
+		}
+		switch {
+		case sp.EffectiveAt.IsZero():
+			*violations = append(*violations, Violation{Code: violationRequired, Field: prefix + ".effective_at", Message: "Is required"})
+		case seen[sp.EffectiveAt]:
+			*violations = append(*violations, Violation{Code: violationDuplicate, Field: prefix + ".effective_at", Message: "Another price takes effect at the same time"})
+		}
+		seen[sp.EffectiveAt] = true
+	}
+	sort.SliceStable(p.ScheduledPrices, func(i, j int) bool {
+		return p.ScheduledPrices[i].EffectiveAt.Before(p.ScheduledPrices[j].EffectiveAt)
+	})
+}
+
+// applySchedule makes the scheduled changes of a product that are due:
+// the latest due price becomes its price, and a publish time that has
+// passed is cleared, so the write tells watchers it went live. It reports
+// whether anything changed.
+func applySchedule(p *Product, now time.Time) bool {
+	changed := false
+	for len(p.ScheduledPrices) > 0 && !now.Before(p.ScheduledPrices[0].EffectiveAt) {
+		p.Price = p.ScheduledPrices[0].Price
+		p.ScheduledPrices = p.ScheduledPrices[1:]
+		changed = true
+	}
+	if len(p.ScheduledPrices) == 0 {
+		p.ScheduledPrices = nil
+	}
+	if p.PublishAt != nil && !now.Before(*p.PublishAt) {
+		p.PublishAt = nil
+		changed = true
+	}
+	return changed
+}
+
+// applySchedules saves every product with scheduled changes due and
+// returns how many there were
+func applySchedules(now time.Time) int {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	applied := 0
+	for _, key := range sortedProductKeys() {
+		product := store.products[key]
+		if product.DeletedAt != nil {
+			continue
+		}
+		before := product
+		product.ScheduledPrices = append([]ScheduledPrice(nil), product.ScheduledPrices...)
+		if !applySchedule(&product, now) {
+			continue
+		}
+		if err := store.save(&product); err != nil {
+			log.Printf("schedule: saving %s: %v", qualifiedID(product.Tenant, product.ID), err)
+			continue
+		}
+		audit.record(nil, "schedule", &before, &product)
+		applied++
+	}
+	return applied
+}
+
+// runSchedules applies scheduled changes on every tick
+func runSchedules(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		// Followers get the leader's changes through the log
+		if replication != nil && !replication.leading() {
+			continue
+		}
+		if applied := applySchedules(time.Now()); applied > 0 {
+			log.Printf("schedule: applied the changes due on %d products", applied)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// storefrontRead is a storefront read of a hidden product and the status
+// it gets
+type storefrontRead struct {
+	name, method, path, body string
+	status                   int
+}
+
+// storefrontReads are the storefront's ways of reading product id, which
+// has a variant sku
+func storefrontReads(id, sku string) []storefrontRead {
+	return []storefrontRead{
+		{"get", "GET", "/v1/products/" + id, "", http.StatusNotFound},
+		{"list", "GET", "/v1/products", "", http.StatusOK},
+		{"low stock", "GET", "/v1/products/low-stock", "", http.StatusOK},
+		{"suggest", "GET", "/v1/products/suggest?q=hid", "", http.StatusOK},
+		{"by SKU", "GET", "/v1/products/by-sku/" + sku, "", http.StatusNotFound},
+		{"batch get", "POST", "/v1/products/batch-get", `{"ids": ["` + id + `"]}`, http.StatusOK},
+		{"metrics", "GET", "/v1/products/" + id + "/metrics", "", http.StatusNotFound},
+		{"full", "GET", "/v1/products/" + id + "/full", "", http.StatusNotFound},
+		{"related", "GET", "/v1/products/" + id + "/related", "", http.StatusNotFound},
+		{"validate", "POST", "/v1/products/" + id + "/validate", "", http.StatusNotFound},
+		{"price", "GET", "/v1/products/" + id + "/price", "", http.StatusNotFound},
+		{"variants", "GET", "/v1/products/" + id + "/variants", "", http.StatusNotFound},
+		{"variant", "GET", "/v1/products/" + id + "/variants/" + sku, "", http.StatusNotFound},
+		{"reviews", "GET", "/v1/products/" + id + "/reviews", "", http.StatusNotFound},
+		{"review", "POST", "/v1/products/" + id + "/reviews", `{"rating": 5}`, http.StatusNotFound},
+		{"quote", "POST", "/v1/pricing/quote", `{"items": [{"product_id": "` + id + `", "sku": "` + sku + `", "quantity": 1}]}`, http.StatusBadRequest},
+		{"availability", "POST", "/v1/availability", `{"lines": [{"sku": "` + sku + `", "quantity": 1}]}`, http.StatusOK},
+		{"GraphQL", "POST", "/v1/graphql", `{"query": "{ product(id: \"` + id + `\") { name } products { nodes { name } } categories { productCount } }"}`, http.StatusOK},
+	}
+}
+
+// hiddenProduct is a product named "Hidden lamp" with a variant sku, and
+// fields set as extra JSON, e.g. `"publish_at": "2099-01-01T00:00:00Z"`
+func hiddenProduct(id, sku, extra string) string {
+	return `{"id": "` + id + `", "name": "Hidden lamp", "description": "Hidden lamp", "category": "lamps", "price": "10.00",
+		"currency": "USD", "stock": 1, "low_stock_threshold": 5,
+		"variants": [{"sku": "` + sku + `", "attributes": {"colour": "red"}, "stock": 1}], ` + extra + `}`
+}
+
+// checkHidden creates a hidden product with extra fields, runs every
+// storefront read and checks none shows it. header is added to each request.
+func checkHidden(t *testing.T, id, sku, extra string, header ...string) {
+	t.Helper()
+	router := newTestRouter(t)
+	mustCreate(t, router, hiddenProduct(id, sku, extra))
+
+	for _, tt := range storefrontReads(id, sku) {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(router, tt.method, tt.path, tt.body, append([]string{"X-Actor", "shopper"}, header...)...)
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if strings.Contains(w.Body.String(), "Hidden lamp") {
+				t.Errorf("hidden product shown: %s", w.Body)
+			}
+		})
+	}
+
+	t.Run("admin", func(t *testing.T) {
+		if w := serve(router, "GET", "/v1/products/"+id, "", asAdmin...); w.Code != http.StatusOK {
+			t.Errorf("admin get: %d %s", w.Code, w.Body)
+		}
+	})
+	t.Run("gRPC", func(t *testing.T) {
+		call := &grpcCall{ctx: context.Background(), header: http.Header{}, send: func([]byte) error { return nil }}
+		for i := 0; i+1 < len(header); i += 2 {
+			call.header.Set(header[i], header[i+1])
+		}
+		var status *grpcStatus
+		err := newGRPCServer(router).get(call, protoString(nil, 1, id))
+		if !errors.As(err, &status) || status.code != grpcCodes[http.StatusNotFound] {
+			t.Errorf("err = %v, want NOT_FOUND", err)
+		}
+	})
+}
+
+func TestUnpublishedProductsHidden(t *testing.T) {
+	checkHidden(t, "embargoed", "EMB-1", `"publish_at": "2099-01-01T00:00:00Z"`)
+}
+
+func TestUnpublishedProductsHiddenInSnapshots(t *testing.T) {
+	router := newTestRouter(t)
+	mustCreate(t, router, hiddenProduct("embargoed", "EMB-2", `"publish_at": "2099-01-01T00:00:00Z"`))
+
+	store.mu.RLock()
+	products := make([]Product, 0, len(store.products))
+	for _, p := range store.products {
+		products = append(products, p)
+	}
+	store.mu.RUnlock()
+	if _, err := snapshots.add("embargo-test", "live", products); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		snapshots.mu.Lock()
+		delete(snapshots.snapshots, "embargo-test")
+		snapshots.mu.Unlock()
+	}()
+
+	for _, path := range []string{"/v1/products", "/v1/products/embargoed"} {
+		w := serve(router, "GET", path, "", snapshotHeader, "embargo-test")
+		if strings.Contains(w.Body.String(), "Hidden lamp") {
+			t.Errorf("%s shows the hidden product: %s", path, w.Body)
+		}
+	}
+}
+
+func TestStorefrontEvent(t *testing.T) {
+	later := time.Date(2099, 1, 1, 0, 0, 0, 0, time.UTC)
+	shown := &Product{ID: "lamp", Stock: 1}
+	embargoed := &Product{ID: "lamp", Stock: 2, PublishAt: &later}
+	tests := []struct {
+		name              string
+		event             ProductEvent
+		ok                bool
+		product, previous bool
+	}{
+		{"created shown", ProductEvent{Type: eventCreated, Product: shown}, true, true, false},
+		{"created embargoed", ProductEvent{Type: eventCreated, Product: embargoed}, false, false, false},
+		{"updated embargoed", ProductEvent{Type: eventUpdated, Product: embargoed, Previous: embargoed}, false, false, false},
+		{"embargo added", ProductEvent{Type: eventUpdated, Product: embargoed, Previous: shown}, true, false, true},
+		{"embargo lifted", ProductEvent{Type: eventUpdated, Product: shown, Previous: embargoed}, true, true, false},
+		{"purged embargoed", ProductEvent{Type: eventPurged, Previous: embargoed}, false, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, ok := storefrontEvent(tt.event, "", time.Now())
+			if ok != tt.ok {
+				t.Fatalf("ok = %v, want %v", ok, tt.ok)
+			}
+			if ok && ((e.Product != nil) != tt.product || (e.Previous != nil) != tt.previous) {
+				t.Errorf("event = %+v", e)
+			}
+		})
+	}
+}
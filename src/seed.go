@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+)
+
+// Seeding fills the catalog at startup. SEED_FILE, or the -seed flag,
+// names a fixture: JSON, JSON lines or YAML, holding a list of products
+// or {"products": [...]}. Without a fixture a fresh store gets the sample
+// products. SEED=off, or -seed=off, turns seeding off entirely, for
+// production catalogs that only change through the API.
+const seedOff = "off"
+
+// Seed policies, for fixture products already in the catalog. Upsert
+// replaces those that differ from the fixture, insert leaves them alone.
+// Either way products that match aren't written again, so seeding on
+// every start doesn't bump versions.
+const (
+	seedUpsert = "upsert"
+	seedInsert = "insert"
+)
+
+// sampleProducts is the catalog of a fresh store when there's no fixture
+var sampleProducts = []Product{
+	{ID: "1", Name: "Laptop", Description: "High-performance laptop", Price: 99999, Currency: "USD", Stock: 10},
+	{ID: "2", Name: "Mouse", Description: "Wireless mouse", Price: 2999, Currency: "USD", Stock: 50},
+	{ID: "3", Name: "Keyboard", Description: "Mechanical keyboard", Price: 8999, Currency: "USD", Stock: 25},
+}
+
+// SeedSummary counts what seeding did to each fixture product
+type SeedSummary struct {
+	Created   int `json:"created"`
+	Updated   int `json:"updated"`
+	Unchanged int `json:"unchanged"`
+	Skipped   int `json:"skipped"` // kept as they are by the insert policy, or deleted
+}
+
+// seedStore seeds the catalog at startup from source, a fixture path,
+// off, or empty for SEED_FILE
+func seedStore(source string) error {
+	if source == "" {
+		source = os.Getenv("SEED_FILE")
+	}
+	if source == seedOff || os.Getenv("SEED") == seedOff {
+		return nil
+	}
+	policy := envString("SEED_POLICY", seedUpsert)
+
+	products := sampleProducts
+	if source != "" {
+		fixture, err := readFixture(source)
+		if err != nil {
+			return err
+		}
+		products = fixture
+	} else if store.recovered {
+		// The samples only fill a fresh store, not one emptied on purpose
+		return nil
+	}
+
+	summary, err := seed(products, policy)
+	if err != nil {
+		return err
+	}
+	if source == "" {
+		source = "sample products"
+	}
+	log.Printf("seed: %s: %d created, %d updated, %d unchanged, %d skipped", source, summary.Created, summary.Updated, summary.Unchanged, summary.Skipped)
+	return nil
+}
+
+// seed writes products to the store under a policy. They're checked
+// first, so a bad fixture changes nothing.
+func seed(products []Product, policy string) (SeedSummary, error) {
+	var summary SeedSummary
+	if policy != seedUpsert && policy != seedInsert {
+		return summary, fmt.Errorf("seed policy must be upsert or insert, not %q", policy)
+	}
+	ids := make(map[string]bool, len(products))
+	for i := range products {
+		if violations := productViolations(&products[i]); len(violations) > 0 {
+			return summary, fmt.Errorf("product %d: %s", i+1, violationSummary(violations))
+		}
+		if ids[products[i].ID] {
+			return summary, fmt.Errorf("product %d: duplicate id %s", i+1, products[i].ID)
+		}
+		ids[products[i].ID] = true
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	for i := range products {
+		if violations := codes.conflicts(&products[i]); len(violations) > 0 {
+			return summary, fmt.Errorf("product %d: %s", i+1, violationSummary(violations))
+		}
+	}
+	for _, product := range products {
+		current, exists := store.products[product.key()]
+		switch {
+		case exists && current.DeletedAt != nil:
+			log.Printf("seed: product %s is deleted, restore or purge it to seed it", product.ID)
+			summary.Skipped++
+			continue
+		case exists && current.Suspension != nil:
+			log.Printf("seed: product %s is suspended, unsuspend it to seed it", product.ID)
+			summary.Skipped++
+			continue
+		case exists && policy == seedInsert:
+			summary.Skipped++
+			continue
+		}
+
+		// Versions, ratings and timestamps are managed by the server
+		product.DeletedAt, product.Suspension, product.ActiveBadges = nil, nil, nil
+		if exists {
+			product.Version, product.CreatedAt, product.UpdatedAt = current.Version, current.CreatedAt, current.UpdatedAt
+			product.Rating, product.ReviewCount = current.Rating, current.ReviewCount
+			syncVariantStock(&product)
+			if reflect.DeepEqual(product, current) {
+				summary.Unchanged++
+				continue
+			}
+			if err := store.save(&product); err != nil {
+				return summary, err
+			}
+			audit.record(nil, "seed", &current, &product)
+			summary.Updated++
+		} else {
+			product.Version = 0
+			product.Rating, product.ReviewCount = 0, 0
+			if err := store.save(&product); err != nil {
+				return summary, err
+			}
+			audit.record(nil, "seed", nil, &product)
+			summary.Created++
+		}
+	}
+	return summary, nil
+}
+
+// readFixture reads the products of a fixture file, by its extension
+func readFixture(path string) ([]Product, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var records []json.RawMessage
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		if data, err = yamlToJSON(data); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		fallthrough
+	case ".json":
+		if records, err = fixtureRecords(data); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	case ".jsonl", ".ndjson":
+		dec := json.NewDecoder(bytes.NewReader(data))
+		for {
+			var raw json.RawMessage
+			if err := dec.Decode(&raw); errors.Is(err, io.EOF) {
+				break
+			} else if err != nil {
+				return nil, fmt.Errorf("%s: line %d: %v", path, len(records)+1, err)
+			}
+			records = append(records, raw)
+		}
+	default:
+		return nil, fmt.Errorf("%s: fixtures are .json, .jsonl or .yaml, not %q", path, ext)
+	}
+
+	products := make([]Product, len(records))
+	for i, raw := range records {
+		if violations := decodeStrict(raw, &products[i]); violations != nil {
+			return nil, fmt.Errorf("%s: product %d: %s", path, i+1, violationSummary(violations))
+		}
+	}
+	return products, nil
+}
+
+// fixtureRecords splits a JSON fixture into its products, from a list or
+// the products key of an object
+func fixtureRecords(data []byte) ([]json.RawMessage, error) {
+	var records []json.RawMessage
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+		var fixture struct {
+			Products []json.RawMessage `json:"products"`
+		}
+		if violations := decodeStrict(trimmed, &fixture); violations != nil {
+			return nil, errors.New(violationSummary(violations))
+		}
+		return fixture.Products, nil
+	}
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, fmt.Errorf("a fixture is a list of products or {\"products\": [...]}: %v", err)
+	}
+	return records, nil
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Shadow comparison against the legacy catalog during the migration:
+// LEGACY_CATALOG_URL is its base URL, SHADOW_SAMPLE_PERCENT the share of
+// product reads (default 1) asked of it too, in the background.
+// SHADOW_FIELDS are the product fields compared and SHADOW_FIELD_MAP,
+// JSON such as {"price": "unit_price"}, names them where the legacy
+// catalog calls them something else.
+var (
+	legacyCatalogURL    = strings.TrimSuffix(os.Getenv("LEGACY_CATALOG_URL"), "/")
+	shadowSamplePercent = envInt("SHADOW_SAMPLE_PERCENT", 1)
+	shadowFields        = strings.Split(envString("SHADOW_FIELDS", "price,sale_price,currency,stock,variants"), ",")
+	shadowFieldMap      = parseShadowFieldMap(os.Getenv("SHADOW_FIELD_MAP"))
+	shadowConcurrency   = envInt("SHADOW_CONCURRENCY", 4)
+)
+
+// shadowMaxBodyBytes caps the response kept for comparison; larger lists
+// aren't compared
+const shadowMaxBodyBytes = 1 << 20
+
+// shadowRecentMismatches is how many mismatches are kept as examples
+const shadowRecentMismatches = 50
+
+func parseShadowFieldMap(raw string) map[string]string {
+	fields := make(map[string]string)
+	if raw == "" {
+		return fields
+	}
+	if err := json.Unmarshal([]byte(raw), &fields); err != nil {
+		panic(fmt.Sprintf("invalid SHADOW_FIELD_MAP: %v", err))
+	}
+	return fields
+}
+
+// ShadowComparer asks the legacy catalog for a sample of the product
+// reads this one serves and counts, per field, how often the answers
+// differ. Comparisons run after the response is written and never hold
+// it up; when SHADOW_CONCURRENCY of them are running, more are skipped.
+type ShadowComparer struct {
+	client *http.Client
+	slots  chan struct{}
+
+	mu         sync.Mutex
+	since      time.Time
+	sampled    int64
+	skipped    int64
+	failed     int64 // the legacy catalog couldn't be asked or answered nonsense
+	compared   int64 // products found in both
+	onlyHere   int64
+	onlyLegacy int64
+	fields     map[string]*ShadowFieldStats
+	recent     []ShadowMismatch
+}
+
+// ShadowFieldStats counts the comparisons of one field
+type ShadowFieldStats struct {
+	Compared     int64   `json:"compared"`
+	Mismatched   int64   `json:"mismatched"`
+	MismatchRate float64 `json:"mismatch_rate"`
+}
+
+// ShadowMismatch is an example of a field the catalogs disagree on
+type ShadowMismatch struct {
+	Path      string          `json:"path"`
+	ProductID string          `json:"product_id"`
+	Field     string          `json:"field"`
+	Here      json.RawMessage `json:"here"`
+	Legacy    json.RawMessage `json:"legacy"`
+	At        time.Time       `json:"at"`
+}
+
+// Global shadow comparer, nil unless LEGACY_CATALOG_URL is set
+var shadow = newShadowComparer()
+
+func newShadowComparer() *ShadowComparer {
+	if legacyCatalogURL == "" {
+		return nil
+	}
+	fields := make(map[string]*ShadowFieldStats, len(shadowFields))
+	for i, name := range shadowFields {
+		name = strings.TrimSpace(name)
+		shadowFields[i] = name
+		fields[name] = &ShadowFieldStats{}
+	}
+	return &ShadowComparer{
+		client: newPooledClient("legacy_catalog", 5*time.Second),
+		slots:  make(chan struct{}, max(shadowConcurrency, 1)),
+		since:  time.Now().UTC(),
+		fields: fields,
+	}
+}
+
+// shadowCompare samples the reads of a route for comparison. Only v1
+// JSON responses are compared, since the legacy catalog answers in that
+// shape, and it's asked for the same path without the version. The
+// legacy catalog has one tenant, so only the default tenant's reads are.
+func shadowCompare() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Field selection leaves out fields to compare
+		if shadow == nil || tenantOf(c) != "" || enveloped(c) || c.Query("fields") != "" || rand.IntN(100) >= shadowSamplePercent {
+			c.Next()
+			return
+		}
+		w := &shadowWriter{ResponseWriter: c.Writer}
+		c.Writer = w
+		c.Next()
+
+		mediaType, _, _ := strings.Cut(w.Header().Get("Content-Type"), ";")
+		if w.Status() != http.StatusOK || strings.TrimSpace(mediaType) != mimeJSON || w.truncated {
+			return
+		}
+		path := versionedPath.ReplaceAllString(c.Request.URL.Path, "/")
+		if c.Request.URL.RawQuery != "" {
+			path += "?" + c.Request.URL.RawQuery
+		}
+		shadow.sample(path, w.body.Bytes())
+	}
+}
+
+// shadowWriter keeps a copy of what a handler writes
+type shadowWriter struct {
+	gin.ResponseWriter
+	body      bytes.Buffer
+	truncated bool
+}
+
+func (w *shadowWriter) Write(b []byte) (int, error) {
+	if w.body.Len()+len(b) > shadowMaxBodyBytes {
+		w.truncated = true
+	} else {
+		w.body.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *shadowWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// sample compares a response with the legacy catalog's in the background
+func (s *ShadowComparer) sample(path string, body []byte) {
+	select {
+	case s.slots <- struct{}{}:
+	default:
+		s.mu.Lock()
+		s.skipped++
+		s.mu.Unlock()
+		return
+	}
+	go func() {
+		defer func() { <-s.slots }()
+		if err := s.compare(path, body); err != nil {
+			s.mu.Lock()
+			s.failed++
+			s.mu.Unlock()
+			log.Printf("shadow: %s: %v", path, err)
+		}
+	}()
+}
+
+// compare asks the legacy catalog for path and tallies the differences
+func (s *ShadowComparer) compare(path string, body []byte) error {
+	here, err := shadowProducts(body)
+	if err != nil {
+		return fmt.Errorf("our response: %v", err)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, legacyCatalogURL+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", mimeJSON)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var legacy map[string]map[string]json.RawMessage
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		legacy = map[string]map[string]json.RawMessage{}
+	case resp.StatusCode/100 != 2:
+		return fmt.Errorf("legacy catalog: %s", resp.Status)
+	default:
+		data, err := io.ReadAll(io.LimitReader(resp.Body, shadowMaxBodyBytes))
+		if err != nil {
+			return err
+		}
+		if legacy, err = shadowProducts(data); err != nil {
+			return fmt.Errorf("legacy catalog: %v", err)
+		}
+	}
+
+	now := time.Now().UTC()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sampled++
+	for id, ours := range here {
+		theirs, exists := legacy[id]
+		if !exists {
+			s.onlyHere++
+			continue
+		}
+		s.compared++
+		for _, field := range shadowFields {
+			legacyField := field
+			if mapped, ok := shadowFieldMap[field]; ok {
+				legacyField = mapped
+			}
+			stats := s.fields[field]
+			stats.Compared++
+			if sameJSONValue(ours[field], theirs[legacyField]) {
+				continue
+			}
+			stats.Mismatched++
+			if len(s.recent) == shadowRecentMismatches {
+				s.recent = s.recent[1:]
+			}
+			s.recent = append(s.recent, ShadowMismatch{
+				Path:      path,
+				ProductID: id,
+				Field:     field,
+				Here:      ours[field],
+				Legacy:    theirs[legacyField],
+				At:        now,
+			})
+		}
+	}
+	for id := range legacy {
+		if _, exists := here[id]; !exists {
+			s.onlyLegacy++
+		}
+	}
+	return nil
+}
+
+// shadowProducts reads the products of a response by ID: one product, a
+// list, or either wrapped in products, items, data or product
+func shadowProducts(body []byte) (map[string]map[string]json.RawMessage, error) {
+	var list []map[string]json.RawMessage
+	if err := json.Unmarshal(body, &list); err != nil {
+		var object map[string]json.RawMessage
+		if err := json.Unmarshal(body, &object); err != nil {
+			return nil, err
+		}
+		list = []map[string]json.RawMessage{object}
+		for _, key := range []string{"products", "items", "data", "product"} {
+			if inner, ok := object[key]; ok {
+				if json.Unmarshal(inner, &list) != nil {
+					var one map[string]json.RawMessage
+					if err := json.Unmarshal(inner, &one); err != nil {
+						return nil, err
+					}
+					list = []map[string]json.RawMessage{one}
+				}
+				break
+			}
+		}
+	}
+
+	products := make(map[string]map[string]json.RawMessage, len(list))
+	for _, p := range list {
+		var id any
+		json.Unmarshal(p["id"], &id)
+		if id == nil {
+			continue
+		}
+		products[fmt.Sprint(id)] = p
+	}
+	return products, nil
+}
+
+// sameJSONValue compares two JSON values. Numbers and numeric strings are
+// compared as decimals, so a price of "19.90" matches 19.9, and a missing
+// field matches null.
+func sameJSONValue(a, b json.RawMessage) bool {
+	return sameValue(decodeJSONValue(a), decodeJSONValue(b))
+}
+
+func decodeJSONValue(raw json.RawMessage) any {
+	if len(raw) == 0 {
+		return nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	var v any
+	if dec.Decode(&v) != nil {
+		return string(raw)
+	}
+	return v
+}
+
+func sameValue(a, b any) bool {
+	switch av := a.(type) {
+	case json.Number, string:
+		x, xok := new(big.Rat).SetString(fmt.Sprint(av))
+		y, yok := new(big.Rat).SetString(fmt.Sprint(b))
+		if xok && yok {
+			return x.Cmp(y) == 0
+		}
+	case []any:
+		bv, ok := b.([]any)
+		if !ok || len(av) != len(bv) {
+			return false
+		}
+		for i := range av {
+			if !sameValue(av[i], bv[i]) {
+				return false
+			}
+		}
+		return true
+	case map[string]any:
+		bv, ok := b.(map[string]any)
+		if !ok {
+			return false
+		}
+		for key, value := range av {
+			if !sameValue(value, bv[key]) {
+				return false
+			}
+		}
+		for key, value := range bv {
+			if _, exists := av[key]; !exists && value != nil {
+				return false
+			}
+		}
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// getShadowReport shows how often the legacy catalog disagrees with this
+// one, per field, since startup or the last reset
+// Returns: 200 OK - Success (Cat comparing notes!)
+// Returns: 401 Unauthorized - Admin access required
+// Returns: 404 Not Found - LEGACY_CATALOG_URL is not set
+func getShadowReport(c *gin.Context) {
+	if shadow == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Shadow comparison is not enabled"})
+		return
+	}
+	s := shadow
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fields := make(map[string]ShadowFieldStats, len(s.fields))
+	for name, stats := range s.fields {
+		view := *stats
+		if view.Compared > 0 {
+			view.MismatchRate = float64(view.Mismatched) / float64(view.Compared)
+		}
+		fields[name] = view
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"legacy_url":        legacyCatalogURL,
+		"sample_percent":    shadowSamplePercent,
+		"since":             s.since,
+		"sampled":           s.sampled,
+		"skipped":           s.skipped,
+		"failed":            s.failed,
+		"products_compared": s.compared,
+		"only_here":         s.onlyHere,
+		"only_legacy":       s.onlyLegacy,
+		"fields":            fields,
+		"recent_mismatches": s.recent,
+	})
+}
+
+// resetShadowReport starts the counts over, for instance after fixing a
+// cause of mismatches
+// Returns: 204 No Content - Reset
+// Returns: 401 Unauthorized - Admin access required
+// Returns: 404 Not Found - LEGACY_CATALOG_URL is not set
+func resetShadowReport(c *gin.Context) {
+	if shadow == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Shadow comparison is not enabled"})
+		return
+	}
+	s := shadow
+	s.mu.Lock()
+	s.since = time.Now().UTC()
+	s.sampled, s.skipped, s.failed, s.compared, s.onlyHere, s.onlyLegacy = 0, 0, 0, 0, 0, 0
+	for name := range s.fields {
+		s.fields[name] = &ShadowFieldStats{}
+	}
+	s.recent = nil
+	s.mu.Unlock()
+	c.Status(http.StatusNoContent)
+}
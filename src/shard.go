@@ -0,0 +1,668 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// shardLocalHeader marks a request already routed to its shard, so the
+// receiving instance serves it from its own store
+const shardLocalHeader = "X-Shard-Local"
+
+// hashRing maps keys to nodes with consistent hashing. Each node gets
+// several points on the ring so keys spread evenly and adding a node only
+// moves the keys between its points and their predecessors.
+type hashRing struct {
+	points []uint32
+	owners map[uint32]string
+}
+
+func ringHash(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32()
+}
+
+func newHashRing(nodes []string, vnodes int) *hashRing {
+	r := &hashRing{owners: make(map[uint32]string, len(nodes)*vnodes)}
+	for _, node := range nodes {
+		for i := 0; i < vnodes; i++ {
+			point := ringHash(node + "#" + strconv.Itoa(i))
+			r.points = append(r.points, point)
+			r.owners[point] = node
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i] < r.points[j] })
+	return r
+}
+
+// owner returns the node owning a key: the first point at or after its hash
+func (r *hashRing) owner(key string) string {
+	h := ringHash(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.owners[r.points[i]]
+}
+
+// clusterMember is an instance of the cluster as seen by this one
+type clusterMember struct {
+	URL      string    `json:"url"`
+	Down     bool      `json:"down"`
+	LastSeen time.Time `json:"last_seen"`
+	misses   int
+}
+
+// Cluster splits the catalog across instances. Each product belongs to the
+// instance the ring picks for its ID; requests for it are forwarded there.
+// Members find each other by joining a seed (SHARD_PEERS) and exchanging
+// member lists on every heartbeat. A member that misses heartbeats is
+// marked down but keeps its keys, so its products fail with a 503 rather
+// than silently moving.
+type Cluster struct {
+	self      string
+	secret    string
+	vnodes    int
+	heartbeat time.Duration
+	http      *http.Client
+	forward   http.RoundTripper // forwarded requests, hedged with HEDGE_READS
+
+	mu      sync.RWMutex
+	members map[string]*clusterMember
+	ring    *hashRing
+	proxies map[string]*httputil.ReverseProxy
+}
+
+// Global cluster, nil unless SHARD_SELF is set
+var cluster = newCluster()
+
+func newCluster() *Cluster {
+	self := strings.TrimSuffix(os.Getenv("SHARD_SELF"), "/")
+	if self == "" {
+		return nil
+	}
+	cl := &Cluster{
+		self:      self,
+		secret:    os.Getenv("SHARD_SECRET"),
+		vnodes:    envInt("SHARD_VNODES", 64),
+		heartbeat: envDuration("SHARD_HEARTBEAT", 5*time.Second),
+		http:      newPooledClient("cluster", 5*time.Second),
+		members:   map[string]*clusterMember{self: {URL: self, LastSeen: time.Now().UTC()}},
+		proxies:   make(map[string]*httputil.ReverseProxy),
+	}
+	cl.forward = &hedgedTransport{base: cl.http.Transport, hedger: newHedger("shard")}
+	for _, peer := range strings.Split(os.Getenv("SHARD_PEERS"), ",") {
+		if peer = strings.TrimSuffix(strings.TrimSpace(peer), "/"); peer != "" {
+			cl.members[peer] = &clusterMember{URL: peer}
+		}
+	}
+	cl.rebuildRing()
+	return cl
+}
+
+// rebuildRing recomputes the ring from the members. Callers must hold cl.mu
+// or be the only user of cl.
+func (cl *Cluster) rebuildRing() {
+	nodes := make([]string, 0, len(cl.members))
+	for node := range cl.members {
+		nodes = append(nodes, node)
+	}
+	cl.ring = newHashRing(nodes, cl.vnodes)
+}
+
+// owner returns the member owning a product key
+func (cl *Cluster) owner(key string) string {
+	cl.mu.RLock()
+	defer cl.mu.RUnlock()
+
+	return cl.ring.owner(key)
+}
+
+// merge adds members learned from a peer and reports whether the ring
+// changed
+func (cl *Cluster) merge(urls []string) bool {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	changed := false
+	for _, u := range urls {
+		u = strings.TrimSuffix(u, "/")
+		if _, exists := cl.members[u]; !exists && u != "" {
+			cl.members[u] = &clusterMember{URL: u}
+			changed = true
+			log.Printf("shard: %s joined", u)
+		}
+	}
+	if changed {
+		cl.rebuildRing()
+	}
+	return changed
+}
+
+// memberURLs lists every known member
+func (cl *Cluster) memberURLs() []string {
+	cl.mu.RLock()
+	defer cl.mu.RUnlock()
+
+	urls := make([]string, 0, len(cl.members))
+	for u := range cl.members {
+		urls = append(urls, u)
+	}
+	sort.Strings(urls)
+	return urls
+}
+
+// peers lists the members other than this instance
+func (cl *Cluster) peers() []string {
+	cl.mu.RLock()
+	defer cl.mu.RUnlock()
+
+	peers := make([]string, 0, len(cl.members))
+	for u := range cl.members {
+		if u != cl.self {
+			peers = append(peers, u)
+		}
+	}
+	sort.Strings(peers)
+	return peers
+}
+
+// internalRequest builds a request to a peer's internal endpoint
+func (cl *Cluster) internalRequest(ctx context.Context, method, peer, path string, body any) (*http.Request, error) {
+	var payload io.Reader
+	if body != nil {
+		data, _ := json.Marshal(body)
+		payload = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, peer+path, payload)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(shardLocalHeader, cl.self)
+	if cl.secret != "" {
+		req.Header.Set("X-Cluster-Secret", cl.secret)
+	}
+	return req, nil
+}
+
+// exchange announces this instance to a peer and learns its members
+func (cl *Cluster) exchange(ctx context.Context, peer string) ([]string, error) {
+	req, err := cl.internalRequest(ctx, http.MethodPost, peer, "/internal/cluster/members", gin.H{"members": cl.memberURLs()})
+	if err != nil {
+		return nil, err
+	}
+	resp, err := cl.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("shard: %s: %s", peer, resp.Status)
+	}
+	var body struct {
+		Members []clusterMember `json:"members"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	urls := make([]string, 0, len(body.Members))
+	for _, m := range body.Members {
+		urls = append(urls, m.URL)
+	}
+	return urls, nil
+}
+
+// run exchanges member lists with every member on each heartbeat, marks
+// members down after three missed heartbeats and hands off products this
+// instance doesn't own, after the first heartbeat (sample data, a recovered
+// WAL) and whenever the ring changes
+func (cl *Cluster) run() {
+	ticker := time.NewTicker(cl.heartbeat)
+	defer ticker.Stop()
+
+	for first := true; ; first = false {
+		changed := first
+		for _, peer := range cl.memberURLs() {
+			if peer == cl.self {
+				continue
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), cl.heartbeat)
+			urls, err := cl.exchange(ctx, peer)
+			cancel()
+
+			cl.mu.Lock()
+			m := cl.members[peer]
+			if err != nil {
+				m.misses++
+				if m.misses >= 3 && !m.Down {
+					m.Down = true
+					log.Printf("shard: %s is down: %v", peer, err)
+				}
+			} else {
+				if m.Down {
+					log.Printf("shard: %s is back", peer)
+				}
+				m.misses, m.Down, m.LastSeen = 0, false, time.Now().UTC()
+			}
+			cl.mu.Unlock()
+
+			if err == nil && cl.merge(urls) {
+				changed = true
+			}
+		}
+		if changed {
+			cl.handoff()
+		}
+		<-ticker.C
+	}
+}
+
+// handoff moves products owned by other members to them through their
+// batch endpoint, then drops the local copies. Soft-deleted products stay
+// until they are purged, as batch writes can't create deleted products.
+func (cl *Cluster) handoff() {
+	// Each batch is one tenant's, sent in its name
+	type destination struct{ owner, tenant string }
+	moves := make(map[destination][]Product)
+	store.mu.RLock()
+	for key, p := range store.products {
+		if owner := cl.owner(key); owner != cl.self && p.DeletedAt == nil {
+			to := destination{owner, p.Tenant}
+			moves[to] = append(moves[to], p)
+		}
+	}
+	store.mu.RUnlock()
+
+	for to, products := range moves {
+		for start := 0; start < len(products); start += maxBatchItems {
+			chunk := products[start:min(start+maxBatchItems, len(products))]
+			moved, err := cl.sendBatch(to.owner, to.tenant, chunk)
+			if err != nil {
+				log.Printf("shard: handing off to %s: %v", to.owner, err)
+				break
+			}
+
+			store.mu.Lock()
+			for _, id := range moved {
+				if err := store.remove(productKey(to.tenant, id)); err != nil {
+					log.Printf("shard: dropping %s after handing it off: %v", qualifiedID(to.tenant, id), err)
+				}
+			}
+			store.mu.Unlock()
+			log.Printf("shard: handed off %d products to %s", len(moved), to.owner)
+		}
+	}
+}
+
+// sendBatch upserts a tenant's products on their owner and returns the
+// IDs it stored
+func (cl *Cluster) sendBatch(owner, tenant string, products []Product) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	req, err := cl.internalRequest(ctx, http.MethodPost, owner, "/v1/products/batch", gin.H{"items": products})
+	if err != nil {
+		return nil, err
+	}
+	if tenant != "" {
+		req.Header.Set(tenantHeader, tenant)
+	}
+	resp, err := cl.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("batch: %s", resp.Status)
+	}
+	var body struct {
+		Results []BatchResult `json:"results"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	moved := make([]string, 0, len(body.Results))
+	for _, r := range body.Results {
+		if r.Status < 300 {
+			moved = append(moved, r.ID)
+		}
+	}
+	return moved, nil
+}
+
+// proxy returns the reverse proxy to a member
+func (cl *Cluster) proxy(owner string) (*httputil.ReverseProxy, error) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	if p, exists := cl.proxies[owner]; exists {
+		return p, nil
+	}
+	target, err := url.Parse(owner)
+	if err != nil {
+		return nil, err
+	}
+	p := httputil.NewSingleHostReverseProxy(target)
+	p.Transport = cl.forward
+	p.ModifyResponse = dropEdgeHeaders
+	p.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadGateway)
+		json.NewEncoder(w).Encode(gin.H{"error": "Shard owner unreachable", "owner": owner})
+	}
+	cl.proxies[owner] = p
+	return p, nil
+}
+
+// isDown reports whether a member is marked down
+func (cl *Cluster) isDown(member string) bool {
+	cl.mu.RLock()
+	defer cl.mu.RUnlock()
+
+	m, exists := cl.members[member]
+	return exists && m.Down
+}
+
+// shardKey returns the product ID a request is about, reading it from the
+// body for creates. Requests without one are served locally. Products
+// are placed by their key, so each tenant's spread over every shard.
+func shardKey(c *gin.Context) (string, bool) {
+	if id := c.Param("id"); id != "" {
+		return id, true
+	}
+	if c.Request.Method != http.MethodPost || !strings.HasSuffix(c.FullPath(), "/products") {
+		return "", false
+	}
+
+	body, err := io.ReadAll(c.Request.Body)
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return "", false
+	}
+	var product struct {
+		ID string `json:"id"`
+	}
+	if json.Unmarshal(body, &product) != nil || product.ID == "" {
+		return "", false
+	}
+	return product.ID, true
+}
+
+// shardRoute forwards requests for a product to the instance owning it.
+// Batch endpoints, exports and reports only cover the local shard.
+// Returns: 502 Bad Gateway - Owner unreachable
+// Returns: 503 Service Unavailable - Owner is marked down
+func shardRoute() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if cluster == nil || c.GetHeader(shardLocalHeader) != "" {
+			c.Next()
+			return
+		}
+		id, ok := shardKey(c)
+		if !ok {
+			c.Next()
+			return
+		}
+		owner := cluster.owner(tenantKey(c, id))
+		if owner == cluster.self {
+			c.Next()
+			return
+		}
+		if cluster.isDown(owner) {
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{
+				"error": "Shard owner is down",
+				"id":    id,
+				"owner": owner,
+			})
+			return
+		}
+
+		proxy, err := cluster.proxy(owner)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadGateway, gin.H{
+				"error":   "Invalid shard owner",
+				"details": err.Error(),
+			})
+			return
+		}
+		// The owner sets these again from the same request
+		c.Request.Header.Set("X-Request-ID", c.GetString(requestIDKey))
+		c.Writer.Header().Del("X-Request-ID")
+		c.Writer.Header().Del("API-Version")
+		c.Request.Header.Set(shardLocalHeader, cluster.self)
+		if tenant := tenantOf(c); tenant != "" {
+			c.Request.Header.Set(tenantHeader, tenant)
+		}
+		c.Header("X-Shard-Owner", owner)
+		proxy.ServeHTTP(c.Writer, c.Request)
+		c.Abort()
+	}
+}
+
+// gatherProducts adds the products of every other shard to a list
+// request. A product still held by two shards, while it's being handed
+// off, is listed once from its owner. Shards that don't answer are listed
+// in X-Shard-Partial.
+func (cl *Cluster) gatherProducts(c *gin.Context, local []Product) []Product {
+	if c.GetHeader(shardLocalHeader) != "" {
+		return local
+	}
+
+	peers := cl.peers()
+	results := make([][]Product, len(peers))
+	failed := make([]bool, len(peers))
+	var wg sync.WaitGroup
+	for i, peer := range peers {
+		if cl.isDown(peer) {
+			failed[i] = true
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i], failed[i] = cl.fetchProducts(c, peer)
+		}()
+	}
+	wg.Wait()
+
+	var partial []string
+	products := append(make([]Product, 0, len(local)), local...)
+	seen := make(map[string]int, len(local))
+	for i, p := range local {
+		seen[p.ID] = i
+	}
+	for i, peer := range peers {
+		if failed[i] {
+			partial = append(partial, peer)
+			continue
+		}
+		for _, p := range results[i] {
+			at, dup := seen[p.ID]
+			if !dup {
+				seen[p.ID] = len(products)
+				products = append(products, p)
+			} else if cl.owner(p.key()) == peer {
+				products[at] = p
+			}
+		}
+	}
+	if len(partial) > 0 {
+		c.Header("X-Shard-Partial", strings.Join(partial, ","))
+	}
+	sort.Slice(products, func(i, j int) bool { return products[i].ID < products[j].ID })
+	return products
+}
+
+// fetchProducts gets the local products of a peer for the same query.
+// It returns true when the peer failed.
+func (cl *Cluster) fetchProducts(c *gin.Context, peer string) ([]Product, bool) {
+	// Whole products, for the ETag and filters here; fields are picked after
+	query := c.Request.URL.Query()
+	query.Del("fields")
+	req, err := cl.internalRequest(c.Request.Context(), http.MethodGet, peer, "/v1/products?"+query.Encode(), nil)
+	if err != nil {
+		return nil, true
+	}
+	if auth := c.GetHeader("Authorization"); auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+	if session := c.GetHeader(sessionHeader); session != "" {
+		req.Header.Set(sessionHeader, session)
+	}
+	if tenant := tenantOf(c); tenant != "" {
+		req.Header.Set(tenantHeader, tenant)
+	}
+	resp, err := cl.http.Do(req)
+	if err != nil {
+		log.Printf("shard: listing %s: %v", peer, err)
+		return nil, true
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("shard: listing %s: %s", peer, resp.Status)
+		return nil, true
+	}
+	var body struct {
+		Products []Product `json:"products"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, true
+	}
+	return body.Products, false
+}
+
+// findProduct asks the other shards for the same lookup, for codes that
+// aren't local, and returns the first product found
+func (cl *Cluster) findProduct(c *gin.Context) ([]byte, bool) {
+	if c.GetHeader(shardLocalHeader) != "" {
+		return nil, false
+	}
+
+	peers := cl.peers()
+	found := make([][]byte, len(peers))
+	var wg sync.WaitGroup
+	for i, peer := range peers {
+		if cl.isDown(peer) {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, err := cl.internalRequest(c.Request.Context(), http.MethodGet, peer, c.Request.URL.Path, nil)
+			if err != nil {
+				return
+			}
+			for _, name := range []string{"Authorization", sessionHeader} {
+				if value := c.GetHeader(name); value != "" {
+					req.Header.Set(name, value)
+				}
+			}
+			if tenant := tenantOf(c); tenant != "" {
+				req.Header.Set(tenantHeader, tenant)
+			}
+			resp, err := cl.http.Do(req)
+			if err != nil {
+				log.Printf("shard: lookup on %s: %v", peer, err)
+				return
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				found[i], _ = io.ReadAll(resp.Body)
+			}
+		}()
+	}
+	wg.Wait()
+
+	for _, body := range found {
+		if len(body) > 0 {
+			return body, true
+		}
+	}
+	return nil, false
+}
+
+// checkClusterSecret rejects internal calls without SHARD_SECRET, when set
+func checkClusterSecret(c *gin.Context) bool {
+	if cluster.secret == "" {
+		return true
+	}
+	if subtle.ConstantTimeCompare([]byte(c.GetHeader("X-Cluster-Secret")), []byte(cluster.secret)) != 1 {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid cluster secret"})
+		return false
+	}
+	return true
+}
+
+// getClusterMembers returns the members this instance knows about
+// Returns: 200 OK - Members and their state (Cats counting the litter!)
+// Returns: 404 Not Found - Sharding is not enabled
+func getClusterMembers(c *gin.Context) {
+	if cluster == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Sharding is not enabled"})
+		return
+	}
+
+	cluster.mu.RLock()
+	members := make([]clusterMember, 0, len(cluster.members))
+	for _, m := range cluster.members {
+		members = append(members, *m)
+	}
+	cluster.mu.RUnlock()
+	sort.Slice(members, func(i, j int) bool { return members[i].URL < members[j].URL })
+
+	c.JSON(http.StatusOK, gin.H{
+		"self":    cluster.self,
+		"count":   len(members),
+		"members": members,
+	})
+}
+
+// exchangeClusterMembers merges the caller's member list and answers with
+// this instance's, used for joining and heartbeats
+// Returns: 200 OK - Members
+// Returns: 400 Bad Request - Invalid member list
+// Returns: 401 Unauthorized - Wrong cluster secret
+// Returns: 404 Not Found - Sharding is not enabled
+func exchangeClusterMembers(c *gin.Context) {
+	if cluster == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Sharding is not enabled"})
+		return
+	}
+	if !checkClusterSecret(c) {
+		return
+	}
+	var body struct {
+		Members []string `json:"members" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":   "Invalid member list",
+			"details": err.Error(),
+		})
+		return
+	}
+	if cluster.merge(body.Members) {
+		go cluster.handoff()
+	}
+
+	getClusterMembers(c)
+}
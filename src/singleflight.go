@@ -0,0 +1,53 @@
+package main
+
+import (
+	"expvar"
+	"sync"
+)
+
+// Coalesced request counts by lookup kind, exposed at /debug/vars
+var coalescedRequests = expvar.NewMap("coalesced_requests")
+
+// flightGroup collapses concurrent calls with the same key into a single
+// call whose result is shared by every waiter
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall
+}
+
+type flightCall struct {
+	wg  sync.WaitGroup
+	val any
+	ok  bool
+}
+
+// Global group for storage lookups
+var flights = &flightGroup{calls: make(map[string]*flightCall)}
+
+// do runs fn once per key at a time. Callers arriving while fn is running
+// wait for it and receive the same result. kind labels the metric.
+func (g *flightGroup) do(kind, key string, fn func() (any, bool)) (any, bool) {
+	key = kind + ":" + key
+
+	g.mu.Lock()
+	if call, exists := g.calls[key]; exists {
+		g.mu.Unlock()
+		coalescedRequests.Add(kind, 1)
+		call.wg.Wait()
+		return call.val, call.ok
+	}
+	call := &flightCall{}
+	call.wg.Add(1)
+	g.calls[key] = call
+	g.mu.Unlock()
+
+	defer func() {
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+		call.wg.Done()
+	}()
+
+	call.val, call.ok = fn()
+	return call.val, call.ok
+}
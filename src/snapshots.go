@@ -0,0 +1,269 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// snapshotHeader pins a read to a named catalog snapshot
+const snapshotHeader = "X-Catalog-Snapshot"
+
+// maxSnapshots caps the snapshots held in memory, MAX_SNAPSHOTS
+var maxSnapshots = envInt("MAX_SNAPSHOTS", 10)
+
+// snapshotName is a valid snapshot name, e.g. "spring-launch"
+var snapshotName = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+// CatalogSnapshot is an immutable copy of the storefront catalog, taken
+// from the live catalog or a backup, so a site rebuild renders against
+// the same data from its first page to its last. Products are kept as
+// the storefront saw them: live ones only, with the badges they showed.
+// Publishing windows and rollouts are checked when serving, as of the
+// snapshot's time, since what a rollout shows depends on the session.
+type CatalogSnapshot struct {
+	Name      string             `json:"name"`
+	Source    string             `json:"source"` // "live" or the backup's name
+	Count     int                `json:"count"`
+	CreatedAt time.Time          `json:"created_at"`
+	products  map[string]Product // by productKey, of every tenant
+}
+
+// SnapshotStore holds the named snapshots of this instance, in memory
+type SnapshotStore struct {
+	mu        sync.RWMutex
+	snapshots map[string]*CatalogSnapshot
+}
+
+// Global snapshots
+var snapshots = &SnapshotStore{snapshots: make(map[string]*CatalogSnapshot)}
+
+// Snapshot errors
+var (
+	errSnapshotExists   = errors.New("a snapshot with this name already exists")
+	errTooManySnapshots = errors.New("too many snapshots, delete one first")
+)
+
+// add takes a snapshot of products under a name
+func (s *SnapshotStore) add(name, source string, products []Product) (*CatalogSnapshot, error) {
+	snap := &CatalogSnapshot{
+		Name:      name,
+		Source:    source,
+		CreatedAt: time.Now().UTC(),
+		products:  make(map[string]Product, len(products)),
+	}
+	for _, p := range withActiveBadges(products) {
+		if p.live() {
+			snap.products[p.key()] = p
+		}
+	}
+	snap.Count = len(snap.products)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.snapshots[name]; exists {
+		return nil, errSnapshotExists
+	}
+	if len(s.snapshots) >= maxSnapshots {
+		return nil, errTooManySnapshots
+	}
+	s.snapshots[name] = snap
+	return snap, nil
+}
+
+// get returns a snapshot by name
+func (s *SnapshotStore) get(name string) (*CatalogSnapshot, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	snap, exists := s.snapshots[name]
+	return snap, exists
+}
+
+// list returns the snapshots, oldest first
+func (s *SnapshotStore) list() []CatalogSnapshot {
+	s.mu.RLock()
+	list := make([]CatalogSnapshot, 0, len(s.snapshots))
+	for _, snap := range s.snapshots {
+		list = append(list, *snap)
+	}
+	s.mu.RUnlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+	return list
+}
+
+// pinnedSnapshot returns the snapshot a read is pinned to, if any. It
+// writes 404 for an unknown snapshot and reports whether the read can go
+// on.
+// Returns: 404 Not Found - No such snapshot
+func pinnedSnapshot(c *gin.Context) (*CatalogSnapshot, bool) {
+	name := c.GetHeader(snapshotHeader)
+	if name == "" {
+		return nil, true
+	}
+	snap, exists := snapshots.get(name)
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error":    "Catalog snapshot not found",
+			"snapshot": name,
+		})
+		return nil, false
+	}
+	return snap, true
+}
+
+// setSnapshotHeaders marks a response as served from a snapshot. Snapshots
+// never change, but can be deleted and taken again under the same name,
+// so ETags include when it was taken.
+func setSnapshotHeaders(c *gin.Context, snap *CatalogSnapshot, etag string) {
+	addVary(c, "Accept", "Authorization", snapshotHeader)
+	c.Header("Cache-Control", "private, max-age=3600")
+	c.Header(snapshotHeader, snap.Name)
+	c.Header("ETag", fmt.Sprintf(`W/"%s-%d-%s"`, snap.Name, snap.CreatedAt.UnixNano(), etag))
+	setLastModified(c, snap.CreatedAt)
+}
+
+// getSnapshotProducts serves GET /products from a snapshot, with the same
+// filters as the live list
+func getSnapshotProducts(c *gin.Context, snap *CatalogSnapshot, query listQuery, format, currency string, fields fieldSet) {
+	products := shownProductsAt(c, query.run(snap.products), snap.CreatedAt)
+	sort.Slice(products, func(i, j int) bool { return products[i].ID < products[j].ID })
+	products, ok := localizeProducts(c, products, currency)
+	if !ok {
+		return
+	}
+	products = translateProducts(c, products)
+
+	setSnapshotHeaders(c, snap, strings.Trim(strings.TrimPrefix(listETag(products, currency), "W/"), `"`))
+	if notModified(c, c.Writer.Header().Get("ETag")) {
+		return
+	}
+	renderProducts(c, format, products, fields)
+}
+
+// getSnapshotProduct serves GET /products/:id from a snapshot
+// Returns: 404 Not Found - Product isn't in the snapshot
+func getSnapshotProduct(c *gin.Context, snap *CatalogSnapshot, id, format, currency string, fields fieldSet) {
+	product, exists := snap.products[tenantKey(c, id)]
+	if !exists || !shownToAt(c, product, snap.CreatedAt) {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error":    "Product not found in the snapshot",
+			"id":       id,
+			"snapshot": snap.Name,
+		})
+		return
+	}
+	localized, ok := localizeProducts(c, []Product{product}, currency)
+	if !ok {
+		return
+	}
+	localized = translateProducts(c, localized)
+
+	setSnapshotHeaders(c, snap, fmt.Sprintf("%s-%d-%s", id, product.Version, currency))
+	if notModified(c, c.Writer.Header().Get("ETag")) {
+		return
+	}
+	renderProduct(c, format, localized[0], fields)
+}
+
+// createSnapshotRequest is the body of POST /admin/snapshots. Backup, when
+// set, takes the snapshot from that backup rather than the live catalog.
+type createSnapshotRequest struct {
+	Name   string `json:"name"`
+	Backup string `json:"backup"`
+}
+
+// createSnapshot takes a named snapshot of the live catalog or a backup
+// Returns: 201 Created - Snapshot taken (Cat posing for a photo!)
+// Returns: 400 Bad Request - Invalid name or backup
+// Returns: 404 Not Found - No such backup, or backups are not configured
+// Returns: 409 Conflict - Name taken, too many snapshots, or sharding is enabled
+// Returns: 502 Bad Gateway - S3 failed or the backup is corrupt
+// Returns: 503 Service Unavailable - S3 is down, with Retry-After
+func createSnapshot(c *gin.Context) {
+	var req createSnapshotRequest
+	if violations := bindStrict(c, &req); violations != nil {
+		invalidRequest(c, "Invalid snapshot", violations)
+		return
+	}
+	if !snapshotName.MatchString(req.Name) {
+		invalidRequest(c, "Invalid snapshot", []Violation{{Code: violationInvalid, Field: "name", Message: "Must be 1 to 64 letters, digits, dots, dashes or underscores"}})
+		return
+	}
+	if cluster != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Sharded catalogs can't be snapshotted as a whole, each shard holds part of it"})
+		return
+	}
+
+	var products []Product
+	source := "live"
+	if req.Backup == "" {
+		products = store.cut().products
+	} else {
+		if backupsUnavailable(c) {
+			return
+		}
+		if !backupNamePattern.MatchString(req.Backup) {
+			invalidRequest(c, "Invalid snapshot", []Violation{{Code: violationInvalid, Field: "backup", Message: "Must be a backup name"}})
+			return
+		}
+		var err error
+		products, err = backups.load(c.Request.Context(), req.Backup)
+		if dependencyUnavailable(c, err) {
+			return
+		}
+		if s3Status(err) == http.StatusNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Backup not found", "name": req.Backup})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to read backup", "name": req.Backup, "details": err.Error()})
+			return
+		}
+		source = req.Backup
+	}
+
+	snap, err := snapshots.add(req.Name, source, products)
+	if err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error(), "name": req.Name})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{
+		"message":  "Snapshot created successfully",
+		"snapshot": snap,
+	})
+}
+
+// getSnapshots lists the catalog snapshots of this instance
+// Returns: 200 OK - Success
+func getSnapshots(c *gin.Context) {
+	list := snapshots.list()
+	c.JSON(http.StatusOK, gin.H{
+		"count":     len(list),
+		"snapshots": list,
+	})
+}
+
+// deleteSnapshot drops a snapshot; reads pinned to it get 404 from then on
+// Returns: 204 No Content - Deleted
+// Returns: 404 Not Found - No such snapshot
+func deleteSnapshot(c *gin.Context) {
+	name := c.Param("name")
+
+	snapshots.mu.Lock()
+	_, exists := snapshots.snapshots[name]
+	delete(snapshots.snapshots, name)
+	snapshots.mu.Unlock()
+
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Catalog snapshot not found", "snapshot": name})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
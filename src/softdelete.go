@@ -0,0 +1,112 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// purgeAfter is how long soft-deleted products are kept before the purge
+// job removes them for good, PURGE_AFTER_DAYS
+var purgeAfter = time.Duration(envInt("PURGE_AFTER_DAYS", 30)) * 24 * time.Hour
+
+// get returns a product unless it doesn't exist, has been soft-deleted or
+// is suspended. Callers must hold s.mu.
+func (s *ProductStore) get(id string) (Product, bool) {
+	p, exists := s.products[id]
+	if !exists || !p.live() {
+		return Product{}, false
+	}
+	return p, true
+}
+
+// getShown returns the request's tenant's product with an ID as the
+// storefront sees it, or false when it's not there for this request:
+// missing, deleted or suspended, outside its publishing window or, when
+// soft launched, outside the session's rollout. Every storefront read of a
+// single product goes through it, so all of them agree on what's hidden.
+// Callers must hold s.mu.
+func (s *ProductStore) getShown(c *gin.Context, id string) (Product, bool) {
+	p, exists := s.get(tenantKey(c, id))
+	if !exists || !shownTo(c, p) {
+		return Product{}, false
+	}
+	return p, true
+}
+
+// includeDeleted reports whether the request asked for soft-deleted and
+// suspended products. Only admins may see them; other callers get a 403.
+func includeDeleted(c *gin.Context) (include, ok bool) {
+	if c.Query("include_deleted") != "true" {
+		return false, true
+	}
+	if !isAdmin(c) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": "include_deleted requires admin access",
+		})
+		return false, false
+	}
+	return true, true
+}
+
+// restoreProduct brings back a soft-deleted product
+// Returns: 200 OK - Restored (Cat back from its nap!)
+// Returns: 404 Not Found - Product doesn't exist (Cat hiding in a box!)
+// Returns: 409 Conflict - Product isn't deleted
+func restoreProduct(c *gin.Context) {
+	id := c.Param("id")
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	product, exists := store.products[tenantKey(c, id)]
+	if !exists {
+		productNotFound(c, id)
+		return
+	}
+	if product.DeletedAt == nil {
+		c.JSON(http.StatusConflict, gin.H{
+			"error": "Product is not deleted",
+			"id":    id,
+		})
+		return
+	}
+
+	before := product
+	product.DeletedAt = nil
+	if err := store.save(&product); err != nil {
+		writeFailed(c, err)
+		return
+	}
+	audit.record(c, "restore", &before, &product)
+
+	c.Header("ETag", productETag(product))
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Product restored successfully",
+		"product": product,
+	})
+}
+
+// purgeDeleted permanently removes products soft-deleted before the cutoff
+// and returns how many were (or, on a dry run, would be) removed
+func (s *ProductStore) purgeDeleted(cutoff time.Time, dryRun bool) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	purged := 0
+	for id, p := range s.products {
+		if p.DeletedAt != nil && p.DeletedAt.Before(cutoff) {
+			if !dryRun {
+				if err := s.remove(id); err != nil {
+					log.Printf("purge: removing %s: %v", id, err)
+					return purged
+				}
+				audit.record(nil, "purge", &p, nil)
+			}
+			purged++
+		}
+	}
+	return purged
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// storeFile keeps the catalog in one JSON file, STORE_FILE, for local
+// development without AWS: it's loaded on start and written again after
+// writes, with each product's stock ledger. Deployments that need every
+// acknowledged write to survive a crash use WAL_DIR instead.
+var storeFile = os.Getenv("STORE_FILE")
+
+// CatalogFile writes the catalog to disk in the background. Writes only
+// mark it changed, so a burst of them, such as a batch or a seed, costs
+// one rewrite of the file rather than one each. The file is an indented
+// JSON array sorted by ID, so it diffs well and can be edited by hand
+// while the server is stopped.
+type CatalogFile struct {
+	path    string
+	pending chan struct{}
+	mu      sync.Mutex // one save at a time
+}
+
+// loadStoreFile replaces the store content with the products in path. On
+// a first start there's no file and the store starts empty, for seeding
+// to fill.
+func (s *ProductStore) loadStoreFile(path string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		var products []LedgeredProduct
+		if err := json.Unmarshal(data, &products); err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		for _, p := range products {
+			if p.ID == "" {
+				return fmt.Errorf("%s: a product has no id", path)
+			}
+		}
+		var ledgers map[string][]StockEntry
+		s.products, ledgers = splitLedgers(products)
+		stockLedger.restore(s.products, ledgers)
+		codes.rebuild(s.products)
+		suggestions.rebuild(s.products)
+		s.recovered = true
+		log.Printf("store file: loaded %d products from %s", len(products), path)
+	case !errors.Is(err, os.ErrNotExist):
+		return err
+	}
+	s.file = &CatalogFile{path: path, pending: make(chan struct{}, 1)}
+	return nil
+}
+
+// changed asks for the file to be written again. Callers must hold
+// store.mu, so the save that follows sees the write.
+func (f *CatalogFile) changed() {
+	select {
+	case f.pending <- struct{}{}:
+	default:
+		// A save is already due and will include this write
+	}
+}
+
+// run saves the catalog whenever it has changed
+func (f *CatalogFile) run() {
+	for range f.pending {
+		if err := f.save(); err != nil {
+			log.Printf("store file: %v", err)
+		}
+	}
+}
+
+// save writes the catalog as it is now. The file is replaced by rename,
+// so a crash leaves the previous version rather than a torn one.
+func (f *CatalogFile) save() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	store.mu.RLock()
+	products := make([]LedgeredProduct, 0, len(store.products))
+	for _, p := range store.products {
+		products = append(products, stockLedger.ledgered(p))
+	}
+	store.mu.RUnlock()
+	sort.Slice(products, func(i, j int) bool { return products[i].key() < products[j].key() })
+
+	data, err := json.MarshalIndent(products, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(f.path), filepath.Base(f.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), f.path)
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// eventStock is sent alongside "updated" when a product's stock changed
+const eventStock = "stock"
+
+// streamHeartbeat keeps idle streams open through proxies, STREAM_HEARTBEAT
+var streamHeartbeat = envDuration("STREAM_HEARTBEAT", 15*time.Second)
+
+// stockChange is the data of a "stock" event
+type stockChange struct {
+	ID            string `json:"id"`
+	Stock         int    `json:"stock"`
+	PreviousStock int    `json:"previous_stock"`
+}
+
+// streamFilter picks the events a stream wants
+type streamFilter struct {
+	tenant   string
+	ids      map[string]bool
+	category string
+}
+
+// matches reports whether an event is about a product the stream wants.
+// A product moving into or out of the category matches either way.
+func (f streamFilter) matches(e ProductEvent) bool {
+	if e.Tenant != f.tenant || len(f.ids) > 0 && !f.ids[e.ID] {
+		return false
+	}
+	if f.category == "" {
+		return true
+	}
+	for _, p := range []*Product{e.Product, e.Previous} {
+		if p != nil && strings.EqualFold(p.Category, f.category) {
+			return true
+		}
+	}
+	return false
+}
+
+// streamProducts streams product changes as Server-Sent Events, from the
+// moment it's called. ?id=1,2 and ?category= narrow it down. Each event's
+// name is its type (created, updated, deleted, purged, stock) and its data
+// the JSON event. A client that falls behind gets a "reset" event and is
+// disconnected, and should re-read what it needs and connect again. With
+// sharding, only this instance's products are streamed. Storefront
+// streams only carry the products the session sees, so unpublished and
+// soft-launched ones don't leak through them.
+// Returns: 200 OK - text/event-stream until the client goes away (Cat on the lookout!)
+func streamProducts(c *gin.Context) {
+	filter := streamFilter{tenant: tenantOf(c), ids: make(map[string]bool), category: c.Query("category")}
+	for _, v := range c.QueryArray("id") {
+		for _, id := range strings.Split(v, ",") {
+			if id = strings.TrimSpace(id); id != "" {
+				filter.ids[id] = true
+			}
+		}
+	}
+	admin, session := isAdmin(c), c.GetHeader(sessionHeader)
+
+	events := productEvents.subscribe(256)
+	defer productEvents.unsubscribe(events)
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	fmt.Fprint(c.Writer, ": connected\n\n")
+	c.Writer.Flush()
+
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				writeStreamEvent(c, "reset", gin.H{"error": "Stream fell behind, re-read and reconnect"})
+				return
+			}
+			if !filter.matches(e) {
+				continue
+			}
+			if !admin {
+				if e, ok = storefrontEvent(e, session, time.Now()); !ok {
+					continue
+				}
+			}
+			writeStreamEvent(c, e.Type, e)
+			if e.Type == eventUpdated && e.Product != nil && e.Previous != nil && e.Previous.Stock != e.Product.Stock {
+				writeStreamEvent(c, eventStock, stockChange{ID: e.ID, Stock: e.Product.Stock, PreviousStock: e.Previous.Stock})
+			}
+			c.Writer.Flush()
+		case <-heartbeat.C:
+			fmt.Fprint(c.Writer, ": heartbeat\n\n")
+			c.Writer.Flush()
+		case <-c.Request.Context().Done():
+			return
+		}
+	}
+}
+
+// storefrontEvent returns an event as a storefront session sees it at a
+// time, or false when the session sees the product neither before nor
+// after the change. A product leaving the session's view, by being
+// deleted, suspended, unpublished or rolled back, is sent without its data.
+func storefrontEvent(e ProductEvent, session string, at time.Time) (ProductEvent, bool) {
+	shown := func(p *Product) bool { return p != nil && p.live() && p.shownAt(session, at) }
+	if !shown(e.Product) && !shown(e.Previous) {
+		return e, false
+	}
+	if !shown(e.Product) {
+		e.Product = nil
+	}
+	if !shown(e.Previous) {
+		e.Previous = nil
+	}
+	return e, true
+}
+
+// writeStreamEvent writes one Server-Sent Event
+func writeStreamEvent(c *gin.Context, name string, data any) {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(c.Writer, "event: %s\ndata: %s\n\n", name, payload)
+}
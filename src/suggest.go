@@ -0,0 +1,227 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Autocomplete limits
+const (
+	defaultSuggestions = 10
+	maxSuggestions     = 20
+	maxSuggestQuery    = 100
+	// maxSuggestPrefix is the longest word prefix indexed; longer query
+	// words are checked against the names of the products it finds
+	maxSuggestPrefix = 12
+)
+
+// SuggestIndex maps the prefixes of the words in product names to the
+// products, so a search box can be completed without scanning the
+// catalog: "lap" finds every product with a name word starting with it.
+// It's kept up to date by store.apply, like the code index, and per
+// tenant.
+type SuggestIndex struct {
+	prefixes map[tenantCode]map[string]bool // to product keys
+}
+
+// Global autocomplete index. Callers must hold store.mu.
+var suggestions = &SuggestIndex{prefixes: make(map[tenantCode]map[string]bool)}
+
+// nameWords splits a name into its lower-case words
+func nameWords(name string) []string {
+	return strings.FieldsFunc(strings.ToLower(name), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// wordPrefixes returns every prefix of the words of a name, up to
+// maxSuggestPrefix runes, without duplicates
+func wordPrefixes(name string) []string {
+	var prefixes []string
+	for _, word := range nameWords(name) {
+		n := 0
+		for i := range word {
+			if n > 0 {
+				prefixes = append(prefixes, word[:i])
+			}
+			if n++; n > maxSuggestPrefix {
+				break
+			}
+		}
+		if n <= maxSuggestPrefix {
+			prefixes = append(prefixes, word)
+		}
+	}
+	slices.Sort(prefixes)
+	return slices.Compact(prefixes)
+}
+
+// update moves a product in the index from before to after; either is nil
+// for creates and purges
+func (x *SuggestIndex) update(before, after *Product) {
+	if before != nil && after != nil && before.Name == after.Name {
+		return
+	}
+	if before != nil {
+		for _, prefix := range wordPrefixes(before.Name) {
+			prefix := tenantCode{before.Tenant, prefix}
+			delete(x.prefixes[prefix], before.key())
+			if len(x.prefixes[prefix]) == 0 {
+				delete(x.prefixes, prefix)
+			}
+		}
+	}
+	if after != nil {
+		for _, prefix := range wordPrefixes(after.Name) {
+			prefix := tenantCode{after.Tenant, prefix}
+			if x.prefixes[prefix] == nil {
+				x.prefixes[prefix] = make(map[string]bool)
+			}
+			x.prefixes[prefix][after.key()] = true
+		}
+	}
+}
+
+// rebuild indexes a whole catalog, after the store is replaced
+func (x *SuggestIndex) rebuild(products map[string]Product) {
+	clear(x.prefixes)
+	for _, p := range products {
+		x.update(nil, &p)
+	}
+}
+
+// lookup returns the keys of the tenant's products with a name word
+// starting with each of words
+func (x *SuggestIndex) lookup(tenant string, words []string) []string {
+	sets := make([]map[string]bool, len(words))
+	for i, word := range words {
+		if utf8.RuneCountInString(word) > maxSuggestPrefix {
+			word = string([]rune(word)[:maxSuggestPrefix])
+		}
+		sets[i] = x.prefixes[tenantCode{tenant, word}]
+		if len(sets[i]) == 0 {
+			return nil
+		}
+	}
+	// Walk the smallest set and check the others
+	slices.SortFunc(sets, func(a, b map[string]bool) int { return len(a) - len(b) })
+	var keys []string
+	for key := range sets[0] {
+		found := true
+		for _, set := range sets[1:] {
+			if !set[key] {
+				found = false
+				break
+			}
+		}
+		if found {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// Suggestion is a name completion and the product it's from
+type Suggestion struct {
+	Text string `json:"text"`
+	ID   string `json:"id"`
+}
+
+// suggestProducts completes a search box: GET /products/suggest?q=lap
+// returns the names of up to ?limit= products (default 10, at most 20)
+// with a word starting with each word of q. Names starting with q come
+// first, then the most reviewed. Each name is suggested once.
+// Returns: 200 OK - Suggestions, possibly none (Cat finishing your sentence!)
+// Returns: 400 Bad Request - Missing or too long q, or invalid limit
+func suggestProducts(c *gin.Context) {
+	q := strings.ToLower(strings.TrimSpace(c.Query("q")))
+	words := nameWords(q)
+	if len(words) == 0 || utf8.RuneCountInString(q) > maxSuggestQuery {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":      "q must have a letter or digit, and at most 100 characters",
+			"max_length": maxSuggestQuery,
+		})
+		return
+	}
+	limit := defaultSuggestions
+	if value := c.Query("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > maxSuggestions {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "limit must be between 1 and 20",
+				"max":   maxSuggestions,
+			})
+			return
+		}
+		limit = n
+	}
+
+	var matches []Product
+	store.mu.RLock()
+	for _, key := range suggestions.lookup(tenantOf(c), words) {
+		p, exists := store.get(key)
+		if !exists || !p.live() || !shownTo(c, p) {
+			continue
+		}
+		if nameHasPrefixes(p.Name, words) {
+			matches = append(matches, p)
+		}
+	}
+	store.mu.RUnlock()
+
+	slices.SortFunc(matches, func(a, b Product) int {
+		aStarts, bStarts := strings.HasPrefix(strings.ToLower(a.Name), q), strings.HasPrefix(strings.ToLower(b.Name), q)
+		switch {
+		case aStarts != bStarts:
+			if aStarts {
+				return -1
+			}
+			return 1
+		case a.ReviewCount != b.ReviewCount:
+			return b.ReviewCount - a.ReviewCount
+		case a.Name != b.Name:
+			return strings.Compare(a.Name, b.Name)
+		}
+		return strings.Compare(a.ID, b.ID)
+	})
+
+	list := make([]Suggestion, 0, limit)
+	seen := make(map[string]bool, limit)
+	for _, p := range matches {
+		if len(list) == limit {
+			break
+		}
+		if key := strings.ToLower(p.Name); !seen[key] {
+			seen[key] = true
+			list = append(list, Suggestion{Text: p.Name, ID: p.ID})
+		}
+	}
+
+	setCacheHeaders(c, cache.list)
+	c.JSON(http.StatusOK, gin.H{
+		"query":       q,
+		"count":       len(list),
+		"suggestions": list,
+	})
+}
+
+// nameHasPrefixes reports whether each of words starts a word of name,
+// for query words longer than the index's prefixes
+func nameHasPrefixes(name string, words []string) bool {
+	have := nameWords(name)
+	for _, word := range words {
+		if utf8.RuneCountInString(word) <= maxSuggestPrefix {
+			continue
+		}
+		if !slices.ContainsFunc(have, func(w string) bool { return strings.HasPrefix(w, word) }) {
+			return false
+		}
+	}
+	return true
+}
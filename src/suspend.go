@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Suspension takes a product off the storefront at once, for recalls and
+// legal takedowns. A suspended product is hidden like a deleted one: from
+// reads, lists and searches, lookups, the stream and GraphQL, and it can't
+// be priced, reviewed or changed until it's unsuspended. Admins still see
+// it with include_deleted=true.
+type Suspension struct {
+	Reason string    `json:"reason"`
+	By     string    `json:"by"`
+	At     time.Time `json:"at"`
+}
+
+// maxSuspendReasonLength limits the reason given for a suspension
+const maxSuspendReasonLength = 500
+
+// live reports whether a product is on the storefront: neither
+// soft-deleted nor suspended
+func (p Product) live() bool {
+	return p.DeletedAt == nil && p.Suspension == nil
+}
+
+// cdnDistribution is the CloudFront distribution in front of the API,
+// CLOUDFRONT_DISTRIBUTION_ID. Suspensions invalidate its product paths so
+// the CDN stops serving copies it cached before.
+var cdnDistribution = os.Getenv("CLOUDFRONT_DISTRIBUTION_ID")
+
+// cdnClient sends CloudFront invalidations
+var cdnClient = newAWSClient("cloudfront", 10*time.Second)
+
+// invalidateCDN drops every cached product response, lists included, as
+// wildcards are charged as one path each. It returns the invalidation
+// ID, or "" when there's no distribution.
+func invalidateCDN(ctx context.Context, reference string) (string, error) {
+	if cdnDistribution == "" {
+		return "", nil
+	}
+	return cloudFrontInvalidate(ctx, cdnClient, cdnDistribution, []string{"/products*", "/v1/products*", "/v2/products*"}, reference)
+}
+
+// suspendRequest is the body of POST /admin/products/:id/suspend
+type suspendRequest struct {
+	Reason string `json:"reason"`
+}
+
+// suspendProduct hides a product everywhere right away. The write goes
+// through the store, so caches are invalidated and watchers, destinations
+// and webhooks get a "suspended" event; then the CDN is invalidated.
+// Returns: 200 OK - Suspended, with the CDN invalidation if there's one
+// Returns: 400 Bad Request - No reason given
+// Returns: 404 Not Found - Product doesn't exist
+// Returns: 409 Conflict - Product is already suspended
+func suspendProduct(c *gin.Context) {
+	id := c.Param("id")
+
+	var req suspendRequest
+	if violations := bindStrict(c, &req); violations != nil {
+		invalidRequest(c, "Invalid suspension", violations)
+		return
+	}
+	var violations []Violation
+	normalizeText(&req.Reason, "reason", maxSuspendReasonLength, &violations)
+	if req.Reason == "" {
+		violations = append(violations, Violation{Code: violationRequired, Field: "reason", Message: "Is required"})
+	}
+	if len(violations) > 0 {
+		invalidRequest(c, "Invalid suspension", violations)
+		return
+	}
+
+	store.mu.Lock()
+	product, exists := store.products[tenantKey(c, id)]
+	if !exists {
+		store.mu.Unlock()
+		productNotFound(c, id)
+		return
+	}
+	if product.Suspension != nil {
+		store.mu.Unlock()
+		c.JSON(http.StatusConflict, gin.H{
+			"error":      "Product is already suspended",
+			"id":         id,
+			"suspension": product.Suspension,
+		})
+		return
+	}
+	before := product
+	product.Suspension = &Suspension{Reason: req.Reason, By: actor(c), At: time.Now().UTC()}
+	if err := store.save(&product); err != nil {
+		store.mu.Unlock()
+		writeFailed(c, err)
+		return
+	}
+	audit.record(c, "suspend", &before, &product)
+	store.mu.Unlock()
+
+	respondSuspension(c, "Product suspended", product)
+}
+
+// unsuspendProduct puts a suspended product back on the storefront
+// Returns: 200 OK - Unsuspended, with the CDN invalidation if there's one
+// Returns: 404 Not Found - Product doesn't exist
+// Returns: 409 Conflict - Product isn't suspended
+func unsuspendProduct(c *gin.Context) {
+	id := c.Param("id")
+
+	store.mu.Lock()
+	product, exists := store.products[tenantKey(c, id)]
+	if !exists {
+		store.mu.Unlock()
+		productNotFound(c, id)
+		return
+	}
+	if product.Suspension == nil {
+		store.mu.Unlock()
+		c.JSON(http.StatusConflict, gin.H{
+			"error": "Product is not suspended",
+			"id":    id,
+		})
+		return
+	}
+	before := product
+	product.Suspension = nil
+	if err := store.save(&product); err != nil {
+		store.mu.Unlock()
+		writeFailed(c, err)
+		return
+	}
+	audit.record(c, "unsuspend", &before, &product)
+	store.mu.Unlock()
+
+	respondSuspension(c, "Product unsuspended", product)
+}
+
+// respondSuspension invalidates the CDN, outside store.mu, and reports
+// the change. The invalidation goes out even if the client goes away. A
+// failed one doesn't undo the change: the API already answers the new
+// way, and the CDN catches up when its copies expire.
+func respondSuspension(c *gin.Context, message string, product Product) {
+	response := gin.H{
+		"message": message,
+		"product": product,
+	}
+	ctx := context.WithoutCancel(c.Request.Context())
+	invalidation, err := invalidateCDN(ctx, fmt.Sprintf("%s-v%d", product.ID, product.Version))
+	switch {
+	case err != nil:
+		log.Printf("cdn: invalidating product %s: %v", product.ID, err)
+		response["cdn_error"] = err.Error()
+	case invalidation != "":
+		response["cdn_invalidation"] = invalidation
+	}
+
+	c.Header("ETag", productETag(product))
+	c.JSON(http.StatusOK, response)
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// tenantHeader names the tenant of a request, as does its subdomain under
+// TENANT_DOMAIN
+const tenantHeader = "X-Tenant-ID"
+
+// tenantContextKey is the gin context key holding the request's tenant
+const tenantContextKey = "tenant"
+
+// tenantName is a valid tenant name, a DNS label so it can be a subdomain
+var tenantName = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// tenantTokens maps each tenant to its bearer token, from TENANTS, a JSON
+// object such as {"acme": "token"}. Without it the deployment has one
+// catalog, the default tenant's, and tenant headers are ignored.
+var tenantTokens = parseTenants(os.Getenv("TENANTS"))
+
+// tenantDomain is the domain whose subdomains name tenants, TENANT_DOMAIN:
+// with shop.example.com, acme.shop.example.com is acme's
+var tenantDomain = strings.ToLower(strings.TrimPrefix(os.Getenv("TENANT_DOMAIN"), "."))
+
+func parseTenants(raw string) map[string]string {
+	tenants := make(map[string]string)
+	if raw == "" {
+		return tenants
+	}
+	if err := json.Unmarshal([]byte(raw), &tenants); err != nil {
+		panic(fmt.Sprintf("invalid TENANTS: %v", err))
+	}
+	for tenant, token := range tenants {
+		switch {
+		case !tenantName.MatchString(tenant):
+			panic(fmt.Sprintf("invalid TENANTS: %q is not a valid tenant name", tenant))
+		case token == "":
+			panic(fmt.Sprintf("invalid TENANTS: %s has no token", tenant))
+		case token == adminToken:
+			panic(fmt.Sprintf("invalid TENANTS: %s has the admin token", tenant))
+		}
+	}
+	return tenants
+}
+
+// productKey is the store key of a tenant's product. The default tenant's
+// products are keyed by their ID, so stores written before tenants keep
+// their keys. IDs can't contain whitespace, so the keys of other tenants'
+// products never collide with them.
+func productKey(tenant, id string) string {
+	if tenant == "" {
+		return id
+	}
+	return tenant + " " + id
+}
+
+// splitProductKey returns the tenant and ID of a store key
+func splitProductKey(key string) (tenant, id string) {
+	if tenant, id, found := strings.Cut(key, " "); found {
+		return tenant, id
+	}
+	return "", key
+}
+
+// qualifiedID names a tenant's product where keys can't have spaces, as
+// in event IDs and SQS message groups: acme/laser
+func qualifiedID(tenant, id string) string {
+	if tenant == "" {
+		return id
+	}
+	return tenant + "/" + id
+}
+
+// key is the product's store key
+func (p Product) key() string {
+	return productKey(p.Tenant, p.ID)
+}
+
+// tenantOf returns the tenant of a request, "" for the default tenant
+func tenantOf(c *gin.Context) string {
+	return c.GetString(tenantContextKey)
+}
+
+// tenantKey is the store key of the request's tenant's product with an ID
+func tenantKey(c *gin.Context, id string) string {
+	return productKey(tenantOf(c), id)
+}
+
+// requestTenant returns the tenant a request names, by header or else by
+// subdomain, "" for none
+func requestTenant(r *http.Request) string {
+	if tenant := r.Header.Get(tenantHeader); tenant != "" {
+		return strings.ToLower(tenant)
+	}
+	if tenantDomain == "" {
+		return ""
+	}
+	host := strings.ToLower(r.Host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if sub, found := strings.CutSuffix(host, "."+tenantDomain); found && !strings.Contains(sub, ".") {
+		return sub
+	}
+	return ""
+}
+
+// resolveTenant returns the tenant a request is scoped to, or the status
+// and error it's refused with. Requests that name no tenant are the
+// default tenant's.
+func resolveTenant(r *http.Request) (string, int, string) {
+	if len(tenantTokens) == 0 {
+		return "", 0, ""
+	}
+	tenant := requestTenant(r)
+	if _, exists := tenantTokens[tenant]; tenant != "" && !exists {
+		return tenant, http.StatusNotFound, "Tenant not found"
+	}
+	if owner, ok := tokenTenant(r.Header); ok && owner != tenant {
+		return tenant, http.StatusForbidden, "Token is for another tenant"
+	}
+	return tenant, 0, ""
+}
+
+// shopperRoutes are the routes other than reads that a tenant's storefront
+// calls without a token, by method and route without the version prefix.
+// They read, or write what a shopper owns, such as a review.
+var shopperRoutes = map[string]bool{
+	"POST /products/batch-get":                true,
+	"POST /products/:id/validate":             true,
+	"POST /products/:id/reviews":              true,
+	"DELETE /products/:id/reviews/:review_id": true,
+	"POST /pricing/quote":                     true,
+	"POST /availability":                      true,
+	"POST /coupons/:code/redeem":              true,
+	"POST /analytics/events":                  true,
+	"POST /graphql":                           true,
+	"DELETE /async-jobs/:id":                  true,
+}
+
+// tenantWriteAllowed reports whether a request may write to a tenant's
+// catalog: it carries the tenant's token or the admin token, or it's a
+// read or a shopper's request. The default tenant's catalog is writable
+// as it was before tenants.
+func tenantWriteAllowed(c *gin.Context, tenant string) bool {
+	switch c.Request.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	// Unmatched requests are routed again under a version, or turned down
+	route := versionedPath.ReplaceAllString(c.FullPath(), "/")
+	return tenant == "" || c.FullPath() == "" || shopperRoutes[c.Request.Method+" "+route] || adminHeader(c.Request.Header, tenant)
+}
+
+// tenantScope resolves the tenant of each request, which every product
+// read and write is scoped to, keeps tenant tokens to their own tenant and
+// writes to a tenant's catalog to its token
+// Returns: 401 Unauthorized - A write to a tenant's catalog without its token
+// Returns: 403 Forbidden - The bearer token is another tenant's (Cat guarding its own bowl!)
+// Returns: 404 Not Found - No such tenant
+func tenantScope() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		tenant, status, msg := resolveTenant(c.Request)
+		if status == 0 && !tenantWriteAllowed(c, tenant) {
+			status, msg = http.StatusUnauthorized, "Writes to a tenant's catalog require its token"
+		}
+		if status != 0 {
+			c.AbortWithStatusJSON(status, gin.H{
+				"error":  msg,
+				"tenant": tenant,
+			})
+			return
+		}
+		c.Set(tenantContextKey, tenant)
+		c.Next()
+	}
+}
+
+// tokenTenant returns the tenant whose token the request carries
+func tokenTenant(header http.Header) (string, bool) {
+	token, found := bearerToken(header)
+	if !found {
+		return "", false
+	}
+	for tenant, tenantToken := range tenantTokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(tenantToken)) == 1 {
+			return tenant, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestProductKey(t *testing.T) {
+	tests := []struct {
+		tenant, id, key string
+	}{
+		{"", "laser", "laser"},
+		{"acme", "laser", "acme laser"},
+		{"acme", "a-b", "acme a-b"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			if got := productKey(tt.tenant, tt.id); got != tt.key {
+				t.Fatalf("productKey(%q, %q) = %q, want %q", tt.tenant, tt.id, got, tt.key)
+			}
+			if tenant, id := splitProductKey(tt.key); tenant != tt.tenant || id != tt.id {
+				t.Errorf("splitProductKey(%q) = %q, %q", tt.key, tenant, id)
+			}
+		})
+	}
+}
+
+func TestRequestTenant(t *testing.T) {
+	defer func(domain string) { tenantDomain = domain }(tenantDomain)
+	tenantDomain = "shop.example.com"
+
+	tests := []struct {
+		name, host, header, want string
+	}{
+		{"header", "shop.example.com", "Acme", "acme"},
+		{"header over subdomain", "globex.shop.example.com", "acme", "acme"},
+		{"subdomain", "acme.shop.example.com:8080", "", "acme"},
+		{"the domain itself", "shop.example.com", "", ""},
+		{"nested subdomain", "a.acme.shop.example.com", "", ""},
+		{"other domain", "acme.example.org", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/v1/products", nil)
+			r.Host = tt.host
+			if tt.header != "" {
+				r.Header.Set(tenantHeader, tt.header)
+			}
+			if got := requestTenant(r); got != tt.want {
+				t.Errorf("requestTenant = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTenantIsolation(t *testing.T) {
+	router := newTestRouter(t)
+	defer func(tokens map[string]string) { tenantTokens = tokens }(tenantTokens)
+	tenantTokens = map[string]string{"acme": "acme-token", "globex": "globex-token"}
+	laser := func(name string) string {
+		return `{"id": "laser", "name": "` + name + `", "description": "A laser", "price": "10.00", "currency": "USD", "stock": 1}`
+	}
+	acme := []string{tenantHeader, "acme"}
+	acmeToken := append([]string{"Authorization", "Bearer acme-token"}, acme...)
+	globexToken := []string{tenantHeader, "globex", "Authorization", "Bearer globex-token"}
+
+	writes := []struct {
+		name         string
+		method, path string
+		body         string
+		header       []string
+		status       int
+	}{
+		{"create without a token", "POST", "/v1/products", laser("Acme laser"), acme, http.StatusUnauthorized},
+		{"create with another tenant's token", "POST", "/v1/products", laser("Acme laser"), append([]string{"Authorization", "Bearer globex-token"}, acme...), http.StatusForbidden},
+		{"create with the tenant's token", "POST", "/v1/products", laser("Acme laser"), acmeToken, http.StatusCreated},
+		{"create in another tenant", "POST", "/v1/products", laser("Globex laser"), globexToken, http.StatusCreated},
+		{"create in the default tenant", "POST", "/v1/products", laser("Default laser"), nil, http.StatusCreated},
+		{"update without a token", "PUT", "/v1/products/laser", laser("Stolen laser"), acme, http.StatusUnauthorized},
+		{"patch without a token", "PATCH", "/v1/products/laser", `{"name": "Stolen laser"}`, acme, http.StatusUnauthorized},
+		{"delete without a token", "DELETE", "/v1/products/laser", "", acme, http.StatusUnauthorized},
+		{"batch get without a token", "POST", "/v1/products/batch-get", `{"ids": ["laser"]}`, acme, http.StatusOK},
+	}
+	for _, tt := range writes {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := serve(router, tt.method, tt.path, tt.body, tt.header...); w.Code != tt.status {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+		})
+	}
+
+	reads := []struct {
+		name   string
+		header []string
+		want   string
+	}{
+		{"acme", acme, "Acme laser"},
+		{"globex", []string{tenantHeader, "globex"}, "Globex laser"},
+		{"default", nil, "Default laser"},
+	}
+	for _, tt := range reads {
+		t.Run("read "+tt.name, func(t *testing.T) {
+			w := serve(router, "GET", "/v1/products/laser", "", tt.header...)
+			var got Product
+			if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil || got.Name != tt.want {
+				t.Errorf("got %d %s, want %s", w.Code, w.Body, tt.want)
+			}
+		})
+	}
+}
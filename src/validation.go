@@ -0,0 +1,377 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Field limits, in characters
+const (
+	maxIDLength          = 64
+	maxNameLength        = 100
+	maxDescriptionLength = 2000
+	maxCategoryLength    = 100
+	maxSKULength         = 64
+	maxAttributeLength   = 100
+	maxVariants          = 100
+	maxImages            = 20
+	maxImageURLLength    = 2048
+	maxBadges            = 10
+	maxBadgeLabelLength  = 32
+)
+
+// Violation codes
+const (
+	violationMalformed    = "malformed"
+	violationUnknownField = "unknown_field"
+	violationInvalidType  = "invalid_type"
+	violationRequired     = "required"
+	violationTooLong      = "too_long"
+	violationOutOfRange   = "out_of_range"
+	violationInvalid      = "invalid"
+	violationDuplicate    = "duplicate"
+	violationMismatch     = "mismatch"
+	violationTooLarge     = "too_large"
+	violationTooDeep      = "too_deep"
+)
+
+// problemValidation is the problem type of every validation failure
+const problemValidation = "urn:productstore:problem:validation"
+
+// Violation is one thing wrong with a request. Field is the JSON path of
+// the offending value, e.g. variants[1].sku, empty for the whole body.
+type Violation struct {
+	Code    string `json:"code"`
+	Field   string `json:"field"`
+	Message string `json:"message"`
+	Rule    string `json:"rule,omitempty"` // the product rule that failed, if it was one
+}
+
+// Problem is an RFC 9457 (formerly 7807) problem details body, sent as
+// application/problem+json. Error repeats the title for clients of the
+// older {"error": ...} bodies.
+type Problem struct {
+	Type     string      `json:"type"`
+	Title    string      `json:"title"`
+	Status   int         `json:"status"`
+	Detail   string      `json:"detail,omitempty"`
+	Instance string      `json:"instance,omitempty"`
+	Error    string      `json:"error"`
+	Errors   []Violation `json:"errors,omitempty"`
+}
+
+// invalidRequest writes a problem listing the violations
+// Returns: 400 Bad Request - application/problem+json with one entry per violation
+// Returns: 413 Content Too Large - Body over MAX_BODY_BYTES
+// Returns: 422 Unprocessable Entity - JSON nested deeper than MAX_JSON_DEPTH
+func invalidRequest(c *gin.Context, title string, violations []Violation) {
+	detail := violations[0].Message
+	if violations[0].Field != "" {
+		detail = violations[0].Field + ": " + detail
+	}
+	if len(violations) > 1 {
+		detail += fmt.Sprintf(" (and %d more)", len(violations)-1)
+	}
+	status := problemStatus(violations)
+	c.Render(status, problemRender{Problem{
+		Type:     problemValidation,
+		Title:    title,
+		Status:   status,
+		Detail:   detail,
+		Instance: c.Request.URL.Path,
+		Error:    title,
+		Errors:   violations,
+	}})
+}
+
+// problemRender renders a Problem with its content type
+type problemRender struct{ problem Problem }
+
+func (r problemRender) Render(w http.ResponseWriter) error {
+	r.WriteContentType(w)
+	return json.NewEncoder(w).Encode(r.problem)
+}
+
+func (r problemRender) WriteContentType(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/problem+json")
+}
+
+// violationSummary joins violations into one line, for the places that
+// report a single error string
+func violationSummary(violations []Violation) string {
+	parts := make([]string, len(violations))
+	for i, v := range violations {
+		parts[i] = v.Message
+		if v.Field != "" {
+			parts[i] = v.Field + ": " + v.Message
+		}
+	}
+	return strings.Join(parts, "; ")
+}
+
+// bindStrict decodes the request body into v, rejecting unknown fields
+func bindStrict(c *gin.Context, v any) []Violation {
+	body, err := io.ReadAll(c.Request.Body)
+	if isBodyTooLarge(err) {
+		return []Violation{bodyTooLarge()}
+	}
+	if err != nil {
+		return []Violation{{Code: violationMalformed, Message: "Request body could not be read"}}
+	}
+	return decodeStrict(body, v)
+}
+
+// decodeStrict decodes one JSON value into v, rejecting unknown fields,
+// trailing data and nesting deeper than MAX_JSON_DEPTH, and describes
+// what went wrong as violations
+func decodeStrict(data []byte, v any) []Violation {
+	if maxJSONDepth > 0 && jsonDepth(data, maxJSONDepth) > maxJSONDepth {
+		return []Violation{{Code: violationTooDeep, Message: fmt.Sprintf("JSON must nest at most %d levels deep", maxJSONDepth)}}
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(v)
+	if err == nil && dec.More() {
+		err = errors.New("unexpected data after the JSON value")
+	}
+	if err == nil {
+		return nil
+	}
+
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.Is(err, io.EOF):
+		return []Violation{{Code: violationMalformed, Message: "Request body is empty"}}
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return []Violation{{Code: violationMalformed, Message: "Request body is truncated"}}
+	case errors.As(err, &syntaxErr):
+		return []Violation{{Code: violationMalformed, Message: fmt.Sprintf("Invalid JSON at offset %d: %v", syntaxErr.Offset, syntaxErr)}}
+	case errors.As(err, &typeErr):
+		return []Violation{{Code: violationInvalidType, Field: jsonPath(typeErr.Field), Message: "Must be " + jsonTypeName(typeErr.Type.Kind().String())}}
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		field := strings.Trim(strings.TrimPrefix(err.Error(), "json: unknown field "), `"`)
+		return []Violation{{Code: violationUnknownField, Field: field, Message: "Unknown field"}}
+	}
+	// Errors of custom types such as Money
+	return []Violation{{Code: violationInvalid, Message: err.Error()}}
+}
+
+// jsonPath turns encoding/json's "variants.1.sku" into "variants[1].sku"
+func jsonPath(field string) string {
+	var b strings.Builder
+	for i, part := range strings.Split(field, ".") {
+		switch {
+		case part != "" && strings.Trim(part, "0123456789") == "":
+			b.WriteString("[" + part + "]")
+		case i > 0:
+			b.WriteString("." + part)
+		default:
+			b.WriteString(part)
+		}
+	}
+	return b.String()
+}
+
+// jsonTypeName names a Go kind the way a JSON client would
+func jsonTypeName(kind string) string {
+	switch {
+	case strings.HasPrefix(kind, "int"), strings.HasPrefix(kind, "uint"):
+		return "an integer"
+	case strings.HasPrefix(kind, "float"):
+		return "a number"
+	case kind == "string":
+		return "a string"
+	case kind == "bool":
+		return "a boolean"
+	case kind == "slice", kind == "array":
+		return "an array"
+	}
+	return "an object"
+}
+
+// normalizeText trims a string and reports a violation when it's too
+// long or holds control characters
+func normalizeText(s *string, field string, limit int, violations *[]Violation) {
+	*s = strings.TrimSpace(*s)
+	switch {
+	case utf8.RuneCountInString(*s) > limit:
+		*violations = append(*violations, Violation{Code: violationTooLong, Field: field, Message: fmt.Sprintf("Must be at most %d characters", limit)})
+	case strings.ContainsFunc(*s, func(r rune) bool { return unicode.IsControl(r) && r != '\n' && r != '\t' }):
+		*violations = append(*violations, Violation{Code: violationInvalid, Field: field, Message: "Must not contain control characters"})
+	}
+}
+
+// productViolations normalizes a product, trimming its strings and
+// upper-casing its currency, and returns everything wrong with it, the
+// product rules included. It's used for every write of a whole product:
+// creates, updates, patches, batches and imports. Catalog rules need the
+// store and are run by the writes themselves, with catalogViolations.
+func productViolations(p *Product) []Violation {
+	var violations []Violation
+	add := func(code, field, message string) {
+		violations = append(violations, Violation{Code: code, Field: field, Message: message})
+	}
+
+	normalizeText(&p.ID, "id", maxIDLength, &violations)
+	switch {
+	case p.ID == "":
+		add(violationRequired, "id", "Is required")
+	case strings.ContainsFunc(p.ID, unicode.IsSpace):
+		add(violationInvalid, "id", "Must not contain whitespace")
+	}
+	normalizeText(&p.Name, "name", maxNameLength, &violations)
+	if p.Name == "" {
+		add(violationRequired, "name", "Is required")
+	}
+	normalizeText(&p.Description, "description", maxDescriptionLength, &violations)
+	normalizeText(&p.Category, "category", maxCategoryLength, &violations)
+
+	switch {
+	case p.Price == 0:
+		add(violationRequired, "price", "Is required")
+	case p.Price < 0:
+		add(violationOutOfRange, "price", "Must be greater than 0")
+	case p.Price > maxPrice:
+		add(violationOutOfRange, "price", fmt.Sprintf("Must be at most %s", maxPrice))
+	}
+	normalizeCurrency(p)
+	if !validCurrency(p.Currency) {
+		add(violationInvalid, "currency", "Must be an ISO 4217 code")
+	}
+	if p.Stock < 0 {
+		add(violationOutOfRange, "stock", "Must not be negative")
+	}
+	if p.LowStockThreshold != nil && *p.LowStockThreshold < 0 {
+		add(violationOutOfRange, "low_stock_threshold", "Must not be negative")
+	}
+	if p.RolloutPercent != nil && (*p.RolloutPercent < 0 || *p.RolloutPercent > 100) {
+		add(violationOutOfRange, "rollout_percent", "Must be between 0 and 100")
+	}
+
+	normalizeText(&p.SKU, "sku", maxSKULength, &violations)
+	if p.SKU != "" && len(p.Variants) > 0 {
+		add(violationInvalid, "sku", "Products with variants have a SKU per variant")
+	}
+	p.GTIN = strings.TrimSpace(p.GTIN)
+	if p.GTIN != "" && !validGTIN(p.GTIN) {
+		add(violationInvalid, "gtin", "Must be a GTIN-8, 12, 13 or 14 with a valid check digit")
+	}
+	if p.WeightGrams < 0 {
+		add(violationOutOfRange, "weight_grams", "Must not be negative")
+	}
+	if len(p.Images) > maxImages {
+		add(violationOutOfRange, "images", fmt.Sprintf("Must have at most %d images", maxImages))
+	}
+	for i := range p.Images {
+		p.Images[i] = strings.TrimSpace(p.Images[i])
+		u, err := url.Parse(p.Images[i])
+		switch {
+		case len(p.Images[i]) > maxImageURLLength:
+			add(violationTooLong, fmt.Sprintf("images[%d]", i), fmt.Sprintf("Must be at most %d characters", maxImageURLLength))
+		case err != nil || u.Scheme != "http" && u.Scheme != "https" || u.Host == "":
+			add(violationInvalid, fmt.Sprintf("images[%d]", i), "Must be an http or https URL")
+		}
+	}
+
+	badgeViolations(p, &violations)
+	relatedViolations(p, &violations)
+	scheduleViolations(p, &violations)
+	translationViolations(p, &violations)
+
+	if len(p.Variants) > maxVariants {
+		add(violationOutOfRange, "variants", fmt.Sprintf("Must have at most %d variants", maxVariants))
+	}
+	barcodes := make(map[string]bool, len(p.Variants)+1)
+	if p.GTIN != "" {
+		barcodes[normalizeGTIN(p.GTIN)] = true
+	}
+	for i := range p.Variants {
+		prefix := fmt.Sprintf("variants[%d]", i)
+		violations = append(violations, variantViolations(p, &p.Variants[i], prefix)...)
+		if gtin := p.Variants[i].GTIN; gtin != "" {
+			if barcodes[normalizeGTIN(gtin)] {
+				add(violationDuplicate, prefix+".gtin", fmt.Sprintf("Duplicate GTIN %q", gtin))
+			}
+			barcodes[normalizeGTIN(gtin)] = true
+		}
+	}
+	return append(violations, runRules(ruleScopeProduct, p, nil)...)
+}
+
+// validGTIN checks the length and check digit of a GTIN (EAN/UPC)
+func validGTIN(gtin string) bool {
+	switch len(gtin) {
+	case 8, 12, 13, 14:
+	default:
+		return false
+	}
+	sum := 0
+	for i := len(gtin) - 1; i >= 0; i-- {
+		d := int(gtin[i] - '0')
+		if d < 0 || d > 9 {
+			return false
+		}
+		// Weights alternate 3, 1 from the digit left of the check digit
+		if (len(gtin)-1-i)%2 == 1 {
+			d *= 3
+		}
+		sum += d
+	}
+	return sum%10 == 0
+}
+
+// variantViolations normalizes a variant of p and returns everything wrong
+// with it, with fields under prefix
+func variantViolations(p *Product, v *Variant, prefix string) []Violation {
+	var violations []Violation
+	field := func(name string) string {
+		if prefix == "" {
+			return name
+		}
+		return prefix + "." + name
+	}
+
+	normalizeText(&v.SKU, field("sku"), maxSKULength, &violations)
+	if v.SKU == "" {
+		violations = append(violations, Violation{Code: violationRequired, Field: field("sku"), Message: "Is required"})
+	}
+	v.GTIN = strings.TrimSpace(v.GTIN)
+	if v.GTIN != "" && !validGTIN(v.GTIN) {
+		violations = append(violations, Violation{Code: violationInvalid, Field: field("gtin"), Message: "Must be a GTIN-8, 12, 13 or 14 with a valid check digit"})
+	}
+	if v.Stock < 0 {
+		violations = append(violations, Violation{Code: violationOutOfRange, Field: field("stock"), Message: "Must not be negative"})
+	}
+	switch {
+	case p.Price > 0 && p.variantPrice(*v) <= 0:
+		violations = append(violations, Violation{Code: violationOutOfRange, Field: field("price_delta"), Message: "Variant price must be greater than 0"})
+	case p.Price <= maxPrice && p.variantPrice(*v) > maxPrice:
+		violations = append(violations, Violation{Code: violationOutOfRange, Field: field("price_delta"), Message: fmt.Sprintf("Variant price must be at most %s", maxPrice)})
+	case p.SalePrice != nil && *p.SalePrice > 0 && *p.SalePrice+v.PriceDelta <= 0:
+		violations = append(violations, Violation{Code: violationOutOfRange, Field: field("price_delta"), Message: "Variant sale price must be greater than 0"})
+	}
+	if len(v.Attributes) > 0 {
+		attributes := make(map[string]string, len(v.Attributes))
+		for name, value := range v.Attributes {
+			name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+			if name == "" || utf8.RuneCountInString(name) > maxAttributeLength || utf8.RuneCountInString(value) > maxAttributeLength {
+				violations = append(violations, Violation{Code: violationInvalid, Field: field("attributes"), Message: fmt.Sprintf("Names must be 1 to %d characters and values at most %d", maxAttributeLength, maxAttributeLength)})
+				break
+			}
+			attributes[name] = value
+		}
+		v.Attributes = attributes
+	}
+	return violations
+}
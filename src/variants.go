@@ -0,0 +1,343 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Variant represents a purchasable option of a product (e.g. size/color).
+// Each variant has its own SKU and stock; its price is the parent product
+// price plus PriceDelta.
+type Variant struct {
+	SKU        string            `json:"sku"`
+	GTIN       string            `json:"gtin,omitempty"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	PriceDelta Money             `json:"price_delta"`
+	Stock      int               `json:"stock"`
+}
+
+// StockAdjustment is the request body for stock operations
+type StockAdjustment struct {
+	SKU    string `json:"sku"`
+	Delta  int    `json:"delta" binding:"required"`
+	Reason string `json:"reason" binding:"omitempty,oneof=restock sale return damage correction"`
+	Note   string `json:"note" binding:"max=200"`
+}
+
+// variantIndex returns the position of the variant with the given SKU, or -1
+func (p *Product) variantIndex(sku string) int {
+	for i, v := range p.Variants {
+		if v.SKU == sku {
+			return i
+		}
+	}
+	return -1
+}
+
+// variantPrice returns the effective price of a variant
+func (p *Product) variantPrice(v Variant) Money {
+	return p.Price + v.PriceDelta
+}
+
+// syncVariantStock keeps the product stock equal to the total variant stock.
+// Products without variants keep their own stock untouched.
+func syncVariantStock(p *Product) {
+	if len(p.Variants) == 0 {
+		return
+	}
+	total := 0
+	for _, v := range p.Variants {
+		total += v.Stock
+	}
+	p.Stock = total
+}
+
+// variantResponse adds the effective price to a variant
+func variantResponse(p Product, v Variant) gin.H {
+	response := gin.H{
+		"sku":         v.SKU,
+		"attributes":  v.Attributes,
+		"price_delta": v.PriceDelta,
+		"price":       p.variantPrice(v),
+		"stock":       v.Stock,
+	}
+	if v.GTIN != "" {
+		response["gtin"] = v.GTIN
+	}
+	return response
+}
+
+// productNotFound writes the standard 404 response for a missing product
+func productNotFound(c *gin.Context, id string) {
+	c.JSON(http.StatusNotFound, gin.H{
+		"error": "Product not found",
+		"id":    id,
+	})
+}
+
+// variantNotFound writes the standard 404 response for a missing variant
+func variantNotFound(c *gin.Context, id, sku string) {
+	c.JSON(http.StatusNotFound, gin.H{
+		"error": "Variant not found",
+		"id":    id,
+		"sku":   sku,
+	})
+}
+
+// getVariants returns all variants of a product
+// Returns: 200 OK - Success
+// Returns: 404 Not Found - Product doesn't exist
+func getVariants(c *gin.Context) {
+	id := c.Param("id")
+
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	product, exists := store.getShown(c, id)
+	if !exists {
+		productNotFound(c, id)
+		return
+	}
+
+	variants := make([]gin.H, 0, len(product.Variants))
+	for _, v := range product.Variants {
+		variants = append(variants, variantResponse(product, v))
+	}
+
+	c.Header("ETag", productETag(product))
+	c.JSON(http.StatusOK, gin.H{
+		"count":    len(variants),
+		"variants": variants,
+	})
+}
+
+// getVariantBySKU returns a single variant of a product
+// Returns: 200 OK - Found
+// Returns: 404 Not Found - Product or variant doesn't exist
+func getVariantBySKU(c *gin.Context) {
+	id, sku := c.Param("id"), c.Param("sku")
+
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	product, exists := store.getShown(c, id)
+	if !exists {
+		productNotFound(c, id)
+		return
+	}
+
+	i := product.variantIndex(sku)
+	if i < 0 {
+		variantNotFound(c, id, sku)
+		return
+	}
+
+	c.Header("ETag", productETag(product))
+	c.JSON(http.StatusOK, variantResponse(product, product.Variants[i]))
+}
+
+// createVariant adds a new variant to a product
+// Returns: 201 Created - Success
+// Returns: 400 Bad Request - Invalid input
+// Returns: 404 Not Found - Product doesn't exist
+// Returns: 409 Conflict - Variant SKU already exists, or another product has the SKU or barcode
+func createVariant(c *gin.Context) {
+	id := c.Param("id")
+
+	var newVariant Variant
+	if violations := bindStrict(c, &newVariant); violations != nil {
+		invalidRequest(c, "Invalid variant data", violations)
+		return
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	product, exists := store.get(tenantKey(c, id))
+	if !exists {
+		productNotFound(c, id)
+		return
+	}
+
+	violations := variantViolations(&product, &newVariant, "")
+	if len(product.Variants) >= maxVariants {
+		violations = append(violations, Violation{Code: violationOutOfRange, Field: "sku", Message: fmt.Sprintf("Product already has %d variants, the most allowed", maxVariants)})
+	}
+	if len(violations) > 0 {
+		invalidRequest(c, "Invalid variant data", violations)
+		return
+	}
+
+	before := product
+	if product.variantIndex(newVariant.SKU) >= 0 {
+		c.JSON(http.StatusConflict, gin.H{
+			"error": "Variant with this SKU already exists",
+			"id":    id,
+			"sku":   newVariant.SKU,
+		})
+		return
+	}
+
+	// Copy the slice so readers holding the old product are unaffected
+	product.Variants = append(append([]Variant(nil), product.Variants...), newVariant)
+	if violations := codes.conflicts(&product); len(violations) > 0 {
+		codeConflict(c, violations)
+		return
+	}
+	if err := store.save(&product); err != nil {
+		writeFailed(c, err)
+		return
+	}
+	audit.record(c, "variant.create", &before, &product)
+	c.Header("ETag", productETag(product))
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message": "Variant created successfully",
+		"variant": variantResponse(product, newVariant),
+	})
+}
+
+// updateVariant replaces an existing variant
+// Requires: If-Match header with the product's current ETag
+// Returns: 200 OK - Success
+// Returns: 400 Bad Request - Invalid input
+// Returns: 404 Not Found - Product or variant doesn't exist
+// Returns: 409 Conflict - Another product has the barcode
+// Returns: 412 Precondition Failed - Stale ETag
+// Returns: 428 Precondition Required - Missing If-Match
+func updateVariant(c *gin.Context) {
+	id, sku := c.Param("id"), c.Param("sku")
+
+	var variant Variant
+	if violations := bindStrict(c, &variant); violations != nil {
+		invalidRequest(c, "Invalid variant data", violations)
+		return
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	product, exists := store.get(tenantKey(c, id))
+	if !exists {
+		productNotFound(c, id)
+		return
+	}
+	if !checkIfMatch(c, product) {
+		return
+	}
+
+	i := product.variantIndex(sku)
+	if i < 0 {
+		variantNotFound(c, id, sku)
+		return
+	}
+	before := product
+
+	violations := variantViolations(&product, &variant, "")
+	if variant.SKU != sku {
+		violations = append(violations, Violation{Code: violationMismatch, Field: "sku", Message: "Must match the SKU in the URL"})
+	}
+	if stockLedgerOnly && variant.Stock != product.Variants[i].Stock {
+		violations = append(violations, Violation{Code: violationInvalid, Field: "stock", Message: "Is changed with POST /products/{id}/stock-adjustments"})
+	}
+	if len(violations) > 0 {
+		invalidRequest(c, "Invalid variant data", violations)
+		return
+	}
+
+	product.Variants = append([]Variant(nil), product.Variants...)
+	product.Variants[i] = variant
+	if violations := codes.conflicts(&product); len(violations) > 0 {
+		codeConflict(c, violations)
+		return
+	}
+	if err := store.save(&product); err != nil {
+		writeFailed(c, err)
+		return
+	}
+	audit.record(c, "variant.update", &before, &product)
+	c.Header("ETag", productETag(product))
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Variant updated successfully",
+		"variant": variantResponse(product, variant),
+	})
+}
+
+// deleteVariant removes a variant from a product
+// Requires: If-Match header with the product's current ETag
+// Returns: 204 No Content - Success
+// Returns: 404 Not Found - Product or variant doesn't exist
+// Returns: 412 Precondition Failed - Stale ETag
+// Returns: 428 Precondition Required - Missing If-Match
+func deleteVariant(c *gin.Context) {
+	id, sku := c.Param("id"), c.Param("sku")
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	product, exists := store.get(tenantKey(c, id))
+	if !exists {
+		productNotFound(c, id)
+		return
+	}
+	if !checkIfMatch(c, product) {
+		return
+	}
+
+	i := product.variantIndex(sku)
+	if i < 0 {
+		variantNotFound(c, id, sku)
+		return
+	}
+
+	before := product
+	variants := make([]Variant, 0, len(product.Variants)-1)
+	variants = append(variants, product.Variants[:i]...)
+	product.Variants = append(variants, product.Variants[i+1:]...)
+	if len(product.Variants) == 0 {
+		// Last variant gone, the product no longer has stock of its own
+		product.Variants = nil
+		product.Stock = 0
+	}
+	if err := store.save(&product); err != nil {
+		writeFailed(c, err)
+		return
+	}
+	audit.record(c, "variant.delete", &before, &product)
+	c.Header("ETag", productETag(product))
+
+	c.Status(http.StatusNoContent)
+}
+
+// adjustProductStock changes stock by a delta. Products with variants
+// require a SKU so the change is applied to the right variant. The reason
+// is correction unless given; POST /products/:id/stock-adjustments is the
+// same with the ledger entry in the response.
+// Returns: 200 OK - Success
+// Returns: 400 Bad Request - Invalid input or missing SKU
+// Returns: 404 Not Found - Product or variant doesn't exist
+// Returns: 409 Conflict - Not enough stock
+func adjustProductStock(c *gin.Context) {
+	id := c.Param("id")
+
+	var adj StockAdjustment
+	if err := c.ShouldBindJSON(&adj); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":   "Invalid stock adjustment",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	product, _, ok := adjustStock(c, id, adj)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, product)
+}
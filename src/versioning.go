@@ -0,0 +1,219 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// apiVersions maps each API version to the function registering its routes.
+// A version with breaking response shapes (v2) gets its own register
+// function and handlers, while both share the store and helpers.
+var apiVersions = map[string]func(r gin.IRouter){
+	"v1": registerV1Routes,
+	"v2": registerV2Routes,
+}
+
+// defaultAPIVersion serves unversioned requests that don't ask for one
+const defaultAPIVersion = "v1"
+
+// versionMediaType matches Accept: application/vnd.productstore.v1+json
+var versionMediaType = regexp.MustCompile(`application/vnd\.productstore\.(v\d+)\+json`)
+
+// versionedPath matches paths that already carry a version
+var versionedPath = regexp.MustCompile(`^/v\d+(/|$)`)
+
+// apiVersionHeader tells clients which version served the response
+func apiVersionHeader(version string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("API-Version", version)
+		c.Next()
+	}
+}
+
+// unversionedRoute keeps unversioned paths working: /products is served as
+// /v1/products, or as the version asked for in the Accept header.
+// Returns: 404 Not Found - No such route
+// Returns: 406 Not Acceptable - Accept asks for an unknown version
+func unversionedRoute(router *gin.Engine) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if versionedPath.MatchString(c.Request.URL.Path) {
+			c.JSON(http.StatusNotFound, gin.H{
+				"error": "Route not found",
+				"path":  c.Request.URL.Path,
+			})
+			return
+		}
+
+		version := defaultAPIVersion
+		if m := versionMediaType.FindStringSubmatch(c.GetHeader("Accept")); m != nil {
+			version = m[1]
+		}
+		if _, exists := apiVersions[version]; !exists {
+			c.JSON(http.StatusNotAcceptable, gin.H{
+				"error":   "Unsupported API version",
+				"version": version,
+			})
+			return
+		}
+
+		// Route again under the version, keeping the request ID
+		addVary(c, "Accept")
+		c.Request.Header.Set("X-Request-ID", c.GetString(requestIDKey))
+		c.Request.URL.Path = "/" + version + strings.TrimSuffix(c.Request.URL.Path, "/")
+		router.HandleContext(c)
+	}
+}
+
+// registerV1Routes registers the v1 API
+func registerV1Routes(r gin.IRouter) {
+	// Product routes
+	r.GET("/products", shadowCompare(), getProducts)
+	r.GET("/products/low-stock", getLowStockProducts)
+	r.GET("/products/suggest", suggestProducts)
+	r.GET("/products/by-sku/:sku", shadowCompare(), getProductBySKU)
+	r.GET("/products/by-barcode/:code", getProductByBarcode)
+	r.GET("/products/stream", streamProducts)
+	r.GET("/products/:id", shadowCompare(), getProductByID)
+	r.POST("/products", idempotent(), createProduct)
+	r.POST("/products/batch-get", batchGetProducts)
+	r.POST("/products/batch", idempotent(), batchUpsertProducts)
+	r.PUT("/products/:id", updateProduct)
+	r.PATCH("/products/:id", patchProduct)
+	r.DELETE("/products/:id", deleteProduct)
+	r.POST("/products/:id/restore", restoreProduct)
+	r.GET("/products/:id/audit", requireAdmin(), getProductAudit)
+	r.GET("/products/:id/metrics", getProductMetrics)
+	r.GET("/products/:id/full", getProductFull)
+	r.GET("/products/:id/related", requireFlag(flagRelatedProducts), getRelatedProducts)
+	r.POST("/products/:id/validate", validateProduct)
+	r.GET("/products/:id/translations", requireAdmin(), getTranslations)
+	r.PUT("/products/:id/translations/:locale", requireAdmin(), putTranslation)
+	r.DELETE("/products/:id/translations/:locale", requireAdmin(), deleteTranslation)
+	r.GET("/validation-profiles", getValidationProfiles)
+	r.GET("/badge-rules", getBadgeRules)
+	r.GET("/product-rules", getProductRules)
+	r.POST("/analytics/events", ingestAnalyticsEvents)
+
+	// Review routes
+	r.GET("/products/:id/reviews", requireFlag(flagReviews), getReviews)
+	r.POST("/products/:id/reviews", requireFlag(flagReviews), createReview)
+	r.DELETE("/products/:id/reviews/:review_id", requireFlag(flagReviews), deleteReview)
+
+	// Category deletions
+	r.POST("/categories/:name/deletions", requestCategoryDeletion)
+	r.GET("/category-deletions", requireAdmin(), getCategoryDeletions)
+	r.GET("/category-deletions/:id", getCategoryDeletion)
+	r.POST("/category-deletions/:id/approve", requireAdmin(), approveCategoryDeletion)
+	r.POST("/category-deletions/:id/reject", requireAdmin(), rejectCategoryDeletion)
+
+	// Coupons and pricing
+	r.GET("/coupons", requireOperator(), getCoupons)
+	r.GET("/coupons/:code", getCouponByCode)
+	r.POST("/coupons", requireOperator(), createCoupon)
+	r.DELETE("/coupons/:code", requireOperator(), deleteCoupon)
+	r.POST("/coupons/:code/redeem", idempotent(), redeemCoupon)
+	r.POST("/pricing/quote", quoteBasket)
+	r.POST("/availability", checkAvailability)
+	r.GET("/products/:id/price", explainPrice)
+
+	// Webhooks
+	r.GET("/webhooks", requireOperator(), getWebhooks)
+	r.GET("/webhooks/:id", requireOperator(), getWebhook)
+	r.POST("/webhooks", requireOperator(), createWebhook)
+	r.DELETE("/webhooks/:id", requireOperator(), deleteWebhook)
+	r.GET("/webhooks/:id/deliveries", requireOperator(), getWebhookDeliveries)
+
+	// Async jobs, for requests made with "Prefer: respond-async"
+	r.GET("/async-jobs/:id", getAsyncJob)
+	r.GET("/async-jobs/:id/result", getAsyncJobResult)
+	r.DELETE("/async-jobs/:id", deleteAsyncJob)
+
+	// Feature flags
+	r.GET("/flags", getFlags)
+
+	// Currency conversion
+	r.GET("/currency/convert", convertCurrency)
+
+	// GraphQL
+	r.GET("/graphql", serveGraphQL)
+	r.POST("/graphql", serveGraphQL)
+	r.GET("/graphql/schema", getGraphQLSchema)
+
+	// Operational view
+	r.GET("/admin/system", requireOperator(), getSystemStatus)
+	r.GET("/admin/reports/dead-stock", requireAdmin(), getDeadStockReport)
+	r.GET("/admin/reports/valuation", requireAdmin(), getValuationReport)
+	r.GET("/admin/reports/margins", requireAdmin(), getMarginReport)
+	r.GET("/admin/reports/inventory-value", requireAdmin(), getInventoryValueReport)
+	r.GET("/admin/reports/top-products", requireAdmin(), getTopProductsReport)
+	r.GET("/admin/reports/stock-movements", requireAdmin(), getStockMovementsReport)
+
+	// Catalog export and import
+	r.GET("/admin/export", requireAdmin(), exportProducts)
+	r.POST("/admin/import", requireAdmin(), importProducts)
+	r.GET("/admin/import-mappings", requireAdmin(), getImportMappings)
+	r.GET("/admin/import-mappings/:name", requireAdmin(), getImportMapping)
+	r.PUT("/admin/import-mappings/:name", requireOperator(), putImportMapping)
+	r.DELETE("/admin/import-mappings/:name", requireOperator(), deleteImportMapping)
+
+	// Find and replace
+	r.GET("/admin/replace-jobs", requireAdmin(), getReplaceJobs)
+	r.GET("/admin/replace-jobs/:id", requireAdmin(), getReplaceJob)
+	r.POST("/admin/replace-jobs", requireAdmin(), createReplaceJob)
+	r.POST("/admin/replace-jobs/:id/apply", requireAdmin(), applyReplaceJob)
+	r.POST("/admin/replace-jobs/:id/rollback", requireAdmin(), rollbackReplaceJob)
+
+	// Catalog backups
+	r.GET("/admin/backups", requireOperator(), getBackups)
+	r.POST("/admin/backups", requireOperator(), createBackup)
+	r.POST("/admin/backups/:name/restore", requireOperator(), restoreBackup)
+
+	// Route policies
+	r.GET("/admin/route-policies", requireOperator(), getRoutePolicies)
+	r.POST("/admin/route-policies/reload", requireOperator(), reloadRoutePoliciesNow)
+	r.GET("/admin/flags", requireOperator(), getAdminFlags)
+
+	// Fault injection, only in builds tagged chaos
+	registerChaosRoutes(r)
+
+	// Data retention
+	r.GET("/admin/retention", requireOperator(), getRetentionReport)
+	r.POST("/admin/retention/run", requireOperator(), runRetentionNow)
+
+	// Catalog snapshots
+	r.GET("/admin/snapshots", requireOperator(), getSnapshots)
+	r.POST("/admin/snapshots", requireOperator(), createSnapshot)
+	r.DELETE("/admin/snapshots/:name", requireOperator(), deleteSnapshot)
+
+	// Kill switch
+	r.POST("/admin/products/:id/suspend", requireAdmin(), suspendProduct)
+	r.POST("/admin/products/:id/unsuspend", requireAdmin(), unsuspendProduct)
+
+	// Shadow comparison with the legacy catalog
+	r.GET("/admin/shadow", requireOperator(), getShadowReport)
+	r.POST("/admin/shadow/reset", requireOperator(), resetShadowReport)
+
+	// Event outbox
+	r.GET("/admin/outbox", requireOperator(), getOutbox)
+
+	// Sealed audit segments
+	r.GET("/audit/segments", requireOperator(), getSealedSegments)
+	r.GET("/audit/segments/:name", requireOperator(), getSealedSegment)
+
+	// Stock and inventory
+	r.POST("/products/:id/stock", idempotent(), adjustProductStock)
+	r.GET("/products/:id/stock-adjustments", requireAdmin(), getStockAdjustments)
+	r.POST("/products/:id/stock-adjustments", idempotent(), createStockAdjustment)
+	r.GET("/products/:id/receipts", requireAdmin(), getReceipts)
+	r.POST("/products/:id/receipts", requireAdmin(), idempotent(), createReceipt)
+
+	// Variant routes
+	r.GET("/products/:id/variants", getVariants)
+	r.GET("/products/:id/variants/:sku", getVariantBySKU)
+	r.POST("/products/:id/variants", idempotent(), createVariant)
+	r.PUT("/products/:id/variants/:sku", updateVariant)
+	r.DELETE("/products/:id/variants/:sku", deleteVariant)
+}
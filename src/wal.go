@@ -0,0 +1,421 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// WAL operations
+const (
+	walPut       = "put"
+	walDelete    = "delete"
+	walOutbox    = "outbox"    // outbox messages carried over by compaction
+	walDelivered = "delivered" // outbox messages sent
+)
+
+// walRecord is one product write in the log, with the outbox messages of
+// its event
+type walRecord struct {
+	Op        string          `json:"op"`
+	ID        string          `json:"id,omitempty"` // the product's key, see productKey
+	Product   *Product        `json:"product,omitempty"`
+	Stock     []StockEntry    `json:"stock,omitempty"` // the ledger entries of a put
+	Outbox    []OutboxMessage `json:"outbox,omitempty"`
+	Delivered []int64         `json:"delivered,omitempty"`
+}
+
+// WriteAheadLog makes the in-memory store survive restarts and crashes.
+// Every write is appended to products.wal before the request returns;
+// compaction writes every product to products.snapshot and starts a new,
+// empty log. On start the snapshot is loaded and the log replayed.
+//
+// Each line is "<crc32> <json>", so a record torn by a crash is detected and
+// dropped, along with anything after it. Only products and the outbox are
+// logged; reviews, coupons and the audit trail stay in memory.
+type WriteAheadLog struct {
+	dir       string
+	syncEvery time.Duration // 0 syncs every record
+
+	mu     sync.Mutex
+	file   *os.File
+	buf    *bufio.Writer
+	size   int64
+	dirty  bool
+	failed error // the first write or sync that failed; every one after fails too
+}
+
+// walDir enables the WAL, WAL_DIR
+var walDir = os.Getenv("WAL_DIR")
+
+func (w *WriteAheadLog) walPath() string      { return filepath.Join(w.dir, "products.wal") }
+func (w *WriteAheadLog) snapshotPath() string { return filepath.Join(w.dir, "products.snapshot") }
+
+// recoverFromWAL replaces the store content with what's on disk, then
+// compacts so the log starts empty. On a first start there's nothing on
+// disk and the store starts empty, for seeding to fill.
+func (s *ProductStore) recoverFromWAL(dir string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	w := &WriteAheadLog{
+		dir:       dir,
+		syncEvery: envDuration("WAL_SYNC_INTERVAL", 0),
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+
+	products, ledgers, pending, found, err := w.load()
+	if err != nil {
+		return err
+	}
+	outbox.add(pending)
+	if found {
+		s.products = products
+		stockLedger.restore(products, ledgers)
+		codes.rebuild(products)
+		suggestions.rebuild(products)
+		s.recovered = true
+		log.Printf("wal: recovered %d products from %s", len(products), dir)
+	}
+	if err := w.compact(s.products); err != nil {
+		return err
+	}
+	s.wal = w
+	return nil
+}
+
+// load reads the snapshot and replays the log over it. It returns the
+// stock ledgers and the outbox messages that weren't delivered too.
+func (w *WriteAheadLog) load() (map[string]Product, map[string][]StockEntry, []OutboxMessage, bool, error) {
+	products := make(map[string]Product)
+	ledgers := make(map[string][]StockEntry)
+	var pending []OutboxMessage
+	found := false
+
+	snapshot, err := os.Open(w.snapshotPath())
+	switch {
+	case err == nil:
+		found = true
+		dec := json.NewDecoder(snapshot)
+		for {
+			var p LedgeredProduct
+			if err := dec.Decode(&p); err == io.EOF {
+				break
+			} else if err != nil {
+				snapshot.Close()
+				return nil, nil, nil, false, fmt.Errorf("wal: reading snapshot: %w", err)
+			}
+			products[p.key()] = p.Product
+			if len(p.StockLedger) > 0 {
+				ledgers[p.key()] = p.StockLedger
+			}
+		}
+		snapshot.Close()
+	case !errors.Is(err, os.ErrNotExist):
+		return nil, nil, nil, false, err
+	}
+
+	file, err := os.Open(w.walPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return products, ledgers, pending, found, nil
+	}
+	if err != nil {
+		return nil, nil, nil, false, err
+	}
+	defer file.Close()
+	found = true
+
+	reader := bufio.NewReader(file)
+	replayed := 0
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			break
+		}
+		rec, ok := parseWALLine(line)
+		if err != nil || !ok {
+			// A crash mid-write leaves a torn last record; nothing after
+			// it was acknowledged
+			log.Printf("wal: dropping torn record after %d records", replayed)
+			break
+		}
+		switch rec.Op {
+		case walPut:
+			products[rec.ID] = *rec.Product
+			ledgers[rec.ID] = append(ledgers[rec.ID], rec.Stock...)
+		case walDelete:
+			delete(products, rec.ID)
+			delete(ledgers, rec.ID)
+		case walDelivered:
+			pending = slices.DeleteFunc(pending, func(m OutboxMessage) bool { return slices.Contains(rec.Delivered, m.Seq) })
+		}
+		pending = append(pending, rec.Outbox...)
+		replayed++
+	}
+	return products, ledgers, pending, found, nil
+}
+
+// parseWALLine checks the checksum of a line and decodes it
+func parseWALLine(line []byte) (walRecord, bool) {
+	var rec walRecord
+	sum, payload, ok := bytes.Cut(bytes.TrimSuffix(line, []byte("\n")), []byte(" "))
+	if !ok || len(line) == 0 || line[len(line)-1] != '\n' {
+		return rec, false
+	}
+	if walChecksum(payload) != string(sum) {
+		return rec, false
+	}
+	if json.Unmarshal(payload, &rec) != nil || (rec.Op == walPut && rec.Product == nil) {
+		return rec, false
+	}
+	return rec, true
+}
+
+func walChecksum(payload []byte) string {
+	return fmt.Sprintf("%08x", crc32.ChecksumIEEE(payload))
+}
+
+// append logs one write, and returns once it's on disk, or buffered with
+// WAL_SYNC_INTERVAL. Callers must hold store.mu, which keeps the log in the
+// same order as the writes, and apply the write only if it succeeds.
+// Outbox deliveries are logged without it, as their order doesn't matter.
+//
+// After a failure the log can't tell what of the record reached the disk,
+// so it takes no more writes: every one after fails too, and readiness
+// reports the WAL down, until a restart recovers from what's on disk.
+func (w *WriteAheadLog) append(rec walRecord) error {
+	start := time.Now()
+	err := w.write(rec)
+	walDependency.observe(start, err)
+	if err != nil {
+		log.Printf("wal: appending %s %s: %v", rec.Op, rec.ID, err)
+	}
+	return err
+}
+
+func (w *WriteAheadLog) write(rec walRecord) error {
+	line, err := walLine(rec)
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.failed != nil {
+		return w.failed
+	}
+	if _, err := w.buf.Write(line); err != nil {
+		return w.fail(err)
+	}
+	w.size += int64(len(line))
+	if w.syncEvery > 0 {
+		w.dirty = true
+		return nil
+	}
+	if err := w.buf.Flush(); err != nil {
+		return w.fail(err)
+	}
+	if err := w.file.Sync(); err != nil {
+		return w.fail(err)
+	}
+	return nil
+}
+
+// fail stops the log taking writes. Callers must hold w.mu.
+func (w *WriteAheadLog) fail(err error) error {
+	w.failed = fmt.Errorf("wal: %w", err)
+	return w.failed
+}
+
+// walLine encodes a record as a line of the log
+func walLine(rec walRecord) ([]byte, error) {
+	payload, err := json.Marshal(rec)
+	if err != nil {
+		return nil, err
+	}
+	line := make([]byte, 0, len(payload)+10)
+	line = append(line, walChecksum(payload)...)
+	line = append(line, ' ')
+	line = append(line, payload...)
+	line = append(line, '\n')
+	return line, nil
+}
+
+// sync flushes records written since the last sync, used when
+// WAL_SYNC_INTERVAL trades the last moments of writes for throughput
+func (w *WriteAheadLog) sync() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.failed != nil {
+		return w.failed
+	}
+	if !w.dirty {
+		return nil
+	}
+	w.dirty = false
+	if err := w.buf.Flush(); err != nil {
+		return w.fail(err)
+	}
+	if err := w.file.Sync(); err != nil {
+		return w.fail(err)
+	}
+	return nil
+}
+
+// compact writes a snapshot of every product, with its stock ledger, and
+// starts a new log that holds only the outbox messages not yet delivered.
+// Callers must hold store.mu so no write lands between the two.
+//
+// Both files are written under a temporary name, synced and renamed into
+// place, and the directory is synced after each rename, so a crash at any
+// point leaves a snapshot and a log that together hold every acknowledged
+// write and every pending message.
+func (w *WriteAheadLog) compact(products map[string]Product) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.failed != nil {
+		return w.failed
+	}
+	err := writeWALFile(w.snapshotPath(), func(buf *bufio.Writer) error {
+		enc := json.NewEncoder(buf)
+		for _, p := range products {
+			if err := enc.Encode(stockLedger.ledgered(p)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// The snapshot holds every product, so the new log starts with just the
+	// outbox messages it doesn't hold. Replaying the old log over the new
+	// snapshot after a crash right here ends in the same state.
+	var size int64
+	err = writeWALFile(w.walPath(), func(buf *bufio.Writer) error {
+		pending := outbox.pendingMessages()
+		if len(pending) == 0 {
+			return nil
+		}
+		line, err := walLine(walRecord{Op: walOutbox, Outbox: pending})
+		if err != nil {
+			return err
+		}
+		size = int64(len(line))
+		_, err = buf.Write(line)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	// Whatever the old log still buffered is in the snapshot
+	if w.file != nil {
+		w.file.Close()
+	}
+	file, err := os.OpenFile(w.walPath(), os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return w.fail(err)
+	}
+	w.file, w.buf, w.size, w.dirty = file, bufio.NewWriter(file), size, false
+	return nil
+}
+
+// writeWALFile replaces a file of the WAL directory with what write puts
+// in it: written to a temporary file, synced, renamed over the file, and
+// the directory synced so the rename survives a crash
+func writeWALFile(path string, write func(*bufio.Writer) error) error {
+	tmp := path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	buf := bufio.NewWriter(file)
+	err = write(buf)
+	if err == nil {
+		err = buf.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// syncDir makes the entries of a directory, such as a rename, durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// runWAL syncs the log on WAL_SYNC_INTERVAL, when set, and compacts it every
+// WAL_COMPACT_INTERVAL once it has grown past WAL_COMPACT_BYTES
+func (s *ProductStore) runWAL() {
+	w := s.wal
+	compactEvery := envDuration("WAL_COMPACT_INTERVAL", 10*time.Minute)
+	compactBytes := int64(envInt("WAL_COMPACT_BYTES", 16<<20))
+
+	var syncTick <-chan time.Time
+	if w.syncEvery > 0 {
+		ticker := time.NewTicker(w.syncEvery)
+		defer ticker.Stop()
+		syncTick = ticker.C
+	}
+	compactTicker := time.NewTicker(compactEvery)
+	defer compactTicker.Stop()
+
+	for {
+		select {
+		case <-syncTick:
+			if err := w.sync(); err != nil {
+				walDependency.observe(time.Now(), err)
+				log.Printf("wal: sync: %v", err)
+			}
+		case <-compactTicker.C:
+			w.mu.Lock()
+			size := w.size
+			w.mu.Unlock()
+			if size < compactBytes {
+				continue
+			}
+
+			start := time.Now()
+			s.mu.Lock()
+			err := w.compact(s.products)
+			s.mu.Unlock()
+			walDependency.observe(start, err)
+			if err != nil {
+				log.Printf("wal: compaction: %v", err)
+			}
+		}
+	}
+}
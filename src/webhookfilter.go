@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"slices"
+	"strconv"
+)
+
+// Webhook condition operators. changed compares a field with the product
+// before the write: on a create every field that's set has changed, on a
+// delete none has.
+var webhookOps = []string{"eq", "ne", "lt", "lte", "gt", "gte", "changed"}
+
+// WebhookCondition is a predicate on a field of the event's product, such
+// as {"field": "price", "op": "lt", "value": "20.00"}. Prices and other
+// amounts compare as numbers, whether given as strings or numbers.
+type WebhookCondition struct {
+	Field string `json:"field"`
+	Op    string `json:"op"`
+	Value any    `json:"value,omitempty"` // unused by changed
+}
+
+// validateWebhookFilters checks a webhook's tenant, category, condition
+// and transform settings and returns why they're invalid
+func validateWebhookFilters(w *Webhook) string {
+	for _, tenant := range w.Tenants {
+		if _, exists := tenantTokens[tenant]; tenant != "" && !exists {
+			return fmt.Sprintf("unknown tenant %q", tenant)
+		}
+	}
+	for _, category := range w.Categories {
+		if category == "" {
+			return "categories can't be empty"
+		}
+	}
+	for i, cond := range w.Where {
+		switch {
+		case !slices.Contains(productFieldNames, cond.Field):
+			return fmt.Sprintf("where[%d]: unknown field %q", i, cond.Field)
+		case !slices.Contains(webhookOps, cond.Op):
+			return fmt.Sprintf("where[%d]: op must be one of %v", i, webhookOps)
+		case cond.Op != "changed" && cond.Value == nil:
+			return fmt.Sprintf("where[%d]: value is required", i)
+		}
+		if _, numeric := webhookNumber(cond.Value); cond.Op != "eq" && cond.Op != "ne" && cond.Op != "changed" && !numeric {
+			return fmt.Sprintf("where[%d]: %s needs a number", i, cond.Op)
+		}
+	}
+	for _, field := range w.Fields {
+		if !slices.Contains(productFieldNames, field) {
+			return fmt.Sprintf("unknown field %q", field)
+		}
+	}
+	sentAs := make(map[string]bool, len(w.Rename))
+	for from, to := range w.Rename {
+		switch {
+		case !slices.Contains(productFieldNames, from):
+			return fmt.Sprintf("rename: unknown field %q", from)
+		case to == "":
+			return fmt.Sprintf("rename: %s needs a new name", from)
+		case slices.Contains(productFieldNames, to):
+			return fmt.Sprintf("rename: %q is already a product field", to)
+		case sentAs[to]:
+			return fmt.Sprintf("rename: two fields renamed to %q", to)
+		}
+		sentAs[to] = true
+	}
+	return ""
+}
+
+// matches reports whether an event passes the webhook's tenant, category
+// and condition filters, on top of its event types. Deletes and purges
+// are matched against the product as it was.
+func (w *Webhook) matches(e ProductEvent) bool {
+	if len(w.Tenants) > 0 && !slices.Contains(w.Tenants, e.Tenant) {
+		return false
+	}
+	if len(w.Categories) == 0 && len(w.Where) == 0 {
+		return true
+	}
+	current := e.Product
+	if current == nil {
+		current = e.Previous
+	}
+	if current == nil {
+		return false
+	}
+	if len(w.Categories) > 0 && !slices.Contains(w.Categories, current.Category) {
+		return false
+	}
+	if len(w.Where) == 0 {
+		return true
+	}
+	after := webhookFields(current)
+	var before map[string]any
+	if e.Previous != nil {
+		before = webhookFields(e.Previous)
+	}
+	for _, cond := range w.Where {
+		if !cond.holds(after[cond.Field], before[cond.Field], e.Product == nil) {
+			return false
+		}
+	}
+	return true
+}
+
+// holds evaluates a condition on a field's value after and before the
+// write
+func (cond WebhookCondition) holds(value, previous any, deleted bool) bool {
+	switch cond.Op {
+	case "changed":
+		return !deleted && !webhookEqual(value, previous)
+	case "eq":
+		return webhookEqual(value, cond.Value)
+	case "ne":
+		return !webhookEqual(value, cond.Value)
+	}
+	have, ok := webhookNumber(value)
+	want, wantOK := webhookNumber(cond.Value)
+	if !ok || !wantOK {
+		return false
+	}
+	switch cond.Op {
+	case "lt":
+		return have < want
+	case "lte":
+		return have <= want
+	case "gt":
+		return have > want
+	}
+	return have >= want
+}
+
+// webhookFields returns a product's fields by JSON name, as receivers see
+// them
+func webhookFields(p *Product) map[string]any {
+	data, _ := json.Marshal(p)
+	var fields map[string]any
+	json.Unmarshal(data, &fields)
+	return fields
+}
+
+// webhookNumber reads numbers and amounts written as strings
+func webhookNumber(v any) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case string:
+		f, err := strconv.ParseFloat(v, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+func webhookEqual(a, b any) bool {
+	if x, ok := webhookNumber(a); ok {
+		if y, ok := webhookNumber(b); ok {
+			return x == y
+		}
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// webhookPayload is an event message whose product went through the
+// webhook's transform
+type webhookPayload struct {
+	EventMessage
+	Product map[string]json.RawMessage `json:"product,omitempty"`
+}
+
+// payload encodes an event message for the webhook, keeping only its
+// fields, when set, and renaming them as it asks. The id is always kept,
+// under its own name unless renamed.
+func (w *Webhook) payload(msg EventMessage) ([]byte, error) {
+	if msg.Product == nil || len(w.Fields) == 0 && len(w.Rename) == 0 {
+		return json.Marshal(msg)
+	}
+	full, err := json.Marshal(msg.Product)
+	if err != nil {
+		return nil, err
+	}
+	var values map[string]json.RawMessage
+	if err := json.Unmarshal(full, &values); err != nil {
+		return nil, err
+	}
+	product := make(map[string]json.RawMessage, len(values))
+	for name, value := range values {
+		if len(w.Fields) > 0 && name != "id" && !slices.Contains(w.Fields, name) {
+			continue
+		}
+		if to, renamed := w.Rename[name]; renamed {
+			name = to
+		}
+		product[name] = value
+	}
+	return json.Marshal(webhookPayload{EventMessage: msg, Product: product})
+}
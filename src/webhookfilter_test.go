@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestWebhookMatches(t *testing.T) {
+	toy := &Product{ID: "laser", Category: "toys", Price: 450, Stock: 3}
+	cheaper := &Product{ID: "laser", Category: "toys", Price: 399, Stock: 3}
+	tree := &Product{ID: "tree", Category: "furniture", Price: 4999}
+	tests := []struct {
+		name    string
+		webhook Webhook
+		event   ProductEvent
+		want    bool
+	}{
+		{"no filters", Webhook{}, ProductEvent{Type: eventUpdated, Product: tree}, true},
+		{"default tenant", Webhook{Tenants: []string{""}}, ProductEvent{Type: eventUpdated, Product: tree}, true},
+		{"other tenant", Webhook{Tenants: []string{""}}, ProductEvent{Type: eventUpdated, Tenant: "acme", Product: tree}, false},
+		{"category", Webhook{Categories: []string{"toys"}}, ProductEvent{Type: eventUpdated, Product: toy}, true},
+		{"other category", Webhook{Categories: []string{"toys"}}, ProductEvent{Type: eventUpdated, Product: tree}, false},
+		{"deleted, by the product as it was", Webhook{Categories: []string{"toys"}}, ProductEvent{Type: eventPurged, Previous: toy}, true},
+		{"price changed", Webhook{Where: []WebhookCondition{{Field: "price", Op: "changed"}}}, ProductEvent{Type: eventUpdated, Product: cheaper, Previous: toy}, true},
+		{"price unchanged", Webhook{Where: []WebhookCondition{{Field: "price", Op: "changed"}}}, ProductEvent{Type: eventUpdated, Product: toy, Previous: toy}, false},
+		{"nothing changes on delete", Webhook{Where: []WebhookCondition{{Field: "price", Op: "changed"}}}, ProductEvent{Type: eventPurged, Previous: toy}, false},
+		{"amount below a number", Webhook{Where: []WebhookCondition{{Field: "price", Op: "lt", Value: 4.0}}}, ProductEvent{Type: eventUpdated, Product: cheaper}, true},
+		{"amount below a string", Webhook{Where: []WebhookCondition{{Field: "price", Op: "lt", Value: "4.00"}}}, ProductEvent{Type: eventUpdated, Product: toy}, false},
+		{"eq on a string", Webhook{Where: []WebhookCondition{{Field: "id", Op: "eq", Value: "laser"}}}, ProductEvent{Type: eventUpdated, Product: toy}, true},
+		{"all conditions hold", Webhook{Where: []WebhookCondition{{Field: "stock", Op: "gte", Value: 3.0}, {Field: "price", Op: "gt", Value: 10.0}}}, ProductEvent{Type: eventUpdated, Product: toy}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if msg := validateWebhookFilters(&tt.webhook); msg != "" {
+				t.Fatalf("invalid webhook: %s", msg)
+			}
+			if got := tt.webhook.matches(tt.event); got != tt.want {
+				t.Errorf("matches = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateWebhookFilters(t *testing.T) {
+	tests := []struct {
+		name    string
+		webhook Webhook
+	}{
+		{"unknown tenant", Webhook{Tenants: []string{"acme"}}},
+		{"unknown condition field", Webhook{Where: []WebhookCondition{{Field: "colour", Op: "eq", Value: "red"}}}},
+		{"unknown op", Webhook{Where: []WebhookCondition{{Field: "price", Op: "like", Value: "1"}}}},
+		{"missing value", Webhook{Where: []WebhookCondition{{Field: "price", Op: "eq"}}}},
+		{"ordering a string", Webhook{Where: []WebhookCondition{{Field: "name", Op: "lt", Value: "cat"}}}},
+		{"unknown field", Webhook{Fields: []string{"colour"}}},
+		{"rename to a product field", Webhook{Rename: map[string]string{"price": "name"}}},
+		{"rename to nothing", Webhook{Rename: map[string]string{"price": ""}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if msg := validateWebhookFilters(&tt.webhook); msg == "" {
+				t.Error("accepted")
+			}
+		})
+	}
+}
+
+func TestWebhookPayload(t *testing.T) {
+	w := Webhook{Fields: []string{"price"}, Rename: map[string]string{"id": "sku_ref", "price": "amount"}}
+	body, err := w.payload(EventMessage{ID: "laser:2:updated", Type: eventUpdated, ProductID: "laser", Product: &Product{ID: "laser", Name: "Laser", Price: 450}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got struct {
+		ID      string         `json:"id"`
+		Product map[string]any `json:"product"`
+	}
+	if err := json.Unmarshal(body, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != "laser:2:updated" {
+		t.Errorf("message id = %q", got.ID)
+	}
+	want := map[string]any{"sku_ref": "laser", "amount": "4.50"}
+	if len(got.Product) != len(want) || got.Product["sku_ref"] != want["sku_ref"] || got.Product["amount"] != want["amount"] {
+		t.Errorf("product = %v, want %v", got.Product, want)
+	}
+}
@@ -0,0 +1,417 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Webhook limits
+const (
+	maxWebhooks          = 100
+	maxWebhookDeliveries = 100 // kept per webhook, for the delivery log
+	minWebhookSecret     = 16
+)
+
+// webhookQueueSize bounds each webhook's queue, like EVENT_QUEUE_SIZE for
+// destinations
+var webhookQueueSize = envInt("EVENT_QUEUE_SIZE", 1000)
+
+// webhookDeliveryRetention is how long finished deliveries stay in the
+// delivery log, WEBHOOK_DELIVERY_RETENTION_DAYS; each log is also capped
+// at maxWebhookDeliveries
+var webhookDeliveryRetention = time.Duration(envInt("WEBHOOK_DELIVERY_RETENTION_DAYS", 7)) * 24 * time.Hour
+
+// webhookMaxAttempts is how often a delivery is tried before it fails,
+// WEBHOOK_MAX_ATTEMPTS
+var webhookMaxAttempts = envInt("WEBHOOK_MAX_ATTEMPTS", 8)
+
+// Webhook delivery statuses
+const (
+	webhookPending   = "pending"
+	webhookSucceeded = "succeeded"
+	webhookFailed    = "failed"
+)
+
+// Webhook is an integrator's subscription to product events, POSTed to
+// URL as EventMessage JSON. Each delivery is signed with the secret in
+// X-Webhook-Signature, "t=<unix time>,v1=<hex HMAC-SHA256 of t.body>",
+// so receivers can check it came from us and isn't a replay. Like
+// at-least-once destinations, a failed delivery is retried with backoff
+// before the next event is sent, up to WEBHOOK_MAX_ATTEMPTS times.
+//
+// Tenants, Categories and Where narrow the events down further, and
+// Fields and Rename reshape the product sent; see webhookfilter.go.
+type Webhook struct {
+	ID         string             `json:"id"`
+	URL        string             `json:"url" binding:"required"`
+	Events     []string           `json:"events,omitempty"`     // event types, all when empty; stock for any stock change
+	Tenants    []string           `json:"tenants,omitempty"`    // products of these tenants, "" for the default one; all when empty
+	Categories []string           `json:"categories,omitempty"` // products in one of these, all when empty
+	Where      []WebhookCondition `json:"where,omitempty"`      // all must hold
+	Fields     []string           `json:"fields,omitempty"`     // product fields sent, all when empty
+	Rename     map[string]string  `json:"rename,omitempty"`     // product fields sent under another name
+	Secret     string             `json:"secret,omitempty"`     // only shown when created
+	CreatedAt  time.Time          `json:"created_at"`
+}
+
+// subscription is a registered webhook with its queue and delivery log
+type subscription struct {
+	Webhook
+	queue      chan EventMessage
+	mu         sync.Mutex
+	deliveries []WebhookDelivery // oldest first
+}
+
+// WebhookDelivery is one event sent, or being sent, to a webhook
+type WebhookDelivery struct {
+	ID            string     `json:"id"` // the event message ID
+	Type          string     `json:"type"`
+	Tenant        string     `json:"tenant,omitempty"`
+	ProductID     string     `json:"product_id"`
+	Status        string     `json:"status"`
+	Attempts      int        `json:"attempts"`
+	StatusCode    int        `json:"status_code,omitempty"` // of the last attempt
+	Error         string     `json:"error,omitempty"`
+	Response      string     `json:"response,omitempty"` // start of the last response body
+	CreatedAt     time.Time  `json:"created_at"`
+	LastAttemptAt *time.Time `json:"last_attempt_at,omitempty"`
+	NextAttemptAt *time.Time `json:"next_attempt_at,omitempty"`
+}
+
+// WebhookStore keeps our in-memory webhooks, each with its own queue and
+// sender like event destinations
+type WebhookStore struct {
+	mu       sync.RWMutex
+	seq      int64
+	webhooks map[string]*subscription
+	http     *http.Client
+}
+
+// Global webhook store
+var webhooks = &WebhookStore{
+	webhooks: make(map[string]*subscription),
+	http:     newPooledClient("webhooks", 10*time.Second),
+}
+
+// enqueue queues an event for the webhooks that want it. Callers hold
+// store.mu, which keeps queues in write order.
+func (s *WebhookStore) enqueue(e ProductEvent) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if len(s.webhooks) == 0 {
+		return
+	}
+	msg := newEventMessage(e)
+	for _, w := range s.webhooks {
+		if !wantsEvent(w.Events, e) || !w.matches(e) {
+			continue
+		}
+		// Logged before the sender can pick it up and log the outcome
+		d := WebhookDelivery{ID: msg.ID, Type: msg.Type, Tenant: msg.Tenant, ProductID: msg.ProductID, Status: webhookPending, CreatedAt: msg.At}
+		w.record(d)
+		select {
+		case w.queue <- msg:
+		default:
+			d.Status, d.Error = webhookFailed, "queue full"
+			w.record(d)
+			eventDeliveries.Add("webhook."+w.ID+".dropped", 1)
+			log.Printf("event %s for webhook %s dropped, queue full", msg.ID, w.ID)
+		}
+	}
+}
+
+// record adds a delivery to the log, or updates it
+func (w *subscription) record(d WebhookDelivery) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for i := len(w.deliveries) - 1; i >= 0; i-- {
+		if w.deliveries[i].ID == d.ID {
+			w.deliveries[i] = d
+			return
+		}
+	}
+	w.deliveries = append(w.deliveries, d)
+	if len(w.deliveries) > maxWebhookDeliveries {
+		w.deliveries = slices.Delete(w.deliveries, 0, len(w.deliveries)-maxWebhookDeliveries)
+	}
+}
+
+// purgeDeliveriesBefore drops finished deliveries created before the
+// cutoff from every webhook's log. Pending ones stay until they finish.
+func (s *WebhookStore) purgeDeliveriesBefore(cutoff time.Time, dryRun bool) int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	purged := 0
+	for _, w := range s.webhooks {
+		w.mu.Lock()
+		expired := func(d WebhookDelivery) bool {
+			return d.Status != webhookPending && d.CreatedAt.Before(cutoff)
+		}
+		for _, d := range w.deliveries {
+			if expired(d) {
+				purged++
+			}
+		}
+		if !dryRun {
+			w.deliveries = slices.DeleteFunc(w.deliveries, expired)
+		}
+		w.mu.Unlock()
+	}
+	return purged
+}
+
+// send delivers a webhook's queue in order until the webhook is deleted
+func (s *WebhookStore) send(w *subscription) {
+	for msg := range w.queue {
+		d := WebhookDelivery{ID: msg.ID, Type: msg.Type, Tenant: msg.Tenant, ProductID: msg.ProductID, CreatedAt: msg.At}
+		backoff := deliveryBackoff
+		for {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			err := s.deliver(ctx, w, msg, &d)
+			cancel()
+			now := time.Now().UTC()
+			d.Attempts++
+			d.LastAttemptAt, d.NextAttemptAt = &now, nil
+			if err == nil {
+				d.Status, d.Error = webhookSucceeded, ""
+				eventDeliveries.Add("webhook."+w.ID+".sent", 1)
+				w.record(d)
+				break
+			}
+			d.Error = err.Error()
+			if d.Attempts >= webhookMaxAttempts {
+				d.Status = webhookFailed
+				eventDeliveries.Add("webhook."+w.ID+".failed", 1)
+				log.Printf("event %s to webhook %s failed after %d attempts: %v", msg.ID, w.ID, d.Attempts, err)
+				w.record(d)
+				break
+			}
+			next := now.Add(backoff)
+			d.Status, d.NextAttemptAt = webhookPending, &next
+			eventDeliveries.Add("webhook."+w.ID+".retried", 1)
+			w.record(d)
+			time.Sleep(backoff)
+			backoff = min(backoff*2, deliveryMaxBackoff)
+		}
+	}
+}
+
+// deliver makes one signed attempt at sending a message, noting the
+// response on the delivery
+func (s *WebhookStore) deliver(ctx context.Context, w *subscription, msg EventMessage, d *WebhookDelivery) (err error) {
+	start := time.Now()
+	defer func() { webhooksDependency.observe(start, err) }()
+
+	body, err := w.payload(msg)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Idempotency-Key", msg.ID)
+	req.Header.Set("X-Webhook-Id", w.ID)
+	req.Header.Set("X-Webhook-Signature", webhookSignature(w.Secret, start, body))
+
+	d.StatusCode, d.Response = 0, ""
+	resp, err := s.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	snippet, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	d.StatusCode, d.Response = resp.StatusCode, string(snippet)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook %s: %s", w.ID, resp.Status)
+	}
+	return nil
+}
+
+// webhookSignature signs a body sent at a time
+func webhookSignature(secret string, at time.Time, body []byte) string {
+	t := strconv.FormatInt(at.Unix(), 10)
+	return "t=" + t + ",v1=" + hex.EncodeToString(hmacSHA256([]byte(secret), t+"."+string(body)))
+}
+
+// validateWebhook checks a new webhook and returns why it's invalid
+func validateWebhook(w *Webhook) string {
+	if u, err := url.Parse(w.URL); err != nil || u.Scheme != "https" && u.Scheme != "http" || u.Host == "" {
+		return "url must be an http or https URL"
+	}
+	for _, event := range w.Events {
+		if !slices.Contains(subscribableEvents, event) {
+			return fmt.Sprintf("unknown event %q", event)
+		}
+	}
+	if w.Secret != "" && len(w.Secret) < minWebhookSecret {
+		return fmt.Sprintf("secret must be at least %d characters", minWebhookSecret)
+	}
+	return validateWebhookFilters(w)
+}
+
+// view returns the webhook without its secret
+func (w *subscription) view() Webhook {
+	view := w.Webhook
+	view.Secret = ""
+	return view
+}
+
+func webhookNotFound(c *gin.Context, id string) {
+	c.JSON(http.StatusNotFound, gin.H{
+		"error": "Webhook not found",
+		"id":    id,
+	})
+}
+
+// getWebhooks lists the webhooks, without their secrets
+// Returns: 200 OK - Success
+func getWebhooks(c *gin.Context) {
+	webhooks.mu.RLock()
+	list := make([]Webhook, 0, len(webhooks.webhooks))
+	for _, w := range webhooks.webhooks {
+		list = append(list, w.view())
+	}
+	webhooks.mu.RUnlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+
+	c.JSON(http.StatusOK, gin.H{
+		"count":    len(list),
+		"webhooks": list,
+	})
+}
+
+// getWebhook returns a webhook, without its secret
+// Returns: 200 OK - Success
+// Returns: 404 Not Found - Webhook doesn't exist
+func getWebhook(c *gin.Context) {
+	id := c.Param("id")
+
+	webhooks.mu.RLock()
+	w, exists := webhooks.webhooks[id]
+	webhooks.mu.RUnlock()
+	if !exists {
+		webhookNotFound(c, id)
+		return
+	}
+	c.JSON(http.StatusOK, w.view())
+}
+
+// createWebhook subscribes a URL to product events. Without a secret one
+// is generated; either way this is the only response that shows it.
+// Returns: 201 Created - Success (Cat ringing the doorbell!)
+// Returns: 400 Bad Request - Invalid webhook
+// Returns: 409 Conflict - Too many webhooks
+func createWebhook(c *gin.Context) {
+	var w Webhook
+	if err := c.ShouldBindJSON(&w); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":   "Invalid webhook",
+			"details": err.Error(),
+		})
+		return
+	}
+	if msg := validateWebhook(&w); msg != "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":   "Invalid webhook",
+			"details": msg,
+		})
+		return
+	}
+	if w.Secret == "" {
+		secret := make([]byte, 24)
+		rand.Read(secret)
+		w.Secret = "whsec_" + hex.EncodeToString(secret)
+	}
+
+	webhooks.mu.Lock()
+	defer webhooks.mu.Unlock()
+
+	if len(webhooks.webhooks) >= maxWebhooks {
+		c.JSON(http.StatusConflict, gin.H{
+			"error": fmt.Sprintf("At most %d webhooks can be registered", maxWebhooks),
+		})
+		return
+	}
+	webhooks.seq++
+	w.ID = strconv.FormatInt(webhooks.seq, 10)
+	w.CreatedAt = time.Now().UTC()
+	sub := &subscription{Webhook: w, queue: make(chan EventMessage, webhookQueueSize)}
+	webhooks.webhooks[w.ID] = sub
+	go webhooks.send(sub)
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message": "Webhook created successfully",
+		"webhook": w,
+	})
+}
+
+// deleteWebhook unsubscribes a webhook. Events already queued for it are
+// still sent.
+// Returns: 204 No Content - Success
+// Returns: 404 Not Found - Webhook doesn't exist
+func deleteWebhook(c *gin.Context) {
+	id := c.Param("id")
+
+	webhooks.mu.Lock()
+	defer webhooks.mu.Unlock()
+
+	w, exists := webhooks.webhooks[id]
+	if !exists {
+		webhookNotFound(c, id)
+		return
+	}
+	delete(webhooks.webhooks, id)
+	close(w.queue)
+
+	c.Status(http.StatusNoContent)
+}
+
+// getWebhookDeliveries lists a webhook's most recent deliveries, newest
+// first, to debug failing ones. ?status= narrows it down.
+// Returns: 200 OK - Success
+// Returns: 404 Not Found - Webhook doesn't exist
+func getWebhookDeliveries(c *gin.Context) {
+	id := c.Param("id")
+	status := c.Query("status")
+
+	webhooks.mu.RLock()
+	w, exists := webhooks.webhooks[id]
+	webhooks.mu.RUnlock()
+	if !exists {
+		webhookNotFound(c, id)
+		return
+	}
+
+	w.mu.Lock()
+	list := make([]WebhookDelivery, 0, len(w.deliveries))
+	for i := len(w.deliveries) - 1; i >= 0; i-- {
+		if status == "" || w.deliveries[i].Status == status {
+			list = append(list, w.deliveries[i])
+		}
+	}
+	w.mu.Unlock()
+
+	c.JSON(http.StatusOK, gin.H{
+		"count":      len(list),
+		"deliveries": list,
+	})
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// yamlToJSON converts the block YAML of seed fixtures to JSON, so it can
+// be decoded like any other body. It covers what fixtures need:
+// mappings, sequences, plain, quoted and | or > block scalars, comments,
+// and JSON-style flow values such as [a, b] written as ["a", "b"]. Anchors,
+// tags and multiple documents aren't supported.
+func yamlToJSON(data []byte) ([]byte, error) {
+	p := &yamlParser{}
+	for i, text := range strings.Split(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n") {
+		content := strings.TrimLeft(text, " ")
+		if strings.HasPrefix(content, "\t") {
+			return nil, fmt.Errorf("line %d: tabs can't indent YAML", i+1)
+		}
+		p.lines = append(p.lines, yamlLine{n: i + 1, indent: len(text) - len(content), text: strings.TrimRight(content, " ")})
+	}
+
+	p.skipBlank()
+	if p.pos < len(p.lines) && p.lines[p.pos].text == "---" {
+		p.pos++
+		p.skipBlank()
+	}
+	if p.pos == len(p.lines) {
+		return []byte("null"), nil
+	}
+	v, err := p.block(p.lines[p.pos].indent)
+	if err != nil {
+		return nil, err
+	}
+	if p.skipBlank(); p.pos < len(p.lines) {
+		return nil, fmt.Errorf("line %d: unexpected indentation", p.lines[p.pos].n)
+	}
+	return json.Marshal(v)
+}
+
+type yamlLine struct {
+	n      int
+	indent int
+	text   string
+}
+
+type yamlParser struct {
+	lines []yamlLine
+	pos   int
+}
+
+// skipBlank moves past empty and comment lines
+func (p *yamlParser) skipBlank() {
+	for p.pos < len(p.lines) {
+		if t := stripYAMLComment(p.lines[p.pos].text); t != "" {
+			return
+		}
+		p.pos++
+	}
+}
+
+// block parses the mapping or sequence starting at the current line
+func (p *yamlParser) block(indent int) (any, error) {
+	if t := p.lines[p.pos].text; t == "-" || strings.HasPrefix(t, "- ") {
+		return p.sequence(indent)
+	}
+	return p.mapping(indent)
+}
+
+func (p *yamlParser) sequence(indent int) (any, error) {
+	items := []any{}
+	for p.skipBlank(); p.pos < len(p.lines); p.skipBlank() {
+		line := p.lines[p.pos]
+		if line.indent < indent {
+			break
+		}
+		text := stripYAMLComment(line.text)
+		if line.indent == indent && text != "-" && !strings.HasPrefix(text, "- ") {
+			// The next key of the mapping a sequence sits under
+			break
+		}
+		if line.indent > indent {
+			return nil, fmt.Errorf("line %d: expected a sequence item", line.n)
+		}
+
+		rest := strings.TrimLeft(strings.TrimPrefix(text, "-"), " ")
+		switch {
+		case rest == "":
+			p.pos++
+			item, err := p.nested(indent)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+		case isYAMLKey(rest):
+			// "- key: value" starts a mapping indented past the dash
+			inner := line.indent + len(text) - len(rest)
+			p.lines[p.pos] = yamlLine{n: line.n, indent: inner, text: rest}
+			item, err := p.mapping(inner)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+		default:
+			p.pos++
+			item, err := p.scalar(rest, line)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+		}
+	}
+	return items, nil
+}
+
+func (p *yamlParser) mapping(indent int) (any, error) {
+	m := map[string]any{}
+	for p.skipBlank(); p.pos < len(p.lines); p.skipBlank() {
+		line := p.lines[p.pos]
+		if line.indent < indent {
+			break
+		}
+		text := stripYAMLComment(line.text)
+		if line.indent > indent || !isYAMLKey(text) {
+			return nil, fmt.Errorf("line %d: expected key: value", line.n)
+		}
+
+		key, rest := splitYAMLKey(text)
+		if _, exists := m[key]; exists {
+			return nil, fmt.Errorf("line %d: duplicate key %q", line.n, key)
+		}
+		p.pos++
+		var err error
+		if rest == "" {
+			m[key], err = p.nested(indent)
+		} else {
+			m[key], err = p.scalar(rest, line)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// nested parses the value of a key or dash with nothing after it: a block
+// indented further, a sequence at the same indentation under a key, or null
+func (p *yamlParser) nested(indent int) (any, error) {
+	p.skipBlank()
+	if p.pos == len(p.lines) {
+		return nil, nil
+	}
+	next := p.lines[p.pos]
+	text := stripYAMLComment(next.text)
+	switch {
+	case next.indent > indent:
+		return p.block(next.indent)
+	case next.indent == indent && (text == "-" || strings.HasPrefix(text, "- ")):
+		return p.sequence(indent)
+	}
+	return nil, nil
+}
+
+// scalar parses a value written after a key or dash
+func (p *yamlParser) scalar(text string, line yamlLine) (any, error) {
+	switch {
+	case text == "|" || text == ">" || text == "|-" || text == ">-":
+		return p.blockScalar(text, line.indent), nil
+	case strings.HasPrefix(text, "[") || strings.HasPrefix(text, "{"):
+		var v any
+		dec := json.NewDecoder(strings.NewReader(text))
+		dec.UseNumber()
+		if err := dec.Decode(&v); err != nil {
+			return nil, fmt.Errorf("line %d: flow values must be JSON: %v", line.n, err)
+		}
+		return v, nil
+	case strings.HasPrefix(text, `"`):
+		s, err := strconv.Unquote(text)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid quoted string", line.n)
+		}
+		return s, nil
+	case strings.HasPrefix(text, "'"):
+		if len(text) < 2 || !strings.HasSuffix(text, "'") {
+			return nil, fmt.Errorf("line %d: invalid quoted string", line.n)
+		}
+		return strings.ReplaceAll(text[1:len(text)-1], "''", "'"), nil
+	}
+
+	switch text {
+	case "null", "~":
+		return nil, nil
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	}
+	if _, err := strconv.ParseFloat(text, 64); err == nil {
+		return json.Number(text), nil
+	}
+	return text, nil
+}
+
+// blockScalar reads the lines of a | (literal) or > (folded) string
+func (p *yamlParser) blockScalar(style string, parent int) string {
+	var lines []string
+	indent := -1
+	for ; p.pos < len(p.lines); p.pos++ {
+		line := p.lines[p.pos]
+		if line.text == "" {
+			lines = append(lines, "")
+			continue
+		}
+		if line.indent <= parent {
+			break
+		}
+		if indent < 0 {
+			indent = line.indent
+		}
+		lines = append(lines, strings.Repeat(" ", max(line.indent-indent, 0))+line.text)
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+
+	s := strings.Join(lines, "\n")
+	if strings.HasPrefix(style, ">") {
+		s = strings.ReplaceAll(s, "\n", " ")
+	}
+	if !strings.HasSuffix(style, "-") {
+		s += "\n"
+	}
+	return s
+}
+
+// isYAMLKey reports whether text starts with "key:"
+func isYAMLKey(text string) bool {
+	if strings.HasPrefix(text, `"`) || strings.HasPrefix(text, "'") || strings.HasPrefix(text, "[") || strings.HasPrefix(text, "{") {
+		return false
+	}
+	key, _, ok := strings.Cut(text, ":")
+	return ok && key != "" && (len(text) == len(key)+1 || text[len(key)+1] == ' ')
+}
+
+func splitYAMLKey(text string) (key, rest string) {
+	key, rest, _ = strings.Cut(text, ":")
+	return strings.TrimSpace(key), strings.TrimSpace(rest)
+}
+
+// stripYAMLComment drops a # comment outside quotes
+func stripYAMLComment(text string) string {
+	var quote rune
+	for i, r := range text {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '"' || r == '\'':
+			quote = r
+		case r == '#' && (i == 0 || text[i-1] == ' '):
+			return strings.TrimRight(text[:i], " ")
+		}
+	}
+	return text
+}
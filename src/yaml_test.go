@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestYAMLToJSON(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+		want string
+	}{
+		{"empty", "", `null`},
+		{"comments only", "# nothing\n\n", `null`},
+		{"mapping", "id: laser\nprice: 4.50\nstock: 3", `{"id":"laser","price":4.50,"stock":3}`},
+		{"document start", "---\nid: laser", `{"id":"laser"}`},
+		{"scalars", "a: true\nb: false\nc: null\nd: ~\ne: -1e3\nf: 007x", `{"a":true,"b":false,"c":null,"d":null,"e":-1e3,"f":"007x"}`},
+		{"quoted", `a: "4.50"` + "\nb: 'it''s'\nc: \"tab\\t\"", `{"a":"4.50","b":"it's","c":"tab\t"}`},
+		{"comments", "# products\nid: laser # the red one\nname: \"#1 laser\"\nurl: a#b", `{"id":"laser","name":"#1 laser","url":"a#b"}`},
+		{"nested mapping", "product:\n  id: laser\n  dims:\n    w: 1", `{"product":{"dims":{"w":1},"id":"laser"}}`},
+		{"sequence", "- a\n- 2\n-\n  - b", `["a",2,["b"]]`},
+		{"sequence under a key", "images:\n- a.jpg\n- b.jpg\nid: laser", `{"id":"laser","images":["a.jpg","b.jpg"]}`},
+		{"sequence of mappings", "products:\n  - id: a\n    stock: 1\n  - id: b", `{"products":[{"id":"a","stock":1},{"id":"b"}]}`},
+		{"empty value", "a:\nb: 1", `{"a":null,"b":1}`},
+		{"flow values", `tags: ["a", "b"]` + "\nattrs: {\"colour\": \"red\"}", `{"attrs":{"colour":"red"},"tags":["a","b"]}`},
+		{"literal block", "d: |\n  one\n    two\n\n  three\nn: 1", `{"d":"one\n  two\n\nthree\n","n":1}`},
+		{"folded block", "d: >-\n  one\n  two\n", `{"d":"one two"}`},
+		{"CRLF", "id: laser\r\nstock: 3\r\n", `{"id":"laser","stock":3}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := yamlToJSON([]byte(tt.yaml))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !jsonEqual(t, got, []byte(tt.want)) {
+				t.Errorf("yamlToJSON = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestYAMLToJSONErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+		line string
+	}{
+		{"tab indentation", "a:\n\tb: 1", "line 2"},
+		{"duplicate key", "id: a\nid: b", "line 2"},
+		{"bad indentation", "a: 1\n  b: 2", "line 2"},
+		{"item in a mapping", "a: 1\n- b", "line 2"},
+		{"key in a sequence", "- a\nb: 1", "line 2"},
+		{"flow value that isn't JSON", "tags: [a, b]", "line 1"},
+		{"unterminated quote", `name: "laser`, "line 1"},
+		{"unterminated single quote", "name: 'laser", "line 1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := yamlToJSON([]byte(tt.yaml))
+			if err == nil || !strings.HasPrefix(err.Error(), tt.line+":") {
+				t.Errorf("err = %v, want one on %s", err, tt.line)
+			}
+		})
+	}
+}
+
+// jsonEqual compares two JSON documents by value, keeping numbers as
+// written
+func jsonEqual(t *testing.T, a, b []byte) bool {
+	t.Helper()
+	normalize := func(data []byte) string {
+		var v any
+		dec := json.NewDecoder(strings.NewReader(string(data)))
+		dec.UseNumber()
+		if err := dec.Decode(&v); err != nil {
+			t.Fatalf("invalid JSON %s: %v", data, err)
+		}
+		out, _ := json.Marshal(v)
+		return string(out)
+	}
+	return normalize(a) == normalize(b)
+}